@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+var (
+	// accessPointARN matches access point ARNs, capturing the partition,
+	// region, account and name. Multi-region access points have no region.
+	accessPointARN = regexp.MustCompile(`^arn:([a-z-]+):s3:([a-z0-9-]*):([0-9]+):accesspoint/([a-zA-Z0-9.-]+)$`)
+)
+
+// errMultiRegionAccessPoint is returned for multi-region access points, which
+// need SigV4A signing that the AWS SDK doesn't support
+var errMultiRegionAccessPoint = fmt.Errorf("multi-region access points are not supported (they require SigV4A signing)")
+
+// accessPoint is a single-region S3 access point
+type accessPoint struct {
+	partition string
+	region    string
+	account   string
+	name      string
+}
+
+// parseAccessPoint parses bucket if it's an access point ARN. It returns nil
+// for regular bucket names.
+func parseAccessPoint(bucket string) (*accessPoint, error) {
+	if !strings.HasPrefix(bucket, "arn:") {
+		return nil, nil
+	}
+
+	match := accessPointARN.FindStringSubmatch(bucket)
+	if match == nil {
+		return nil, fmt.Errorf("invalid access point ARN %q", bucket)
+	}
+	if match[2] == "" {
+		return nil, errMultiRegionAccessPoint
+	}
+
+	partition, err := regionPartition(match[2])
+	if err != nil {
+		return nil, err
+	}
+	if partition != match[1] {
+		return nil, fmt.Errorf("region %s of access point %q isn't in partition %s", match[2], bucket, match[1])
+	}
+
+	return &accessPoint{partition: match[1], region: match[2], account: match[3], name: match[4]}, nil
+}
+
+// accessPointName returns the name of the access point if bucket is an access
+// point ARN, or bucket itself otherwise. Destination policies apply to it.
+func accessPointName(bucket string) string {
+	if ap, err := parseAccessPoint(bucket); err == nil && ap != nil {
+		return ap.name
+	}
+	return bucket
+}
+
+// endpoint returns the access point endpoint without the `<name>-<account>`
+// host prefix, which the SDK adds in place of the bucket name
+func (ap *accessPoint) endpoint(dualstack bool) string {
+	domain := "amazonaws.com"
+	if ap.partition == "aws-cn" {
+		domain = "amazonaws.com.cn"
+	}
+
+	host := "s3-accesspoint."
+	if dualstack {
+		host += "dualstack."
+	}
+
+	return "https://" + host + ap.region + "." + domain
+}
+
+// hostPrefix is the part of the access point host which precedes the endpoint
+func (ap *accessPoint) hostPrefix() string {
+	return ap.name + "-" + ap.account
+}
+
+// useAccessPoint is a request handler which replaces the access point ARN in
+// the Bucket parameter with the access point host prefix, so the SDK
+// addresses the access point endpoint in virtual-hosted style. It runs on
+// the SDK's copy of the input.
+func (ap *accessPoint) useAccessPoint(r *aws.Request) {
+	params := reflect.ValueOf(r.Params)
+	if params.Kind() != reflect.Ptr || params.Elem().Kind() != reflect.Struct {
+		return
+	}
+
+	field := params.Elem().FieldByName("Bucket")
+	if field.IsValid() && field.CanSet() && field.Type() == reflect.TypeOf((*string)(nil)) {
+		field.Set(reflect.ValueOf(aws.String(ap.hostPrefix())))
+	}
+}
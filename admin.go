@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// AdminUploadersPath is the admin endpoint for the uploader cache
+const AdminUploadersPath = "/admin/uploaders"
+
+// uploaderInfo describes a cached uploader in the admin API
+type uploaderInfo struct {
+	Bucket     string    `json:"bucket"`
+	Region     string    `json:"region"`
+	Endpoint   string    `json:"endpoint"`
+	CreatedAt  time.Time `json:"created_at"`
+	AgeSeconds int64     `json:"age_seconds"`
+	Hits       int64     `json:"hits"`
+	// ExpectedOwner and OwnerCheck are only set for buckets with an expected owner
+	ExpectedOwner string `json:"expected_owner,omitempty"`
+	OwnerCheck    string `json:"owner_check,omitempty"`
+	// Profile is the named AWS profile of the uploader, if any
+	Profile string `json:"profile,omitempty"`
+}
+
+// adminRoutes sets up the handlers served on the admin port
+func (d *Deflator) adminRoutes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(AdminUploadersPath, d.uploadersHandler)
+	mux.HandleFunc(AdminUploadersPath+"/", d.uploadersHandler)
+	mux.HandleFunc(AdminRestorePath, d.restoreHandler)
+	mux.HandleFunc(AdminUsagePath, d.usageHandler)
+	mux.HandleFunc(AdminPrincipalsPath, d.principalsHandler)
+	mux.HandleFunc(AdminFailuresPath, d.failuresHandler)
+	mux.HandleFunc(AdminFailuresPath+"/", d.failuresHandler)
+	mux.HandleFunc(AdminMaintenancePath, d.maintenanceHandler)
+
+	return mux
+}
+
+// isAdminAuthorized checks the bearer token of admin requests. Mutating
+// admin endpoints are disabled when no AdminToken is configured.
+func (d *Deflator) isAdminAuthorized(r *http.Request) bool {
+	if d.config.AdminToken == "" {
+		return false
+	}
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(d.config.AdminToken)) == 1
+}
+
+// uploadersHandler lists the cached uploaders (GET) or evicts them (DELETE)
+// so the next request re-resolves the bucket region
+func (d *Deflator) uploadersHandler(w http.ResponseWriter, r *http.Request) {
+	bucket := strings.Trim(strings.TrimPrefix(r.URL.Path, AdminUploadersPath), "/")
+
+	switch {
+	case r.Method == http.MethodGet && bucket == "":
+		d.listUploaders(w)
+	case r.Method == http.MethodDelete:
+		if !d.isAdminAuthorized(r) {
+			writeError(w, r, newRequestError(http.StatusForbidden, ErrorCodeForbidden, "Forbidden"))
+			return
+		}
+		d.evictUploaders(w, r, bucket)
+	default:
+		writeError(w, r, newRequestError(http.StatusMethodNotAllowed, ErrorCodeMethodNotAllowed, "Method not allowed"))
+	}
+}
+
+func (d *Deflator) listUploaders(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(uploaderCacheInfo())
+}
+
+// uploaderCacheInfo describes the cached uploaders, sorted by bucket
+func uploaderCacheInfo() []uploaderInfo {
+	now := time.Now()
+	uploaders := []uploaderInfo{}
+
+	// Peek doesn't update the recency of the entries
+	for _, key := range uploaderCache.Keys() {
+		value, ok := uploaderCache.Peek(key)
+		if !ok {
+			continue
+		}
+		entry := value.(*uploaderCacheEntry)
+
+		uploaders = append(uploaders, uploaderInfo{
+			Bucket:     key.(string),
+			Region:     entry.region,
+			Endpoint:   entry.endpoint,
+			CreatedAt:  entry.created.UTC(),
+			AgeSeconds: int64(now.Sub(entry.created) / time.Second),
+			Hits:       atomic.LoadInt64(&entry.hits),
+
+			ExpectedOwner: entry.expectedOwner,
+			OwnerCheck:    entry.ownerCheck,
+			Profile:       entry.profile,
+		})
+	}
+
+	sort.Slice(uploaders, func(i, j int) bool { return uploaders[i].Bucket < uploaders[j].Bucket })
+
+	return uploaders
+}
+
+// evictUploaders removes the uploader for bucket from the cache, or all of
+// them if bucket is empty
+func (d *Deflator) evictUploaders(w http.ResponseWriter, r *http.Request, bucket string) {
+	if bucket == "" {
+		count := uploaderCache.Len()
+		uploaderCache.Purge()
+		log.Infof("Flushed the uploader cache (%d entries)", count)
+		audit("uploader_cache_flush", log.Fields{"entries": count, "client_ip": d.clientIP(r)})
+	} else {
+		if !uploaderCache.Contains(bucket) {
+			writeError(w, r, newRequestError(http.StatusNotFound, ErrorCodeNotFound, "Not found"))
+			return
+		}
+		uploaderCache.Remove(bucket)
+		log.Infof("Evicted the uploader for bucket %q", bucket)
+		audit("uploader_cache_evict", log.Fields{"bucket": bucket, "client_ip": d.clientIP(r)})
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
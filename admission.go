@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Admission lanes: uploads smaller than AdmissionSmallUploadSize go to the
+	// priority lane, the others to the normal one
+	LanePriority = "priority"
+	LaneNormal   = "normal"
+)
+
+var (
+	// admissionStats has, per lane, the gauges of the queued and admitted
+	// uploads, the accumulated queue wait in milliseconds and the number of
+	// shed uploads
+	admissionStats = expvar.NewMap("admission")
+)
+
+// admissionQueue admits the spooled uploads into the processing and upload
+// stage, so slow large uploads can't keep the small ones waiting. Each lane
+// has its own concurrency and all of them share a global cap, of which the
+// normal lane doesn't take the slots the priority lane is waiting for.
+type admissionQueue struct {
+	config *Config
+
+	mu       sync.Mutex
+	inflight map[string]int
+	queued   map[string]int
+	total    int
+	// released gets closed and replaced every time a slot frees up
+	released chan struct{}
+}
+
+func newAdmissionQueue(config *Config) *admissionQueue {
+	return &admissionQueue{
+		config:   config,
+		inflight: make(map[string]int),
+		queued:   make(map[string]int),
+		released: make(chan struct{}),
+	}
+}
+
+// lane classifies an upload of size bytes
+func (q *admissionQueue) lane(size int) string {
+	if int64(size) < q.config.AdmissionSmallUploadSize {
+		return LanePriority
+	}
+	return LaneNormal
+}
+
+// available checks if lane has a free slot. q.mu must be held.
+func (q *admissionQueue) available(lane string) bool {
+	if lane == LanePriority {
+		return q.inflight[lane] < q.config.AdmissionPriorityLimit && q.total < q.config.AdmissionMaxLimit
+	}
+	return q.inflight[lane] < q.config.AdmissionNormalLimit &&
+		q.total+q.queued[LanePriority] < q.config.AdmissionMaxLimit
+}
+
+// admit waits up to AdmissionMaxWait for a slot in lane, failing with 503
+// when none frees up in time. The returned function releases the slot. A nil
+// *admissionQueue admits everything right away.
+func (q *admissionQueue) admit(ctx context.Context, lane string) (func(), error) {
+	if q == nil {
+		return func() {}, nil
+	}
+
+	start := time.Now()
+	timeout := time.NewTimer(q.config.AdmissionMaxWait)
+	defer timeout.Stop()
+
+	q.mu.Lock()
+	q.queued[lane]++
+	admissionStats.Add(lane+"_queued", 1)
+	for !q.available(lane) {
+		released := q.released
+		q.mu.Unlock()
+
+		var err error
+		select {
+		case <-released:
+		case <-timeout.C:
+			log.Debugf("No %s admission slot freed up within %s", lane, q.config.AdmissionMaxWait)
+			admissionStats.Add(lane+"_shed", 1)
+			rerr := newRequestError(http.StatusServiceUnavailable, ErrorCodeOverloaded, "Server overloaded, try again later")
+			rerr.retryAfter = q.config.ConcurrencyRetryAfter
+			err = rerr
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+
+		q.mu.Lock()
+		if err != nil {
+			q.queued[lane]--
+			admissionStats.Add(lane+"_queued", -1)
+			// The normal lane may have been waiting for this one
+			q.notify()
+			q.mu.Unlock()
+			q.recordWait(lane, start)
+			return nil, err
+		}
+	}
+	q.queued[lane]--
+	q.inflight[lane]++
+	q.total++
+	q.mu.Unlock()
+
+	admissionStats.Add(lane+"_queued", -1)
+	admissionStats.Add(lane+"_inflight", 1)
+	q.recordWait(lane, start)
+
+	var once sync.Once
+	return func() { once.Do(func() { q.release(lane) }) }, nil
+}
+
+func (q *admissionQueue) release(lane string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.inflight[lane]--
+	q.total--
+	admissionStats.Add(lane+"_inflight", -1)
+	q.notify()
+}
+
+// notify wakes up the waiting uploads. q.mu must be held.
+func (q *admissionQueue) notify() {
+	close(q.released)
+	q.released = make(chan struct{})
+}
+
+func (q *admissionQueue) recordWait(lane string, start time.Time) {
+	admissionStats.Add(lane+"_wait_ms", int64(time.Since(start)/time.Millisecond))
+}
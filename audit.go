@@ -0,0 +1,79 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// auditLogger is kept separate from the standard logger so audit entries are
+// emitted regardless of the configured logging level
+var auditLogger = newAuditLogger()
+
+// auditKeys is the AuditKeys setting, applied to the keyFields of the audit
+// log
+var auditKeys = LogKeysFull
+
+// keyFields are the log fields holding object keys, or lists of them
+var keyFields = map[string]bool{
+	"key":          true,
+	"trash_key":    true,
+	"original_key": true,
+	"siblings":     true,
+}
+
+func newAuditLogger() *log.Logger {
+	logger := log.New()
+	logger.Formatter = &log.JSONFormatter{}
+	logger.Level = log.InfoLevel
+
+	return logger
+}
+
+// audit records a security-relevant action (e.g. an object deletion) in the audit log
+func audit(action string, fields log.Fields) {
+	auditLogger.WithFields(redactKeyFields(fields, auditKeys)).WithField("action", action).Info("audit")
+}
+
+// keyRedactionHook applies logKeys to the keyFields of the standard logger,
+// whatever the call site
+type keyRedactionHook struct{}
+
+func (keyRedactionHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (keyRedactionHook) Fire(entry *log.Entry) error {
+	entry.Data = redactKeyFields(entry.Data, logKeys)
+	return nil
+}
+
+// redactKeyFields applies the LogKeys mode to the keyFields, dropping
+// them with LogKeysOmit. fields itself isn't modified.
+func redactKeyFields(fields log.Fields, mode string) log.Fields {
+	if mode == LogKeysFull {
+		return fields
+	}
+
+	redacted := make(log.Fields, len(fields))
+	for name, value := range fields {
+		if !keyFields[name] {
+			redacted[name] = value
+			continue
+		}
+		if mode == LogKeysOmit {
+			continue
+		}
+		switch value := value.(type) {
+		case string:
+			redacted[name] = redactKey(mode, value)
+		case []string:
+			keys := make([]string, len(value))
+			for i, key := range value {
+				keys[i] = redactKey(mode, key)
+			}
+			redacted[name] = keys
+		default:
+			redacted[name] = value
+		}
+	}
+	return redacted
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/http"
+)
+
+// AVIFContentType is the content type sniffed for AVIF images
+const AVIFContentType = "image/avif"
+
+// decodeAVIF decodes an AVIF image into a format libvips can load. libvips
+// doesn't read AVIF, so it's only set by the builds with the `avif` tag,
+// which link against libavif (see avif_libavif.go).
+var decodeAVIF func(body []byte) ([]byte, error)
+
+// avifBrands are the ftyp brands of AVIF still images and sequences
+var avifBrands = [][]byte{[]byte("avif"), []byte("avis")}
+
+// isAVIF checks whether head starts with the ftyp box of an AVIF file, by its
+// major brand or one of its compatible brands
+func isAVIF(head []byte) bool {
+	if len(head) < 16 || !bytes.Equal(head[4:8], []byte("ftyp")) {
+		return false
+	}
+	size := int(binary.BigEndian.Uint32(head[:4]))
+	if size < 16 {
+		return false
+	}
+	if size > len(head) {
+		// Only check the brands which were sniffed
+		size = len(head)
+	}
+
+	// The major brand, then the minor version and the compatible brands
+	for i := 8; i+4 <= size; i += 4 {
+		if i == 12 {
+			continue
+		}
+		for _, brand := range avifBrands {
+			if bytes.Equal(head[i:i+4], brand) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkAVIFSupport rejects AVIF uploads unless the build can decode them
+func checkAVIFSupport(contentType string) error {
+	if contentType == AVIFContentType && decodeAVIF == nil {
+		return newRequestError(http.StatusUnsupportedMediaType, ErrorCodeUnsupportedMediaType, "AVIF input isn't supported in this build")
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+//go:build avif
+// +build avif
+
+package main
+
+/*
+#cgo pkg-config: libavif
+#include <stdlib.h>
+#include <string.h>
+#include <avif/avif.h>
+
+// imgdeflator_avif_decode decodes the first image of data into 8-bit RGBA
+// pixels, which the caller frees
+static avifResult imgdeflator_avif_decode(const uint8_t *data, size_t size, uint8_t **pixels, uint32_t *width, uint32_t *height) {
+	avifDecoder *decoder = avifDecoderCreate();
+	if (decoder == NULL) {
+		return AVIF_RESULT_OUT_OF_MEMORY;
+	}
+
+	avifResult result = avifDecoderSetIOMemory(decoder, data, size);
+	if (result == AVIF_RESULT_OK) {
+		result = avifDecoderParse(decoder);
+	}
+	if (result == AVIF_RESULT_OK) {
+		result = avifDecoderNextImage(decoder);
+	}
+	if (result != AVIF_RESULT_OK) {
+		avifDecoderDestroy(decoder);
+		return result;
+	}
+
+	avifRGBImage rgb;
+	avifRGBImageSetDefaults(&rgb, decoder->image);
+	rgb.format = AVIF_RGB_FORMAT_RGBA;
+	rgb.depth = 8;
+	result = avifRGBImageAllocatePixels(&rgb);
+	if (result == AVIF_RESULT_OK) {
+		result = avifImageYUVToRGB(decoder->image, &rgb);
+	}
+	if (result == AVIF_RESULT_OK) {
+		size_t rowBytes = (size_t)rgb.width * 4;
+		*pixels = malloc(rowBytes * rgb.height);
+		if (*pixels == NULL) {
+			result = AVIF_RESULT_OUT_OF_MEMORY;
+		} else {
+			for (uint32_t y = 0; y < rgb.height; y++) {
+				memcpy(*pixels + y * rowBytes, rgb.pixels + y * rgb.rowBytes, rowBytes);
+			}
+			*width = rgb.width;
+			*height = rgb.height;
+		}
+	}
+
+	avifRGBImageFreePixels(&rgb);
+	avifDecoderDestroy(decoder);
+	return result;
+}
+
+// imgdeflator_avif_encode encodes 8-bit RGBA pixels into output, which the
+// caller frees. A negative quality keeps the libavif default.
+static avifResult imgdeflator_avif_encode(const uint8_t *pixels, uint32_t width, uint32_t height, int quality, avifRWData *output) {
+	avifImage *image = avifImageCreate(width, height, 8, AVIF_PIXEL_FORMAT_YUV420);
+	if (image == NULL) {
+		return AVIF_RESULT_OUT_OF_MEMORY;
+	}
+
+	avifRGBImage rgb;
+	avifRGBImageSetDefaults(&rgb, image);
+	rgb.format = AVIF_RGB_FORMAT_RGBA;
+	rgb.depth = 8;
+	rgb.pixels = (uint8_t *)pixels;
+	rgb.rowBytes = width * 4;
+	avifResult result = avifImageRGBToYUV(image, &rgb);
+	if (result == AVIF_RESULT_OK) {
+		avifEncoder *encoder = avifEncoderCreate();
+		if (encoder == NULL) {
+			result = AVIF_RESULT_OUT_OF_MEMORY;
+		} else {
+			if (quality >= 0) {
+				encoder->quality = quality;
+				encoder->qualityAlpha = quality;
+			}
+			result = avifEncoderWrite(encoder, image, output);
+			avifEncoderDestroy(encoder);
+		}
+	}
+
+	avifImageDestroy(image);
+	return result;
+}
+*/
+import "C"
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/draw"
+	"image/png"
+	"unsafe"
+)
+
+func init() {
+	decodeAVIF = decodeAVIFWithLibavif
+	encodeAVIF = encodeAVIFWithLibavif
+}
+
+// decodeAVIFWithLibavif decodes the first image of an AVIF file and encodes
+// it as a PNG, which keeps its alpha channel for libvips
+func decodeAVIFWithLibavif(body []byte) ([]byte, error) {
+	if len(body) == 0 {
+		return nil, errors.New("empty image")
+	}
+
+	var pixels *C.uint8_t
+	var width, height C.uint32_t
+	result := C.imgdeflator_avif_decode((*C.uint8_t)(unsafe.Pointer(&body[0])), C.size_t(len(body)), &pixels, &width, &height)
+	if result != C.AVIF_RESULT_OK {
+		return nil, errors.New(C.GoString(C.avifResultToString(result)))
+	}
+	defer C.free(unsafe.Pointer(pixels))
+
+	img := &image.NRGBA{
+		Pix:    C.GoBytes(unsafe.Pointer(pixels), C.int(width*height*4)),
+		Stride: int(width) * 4,
+		Rect:   image.Rect(0, 0, int(width), int(height)),
+	}
+
+	var buf bytes.Buffer
+	encoder := png.Encoder{CompressionLevel: png.BestSpeed}
+	err := encoder.Encode(&buf, img)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// encodeAVIFWithLibavif encodes a PNG image, as libvips exports it, into an
+// AVIF file
+func encodeAVIFWithLibavif(body []byte, quality int) ([]byte, error) {
+	decoded, err := png.Decode(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	bounds := decoded.Bounds()
+	if bounds.Empty() {
+		return nil, errors.New("empty image")
+	}
+	img, ok := decoded.(*image.NRGBA)
+	if !ok || img.Stride != bounds.Dx()*4 {
+		img = image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+		draw.Draw(img, img.Bounds(), decoded, bounds.Min, draw.Src)
+	}
+
+	if quality <= 0 {
+		quality = -1
+	}
+	var output C.avifRWData
+	result := C.imgdeflator_avif_encode((*C.uint8_t)(unsafe.Pointer(&img.Pix[0])), C.uint32_t(bounds.Dx()), C.uint32_t(bounds.Dy()), C.int(quality), &output)
+	if result != C.AVIF_RESULT_OK {
+		return nil, errors.New(C.GoString(C.avifResultToString(result)))
+	}
+	defer C.avifRWDataFree(&output)
+
+	return C.GoBytes(unsafe.Pointer(output.data), C.int(output.size)), nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/external"
+)
+
+var (
+	// profileConfigs caches the AWS configs of the named profiles
+	profileConfigs   = make(map[string]aws.Config)
+	profileConfigsMu sync.Mutex
+)
+
+// bucketProfile routes the buckets matching pattern to a named AWS profile
+type bucketProfile struct {
+	pattern string
+	profile string
+}
+
+// parseBucketProfiles parses the `<pattern>=<profile>` entries of
+// AWSProfiles, checking that every profile exists in the shared config
+// files. Patterns are globs like `media-*`.
+func parseBucketProfiles(entries []string) ([]bucketProfile, error) {
+	var profiles []bucketProfile
+	for _, entry := range entries {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid AWS profile mapping %q (expected <bucket pattern>=<profile>)", entry)
+		}
+		pattern, profile := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid bucket pattern %q: %s", pattern, err)
+		}
+		if _, err := loadProfileAWSConfig(profile); err != nil {
+			return nil, err
+		}
+		profiles = append(profiles, bucketProfile{pattern: pattern, profile: profile})
+	}
+	return profiles, nil
+}
+
+// awsProfile returns the AWS profile of bucket, from the first mapping whose
+// pattern it matches, or an empty string for the default chain
+func (d *Deflator) awsProfile(bucket string) string {
+	for _, mapping := range d.awsProfiles {
+		if ok, _ := path.Match(mapping.pattern, bucket); ok {
+			return mapping.profile
+		}
+	}
+	return ""
+}
+
+// loadProfileAWSConfig loads the AWS config of a named profile from the
+// shared config and credentials files, caching it per profile. The
+// environment isn't consulted, so its credentials don't take precedence over
+// the ones of the profile.
+func loadProfileAWSConfig(profile string) (aws.Config, error) {
+	profileConfigsMu.Lock()
+	defer profileConfigsMu.Unlock()
+
+	if awsCfg, ok := profileConfigs[profile]; ok {
+		return awsCfg.Copy(), nil
+	}
+
+	configs, err := external.Configs{external.WithSharedConfigProfile(profile)}.
+		AppendFromLoaders([]external.ConfigLoader{external.LoadSharedConfig})
+	if err != nil {
+		return aws.Config{}, fmt.Errorf("could not load the AWS profile %q: %s", profile, err)
+	}
+	awsCfg, err := configs.ResolveAWSConfig(external.DefaultAWSConfigResolvers)
+	if err != nil {
+		return aws.Config{}, fmt.Errorf("could not load the AWS profile %q: %s", profile, err)
+	}
+
+	if s3HTTPClient != nil {
+		awsCfg.HTTPClient = s3HTTPClient
+	}
+	if s3Endpoint != "" {
+		awsCfg.EndpointResolver = aws.ResolveWithEndpointURL(s3Endpoint)
+	}
+	limitS3Calls(&awsCfg)
+
+	profileConfigs[profile] = awsCfg
+	return awsCfg.Copy(), nil
+}
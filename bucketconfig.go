@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+// DefaultBucketConfigName is the entry in the bucket config file which applies
+// to all the buckets that don't have their own entry
+const DefaultBucketConfigName = "*"
+
+const (
+	// ExpiryMechanismTag sets an `expiry` object tag, to be matched by a lifecycle rule
+	ExpiryMechanismTag = "tag"
+	// ExpiryMechanismExpires sets the Expires metadata of the object
+	ExpiryMechanismExpires = "expires"
+)
+
+// BucketConfig holds the per-bucket settings loaded from the bucket config file
+type BucketConfig struct {
+	KeyTemplate string `json:"key_template"`
+	// MaxTTL is the maximum `ttl` in seconds which requests can specify. Zero disallows TTLs.
+	MaxTTL          uint64 `json:"max_ttl"`
+	ExpiryMechanism string `json:"expiry_mechanism"`
+	// Replicas lists the secondary buckets which receive a copy of every upload
+	Replicas          []string `json:"replicas"`
+	ReplicationPolicy string   `json:"replication"`
+	// UseAccelerate and UseDualstack override the S3UseAccelerate and
+	// S3UseDualstack defaults when set
+	UseAccelerate *bool `json:"use_accelerate"`
+	UseDualstack  *bool `json:"use_dualstack"`
+	// Region is the region of the bucket, which then doesn't get looked up
+	Region string `json:"region"`
+	// CacheControl overrides the Cache-Control header of GET responses
+	CacheControl string `json:"cache_control"`
+	// ExpectedOwner overrides the ExpectedBucketOwner AWS account ID
+	ExpectedOwner string `json:"expected_owner"`
+	// Collision is the default strategy for keys which are already taken
+	Collision string `json:"collision"`
+	// KMSKeyID enables the client-side encryption of the uploads with data
+	// keys of this KMS key
+	KMSKeyID string `json:"kms_key_id"`
+	// Profiles restricts the transform profiles requests can select. Empty
+	// allows all of them.
+	Profiles []string `json:"profiles"`
+	// ProfilesOnly rejects the explicit transform options, so the requests
+	// can only select a profile
+	ProfilesOnly bool `json:"profiles_only"`
+	// Passthrough stores the uploads as is, streaming them to S3 without
+	// any image processing
+	Passthrough bool `json:"passthrough"`
+	// MinBytes overrides MinUploadSize for the uploads to the bucket
+	MinBytes int64 `json:"min_bytes"`
+	// MaxInputBytes overrides the MaxUploadSize limits of the request bodies
+	// and MaxStoredBytes the MaxStoredSize of the processed images
+	MaxInputBytes  int64 `json:"max_input_bytes"`
+	MaxStoredBytes int64 `json:"max_stored_bytes"`
+	// WorkBudget and MaxRenditions override the WorkBudget and MaxRenditions
+	// defaults when set
+	WorkBudget    *float64 `json:"work_budget"`
+	MaxRenditions *int     `json:"max_renditions"`
+	// SkipPhash disables the perceptual hashes of the uploads
+	SkipPhash bool `json:"skip_phash"`
+	// AnyContentType disables the early rejection of the uploads declaring
+	// a non-image Content-Type
+	AnyContentType bool `json:"any_content_type"`
+	// VerifyUploads checks the stored objects with a HeadObject after the
+	// upload, unless the request opts out
+	VerifyUploads bool `json:"verify_uploads"`
+	// Siblings are the formats of the variants stored next to the objects,
+	// unless the request sets its own
+	Siblings []string `json:"siblings"`
+
+	keyTemplate *keyTemplate
+}
+
+// loadBucketConfigs reads and validates the JSON bucket config file, which
+// maps bucket names to their BucketConfig
+func loadBucketConfigs(path string) (map[string]*BucketConfig, error) {
+	configs := make(map[string]*BucketConfig)
+	if path == "" {
+		return configs, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read bucket config file: %s", err)
+	}
+
+	err = json.Unmarshal(data, &configs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse bucket config file: %s", err)
+	}
+
+	for bucket, config := range configs {
+		switch config.ExpiryMechanism {
+		case "":
+			config.ExpiryMechanism = ExpiryMechanismTag
+		case ExpiryMechanismTag, ExpiryMechanismExpires:
+		default:
+			return nil, fmt.Errorf("invalid config for bucket %q: unknown expiry mechanism %q", bucket, config.ExpiryMechanism)
+		}
+
+		switch config.ReplicationPolicy {
+		case "":
+			config.ReplicationPolicy = ReplicationPolicyRequired
+		case ReplicationPolicyRequired, ReplicationPolicyBestEffort:
+		default:
+			return nil, fmt.Errorf("invalid config for bucket %q: unknown replication policy %q", bucket, config.ReplicationPolicy)
+		}
+
+		switch {
+		case config.Collision == "":
+			config.Collision = CollisionOverwrite
+		case !isCollisionStrategy(config.Collision):
+			return nil, fmt.Errorf("invalid config for bucket %q: unknown collision strategy %q", bucket, config.Collision)
+		}
+
+		for _, name := range append([]string{bucket}, config.Replicas...) {
+			if _, err := parseAccessPoint(name); err != nil {
+				return nil, fmt.Errorf("invalid config for bucket %q: %s", bucket, err)
+			}
+		}
+
+		if config.Region != "" {
+			if _, err := regionPartition(config.Region); err != nil {
+				return nil, fmt.Errorf("invalid config for bucket %q: %s", bucket, err)
+			}
+		}
+
+		if err := validateAccountID(config.ExpectedOwner); err != nil {
+			return nil, fmt.Errorf("invalid config for bucket %q: %s", bucket, err)
+		}
+
+		if config.MinBytes < 0 {
+			return nil, fmt.Errorf("invalid config for bucket %q: negative min_bytes %d", bucket, config.MinBytes)
+		}
+		if config.MaxInputBytes < 0 || config.MaxStoredBytes < 0 {
+			return nil, fmt.Errorf("invalid config for bucket %q: negative max_input_bytes or max_stored_bytes", bucket)
+		}
+		if (config.WorkBudget != nil && *config.WorkBudget < 0) || (config.MaxRenditions != nil && *config.MaxRenditions < 0) {
+			return nil, fmt.Errorf("invalid config for bucket %q: negative work_budget or max_renditions", bucket)
+		}
+
+		if config.Siblings != nil {
+			config.Siblings, err = parseSiblingFormats(config.Siblings)
+			if err != nil {
+				return nil, fmt.Errorf("invalid config for bucket %q: %s", bucket, err)
+			}
+		}
+
+		if config.Passthrough && (config.KMSKeyID != "" || len(config.Replicas) > 0) {
+			return nil, fmt.Errorf("invalid config for bucket %q: passthrough can't be combined with kms_key_id or replicas", bucket)
+		}
+
+		if config.KeyTemplate != "" {
+			config.keyTemplate, err = parseKeyTemplate(config.KeyTemplate)
+			if err != nil {
+				return nil, fmt.Errorf("invalid config for bucket %q: %s", bucket, err)
+			}
+		}
+	}
+
+	return configs, nil
+}
+
+// bucketConfig returns the config for the specified bucket, falling back to
+// the default entry and then to an empty config
+func (d *Deflator) bucketConfig(bucket string) *BucketConfig {
+	if config, ok := d.buckets[bucket]; ok {
+		return config
+	}
+
+	if config, ok := d.buckets[DefaultBucketConfigName]; ok {
+		return config
+	}
+
+	return &BucketConfig{
+		ExpiryMechanism:   ExpiryMechanismTag,
+		ReplicationPolicy: ReplicationPolicyRequired,
+		Collision:         CollisionOverwrite,
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// ExpectedBucketOwnerHeader makes S3 reject requests to buckets owned by
+	// another AWS account. This SDK version has no field for it.
+	ExpectedBucketOwnerHeader = "X-Amz-Expected-Bucket-Owner"
+
+	// Values of the owner check in the admin API
+	OwnerCheckUnchecked = "unchecked"
+	OwnerCheckVerified  = "verified"
+	OwnerCheckMismatch  = "mismatch"
+)
+
+// awsAccountID matches 12-digit AWS account IDs
+var awsAccountID = regexp.MustCompile(`^[0-9]{12}$`)
+
+func validateAccountID(owner string) error {
+	if owner != "" && !awsAccountID.MatchString(owner) {
+		return fmt.Errorf("invalid AWS account ID %q", owner)
+	}
+	return nil
+}
+
+// expectBucketOwner sends the ExpectedBucketOwnerHeader with all the requests
+// of client
+func expectBucketOwner(client *s3.S3, owner string) {
+	client.Handlers.Build.PushBack(func(r *aws.Request) {
+		r.HTTPRequest.Header.Set(ExpectedBucketOwnerHeader, owner)
+	})
+}
+
+// bucketOwnerMismatchError is returned for buckets which don't belong to the
+// expected owner
+func bucketOwnerMismatchError(bucket string) error {
+	return newRequestError(http.StatusForbidden, ErrorCodeBucketOwnerMismatch, "Bucket %q doesn't belong to the expected owner", bucket)
+}
+
+// checkBucketOwner sends a HeadBucket request with the expected owner, which
+// client already sets. It returns the owner check result, and an error is
+// only set for mismatches.
+func checkBucketOwner(ctx context.Context, client *s3.S3, bucket string) (string, error) {
+	req := client.HeadBucketRequest(&s3.HeadBucketInput{Bucket: aws.String(bucket)})
+	req.SetContext(ctx)
+	_, err := req.Send()
+	switch {
+	case err == nil:
+		return OwnerCheckVerified, nil
+	case isAccessDeniedError(err):
+		log.Errorf("Bucket %q doesn't belong to the expected owner: %s", bucket, err)
+		return OwnerCheckMismatch, bucketOwnerMismatchError(bucket)
+	default:
+		// Uploads still carry the expected owner, so S3 rejects them if needed
+		log.Warnf("Failed to check the owner of bucket %q: %s", bucket, err)
+		return OwnerCheckUnchecked, nil
+	}
+}
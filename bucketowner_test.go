@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+const (
+	testOwner  = "111111111111"
+	otherOwner = "222222222222"
+)
+
+// countOwnerChecks counts the HeadBucket requests of the owner checks to the
+// fakes3 server of s, and the objects written to it
+func countOwnerChecks(s *testServer) (checks, puts *int64) {
+	checks, puts = new(int64), new(int64)
+	s.fake.SetFault(func(r *http.Request) int {
+		switch {
+		case r.Method == http.MethodPut:
+			atomic.AddInt64(puts, 1)
+		// The region lookups use HeadBucket too, without an expected owner
+		case r.Method == http.MethodHead && strings.Count(r.URL.Path, "/") == 1 && r.Header.Get(ExpectedBucketOwnerHeader) != "":
+			atomic.AddInt64(checks, 1)
+		}
+		return 0
+	})
+	return checks, puts
+}
+
+// ownerCheck returns the owner check of the cached uploader of bucket
+func ownerCheck(t *testing.T, bucket string) uploaderInfo {
+	for _, info := range uploaderCacheInfo() {
+		if info.Bucket == bucket {
+			return info
+		}
+	}
+	t.Fatalf("No cached uploader for bucket %q", bucket)
+	return uploaderInfo{}
+}
+
+func TestValidateAccountID(t *testing.T) {
+	for _, owner := range []string{"", testOwner} {
+		if err := validateAccountID(owner); err != nil {
+			t.Errorf("Expected %q to be valid, got %s", owner, err)
+		}
+	}
+	for _, owner := range []string{"11111111111", "1111111111111", "11111111111a", "arn:aws:iam::111111111111:root"} {
+		if err := validateAccountID(owner); err == nil {
+			t.Errorf("Expected %q to be invalid", owner)
+		}
+	}
+
+	config, err := loadTestConfig("")
+	if err != nil {
+		t.Fatalf("Failed to load the config: %s", err)
+	}
+	config.ExpectedBucketOwner = "owner"
+	if _, err := NewDeflator(config, nil, nil); err == nil {
+		t.Errorf("Expected the Deflator to refuse an invalid expected owner")
+	}
+}
+
+func TestBucketOwner(t *testing.T) {
+	tests := []struct {
+		name   string
+		owner  string
+		verify bool
+		status int
+		checks int64
+		puts   int64
+		check  string
+	}{
+		{"matching", testOwner, false, http.StatusOK, 0, 1, OwnerCheckUnchecked},
+		{"matching verified", testOwner, true, http.StatusOK, 1, 1, OwnerCheckVerified},
+		// S3 denies the upload itself
+		{"mismatch", otherOwner, false, http.StatusForbidden, 0, 1, OwnerCheckUnchecked},
+		{"mismatch verified", otherOwner, true, http.StatusForbidden, 1, 0, OwnerCheckMismatch},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestServer(t, func(config *Config) {
+				config.ExpectedBucketOwner = test.owner
+				config.VerifyBucketOwner = test.verify
+			})
+			defer s.close()
+			s.fake.SetOwner(TestBucket, testOwner)
+			checks, puts := countOwnerChecks(s)
+
+			resp := s.post("photo.png", "width=16", bytes.NewReader(testPNG(t, 32, 32)))
+			if test.status == http.StatusOK {
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					t.Fatalf("Expected the upload to succeed, got %d", resp.StatusCode)
+				}
+			} else if code := decodeError(t, resp, test.status).Code; code != ErrorCodeBucketOwnerMismatch {
+				t.Errorf("Expected the %s code, got %s", ErrorCodeBucketOwnerMismatch, code)
+			}
+
+			if n := atomic.LoadInt64(checks); n != test.checks {
+				t.Errorf("Expected %d owner checks, got %d", test.checks, n)
+			}
+			if n := atomic.LoadInt64(puts); n != test.puts {
+				t.Errorf("Expected %d writes, got %d", test.puts, n)
+			}
+			info := ownerCheck(t, TestBucket)
+			if info.ExpectedOwner != test.owner || info.OwnerCheck != test.check {
+				t.Errorf("Expected the %s owner check of %s, got %s of %s", test.check, test.owner, info.OwnerCheck, info.ExpectedOwner)
+			}
+		})
+	}
+}
+
+func TestBucketOwnerMismatchCached(t *testing.T) {
+	s := newTestServer(t, func(config *Config) {
+		config.ExpectedBucketOwner = otherOwner
+		config.VerifyBucketOwner = true
+	})
+	defer s.close()
+	s.fake.SetOwner(TestBucket, testOwner)
+	checks, puts := countOwnerChecks(s)
+
+	for i := 0; i < 3; i++ {
+		resp := s.post("photo.png", "width=16", bytes.NewReader(testPNG(t, 32, 32)))
+		if code := decodeError(t, resp, http.StatusForbidden).Code; code != ErrorCodeBucketOwnerMismatch {
+			t.Errorf("Expected the %s code, got %s", ErrorCodeBucketOwnerMismatch, code)
+		}
+	}
+	if n := atomic.LoadInt64(checks); n != 1 {
+		t.Errorf("Expected the mismatch to be cached after one check, got %d checks", n)
+	}
+	if n := atomic.LoadInt64(puts); n != 0 {
+		t.Errorf("Expected nothing to be written, got %d writes", n)
+	}
+}
+
+func TestBucketOwnerOverride(t *testing.T) {
+	s := newTestServer(t, func(config *Config) {
+		config.ExpectedBucketOwner = otherOwner
+	})
+	defer s.close()
+	s.fake.SetOwner(TestBucket, testOwner)
+	s.deflator.buckets = map[string]*BucketConfig{
+		TestBucket: {
+			ExpiryMechanism:   ExpiryMechanismTag,
+			ReplicationPolicy: ReplicationPolicyRequired,
+			Collision:         CollisionOverwrite,
+			ExpectedOwner:     testOwner,
+		},
+	}
+
+	resp := s.post("photo.png", "width=16", bytes.NewReader(testPNG(t, 32, 32)))
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the bucket owner to override the global one, got %d", resp.StatusCode)
+	}
+	if info := ownerCheck(t, TestBucket); info.ExpectedOwner != testOwner {
+		t.Errorf("Expected the uploader to expect %s, got %q", testOwner, info.ExpectedOwner)
+	}
+}
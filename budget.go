@@ -0,0 +1,97 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"strconv"
+
+	"github.com/davidbyttow/govips/pkg/vips"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// workCosts is the distribution of the request costs, in decoded
+	// megapixels times encodes, by upper bound
+	workCosts = expvar.NewMap("work_costs")
+
+	// workCostBounds are the upper bounds of the workCosts buckets
+	workCostBounds = []float64{1, 4, 16, 64, 256, 1024}
+)
+
+// workload is the work a request asks for, for its budget
+type workload struct {
+	// encodes is how many times the decoded image gets encoded
+	encodes int
+	// renditions is how many images the request outputs
+	renditions int
+}
+
+// workLimits returns the work budget of bucket, in megapixels times encodes,
+// and its maximum number of renditions. Zero disables a limit.
+func (d *Deflator) workLimits(bucket string) (float64, int) {
+	config := d.bucketConfig(bucket)
+	budget, renditions := d.config.WorkBudget, d.config.MaxRenditions
+	if config.WorkBudget != nil {
+		budget = *config.WorkBudget
+	}
+	if config.MaxRenditions != nil {
+		renditions = *config.MaxRenditions
+	}
+	return budget, renditions
+}
+
+// imageMegapixels reads the dimensions of body from its header, which
+// doesn't decode the pixels
+func imageMegapixels(body []byte) (float64, bool) {
+	image, err := vips.NewImageFromBuffer(body)
+	if err != nil {
+		return 0, false
+	}
+	defer image.Close()
+	return float64(image.Width()) * float64(image.Height()) / 1e6, true
+}
+
+// checkWorkBudget rejects the requests whose work on body exceeds the limits
+// of bucket. It's meant to be called before any heavy work, by every path
+// which transforms images. Images libvips can't read the header of get
+// through, since their transform fails anyway.
+func (d *Deflator) checkWorkBudget(bucket string, body []byte, work workload) error {
+	budget, maxRenditions := d.workLimits(bucket)
+	if maxRenditions > 0 && work.renditions > maxRenditions {
+		log.Debugf("Too many renditions (%d, limit: %d)", work.renditions, maxRenditions)
+		return newRequestError(
+			http.StatusRequestEntityTooLarge, ErrorCodeWorkBudgetExceeded,
+			"Too many renditions (%d, limit: %d)", work.renditions, maxRenditions,
+		)
+	}
+
+	megapixels, ok := imageMegapixels(body)
+	if !ok {
+		return nil
+	}
+	cost := megapixels * float64(work.encodes)
+	countWorkCost(cost)
+
+	if budget > 0 && cost > budget {
+		log.Debugf("Work budget exceeded (%.1f, limit: %g)", cost, budget)
+		return newRequestError(
+			http.StatusRequestEntityTooLarge, ErrorCodeWorkBudgetExceeded,
+			"Request too expensive (%.1f megapixels × %d encodes = %.1f, limit: %g)", megapixels, work.encodes, cost, budget,
+		)
+	}
+	return nil
+}
+
+// countWorkCost adds cost to the workCosts distribution
+func countWorkCost(cost float64) {
+	bucket := "inf"
+	for _, bound := range workCostBounds {
+		if cost <= bound {
+			bucket = "le_" + strconv.FormatFloat(bound, 'f', -1, 64)
+			break
+		}
+	}
+	workCosts.Add(bucket, 1)
+	workCosts.AddFloat("sum", cost)
+	workCosts.Add("count", 1)
+}
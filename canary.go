@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Nitro/urlsign"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// canaryStats counts the canary outcomes and accumulates their durations
+	// in milliseconds
+	canaryStats = expvar.NewMap("canary")
+)
+
+type canaryContextKey struct{}
+
+// withCanary marks the requests sent by the canary, which aren't accounted
+// for in the usage
+func withCanary(ctx context.Context) context.Context {
+	return context.WithValue(ctx, canaryContextKey{}, true)
+}
+
+func isCanary(ctx context.Context) bool {
+	canary, _ := ctx.Value(canaryContextKey{}).(bool)
+	return canary
+}
+
+// canaryResult is the outcome of the last canary upload, as reported by the
+// readiness endpoint
+type canaryResult struct {
+	Time       time.Time `json:"time"`
+	DurationMS int64     `json:"duration_ms"`
+	Status     int       `json:"status"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// runCanary uploads the test image to the CanaryBucket through the whole
+// request path: the URL gets signed like a client would, and the request is
+// served by the upload handler itself
+func (d *Deflator) runCanary(ctx context.Context) *canaryResult {
+	location := "s3://" + d.config.CanaryBucket + "/" + d.config.CanaryKey
+	u := &url.URL{
+		Path: "/" + base64.RawURLEncoding.EncodeToString([]byte(location)),
+		// The canary object gets overwritten every time
+		RawQuery: "collision=" + CollisionOverwrite + "&width=4",
+	}
+	if d.config.UrlSigningSecret != "" {
+		token := urlsign.GenerateToken(d.config.UrlSigningSecret, d.config.SigningBucketSize, d.clock.Now(), u.String())
+		u.RawQuery += "&token=" + token
+	}
+
+	r := httptest.NewRequest(http.MethodPost, u.String(), bytes.NewReader(testImage)).WithContext(withCanary(ctx))
+	r.Header.Set("Content-Type", "image/png")
+	r.RemoteAddr = "127.0.0.1:0"
+
+	start := time.Now()
+	w := httptest.NewRecorder()
+	d.Handler(w, r)
+	duration := time.Since(start)
+
+	result := &canaryResult{
+		Time:       d.clock.Now(),
+		DurationMS: int64(duration / time.Millisecond),
+		Status:     w.Code,
+	}
+	canaryStats.Add("duration_ms", result.DurationMS)
+	if w.Code < 200 || w.Code > 299 {
+		result.Error = strings.TrimSpace(w.Body.String())
+		canaryStats.Add("failure", 1)
+		log.Warnf("Canary upload to %q failed in %s (%d): %s", d.config.CanaryBucket, duration, w.Code, result.Error)
+	} else {
+		canaryStats.Add("success", 1)
+		log.Debugf("Canary upload to %q succeeded in %s", d.config.CanaryBucket, duration)
+	}
+
+	return result
+}
+
+// RunCanary runs the canary every CanaryInterval, starting right away, until
+// ctx is cancelled
+func (d *Deflator) RunCanary(ctx context.Context) {
+	ticker := time.NewTicker(d.config.CanaryInterval)
+	defer ticker.Stop()
+
+	for {
+		canaryCtx, cancel := context.WithTimeout(ctx, d.config.UploadTimeout)
+		d.lastCanary.Store(d.runCanary(canaryCtx))
+		cancel()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// canaryCheck reports the last canary result, if any. Failures only make the
+// check fail when CanaryAffectsReadiness is set.
+func (d *Deflator) canaryCheck() (checkResult, bool) {
+	last, ok := d.lastCanary.Load().(*canaryResult)
+	if !ok {
+		return checkResult{}, false
+	}
+
+	result := checkResult{Name: "canary", Detail: last}
+	if last.Error != "" && d.config.CanaryAffectsReadiness {
+		result.Error = "canary upload failed"
+	}
+	return result, true
+}
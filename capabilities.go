@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/davidbyttow/govips/pkg/vips"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// CapabilitiesPath describes what the deployment supports
+	CapabilitiesPath = "/capabilities"
+	// APIVersion is the version of the HTTP API, bumped on incompatible
+	// changes
+	APIVersion = "1"
+
+	// Authentication modes of the capabilities
+	AuthModeSignedURL  = "signed_url"
+	AuthModeUnsigned   = "unsigned"
+	AuthModeSession    = "session"
+	AuthModeAdminToken = "admin_token"
+)
+
+// capabilities is the document served on CapabilitiesPath, derived from the
+// config. It never holds secrets, or bucket names without
+// CapabilitiesBuckets.
+type capabilities struct {
+	APIVersion    string                      `json:"api_version"`
+	Limits        capabilityLimits            `json:"limits"`
+	InputFormats  []string                    `json:"input_formats"`
+	OutputFormats []string                    `json:"output_formats"`
+	Options       map[string]capabilityOption `json:"options"`
+	Profiles      []string                    `json:"profiles"`
+	Auth          []string                    `json:"auth"`
+	Features      []string                    `json:"features"`
+	Buckets       []string                    `json:"buckets,omitempty"`
+}
+
+// capabilityLimits are the global size limits, which buckets and profiles
+// can override
+type capabilityLimits struct {
+	MaxInputBytes       int64            `json:"max_input_bytes"`
+	MaxInputBytesByType map[string]int64 `json:"max_input_bytes_by_type,omitempty"`
+	MinInputBytes       int64            `json:"min_input_bytes,omitempty"`
+	MaxStoredBytes      int64            `json:"max_stored_bytes,omitempty"`
+	MaxPassthroughBytes int64            `json:"max_passthrough_bytes,omitempty"`
+	MaxWidth            uint64           `json:"max_width"`
+	MaxHeight           uint64           `json:"max_height"`
+}
+
+// capabilityOption describes the values a request option accepts, Max
+// being the longest length of the strings and the most repetitions of the
+// repeatable options
+type capabilityOption struct {
+	Type       string   `json:"type"`
+	Min        *float64 `json:"min,omitempty"`
+	Max        *float64 `json:"max,omitempty"`
+	Values     []string `json:"values,omitempty"`
+	Repeatable bool     `json:"repeatable,omitempty"`
+}
+
+// cachedCapabilities is the encoded capabilities, computed on the first
+// request after a startup or a reload
+type cachedCapabilities struct {
+	body []byte
+	etag string
+}
+
+// numericOption describes an option taking numbers from min to max, or
+// without an upper bound if max is negative
+func numericOption(kind string, min, max float64) capabilityOption {
+	option := capabilityOption{Type: kind, Min: &min}
+	if max >= 0 {
+		option.Max = &max
+	}
+	return option
+}
+
+// optionCapabilities describes the options of the requests. The ones
+// without a description are listed as strings.
+func (d *Deflator) optionCapabilities() map[string]capabilityOption {
+	siblings := []string{SiblingFormatWEBP}
+	if encodeAVIF != nil {
+		siblings = append(siblings, SiblingFormatAVIF)
+	}
+	maxRegions := float64(d.config.RedactMaxRegions)
+
+	options := map[string]capabilityOption{
+		"width":     numericOption("integer", 0, float64(d.config.MaxWidth)),
+		"height":    numericOption("integer", 0, float64(d.config.MaxHeight)),
+		"ttl":       numericOption("integer", 0, -1),
+		"timeout":   numericOption("seconds", d.config.UploadTimeoutMin.Seconds(), d.maxUploadTimeout().Seconds()),
+		"format":    {Type: "enum", Values: append(d.outputFormatNames(), FormatAuto)},
+		"profile":   {Type: "enum", Values: d.profileNames()},
+		"response":  {Type: "enum", Values: []string{ResponseStyleLegacy, ResponseStyleFull, ResponseStyleJSON, ResponseStyleEmpty, ResponseStyleMinimal}},
+		"collision": {Type: "enum", Values: []string{CollisionOverwrite, CollisionError, CollisionSuffix}},
+		"siblings":  {Type: "list", Values: append(siblings, SiblingsNone)},
+		"source":    {Type: "string"},
+		"redact":    {Type: "region", Max: &maxRegions, Repeatable: true},
+	}
+	for _, name := range []string{"soft", "keep_original", "echo", "verify", "strip"} {
+		options[name] = capabilityOption{Type: "boolean"}
+	}
+	// The captions need a font
+	if d.config.TextFont != "" {
+		maxLength := float64(d.config.TextMaxLength)
+		options["text"] = capabilityOption{Type: "string", Max: &maxLength}
+		options["text_size"] = numericOption("integer", 1, float64(d.config.TextMaxSize))
+		options["text_position"] = capabilityOption{Type: "enum", Values: []string{TextPositionTop, TextPositionCenter, TextPositionBottom}}
+		options["text_color"] = capabilityOption{Type: "color"}
+	}
+
+	for name := range optionParsers {
+		if _, ok := options[name]; !ok && !strings.HasPrefix(name, "text") {
+			options[name] = capabilityOption{Type: "string"}
+		}
+	}
+	return options
+}
+
+// outputFormatNames returns the sorted values of the `format` option
+func (d *Deflator) outputFormatNames() []string {
+	names := make([]string, 0, len(outputFormats))
+	for name := range outputFormats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// profileNames returns the sorted names of the transform profiles
+func (d *Deflator) profileNames() []string {
+	profiles := d.transformProfiles()
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// inputFormats returns the formats libvips can load in this build, and AVIF
+// with libavif
+func inputFormats() []string {
+	formats := []string{}
+	for imageType, name := range vips.ImageTypes {
+		if vips.IsTypeSupported(imageType) {
+			formats = append(formats, name)
+		}
+	}
+	if decodeAVIF != nil {
+		formats = append(formats, "avif")
+	}
+	sort.Strings(formats)
+	return formats
+}
+
+// authModes lists how clients can authenticate, on any listener
+func (d *Deflator) authModes() []string {
+	var modes []string
+	unsigned := d.config.UrlSigningSecret == ""
+	for _, listener := range d.listenerConfigs {
+		unsigned = unsigned || listener.DisableAuth
+	}
+	if d.config.UrlSigningSecret != "" {
+		modes = append(modes, AuthModeSignedURL)
+	}
+	if unsigned {
+		modes = append(modes, AuthModeUnsigned)
+	}
+	if d.sessions != nil {
+		modes = append(modes, AuthModeSession)
+	}
+	if d.config.AdminToken != "" {
+		modes = append(modes, AuthModeAdminToken)
+	}
+	return modes
+}
+
+// features lists the optional endpoints and behaviors which are enabled
+func (d *Deflator) features() []string {
+	features := []string{"envelope"}
+	for _, feature := range []struct {
+		name    string
+		enabled bool
+	}{
+		{"delete", d.config.EnableDelete},
+		{"get", d.config.EnableGet},
+		{"tus", d.config.EnableTus},
+		{"grpc", d.config.GRPCPort != ""},
+		{"passthrough", d.passthroughBuckets},
+		{"rendition_cache", d.config.CacheRenditions},
+		{"streaming_transforms", d.config.StreamingTransforms},
+		{"perceptual_hash", d.config.PerceptualHash},
+	} {
+		if feature.enabled {
+			features = append(features, feature.name)
+		}
+	}
+	for _, listener := range d.listenerConfigs {
+		if listener.PlainPut {
+			features = append(features, "plain_put")
+			break
+		}
+	}
+	return features
+}
+
+// capabilityBuckets lists the configured buckets, of the allowed
+// destinations and of the bucket config file
+func (d *Deflator) capabilityBuckets() []string {
+	seen := map[string]bool{}
+	for _, entry := range d.config.AllowedDestinations {
+		seen[strings.SplitN(entry, "/", 2)[0]] = true
+	}
+	for bucket := range d.buckets {
+		seen[bucket] = true
+	}
+	buckets := make([]string, 0, len(seen))
+	for bucket := range seen {
+		buckets = append(buckets, bucket)
+	}
+	sort.Strings(buckets)
+	return buckets
+}
+
+// buildCapabilities encodes the capabilities of the current config
+func (d *Deflator) buildCapabilities() (*cachedCapabilities, error) {
+	doc := &capabilities{
+		APIVersion: APIVersion,
+		Limits: capabilityLimits{
+			MaxInputBytes:       d.config.MaxUploadSize,
+			MaxInputBytesByType: d.sizeLimits,
+			MinInputBytes:       d.config.MinUploadSize,
+			MaxStoredBytes:      d.config.MaxStoredSize,
+			MaxWidth:            d.config.MaxWidth,
+			MaxHeight:           d.config.MaxHeight,
+		},
+		InputFormats:  inputFormats(),
+		OutputFormats: d.outputFormatNames(),
+		Options:       d.optionCapabilities(),
+		Profiles:      d.profileNames(),
+		Auth:          d.authModes(),
+		Features:      d.features(),
+	}
+	if d.passthroughBuckets {
+		doc.Limits.MaxPassthroughBytes = d.config.PassthroughMaxSize
+	}
+	if d.config.CapabilitiesBuckets {
+		doc.Buckets = d.capabilityBuckets()
+	}
+
+	// The maps get encoded with sorted keys, so the ETag is stable
+	body, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(body)
+	return &cachedCapabilities{body: body, etag: `"` + hex.EncodeToString(sum[:16]) + `"`}, nil
+}
+
+// invalidateCapabilities drops the cached capabilities, on reloads
+func (d *Deflator) invalidateCapabilities() {
+	d.capabilities.Store((*cachedCapabilities)(nil))
+}
+
+// capabilitiesHandler serves the capabilities, with an ETag for the clients
+// polling them
+func (d *Deflator) capabilitiesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeError(w, r, newRequestError(http.StatusMethodNotAllowed, ErrorCodeMethodNotAllowed, "Method not allowed"))
+		return
+	}
+
+	cached, _ := d.capabilities.Load().(*cachedCapabilities)
+	if cached == nil {
+		var err error
+		cached, err = d.buildCapabilities()
+		if err != nil {
+			log.Errorf("Failed to encode the capabilities: %s", err)
+			writeError(w, r, newRequestError(http.StatusInternalServerError, ErrorCodeInternal, "Internal error").withCause(err))
+			return
+		}
+		d.capabilities.Store(cached)
+	}
+
+	// ServeContent answers the If-None-Match requests with the ETag
+	w.Header().Set("ETag", cached.etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-Type", "application/json")
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(cached.body))
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/davidbyttow/govips/pkg/vips"
+)
+
+const (
+	// Values of the `text_position` option
+	TextPositionTop    = "top"
+	TextPositionCenter = "center"
+	TextPositionBottom = "bottom"
+
+	// TextMargin is the fraction of the image height kept free above or below
+	// captions at the top or the bottom
+	TextMargin = 0.05
+	// textLineHeight and textCharWidth approximate the size of the rendered
+	// text relative to the font size, to position captions vertically
+	textLineHeight = 1.25
+	textCharWidth  = 0.55
+)
+
+// textCaption is text rendered onto the image after it's been resized.
+// libvips renders it with Pango, which wraps the lines inside the text box.
+type textCaption struct {
+	text     string
+	font     string
+	position string
+	size     uint64
+	color    vips.Color
+}
+
+// parseTextColor parses colors like `ff0000` or `#ff0000`
+func parseTextColor(value string) (vips.Color, error) {
+	value = strings.TrimPrefix(value, "#")
+	if len(value) != 6 {
+		return vips.Color{}, fmt.Errorf("invalid color %q", value)
+	}
+
+	rgb, err := strconv.ParseUint(value, 16, 32)
+	if err != nil {
+		return vips.Color{}, fmt.Errorf("invalid color %q", value)
+	}
+
+	return vips.Color{R: uint8(rgb >> 16), G: uint8(rgb >> 8), B: uint8(rgb)}, nil
+}
+
+// sanitizeText drops the control characters from text, which Pango renders as
+// boxes, and replaces line breaks with spaces
+func sanitizeText(text string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r == '\n' || r == '\r' || r == '\t':
+			return ' '
+		case unicode.IsControl(r):
+			return -1
+		default:
+			return r
+		}
+	}, text)
+}
+
+// String describes the caption for cache keys
+func (c *textCaption) String() string {
+	if c == nil {
+		return ""
+	}
+	return fmt.Sprintf("%s|%s|%d|%02x%02x%02x|%s", c.font, c.position, c.size, c.color.R, c.color.G, c.color.B, c.text)
+}
+
+// estimateHeight approximates the height in pixels of the caption wrapped in
+// a box boxWidth pixels wide
+func (c *textCaption) estimateHeight(boxWidth int) int {
+	charsPerLine := math.Floor(float64(boxWidth) / (float64(c.size) * textCharWidth))
+	if charsPerLine < 1 {
+		charsPerLine = 1
+	}
+
+	lines := math.Ceil(float64(utf8.RuneCountInString(c.text)) / charsPerLine)
+	return int(lines * float64(c.size) * textLineHeight)
+}
+
+// label returns the libvips label parameters for an output image of the
+// specified size. The text box spans the image width minus the margins, and
+// captions which don't fit get clipped at the bottom edge.
+func (c *textCaption) label(width, height int) *vips.LabelParams {
+	boxWidth := int(float64(width) * (1 - 2*TextMargin))
+	margin := int(float64(height) * TextMargin)
+
+	offsetY := margin
+	switch c.position {
+	case TextPositionCenter:
+		offsetY = (height - c.estimateHeight(boxWidth)) / 2
+	case TextPositionBottom:
+		offsetY = height - margin - c.estimateHeight(boxWidth)
+	}
+	if offsetY < 0 {
+		offsetY = 0
+	}
+
+	params := &vips.LabelParams{
+		// The text is interpreted as Pango markup
+		Text:      html.EscapeString(c.text),
+		Font:      fmt.Sprintf("%s %d", c.font, c.size),
+		Color:     c.color,
+		Opacity:   1,
+		Alignment: vips.AlignCenter,
+	}
+	params.Width.SetInt(boxWidth)
+	params.Height.SetInt(height - offsetY)
+	params.OffsetX.SetInt((width - boxWidth) / 2)
+	params.OffsetY.SetInt(offsetY)
+
+	return params
+}
+
+// outputSize computes the size of an image of the specified size resized to
+// width and/or height, zero values keeping the aspect ratio
+func outputSize(sourceWidth, sourceHeight int, width, height uint64) (int, int) {
+	switch {
+	case width > 0 && height > 0:
+		return int(width), int(height)
+	case width > 0:
+		return int(width), int(math.Round(float64(sourceHeight) * float64(width) / float64(sourceWidth)))
+	case height > 0:
+		return int(math.Round(float64(sourceWidth) * float64(height) / float64(sourceHeight))), int(height)
+	default:
+		return sourceWidth, sourceHeight
+	}
+}
+
+// checkTextFont renders a caption with the configured font onto the test
+// image, so a libvips build without text support gets caught at startup
+func (d *Deflator) checkTextFont() error {
+	if d.config.TextFont == "" {
+		return nil
+	}
+
+	caption := &textCaption{text: "imgdeflator", font: d.config.TextFont, position: TextPositionTop, size: 4}
+	_, _, err := transformImage(testImage, 0, 0, nil, caption)
+	if err != nil {
+		return fmt.Errorf("failed to render text with font %q: %s", d.config.TextFont, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/davidbyttow/govips/pkg/vips"
+)
+
+var updateGolden = flag.Bool("update", false, "Update the golden files in testdata")
+
+// checkGolden compares output with the golden file name in testdata, or
+// replaces it with -update
+func checkGolden(t *testing.T, name string, output []byte) {
+	path := filepath.Join("testdata", name)
+	if *updateGolden {
+		err := ioutil.WriteFile(path, output, 0644)
+		if err != nil {
+			t.Fatalf("Failed to update %s: %s", path, err)
+		}
+		return
+	}
+
+	expected, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read %s: %s", path, err)
+	}
+	if !bytes.Equal(output, expected) {
+		t.Errorf("The output doesn't match %s (run the tests with -update if that's expected):\n%s", path, output)
+	}
+}
+
+func TestCaptionLabels(t *testing.T) {
+	long := "The quick brown fox jumps over the lazy dog, again and again, until the caption fills the whole card"
+
+	tests := []struct {
+		name          string
+		text          string
+		position      string
+		size          uint64
+		width, height int
+	}{
+		{"top", "Hello", TextPositionTop, 24, 400, 200},
+		{"center", "Hello", TextPositionCenter, 24, 400, 200},
+		{"bottom", "Hello", TextPositionBottom, 24, 400, 200},
+		{"wrapped top", long, TextPositionTop, 24, 400, 200},
+		{"wrapped center", long, TextPositionCenter, 24, 400, 200},
+		{"wrapped bottom", long, TextPositionBottom, 24, 400, 200},
+		{"overflowing center", long, TextPositionCenter, 48, 400, 200},
+		{"overflowing bottom", long, TextPositionBottom, 48, 400, 200},
+		{"narrow", "Hello", TextPositionBottom, 24, 10, 200},
+		{"tiny", "Hello", TextPositionTop, 12, 1, 1},
+		{"markup", "<b>Fish & Chips</b>", TextPositionCenter, 24, 400, 200},
+		{"non-latin", "日本語のキャプション", TextPositionBottom, 24, 400, 200},
+		{"emoji", "Launch day 🚀🚀🚀", TextPositionBottom, 24, 400, 200},
+	}
+
+	var output bytes.Buffer
+	for _, test := range tests {
+		caption := &textCaption{
+			text:     test.text,
+			font:     "DejaVu Sans",
+			position: test.position,
+			size:     test.size,
+			color:    vips.Color{R: 255, G: 255, B: 255},
+		}
+		label := caption.label(test.width, test.height)
+		fmt.Fprintf(&output, "%s (%dx%d): box %gx%g at %g,%g, font %q, text %q\n",
+			test.name, test.width, test.height,
+			label.Width.Value, label.Height.Value, label.OffsetX.Value, label.OffsetY.Value,
+			label.Font, label.Text,
+		)
+
+		// The box always stays inside the image
+		if label.OffsetY.Value < 0 || label.OffsetY.Value+label.Height.Value > float64(test.height) ||
+			label.OffsetX.Value < 0 || label.OffsetX.Value+label.Width.Value > float64(test.width) {
+			t.Errorf("%s: the text box %+v is outside the %dx%d image", test.name, label, test.width, test.height)
+		}
+	}
+
+	checkGolden(t, "captions.golden", output.Bytes())
+}
+
+func TestSanitizeText(t *testing.T) {
+	tests := []struct {
+		text, sanitized string
+	}{
+		{"Hello", "Hello"},
+		{"Two\nlines", "Two lines"},
+		{"Tab\tand\r\nbreak", "Tab and  break"},
+		{"Bell\a and null\x00", "Bell and null"},
+		{"日本語", "日本語"},
+	}
+
+	for _, test := range tests {
+		if sanitized := sanitizeText(test.text); sanitized != test.sanitized {
+			t.Errorf("Expected %q for %q, got %q", test.sanitized, test.text, sanitized)
+		}
+	}
+}
+
+func TestParseTextColor(t *testing.T) {
+	color, err := parseTextColor("#FF8000")
+	if err != nil || color != (vips.Color{R: 255, G: 128, B: 0}) {
+		t.Errorf("Expected orange, got %+v (%v)", color, err)
+	}
+
+	for _, value := range []string{"", "fff", "#ff80001", "gg0000", "#-12345"} {
+		if _, err := parseTextColor(value); err == nil {
+			t.Errorf("Expected %q to be rejected", value)
+		}
+	}
+}
+
+func TestCaptionString(t *testing.T) {
+	var caption *textCaption
+	if caption.String() != "" {
+		t.Errorf("Expected no description without caption")
+	}
+
+	caption = &textCaption{text: "Hello", font: "Sans", position: TextPositionTop, size: 12, color: vips.Color{R: 1, G: 2, B: 3}}
+	if s := caption.String(); s != "Sans|top|12|010203|Hello" {
+		t.Errorf("Unexpected description %q", s)
+	}
+	if strings.Contains((&textCaption{text: "Hello", size: 13}).String(), "|12|") {
+		t.Errorf("Expected the size to change the description")
+	}
+}
+
+func TestOutputSize(t *testing.T) {
+	tests := []struct {
+		sourceWidth, sourceHeight int
+		width, height             uint64
+		outputWidth, outputHeight int
+	}{
+		{400, 200, 0, 0, 400, 200},
+		{400, 200, 100, 0, 100, 50},
+		{400, 200, 0, 100, 200, 100},
+		{400, 200, 100, 100, 100, 100},
+		{3, 2, 2, 0, 2, 1},
+	}
+
+	for _, test := range tests {
+		width, height := outputSize(test.sourceWidth, test.sourceHeight, test.width, test.height)
+		if width != test.outputWidth || height != test.outputHeight {
+			t.Errorf("Expected %dx%d for %dx%d resized to %dx%d, got %dx%d", test.outputWidth, test.outputHeight,
+				test.sourceWidth, test.sourceHeight, test.width, test.height, width, height)
+		}
+	}
+}
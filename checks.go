@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/s3manager"
+	"github.com/davidbyttow/govips/pkg/vips"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// CanaryKeyName is appended to the allowed prefix of each destination when
+	// writing canary objects
+	CanaryKeyName = ".imgdeflator-canary.png"
+)
+
+// testImage is a tiny 8x8 PNG used to exercise the image pipeline
+var testImage, _ = base64.StdEncoding.DecodeString(
+	"iVBORw0KGgoAAAANSUhEUgAAAAgAAAAICAIAAABLbSncAAAAGUlEQVR4nGJhYGhQYGDARCwgAhsYnBKAAQBqxwJhq0KzfgAAAABJRU5ErkJggg==",
+)
+
+// checkResult is the outcome of a single self-test check
+type checkResult struct {
+	Name  string `json:"name"`
+	Error string `json:"error,omitempty"`
+	// Detail is an optional description of the outcome
+	Detail interface{} `json:"detail,omitempty"`
+}
+
+// allowedBuckets returns the distinct buckets from the AllowedDestinations
+// together with the first allowed prefix for each of them
+func (d *Deflator) allowedBuckets() map[string]string {
+	buckets := make(map[string]string)
+	for _, entry := range d.config.AllowedDestinations {
+		bucket, prefix := entry, ""
+		if i := strings.Index(entry, "/"); i >= 0 {
+			bucket, prefix = entry[:i], entry[i+1:]
+		}
+
+		if _, ok := buckets[bucket]; !ok {
+			buckets[bucket] = prefix
+		}
+	}
+
+	return buckets
+}
+
+// runChecks verifies that the AWS credentials can be resolved, that every
+// allowed bucket is reachable and that the image pipeline works. When
+// writeCanary is set, a canary object is also uploaded to and deleted from
+// each allowed bucket.
+func (d *Deflator) runChecks(ctx context.Context, writeCanary bool) []checkResult {
+	var results []checkResult
+	record := func(name string, err error) {
+		result := checkResult{Name: name}
+		if err != nil {
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+
+	record("aws credentials", checkCredentials())
+	record("resources", d.resources.err())
+
+	buf, err := checkPipeline()
+	record("image pipeline", err)
+
+	allowedBuckets := d.allowedBuckets()
+	bucketNames := make([]string, 0, len(allowedBuckets))
+	for bucket := range allowedBuckets {
+		bucketNames = append(bucketNames, bucket)
+	}
+	sort.Strings(bucketNames)
+
+	for _, bucket := range bucketNames {
+		prefix := allowedBuckets[bucket]
+		uploader, err := getS3Uploader(ctx, bucket, "", d.config.DefaultS3Region, d.endpointOptions(bucket))
+		if err == nil {
+			req := uploader.S3.HeadBucketRequest(&s3.HeadBucketInput{Bucket: aws.String(bucket)})
+			req.SetContext(ctx)
+			_, err = req.Send()
+		}
+		record(fmt.Sprintf("bucket %q", bucket), err)
+
+		if writeCanary && err == nil && buf != nil {
+			record(
+				fmt.Sprintf("canary upload to bucket %q", bucket),
+				checkCanary(ctx, uploader, bucket, prefix+CanaryKeyName, buf),
+			)
+		}
+	}
+
+	return results
+}
+
+// selfCheck resolves the AWS credentials like at startup, then runs the
+// checks, failing the credentials check if they couldn't be resolved
+func (d *Deflator) selfCheck(ctx context.Context, allowAnonymous, writeCanary bool) []checkResult {
+	credentialsErr := initCredentials(allowAnonymous)
+	results := d.runChecks(ctx, writeCanary)
+	if credentialsErr != nil {
+		for i := range results {
+			if results[i].Name == "aws credentials" {
+				results[i].Error = credentialsErr.Error()
+			}
+		}
+	}
+
+	return results
+}
+
+// checkCredentials makes sure that the default AWS config provides credentials,
+// unless anonymous requests are allowed
+func checkCredentials() error {
+	// Unsigned requests don't need any
+	if sharedCredentials != nil && sharedCredentials.anonymous {
+		return nil
+	}
+
+	awsCfg, err := loadAWSConfig()
+	if err != nil {
+		return err
+	}
+
+	_, err = awsCfg.Credentials.Retrieve()
+	if err != nil {
+		return fmt.Errorf("could not retrieve credentials: %s", err)
+	}
+
+	return nil
+}
+
+// checkPipeline runs the test image through the decode/transform/encode pipeline
+func checkPipeline() ([]byte, error) {
+	buf, _, err := vips.NewTransform().
+		Load(bytes.NewReader(testImage)).
+		ResizeStrategy(vips.ResizeStrategyCrop).
+		ResizeWidth(4).
+		Apply()
+	if err != nil {
+		return nil, fmt.Errorf("failed to resize the test image: %s", err)
+	}
+
+	return buf, nil
+}
+
+// checkCanary uploads a canary object and deletes it afterwards
+func checkCanary(ctx context.Context, uploader *s3manager.Uploader, bucket, key string, body []byte) error {
+	_, err := uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+		Body:        bytes.NewReader(body),
+		Bucket:      aws.String(bucket),
+		ContentType: aws.String("image/png"),
+		Key:         aws.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload %q: %s", key, err)
+	}
+
+	req := uploader.S3.DeleteObjectRequest(&s3.DeleteObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	req.SetContext(ctx)
+	_, err = req.Send()
+	if err != nil {
+		return fmt.Errorf("failed to delete %q: %s", key, err)
+	}
+
+	return nil
+}
+
+// checksFailed returns true if any of the results is a failure
+func checksFailed(results []checkResult) bool {
+	for _, result := range results {
+		if result.Error != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// printCheckReport writes a human-readable report of the check results
+func printCheckReport(out io.Writer, results []checkResult) {
+	for _, result := range results {
+		if result.Error != "" {
+			fmt.Fprintf(out, "FAIL  %s: %s\n", result.Name, result.Error)
+		} else {
+			fmt.Fprintf(out, "OK    %s\n", result.Name)
+		}
+	}
+}
+
+// readinessChecks are the checks of every readiness probe. They only look at
+// the state of this process: the buckets and the image pipeline are left to
+// the `check` command, so a single unreachable bucket, or a slow one, doesn't
+// take every instance out of rotation.
+func (d *Deflator) readinessChecks() []checkResult {
+	var results []checkResult
+	record := func(name string, err error) {
+		result := checkResult{Name: name}
+		if err != nil {
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+
+	// The state refreshed in the background by the credentialGuard
+	record("aws credentials", sharedCredentials.err())
+	record("resources", d.resources.err())
+
+	return results
+}
+
+// ReadinessHandler reports whether the service can serve requests, from the
+// state of the credentials and of the resources, plus the last canary result
+func (d *Deflator) ReadinessHandler(w http.ResponseWriter, r *http.Request) {
+	if d.isDraining() {
+		// Until the load balancers deregister the instance
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_ = json.NewEncoder(w).Encode([]checkResult{{Name: "shutdown", Error: "shutting down"}})
+		return
+	}
+
+	results := d.readinessChecks()
+	if canary, ok := d.canaryCheck(); ok {
+		results = append(results, canary)
+	}
+	if maintenance, ok := d.maintenanceCheck(); ok {
+		results = append(results, maintenance)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if checksFailed(results) {
+		log.Warnf("Readiness check failed: %+v", results)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	_ = json.NewEncoder(w).Encode(results)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// credentialsCheck returns the result of the credentials check in results
+func credentialsCheck(t *testing.T, results []checkResult) checkResult {
+	for _, result := range results {
+		if result.Name == "aws credentials" {
+			return result
+		}
+	}
+	t.Fatalf("No credentials check in %+v", results)
+	return checkResult{}
+}
+
+// withoutCredentials runs fn without the AWS credentials of the environment
+func withoutCredentials(t *testing.T, fn func()) {
+	keyID, secret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	os.Unsetenv("AWS_ACCESS_KEY_ID")
+	os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+	// loadAWSConfig would pick up the credentials resolved so far
+	sharedCredentials = nil
+	defer func() {
+		sharedCredentials = nil
+		os.Setenv("AWS_ACCESS_KEY_ID", keyID)
+		os.Setenv("AWS_SECRET_ACCESS_KEY", secret)
+		err := initCredentials(false)
+		if err != nil {
+			t.Fatalf("Failed to restore the AWS credentials: %s", err)
+		}
+	}()
+
+	fn()
+}
+
+func TestSelfCheckCredentials(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.close()
+
+	result := credentialsCheck(t, s.deflator.selfCheck(context.Background(), false, false))
+	if result.Error != "" {
+		t.Errorf("Expected the credentials check to pass, got %q", result.Error)
+	}
+
+	withoutCredentials(t, func() {
+		result := credentialsCheck(t, s.deflator.selfCheck(context.Background(), false, false))
+		if !strings.Contains(result.Error, "no AWS credentials found") {
+			t.Errorf("Expected the credentials check to fail, got %q", result.Error)
+		}
+
+		result = credentialsCheck(t, s.deflator.selfCheck(context.Background(), true, false))
+		if result.Error != "" {
+			t.Errorf("Expected anonymous requests to pass the credentials check, got %q", result.Error)
+		}
+	})
+}
+
+// unreadBody is an upload body which must not be read
+type unreadBody struct {
+	t *testing.T
+}
+
+func (b unreadBody) Read([]byte) (int, error) {
+	b.t.Errorf("Expected the body not to be read")
+	return 0, io.EOF
+}
+
+func TestUploadWithoutCredentials(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.close()
+
+	shared := sharedCredentials
+	sharedCredentials = &credentialGuard{failing: 1, available: new(expvar.Int)}
+	defer func() { sharedCredentials = shared }()
+
+	// The error comes before the empty body check would read it
+	req := &uploadRequest{bucket: TestBucket, key: "photo.png", width: 16, body: unreadBody{t}}
+	_, err := s.deflator.upload(context.Background(), req)
+	if code := errorCode(err); code != ErrorCodeStorageCredentialsUnavailable {
+		t.Errorf("Expected the %s code, got %s", ErrorCodeStorageCredentialsUnavailable, code)
+	}
+}
+
+func TestReadiness(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.close()
+	// Not even an unreachable bucket fails the probes, which don't call S3
+	s.deflator.config.AllowedDestinations = append(s.deflator.config.AllowedDestinations, "missing-bucket")
+	var requests int32
+	s.fake.SetFault(func(*http.Request) int {
+		atomic.AddInt32(&requests, 1)
+		return http.StatusInternalServerError
+	})
+
+	ready := func() int {
+		w := httptest.NewRecorder()
+		s.deflator.ReadinessHandler(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		return w.Code
+	}
+	if status := ready(); status != http.StatusOK {
+		t.Errorf("Expected the instance to be ready, got %d", status)
+	}
+	if n := atomic.LoadInt32(&requests); n != 0 {
+		t.Errorf("Expected the probe not to call S3, got %d requests", n)
+	}
+
+	shared := sharedCredentials
+	sharedCredentials = &credentialGuard{failing: 1, available: new(expvar.Int)}
+	defer func() { sharedCredentials = shared }()
+	if status := ready(); status != http.StatusServiceUnavailable {
+		t.Errorf("Expected the instance not to be ready without credentials, got %d", status)
+	}
+}
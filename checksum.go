@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+	"github.com/aws/aws-sdk-go-v2/service/s3/s3manager"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Values of ChecksumAlgorithm, the additional checksums S3 validates
+	ChecksumCRC32C = "CRC32C"
+	ChecksumSHA1   = "SHA1"
+	ChecksumSHA256 = "SHA256"
+)
+
+// checksumUnsupported remembers the buckets whose endpoint rejected the
+// additional checksums, which don't get sent to them anymore
+var checksumUnsupported sync.Map
+
+// uploadChecksum is the additional checksum of a stored object
+type uploadChecksum struct {
+	Algorithm string `json:"algorithm"`
+	// Value is the base64 encoded checksum, as S3 reports it
+	Value string `json:"value"`
+}
+
+// newChecksumHash returns the hash of algorithm, or nil if it isn't supported
+func newChecksumHash(algorithm string) hash.Hash {
+	switch algorithm {
+	case ChecksumCRC32C:
+		return crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	case ChecksumSHA1:
+		return sha1.New()
+	case ChecksumSHA256:
+		return sha256.New()
+	}
+	return nil
+}
+
+// validateChecksumAlgorithm checks the ChecksumAlgorithm setting
+func validateChecksumAlgorithm(algorithm string) error {
+	if algorithm != "" && newChecksumHash(algorithm) == nil {
+		return fmt.Errorf("invalid checksum algorithm %q (expected %s, %s or %s)", algorithm, ChecksumCRC32C, ChecksumSHA1, ChecksumSHA256)
+	}
+	return nil
+}
+
+// computeChecksum returns the algorithm checksum of payload
+func computeChecksum(algorithm string, payload []byte) *uploadChecksum {
+	h := newChecksumHash(algorithm)
+	h.Write(payload)
+	return &uploadChecksum{Algorithm: algorithm, Value: base64.StdEncoding.EncodeToString(h.Sum(nil))}
+}
+
+// header is the header carrying the checksum, e.g. `x-amz-checksum-crc32c`
+func (c *uploadChecksum) header() string {
+	return "X-Amz-Checksum-" + strings.ToLower(c.Algorithm)
+}
+
+// uploadOption sends the checksum with the PutObject requests, for S3 to
+// validate, and sets acknowledged if the response returns it. The SDK
+// doesn't know about the additional checksums, so they're plain headers.
+func (c *uploadChecksum) uploadOption(acknowledged *int32) func(*s3manager.Uploader) {
+	return s3manager.WithUploaderRequestOptions(func(r *aws.Request) {
+		if r.Operation.Name != "PutObject" {
+			return
+		}
+		r.HTTPRequest.Header.Set(c.header(), c.Value)
+		r.Handlers.Complete.PushBack(func(r *aws.Request) {
+			if r.Error == nil && r.HTTPResponse != nil && r.HTTPResponse.Header.Get(c.header()) == c.Value {
+				atomic.StoreInt32(acknowledged, 1)
+			}
+		})
+	})
+}
+
+// isChecksumUnsupportedError checks if err is how an endpoint rejects the
+// checksum headers it doesn't know. BadDigest, for checksums which don't
+// match, is a genuine failure.
+func isChecksumUnsupportedError(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	if !ok {
+		return false
+	}
+	switch aerr.Code() {
+	case "NotImplemented":
+		return true
+	case "InvalidArgument", "InvalidRequest":
+		return strings.Contains(strings.ToLower(aerr.Message()), "checksum")
+	}
+	return false
+}
+
+// checksumUpload returns the checksum of the payload of req, if an
+// algorithm is configured, with the upload option sending it to S3. The
+// checksum isn't sent for the multipart uploads, which only have per part
+// checksums, nor to the endpoints which rejected it, and S3 doesn't
+// validate it then.
+func (d *Deflator) checksumUpload(ctx context.Context, req *uploadRequest, uploader *s3manager.Uploader, payload []byte, acknowledged *int32) (*uploadChecksum, []func(*s3manager.Uploader)) {
+	if d.config.ChecksumAlgorithm == "" || d.endpointOptions(req.bucket).filesystemRoot != "" {
+		return nil, nil
+	}
+
+	checksum := computeChecksum(d.config.ChecksumAlgorithm, payload)
+	if _, ok := checksumUnsupported.Load(req.bucket); ok || int64(len(payload)) >= uploader.PartSize {
+		addWarning(ctx, req.bucket, WarningChecksumUnvalidated)
+		return checksum, nil
+	}
+	return checksum, []func(*s3manager.Uploader){checksum.uploadOption(acknowledged)}
+}
+
+// disableChecksums stops sending the checksums to bucket, whose endpoint
+// rejected them with err
+func disableChecksums(bucket string, err error) {
+	if _, loaded := checksumUnsupported.LoadOrStore(bucket, true); !loaded {
+		log.Warnf("The endpoint of bucket %q doesn't support the additional checksums, uploading without them: %s", bucket, err)
+	}
+}
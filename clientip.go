@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// parseCIDRs parses a list of CIDRs. Plain IP addresses are accepted as
+// single-address networks.
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", cidr)
+			}
+
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %s", cidr, err)
+		}
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+// containsIP checks if ip belongs to any of the networks
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseForwardedFor extracts the `for` addresses from an RFC 7239 Forwarded header
+func parseForwardedFor(header string) []string {
+	var addrs []string
+	for _, element := range strings.Split(header, ",") {
+		for _, pair := range strings.Split(element, ";") {
+			pair = strings.TrimSpace(pair)
+			if len(pair) < 4 || !strings.EqualFold(pair[:4], "for=") {
+				continue
+			}
+
+			addr := strings.Trim(pair[4:], `"`)
+			// IPv6 addresses are quoted and bracketed, optionally with a port
+			if strings.HasPrefix(addr, "[") {
+				if end := strings.Index(addr, "]"); end > 0 {
+					addr = addr[1:end]
+				}
+			} else if host, _, err := net.SplitHostPort(addr); err == nil {
+				addr = host
+			}
+			addrs = append(addrs, addr)
+		}
+	}
+
+	return addrs
+}
+
+// clientIP returns the IP address of the client which sent r. The
+// X-Forwarded-For and Forwarded headers are only taken into account when the
+// immediate peer is a trusted proxy, in which case the client is the
+// rightmost address in the chain which isn't a trusted proxy itself.
+func (d *Deflator) clientIP(r *http.Request) string {
+	peer, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		peer = r.RemoteAddr
+	}
+
+	peerIP := net.ParseIP(peer)
+	if peerIP == nil || !containsIP(d.trustedProxies, peerIP) {
+		return peer
+	}
+
+	var chain []string
+	for _, header := range r.Header["X-Forwarded-For"] {
+		for _, addr := range strings.Split(header, ",") {
+			chain = append(chain, strings.TrimSpace(addr))
+		}
+	}
+	if len(chain) == 0 {
+		for _, header := range r.Header["Forwarded"] {
+			chain = append(chain, parseForwardedFor(header)...)
+		}
+	}
+
+	client := peer
+	for i := len(chain) - 1; i >= 0; i-- {
+		ip := net.ParseIP(chain[i])
+		if ip == nil {
+			// Anything past a malformed entry can't be trusted
+			break
+		}
+
+		client = ip.String()
+		if !containsIP(d.trustedProxies, ip) {
+			break
+		}
+	}
+
+	return client
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// newClientIPDeflator returns a Deflator trusting the proxies
+func newClientIPDeflator(t *testing.T, proxies ...string) *Deflator {
+	trustedProxies, err := parseCIDRs(proxies)
+	if err != nil {
+		t.Fatalf("Failed to parse the trusted proxies: %s", err)
+	}
+	return &Deflator{trustedProxies: trustedProxies}
+}
+
+func TestParseCIDRs(t *testing.T) {
+	networks, err := parseCIDRs([]string{"10.0.0.0/8", " 192.168.1.1 ", "", "::1", "2001:db8::/32"})
+	if err != nil {
+		t.Fatalf("Failed to parse the CIDRs: %s", err)
+	}
+
+	tests := []struct {
+		ip       string
+		contains bool
+	}{
+		{"10.1.2.3", true},
+		{"11.1.2.3", false},
+		{"192.168.1.1", true},
+		{"192.168.1.2", false},
+		{"::1", true},
+		{"2001:db8::1", true},
+		{"2001:db9::1", false},
+	}
+	for _, test := range tests {
+		if containsIP(networks, net.ParseIP(test.ip)) != test.contains {
+			t.Errorf("Expected %s to be contained: %t", test.ip, test.contains)
+		}
+	}
+
+	for _, cidr := range []string{"10.0.0.0/33", "10.0.0", "not an ip"} {
+		_, err := parseCIDRs([]string{cidr})
+		if err == nil {
+			t.Errorf("Expected %q to be rejected", cidr)
+		}
+	}
+}
+
+func TestParseForwardedFor(t *testing.T) {
+	tests := []struct {
+		header string
+		addrs  []string
+	}{
+		{"for=192.0.2.60;proto=http;by=203.0.113.43", []string{"192.0.2.60"}},
+		{"for=192.0.2.43, for=198.51.100.17", []string{"192.0.2.43", "198.51.100.17"}},
+		{`For="[2001:db8:cafe::17]:4711"`, []string{"2001:db8:cafe::17"}},
+		{"for=192.0.2.43:8080", []string{"192.0.2.43"}},
+		{"proto=https;by=203.0.113.43", nil},
+	}
+
+	for _, test := range tests {
+		addrs := parseForwardedFor(test.header)
+		if len(addrs) != len(test.addrs) {
+			t.Errorf("Expected %q from %q, got %q", test.addrs, test.header, addrs)
+			continue
+		}
+		for i := range addrs {
+			if addrs[i] != test.addrs[i] {
+				t.Errorf("Expected %q from %q, got %q", test.addrs, test.header, addrs)
+				break
+			}
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	d := newClientIPDeflator(t, "10.0.0.0/8", "2001:db8::/32")
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    http.Header
+		clientIP   string
+	}{
+		{"no proxy", "203.0.113.7:1234", nil, "203.0.113.7"},
+		{"spoofed from untrusted peer", "203.0.113.7:1234",
+			http.Header{"X-Forwarded-For": {"198.51.100.1"}}, "203.0.113.7"},
+		{"spoofed Forwarded from untrusted peer", "203.0.113.7:1234",
+			http.Header{"Forwarded": {"for=198.51.100.1"}}, "203.0.113.7"},
+		{"trusted proxy", "10.0.0.1:1234",
+			http.Header{"X-Forwarded-For": {"198.51.100.1"}}, "198.51.100.1"},
+		{"trusted proxy without header", "10.0.0.1:1234", nil, "10.0.0.1"},
+		{"spoofed chain behind trusted proxy", "10.0.0.1:1234",
+			http.Header{"X-Forwarded-For": {"1.2.3.4, 198.51.100.1"}}, "198.51.100.1"},
+		{"trusted proxy chain", "10.0.0.1:1234",
+			http.Header{"X-Forwarded-For": {"198.51.100.1, 10.0.0.2, 10.0.0.3"}}, "198.51.100.1"},
+		{"repeated headers", "10.0.0.1:1234",
+			http.Header{"X-Forwarded-For": {"1.2.3.4", "198.51.100.1, 10.0.0.2"}}, "198.51.100.1"},
+		{"only trusted proxies", "10.0.0.1:1234",
+			http.Header{"X-Forwarded-For": {"10.0.0.2, 10.0.0.3"}}, "10.0.0.2"},
+		{"malformed entry", "10.0.0.1:1234",
+			http.Header{"X-Forwarded-For": {"198.51.100.1, garbage, 10.0.0.2"}}, "10.0.0.2"},
+		{"forwarded", "10.0.0.1:1234",
+			http.Header{"Forwarded": {"for=1.2.3.4, for=198.51.100.1;proto=https"}}, "198.51.100.1"},
+		{"X-Forwarded-For takes precedence", "10.0.0.1:1234",
+			http.Header{"X-Forwarded-For": {"198.51.100.1"}, "Forwarded": {"for=198.51.100.2"}}, "198.51.100.1"},
+		{"IPv6 proxy", "[2001:db8::1]:1234",
+			http.Header{"Forwarded": {`for="[2001:db9::2]:4711"`}}, "2001:db9::2"},
+		{"remote address without port", "203.0.113.7", nil, "203.0.113.7"},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+		r.RemoteAddr = test.remoteAddr
+		for name, values := range test.headers {
+			r.Header[name] = values
+		}
+
+		if clientIP := d.clientIP(r); clientIP != test.clientIP {
+			t.Errorf("%s: expected %s, got %s", test.name, test.clientIP, clientIP)
+		}
+	}
+}
+
+func TestIPFilterClientIP(t *testing.T) {
+	d := newClientIPDeflator(t, "10.0.0.0/8")
+	deny, err := parseCIDRs([]string{"198.51.100.1"})
+	if err != nil {
+		t.Fatalf("Failed to parse the denylist: %s", err)
+	}
+	d.ipFilter.Store(&ipFilter{deny: deny})
+
+	var served int64
+	handler := d.ipFilterHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&served, 1)
+	}))
+
+	tests := []struct {
+		remoteAddr   string
+		forwardedFor string
+		status       int
+	}{
+		// The denied client behind the proxy
+		{"10.0.0.1:1234", "198.51.100.1", http.StatusForbidden},
+		// The denied client spoofing another address in front of the proxy
+		{"10.0.0.1:1234", "203.0.113.7, 198.51.100.1", http.StatusForbidden},
+		// Another client pretending to be denied directly
+		{"203.0.113.7:1234", "198.51.100.1", http.StatusOK},
+		// The denied client pretending to be proxied
+		{"198.51.100.1:1234", "203.0.113.7", http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+		r.RemoteAddr = test.remoteAddr
+		r.Header.Set("X-Forwarded-For", test.forwardedFor)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("Expected %d from %s for %s, got %d", test.status, test.remoteAddr, test.forwardedFor, w.Code)
+		}
+	}
+	if served != 1 {
+		t.Errorf("Expected a single request to be served, got %d", served)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// coalescedCall is an upload which identical concurrent requests wait for
+type coalescedCall struct {
+	done   chan struct{}
+	result *uploadResult
+	err    error
+}
+
+// uploadCoalescer runs a single upload for concurrent identical requests.
+// The zero value is ready to use.
+type uploadCoalescer struct {
+	sync.Mutex
+	calls map[string]*coalescedCall
+}
+
+// do runs fn unless an upload with the same digest is already in progress,
+// in which case it waits for that one and returns its outcome, with the
+// result marked as coalesced
+func (c *uploadCoalescer) do(digest string, fn func() (*uploadResult, error)) (*uploadResult, error) {
+	c.Lock()
+	if c.calls == nil {
+		c.calls = make(map[string]*coalescedCall)
+	}
+	if call, ok := c.calls[digest]; ok {
+		c.Unlock()
+		<-call.done
+
+		if call.err != nil {
+			return nil, call.err
+		}
+		result := *call.result
+		result.Coalesced = true
+		result.shadowed = false
+		return &result, nil
+	}
+
+	call := &coalescedCall{done: make(chan struct{})}
+	c.calls[digest] = call
+	c.Unlock()
+
+	call.result, call.err = fn()
+
+	c.Lock()
+	delete(c.calls, digest)
+	c.Unlock()
+	close(call.done)
+
+	return call.result, call.err
+}
+
+// uploadDigest identifies identical upload requests by their destination,
+// transform parameters and the hash of the body, so different bodies racing
+// for the same key don't get coalesced
+func uploadDigest(req *uploadRequest, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+
+	template := ""
+	if req.keyTemplate != nil {
+		template = req.keyTemplate.raw
+	}
+
+	// The echo headers end up in the object metadata
+	echo := make([]string, 0, len(req.echo))
+	for name, value := range req.echo {
+		echo = append(echo, name+"="+value)
+	}
+	sort.Strings(echo)
+
+	hash := sha256.Sum256([]byte(fmt.Sprintf(
+		"%s\x00%s\x00%d\x00%d\x00%d\x00%s\x00%s\x00%s\x00%v\x00%t\x00%s\x00%t\x00%q\x00%t\x00%q\x00%t\x00%x",
+		req.bucket, req.key, req.width, req.height, req.ttl, template, req.contentType, req.caption, req.redactions, req.keepOriginal, req.collision, req.canary, echo, req.echoImage, req.siblings, req.stripMetadata, bodyHash,
+	)))
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+	"github.com/aws/aws-sdk-go-v2/service/s3/s3manager"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Values of the `collision` option, which decides what happens to uploads
+	// whose key is already taken
+	CollisionOverwrite = "overwrite"
+	CollisionError     = "error"
+	CollisionSuffix    = "suffix"
+)
+
+func isCollisionStrategy(value string) bool {
+	switch value {
+	case CollisionOverwrite, CollisionError, CollisionSuffix:
+		return true
+	default:
+		return false
+	}
+}
+
+// suffixedKey inserts `-<n>` before the extension of key, if any, e.g.
+// `a/b-2.jpg`. The key is unchanged for n = 0.
+func suffixedKey(key string, n int) string {
+	if n == 0 {
+		return key
+	}
+
+	// Dotfiles like `a/.hidden` don't have an extension
+	ext := path.Ext(key)
+	if ext == key[strings.LastIndex(key, "/")+1:] {
+		ext = ""
+	}
+	return strings.TrimSuffix(key, ext) + "-" + strconv.Itoa(n) + ext
+}
+
+// ifNoneMatchAny makes S3 refuse to replace existing objects. Multipart
+// uploads are only checked when they get completed.
+func ifNoneMatchAny(r *aws.Request) {
+	switch r.Operation.Name {
+	case "PutObject", "CompleteMultipartUpload":
+		r.HTTPRequest.Header.Set("If-None-Match", "*")
+	}
+}
+
+// noOverwrite is the upload option of the `error` and `suffix` strategies
+var noOverwrite = s3manager.WithUploaderRequestOptions(ifNoneMatchAny)
+
+// isPreconditionFailedError checks if err is the AWS error returned for
+// conditional writes to keys which got taken in the mean time
+func isPreconditionFailedError(err error) bool {
+	// s3manager wraps the errors of multipart uploads
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "MultipartUpload" {
+		err = aerr.OrigErr()
+	}
+	code := awsErrorCode(err)
+	return code == "PreconditionFailed" || code == "ConditionalRequestConflict"
+}
+
+func collisionError(key string) error {
+	return newRequestError(http.StatusConflict, ErrorCodeAlreadyExists, "Object %q already exists", key)
+}
+
+// freeKey probes key and up to CollisionSuffixAttempts suffixed variants,
+// starting with suffix n, and returns the first one which doesn't exist with
+// its suffix. The `error` strategy only probes key itself.
+func (d *Deflator) freeKey(ctx context.Context, uploader *s3manager.Uploader, bucket, key, strategy string, n int) (string, int, error) {
+	for ; n <= d.config.CollisionSuffixAttempts; n++ {
+		candidate := suffixedKey(key, n)
+		err := sanitizeKey(candidate)
+		if err != nil {
+			return "", 0, newRequestError(http.StatusBadRequest, ErrorCodeInvalidKey, "Invalid key: %s", err)
+		}
+
+		_, err = headObject(ctx, uploader, bucket, candidate)
+		switch {
+		case isNotFoundError(err):
+			return candidate, n, nil
+		case err != nil:
+			log.Warnf("Failed to check whether %q exists: %s", (&s3Location{bucket: bucket, key: candidate}).logString(), err)
+			return "", 0, newRequestError(http.StatusServiceUnavailable, ErrorCodeStorageUnavailable, "Internal error").withCause(err)
+		case strategy != CollisionSuffix:
+			return "", 0, collisionError(candidate)
+		}
+	}
+
+	log.Debugf("No free key for %q after %d attempts", (&s3Location{bucket: bucket, key: key}).logString(), n)
+	return "", 0, newRequestError(http.StatusConflict, ErrorCodeAlreadyExists, "Object %q and its %d suffixed variants already exist", key, n-1)
+}
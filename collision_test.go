@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"sync"
+	"testing"
+)
+
+// winningKeys are the objects of the concurrent upload which takes photo.png
+var winningKeys = []string{"photo.png", "photo.png.orig", "photo.png.webp"}
+
+// raceUpload makes another upload store winningKeys between the probe of
+// photo.png and its conditional upload
+func raceUpload(s *testServer) {
+	var once sync.Once
+	s.fake.SetFault(func(r *http.Request) int {
+		if r.Method == http.MethodPut && r.URL.Path == "/"+TestBucket+"/photo.png" && r.Header.Get("If-None-Match") == "*" {
+			once.Do(func() {
+				for _, key := range winningKeys {
+					s.putObject(key, []byte("winner"))
+				}
+			})
+		}
+		return 0
+	})
+}
+
+// checkWinner checks that the objects of the concurrent upload are intact
+func checkWinner(t *testing.T, s *testServer) {
+	for _, key := range winningKeys {
+		object, ok := s.fake.Object(TestBucket, key)
+		if !ok || string(object.Body) != "winner" {
+			t.Errorf("Expected %s to be left to the upload which took the key", key)
+		}
+	}
+}
+
+func TestCollisionRaceError(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.close()
+	raceUpload(s)
+
+	resp := s.post("photo.png", "width=16&collision=error&keep_original=1&siblings=webp", bytes.NewReader(testPNG(t, 32, 32)))
+	if code := decodeError(t, resp, http.StatusConflict).Code; code != ErrorCodeAlreadyExists {
+		t.Errorf("Expected the %s code, got %s", ErrorCodeAlreadyExists, code)
+	}
+	checkWinner(t, s)
+	if keys := s.fake.Keys(TestBucket); len(keys) != len(winningKeys) {
+		t.Errorf("Expected only the objects of the other upload, got %q", keys)
+	}
+}
+
+func TestCollisionRaceSuffix(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.close()
+	raceUpload(s)
+
+	resp := s.post("photo.png", "width=16&collision=suffix&keep_original=1&siblings=webp", bytes.NewReader(testPNG(t, 32, 32)))
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the upload to take the next key, got %d: %s", resp.StatusCode, body)
+	}
+	var result uploadResult
+	err := json.Unmarshal(body, &result)
+	if err != nil {
+		t.Fatalf("Failed to decode the upload result %q: %s", body, err)
+	}
+	if result.Key != "photo-1.png" || result.Original == nil || result.Original.Key != "photo-1.png.orig" || len(result.Siblings) != 1 || result.Siblings[0].Key != "photo-1.png.webp" {
+		t.Errorf("Expected the objects to be stored under photo-1.png, got %s", body)
+	}
+
+	checkWinner(t, s)
+	keys := s.fake.Keys(TestBucket)
+	sort.Strings(keys)
+	expected := []string{"photo-1.png", "photo-1.png.orig", "photo-1.png.webp", "photo.png", "photo.png.orig", "photo.png.webp"}
+	if len(keys) != len(expected) {
+		t.Fatalf("Expected %q, got %q", expected, keys)
+	}
+	for i := range keys {
+		if keys[i] != expected[i] {
+			t.Errorf("Expected %q, got %q", expected, keys)
+			break
+		}
+	}
+}
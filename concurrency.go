@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// concurrencyLimits is a gauge of the current upload concurrency limit per bucket
+	concurrencyLimits = newBucketMap("bucket_concurrency_limit")
+)
+
+// isThrottlingError reports whether err means S3 is overloaded, i.e. a
+// SlowDown or any 5xx response, looking through the errors wrapped by the
+// S3 uploader
+func isThrottlingError(err error) bool {
+	for err != nil {
+		if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() >= http.StatusInternalServerError {
+			return true
+		}
+
+		aerr, ok := err.(awserr.Error)
+		if !ok {
+			return false
+		}
+		if aerr.Code() == "SlowDown" {
+			return true
+		}
+		err = aerr.OrigErr()
+	}
+
+	return false
+}
+
+// concurrencyLimiter limits the number of simultaneous uploads to a bucket,
+// adjusting the limit with AIMD: it grows by AdditiveIncrease for every limit
+// successful uploads and gets multiplied by DecreaseFactor on throttling
+type concurrencyLimiter struct {
+	config *Config
+	gauge  *expvar.Float
+
+	mu       sync.Mutex
+	limit    float64
+	inflight int
+	// released gets closed and replaced every time a slot frees up
+	released chan struct{}
+	// throttled counts the uploads throttled in a row, which trip the
+	// bucket for the maintenance mode
+	throttled int
+}
+
+func newConcurrencyLimiter(config *Config, gauge *expvar.Float) *concurrencyLimiter {
+	l := &concurrencyLimiter{
+		config:   config,
+		gauge:    gauge,
+		limit:    float64(config.ConcurrencyInitialLimit),
+		released: make(chan struct{}),
+	}
+	gauge.Set(l.limit)
+
+	return l
+}
+
+// acquire waits up to ConcurrencyQueueTimeout for an upload slot. The returned
+// function must be called with the outcome of the upload to release the slot.
+func (l *concurrencyLimiter) acquire(ctx context.Context) (func(error), bool) {
+	timeout := time.NewTimer(l.config.ConcurrencyQueueTimeout)
+	defer timeout.Stop()
+
+	for {
+		l.mu.Lock()
+		if float64(l.inflight) < l.limit {
+			l.inflight++
+			l.mu.Unlock()
+			return l.release, true
+		}
+		released := l.released
+		l.mu.Unlock()
+
+		select {
+		case <-released:
+		case <-timeout.C:
+			return nil, false
+		case <-ctx.Done():
+			return nil, false
+		}
+	}
+}
+
+func (l *concurrencyLimiter) release(err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.inflight--
+
+	if isThrottlingError(err) {
+		l.limit *= l.config.ConcurrencyDecreaseFactor
+		l.throttled++
+	} else if err == nil {
+		l.limit += l.config.ConcurrencyAdditiveIncrease / l.limit
+		l.throttled = 0
+	}
+
+	if min := float64(l.config.ConcurrencyMinLimit); l.limit < min {
+		l.limit = min
+	}
+	if max := float64(l.config.ConcurrencyMaxLimit); l.limit > max {
+		l.limit = max
+	}
+	l.gauge.Set(l.limit)
+
+	close(l.released)
+	l.released = make(chan struct{})
+}
+
+// concurrencyLimiters holds the limiter of each bucket
+type concurrencyLimiters struct {
+	config   *Config
+	mu       sync.Mutex
+	limiters map[string]*concurrencyLimiter
+}
+
+func newConcurrencyLimiters(config *Config) *concurrencyLimiters {
+	return &concurrencyLimiters{config: config, limiters: make(map[string]*concurrencyLimiter)}
+}
+
+// acquire waits for an upload slot for bucket, failing with 429 when none
+// frees up in time. A nil *concurrencyLimiters doesn't limit anything.
+func (c *concurrencyLimiters) acquire(ctx context.Context, bucket string) (func(error), error) {
+	if c == nil {
+		return func(error) {}, nil
+	}
+
+	c.mu.Lock()
+	limiter, ok := c.limiters[bucket]
+	if !ok {
+		gauge := new(expvar.Float)
+		concurrencyLimits.set(bucket, gauge)
+		limiter = newConcurrencyLimiter(c.config, gauge)
+		c.limiters[bucket] = limiter
+	}
+	c.mu.Unlock()
+
+	release, ok := limiter.acquire(ctx)
+	if !ok {
+		log.Debugf("Upload concurrency limit reached for bucket %q", bucket)
+		err := newRequestError(http.StatusTooManyRequests, ErrorCodeRateLimited, "Too many requests")
+		err.retryAfter = c.config.ConcurrencyRetryAfter
+		return nil, err
+	}
+
+	return release, nil
+}
+
+// trippedBuckets returns the buckets whose last threshold uploads, or more,
+// all got throttled, in name order. A nil *concurrencyLimiters has none.
+func (c *concurrencyLimiters) trippedBuckets(threshold int) []string {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var buckets []string
+	for bucket, limiter := range c.limiters {
+		limiter.mu.Lock()
+		if limiter.throttled >= threshold {
+			buckets = append(buckets, bucket)
+		}
+		limiter.mu.Unlock()
+	}
+	sort.Strings(buckets)
+	return buckets
+}
+
+// resetTripped forgets the throttled uploads of every bucket, so they have to
+// trip again
+func (c *concurrencyLimiters) resetTripped() {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, limiter := range c.limiters {
+		limiter.mu.Lock()
+		limiter.throttled = 0
+		limiter.mu.Unlock()
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+)
+
+// testConcurrencyConfig returns the default adaptive concurrency settings
+func testConcurrencyConfig() *Config {
+	return &Config{
+		AdaptiveConcurrency:         true,
+		ConcurrencyInitialLimit:     20,
+		ConcurrencyMinLimit:         1,
+		ConcurrencyMaxLimit:         100,
+		ConcurrencyAdditiveIncrease: 1,
+		ConcurrencyDecreaseFactor:   0.5,
+		ConcurrencyQueueTimeout:     time.Second,
+		ConcurrencyRetryAfter:       time.Second,
+	}
+}
+
+func TestIsThrottlingError(t *testing.T) {
+	slowDown := awserr.New("SlowDown", "Please reduce your request rate", nil)
+
+	tests := []struct {
+		err       error
+		throttled bool
+	}{
+		{nil, false},
+		{errors.New("failure"), false},
+		{slowDown, true},
+		{awserr.New("MultipartUpload", "upload multipart failed", slowDown), true},
+		{awserr.NewRequestFailure(awserr.New("InternalError", "Internal error", nil), http.StatusInternalServerError, "id"), true},
+		{awserr.NewRequestFailure(awserr.New("AccessDenied", "Access denied", nil), http.StatusForbidden, "id"), false},
+		{awserr.New("RequestCanceled", "request context canceled", context.Canceled), false},
+	}
+
+	for _, test := range tests {
+		if isThrottlingError(test.err) != test.throttled {
+			t.Errorf("Expected %v to be a throttling error: %t", test.err, test.throttled)
+		}
+	}
+}
+
+func TestConcurrencyLimiterAIMD(t *testing.T) {
+	gauge := new(expvar.Float)
+	l := newConcurrencyLimiter(testConcurrencyConfig(), gauge)
+
+	release, ok := l.acquire(context.Background())
+	if !ok {
+		t.Fatalf("Failed to acquire a slot")
+	}
+	release(awserr.New("SlowDown", "Please reduce your request rate", nil))
+	if gauge.Value() != 10 {
+		t.Errorf("Expected the limit to be halved to 10, got %f", gauge.Value())
+	}
+
+	// The limit grows by one for every limit successful uploads
+	for i := 0; i < 10; i++ {
+		release, _ := l.acquire(context.Background())
+		release(nil)
+	}
+	if gauge.Value() < 10.9 || gauge.Value() > 11 {
+		t.Errorf("Expected the limit to grow to about 11, got %f", gauge.Value())
+	}
+
+	// Other errors don't change it
+	release, _ = l.acquire(context.Background())
+	before := gauge.Value()
+	release(errors.New("invalid image"))
+	if gauge.Value() != before {
+		t.Errorf("Expected the limit to stay at %f, got %f", before, gauge.Value())
+	}
+
+	// Nor does it drop under the minimum
+	for i := 0; i < 10; i++ {
+		release, _ := l.acquire(context.Background())
+		release(awserr.New("SlowDown", "Please reduce your request rate", nil))
+	}
+	if gauge.Value() != 1 {
+		t.Errorf("Expected the limit to stop at 1, got %f", gauge.Value())
+	}
+}
+
+func TestConcurrencyLimitersShedLoad(t *testing.T) {
+	config := testConcurrencyConfig()
+	config.ConcurrencyInitialLimit = 1
+	config.ConcurrencyQueueTimeout = 10 * time.Millisecond
+	config.ConcurrencyRetryAfter = 3 * time.Second
+	limiters := newConcurrencyLimiters(config)
+
+	release, err := limiters.acquire(context.Background(), "bucket")
+	if err != nil {
+		t.Fatalf("Failed to acquire a slot: %s", err)
+	}
+
+	_, err = limiters.acquire(context.Background(), "bucket")
+	rerr, ok := err.(*requestError)
+	if !ok || rerr.status != http.StatusTooManyRequests || rerr.code != ErrorCodeRateLimited || rerr.retryAfter != 3*time.Second {
+		t.Fatalf("Expected a 429 when the window is full, got %v", err)
+	}
+
+	// Other buckets have their own limit
+	releaseOther, err := limiters.acquire(context.Background(), "other")
+	if err != nil {
+		t.Fatalf("Expected the other bucket to get a slot, got %s", err)
+	}
+	releaseOther(nil)
+
+	// Waiting uploads get the slots as they free up
+	acquired := make(chan error)
+	go func() {
+		release, err := limiters.acquire(context.Background(), "bucket")
+		if err == nil {
+			release(nil)
+		}
+		acquired <- err
+	}()
+	time.Sleep(time.Millisecond)
+	release(nil)
+	if err := <-acquired; err != nil {
+		t.Errorf("Expected the queued upload to get the released slot, got %s", err)
+	}
+
+	var disabled *concurrencyLimiters
+	release, err = disabled.acquire(context.Background(), "bucket")
+	if err != nil {
+		t.Fatalf("Expected no limit when adaptive concurrency is disabled, got %s", err)
+	}
+	release(nil)
+}
+
+func TestConcurrencyLimitersTripped(t *testing.T) {
+	limiters := newConcurrencyLimiters(testConcurrencyConfig())
+
+	for _, bucket := range []string{"throttled", "healthy"} {
+		for i := 0; i < 3; i++ {
+			release, err := limiters.acquire(context.Background(), bucket)
+			if err != nil {
+				t.Fatalf("Failed to acquire a slot: %s", err)
+			}
+			if bucket == "throttled" {
+				release(awserr.New("SlowDown", "Please reduce your request rate", nil))
+			} else {
+				release(nil)
+			}
+		}
+	}
+
+	tripped := limiters.trippedBuckets(3)
+	if len(tripped) != 1 || tripped[0] != "throttled" {
+		t.Errorf("Expected only the throttled bucket to trip, got %q", tripped)
+	}
+	limiters.resetTripped()
+	if tripped := limiters.trippedBuckets(3); len(tripped) != 0 {
+		t.Errorf("Expected no tripped buckets after the reset, got %q", tripped)
+	}
+}
+
+// TestConcurrencyLimiterConverges runs uploads against a simulated S3 which
+// throttles the requests above a concurrency of capacity
+func TestConcurrencyLimiterConverges(t *testing.T) {
+	const (
+		capacity = 8
+		clients  = 40
+		uploads  = 40
+	)
+
+	config := testConcurrencyConfig()
+	config.ConcurrencyQueueTimeout = time.Minute
+	gauge := new(expvar.Float)
+	l := newConcurrencyLimiter(config, gauge)
+
+	var active, throttled, late, lateThrottled int64
+	var mu sync.Mutex
+	var limits []float64
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < uploads; j++ {
+				release, ok := l.acquire(context.Background())
+				if !ok {
+					t.Errorf("Timed out waiting for a slot")
+					return
+				}
+
+				var err error
+				if atomic.AddInt64(&active, 1) > capacity {
+					err = awserr.New("SlowDown", "Please reduce your request rate", nil)
+					atomic.AddInt64(&throttled, 1)
+				}
+				time.Sleep(time.Millisecond)
+				atomic.AddInt64(&active, -1)
+
+				// The second half of the run shows where the limit settled
+				if j >= uploads/2 {
+					mu.Lock()
+					limits = append(limits, gauge.Value())
+					mu.Unlock()
+					atomic.AddInt64(&late, 1)
+					if err != nil {
+						atomic.AddInt64(&lateThrottled, 1)
+					}
+				}
+				release(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if throttled == 0 {
+		t.Fatalf("The simulated S3 never throttled")
+	}
+	// Not counting the end of the run, when the concurrency drops with the
+	// clients which are done
+	limits = limits[:len(limits)/2]
+	var sum float64
+	for _, limit := range limits {
+		sum += limit
+	}
+	if limit := sum / float64(len(limits)); limit < capacity/4 || limit > 2*capacity {
+		t.Errorf("Expected the limit to converge around %d, got %f on average", capacity, limit)
+	}
+	if ratio := float64(lateThrottled) / float64(late); ratio > 0.25 {
+		t.Errorf("Expected few uploads to be throttled once the limit converged, got %.0f%%", 100*ratio)
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/s3manager"
+	"github.com/hashicorp/golang-lru"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// sourceDownloaders caches the downloaders of the copy-transform sources
+	// by bucket, on top of the clients of the cached uploaders
+	sourceDownloaders, _ = lru.New(UploaderCacheSize)
+)
+
+// transformSource is the S3 object a copy-transform request reads its image
+// from, instead of the request body
+type transformSource struct {
+	location *s3Location
+	// presignedURL is the presigned GET URL of the object, if the source was
+	// given as one. It's a credential, so it never gets logged.
+	presignedURL string
+}
+
+// sourceObject describes the source of a copy-transform in its result
+type sourceObject struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+	ETag   string `json:"etag,omitempty"`
+}
+
+// downloaderCacheEntry is the downloader built on the client of uploader
+type downloaderCacheEntry struct {
+	uploader   *s3manager.Uploader
+	downloader *s3manager.Downloader
+}
+
+func parseSourceOption(d *Deflator, options *requestOptions, name, value string) error {
+	location, err := parseS3Location(value)
+	if err != nil {
+		return newRequestError(
+			http.StatusBadRequest, ErrorCodeInvalidParameter,
+			"Invalid %s: unrecognized S3 URL. Accepted formats: %s", name, AcceptedS3URLFormats,
+		)
+	}
+	location.key, err = d.normalizeKey(location.key)
+	if err != nil {
+		return err
+	}
+
+	options.source = &transformSource{location: location}
+	if isPresignedURL(value) {
+		options.source.presignedURL = value
+	}
+
+	return nil
+}
+
+// isPresignedURL checks whether raw is an HTTPS URL with a SigV4 or SigV2
+// query signature
+func isPresignedURL(raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme != "https" {
+		return false
+	}
+	query := u.Query()
+	return query.Get("X-Amz-Signature") != "" || query.Get("Signature") != ""
+}
+
+// sourceDownloader returns the downloader of bucket, built on the client of
+// its cached uploader so they share the region and endpoint settings
+func sourceDownloader(bucket string, uploader *s3manager.Uploader) *s3manager.Downloader {
+	if entry, ok := sourceDownloaders.Get(bucket); ok && entry.(*downloaderCacheEntry).uploader == uploader {
+		return entry.(*downloaderCacheEntry).downloader
+	}
+
+	downloader := s3manager.NewDownloaderWithClient(uploader.S3)
+	sourceDownloaders.Add(bucket, &downloaderCacheEntry{uploader: uploader, downloader: downloader})
+	return downloader
+}
+
+// hasRequestBody checks whether r has a body, reading at most one byte of
+// the chunked ones
+func hasRequestBody(r *http.Request) bool {
+	if r.ContentLength != -1 || r.Body == nil {
+		return r.ContentLength > 0
+	}
+	n, _ := r.Body.Read(make([]byte, 1))
+	return n > 0
+}
+
+// sourceTooLarge is the error of the sources above limit
+func (d *Deflator) sourceTooLarge(req *uploadRequest, source *s3Location, size, limit int64) error {
+	log.Debugf("Source object %q too large (%d bytes)", source.logString(), size)
+	return d.sizeLimitError(req, limit, newRequestError(
+		http.StatusRequestEntityTooLarge, ErrorCodePayloadTooLarge,
+		"Source object too large (%d bytes, limit: %d bytes)", size, limit,
+	))
+}
+
+// downloadSource checks the size of the source object of req with a
+// HeadObject, then downloads it. The ETag of the checked object is required
+// by the download, so a replaced object fails instead of bypassing the check.
+func (d *Deflator) downloadSource(ctx context.Context, req *uploadRequest, source *s3Location) ([]byte, *sourceObject, string, error) {
+	uploader, err := getS3Uploader(ctx, source.bucket, source.regionHint, d.config.DefaultS3Region, d.endpointOptions(source.bucket))
+	if err != nil {
+		return nil, nil, "", uploaderError(source.bucket, err)
+	}
+
+	head, err := headObject(ctx, uploader, source.bucket, source.key)
+	if err != nil {
+		switch {
+		case isNotFoundError(err):
+			return nil, nil, "", newRequestError(http.StatusNotFound, ErrorCodeNotFound, "Source object not found")
+		case isAccessDeniedError(err):
+			return nil, nil, "", newRequestError(http.StatusForbidden, ErrorCodeForbidden, "Forbidden")
+		default:
+			log.Warnf("Failed to check the source object %q: %s", source.logString(), err)
+			return nil, nil, "", newRequestError(http.StatusServiceUnavailable, ErrorCodeStorageUnavailable, "Internal error").withCause(err)
+		}
+	}
+	// The ciphertext of client-side encrypted objects isn't an image
+	if isEncrypted(head.Metadata) {
+		return nil, nil, "", newRequestError(http.StatusBadRequest, ErrorCodeInvalidParameter, "Encrypted source objects aren't supported")
+	}
+
+	contentType := aws.StringValue(head.ContentType)
+	size := aws.Int64Value(head.ContentLength)
+	if limit := d.inputSizeLimit(req, contentType); size > limit {
+		return nil, nil, "", d.sourceTooLarge(req, source, size, limit)
+	}
+
+	buf := aws.NewWriteAtBuffer(make([]byte, 0, size))
+	_, err = sourceDownloader(source.bucket, uploader).DownloadWithContext(ctx, buf, &s3.GetObjectInput{
+		Bucket:  aws.String(source.bucket),
+		Key:     aws.String(source.key),
+		IfMatch: head.ETag,
+	})
+	if err != nil {
+		log.Warnf("Failed to download the source object %q: %s", source.logString(), err)
+		return nil, nil, "", newRequestError(http.StatusServiceUnavailable, ErrorCodeStorageUnavailable, "Internal error").withCause(err)
+	}
+
+	return buf.Bytes(), &sourceObject{Bucket: source.bucket, Key: source.key, ETag: aws.StringValue(head.ETag)}, contentType, nil
+}
+
+// fetchPresignedSource downloads the source object of req through its
+// presigned GET URL, which doesn't allow a HeadObject: the size gets checked
+// against the Content-Length before the body is read.
+func (d *Deflator) fetchPresignedSource(ctx context.Context, req *uploadRequest, source *transformSource) ([]byte, *sourceObject, string, error) {
+	httpReq, err := http.NewRequest(http.MethodGet, source.presignedURL, nil)
+	if err != nil {
+		return nil, nil, "", newRequestError(http.StatusBadRequest, ErrorCodeInvalidParameter, "Invalid source URL")
+	}
+	resp, err := s3HTTPClient.Do(httpReq.WithContext(ctx))
+	if err != nil {
+		log.Warnf("Failed to download the source object %q: %s", source.location.logString(), err)
+		return nil, nil, "", newRequestError(http.StatusServiceUnavailable, ErrorCodeStorageUnavailable, "Internal error").withCause(err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, nil, "", newRequestError(http.StatusNotFound, ErrorCodeNotFound, "Source object not found")
+	case resp.StatusCode == http.StatusForbidden:
+		// Also returned for the expired URLs
+		return nil, nil, "", newRequestError(http.StatusForbidden, ErrorCodeForbidden, "Forbidden")
+	case resp.StatusCode != http.StatusOK:
+		log.Warnf("Failed to download the source object %q: status %d", source.location.logString(), resp.StatusCode)
+		return nil, nil, "", newRequestError(http.StatusServiceUnavailable, ErrorCodeStorageUnavailable, "Internal error")
+	}
+
+	contentType := resp.Header.Get("Content-Type")
+	limit := d.inputSizeLimit(req, contentType)
+	if resp.ContentLength > limit {
+		return nil, nil, "", d.sourceTooLarge(req, source.location, resp.ContentLength, limit)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		log.Warnf("Failed to download the source object %q: %s", source.location.logString(), err)
+		return nil, nil, "", newRequestError(http.StatusServiceUnavailable, ErrorCodeStorageUnavailable, "Internal error").withCause(err)
+	}
+	if int64(len(body)) > limit {
+		return nil, nil, "", d.sourceTooLarge(req, source.location, int64(len(body)), limit)
+	}
+
+	return body, &sourceObject{Bucket: source.location.bucket, Key: source.location.key, ETag: resp.Header.Get("ETag")}, contentType, nil
+}
+
+// copyTransformHandler transforms the source object of options and uploads
+// the result to location, so the image doesn't go through the client. The
+// request has no body, and the source is held to the same allowlist as the
+// destinations.
+func (d *Deflator) copyTransformHandler(w http.ResponseWriter, r *http.Request, location *s3Location, options *requestOptions) {
+	if hasRequestBody(r) {
+		writeError(w, r, newRequestError(http.StatusBadRequest, ErrorCodeConflictingParameter, "source can't be combined with a request body"))
+		return
+	}
+
+	source := options.source
+	err := d.authorizeDestination(source.location.bucket, source.location.key)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	req, err := d.uploadRequestFromOptions(location, options)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	req.clientIP = d.clientIP(r)
+
+	var body []byte
+	if source.presignedURL != "" {
+		body, req.source, req.contentType, err = d.fetchPresignedSource(r.Context(), req, source)
+	} else {
+		body, req.source, req.contentType, err = d.downloadSource(r.Context(), req, source.location)
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	log.Debugf("Downloaded the source object %q (%d bytes)", source.location.logString(), len(body))
+
+	d.serveUpload(w, r, req, bytes.NewReader(body), int64(len(body)))
+}
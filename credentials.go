@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	log "github.com/sirupsen/logrus"
+)
+
+// CredentialCheckInterval is how often the AWS credentials get retrieved in
+// the background, which refreshes them before they expire and detects when
+// they become available again
+const CredentialCheckInterval = 30 * time.Second
+
+var (
+	// credentialStats publishes 1 for `available` while the AWS credentials can
+	// be retrieved, next to the number of `refresh_failures`
+	credentialStats = expvar.NewMap("aws_credentials")
+
+	// sharedCredentials is shared by all the uploaders once it's been
+	// initialised at startup
+	sharedCredentials *credentialGuard
+)
+
+// credentialGuard wraps the credentials provider resolved from the default
+// AWS config, caching whether the credentials could be retrieved
+type credentialGuard struct {
+	provider  aws.CredentialsProvider
+	anonymous bool
+	failing   int32
+	available *expvar.Int
+}
+
+// initCredentials resolves the AWS credentials once at startup. Without
+// credentials it fails unless allowAnonymous is set, in which case requests
+// are sent unsigned.
+func initCredentials(allowAnonymous bool) error {
+	awsCfg, err := loadAWSConfig()
+	if err != nil {
+		return err
+	}
+
+	guard := &credentialGuard{provider: awsCfg.Credentials, available: new(expvar.Int)}
+	credentialStats.Set("available", guard.available)
+
+	_, err = guard.Retrieve()
+	if err != nil {
+		if !allowAnonymous {
+			return fmt.Errorf("no AWS credentials found (configure them or run with --allow-anonymous): %s", err)
+		}
+		log.Warnf("No AWS credentials found, sending anonymous requests: %s", err)
+		guard.anonymous = true
+		atomic.StoreInt32(&guard.failing, 0)
+		guard.available.Set(1)
+	}
+
+	sharedCredentials = guard
+	return nil
+}
+
+// Retrieve implements aws.CredentialsProvider, recording the transitions
+// between the available and failing states
+func (g *credentialGuard) Retrieve() (aws.Credentials, error) {
+	if g.provider == nil {
+		return aws.Credentials{}, fmt.Errorf("no credentials provider")
+	}
+
+	creds, err := g.provider.Retrieve()
+	switch {
+	case err != nil && atomic.CompareAndSwapInt32(&g.failing, 0, 1):
+		log.Errorf("Failed to retrieve the AWS credentials: %s", err)
+		credentialStats.Add("refresh_failures", 1)
+		g.available.Set(0)
+	case err != nil:
+		credentialStats.Add("refresh_failures", 1)
+	case atomic.CompareAndSwapInt32(&g.failing, 1, 0) || g.available.Value() == 0:
+		log.Infof("AWS credentials available from %s", creds.Source)
+		g.available.Set(1)
+	}
+
+	return creds, err
+}
+
+// credentials returns the provider to use in the AWS config
+func (g *credentialGuard) credentials() aws.CredentialsProvider {
+	if g.anonymous {
+		// The signer only skips requests with this exact value
+		return aws.AnonymousCredentials
+	}
+	return g
+}
+
+// err returns the error for requests which can't be signed, nil otherwise.
+// It's safe to call on a nil credentialGuard.
+func (g *credentialGuard) err() error {
+	if g == nil || g.anonymous || atomic.LoadInt32(&g.failing) == 0 {
+		return nil
+	}
+	return newRequestError(http.StatusServiceUnavailable, ErrorCodeStorageCredentialsUnavailable, "Storage credentials unavailable")
+}
+
+// credentialsError returns the error of the shared credentials for the
+// endpoints which use them. The filesystem buckets don't need any and the
+// named profiles have their own.
+func credentialsError(options s3EndpointOptions) error {
+	if options.filesystemRoot != "" || options.profile != "" {
+		return nil
+	}
+	return sharedCredentials.err()
+}
+
+// Run retrieves the credentials periodically until ctx is cancelled
+func (g *credentialGuard) Run(ctx context.Context) {
+	if g.anonymous {
+		return
+	}
+
+	ticker := time.NewTicker(CredentialCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			_, _ = g.Retrieve()
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	// DerivedKeyVersion is the version of the derived key encoding. A new one
+	// is needed whenever the encoding or the hashed options change.
+	DerivedKeyVersion = "v1"
+
+	// derivedKeySeparator separates the source key from the encoded options
+	derivedKeySeparator = "__"
+)
+
+// derivedKeySuffix matches the suffix of the derived keys, capturing the
+// encoded options and the hash
+var derivedKeySuffix = regexp.MustCompile(`^(.+)` + derivedKeySeparator + DerivedKeyVersion + `((?:_[a-z0-9]+)*)_([0-9a-f]{8})$`)
+
+// transformOptions returns the options which set the output image, dropping
+// the ones which are about the request
+func (o *requestOptions) transformOptions() *requestOptions {
+	return &requestOptions{
+		width:        o.width,
+		height:       o.height,
+		format:       o.format,
+		text:         o.text,
+		textPosition: o.textPosition,
+		textSize:     o.textSize,
+		textColor:    o.textColor,
+	}
+}
+
+// derivedKey returns the key of the rendition of key with the transform
+// options, e.g. `photo.jpg__v1_w400_h300_webp_1f2e3d4c`. The readable part
+// covers the dimensions and the format, the hash all the transform options,
+// so the same options always give the same key and different ones a
+// different key. Options without any transform give key itself.
+func derivedKey(key string, options *requestOptions) string {
+	transform := options.transformOptions()
+	if !transform.transform() {
+		return key
+	}
+
+	parts := []string{DerivedKeyVersion}
+	if transform.width > 0 {
+		parts = append(parts, "w"+strconv.FormatUint(transform.width, 10))
+	}
+	if transform.height > 0 {
+		parts = append(parts, "h"+strconv.FormatUint(transform.height, 10))
+	}
+	if transform.format != "" {
+		parts = append(parts, transform.format)
+	}
+	// The caption can't be part of a key, only of the hash
+	if transform.text != "" {
+		parts = append(parts, "text")
+	}
+
+	hash := sha256.Sum256([]byte(DerivedKeyVersion + "\n" + transform.canonical()))
+	parts = append(parts, hex.EncodeToString(hash[:4]))
+
+	return key + derivedKeySeparator + strings.Join(parts, "_")
+}
+
+// parseDerivedKey recognizes the keys returned by derivedKey, returning the
+// source key and the transform options. Keys which don't round-trip, like the
+// ones with a caption or a hash which doesn't match, aren't derived keys.
+func (d *Deflator) parseDerivedKey(key string) (string, *requestOptions, bool) {
+	match := derivedKeySuffix.FindStringSubmatch(key)
+	if match == nil || match[2] == "" {
+		return "", nil, false
+	}
+
+	options := d.newRequestOptions()
+	for _, part := range strings.Split(strings.TrimPrefix(match[2], "_"), "_") {
+		var err error
+		// The formats don't start with a digit after their first letter
+		dimension := len(part) > 1 && part[1] >= '0' && part[1] <= '9'
+		switch {
+		case dimension && part[0] == 'w':
+			err = parseDimensionOption(d, options, "width", part[1:])
+		case dimension && part[0] == 'h':
+			err = parseDimensionOption(d, options, "height", part[1:])
+		default:
+			err = parseFormatOption(d, options, "format", part)
+		}
+		if err != nil {
+			return "", nil, false
+		}
+	}
+
+	if derivedKey(match[1], options) != key {
+		return "", nil, false
+	}
+	return match[1], options, true
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// newDerivedKeyDeflator returns the Deflator of newOptionsDeflator, accepting
+// the caption options
+func newDerivedKeyDeflator(t *testing.T) (*Deflator, func()) {
+	d, done := newOptionsDeflator(t, nil)
+	// The parser only checks that a font is configured
+	d.config.TextFont = "Sans"
+	return d, done
+}
+
+// optionsFromQuery parses the options of a query
+func optionsFromQuery(t *testing.T, d *Deflator, query string) *requestOptions {
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		t.Fatalf("Invalid query %q: %s", query, err)
+	}
+	options, err := d.parseOptions(TestBucket, values, nil)
+	if err != nil {
+		t.Fatalf("Failed to parse %q: %s", query, err)
+	}
+	return options
+}
+
+func TestDerivedKey(t *testing.T) {
+	d, done := newDerivedKeyDeflator(t)
+	defer done()
+
+	tests := []struct {
+		query  string
+		prefix string
+	}{
+		{"width=400&height=300&format=webp", "photo.jpg__v1_w400_h300_webp_"},
+		{"width=400", "photo.jpg__v1_w400_"},
+		{"height=300", "photo.jpg__v1_h300_"},
+		{"format=png", "photo.jpg__v1_png_"},
+		{"format=auto", "photo.jpg__v1_auto_"},
+		{"width=100&text=Hello", "photo.jpg__v1_w100_text_"},
+		{"profile=thumb", "photo.jpg__v1_w100_webp_"},
+	}
+
+	hash := regexp.MustCompile(`^[0-9a-f]{8}$`)
+	for _, test := range tests {
+		key := derivedKey("photo.jpg", optionsFromQuery(t, d, test.query))
+		if !strings.HasPrefix(key, test.prefix) || !hash.MatchString(strings.TrimPrefix(key, test.prefix)) {
+			t.Errorf("Expected %q to give %s<hash>, got %q", test.query, test.prefix, key)
+		}
+	}
+
+	for _, query := range []string{"", "ttl=60", "keep_original=1&collision=suffix"} {
+		if key := derivedKey("photo.jpg", optionsFromQuery(t, d, query)); key != "photo.jpg" {
+			t.Errorf("Expected %q without a transform to keep the key, got %q", query, key)
+		}
+	}
+}
+
+func TestDerivedKeyStable(t *testing.T) {
+	d, done := newDerivedKeyDeflator(t)
+	defer done()
+
+	// Each set of queries sets the same transform
+	equivalent := [][]string{
+		{
+			"width=400&height=300&format=webp",
+			"format=webp&height=300&width=400",
+			"width=400&width=400&height=300&format=webp",
+			// The other options are about the request, not the output
+			"width=400&height=300&format=webp&ttl=3600&soft=1&keep_original=1&collision=suffix&response=minimal",
+			"width=400&height=300&format=webp&strip=1&siblings=none&verify=0&echo=1",
+		},
+		{"profile=thumb", "width=100&format=webp", "profile=thumb&width=100"},
+		{"width=100&text=Hello", "text=Hello&width=100&text_position=" + TextPositionBottom},
+	}
+
+	for _, queries := range equivalent {
+		expected := derivedKey("photo.jpg", optionsFromQuery(t, d, queries[0]))
+		for _, query := range queries[1:] {
+			if key := derivedKey("photo.jpg", optionsFromQuery(t, d, query)); key != expected {
+				t.Errorf("Expected %q to give the key %q of %q, got %q", query, expected, queries[0], key)
+			}
+		}
+	}
+}
+
+func TestDerivedKeyChanges(t *testing.T) {
+	d, done := newDerivedKeyDeflator(t)
+	defer done()
+
+	// Changing any transform option of the base gives another key
+	base := "width=400&height=300&format=webp&text=Hello&text_position=top&text_size=24&text_color=ffffff"
+	variants := []string{
+		base,
+		strings.Replace(base, "width=400", "width=401", 1),
+		strings.Replace(base, "width=400&", "", 1),
+		strings.Replace(base, "height=300", "height=301", 1),
+		strings.Replace(base, "height=300&", "", 1),
+		strings.Replace(base, "format=webp", "format=png", 1),
+		strings.Replace(base, "format=webp", "format=jpeg", 1),
+		strings.Replace(base, "format=webp", "format=auto", 1),
+		strings.Replace(base, "format=webp&", "", 1),
+		strings.Replace(base, "text=Hello", "text=Hello!", 1),
+		strings.Replace(base, "text=Hello", "text=hello", 1),
+		strings.Replace(base, "text_position=top", "text_position=bottom", 1),
+		strings.Replace(base, "text_size=24", "text_size=25", 1),
+		strings.Replace(base, "text_color=ffffff", "text_color=000000", 1),
+		// Neither the dimensions nor the text can be swapped
+		"width=300&height=400&format=webp&text=Hello&text_position=top&text_size=24&text_color=ffffff",
+		"width=400&height=300&format=webp",
+	}
+
+	keys := make(map[string]string)
+	for _, query := range variants {
+		key := derivedKey("photo.jpg", optionsFromQuery(t, d, query))
+		if other, ok := keys[key]; ok {
+			t.Errorf("%q and %q give the same key %q", query, other, key)
+		}
+		keys[key] = query
+	}
+
+	// Nor do the source keys collide
+	options := optionsFromQuery(t, d, "width=400")
+	if derivedKey("a", options) == derivedKey("b", options) {
+		t.Errorf("Two source keys give the same derived key")
+	}
+}
+
+func TestParseDerivedKey(t *testing.T) {
+	d, done := newDerivedKeyDeflator(t)
+	defer done()
+
+	for _, query := range []string{"width=400&height=300&format=webp", "width=400", "height=300", "format=png", "format=auto", "profile=thumb"} {
+		options := optionsFromQuery(t, d, query)
+		for _, source := range []string{"photo.jpg", "path/to/photo", "photo__v1_w1_00000000", "a__b"} {
+			key := derivedKey(source, options)
+			parsedSource, parsed, ok := d.parseDerivedKey(key)
+			if !ok {
+				t.Errorf("Failed to parse the key %q of %q", key, query)
+				continue
+			}
+			if parsedSource != source || derivedKey(parsedSource, parsed) != key {
+				t.Errorf("Expected %q to give back %q with %q, got %q with %q", key, source, options.canonical(), parsedSource, parsed.canonical())
+			}
+		}
+	}
+
+	key := derivedKey("photo.jpg", optionsFromQuery(t, d, "width=400&format=webp"))
+	for _, key := range []string{
+		"photo.jpg",
+		"photo.jpg__v1",
+		"photo.jpg__v1_" + key[len(key)-8:],
+		key[:len(key)-1],
+		corruptHash(key),
+		strings.Replace(key, "w400", "w401", 1),
+		strings.Replace(key, "webp", "png", 1),
+		strings.Replace(key, "__v1_", "__v2_", 1),
+		strings.Replace(key, "__v1_", "__V1_", 1),
+		"__v1_w400_webp_" + key[len(key)-8:],
+		// The caption is only part of the hash
+		derivedKey("photo.jpg", optionsFromQuery(t, d, "width=100&text=Hello")),
+		"photo.jpg__v1_w0_00000000",
+		"photo.jpg__v1_wx_00000000",
+		"photo.jpg__v1_w99999999_00000000",
+		"photo.jpg__v1_gif_00000000",
+	} {
+		if source, options, ok := d.parseDerivedKey(key); ok {
+			t.Errorf("Expected %q not to be a derived key, got %q with %q", key, source, options.canonical())
+		}
+	}
+}
+
+func TestGetDerivedKey(t *testing.T) {
+	s := newTestServer(t, func(config *Config) {
+		config.EnableGet = true
+	})
+	defer s.close()
+	s.putObject("photo.png", testPNG(t, 64, 32))
+
+	d := s.deflator
+	key := derivedKey("photo.png", optionsFromQuery(t, d, "width=16&format=png"))
+	resp, err := http.Get(s.uploadURL(TestBucket, key, ""))
+	if err != nil {
+		t.Fatalf("Failed to get the derived key: %s", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !bytes.HasPrefix(body, []byte("\x89PNG")) {
+		t.Fatalf("Expected the transformed source in PNG, got %d (%d bytes)", resp.StatusCode, len(body))
+	}
+
+	// Keys which only look derived don't fall back to a source
+	resp, err = http.Get(s.uploadURL(TestBucket, corruptHash(key), ""))
+	if err != nil {
+		t.Fatalf("Failed to get the key: %s", err)
+	}
+	if code := decodeError(t, resp, http.StatusNotFound).Code; code != ErrorCodeNotFound {
+		t.Errorf("Expected the %s code, got %s", ErrorCodeNotFound, code)
+	}
+}
+
+// corruptHash changes the last digit of the hash of a derived key
+func corruptHash(key string) string {
+	last := "0"
+	if strings.HasSuffix(key, last) {
+		last = "1"
+	}
+	return key[:len(key)-1] + last
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+
+	"github.com/davidbyttow/govips/pkg/vips"
+)
+
+// canonicalDigestVersion is mixed into the canonical digests, so changing
+// what they cover doesn't reuse the keys of the previous scheme
+const canonicalDigestVersion = "imgdeflator-canonical-v1"
+
+// isDeterministicFormat checks whether the encoding of format is
+// byte-for-byte reproducible across platforms. The lossy encoders have SIMD
+// code paths which differ between amd64 and arm64.
+func isDeterministicFormat(format vips.ImageType) bool {
+	return format == vips.ImageTypePNG || format == vips.ImageTypeGIF
+}
+
+// encoderID identifies the encoder of the processed images in the upload
+// results, so the outputs of different builds can be told apart
+func encoderID() string {
+	return "libvips/" + vips.VipsVersion
+}
+
+// canonicalDigest hashes what the output of a transform is derived from
+// instead of its bytes: the pixels of body decoded in pure Go, which doesn't
+// depend on the platform, and the transform parameters. Sources Go can't
+// decode are hashed as is.
+func canonicalDigest(body []byte, width, height uint64, profile *encoderProfile, caption *textCaption) []byte {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s\n%dx%d\n", canonicalDigestVersion, width, height)
+	if profile != nil {
+		fmt.Fprintf(hash, "%+v\n", *profile)
+	}
+	if caption != nil {
+		fmt.Fprintf(hash, "%+v\n", *caption)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(body))
+	if err != nil {
+		hash.Write(body)
+		return hash.Sum(nil)
+	}
+	bounds := img.Bounds()
+	fmt.Fprintf(hash, "%dx%d\n", bounds.Dx(), bounds.Dy())
+	switch img := img.(type) {
+	case *image.YCbCr:
+		fmt.Fprintf(hash, "ycbcr %d\n", img.SubsampleRatio)
+		hash.Write(img.Y)
+		hash.Write(img.Cb)
+		hash.Write(img.Cr)
+	case *image.Gray:
+		hash.Write(img.Pix)
+	case *image.NRGBA:
+		hash.Write(img.Pix)
+	case *image.RGBA:
+		hash.Write(img.Pix)
+	case *image.Paletted:
+		for _, c := range img.Palette {
+			r, g, b, a := c.RGBA()
+			fmt.Fprintf(hash, "%d,%d,%d,%d;", r, g, b, a)
+		}
+		hash.Write(img.Pix)
+	default:
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				r, g, b, a := img.At(x, y).RGBA()
+				fmt.Fprintf(hash, "%d,%d,%d,%d;", r, g, b, a)
+			}
+		}
+	}
+	return hash.Sum(nil)
+}
+
+// contentDigest returns the digest the {sha256} placeholder expands to when
+// it isn't the hash of the output: in deterministic mode, for the formats
+// whose encoding isn't reproducible
+func (d *Deflator) contentDigest(imageType vips.ImageType, body []byte, width, height uint64, profile *encoderProfile, caption *textCaption) []byte {
+	if !d.config.Deterministic || isDeterministicFormat(imageType) {
+		return nil
+	}
+	return canonicalDigest(body, width, height, profile, caption)
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/davidbyttow/govips/pkg/vips"
+)
+
+// goldenSource is an upload of the golden tests, encoded in pure Go
+type goldenSource struct {
+	name string
+	body []byte
+}
+
+// goldenSources encodes the same gradient in every format Go can decode, and
+// in ways which give all the decoded image types
+func goldenSources(t *testing.T) []goldenSource {
+	gradient := image.NewNRGBA64(image.Rect(0, 0, 16, 8))
+	for x := 0; x < 16; x++ {
+		for y := 0; y < 8; y++ {
+			gradient.Set(x, y, color.NRGBA64{R: uint16(x * 4096), G: uint16(y * 8192), B: uint16(x * y * 512), A: 0xffff})
+		}
+	}
+	gray := image.NewGray(gradient.Bounds())
+	palette := image.NewPaletted(gradient.Bounds(), []color.Color{color.Black, color.White, color.RGBA{R: 255, A: 255}})
+	for x := 0; x < 16; x++ {
+		for y := 0; y < 8; y++ {
+			gray.Set(x, y, gradient.At(x, y))
+			palette.Set(x, y, gradient.At(x, y))
+		}
+	}
+
+	encode := func(name string, encode func(buf *bytes.Buffer) error) goldenSource {
+		var buf bytes.Buffer
+		err := encode(&buf)
+		if err != nil {
+			t.Fatalf("Failed to encode the %s source: %s", name, err)
+		}
+		return goldenSource{name, buf.Bytes()}
+	}
+	return []goldenSource{
+		{"png", testPNG(t, 16, 8)},
+		encode("png16", func(buf *bytes.Buffer) error { return png.Encode(buf, gradient) }),
+		encode("gray", func(buf *bytes.Buffer) error { return png.Encode(buf, gray) }),
+		encode("jpeg", func(buf *bytes.Buffer) error { return jpeg.Encode(buf, gradient, &jpeg.Options{Quality: 90}) }),
+		encode("gif", func(buf *bytes.Buffer) error { return gif.Encode(buf, palette, nil) }),
+		// Go can't decode WebP, so its bytes get hashed
+		{"webp", []byte("RIFF\x1a\x00\x00\x00WEBPVP8L\x0d\x00\x00\x00\x2f\x00\x00\x00\x10\x07\x10\x11\x11\x88\x88\xfe\x07\x00")},
+	}
+}
+
+func TestCanonicalDigestGolden(t *testing.T) {
+	caption := &textCaption{text: "Hello", font: "Sans", position: TextPositionBottom, size: 24, color: vips.Color{R: 255, G: 255, B: 255}}
+	transforms := []struct {
+		name          string
+		width, height uint64
+		profile       *encoderProfile
+		caption       *textCaption
+	}{
+		{"original", 0, 0, nil, nil},
+		{"w8", 8, 0, nil, nil},
+		{"w8 h4", 8, 4, nil, nil},
+		{"webp q75", 8, 0, &encoderProfile{Quality: 75, format: vips.ImageTypeWEBP}, nil},
+		{"stripped", 8, 0, &encoderProfile{StripMetadata: true}, nil},
+		{"caption", 8, 0, nil, caption},
+	}
+
+	// The digests only depend on the pure Go decoders, so they're the same on
+	// every platform
+	var output bytes.Buffer
+	for _, source := range goldenSources(t) {
+		for _, transform := range transforms {
+			digest := canonicalDigest(source.body, transform.width, transform.height, transform.profile, transform.caption)
+			fmt.Fprintf(&output, "%s %s: %x\n", source.name, transform.name, digest)
+		}
+	}
+	checkGolden(t, "canonical_digests.golden", output.Bytes())
+}
+
+func TestCanonicalDigest(t *testing.T) {
+	sources := goldenSources(t)
+	body := sources[0].body
+
+	// The digest is of the pixels, whatever the encoding
+	var reencoded bytes.Buffer
+	img, err := png.Decode(bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to decode the source: %s", err)
+	}
+	err = (&png.Encoder{CompressionLevel: png.BestCompression}).Encode(&reencoded, img)
+	if err != nil {
+		t.Fatalf("Failed to encode the source: %s", err)
+	}
+	if bytes.Equal(reencoded.Bytes(), body) {
+		t.Fatalf("Expected the compression level to change the encoding")
+	}
+	if !bytes.Equal(canonicalDigest(reencoded.Bytes(), 8, 0, nil, nil), canonicalDigest(body, 8, 0, nil, nil)) {
+		t.Errorf("Expected the same pixels to give the same digest")
+	}
+
+	digests := make(map[string]string)
+	for _, source := range sources {
+		digest := hex.EncodeToString(canonicalDigest(source.body, 8, 0, nil, nil))
+		if other, ok := digests[digest]; ok {
+			t.Errorf("The %s and %s sources give the same digest", source.name, other)
+		}
+		digests[digest] = source.name
+	}
+
+	// Go can't decode the WebP source, whose digest is still not its hash
+	webp := sources[len(sources)-1].body
+	sum := sha256.Sum256(webp)
+	if bytes.Equal(canonicalDigest(webp, 0, 0, nil, nil), sum[:]) {
+		t.Errorf("Expected the digest to cover the transform")
+	}
+}
+
+func TestContentDigest(t *testing.T) {
+	body := testPNG(t, 16, 8)
+	for _, deterministic := range []bool{false, true} {
+		d := &Deflator{config: &Config{Deterministic: deterministic}}
+		for _, imageType := range []vips.ImageType{vips.ImageTypePNG, vips.ImageTypeGIF, vips.ImageTypeJPEG, vips.ImageTypeWEBP} {
+			digest := d.contentDigest(imageType, body, 8, 0, nil, nil)
+			// Only the outputs which aren't reproducible get the canonical
+			// digest
+			if deterministic && !isDeterministicFormat(imageType) {
+				if !bytes.Equal(digest, canonicalDigest(body, 8, 0, nil, nil)) {
+					t.Errorf("Expected the canonical digest for %s", imageType.OutputExt())
+				}
+			} else if digest != nil {
+				t.Errorf("Expected %s to be hashed as is (deterministic: %t)", imageType.OutputExt(), deterministic)
+			}
+		}
+	}
+}
+
+func TestDeterministicUpload(t *testing.T) {
+	for _, deterministic := range []bool{false, true} {
+		t.Run(fmt.Sprintf("deterministic %t", deterministic), func(t *testing.T) {
+			s := newTestServer(t, func(config *Config) {
+				config.Deterministic = deterministic
+				config.AllowKeyTemplateHeader = true
+			})
+			defer s.close()
+
+			for _, source := range goldenSources(t) {
+				if source.name == "webp" {
+					continue
+				}
+
+				// Uploading the same source twice stores the same bytes under
+				// the same key
+				var results [2]uploadResult
+				for i := range results {
+					results[i] = s.templateUpload(fmt.Sprintf("%s-%d", source.name, i), source.body)
+				}
+				if results[0].Key != results[1].Key {
+					t.Errorf("Expected the %s uploads to get the same key, got %q and %q", source.name, results[0].Key, results[1].Key)
+				}
+				object, ok := s.fake.Object(TestBucket, results[0].Key)
+				if !ok {
+					t.Errorf("The %s upload wasn't stored as %q, got %q", source.name, results[0].Key, s.fake.Keys(TestBucket))
+					continue
+				}
+				if results[0].Encoder != encoderID() {
+					t.Errorf("Expected the %s upload to report the encoder %q, got %q", source.name, encoderID(), results[0].Encoder)
+				}
+
+				// The non-reproducible outputs are named after their source
+				name, ext := strings.TrimPrefix(results[0].Key, "images/"), ""
+				if i := strings.LastIndex(name, "."); i >= 0 {
+					name, ext = name[:i], name[i+1:]
+				}
+				expected := sha256.Sum256(object.Body)
+				digest := expected[:]
+				if deterministic && ext == strings.TrimPrefix(vips.ImageTypeJPEG.OutputExt(), ".") {
+					digest = canonicalDigest(source.body, 8, 0, nil, nil)
+				}
+				if name != hex.EncodeToString(digest) {
+					t.Errorf("Expected the %s upload to be stored as %x.%s, got %q", source.name, digest, ext, results[0].Key)
+				}
+			}
+		})
+	}
+}
+
+// templateUpload uploads body under the key template images/{sha256}.{ext},
+// resized to a width of 8, returning its result
+func (s *testServer) templateUpload(key string, body []byte) uploadResult {
+	r, err := http.NewRequest(http.MethodPost, s.uploadURL(TestBucket, key, "width=8"), bytes.NewReader(body))
+	if err != nil {
+		s.t.Fatalf("Failed to create the request: %s", err)
+	}
+	r.Header.Set("X-Key-Template", "images/{sha256}.{ext}")
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		s.t.Fatalf("Failed to send the upload of %q: %s", key, err)
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		s.t.Fatalf("Expected the upload of %q to succeed, got %d: %s", key, resp.StatusCode, respBody)
+	}
+
+	var result uploadResult
+	err = json.Unmarshal(respBody, &result)
+	if err != nil {
+		s.t.Fatalf("Failed to decode the upload result %q: %s", respBody, err)
+	}
+	return result
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"runtime"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/relistan/rubberneck"
+	log "github.com/sirupsen/logrus"
+)
+
+// secretConfigFields are masked in the diagnostic dump
+var secretConfigFields = map[string]bool{
+	"UrlSigningSecret": true,
+	"AdminToken":       true,
+	"SentryDSN":        true,
+	"S3ProxyURL":       true,
+	"ProxyURL":         true,
+}
+
+// trackInflight registers req for the diagnostic dump until the returned
+// function gets called
+func (d *Deflator) trackInflight(req *uploadRequest) func() {
+	d.inflight.Store(req, struct{}{})
+	return func() { d.inflight.Delete(req) }
+}
+
+// DiagnosticDump logs a snapshot of the state of the service in the
+// background. Dumps requested while another one is running are coalesced.
+func (d *Deflator) DiagnosticDump() {
+	if !atomic.CompareAndSwapInt32(&d.dumping, 0, 1) {
+		log.Info("Diagnostic dump already in progress")
+		return
+	}
+
+	go func() {
+		defer atomic.StoreInt32(&d.dumping, 0)
+		d.dumpDiagnostics()
+	}()
+}
+
+func (d *Deflator) dumpDiagnostics() {
+	now := time.Now()
+	log.Infof("Diagnostic dump %s", strings.Repeat("-", 34))
+
+	// In-flight requests, oldest first
+	var requests []*uploadRequest
+	d.inflight.Range(func(key, _ interface{}) bool {
+		requests = append(requests, key.(*uploadRequest))
+		return true
+	})
+	sort.Slice(requests, func(i, j int) bool { return requests[i].progress.start.Before(requests[j].progress.start) })
+
+	log.Infof("In-flight uploads: %d", len(requests))
+	for _, req := range requests {
+		stage, read, uploaded := req.progress.snapshot()
+		log.Infof(
+			"  * %s: age %s, stage %s, %d bytes read, %d bytes uploaded",
+			req.location(), now.Sub(req.progress.start).Truncate(time.Millisecond), stage, read, uploaded,
+		)
+	}
+
+	uploaders := uploaderCacheInfo()
+	log.Infof("Cached uploaders: %d", len(uploaders))
+	for _, uploader := range uploaders {
+		log.Infof(
+			"  * %s: region %s, %s endpoint, age %ds, %d hits",
+			uploader.Bucket, uploader.Region, uploader.Endpoint, uploader.AgeSeconds, uploader.Hits,
+		)
+	}
+
+	log.Infof("Replication queue: %d/%d", len(d.replicationQueue), cap(d.replicationQueue))
+	log.Infof("Shadow queue: %d/%d", len(d.shadowQueue), cap(d.shadowQueue))
+	if d.errorReporter != nil {
+		log.Infof("Error report queue: %d/%d", len(d.errorReporter.events), cap(d.errorReporter.events))
+	}
+
+	// ReadMemStats only pauses the world very briefly, unlike a heap dump
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	log.Infof(
+		"Memory: %d bytes heap in use, %d bytes from the OS, %d GCs, %d goroutines",
+		mem.HeapInuse, mem.Sys, mem.NumGC, runtime.NumGoroutine(),
+	)
+
+	rubberneck.NewPrinterWithKeyMasking(log.Infof, maskSecretConfig, rubberneck.NoAddLineFeed).
+		PrintWithLabel("Effective config", d.config)
+}
+
+func maskSecretConfig(name string) *string {
+	if !secretConfigFields[name] {
+		return nil
+	}
+	masked := "********"
+	return &masked
+}
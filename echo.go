@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+// EchoHeaderMaxLength is how much of each echo header value is kept
+const EchoHeaderMaxLength = 256
+
+// validateEchoHeaders checks the names of the configured echo headers
+func validateEchoHeaders(names []string) error {
+	for _, name := range names {
+		if name == "" || strings.IndexFunc(name, func(r rune) bool {
+			return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-')
+		}) >= 0 {
+			return fmt.Errorf("invalid echo header %q", name)
+		}
+	}
+	return nil
+}
+
+// sanitizeEchoValue keeps the printable ASCII characters of value, up to
+// EchoHeaderMaxLength, since it ends up in the object metadata
+func sanitizeEchoValue(value string) string {
+	value = strings.Map(func(r rune) rune {
+		if r < ' ' || r > '~' {
+			return -1
+		}
+		return r
+	}, value)
+	if len(value) > EchoHeaderMaxLength {
+		value = value[:EchoHeaderMaxLength]
+	}
+	return strings.TrimSpace(value)
+}
+
+// echoHeaders returns the values of the configured echo headers present in
+// header, by lowercase header name. Other headers never get echoed.
+func (d *Deflator) echoHeaders(header http.Header) map[string]string {
+	var echo map[string]string
+	for _, name := range d.config.EchoHeaders {
+		value := sanitizeEchoValue(header.Get(textproto.CanonicalMIMEHeaderKey(name)))
+		if value == "" {
+			continue
+		}
+		if echo == nil {
+			echo = make(map[string]string)
+		}
+		echo[strings.ToLower(name)] = value
+	}
+	return echo
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/endpoints"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/s3manager"
+	log "github.com/sirupsen/logrus"
+)
+
+// Object metadata of the client-side encrypted objects, following the
+// conventions of the AWS S3 Encryption Client (v2 format, KMS with context)
+const (
+	EncryptionMetaKey           = "X-Amz-Key-V2"
+	EncryptionMetaIV            = "X-Amz-Iv"
+	EncryptionMetaMatDesc       = "X-Amz-Matdesc"
+	EncryptionMetaWrapAlg       = "X-Amz-Wrap-Alg"
+	EncryptionMetaCEKAlg        = "X-Amz-Cek-Alg"
+	EncryptionMetaTagLen        = "X-Amz-Tag-Len"
+	EncryptionMetaPlaintextSize = "X-Amz-Unencrypted-Content-Length"
+
+	EncryptionWrapAlgKMS        = "kms"
+	EncryptionWrapAlgKMSContext = "kms+context"
+	EncryptionCEKAlgAESGCM      = "AES/GCM/NoPadding"
+
+	// encryptionContextCEKAlg is the encryption context key which binds the
+	// data keys to the content encryption algorithm
+	encryptionContextCEKAlg = "aws:x-amz-cek-alg"
+
+	gcmTagBits = 128
+)
+
+var (
+	// kmsClients holds a *kms.KMS per region
+	kmsClients sync.Map
+)
+
+// kmsClient returns the KMS client of the region of keyID, which is either
+// part of the key ARN or the region of the bucket served by uploader
+func kmsClient(uploader *s3manager.Uploader, keyID string) (*kms.KMS, error) {
+	var region string
+	if client, ok := uploader.S3.(*s3.S3); ok {
+		region = client.Config.Region
+	}
+	if parts := strings.Split(keyID, ":"); len(parts) > 3 && parts[0] == "arn" {
+		region = parts[3]
+	}
+
+	if client, ok := kmsClients.Load(region); ok {
+		return client.(*kms.KMS), nil
+	}
+
+	awsCfg, err := loadAWSConfig()
+	if err != nil {
+		return nil, err
+	}
+	// The S3 endpoint settings don't apply to KMS
+	awsCfg.EndpointResolver = endpoints.NewDefaultResolver()
+	awsCfg.Region = region
+
+	client, _ := kmsClients.LoadOrStore(region, kms.New(awsCfg))
+	return client.(*kms.KMS), nil
+}
+
+// encryptionUnavailableError is returned when KMS can't be used. Encrypted
+// buckets fail closed: nothing gets stored or served without it.
+func encryptionUnavailableError(err error) error {
+	return newRequestError(http.StatusServiceUnavailable, ErrorCodeEncryptionUnavailable, "Encryption unavailable").withCause(err)
+}
+
+// encryptPayload encrypts body with AES-GCM under a new data key of the KMS
+// key keyID, returning the ciphertext and the object metadata needed to
+// decrypt it
+func encryptPayload(ctx context.Context, uploader *s3manager.Uploader, keyID string, body []byte) ([]byte, map[string]string, error) {
+	client, err := kmsClient(uploader, keyID)
+	if err != nil {
+		log.Warnf("Failed to set up KMS for key %q: %s", keyID, err)
+		return nil, nil, encryptionUnavailableError(err)
+	}
+
+	encryptionContext := map[string]string{encryptionContextCEKAlg: EncryptionCEKAlgAESGCM}
+	req := client.GenerateDataKeyRequest(&kms.GenerateDataKeyInput{
+		KeyId:             aws.String(keyID),
+		KeySpec:           kms.DataKeySpecAes256,
+		EncryptionContext: encryptionContext,
+	})
+	req.SetContext(ctx)
+	dataKey, err := req.Send()
+	if err != nil {
+		log.Warnf("Failed to generate a data key with KMS key %q: %s", keyID, err)
+		return nil, nil, encryptionUnavailableError(err)
+	}
+
+	gcm, err := newGCM(dataKey.Plaintext)
+	if err != nil {
+		return nil, nil, encryptionUnavailableError(err)
+	}
+	iv := make([]byte, gcm.NonceSize())
+	if _, err = rand.Read(iv); err != nil {
+		return nil, nil, encryptionUnavailableError(err)
+	}
+	matDesc, err := json.Marshal(encryptionContext)
+	if err != nil {
+		return nil, nil, encryptionUnavailableError(err)
+	}
+
+	metadata := map[string]string{
+		EncryptionMetaKey:           base64.StdEncoding.EncodeToString(dataKey.CiphertextBlob),
+		EncryptionMetaIV:            base64.StdEncoding.EncodeToString(iv),
+		EncryptionMetaMatDesc:       string(matDesc),
+		EncryptionMetaWrapAlg:       EncryptionWrapAlgKMSContext,
+		EncryptionMetaCEKAlg:        EncryptionCEKAlgAESGCM,
+		EncryptionMetaTagLen:        strconv.Itoa(gcmTagBits),
+		EncryptionMetaPlaintextSize: strconv.Itoa(len(body)),
+	}
+
+	// Like the S3 Encryption Client, the tag gets appended to the ciphertext
+	return gcm.Seal(nil, iv, body, nil), metadata, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// metadataValue looks up name in object metadata, whose keys don't always
+// come back with the same case
+func metadataValue(metadata map[string]string, name string) string {
+	for key, value := range metadata {
+		if strings.EqualFold(key, name) {
+			return value
+		}
+	}
+	return ""
+}
+
+// isEncrypted checks if metadata describes a client-side encrypted object
+func isEncrypted(metadata map[string]string) bool {
+	return metadataValue(metadata, EncryptionMetaKey) != ""
+}
+
+// plaintextSize returns the size of the decrypted object, or -1 if the
+// metadata doesn't have it
+func plaintextSize(metadata map[string]string) int64 {
+	size, err := strconv.ParseInt(metadataValue(metadata, EncryptionMetaPlaintextSize), 10, 64)
+	if err != nil {
+		return -1
+	}
+	return size
+}
+
+// decryptPayload reverses encryptPayload, as well as the encryption of the
+// AES-GCM objects written by the S3 Encryption Client with a KMS key. The data
+// key gets decrypted in the region of keyID, the configured key of the bucket
+// if any.
+func decryptPayload(ctx context.Context, uploader *s3manager.Uploader, keyID string, metadata map[string]string, ciphertext []byte) ([]byte, error) {
+	wrapAlg := metadataValue(metadata, EncryptionMetaWrapAlg)
+	cekAlg := metadataValue(metadata, EncryptionMetaCEKAlg)
+	if (wrapAlg != EncryptionWrapAlgKMS && wrapAlg != EncryptionWrapAlgKMSContext) || cekAlg != EncryptionCEKAlgAESGCM {
+		return nil, newRequestError(
+			http.StatusNotImplemented, ErrorCodeNotImplemented,
+			"Unsupported client-side encryption (%q wrapping, %q content encryption)", wrapAlg, cekAlg,
+		)
+	}
+	if tagLen := metadataValue(metadata, EncryptionMetaTagLen); tagLen != "" && tagLen != strconv.Itoa(gcmTagBits) {
+		return nil, newRequestError(http.StatusNotImplemented, ErrorCodeNotImplemented, "Unsupported GCM tag length %s", tagLen)
+	}
+
+	wrappedKey, err := base64.StdEncoding.DecodeString(metadataValue(metadata, EncryptionMetaKey))
+	if err != nil {
+		return nil, corruptEncryptionError(err)
+	}
+	iv, err := base64.StdEncoding.DecodeString(metadataValue(metadata, EncryptionMetaIV))
+	if err != nil {
+		return nil, corruptEncryptionError(err)
+	}
+	var encryptionContext map[string]string
+	if matDesc := metadataValue(metadata, EncryptionMetaMatDesc); matDesc != "" {
+		err = json.Unmarshal([]byte(matDesc), &encryptionContext)
+		if err != nil {
+			return nil, corruptEncryptionError(err)
+		}
+	}
+
+	// The key ID is part of the wrapped key
+	client, err := kmsClient(uploader, keyID)
+	if err != nil {
+		log.Warnf("Failed to set up KMS: %s", err)
+		return nil, encryptionUnavailableError(err)
+	}
+	req := client.DecryptRequest(&kms.DecryptInput{
+		CiphertextBlob:    wrappedKey,
+		EncryptionContext: encryptionContext,
+	})
+	req.SetContext(ctx)
+	dataKey, err := req.Send()
+	if err != nil {
+		log.Warnf("Failed to decrypt a data key with KMS: %s", err)
+		return nil, encryptionUnavailableError(err)
+	}
+
+	gcm, err := newGCM(dataKey.Plaintext)
+	if err != nil {
+		return nil, corruptEncryptionError(err)
+	}
+	if len(iv) != gcm.NonceSize() {
+		return nil, corruptEncryptionError(fmt.Errorf("invalid IV size %d", len(iv)))
+	}
+	body, err := gcm.Open(nil, iv, ciphertext, nil)
+	if err != nil {
+		return nil, corruptEncryptionError(err)
+	}
+
+	return body, nil
+}
+
+// corruptEncryptionError is returned for encrypted objects which can't be
+// decrypted with their data key
+func corruptEncryptionError(err error) error {
+	log.Warnf("Failed to decrypt object: %s", err)
+	return newRequestError(http.StatusInternalServerError, ErrorCodeInternal, "Internal error").withCause(err)
+}
+
+// mergeMetadata returns the object metadata combining the hook metadata with
+// the encryption metadata, which takes precedence
+func mergeMetadata(metadata, encryption map[string]string) map[string]string {
+	merged := make(map[string]string, len(metadata)+len(encryption))
+	for name, value := range metadata {
+		merged[name] = value
+	}
+	for name, value := range encryption {
+		merged[name] = value
+	}
+	return merged
+}
+
+// readDecrypted reads and decrypts the body of a client-side encrypted
+// object, which needs to be held in memory as a whole. Objects larger than
+// the upload size limits can't have been stored by imgdeflator and are
+// rejected.
+func (d *Deflator) readDecrypted(ctx context.Context, location *s3Location, output *s3.GetObjectOutput) ([]byte, error) {
+	limit := d.maxUploadSizeLimit() + gcmTagBits/8
+	ciphertext, err := ioutil.ReadAll(io.LimitReader(output.Body, limit+1))
+	if err != nil {
+		log.Warnf("Failed to download %q: %s", location.logString(), err)
+		return nil, newRequestError(http.StatusServiceUnavailable, ErrorCodeStorageUnavailable, "Internal error").withCause(err)
+	}
+	if int64(len(ciphertext)) > limit {
+		return nil, newRequestError(
+			http.StatusRequestEntityTooLarge, ErrorCodePayloadTooLarge,
+			"Encrypted source object too large (limit: %d bytes)", limit,
+		)
+	}
+
+	uploader, err := getS3Uploader(ctx, location.bucket, location.regionHint, d.config.DefaultS3Region, d.endpointOptions(location.bucket))
+	if err != nil {
+		return nil, uploaderError(location.bucket, err)
+	}
+
+	return decryptPayload(ctx, uploader, d.bucketConfig(location.bucket).KMSKeyID, output.Metadata, ciphertext)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// EnvelopeUploadPath accepts uploads as JSON envelopes
+	EnvelopeUploadPath = "/v1/upload"
+	// EnvelopeOverhead is how much larger than the encoded image an envelope
+	// can be
+	EnvelopeOverhead = 64 * 1024
+)
+
+// uploadEnvelope is the JSON body of EnvelopeUploadPath requests. Options
+// take the same values as the query parameters of regular uploads.
+type uploadEnvelope struct {
+	Bucket      string                 `json:"bucket"`
+	Key         string                 `json:"key"`
+	ContentType string                 `json:"content_type"`
+	DataBase64  string                 `json:"data_base64"`
+	Options     map[string]interface{} `json:"options"`
+}
+
+// query converts the envelope options to query parameters
+func (e *uploadEnvelope) query() (url.Values, error) {
+	query := url.Values{}
+	for name, value := range e.Options {
+		values := []interface{}{value}
+		if list, ok := value.([]interface{}); ok {
+			values = list
+		}
+
+		for _, value := range values {
+			switch value := value.(type) {
+			case string:
+				query.Add(name, value)
+			case float64:
+				query.Add(name, strconv.FormatFloat(value, 'f', -1, 64))
+			case bool:
+				query.Add(name, strconv.FormatBool(value))
+			default:
+				return nil, newRequestError(http.StatusBadRequest, ErrorCodeInvalidEnvelope, "Invalid value for option %q", name)
+			}
+		}
+	}
+
+	return query, nil
+}
+
+// envelopeHandler uploads the base64-encoded image of a JSON envelope. The
+// request URL is signed like the path-based uploads, and the destination is
+// checked against the same allowed destinations.
+func (d *Deflator) envelopeHandler(w http.ResponseWriter, r *http.Request) {
+	log.Infof("Received %s request from %s: %s", r.Method, d.clientIP(r), r.URL)
+
+	if r.Method != http.MethodPost {
+		writeError(w, r, newRequestError(http.StatusMethodNotAllowed, ErrorCodeMethodNotAllowed, "Method not allowed"))
+		return
+	}
+
+	err := d.verifySignature(r.Context(), r.URL)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	// Reject oversized envelopes before reading them entirely
+	limit := d.maxUploadSizeLimit()
+	maxEncodedSize := int64(base64.StdEncoding.EncodedLen(int(limit)))
+	if r.ContentLength > maxEncodedSize+EnvelopeOverhead {
+		writeError(w, r, newRequestError(
+			http.StatusRequestEntityTooLarge, ErrorCodePayloadTooLarge,
+			"File too large (limit: %d bytes)", limit,
+		))
+		return
+	}
+
+	var envelope uploadEnvelope
+	err = json.NewDecoder(http.MaxBytesReader(w, r.Body, maxEncodedSize+EnvelopeOverhead)).Decode(&envelope)
+	if err != nil {
+		log.Debugf("Invalid upload envelope: %s", err)
+		writeError(w, r, newRequestError(http.StatusBadRequest, ErrorCodeInvalidEnvelope, "Invalid JSON envelope"))
+		return
+	}
+
+	required := []struct{ field, value string }{
+		{"bucket", envelope.Bucket},
+		{"key", envelope.Key},
+		{"data_base64", envelope.DataBase64},
+	}
+	for _, field := range required {
+		if field.value == "" {
+			writeError(w, r, newRequestError(http.StatusBadRequest, ErrorCodeMissingField, "Missing field %q", field.field))
+			return
+		}
+	}
+
+	// DecodedLen counts the padding, which is up to 2 bytes
+	if int64(base64.StdEncoding.DecodedLen(len(envelope.DataBase64))) > limit+2 {
+		writeError(w, r, newRequestError(
+			http.StatusRequestEntityTooLarge, ErrorCodePayloadTooLarge,
+			"File too large (limit: %d bytes)", limit,
+		))
+		return
+	}
+
+	data, err := base64.StdEncoding.DecodeString(envelope.DataBase64)
+	if err != nil {
+		log.Debugf("Invalid base64 data: %s", err)
+		writeError(w, r, newRequestError(http.StatusBadRequest, ErrorCodeInvalidBase64, "Invalid data_base64: %s", err))
+		return
+	}
+
+	query, err := envelope.query()
+	if err == nil {
+		err = d.authorizeDestination(envelope.Bucket, envelope.Key)
+	}
+	var options *requestOptions
+	if err == nil {
+		options, err = d.parseOptions(envelope.Bucket, query, nil)
+	}
+	var req *uploadRequest
+	if err == nil {
+		req, err = d.uploadRequestFromOptions(&s3Location{bucket: envelope.Bucket, key: envelope.Key}, options)
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	req.contentType = envelope.ContentType
+	req.clientIP = d.clientIP(r)
+
+	d.serveUpload(w, r, req, bytes.NewReader(data), int64(len(data)))
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	ErrorReportQueueSize     = 100
+	ErrorReportBatchSize     = 20
+	ErrorReportFlushInterval = 5 * time.Second
+)
+
+// errorEvent is an error captured for the error reporter
+type errorEvent struct {
+	Timestamp    time.Time
+	Message      string
+	RequestID    string
+	Bucket       string
+	Key          string
+	AWSErrorCode string
+	Stacktrace   string
+}
+
+// errorTransport delivers batches of captured errors to an error tracking service
+type errorTransport interface {
+	Send(events []*errorEvent) error
+}
+
+// errorReporter captures errors and hands them over to its transport in
+// batches, from a separate goroutine. A nil *errorReporter discards everything.
+type errorReporter struct {
+	transport errorTransport
+	scrubKeys bool
+	events    chan *errorEvent
+	flushes   chan chan struct{}
+}
+
+func newErrorReporter(transport errorTransport, scrubKeys bool) *errorReporter {
+	return &errorReporter{
+		transport: transport,
+		scrubKeys: scrubKeys,
+		events:    make(chan *errorEvent, ErrorReportQueueSize),
+		flushes:   make(chan chan struct{}),
+	}
+}
+
+// Capture queues event for reporting. Events are dropped when the queue is full.
+func (r *errorReporter) Capture(event *errorEvent) {
+	if r == nil {
+		return
+	}
+
+	if r.scrubKeys && event.Key != "" {
+		event.Key = "[scrubbed]"
+	}
+
+	select {
+	case r.events <- event:
+	default:
+		log.Warnf("Error report queue full. Dropping %q", event.Message)
+	}
+}
+
+// Run sends the captured events when a batch is full, when the flush interval
+// elapses and when Flush is called
+func (r *errorReporter) Run() {
+	ticker := time.NewTicker(ErrorReportFlushInterval)
+	defer ticker.Stop()
+
+	var batch []*errorEvent
+	send := func() {
+		if len(batch) == 0 {
+			return
+		}
+		err := r.transport.Send(batch)
+		if err != nil {
+			log.Warnf("Failed to report %d errors: %s", len(batch), err)
+		}
+		batch = nil
+	}
+
+	for {
+		select {
+		case event := <-r.events:
+			batch = append(batch, event)
+			if len(batch) >= ErrorReportBatchSize {
+				send()
+			}
+		case <-ticker.C:
+			send()
+		case done := <-r.flushes:
+			// Drain whatever got queued before the flush was requested
+			for len(r.events) > 0 {
+				batch = append(batch, <-r.events)
+			}
+			send()
+			close(done)
+		}
+	}
+}
+
+// Flush sends all the queued events and waits until that's done or ctx expires
+func (r *errorReporter) Flush(ctx context.Context) {
+	if r == nil {
+		return
+	}
+
+	done := make(chan struct{})
+	select {
+	case r.flushes <- done:
+	case <-ctx.Done():
+		return
+	}
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Warn("Timed out flushing the error reports")
+	}
+}
+
+// sentryTransport sends events to the Sentry store API (or any compatible service)
+type sentryTransport struct {
+	client     *http.Client
+	storeURL   string
+	authHeader string
+}
+
+// newSentryTransport configures a sentryTransport from a DSN in the format
+// `https://<key>@<host>/<project>`, sending the events with client
+func newSentryTransport(dsn string, client *http.Client) (*sentryTransport, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	project := strings.Trim(u.Path, "/")
+	if u.User == nil || u.User.Username() == "" || project == "" {
+		return nil, fmt.Errorf("missing key or project in DSN")
+	}
+
+	auth := "Sentry sentry_version=7, sentry_client=imgdeflator/1.0, sentry_key=" + u.User.Username()
+	if secret, ok := u.User.Password(); ok {
+		auth += ", sentry_secret=" + secret
+	}
+
+	return &sentryTransport{
+		client:     client,
+		storeURL:   u.Scheme + "://" + u.Host + "/api/" + project + "/store/",
+		authHeader: auth,
+	}, nil
+}
+
+// Send posts each event to the store API, which doesn't accept batches
+func (t *sentryTransport) Send(events []*errorEvent) error {
+	for _, event := range events {
+		var id [16]byte
+		if _, err := rand.Read(id[:]); err != nil {
+			return fmt.Errorf("failed to generate event ID: %s", err)
+		}
+
+		tags := map[string]string{}
+		for name, value := range map[string]string{
+			"request_id":     event.RequestID,
+			"bucket":         event.Bucket,
+			"key":            event.Key,
+			"aws_error_code": event.AWSErrorCode,
+		} {
+			if value != "" {
+				tags[name] = value
+			}
+		}
+
+		payload := map[string]interface{}{
+			"event_id":  hex.EncodeToString(id[:]),
+			"timestamp": event.Timestamp.UTC().Format("2006-01-02T15:04:05"),
+			"level":     "error",
+			"logger":    "imgdeflator",
+			"platform":  "go",
+			"message":   event.Message,
+			"tags":      tags,
+		}
+		if event.Stacktrace != "" {
+			payload["extra"] = map[string]string{"stacktrace": event.Stacktrace}
+		}
+
+		body, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+
+		req, err := http.NewRequest(http.MethodPost, t.storeURL, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Sentry-Auth", t.authHeader)
+
+		resp, err := t.client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("unexpected status from %s: %s", t.storeURL, resp.Status)
+		}
+	}
+
+	return nil
+}
+
+// RequestIDHeader identifies a request in the responses, the logs and the
+// error reports
+const RequestIDHeader = "X-Request-Id"
+
+// requestID returns the X-Request-Id of r, generating one if the client
+// didn't send it. The requests served by the routes got theirs from
+// requestIDHandler.
+func requestID(r *http.Request) string {
+	id := r.Header.Get(RequestIDHeader)
+	if id == "" {
+		id, _ = newUUID()
+		r.Header.Set(RequestIDHeader, id)
+	}
+	return id
+}
+
+// requestIDHandler assigns the request ID before handler runs, and returns
+// it in the X-Request-Id response header of every response
+func requestIDHandler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(RequestIDHeader, requestID(r))
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// reportServerError captures err if it results in a 5xx response
+func (d *Deflator) reportServerError(r *http.Request, bucket, key string, err error) {
+	if d.errorReporter == nil {
+		return
+	}
+
+	status, _ := errorStatus(err)
+	if status < http.StatusInternalServerError {
+		return
+	}
+
+	event := &errorEvent{
+		Timestamp: d.clock.Now(),
+		Message:   err.Error(),
+		RequestID: requestID(r),
+		Bucket:    bucket,
+		Key:       key,
+	}
+	if rerr, ok := err.(*requestError); ok && rerr.cause != nil {
+		event.Message = rerr.cause.Error()
+		event.AWSErrorCode = awsErrorCode(rerr.cause)
+	}
+
+	d.errorReporter.Capture(event)
+}
+
+// recoverHandler turns panics in handler into 500 responses and reports them
+func (d *Deflator) recoverHandler(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if p := recover(); p != nil {
+				if p == http.ErrAbortHandler {
+					panic(p)
+				}
+
+				stack := string(debug.Stack())
+				log.Errorf("Panic while handling %s %s: %v\n%s", r.Method, describePath(r.URL.Path), p, stack)
+				d.errorReporter.Capture(&errorEvent{
+					Timestamp:  d.clock.Now(),
+					Message:    fmt.Sprintf("panic: %v", p),
+					RequestID:  requestID(r),
+					Stacktrace: stack,
+				})
+				d.recordPanic(r, p, stack)
+
+				writeError(w, r, newRequestError(http.StatusInternalServerError, ErrorCodeInternal, "Internal error"))
+			}
+		}()
+
+		handler(w, r)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Error codes returned to clients in the `code` field of error responses
+const (
+	ErrorCodeMethodNotAllowed              = "method_not_allowed"
+	ErrorCodeInvalidSignature              = "invalid_signature"
+	ErrorCodeInvalidPath                   = "invalid_path"
+	ErrorCodeMalformedPath                 = "malformed_path"
+	ErrorCodeInvalidBucket                 = "invalid_bucket"
+	ErrorCodeInvalidRegion                 = "invalid_region"
+	ErrorCodeInvalidDimensions             = "invalid_dimensions"
+	ErrorCodeInvalidTTL                    = "invalid_ttl"
+	ErrorCodeInvalidFormat                 = "invalid_format"
+	ErrorCodeInvalidRange                  = "invalid_range"
+	ErrorCodeInvalidKey                    = "invalid_key"
+	ErrorCodeInvalidContentType            = "invalid_content_type"
+	ErrorCodeUnsupportedMediaType          = "unsupported_media_type"
+	ErrorCodeInvalidParameter              = "invalid_parameter"
+	ErrorCodeConflictingParameter          = "conflicting_parameter"
+	ErrorCodeNotImplemented                = "not_implemented"
+	ErrorCodeInvalidEnvelope               = "invalid_envelope"
+	ErrorCodeInvalidBase64                 = "invalid_base64"
+	ErrorCodeMissingField                  = "missing_field"
+	ErrorCodeMetadataTooLarge              = "metadata_too_large"
+	ErrorCodeObjectLimitExceeded           = "object_limit_exceeded"
+	ErrorCodeInvalidSession                = "invalid_session"
+	ErrorCodeSessionExpired                = "session_expired"
+	ErrorCodeSessionUsed                   = "session_used"
+	ErrorCodeSessionMismatch               = "session_mismatch"
+	ErrorCodeOffsetMismatch                = "offset_mismatch"
+	ErrorCodeUploadFinalizing              = "upload_finalizing"
+	ErrorCodeUploadExpired                 = "upload_expired"
+	ErrorCodePreconditionFailed            = "precondition_failed"
+	ErrorCodeBucketNotAllowed              = "bucket_not_allowed"
+	ErrorCodeBucketOwnerMismatch           = "bucket_owner_mismatch"
+	ErrorCodeForbidden                     = "forbidden"
+	ErrorCodeNotFound                      = "not_found"
+	ErrorCodeAlreadyExists                 = "already_exists"
+	ErrorCodePayloadTooLarge               = "payload_too_large"
+	ErrorCodeOutputTooLarge                = "output_too_large"
+	ErrorCodePayloadTooSmall               = "payload_too_small"
+	ErrorCodeWorkBudgetExceeded            = "work_budget_exceeded"
+	ErrorCodeEmptyBody                     = "empty_body"
+	ErrorCodeTruncatedImage                = "truncated_image"
+	ErrorCodeInfected                      = "infected"
+	ErrorCodeDenylistedImage               = "denylisted_image"
+	ErrorCodeRateLimited                   = "rate_limited"
+	ErrorCodeConcurrencyLimitExceeded      = "concurrency_limit_exceeded"
+	ErrorCodeOverloaded                    = "overloaded"
+	ErrorCodeRejected                      = "rejected"
+	ErrorCodeRequestStalled                = "request_stalled"
+	ErrorCodeUploadStalled                 = "upload_stalled"
+	ErrorCodeUploadTimeout                 = "upload_timeout"
+	ErrorCodeDeadlineExceededOnArrival     = "deadline_exceeded_on_arrival"
+	ErrorCodeTransformFailed               = "transform_failed"
+	ErrorCodeStorageCredentialsUnavailable = "storage_credentials_unavailable"
+	ErrorCodeStorageUnavailable            = "storage_unavailable"
+	ErrorCodeStorageVerificationFailed     = "storage_verification_failed"
+	ErrorCodeStorageMaintenance            = "storage_maintenance"
+	ErrorCodeRegionLookupFailed            = "region_lookup_failed"
+	ErrorCodeProxyUnavailable              = "proxy_unavailable"
+	ErrorCodeInsufficientStorage           = "insufficient_storage"
+	ErrorCodeEncryptionUnavailable         = "encryption_unavailable"
+	ErrorCodeScannerUnavailable            = "scanner_unavailable"
+	ErrorCodeInternal                      = "internal_error"
+)
+
+// retryableErrorCodes are the error codes for failures which may succeed if
+// the same request is retried later
+var retryableErrorCodes = map[string]bool{
+	ErrorCodeRateLimited:                   true,
+	ErrorCodeConcurrencyLimitExceeded:      true,
+	ErrorCodeOverloaded:                    true,
+	ErrorCodeRequestStalled:                true,
+	ErrorCodeUploadStalled:                 true,
+	ErrorCodeUploadTimeout:                 true,
+	ErrorCodeStorageUnavailable:            true,
+	ErrorCodeStorageVerificationFailed:     true,
+	ErrorCodeStorageMaintenance:            true,
+	ErrorCodeStorageCredentialsUnavailable: true,
+	ErrorCodeRegionLookupFailed:            true,
+	ErrorCodeProxyUnavailable:              true,
+	ErrorCodeEncryptionUnavailable:         true,
+	ErrorCodeScannerUnavailable:            true,
+}
+
+var (
+	// errorsByCode counts the error responses by error code
+	errorsByCode = expvar.NewMap("errors")
+)
+
+// requestError is returned by the pipeline for failures which should be
+// reported to the client with a specific HTTP status code
+type requestError struct {
+	status  int
+	code    string
+	message string
+	// cause is the underlying error, which doesn't get exposed to the client
+	cause error
+	// retryAfter is sent to the client in the Retry-After header, if set
+	retryAfter time.Duration
+	// detail is added to the JSON response, if set
+	detail interface{}
+}
+
+func (e *requestError) Error() string {
+	return e.message
+}
+
+func newRequestError(status int, code string, format string, args ...interface{}) *requestError {
+	return &requestError{status: status, code: code, message: fmt.Sprintf(format, args...)}
+}
+
+// withCause records the underlying error of e for error reporting
+func (e *requestError) withCause(err error) *requestError {
+	e.cause = err
+	return e
+}
+
+// errorStatus returns the HTTP status code and the client-facing message for err
+func errorStatus(err error) (int, string) {
+	if rerr, ok := err.(*requestError); ok {
+		return rerr.status, rerr.message
+	}
+	return http.StatusInternalServerError, "Internal error"
+}
+
+// errorCode returns the machine-readable code for err
+func errorCode(err error) string {
+	if rerr, ok := err.(*requestError); ok {
+		return rerr.code
+	}
+	return ErrorCodeInternal
+}
+
+// errorResponse is the JSON body of error responses
+type errorResponse struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id"`
+	Retryable bool   `json:"retryable"`
+	// Detail has the context of some errors, like upload timeouts
+	Detail interface{} `json:"detail,omitempty"`
+}
+
+// acceptsPlainText reports whether the client asked for plain text errors
+// rather than JSON, like older clients do
+func acceptsPlainText(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "text/plain") && !strings.Contains(accept, "application/json")
+}
+
+// writeError sends the HTTP response for err
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	err = shedS3BudgetError(err)
+	status, message := errorStatus(err)
+	code := errorCode(err)
+	errorsByCode.Add(code, 1)
+
+	if rerr, ok := err.(*requestError); ok && rerr.retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(rerr.retryAfter.Seconds()))))
+	}
+
+	if acceptsPlainText(r) {
+		http.Error(w, message, status)
+		return
+	}
+
+	response := &errorResponse{
+		Code:      code,
+		Message:   message,
+		RequestID: requestID(r),
+		Retryable: retryableErrorCodes[code],
+	}
+	if rerr, ok := err.(*requestError); ok {
+		response.Detail = rerr.detail
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteError(t *testing.T) {
+	rateLimited := newRequestError(http.StatusTooManyRequests, ErrorCodeRateLimited, "Slow down")
+	rateLimited.retryAfter = 1500 * time.Millisecond
+
+	tests := []struct {
+		err        error
+		status     int
+		code       string
+		retryable  bool
+		retryAfter string
+	}{
+		{newRequestError(http.StatusBadRequest, ErrorCodeInvalidPath, "Bad request"), http.StatusBadRequest, ErrorCodeInvalidPath, false, ""},
+		{newRequestError(http.StatusForbidden, ErrorCodeBucketNotAllowed, "Forbidden"), http.StatusForbidden, ErrorCodeBucketNotAllowed, false, ""},
+		{newRequestError(http.StatusRequestEntityTooLarge, ErrorCodePayloadTooLarge, "File too large"), http.StatusRequestEntityTooLarge, ErrorCodePayloadTooLarge, false, ""},
+		{newRequestError(http.StatusServiceUnavailable, ErrorCodeTransformFailed, "Internal error"), http.StatusServiceUnavailable, ErrorCodeTransformFailed, false, ""},
+		{newRequestError(http.StatusServiceUnavailable, ErrorCodeStorageUnavailable, "Internal error"), http.StatusServiceUnavailable, ErrorCodeStorageUnavailable, true, ""},
+		{newRequestError(http.StatusGatewayTimeout, ErrorCodeUploadTimeout, "Upload timeout"), http.StatusGatewayTimeout, ErrorCodeUploadTimeout, true, ""},
+		{rateLimited, http.StatusTooManyRequests, ErrorCodeRateLimited, true, "2"},
+		{errors.New("unexpected"), http.StatusInternalServerError, ErrorCodeInternal, false, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.code, func(t *testing.T) {
+			before := errorCount(test.code)
+
+			r := httptest.NewRequest(http.MethodPost, "/", nil)
+			r.Header.Set(RequestIDHeader, "request-1")
+			w := httptest.NewRecorder()
+			writeError(w, r, test.err)
+
+			if w.Code != test.status {
+				t.Errorf("Expected status %d, got %d", test.status, w.Code)
+			}
+			if w.Header().Get("Content-Type") != "application/json" {
+				t.Errorf("Expected a JSON response, got %q", w.Header().Get("Content-Type"))
+			}
+			if w.Header().Get("Retry-After") != test.retryAfter {
+				t.Errorf("Expected Retry-After %q, got %q", test.retryAfter, w.Header().Get("Retry-After"))
+			}
+
+			var response errorResponse
+			err := json.Unmarshal(w.Body.Bytes(), &response)
+			if err != nil {
+				t.Fatalf("Failed to decode the error response %q: %s", w.Body.String(), err)
+			}
+			if response.Code != test.code || response.Retryable != test.retryable || response.RequestID != "request-1" {
+				t.Errorf("Expected code %s (retryable: %t) for request-1, got %+v", test.code, test.retryable, response)
+			}
+			if count := errorCount(test.code); count != before+1 {
+				t.Errorf("Expected the %s error count to go from %d to %d, got %d", test.code, before, before+1, count)
+			}
+		})
+	}
+}
+
+func TestWriteErrorPlainText(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	r.Header.Set("Accept", "text/plain")
+	w := httptest.NewRecorder()
+	writeError(w, r, newRequestError(http.StatusBadRequest, ErrorCodeInvalidPath, "Bad request"))
+
+	if w.Code != http.StatusBadRequest || strings.TrimSpace(w.Body.String()) != "Bad request" {
+		t.Errorf("Expected the plain text message, got %d: %q", w.Code, w.Body.String())
+	}
+}
+
+func TestUploaderErrorCodes(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{&bucketNotFoundError{bucket: "bucket"}, http.StatusNotFound, ErrorCodeNotFound},
+		{&regionLookupError{bucket: "bucket", err: errors.New("timeout")}, http.StatusServiceUnavailable, ErrorCodeRegionLookupFailed},
+		{&unknownPartitionError{region: "xx-east-1"}, http.StatusBadRequest, ErrorCodeInvalidRegion},
+		{errors.New("invalid bucket"), http.StatusBadRequest, ErrorCodeInvalidBucket},
+		{newRequestError(http.StatusForbidden, ErrorCodeBucketOwnerMismatch, "Forbidden"), http.StatusForbidden, ErrorCodeBucketOwnerMismatch},
+	}
+
+	for _, test := range tests {
+		err := uploaderError("bucket", test.err)
+		status, _ := errorStatus(err)
+		if status != test.status || errorCode(err) != test.code {
+			t.Errorf("Expected %d %s for %q, got %d %s", test.status, test.code, test.err, status, errorCode(err))
+		}
+	}
+}
+
+func TestRouteErrorCodes(t *testing.T) {
+	s := newTestServer(t, func(config *Config) {
+		config.MaxUploadSize = 1024
+		config.AllowedDestinations = []string{TestBucket + "/images/"}
+	})
+	defer s.close()
+
+	tests := []struct {
+		name   string
+		method string
+		url    string
+		body   []byte
+		status int
+		code   string
+	}{
+		{"method", http.MethodPatch, s.uploadURL(TestBucket, "images/photo.png", "width=16"), nil, http.StatusBadRequest, ErrorCodeMethodNotAllowed},
+		{"signature", http.MethodPost, s.uploadURL(TestBucket, "images/photo.png", "width=16") + "0", []byte("image"), http.StatusBadRequest, ErrorCodeInvalidSignature},
+		{"destination", http.MethodPost, s.uploadURL(TestBucket, "other/photo.png", "width=16"), []byte("image"), http.StatusForbidden, ErrorCodeBucketNotAllowed},
+		{"dimensions", http.MethodPost, s.uploadURL(TestBucket, "images/photo.png", ""), []byte("image"), http.StatusBadRequest, ErrorCodeInvalidDimensions},
+		{"size", http.MethodPost, s.uploadURL(TestBucket, "images/photo.png", "width=16"), bytes.Repeat([]byte{0}, 2048), http.StatusRequestEntityTooLarge, ErrorCodePayloadTooLarge},
+		{"transform", http.MethodPost, s.uploadURL(TestBucket, "images/photo.png", "width=16"), []byte("not an image"), http.StatusServiceUnavailable, ErrorCodeTransformFailed},
+		{"not found", http.MethodHead, s.uploadURL(TestBucket, "images/missing.png", ""), nil, http.StatusNotFound, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r, err := http.NewRequest(test.method, test.url, bytes.NewReader(test.body))
+			if err != nil {
+				t.Fatalf("Failed to create the request: %s", err)
+			}
+			resp, err := http.DefaultClient.Do(r)
+			if err != nil {
+				t.Fatalf("Failed to send the request: %s", err)
+			}
+
+			id := resp.Header.Get(RequestIDHeader)
+			if id == "" {
+				t.Errorf("Expected a %s response header", RequestIDHeader)
+			}
+			if test.method == http.MethodHead {
+				resp.Body.Close()
+				if resp.StatusCode != test.status {
+					t.Errorf("Expected status %d, got %d", test.status, resp.StatusCode)
+				}
+				return
+			}
+
+			response := decodeError(t, resp, test.status)
+			if test.code != "" && response.Code != test.code {
+				t.Errorf("Expected the %s code, got %s", test.code, response.Code)
+			}
+			if response.RequestID != id {
+				t.Errorf("Expected the request ID %q of the response header, got %q", id, response.RequestID)
+			}
+		})
+	}
+}
+
+func TestRequestIDOnSuccess(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.close()
+
+	r, err := http.NewRequest(http.MethodGet, s.server.URL+"/health", nil)
+	if err != nil {
+		t.Fatalf("Failed to create the request: %s", err)
+	}
+	r.Header.Set(RequestIDHeader, "client-id")
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatalf("Failed to send the request: %s", err)
+	}
+	resp.Body.Close()
+	if id := resp.Header.Get(RequestIDHeader); id != "client-id" {
+		t.Errorf("Expected the request ID of the client, got %q", id)
+	}
+
+	resp = s.post("photo.png", "width=16", bytes.NewReader(testPNG(t, 16, 16)))
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get(RequestIDHeader) == "" {
+		t.Errorf("Expected a generated request ID on the successful upload, got %d with %q", resp.StatusCode, resp.Header.Get(RequestIDHeader))
+	}
+}
+
+// errorCount returns the number of error responses with code so far
+func errorCount(code string) int64 {
+	count, ok := errorsByCode.Get(code).(*expvar.Int)
+	if !ok {
+		return 0
+	}
+	return count.Value()
+}
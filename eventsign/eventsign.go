@@ -0,0 +1,158 @@
+// Package eventsign signs the payloads sent by imgdeflator to other services
+// and verifies them on the receiving end. A payload is signed with the HMAC
+// SHA-256 of its timestamp and body, under one of several keys so they can be
+// rotated: every key has a validity window, the most recent active key signs
+// and receivers keep accepting the older ones until their window ends.
+//
+// Receivers check the headers with Verify:
+//
+//	keys := eventsign.KeySet{
+//		{ID: "2019-06", Secret: oldSecret, NotAfter: rotation.Add(24 * time.Hour)},
+//		{ID: "2019-07", Secret: newSecret, NotBefore: rotation},
+//	}
+//	err := eventsign.Verify(keys, r.Header, body, time.Now(), 5*time.Minute)
+package eventsign
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// KeyIDHeader is the ID of the key which signed the payload
+	KeyIDHeader = "X-Imgdeflator-Key-Id"
+	// TimestampHeader is the Unix time the payload was signed at
+	TimestampHeader = "X-Imgdeflator-Timestamp"
+	// SignatureHeader is the versioned signature, e.g. `v1=<hex HMAC>`
+	SignatureHeader = "X-Imgdeflator-Signature"
+
+	// signatureVersion prefixes the signatures of the current scheme
+	signatureVersion = "v1="
+)
+
+var (
+	// ErrNoActiveKey is returned by Sign when no key is valid at that time
+	ErrNoActiveKey = errors.New("no active signing key")
+	// ErrMissingSignature is returned for payloads without the signature headers
+	ErrMissingSignature = errors.New("missing signature headers")
+	// ErrUnknownKey is returned for signatures from keys missing from the set
+	ErrUnknownKey = errors.New("unknown signing key")
+	// ErrExpiredKey is returned for signatures made outside the key's
+	// validity window
+	ErrExpiredKey = errors.New("signing key not valid at the signature time")
+	// ErrClockSkew is returned for signatures whose timestamp is too far from
+	// the verification time, which is what stops replays
+	ErrClockSkew = errors.New("signature timestamp outside the allowed clock skew")
+	// ErrInvalidSignature is returned when the signature doesn't match
+	ErrInvalidSignature = errors.New("invalid signature")
+)
+
+// Key is a signing key. A zero NotBefore or NotAfter leaves that side of its
+// validity window open.
+type Key struct {
+	ID        string
+	Secret    []byte
+	NotBefore time.Time
+	NotAfter  time.Time
+}
+
+// validAt checks that t is within the validity window of k
+func (k *Key) validAt(t time.Time) bool {
+	return (k.NotBefore.IsZero() || !t.Before(k.NotBefore)) &&
+		(k.NotAfter.IsZero() || t.Before(k.NotAfter))
+}
+
+// KeySet is the list of keys which are (or were) in use
+type KeySet []Key
+
+// signingKey returns the active key which became valid last
+func (s KeySet) signingKey(now time.Time) *Key {
+	var signing *Key
+	for i := range s {
+		key := &s[i]
+		if key.validAt(now) && (signing == nil || key.NotBefore.After(signing.NotBefore)) {
+			signing = key
+		}
+	}
+	return signing
+}
+
+// find returns the key with id, if any
+func (s KeySet) find(id string) *Key {
+	for i := range s {
+		if s[i].ID == id {
+			return &s[i]
+		}
+	}
+	return nil
+}
+
+// mac computes the signature of body at timestamp with secret
+func mac(secret []byte, timestamp string, body []byte) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(timestamp))
+	h.Write([]byte("."))
+	h.Write(body)
+	return h.Sum(nil)
+}
+
+// Sign sets the signature headers of body, signed at now with the current
+// key of the set
+func (s KeySet) Sign(header http.Header, body []byte, now time.Time) error {
+	key := s.signingKey(now)
+	if key == nil {
+		return ErrNoActiveKey
+	}
+
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	header.Set(KeyIDHeader, key.ID)
+	header.Set(TimestampHeader, timestamp)
+	header.Set(SignatureHeader, signatureVersion+hex.EncodeToString(mac(key.Secret, timestamp, body)))
+	return nil
+}
+
+// Verify checks the signature headers of body against keys. The signature
+// has to come from a key which was valid when the payload was signed, and be
+// no further than maxSkew from now, so a captured payload can't be replayed
+// later on. Receivers which can't tolerate replays within maxSkew need to
+// remember the signatures they've seen for that long.
+func Verify(keys KeySet, header http.Header, body []byte, now time.Time, maxSkew time.Duration) error {
+	keyID := header.Get(KeyIDHeader)
+	timestamp := header.Get(TimestampHeader)
+	signature := header.Get(SignatureHeader)
+	if keyID == "" || timestamp == "" || signature == "" {
+		return ErrMissingSignature
+	}
+
+	key := keys.find(keyID)
+	if key == nil {
+		return ErrUnknownKey
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	signedAt := time.Unix(seconds, 0)
+	if skew := now.Sub(signedAt); skew > maxSkew || skew < -maxSkew {
+		return ErrClockSkew
+	}
+	if !key.validAt(signedAt) {
+		return ErrExpiredKey
+	}
+
+	if !strings.HasPrefix(signature, signatureVersion) {
+		return ErrInvalidSignature
+	}
+	sum, err := hex.DecodeString(strings.TrimPrefix(signature, signatureVersion))
+	if err != nil || !hmac.Equal(sum, mac(key.Secret, timestamp, body)) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
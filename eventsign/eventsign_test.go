@@ -0,0 +1,195 @@
+package eventsign
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var (
+	rotation = time.Date(2019, 7, 1, 0, 0, 0, 0, time.UTC)
+	oldKey   = Key{ID: "2019-06", Secret: []byte("old secret"), NotAfter: rotation.Add(24 * time.Hour)}
+	newKey   = Key{ID: "2019-07", Secret: []byte("new secret"), NotBefore: rotation}
+	// keys is the set during the rotation, once both keys are deployed
+	keys = KeySet{oldKey, newKey}
+)
+
+const maxSkew = 5 * time.Minute
+
+// sign returns the signature headers of body, signed with keys at that time
+func sign(t *testing.T, keys KeySet, body []byte, at time.Time) http.Header {
+	header := make(http.Header)
+	err := keys.Sign(header, body, at)
+	if err != nil {
+		t.Fatalf("Failed to sign at %s: %s", at, err)
+	}
+	return header
+}
+
+func TestSignVerify(t *testing.T) {
+	body := []byte(`{"bucket":"bucket","key":"photo.png"}`)
+	at := rotation.Add(time.Hour + 500*time.Millisecond)
+	header := sign(t, keys, body, at)
+
+	if header.Get(KeyIDHeader) != newKey.ID {
+		t.Errorf("Expected the newest active key to sign, got %q", header.Get(KeyIDHeader))
+	}
+	if header.Get(TimestampHeader) != strconv.FormatInt(at.Unix(), 10) {
+		t.Errorf("Expected the Unix timestamp %d, got %q", at.Unix(), header.Get(TimestampHeader))
+	}
+	if err := Verify(keys, header, body, at, maxSkew); err != nil {
+		t.Errorf("Failed to verify the signature: %s", err)
+	}
+}
+
+func TestRotationOverlap(t *testing.T) {
+	body := []byte("payload")
+
+	// Before the rotation, only the old key is active
+	before := sign(t, keys, body, rotation.Add(-time.Second))
+	if before.Get(KeyIDHeader) != oldKey.ID {
+		t.Fatalf("Expected the old key to sign before the rotation, got %q", before.Get(KeyIDHeader))
+	}
+	after := sign(t, keys, body, rotation)
+	if after.Get(KeyIDHeader) != newKey.ID {
+		t.Fatalf("Expected the new key to sign from the rotation on, got %q", after.Get(KeyIDHeader))
+	}
+
+	// Receivers accept both keys across the rotation
+	for _, header := range []http.Header{before, after} {
+		if err := Verify(keys, header, body, rotation.Add(time.Minute), maxSkew); err != nil {
+			t.Errorf("Failed to verify the %s signature after the rotation: %s", header.Get(KeyIDHeader), err)
+		}
+	}
+
+	// Senders which didn't get the new key yet keep signing with the old one,
+	// until its window ends
+	late := sign(t, KeySet{oldKey}, body, rotation.Add(time.Hour))
+	if err := Verify(keys, late, body, rotation.Add(time.Hour), maxSkew); err != nil {
+		t.Errorf("Failed to verify the old key within its window: %s", err)
+	}
+
+	// Receivers which didn't get the new key yet reject its signatures
+	if err := Verify(KeySet{oldKey}, after, body, rotation, maxSkew); err != ErrUnknownKey {
+		t.Errorf("Expected %q, got %v", ErrUnknownKey, err)
+	}
+}
+
+func TestExpiredKey(t *testing.T) {
+	body := []byte("payload")
+
+	// An old sender signs with the old key after its window
+	expired := rotation.Add(25 * time.Hour)
+	header := make(http.Header)
+	if err := (KeySet{{ID: oldKey.ID, Secret: oldKey.Secret}}).Sign(header, body, expired); err != nil {
+		t.Fatalf("Failed to sign: %s", err)
+	}
+	if err := Verify(keys, header, body, expired, maxSkew); err != ErrExpiredKey {
+		t.Errorf("Expected %q after the end of the window, got %v", ErrExpiredKey, err)
+	}
+
+	// Nor is the new key valid before its window
+	early := rotation.Add(-time.Hour)
+	header = make(http.Header)
+	if err := (KeySet{{ID: newKey.ID, Secret: newKey.Secret}}).Sign(header, body, early); err != nil {
+		t.Fatalf("Failed to sign: %s", err)
+	}
+	if err := Verify(keys, header, body, early, maxSkew); err != ErrExpiredKey {
+		t.Errorf("Expected %q before the start of the window, got %v", ErrExpiredKey, err)
+	}
+
+	// The end of the window is exclusive
+	if err := (KeySet{oldKey}).Sign(make(http.Header), body, oldKey.NotAfter); err != ErrNoActiveKey {
+		t.Errorf("Expected %q at the end of the window, got %v", ErrNoActiveKey, err)
+	}
+	if err := (KeySet{newKey}).Sign(make(http.Header), body, rotation.Add(-time.Second)); err != ErrNoActiveKey {
+		t.Errorf("Expected %q before the start of the window, got %v", ErrNoActiveKey, err)
+	}
+}
+
+func TestClockSkew(t *testing.T) {
+	body := []byte("payload")
+	at := rotation.Add(time.Hour)
+	header := sign(t, keys, body, at)
+
+	for _, now := range []time.Time{at.Add(-maxSkew), at.Add(maxSkew)} {
+		if err := Verify(keys, header, body, now, maxSkew); err != nil {
+			t.Errorf("Failed to verify the signature %s away: %s", now.Sub(at), err)
+		}
+	}
+	// Replays after maxSkew are rejected, and so are the timestamps from the
+	// future
+	for _, now := range []time.Time{at.Add(-maxSkew - time.Second), at.Add(maxSkew + time.Second)} {
+		if err := Verify(keys, header, body, now, maxSkew); err != ErrClockSkew {
+			t.Errorf("Expected %q %s away, got %v", ErrClockSkew, now.Sub(at), err)
+		}
+	}
+}
+
+func TestTamperedPayload(t *testing.T) {
+	body := []byte(`{"bucket":"bucket","key":"photo.png"}`)
+	at := rotation.Add(time.Hour)
+
+	tests := []struct {
+		name   string
+		tamper func(header http.Header) []byte
+		err    error
+	}{
+		{"body", func(http.Header) []byte { return []byte(`{"bucket":"bucket","key":"other.png"}`) }, ErrInvalidSignature},
+		{"truncated body", func(http.Header) []byte { return body[:len(body)-1] }, ErrInvalidSignature},
+		{"timestamp", func(header http.Header) []byte {
+			header.Set(TimestampHeader, strconv.FormatInt(at.Unix()+1, 10))
+			return body
+		}, ErrInvalidSignature},
+		{"invalid timestamp", func(header http.Header) []byte {
+			header.Set(TimestampHeader, "yesterday")
+			return body
+		}, ErrInvalidSignature},
+		// The signature of the old key doesn't match under the new one
+		{"key", func(header http.Header) []byte {
+			header.Set(KeyIDHeader, oldKey.ID)
+			return body
+		}, ErrInvalidSignature},
+		{"unknown key", func(header http.Header) []byte {
+			header.Set(KeyIDHeader, "2019-08")
+			return body
+		}, ErrUnknownKey},
+		{"signature", func(header http.Header) []byte {
+			signature := []byte(header.Get(SignatureHeader))
+			signature[len(signature)-1] ^= 1
+			header.Set(SignatureHeader, string(signature))
+			return body
+		}, ErrInvalidSignature},
+		{"version", func(header http.Header) []byte {
+			header.Set(SignatureHeader, "v2="+header.Get(SignatureHeader)[len(signatureVersion):])
+			return body
+		}, ErrInvalidSignature},
+		{"not hex", func(header http.Header) []byte {
+			header.Set(SignatureHeader, signatureVersion+"signature")
+			return body
+		}, ErrInvalidSignature},
+		{"missing signature", func(header http.Header) []byte {
+			header.Del(SignatureHeader)
+			return body
+		}, ErrMissingSignature},
+		{"missing timestamp", func(header http.Header) []byte {
+			header.Del(TimestampHeader)
+			return body
+		}, ErrMissingSignature},
+		{"missing key", func(header http.Header) []byte {
+			header.Del(KeyIDHeader)
+			return body
+		}, ErrMissingSignature},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			header := sign(t, keys, body, at)
+			tampered := test.tamper(header)
+			if err := Verify(keys, header, tampered, at, maxSkew); err != test.err {
+				t.Errorf("Expected %q, got %v", test.err, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+)
+
+// AdminFailuresPath is the admin endpoint for the recently failed requests
+const AdminFailuresPath = "/admin/failures"
+
+// failureTiming is the time spent in a pipeline stage by a failed request
+type failureTiming struct {
+	Stage      string  `json:"stage"`
+	DurationMS float64 `json:"duration_ms"`
+}
+
+// failureRecord is what's kept of a failed request for the admin API. It
+// never holds the request body, the query string (which has the signature)
+// or the request headers.
+type failureRecord struct {
+	RequestID string    `json:"request_id"`
+	Time      time.Time `json:"time"`
+	Method    string    `json:"method"`
+	ClientIP  string    `json:"client_ip,omitempty"`
+	Principal string    `json:"principal,omitempty"`
+	// Destination is the decoded destination, with the full key
+	Destination   string            `json:"destination,omitempty"`
+	RegionHint    string            `json:"region_hint,omitempty"`
+	Options       map[string]string `json:"options,omitempty"`
+	ContentType   string            `json:"content_type,omitempty"`
+	DeclaredSize  int64             `json:"declared_size,omitempty"`
+	BytesRead     int64             `json:"bytes_read"`
+	BytesUploaded int64             `json:"bytes_uploaded"`
+	// Stage is the stage the request failed in
+	Stage   string          `json:"stage,omitempty"`
+	Timings []failureTiming `json:"timings,omitempty"`
+
+	Status       int    `json:"status"`
+	Code         string `json:"code"`
+	Message      string `json:"message"`
+	Cause        string `json:"cause,omitempty"`
+	AWSErrorCode string `json:"aws_error_code,omitempty"`
+	AWSRequestID string `json:"aws_request_id,omitempty"`
+	Stacktrace   string `json:"stacktrace,omitempty"`
+}
+
+// failureBuffer keeps the records of the last failed requests, up to its
+// size and for up to its retention. A nil *failureBuffer records nothing.
+type failureBuffer struct {
+	clock     Clock
+	retention time.Duration
+
+	mu      sync.Mutex
+	records []*failureRecord
+	// next is where the next record goes once the buffer is full
+	next int
+}
+
+func newFailureBuffer(clock Clock, size int, retention time.Duration) *failureBuffer {
+	return &failureBuffer{
+		clock:     clock,
+		retention: retention,
+		records:   make([]*failureRecord, 0, size),
+	}
+}
+
+// add stores record, replacing the oldest one when the buffer is full
+func (b *failureBuffer) add(record *failureRecord) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.records) < cap(b.records) {
+		b.records = append(b.records, record)
+		return
+	}
+	b.records[b.next] = record
+	b.next = (b.next + 1) % len(b.records)
+}
+
+// list returns the records which haven't expired yet, most recent first
+func (b *failureBuffer) list() []*failureRecord {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	cutoff := b.clock.Now().Add(-b.retention)
+	records := []*failureRecord{}
+	for i := len(b.records) - 1; i >= 0; i-- {
+		record := b.records[(b.next+i)%len(b.records)]
+		if record.Time.After(cutoff) {
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+// get returns the most recent record of requestID, if it hasn't expired
+func (b *failureBuffer) get(requestID string) *failureRecord {
+	for _, record := range b.list() {
+		if record.RequestID == requestID {
+			return record
+		}
+	}
+	return nil
+}
+
+// awsRequestID returns the AWS request ID of err, if it's an AWS request
+// failure or wraps one
+func awsRequestID(err error) string {
+	for err != nil {
+		if reqErr, ok := err.(awserr.RequestFailure); ok {
+			return reqErr.RequestID()
+		}
+		aerr, ok := err.(awserr.Error)
+		if !ok {
+			return ""
+		}
+		err = aerr.OrigErr()
+	}
+	return ""
+}
+
+// uploadOptions describes the options of req in the failure records
+func uploadOptions(req *uploadRequest) map[string]string {
+	options := make(map[string]string)
+	if req.profile != "" {
+		options["profile"] = req.profile
+	}
+	if req.width > 0 {
+		options["width"] = strconv.FormatUint(req.width, 10)
+	}
+	if req.height > 0 {
+		options["height"] = strconv.FormatUint(req.height, 10)
+	}
+	if req.ttl > 0 {
+		options["ttl"] = strconv.FormatUint(req.ttl, 10)
+	}
+	if req.keepOriginal {
+		options["keep_original"] = "true"
+	}
+	if req.collision != "" {
+		options["collision"] = req.collision
+	}
+	if len(req.siblings) > 0 {
+		options["siblings"] = strings.Join(req.siblings, ",")
+	}
+	if req.stripMetadata {
+		options["strip"] = "true"
+	}
+	// The caption and the redacted regions may say more than their count
+	if req.caption != nil {
+		options["text"] = "1"
+	}
+	if len(req.redactions) > 0 {
+		options["redact"] = strconv.Itoa(len(req.redactions))
+	}
+	if req.keyTemplate != nil {
+		options["key_template"] = "header"
+	}
+	if req.responseStyle != "" {
+		options["response"] = req.responseStyle
+	}
+	return options
+}
+
+// newFailureRecord describes the failure of r with err
+func (d *Deflator) newFailureRecord(r *http.Request, err error) *failureRecord {
+	status, message := errorStatus(err)
+	record := &failureRecord{
+		RequestID: requestID(r),
+		Time:      d.clock.Now(),
+		Method:    r.Method,
+		ClientIP:  d.clientIP(r),
+		Status:    status,
+		Code:      errorCode(err),
+		Message:   message,
+	}
+	if rerr, ok := err.(*requestError); ok && rerr.cause != nil {
+		record.Cause = rerr.cause.Error()
+		record.AWSErrorCode = awsErrorCode(rerr.cause)
+		record.AWSRequestID = awsRequestID(rerr.cause)
+	}
+	return record
+}
+
+// recordUploadFailure keeps the diagnostic record of an upload which failed
+// with err. It's only called for failures, so successful uploads don't pay
+// for it.
+func (d *Deflator) recordUploadFailure(r *http.Request, req *uploadRequest, err error) {
+	if d.failures == nil {
+		return
+	}
+
+	record := d.newFailureRecord(r, err)
+	record.Principal = req.principal
+	record.Destination = "s3://" + req.bucket + "/" + req.key
+	record.RegionHint = req.regionHint
+	record.Options = uploadOptions(req)
+	record.ContentType = req.contentType
+	record.DeclaredSize = req.declaredSize
+	if req.progress != nil {
+		record.Stage, record.BytesRead, record.BytesUploaded = req.progress.snapshot()
+		for _, timing := range req.progress.stageTimings() {
+			record.Timings = append(record.Timings, failureTiming{
+				Stage:      timing.stage,
+				DurationMS: float64(timing.duration) / float64(time.Millisecond),
+			})
+		}
+	}
+
+	d.failures.add(record)
+}
+
+// recordPanic keeps the diagnostic record of a request whose handler panicked
+func (d *Deflator) recordPanic(r *http.Request, p interface{}, stack string) {
+	if d.failures == nil {
+		return
+	}
+
+	record := d.newFailureRecord(r, newRequestError(http.StatusInternalServerError, ErrorCodeInternal, "Internal error"))
+	record.Destination = describePath(r.URL.Path)
+	record.Cause = fmt.Sprintf("panic: %v", p)
+	record.Stacktrace = stack
+
+	d.failures.add(record)
+}
+
+// failuresHandler lists the recently failed requests, or returns the one
+// with the request ID in the path
+func (d *Deflator) failuresHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, newRequestError(http.StatusMethodNotAllowed, ErrorCodeMethodNotAllowed, "Method not allowed"))
+		return
+	}
+	if d.failures == nil {
+		writeError(w, r, newRequestError(http.StatusNotFound, ErrorCodeNotFound, "The failure buffer is disabled"))
+		return
+	}
+
+	var response interface{}
+	if id := strings.Trim(strings.TrimPrefix(r.URL.Path, AdminFailuresPath), "/"); id != "" {
+		record := d.failures.get(id)
+		if record == nil {
+			writeError(w, r, newRequestError(http.StatusNotFound, ErrorCodeNotFound, "Not found"))
+			return
+		}
+		response = record
+	} else {
+		response = d.failures.list()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(response)
+}
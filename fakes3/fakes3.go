@@ -0,0 +1,438 @@
+// Package fakes3 is an in-memory S3 server, for exercising imgdeflator (or any
+// other S3 client) without AWS. It implements the path-style subset of the S3
+// API that imgdeflator uses: bucket region lookups, single and multipart
+// uploads (optionally conditional), copies, heads, downloads and deletes. Requests aren't
+// authenticated.
+//
+// Serve it with httptest and point imgdeflator at it:
+//
+//	fake := fakes3.New()
+//	fake.CreateBucket("my-bucket", "eu-central-1")
+//	server := httptest.NewServer(fake)
+//	// IMGDEFLATOR_S3_ENDPOINT=server.URL, with any AWS credentials
+package fakes3
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultRegion is the region of the buckets created on the fly
+const DefaultRegion = "us-east-1"
+
+// Object is a stored object
+type Object struct {
+	Body         []byte
+	ContentType  string
+	Metadata     map[string]string
+	Tagging      string
+	Expires      string
+	ETag         string
+	LastModified time.Time
+}
+
+type bucket struct {
+	region  string
+	owner   string
+	objects map[string]*Object
+}
+
+type multipartUpload struct {
+	bucket string
+	key    string
+	object *Object
+	parts  map[int][]byte
+}
+
+// Fault inspects the requests before they get served. It runs outside of the
+// server lock, so it can delay or block them, and it fails them by returning
+// an HTTP status. Zero serves the request.
+type Fault func(r *http.Request) int
+
+// Server is an in-memory S3 server. The zero value isn't usable, see New.
+type Server struct {
+	mu       sync.Mutex
+	buckets  map[string]*bucket
+	uploads  map[string]*multipartUpload
+	nextID   int
+	failures []int
+	fault    Fault
+	requests int
+}
+
+// New creates a Server without buckets
+func New() *Server {
+	return &Server{
+		buckets: make(map[string]*bucket),
+		uploads: make(map[string]*multipartUpload),
+	}
+}
+
+// CreateBucket adds an empty bucket in region, which defaults to
+// DefaultRegion
+func (s *Server) CreateBucket(name, region string) {
+	if region == "" {
+		region = DefaultRegion
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.buckets[name] = &bucket{region: region, objects: make(map[string]*Object)}
+}
+
+// SetOwner sets the AWS account ID which owns a bucket. Requests with another
+// expected bucket owner get denied.
+func (s *Server) SetOwner(name, owner string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if b, ok := s.buckets[name]; ok {
+		b.owner = owner
+	}
+}
+
+// Object returns a copy of a stored object
+func (s *Server) Object(bucketName, key string) (*Object, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.buckets[bucketName]
+	if !ok {
+		return nil, false
+	}
+	object, ok := b.objects[key]
+	if !ok {
+		return nil, false
+	}
+
+	copied := *object
+	return &copied, true
+}
+
+// Keys lists the keys stored in a bucket, sorted
+func (s *Server) Keys(bucketName string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := []string{}
+	if b, ok := s.buckets[bucketName]; ok {
+		for key := range b.objects {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// FailNext makes the next len(statuses) requests fail with these statuses,
+// e.g. FailNext(500, 503) for two server errors
+func (s *Server) FailNext(statuses ...int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = append(s.failures, statuses...)
+}
+
+// SetFault makes fault inspect all the following requests, nil removes it
+func (s *Server) SetFault(fault Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fault = fault
+}
+
+// Requests returns the number of requests received so far
+func (s *Server) Requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+type s3Error struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string   `xml:"Code"`
+	Message string   `xml:"Message"`
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		_ = xml.NewEncoder(w).Encode(&s3Error{Code: code, Message: message})
+	}
+}
+
+// writeInjectedError fails a request with status, using the S3 error code of
+// the status where clients treat it specially
+func writeInjectedError(w http.ResponseWriter, r *http.Request, status int) {
+	switch status {
+	case http.StatusForbidden:
+		writeError(w, r, status, "AccessDenied", "Access Denied")
+	case http.StatusServiceUnavailable:
+		writeError(w, r, status, "SlowDown", "Please reduce your request rate")
+	default:
+		writeError(w, r, status, "InternalError", "Injected failure")
+	}
+}
+
+func writeXML(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	_, _ = w.Write([]byte(xml.Header))
+	_ = xml.NewEncoder(w).Encode(value)
+}
+
+func etag(body []byte) string {
+	sum := md5.Sum(body)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// ServeHTTP implements the S3 API
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Read the body before locking, so slow clients don't block the others
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "IncompleteBody", err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	fault := s.fault
+	s.mu.Unlock()
+	status := 0
+	if fault != nil {
+		status = fault(r)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requests++
+	if status == 0 && len(s.failures) > 0 {
+		status = s.failures[0]
+		s.failures = s.failures[1:]
+	}
+	if status != 0 {
+		writeInjectedError(w, r, status)
+		return
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	b, ok := s.buckets[parts[0]]
+	if !ok {
+		writeError(w, r, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist")
+		return
+	}
+	if owner := r.Header.Get("X-Amz-Expected-Bucket-Owner"); owner != "" && owner != b.owner {
+		writeError(w, r, http.StatusForbidden, "AccessDenied", "Access Denied")
+		return
+	}
+
+	if len(parts) == 1 || parts[1] == "" {
+		s.serveBucket(w, r, b)
+		return
+	}
+	s.serveObject(w, r, parts[0], b, parts[1], body)
+}
+
+func (s *Server) serveBucket(w http.ResponseWriter, r *http.Request, b *bucket) {
+	query := r.URL.Query()
+	switch {
+	case r.Method == http.MethodHead:
+		w.Header().Set("X-Amz-Bucket-Region", b.region)
+	case r.Method == http.MethodGet && query["location"] != nil:
+		location := struct {
+			XMLName xml.Name `xml:"LocationConstraint"`
+			Region  string   `xml:",chardata"`
+		}{Region: b.region}
+		if b.region == DefaultRegion {
+			location.Region = ""
+		}
+		writeXML(w, &location)
+	case r.Method == http.MethodGet && query["accelerate"] != nil:
+		writeXML(w, &struct {
+			XMLName xml.Name `xml:"AccelerateConfiguration"`
+		}{})
+	default:
+		writeError(w, r, http.StatusNotImplemented, "NotImplemented", "Not implemented by fakes3")
+	}
+}
+
+func (s *Server) serveObject(w http.ResponseWriter, r *http.Request, bucketName string, b *bucket, key string, body []byte) {
+	query := r.URL.Query()
+	uploadID := query.Get("uploadId")
+
+	switch {
+	case r.Method == http.MethodPost && query["uploads"] != nil:
+		s.nextID++
+		id := strconv.Itoa(s.nextID)
+		s.uploads[id] = &multipartUpload{bucket: bucketName, key: key, object: newObject(r), parts: make(map[int][]byte)}
+		writeXML(w, &struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string   `xml:"Bucket"`
+			Key      string   `xml:"Key"`
+			UploadID string   `xml:"UploadId"`
+		}{Bucket: bucketName, Key: key, UploadID: id})
+
+	case uploadID != "":
+		upload, ok := s.uploads[uploadID]
+		if !ok || upload.bucket != bucketName || upload.key != key {
+			writeError(w, r, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist")
+			return
+		}
+		s.serveMultipart(w, r, b, upload, uploadID, body)
+
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		source, err := url.PathUnescape(strings.TrimPrefix(r.Header.Get("X-Amz-Copy-Source"), "/"))
+		sourceParts := strings.SplitN(source, "/", 2)
+		if err != nil || len(sourceParts) != 2 {
+			writeError(w, r, http.StatusBadRequest, "InvalidArgument", "Invalid copy source")
+			return
+		}
+		sourceBucket, ok := s.buckets[sourceParts[0]]
+		if !ok {
+			writeError(w, r, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist")
+			return
+		}
+		sourceObject, ok := sourceBucket.objects[sourceParts[1]]
+		if !ok {
+			writeError(w, r, http.StatusNotFound, "NoSuchKey", "The specified key does not exist")
+			return
+		}
+		copied := *sourceObject
+		copied.LastModified = time.Now()
+		b.objects[key] = &copied
+		writeXML(w, &struct {
+			XMLName xml.Name `xml:"CopyObjectResult"`
+			ETag    string   `xml:"ETag"`
+		}{ETag: copied.ETag})
+
+	case r.Method == http.MethodPut:
+		if !checkIfNoneMatch(w, r, b, key) {
+			return
+		}
+		object := newObject(r)
+		object.Body = body
+		object.ETag = etag(body)
+		b.objects[key] = object
+		w.Header().Set("ETag", object.ETag)
+
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		object, ok := b.objects[key]
+		if !ok {
+			writeError(w, r, http.StatusNotFound, "NoSuchKey", "The specified key does not exist")
+			return
+		}
+		header := w.Header()
+		header.Set("Content-Type", object.ContentType)
+		header.Set("Content-Length", strconv.Itoa(len(object.Body)))
+		header.Set("ETag", object.ETag)
+		header.Set("Last-Modified", object.LastModified.UTC().Format(http.TimeFormat))
+		for name, value := range object.Metadata {
+			header.Set("X-Amz-Meta-"+name, value)
+		}
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(object.Body)
+		}
+
+	case r.Method == http.MethodDelete:
+		delete(b.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, r, http.StatusNotImplemented, "NotImplemented", "Not implemented by fakes3")
+	}
+}
+
+func (s *Server) serveMultipart(w http.ResponseWriter, r *http.Request, b *bucket, upload *multipartUpload, uploadID string, body []byte) {
+	switch r.Method {
+	case http.MethodPut:
+		partNumber, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+		if err != nil || partNumber < 1 {
+			writeError(w, r, http.StatusBadRequest, "InvalidArgument", "Invalid part number")
+			return
+		}
+		upload.parts[partNumber] = body
+		w.Header().Set("ETag", etag(body))
+
+	case http.MethodPost:
+		var complete struct {
+			Parts []struct {
+				PartNumber int `xml:"PartNumber"`
+			} `xml:"Part"`
+		}
+		err := xml.Unmarshal(body, &complete)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, "MalformedXML", err.Error())
+			return
+		}
+
+		if !checkIfNoneMatch(w, r, b, upload.key) {
+			return
+		}
+
+		var data bytes.Buffer
+		for _, part := range complete.Parts {
+			partData, ok := upload.parts[part.PartNumber]
+			if !ok {
+				writeError(w, r, http.StatusBadRequest, "InvalidPart", fmt.Sprintf("Part %d wasn't uploaded", part.PartNumber))
+				return
+			}
+			data.Write(partData)
+		}
+
+		object := upload.object
+		object.Body = data.Bytes()
+		object.ETag = fmt.Sprintf(`"%s-%d"`, strings.Trim(etag(object.Body), `"`), len(complete.Parts))
+		b.objects[upload.key] = object
+		delete(s.uploads, uploadID)
+
+		writeXML(w, &struct {
+			XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+			Bucket  string   `xml:"Bucket"`
+			Key     string   `xml:"Key"`
+			ETag    string   `xml:"ETag"`
+		}{Bucket: upload.bucket, Key: upload.key, ETag: object.ETag})
+
+	case http.MethodDelete:
+		delete(s.uploads, uploadID)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, r, http.StatusNotImplemented, "NotImplemented", "Not implemented by fakes3")
+	}
+}
+
+// checkIfNoneMatch fails conditional writes (`If-None-Match: *`) to existing
+// keys with a 412
+func checkIfNoneMatch(w http.ResponseWriter, r *http.Request, b *bucket, key string) bool {
+	if _, ok := b.objects[key]; ok && r.Header.Get("If-None-Match") == "*" {
+		writeError(w, r, http.StatusPreconditionFailed, "PreconditionFailed", "At least one of the pre-conditions you specified did not hold")
+		return false
+	}
+	return true
+}
+
+// newObject collects the object settings from the request headers
+func newObject(r *http.Request) *Object {
+	object := &Object{
+		ContentType:  r.Header.Get("Content-Type"),
+		Metadata:     make(map[string]string),
+		Tagging:      r.Header.Get("X-Amz-Tagging"),
+		Expires:      r.Header.Get("Expires"),
+		LastModified: time.Now(),
+	}
+	for name, values := range r.Header {
+		if strings.HasPrefix(name, "X-Amz-Meta-") && len(values) > 0 {
+			object.Metadata[strings.TrimPrefix(name, "X-Amz-Meta-")] = values[0]
+		}
+	}
+	return object
+}
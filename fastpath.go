@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+)
+
+const (
+	// Values of the `transform_path` of the results: the full pipeline
+	// decodes the image, while the JPEGs whose pixels don't change can skip
+	// it to only drop their metadata segments or be stored as is
+	TransformPathFull  = "full"
+	TransformPathStrip = "strip"
+	TransformPathCopy  = "copy"
+
+	// jpegStreamBuffer is the size of the buffers of stripJPEGMetadata
+	jpegStreamBuffer = 32 << 10
+)
+
+var errInvalidJPEG = errors.New("invalid JPEG")
+
+// jpegSize returns the dimensions in the frame header of a JPEG
+func jpegSize(body []byte) (int, int, bool) {
+	if !bytes.HasPrefix(body, []byte{0xff, 0xd8}) {
+		return 0, 0, false
+	}
+	for i := 2; i+4 <= len(body); {
+		if body[i] != 0xff {
+			return 0, 0, false
+		}
+		marker := body[i+1]
+		switch {
+		case marker == 0xff:
+			// Fill byte
+			i++
+			continue
+		case marker == 0x01 || marker >= 0xd0 && marker <= 0xd7:
+			i += 2
+			continue
+		case marker == 0xd9 || marker == 0xda:
+			// The end of the image, or its data, before any frame header
+			return 0, 0, false
+		}
+
+		length := int(body[i+2])<<8 | int(body[i+3])
+		// SOF0 to SOF15, except DHT, JPG and DAC
+		if marker >= 0xc0 && marker <= 0xcf && marker != 0xc4 && marker != 0xc8 && marker != 0xcc {
+			if i+9 > len(body) {
+				return 0, 0, false
+			}
+			height := int(body[i+5])<<8 | int(body[i+6])
+			width := int(body[i+7])<<8 | int(body[i+8])
+			return width, height, width > 0 && height > 0
+		}
+		i += 2 + length
+	}
+	return 0, 0, false
+}
+
+// isJPEGMetadataMarker checks whether the segments of marker only hold
+// metadata: EXIF and XMP (APP1), ICC profiles (APP2), IPTC (APP13), the
+// other application segments and comments. JFIF (APP0) and Adobe (APP14),
+// which tell how to decode the image, are kept.
+func isJPEGMetadataMarker(marker byte) bool {
+	return marker >= 0xe1 && marker <= 0xef && marker != 0xee || marker == 0xfe
+}
+
+// stripJPEGMetadata copies the JPEG from src to dst without its metadata
+// segments, like the StripMetadata encoder setting, but without decoding it.
+// Only the segments before the image data are parsed, through fixed size
+// buffers, and the rest is copied as is.
+func stripJPEGMetadata(dst io.Writer, src io.Reader) error {
+	r := bufio.NewReaderSize(src, jpegStreamBuffer)
+	w := bufio.NewWriterSize(dst, jpegStreamBuffer)
+
+	var soi [2]byte
+	if _, err := io.ReadFull(r, soi[:]); err != nil || soi != [2]byte{0xff, 0xd8} {
+		return errInvalidJPEG
+	}
+	_, _ = w.Write(soi[:])
+
+	for {
+		b, err := r.ReadByte()
+		if err != nil || b != 0xff {
+			return errInvalidJPEG
+		}
+		marker := byte(0xff)
+		for marker == 0xff {
+			if marker, err = r.ReadByte(); err != nil {
+				return errInvalidJPEG
+			}
+		}
+		if marker == 0x01 || marker >= 0xd0 && marker <= 0xd9 {
+			_, _ = w.Write([]byte{0xff, marker})
+			if marker == 0xd9 {
+				return w.Flush()
+			}
+			continue
+		}
+
+		var header [2]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return errInvalidJPEG
+		}
+		length := int64(header[0])<<8 | int64(header[1])
+		if length < 2 {
+			return errInvalidJPEG
+		}
+		if isJPEGMetadataMarker(marker) {
+			if _, err := r.Discard(int(length - 2)); err != nil {
+				return errInvalidJPEG
+			}
+			continue
+		}
+
+		_, _ = w.Write([]byte{0xff, marker, header[0], header[1]})
+		if _, err := io.CopyN(w, r, length-2); err != nil {
+			return errInvalidJPEG
+		}
+		// The start of scan, after which everything is image data
+		if marker == 0xda {
+			if _, err := io.Copy(w, r); err != nil {
+				return err
+			}
+			return w.Flush()
+		}
+	}
+}
+
+// fastTransformPath returns how req can transform body without the full
+// pipeline, with StreamingTransforms: JPEGs requested at their own
+// dimensions, without other changes, are stored as is, or stripped of their
+// metadata with `strip`. Anything else takes TransformPathFull.
+func (d *Deflator) fastTransformPath(req *uploadRequest, body []byte, profile *encoderProfile) string {
+	if !d.config.StreamingTransforms || profile != nil || req.caption != nil || len(req.redactions) > 0 || len(req.siblings) > 0 {
+		return TransformPathFull
+	}
+	width, height, ok := jpegSize(body)
+	if !ok || (req.width != 0 && req.width != uint64(width)) || (req.height != 0 && req.height != uint64(height)) {
+		return TransformPathFull
+	}
+	if req.stripMetadata {
+		return TransformPathStrip
+	}
+	return TransformPathCopy
+}
+
+// fastTransform runs body through path, returning TransformPathFull if it
+// turned out to need the full pipeline
+func fastTransform(body []byte, path string) ([]byte, string) {
+	if path == TransformPathCopy {
+		return body, path
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(len(body))
+	if err := stripJPEGMetadata(&buf, bytes.NewReader(body)); err != nil {
+		return nil, TransformPathFull
+	}
+	return buf.Bytes(), path
+}
+
+func parseStripOption(d *Deflator, options *requestOptions, name, value string) error {
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return newRequestError(400, ErrorCodeInvalidParameter, "Invalid %s %q", name, value)
+	}
+	options.stripMetadata = parsed
+
+	return nil
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/davidbyttow/govips/pkg/vips"
+	log "github.com/sirupsen/logrus"
+)
+
+// FormatAuto picks the output format from the Accept header of the request
+const FormatAuto = "auto"
+
+// outputFormats are the values accepted by the `format` parameter
+var outputFormats = map[string]vips.ImageType{
+	"jpeg": vips.ImageTypeJPEG,
+	"png":  vips.ImageTypePNG,
+	"webp": vips.ImageTypeWEBP,
+}
+
+// transform checks if the options ask for a transformed image. Requests
+// without any transform option get the stored object as is.
+func (o *requestOptions) transform() bool {
+	return o.width > 0 || o.height > 0 || o.format != "" || o.text != ""
+}
+
+// outputFormat resolves the requested format for r. ImageTypeUnknown keeps
+// the format of the source image.
+func (o *requestOptions) outputFormat(r *http.Request) vips.ImageType {
+	if o.format == FormatAuto {
+		if strings.Contains(r.Header.Get("Accept"), "image/webp") {
+			return vips.ImageTypeWEBP
+		}
+		return vips.ImageTypeUnknown
+	}
+
+	return outputFormats[o.format]
+}
+
+// transformETag derives a strong ETag for the transformed image from the
+// ETag of the source object and the normalized transform parameters
+func transformETag(sourceETag string, options *requestOptions, format vips.ImageType) string {
+	formatName := "source"
+	if format != vips.ImageTypeUnknown {
+		formatName = vips.ImageTypes[format]
+	}
+
+	resolved := *options
+	resolved.format, resolved.ttl, resolved.soft = formatName, 0, false
+	hash := sha256.Sum256([]byte(sourceETag + "\n" + resolved.canonical()))
+	return `"` + hex.EncodeToString(hash[:16]) + `"`
+}
+
+// matchesETag checks etag against the value of an If-None-Match header,
+// using weak comparison (RFC 7232)
+func matchesETag(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// cacheControl returns the Cache-Control header value for GET responses
+// from bucket
+func (d *Deflator) cacheControl(bucket string) string {
+	if config := d.bucketConfig(bucket); config.CacheControl != "" {
+		return config.CacheControl
+	}
+	return d.config.CacheControl
+}
+
+// setFetchHeaders sets the caching headers of a GET response and returns
+// its ETag, which is empty if the source object has none
+func (d *Deflator) setFetchHeaders(w http.ResponseWriter, r *http.Request, bucket string, options *requestOptions, sourceETag *string, lastModified *time.Time) string {
+	etag := aws.StringValue(sourceETag)
+	if etag != "" && options.transform() {
+		etag = transformETag(etag, options, options.outputFormat(r))
+	}
+
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	if lastModified != nil {
+		w.Header().Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+	if options.format == FormatAuto {
+		w.Header().Set("Vary", "Accept")
+	}
+	w.Header().Set("Cache-Control", d.cacheControl(bucket))
+
+	return etag
+}
+
+// getObject downloads the object at location, or only the requested range
+// of it if br isn't nil
+func (d *Deflator) getObject(ctx context.Context, location *s3Location, br *byteRange) (*s3.GetObjectOutput, error) {
+	uploader, err := getS3Uploader(ctx, location.bucket, location.regionHint, d.config.DefaultS3Region, d.endpointOptions(location.bucket))
+	if err != nil {
+		return nil, uploaderError(location.bucket, err)
+	}
+
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(location.bucket),
+		Key:    aws.String(location.key),
+	}
+	if br != nil {
+		input.Range = aws.String(br.header())
+	}
+
+	req := uploader.S3.GetObjectRequest(input)
+	req.SetContext(ctx)
+
+	output, err := req.Send()
+	if err != nil {
+		switch {
+		case isNotFoundError(err):
+			return nil, newRequestError(http.StatusNotFound, ErrorCodeNotFound, "Not found")
+		case isAccessDeniedError(err):
+			return nil, newRequestError(http.StatusForbidden, ErrorCodeForbidden, "Forbidden")
+		default:
+			log.Warnf("Failed to download %q: %s", location.logString(), err)
+			return nil, newRequestError(http.StatusServiceUnavailable, ErrorCodeStorageUnavailable, "Internal error").withCause(err)
+		}
+	}
+
+	return output, nil
+}
+
+// getHandler serves the object at location, transformed according to the
+// query parameters if there are any. Conditional requests are answered from
+// the source object metadata, without downloading it.
+func (d *Deflator) getHandler(w http.ResponseWriter, r *http.Request, location *s3Location, options *requestOptions) {
+	// Serving a redacted copy would suggest that the stored object is redacted
+	if len(options.redactions) > 0 {
+		writeError(w, r, newRequestError(http.StatusBadRequest, ErrorCodeInvalidParameter, "The redact option is only supported for uploads"))
+		return
+	}
+
+	renditionKey := d.renditionKey(r, location, options)
+	storable := false
+	if renditionKey != "" {
+		var served bool
+		served, storable = d.serveCachedRendition(w, r, location, options, renditionKey)
+		if served {
+			return
+		}
+	}
+
+	source, err := d.inspect(r.Context(), location.bucket, location.key, location.regionHint)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if source == nil {
+		// Renditions which weren't stored get transformed from their source
+		if sourceKey, derived, ok := d.parseDerivedKey(location.key); ok && !options.transform() &&
+			!d.bucketConfig(location.bucket).ProfilesOnly && d.authorizeDestination(location.bucket, sourceKey) == nil {
+			log.Debugf("Serving missing derived key %q from its source", location.logString())
+			d.getHandler(w, r, &s3Location{bucket: location.bucket, key: sourceKey, regionHint: location.regionHint}, derived)
+			return
+		}
+		writeError(w, r, newRequestError(http.StatusNotFound, ErrorCodeNotFound, "Not found"))
+		return
+	}
+
+	// Client-side encrypted objects get decrypted as a whole
+	encrypted := isEncrypted(source.Metadata)
+	size := source.ContentLength
+	if encrypted {
+		size = nil
+		if plaintext := plaintextSize(source.Metadata); plaintext >= 0 {
+			size = &plaintext
+		}
+	}
+
+	if options.transform() && size != nil && *size > d.config.MaxUploadSize {
+		log.Debugf("Source object %q too large (%d bytes)", location.logString(), *size)
+		writeError(w, r, newRequestError(
+			http.StatusRequestEntityTooLarge, ErrorCodePayloadTooLarge,
+			"Source object too large (%d bytes, limit: %d bytes)", *size, d.config.MaxUploadSize,
+		))
+		return
+	}
+
+	etag := d.setFetchHeaders(w, r, location.bucket, options, source.ETag, source.LastModified)
+	if etag != "" && matchesETag(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	switch {
+	case options.transform() && r.Header.Get("Range") != "":
+		// Transforms need the whole image
+		w.Header().Set("X-Imgdeflator-Range-Ignored", "transform")
+	case encrypted && r.Header.Get("Range") != "":
+		w.Header().Set("X-Imgdeflator-Range-Ignored", "encrypted")
+	case !options.transform() && !encrypted:
+		w.Header().Set("Accept-Ranges", "bytes")
+	}
+
+	if r.Method == http.MethodHead {
+		if !options.transform() {
+			if size != nil {
+				w.Header().Set("Content-Length", strconv.FormatInt(*size, 10))
+			}
+			if source.ContentType != nil {
+				w.Header().Set("Content-Type", *source.ContentType)
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	var br *byteRange
+	if !options.transform() && !encrypted && source.ContentLength != nil {
+		var ok bool
+		br, ok = d.requestedRange(w, r, *source.ContentLength)
+		if !ok {
+			return
+		}
+	}
+
+	output, err := d.getObject(r.Context(), location, br)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	defer output.Body.Close()
+
+	// The object may have changed since it was inspected
+	d.setFetchHeaders(w, r, location.bucket, options, output.ETag, output.LastModified)
+
+	var body []byte
+	if isEncrypted(output.Metadata) {
+		body, err = d.readDecrypted(r.Context(), location, output)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+	}
+
+	if !options.transform() && body != nil {
+		if output.ContentType != nil {
+			w.Header().Set("Content-Type", *output.ContentType)
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(body)
+		return
+	}
+
+	if !options.transform() {
+		if output.ContentLength != nil {
+			w.Header().Set("Content-Length", strconv.FormatInt(*output.ContentLength, 10))
+		}
+		if output.ContentType != nil {
+			w.Header().Set("Content-Type", *output.ContentType)
+		}
+
+		status := http.StatusOK
+		if br != nil {
+			contentRange := br.contentRange(*source.ContentLength)
+			if output.ContentRange != nil {
+				contentRange = *output.ContentRange
+			}
+			w.Header().Set("Content-Range", contentRange)
+			status = http.StatusPartialContent
+		}
+		w.WriteHeader(status)
+
+		_, err = io.Copy(w, output.Body)
+		if err != nil {
+			log.Warnf("Failed to send %q: %s", location.logString(), err)
+		}
+		return
+	}
+
+	if body == nil {
+		body, err = ioutil.ReadAll(io.LimitReader(output.Body, d.config.MaxUploadSize+1))
+		if err != nil {
+			log.Warnf("Failed to download %q: %s", location.logString(), err)
+			writeError(w, r, newRequestError(http.StatusServiceUnavailable, ErrorCodeStorageUnavailable, "Internal error").withCause(err))
+			return
+		}
+	}
+	if int64(len(body)) > d.config.MaxUploadSize {
+		writeError(w, r, newRequestError(
+			http.StatusRequestEntityTooLarge, ErrorCodePayloadTooLarge,
+			"Source object too large (limit: %d bytes)", d.config.MaxUploadSize,
+		))
+		return
+	}
+
+	err = d.checkWorkBudget(location.bucket, body, workload{encodes: 1, renditions: 1})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	buf, imageType, err := transformImage(body, options.width, options.height, &encoderProfile{format: options.outputFormat(r)}, options.caption())
+	if err != nil {
+		log.Warnf("Failed to transform image %q: %s", location.logString(), err)
+		err = newRequestError(http.StatusServiceUnavailable, ErrorCodeTransformFailed, "Internal error").withCause(err)
+		d.reportServerError(r, location.bucket, location.key, err)
+		writeError(w, r, err)
+		return
+	}
+
+	if renditionKey != "" {
+		renditionCacheStats.Add(CacheMiss, 1)
+		w.Header().Set("X-Cache", CacheMiss)
+		if storable && !isEncrypted(output.Metadata) {
+			d.cacheRendition(location, renditionKey, buf, imageType, aws.StringValue(output.ETag))
+		}
+	}
+
+	w.Header().Set("Content-Type", "image/"+strings.TrimPrefix(imageType.OutputExt(), "."))
+	w.Header().Set("Content-Length", strconv.Itoa(len(buf)))
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(buf)
+}
@@ -0,0 +1,625 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+	"github.com/aws/aws-sdk-go-v2/aws/defaults"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/s3manager"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// FilesystemRegion is the region reported for the filesystem buckets
+	FilesystemRegion = "local"
+
+	// filesystemStateDir holds the sidecars and the multipart uploads under
+	// the filesystem root. Bucket names can't start with a dot, so it can't
+	// clash with a bucket directory.
+	filesystemStateDir = ".imgdeflator"
+)
+
+// filesystemBackend serves the subset of the S3 API which imgdeflator uses
+// from a local directory tree, so the filesystem buckets share all the code
+// of the S3 ones. Objects are stored at `<root>/<bucket>/<key>`, and their
+// content type and metadata in a JSON sidecar at the same path under
+// `<root>/.imgdeflator/meta`.
+type filesystemBackend struct {
+	root string
+	// sync fsyncs the files and their directory before acknowledging writes
+	sync bool
+}
+
+// filesystemMetadata is the content of a sidecar
+type filesystemMetadata struct {
+	ContentType string            `json:"content_type"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	Tagging     string            `json:"tagging,omitempty"`
+	Expires     string            `json:"expires,omitempty"`
+	ETag        string            `json:"etag"`
+}
+
+// isFilesystemBucket checks if bucket is stored on the filesystem, according
+// to the FilesystemBucketPrefixes
+func isFilesystemBucket(prefixes []string, bucket string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(bucket, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// newFilesystemUploader returns an uploader whose requests are served by a
+// filesystemBackend, without leaving the process
+func newFilesystemUploader(root string, sync bool) *s3manager.Uploader {
+	awsCfg := defaults.Config()
+	awsCfg.Region = FilesystemRegion
+	awsCfg.EndpointResolver = aws.ResolveWithEndpointURL("http://filesystem")
+	awsCfg.HTTPClient = &http.Client{Transport: handlerTransport{&filesystemBackend{root: root, sync: sync}}}
+	// Local failures don't go away by retrying
+	awsCfg.Retryer = aws.DefaultRetryer{NumMaxRetries: 0}
+
+	client := s3.New(awsCfg)
+	client.ForcePathStyle = true
+
+	return s3manager.NewUploaderWithClient(client)
+}
+
+// handlerTransport sends the requests to an in-process handler
+type handlerTransport struct {
+	handler http.Handler
+}
+
+func (t handlerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.Body == nil {
+		r.Body = http.NoBody
+	}
+
+	w := httptest.NewRecorder()
+	t.handler.ServeHTTP(w, r)
+
+	resp := w.Result()
+	resp.Request = r
+	return resp, nil
+}
+
+// isInsufficientStorageError checks if err is returned for filesystem writes
+// which ran out of space
+func isInsufficientStorageError(err error) bool {
+	// s3manager wraps the errors of multipart uploads
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "MultipartUpload" {
+		err = aerr.OrigErr()
+	}
+	return awsErrorCode(err) == "InsufficientStorage"
+}
+
+// path maps bucket and key to a path under base. Nothing can resolve outside
+// of it: the bucket must be a single path segment which isn't hidden, and the
+// key must pass sanitizeKey, which rejects `.` and `..` segments, on top of
+// which empty segments are rejected.
+func (b *filesystemBackend) path(base, bucket, key string) (string, error) {
+	if bucket == "" || strings.HasPrefix(bucket, ".") || strings.ContainsAny(bucket, `/\`) {
+		return "", fmt.Errorf("invalid bucket %q", bucket)
+	}
+
+	err := sanitizeKey(key)
+	if err != nil {
+		return "", err
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" {
+			return "", fmt.Errorf("key %q contains empty path segments", key)
+		}
+	}
+	if os.PathSeparator != '/' && strings.ContainsRune(key, os.PathSeparator) {
+		return "", fmt.Errorf("key %q contains path separators", key)
+	}
+
+	path := filepath.Join(base, bucket, filepath.FromSlash(key))
+	if !strings.HasPrefix(path, base+string(filepath.Separator)) {
+		return "", fmt.Errorf("key %q escapes the root", key)
+	}
+	return path, nil
+}
+
+func (b *filesystemBackend) objectPath(bucket, key string) (string, error) {
+	return b.path(b.root, bucket, key)
+}
+
+func (b *filesystemBackend) metadataPath(bucket, key string) (string, error) {
+	return b.path(filepath.Join(b.root, filesystemStateDir, "meta"), bucket, key)
+}
+
+func (b *filesystemBackend) uploadDir(id string) string {
+	return filepath.Join(b.root, filesystemStateDir, "uploads", id)
+}
+
+// writeFile writes body to path through a temporary file which then replaces
+// it atomically. With exclusive set, existing files are left alone and
+// os.IsExist(err) is true. It returns the MD5 based ETag of body.
+func (b *filesystemBackend) writeFile(path string, body io.Reader, exclusive bool) (string, error) {
+	dir := filepath.Dir(path)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return "", err
+	}
+
+	tmp, err := ioutil.TempFile(dir, ".imgdeflator-tmp-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	hash := md5.New()
+	_, err = io.Copy(io.MultiWriter(tmp, hash), body)
+	if err == nil && b.sync {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// Temporary files are only readable by their owner, unlike the objects
+	err = os.Chmod(tmp.Name(), 0644)
+	if err != nil {
+		return "", err
+	}
+	if exclusive {
+		// Unlike renames, links don't replace existing files
+		err = os.Link(tmp.Name(), path)
+	} else {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if b.sync {
+		err = syncDir(dir)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return `"` + hex.EncodeToString(hash.Sum(nil)) + `"`, nil
+}
+
+// syncDir makes the entries of dir durable
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
+func (b *filesystemBackend) readMetadata(bucket, key string) *filesystemMetadata {
+	metadata := &filesystemMetadata{}
+	path, err := b.metadataPath(bucket, key)
+	if err != nil {
+		return metadata
+	}
+
+	// Files without a sidecar, e.g. copied by hand, are still served
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		err = json.Unmarshal(data, metadata)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		log.Warnf("Failed to read the metadata of %q: %s", (&s3Location{bucket: bucket, key: key}).logString(), err)
+	}
+	return metadata
+}
+
+func (b *filesystemBackend) writeMetadata(bucket, key string, metadata *filesystemMetadata) error {
+	path, err := b.metadataPath(bucket, key)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	_, err = b.writeFile(path, bytes.NewReader(data), false)
+	return err
+}
+
+// metadataFromRequest collects the object settings from the request headers
+func metadataFromRequest(r *http.Request) *filesystemMetadata {
+	metadata := &filesystemMetadata{
+		ContentType: r.Header.Get("Content-Type"),
+		Metadata:    make(map[string]string),
+		Tagging:     r.Header.Get("X-Amz-Tagging"),
+		Expires:     r.Header.Get("Expires"),
+	}
+	for name, values := range r.Header {
+		if strings.HasPrefix(name, "X-Amz-Meta-") && len(values) > 0 {
+			metadata.Metadata[strings.TrimPrefix(name, "X-Amz-Meta-")] = values[0]
+		}
+	}
+	return metadata
+}
+
+type filesystemError struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string   `xml:"Code"`
+	Message string   `xml:"Message"`
+}
+
+func writeFilesystemError(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		_ = xml.NewEncoder(w).Encode(&filesystemError{Code: code, Message: message})
+	}
+}
+
+// writeStorageError reports a failed filesystem operation like S3 would
+func writeStorageError(w http.ResponseWriter, r *http.Request, err error) {
+	switch errno := unwrapErrno(err); {
+	case os.IsNotExist(err), errno == syscall.ENOTDIR:
+		writeFilesystemError(w, r, http.StatusNotFound, "NoSuchKey", "The specified key does not exist")
+	case os.IsExist(err):
+		writeFilesystemError(w, r, http.StatusPreconditionFailed, "PreconditionFailed", "The object already exists")
+	case errno == syscall.ENOSPC, errno == syscall.EDQUOT:
+		log.Errorf("Filesystem storage full: %s", err)
+		writeFilesystemError(w, r, http.StatusInsufficientStorage, "InsufficientStorage", "Not enough space left")
+	default:
+		log.Errorf("Filesystem storage failure: %s", err)
+		writeFilesystemError(w, r, http.StatusInternalServerError, "InternalError", "Filesystem storage failure")
+	}
+}
+
+// unwrapErrno returns the errno behind an os error, if any
+func unwrapErrno(err error) syscall.Errno {
+	for {
+		switch e := err.(type) {
+		case *os.PathError:
+			err = e.Err
+		case *os.LinkError:
+			err = e.Err
+		case *os.SyscallError:
+			err = e.Err
+		case syscall.Errno:
+			return e
+		default:
+			return 0
+		}
+	}
+}
+
+func writeFilesystemXML(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	_, _ = w.Write([]byte(xml.Header))
+	_ = xml.NewEncoder(w).Encode(value)
+}
+
+// ServeHTTP implements the path-style S3 API on the filesystem
+func (b *filesystemBackend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if len(parts) == 1 || parts[1] == "" {
+		// Bucket directories get created with their first object
+		if r.Method == http.MethodHead {
+			w.Header().Set("X-Amz-Bucket-Region", FilesystemRegion)
+			return
+		}
+		writeFilesystemError(w, r, http.StatusNotImplemented, "NotImplemented", "Not implemented by the filesystem storage")
+		return
+	}
+	bucket, key := parts[0], parts[1]
+
+	path, err := b.objectPath(bucket, key)
+	if err != nil {
+		writeFilesystemError(w, r, http.StatusBadRequest, "InvalidArgument", err.Error())
+		return
+	}
+
+	query := r.URL.Query()
+	switch {
+	case r.Method == http.MethodPost && query["uploads"] != nil:
+		b.createMultipartUpload(w, r, bucket, key)
+	case query.Get("uploadId") != "":
+		b.serveMultipartUpload(w, r, bucket, key, path, query.Get("uploadId"))
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		b.copyObject(w, r, bucket, key, path)
+	case r.Method == http.MethodPut:
+		b.putObject(w, r, bucket, key, path, r.Body)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		b.getObject(w, r, bucket, key, path)
+	case r.Method == http.MethodDelete:
+		b.deleteObject(w, r, bucket, key, path)
+	default:
+		writeFilesystemError(w, r, http.StatusNotImplemented, "NotImplemented", "Not implemented by the filesystem storage")
+	}
+}
+
+// putObject stores body and the sidecar, failing with a 412 for conditional
+// writes to existing keys
+func (b *filesystemBackend) putObject(w http.ResponseWriter, r *http.Request, bucket, key, path string, body io.Reader) {
+	etag, err := b.writeFile(path, body, r.Header.Get("If-None-Match") == "*")
+	if err != nil {
+		writeStorageError(w, r, err)
+		return
+	}
+
+	metadata := metadataFromRequest(r)
+	metadata.ETag = etag
+	err = b.writeMetadata(bucket, key, metadata)
+	if err != nil {
+		writeStorageError(w, r, err)
+		return
+	}
+
+	w.Header().Set("ETag", etag)
+}
+
+// copyObject copies an object of the same bucket, with its metadata
+func (b *filesystemBackend) copyObject(w http.ResponseWriter, r *http.Request, bucket, key, path string) {
+	source, err := url.PathUnescape(strings.TrimPrefix(r.Header.Get("X-Amz-Copy-Source"), "/"))
+	sourceParts := strings.SplitN(source, "/", 2)
+	if err != nil || len(sourceParts) != 2 || sourceParts[0] != bucket {
+		writeFilesystemError(w, r, http.StatusBadRequest, "InvalidArgument", "Invalid copy source")
+		return
+	}
+	sourcePath, err := b.objectPath(bucket, sourceParts[1])
+	if err != nil {
+		writeFilesystemError(w, r, http.StatusBadRequest, "InvalidArgument", err.Error())
+		return
+	}
+
+	file, err := os.Open(sourcePath)
+	if err != nil {
+		writeStorageError(w, r, err)
+		return
+	}
+	defer file.Close()
+
+	etag, err := b.writeFile(path, file, false)
+	if err != nil {
+		writeStorageError(w, r, err)
+		return
+	}
+
+	metadata := b.readMetadata(bucket, sourceParts[1])
+	metadata.ETag = etag
+	err = b.writeMetadata(bucket, key, metadata)
+	if err != nil {
+		writeStorageError(w, r, err)
+		return
+	}
+
+	writeFilesystemXML(w, &struct {
+		XMLName xml.Name `xml:"CopyObjectResult"`
+		ETag    string   `xml:"ETag"`
+	}{ETag: etag})
+}
+
+func (b *filesystemBackend) getObject(w http.ResponseWriter, r *http.Request, bucket, key, path string) {
+	file, err := os.Open(path)
+	if err != nil {
+		writeStorageError(w, r, err)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		writeStorageError(w, r, err)
+		return
+	}
+	if info.IsDir() {
+		writeFilesystemError(w, r, http.StatusNotFound, "NoSuchKey", "The specified key does not exist")
+		return
+	}
+
+	metadata := b.readMetadata(bucket, key)
+	header := w.Header()
+	header.Set("Content-Type", metadata.ContentType)
+	if metadata.ContentType == "" {
+		header.Set("Content-Type", "binary/octet-stream")
+	}
+	if metadata.ETag != "" {
+		header.Set("ETag", metadata.ETag)
+	}
+	if metadata.Expires != "" {
+		header.Set("Expires", metadata.Expires)
+	}
+	for name, value := range metadata.Metadata {
+		header.Set("X-Amz-Meta-"+name, value)
+	}
+
+	// ServeContent handles the ranges and the HEAD requests
+	http.ServeContent(w, r, "", info.ModTime(), file)
+}
+
+// deleteObject removes an object and its sidecar, succeeding for missing keys
+// like S3
+func (b *filesystemBackend) deleteObject(w http.ResponseWriter, r *http.Request, bucket, key, path string) {
+	err := os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		writeStorageError(w, r, err)
+		return
+	}
+
+	if metadataPath, err := b.metadataPath(bucket, key); err == nil {
+		err = os.Remove(metadataPath)
+		if err != nil && !os.IsNotExist(err) {
+			log.Warnf("Failed to delete the metadata of %q: %s", (&s3Location{bucket: bucket, key: key}).logString(), err)
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// createMultipartUpload keeps the object settings in the directory of the
+// upload, which collects the parts until it gets completed
+func (b *filesystemBackend) createMultipartUpload(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		writeStorageError(w, r, err)
+		return
+	}
+	uploadID := hex.EncodeToString(id[:])
+
+	data, err := json.Marshal(metadataFromRequest(r))
+	if err == nil {
+		_, err = b.writeFile(filepath.Join(b.uploadDir(uploadID), "metadata"), bytes.NewReader(data), false)
+	}
+	if err != nil {
+		writeStorageError(w, r, err)
+		return
+	}
+
+	writeFilesystemXML(w, &struct {
+		XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+		Bucket   string   `xml:"Bucket"`
+		Key      string   `xml:"Key"`
+		UploadID string   `xml:"UploadId"`
+	}{Bucket: bucket, Key: key, UploadID: uploadID})
+}
+
+func (b *filesystemBackend) serveMultipartUpload(w http.ResponseWriter, r *http.Request, bucket, key, path, uploadID string) {
+	if _, err := hex.DecodeString(uploadID); err != nil || len(uploadID) != 32 {
+		writeFilesystemError(w, r, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist")
+		return
+	}
+	dir := b.uploadDir(uploadID)
+	if _, err := os.Stat(dir); err != nil {
+		writeFilesystemError(w, r, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		partNumber, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+		if err != nil || partNumber < 1 || partNumber > s3manager.MaxUploadParts {
+			writeFilesystemError(w, r, http.StatusBadRequest, "InvalidArgument", "Invalid part number")
+			return
+		}
+		etag, err := b.writeFile(filepath.Join(dir, strconv.Itoa(partNumber)), r.Body, false)
+		if err != nil {
+			writeStorageError(w, r, err)
+			return
+		}
+		w.Header().Set("ETag", etag)
+
+	case http.MethodPost:
+		b.completeMultipartUpload(w, r, bucket, key, path, dir)
+
+	case http.MethodDelete:
+		err := os.RemoveAll(dir)
+		if err != nil {
+			writeStorageError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeFilesystemError(w, r, http.StatusNotImplemented, "NotImplemented", "Not implemented by the filesystem storage")
+	}
+}
+
+// completeMultipartUpload concatenates the parts into the object
+func (b *filesystemBackend) completeMultipartUpload(w http.ResponseWriter, r *http.Request, bucket, key, path, dir string) {
+	var complete struct {
+		Parts []struct {
+			PartNumber int `xml:"PartNumber"`
+		} `xml:"Part"`
+	}
+	err := xml.NewDecoder(r.Body).Decode(&complete)
+	if err != nil {
+		writeFilesystemError(w, r, http.StatusBadRequest, "MalformedXML", err.Error())
+		return
+	}
+	sort.Slice(complete.Parts, func(i, j int) bool { return complete.Parts[i].PartNumber < complete.Parts[j].PartNumber })
+
+	var parts []io.Reader
+	for _, part := range complete.Parts {
+		file, err := os.Open(filepath.Join(dir, strconv.Itoa(part.PartNumber)))
+		if err != nil {
+			writeFilesystemError(w, r, http.StatusBadRequest, "InvalidPart", fmt.Sprintf("Part %d wasn't uploaded", part.PartNumber))
+			return
+		}
+		defer file.Close()
+		parts = append(parts, file)
+	}
+
+	metadata := &filesystemMetadata{}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "metadata"))
+	if err == nil {
+		err = json.Unmarshal(data, metadata)
+	}
+	if err != nil {
+		writeStorageError(w, r, err)
+		return
+	}
+
+	etag, err := b.writeFile(path, io.MultiReader(parts...), r.Header.Get("If-None-Match") == "*")
+	if err != nil {
+		writeStorageError(w, r, err)
+		return
+	}
+	metadata.ETag = fmt.Sprintf(`"%s-%d"`, strings.Trim(etag, `"`), len(parts))
+	err = b.writeMetadata(bucket, key, metadata)
+	if err != nil {
+		writeStorageError(w, r, err)
+		return
+	}
+
+	_ = os.RemoveAll(dir)
+
+	writeFilesystemXML(w, &struct {
+		XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+		Bucket  string   `xml:"Bucket"`
+		Key     string   `xml:"Key"`
+		ETag    string   `xml:"ETag"`
+	}{Bucket: bucket, Key: key, ETag: metadata.ETag})
+}
+
+// getFilesystemUploader looks up bucket in the uploaderCache like
+// getS3Uploader, provisioning a filesystem uploader for it if needed
+func getFilesystemUploader(bucket string, options s3EndpointOptions) *s3manager.Uploader {
+	if entry, ok := uploaderCache.Get(bucket); ok {
+		atomic.AddInt64(&entry.(*uploaderCacheEntry).hits, 1)
+		return entry.(*uploaderCacheEntry).uploader
+	}
+
+	uploader := newFilesystemUploader(options.filesystemRoot, options.filesystemSync)
+	log.Infof("Provisioned uploader for bucket %q using the filesystem at %s", bucket, options.filesystemRoot)
+
+	cacheUploader(bucket, &uploaderCacheEntry{
+		uploader: uploader,
+		region:   FilesystemRegion,
+		endpoint: "filesystem",
+		created:  time.Now(),
+	})
+
+	return uploader
+}
@@ -4,8 +4,12 @@ require (
 	github.com/Nitro/urlsign v0.0.0-20181015102600-5c9420004fa4
 	github.com/aws/aws-sdk-go-v2 v0.7.0
 	github.com/davidbyttow/govips v0.0.0-20190304175058-d272f04c0fea
+	github.com/golang/protobuf v1.3.1
 	github.com/hashicorp/golang-lru v0.5.0
 	github.com/relistan/envconfig v1.2.0
 	github.com/relistan/rubberneck v1.1.0
 	github.com/sirupsen/logrus v1.3.0
+	golang.org/x/net v0.0.0-20190311183353-d8887717615a
+	golang.org/x/text v0.3.0
+	google.golang.org/grpc v1.20.1
 )
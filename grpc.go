@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/Nitro/imgdeflator/imgdeflatorpb"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+)
+
+// grpcServer implements the imgdeflator gRPC API on top of the same pipeline
+// as the HTTP handlers
+type grpcServer struct {
+	deflator *Deflator
+}
+
+// uploadStreamReader exposes the chunks received on an Upload stream as an
+// io.Reader, failing once more than limit bytes were received
+type uploadStreamReader struct {
+	stream   imgdeflatorpb.Deflator_UploadServer
+	buf      []byte
+	read     int64
+	limit    int64
+	tooLarge bool
+}
+
+func (r *uploadStreamReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		msg, err := r.stream.Recv()
+		if err != nil {
+			return 0, err
+		}
+
+		r.buf = msg.GetChunk()
+	}
+
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+
+	r.read += int64(n)
+	if r.read > r.limit {
+		r.tooLarge = true
+		return 0, status.Errorf(codes.ResourceExhausted, "File too large (more than %d bytes)", r.limit)
+	}
+
+	return n, nil
+}
+
+// grpcError converts errors returned by the pipeline to gRPC status errors
+func grpcError(err error) error {
+	code := codes.Internal
+	httpStatus, message := errorStatus(err)
+	switch httpStatus {
+	case http.StatusBadRequest:
+		code = codes.InvalidArgument
+	case http.StatusForbidden:
+		code = codes.PermissionDenied
+	case http.StatusNotFound:
+		code = codes.NotFound
+	case http.StatusRequestEntityTooLarge:
+		code = codes.ResourceExhausted
+	case http.StatusUnprocessableEntity:
+		code = codes.InvalidArgument
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable:
+		code = codes.Unavailable
+	}
+
+	return status.Error(code, message)
+}
+
+func (s *grpcServer) Upload(stream imgdeflatorpb.Deflator_UploadServer) error {
+	if err := s.deflator.resources.err(); err != nil {
+		return grpcError(err)
+	}
+
+	msg, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+
+	metadata := msg.GetMetadata()
+	if metadata == nil {
+		return status.Error(codes.InvalidArgument, "The first message must contain the upload metadata")
+	}
+
+	err = s.deflator.authorizeDestination(metadata.Bucket, metadata.Key)
+	if err != nil {
+		return grpcError(err)
+	}
+
+	body := &uploadStreamReader{stream: stream, limit: s.deflator.maxUploadSizeLimit()}
+	req := &uploadRequest{
+		bucket:      metadata.Bucket,
+		key:         metadata.Key,
+		contentType: metadata.ContentType,
+		body:        body,
+		width:       metadata.GetOptions().GetWidth(),
+		height:      metadata.GetOptions().GetHeight(),
+		ttl:         metadata.GetOptions().GetTtl(),
+	}
+	req.clientIP = grpcPeerIP(stream.Context())
+
+	log.Infof("Received gRPC upload request: %s", req.location())
+
+	// The client deadline propagates through the stream context
+	ctx, cancel := context.WithTimeout(stream.Context(), s.deflator.config.UploadTimeout)
+	defer cancel()
+
+	result, err := s.deflator.upload(ctx, req)
+	if body.tooLarge {
+		return status.Errorf(codes.ResourceExhausted, "File too large (more than %d bytes)", body.limit)
+	}
+	if err != nil {
+		return grpcError(err)
+	}
+
+	response := &imgdeflatorpb.UploadResponse{
+		Bucket: result.Bucket,
+		Key:    result.Key,
+		Size:   int64(result.Size),
+	}
+	if result.ExpiresAt != nil {
+		response.ExpiresAt = result.ExpiresAt.Format(time.RFC3339)
+	}
+	for _, replica := range result.Replicas {
+		response.Replicas = append(response.Replicas, &imgdeflatorpb.ReplicaResult{
+			Bucket: replica.Bucket,
+			Status: replica.Status,
+			Error:  replica.Error,
+		})
+	}
+
+	return stream.SendAndClose(response)
+}
+
+func (s *grpcServer) Inspect(ctx context.Context, req *imgdeflatorpb.InspectRequest) (*imgdeflatorpb.InspectResponse, error) {
+	err := s.deflator.authorizeDestination(req.Bucket, req.Key)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	output, err := s.deflator.inspect(ctx, req.Bucket, req.Key, "")
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	response := &imgdeflatorpb.InspectResponse{}
+	if output == nil {
+		return response, nil
+	}
+
+	response.Exists = true
+	if output.ContentLength != nil {
+		response.ContentLength = *output.ContentLength
+	}
+	if output.ContentType != nil {
+		response.ContentType = *output.ContentType
+	}
+	if output.ETag != nil {
+		response.Etag = *output.ETag
+	}
+	if output.LastModified != nil {
+		response.LastModified = output.LastModified.UTC().Format(time.RFC3339)
+	}
+
+	return response, nil
+}
+
+// ListenGRPC binds the configured GRPCPort, unless the listener was inherited
+func (d *Deflator) ListenGRPC() error {
+	addr := ":" + d.config.GRPCPort
+	d.grpcListener = takeInheritedListener(addr)
+	if d.grpcListener != nil {
+		return nil
+	}
+
+	var err error
+	d.grpcListener, err = net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen for gRPC connections on port %s: %s", d.config.GRPCPort, err)
+	}
+	return nil
+}
+
+// ServeGRPC starts serving the gRPC API on the listener bound by ListenGRPC
+func (d *Deflator) ServeGRPC() {
+	err := d.grpcServer.Serve(d.grpcListener)
+	if err != nil && err != grpc.ErrServerStopped {
+		log.Errorf("grpc.Serve error: %s", err)
+	}
+}
+
+// newGRPCServer sets up the gRPC server with reflection enabled so the API
+// can be explored with tools like grpcurl
+func newGRPCServer(d *Deflator) *grpc.Server {
+	unaryIPFilter, streamIPFilter := d.grpcIPFilterInterceptors()
+	server := grpc.NewServer(grpc.UnaryInterceptor(unaryIPFilter), grpc.StreamInterceptor(streamIPFilter))
+	imgdeflatorpb.RegisterDeflatorServer(server, &grpcServer{deflator: d})
+	reflection.Register(server)
+
+	return server
+}
+
+// stopGRPC gracefully stops the gRPC server, forcing it to stop if ctx expires first
+func (d *Deflator) stopGRPC(ctx context.Context) {
+	stopped := make(chan struct{})
+	go func() {
+		d.grpcServer.GracefulStop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		d.grpcServer.Stop()
+	}
+}
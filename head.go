@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/s3manager"
+	"github.com/hashicorp/golang-lru"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	HeadCacheSize = 4096
+)
+
+var (
+	// headCache is sized by configureHeadCache, from NewDeflator
+	headCache, _ = lru.New(HeadCacheSize)
+)
+
+// configureHeadCache replaces the HEAD cache with one of size entries
+func configureHeadCache(size int) error {
+	if size <= 0 {
+		return fmt.Errorf("invalid HEAD cache size %d", size)
+	}
+
+	cache, err := lru.New(size)
+	if err != nil {
+		return err
+	}
+	headCache = cache
+	return nil
+}
+
+// headCacheEntry holds the outcome of a HeadObject call. A nil output means
+// that the object doesn't exist.
+type headCacheEntry struct {
+	output  *s3.HeadObjectOutput
+	expires time.Time
+}
+
+func headCacheKey(bucket, key string) string {
+	return bucket + "/" + key
+}
+
+// invalidateHeadCache drops the cached existence information for an object
+// after it was modified through this service
+func invalidateHeadCache(bucket, key string) {
+	headCache.Remove(headCacheKey(bucket, key))
+}
+
+// headObject performs a HeadObject call for the specified object
+func headObject(ctx context.Context, uploader *s3manager.Uploader, bucket, key string) (*s3.HeadObjectOutput, error) {
+	req := uploader.S3.HeadObjectRequest(&s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	req.SetContext(ctx)
+
+	return req.Send()
+}
+
+// isNotFoundError checks if err is the AWS error returned for missing objects
+func isNotFoundError(err error) bool {
+	code := awsErrorCode(err)
+	return code == "NotFound" || code == s3.ErrCodeNoSuchKey
+}
+
+// isAccessDeniedError checks if err is the AWS error returned for denied access
+func isAccessDeniedError(err error) bool {
+	code := awsErrorCode(err)
+	return code == "Forbidden" || code == "AccessDenied"
+}
+
+// inspect looks up the metadata of an object, returning a nil output if it
+// doesn't exist. Results are cached for HeadCacheTTL, and missing objects for
+// HeadCacheMissTTL, as they can be uploaded by other clients at any time.
+func (d *Deflator) inspect(ctx context.Context, bucket, key, regionHint string) (*s3.HeadObjectOutput, error) {
+	cacheKey := headCacheKey(bucket, key)
+	if entry, ok := headCache.Get(cacheKey); ok && d.clock.Now().Before(entry.(*headCacheEntry).expires) {
+		return entry.(*headCacheEntry).output, nil
+	}
+
+	uploader, err := getS3Uploader(ctx, bucket, regionHint, d.config.DefaultS3Region, d.endpointOptions(bucket))
+	if err != nil {
+		return nil, uploaderError(bucket, err)
+	}
+
+	output, err := headObject(ctx, uploader, bucket, key)
+	if err != nil {
+		switch {
+		case isNotFoundError(err):
+			output = nil
+		case isAccessDeniedError(err):
+			return nil, newRequestError(http.StatusForbidden, ErrorCodeForbidden, "Forbidden")
+		default:
+			log.Warnf("Failed to check if %q exists: %s", (&s3Location{bucket: bucket, key: key}).logString(), err)
+			return nil, newRequestError(http.StatusServiceUnavailable, ErrorCodeStorageUnavailable, "Internal error").withCause(err)
+		}
+	}
+
+	ttl := d.config.HeadCacheTTL
+	if output == nil {
+		ttl = d.config.HeadCacheMissTTL
+	}
+	if ttl > 0 {
+		headCache.Add(cacheKey, &headCacheEntry{
+			output:  output,
+			expires: d.clock.Now().Add(ttl),
+		})
+	}
+
+	return output, nil
+}
+
+// headHandler reports whether the object at location exists together with its
+// size, type, ETag and modification time
+func (d *Deflator) headHandler(w http.ResponseWriter, r *http.Request, location *s3Location) {
+	output, err := d.inspect(r.Context(), location.bucket, location.key, location.regionHint)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if output == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if output.ContentLength != nil {
+		w.Header().Set("Content-Length", strconv.FormatInt(*output.ContentLength, 10))
+	}
+	if output.ContentType != nil {
+		w.Header().Set("Content-Type", *output.ContentType)
+	}
+	if output.ETag != nil {
+		w.Header().Set("ETag", *output.ETag)
+	}
+	if output.LastModified != nil {
+		w.Header().Set("Last-Modified", output.LastModified.UTC().Format(http.TimeFormat))
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// head sends a HEAD request for key to s
+func (s *testServer) head(key string) *http.Response {
+	resp, err := http.Head(s.uploadURL(TestBucket, key, ""))
+	if err != nil {
+		s.t.Fatalf("Failed to send the HEAD request: %s", err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+// putObject stores an object directly in the fakes3 server of s, as another
+// client would
+func (s *testServer) putObject(key string, body []byte) {
+	r, err := http.NewRequest(http.MethodPut, s.s3.URL+"/"+TestBucket+"/"+key, bytes.NewReader(body))
+	if err != nil {
+		s.t.Fatalf("Failed to create the PUT request: %s", err)
+	}
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		s.t.Fatalf("Failed to store %s: %s", key, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		s.t.Fatalf("Failed to store %s: %d", key, resp.StatusCode)
+	}
+}
+
+// countHeads counts the HeadObject requests to the fakes3 server of s
+func countHeads(s *testServer) *int64 {
+	var heads int64
+	s.fake.SetFault(func(r *http.Request) int {
+		// The region lookups use HeadBucket
+		if r.Method == http.MethodHead && strings.Count(r.URL.Path, "/") > 1 {
+			atomic.AddInt64(&heads, 1)
+		}
+		return 0
+	})
+	return &heads
+}
+
+func TestHeadCache(t *testing.T) {
+	s := newTestServer(t, func(config *Config) {
+		config.HeadCacheTTL = time.Minute
+	})
+	defer s.close()
+	heads := countHeads(s)
+
+	// Misses aren't cached by default
+	if resp := s.head("photo.png"); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected the missing object to be reported with 404, got %d", resp.StatusCode)
+	}
+	s.putObject("photo.png", []byte("image"))
+
+	resp := s.head("photo.png")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the object uploaded by another client to be found, got %d", resp.StatusCode)
+	}
+	if resp.Header.Get("Content-Length") != "5" {
+		t.Errorf("Expected the Content-Length of the object, got %q", resp.Header.Get("Content-Length"))
+	}
+
+	// Existing objects are
+	if resp := s.head("photo.png"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the cached object to be found, got %d", resp.StatusCode)
+	}
+	if n := atomic.LoadInt64(heads); n != 2 {
+		t.Errorf("Expected 2 HeadObject requests, got %d", n)
+	}
+
+	// Until they're overwritten through imgdeflator
+	upload := s.post("photo.png", "width=16", bytes.NewReader(testPNG(t, 32, 32)))
+	upload.Body.Close()
+	if upload.StatusCode != http.StatusOK {
+		t.Fatalf("Failed to upload: %d", upload.StatusCode)
+	}
+	object, _ := s.fake.Object(TestBucket, "photo.png")
+	resp = s.head("photo.png")
+	if resp.Header.Get("Content-Length") != strconv.Itoa(len(object.Body)) {
+		t.Errorf("Expected the Content-Length %d of the new object, got %q", len(object.Body), resp.Header.Get("Content-Length"))
+	}
+}
+
+func TestHeadCacheMissTTL(t *testing.T) {
+	s := newTestServer(t, func(config *Config) {
+		config.HeadCacheTTL = time.Minute
+		config.HeadCacheMissTTL = time.Minute
+	})
+	defer s.close()
+	heads := countHeads(s)
+
+	s.head("photo.png")
+	s.putObject("photo.png", []byte("image"))
+	if resp := s.head("photo.png"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected the cached miss, got %d", resp.StatusCode)
+	}
+	if n := atomic.LoadInt64(heads); n != 1 {
+		t.Errorf("Expected a single HeadObject request, got %d", n)
+	}
+}
+
+func TestHeadCacheSize(t *testing.T) {
+	for _, size := range []int{0, -1} {
+		config := testConfig(t, "http://127.0.0.1")
+		config.HeadCacheSize = size
+		_, err := NewDeflator(config, nil, nil)
+		if err == nil {
+			t.Errorf("Expected the HEAD cache size %d to be rejected", size)
+		}
+	}
+}
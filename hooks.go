@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+var (
+	// hookDurations accumulates the time spent in each hook callback, in
+	// milliseconds, next to the number of calls
+	hookDurations = expvar.NewMap("hook_duration_ms")
+	hookCalls     = expvar.NewMap("hook_calls")
+)
+
+// HookRequest describes the upload being processed to hooks. Key and Metadata
+// can be modified by OnBeforeUpload.
+type HookRequest struct {
+	Bucket      string
+	Key         string
+	ContentType string
+	Width       uint64
+	Height      uint64
+	ClientIP    string
+	// Metadata is stored as the user-defined (x-amz-meta-*) object metadata
+	Metadata map[string]string
+}
+
+// HookContext is passed to the hook callbacks
+type HookContext struct {
+	context.Context
+	Request *HookRequest
+	// Body and Size describe the spooled request body in OnBeforeUpload
+	Body io.ReaderAt
+	Size int64
+	// Result is set in OnUploadComplete
+	Result *uploadResult
+}
+
+// Hook is a plugin which gets called at the different stages of an upload.
+// Hooks run in the order they were registered with NewDeflator. Returning an
+// error from OnRequestValidated or OnBeforeUpload aborts the upload; use
+// VetoError to control the response status.
+type Hook interface {
+	OnRequestValidated(ctx *HookContext) error
+	OnBeforeUpload(ctx *HookContext) error
+	OnUploadComplete(ctx *HookContext)
+}
+
+// NopHook implements Hook without doing anything. Embed it to only implement
+// the callbacks you need.
+type NopHook struct{}
+
+func (NopHook) OnRequestValidated(ctx *HookContext) error { return nil }
+func (NopHook) OnBeforeUpload(ctx *HookContext) error     { return nil }
+func (NopHook) OnUploadComplete(ctx *HookContext)         {}
+
+// VetoError is returned by hooks to reject an upload with the specified
+// status and message
+func VetoError(status int, format string, args ...interface{}) error {
+	return newRequestError(status, ErrorCodeRejected, format, args...)
+}
+
+// KeyPrefixHook is an example hook which stores all uploads under Prefix
+type KeyPrefixHook struct {
+	NopHook
+	Prefix string
+}
+
+func (h *KeyPrefixHook) OnBeforeUpload(ctx *HookContext) error {
+	ctx.Request.Key = h.Prefix + ctx.Request.Key
+	return nil
+}
+
+// timeHook records the duration of a hook callback
+func timeHook(hook Hook, callback string, start time.Time) {
+	name := fmt.Sprintf("%T.%s", hook, callback)
+	hookDurations.Add(name, int64(time.Since(start)/time.Millisecond))
+	hookCalls.Add(name, 1)
+}
+
+// hookError makes sure that errors returned by hooks which aren't vetoes
+// don't leak to clients
+func hookError(hook Hook, err error) error {
+	if _, ok := err.(*requestError); ok {
+		return err
+	}
+	return newRequestError(http.StatusInternalServerError, ErrorCodeInternal, "Internal error").withCause(fmt.Errorf("%T: %s", hook, err))
+}
+
+// runRequestValidated calls OnRequestValidated on all the hooks, stopping at
+// the first error
+func (d *Deflator) runRequestValidated(ctx *HookContext) error {
+	for _, hook := range d.hooks {
+		start := time.Now()
+		err := hook.OnRequestValidated(ctx)
+		timeHook(hook, "OnRequestValidated", start)
+		if err != nil {
+			return hookError(hook, err)
+		}
+	}
+	return nil
+}
+
+// runBeforeUpload calls OnBeforeUpload on all the hooks, stopping at the
+// first error
+func (d *Deflator) runBeforeUpload(ctx *HookContext) error {
+	for _, hook := range d.hooks {
+		start := time.Now()
+		err := hook.OnBeforeUpload(ctx)
+		timeHook(hook, "OnBeforeUpload", start)
+		if err != nil {
+			return hookError(hook, err)
+		}
+	}
+	return nil
+}
+
+// runUploadComplete calls OnUploadComplete on all the hooks
+func (d *Deflator) runUploadComplete(ctx *HookContext) {
+	for _, hook := range d.hooks {
+		start := time.Now()
+		hook.OnUploadComplete(ctx)
+		timeHook(hook, "OnUploadComplete", start)
+	}
+}
@@ -1,53 +1,218 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	_ "net/http/pprof"
 	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/Nitro/urlsign"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/aws/awserr"
-	"github.com/aws/aws-sdk-go-v2/aws/external"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/s3manager"
 	"github.com/davidbyttow/govips/pkg/vips"
 	"github.com/hashicorp/golang-lru"
 	"github.com/relistan/envconfig"
 	"github.com/relistan/rubberneck"
 	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
 )
 
 const (
+	// UploaderCacheSize is the default size of the uploader cache
 	UploaderCacheSize = 25
 )
 
 var (
-	// TODO: Check for errors when UploaderCacheSize < 0
+	// uploaderCache is sized by configureUploaderCache, from NewDeflator
 	uploaderCache, _ = lru.New(UploaderCacheSize)
 )
 
 type Config struct {
-	LoggingLevel      string        `envconfig:"LOGGING_LEVEL" default:"info"`
-	MaxUploadSize     int64         `envconfig:"MAX_UPLOAD_SIZE" default:"5242880"` //5MB
-	HTTPPort          string        `envconfig:"HTTP_PORT" default:"8080"`
-	UploadTimeout     time.Duration `envconfig:"UPLOAD_TIMEOUT" default:"10s"`
-	RequestTimeout    time.Duration `envconfig:"REQUEST_TIMEOUT" default:"11s"`
-	DefaultS3Region   string        `envconfig:"DEFAULT_S3_REGION" default:"eu-central-1"`
+	LoggingLevel        string        `envconfig:"LOGGING_LEVEL" default:"info"`
+	LogKeys             string        `envconfig:"LOG_KEYS" default:"full"`
+	AuditKeys           string        `envconfig:"AUDIT_KEYS" default:"full"`
+	LogSampleFirst      int           `envconfig:"LOG_SAMPLE_FIRST" default:"0"`
+	LogSampleInterval   time.Duration `envconfig:"LOG_SAMPLE_INTERVAL" default:"1m"`
+	MetricBuckets       []string      `envconfig:"METRIC_BUCKETS"`
+	MaxUploadSize       int64         `envconfig:"MAX_UPLOAD_SIZE" default:"5242880"` //5MB
+	MaxUploadSizeByType []string      `envconfig:"MAX_UPLOAD_SIZE_BY_TYPE"`
+	MinUploadSize       int64         `envconfig:"MIN_UPLOAD_SIZE" default:"0"`
+	ContentTypeGate     bool          `envconfig:"CONTENT_TYPE_GATE" default:"true"`
+	MaxStoredSize       int64         `envconfig:"MAX_STORED_SIZE" default:"0"`
+	PassthroughMaxSize  int64         `envconfig:"PASSTHROUGH_MAX_SIZE" default:"1073741824"` //1GB
+	SoftUploadSizePct   int           `envconfig:"SOFT_UPLOAD_SIZE_PERCENT" default:"0"`
+	EchoMaxSize         int64         `envconfig:"ECHO_MAX_SIZE" default:"5242880"` //5MB
+	ValidateHeaders     bool          `envconfig:"VALIDATE_HEADERS" default:"false"`
+	HTTPPort            string        `envconfig:"HTTP_PORT" default:"8080"`
+	UploadTimeout       time.Duration `envconfig:"UPLOAD_TIMEOUT" default:"10s"`
+	UploadTimeoutMin    time.Duration `envconfig:"UPLOAD_TIMEOUT_MIN" default:"1s"`
+	UploadTimeoutMax    time.Duration `envconfig:"UPLOAD_TIMEOUT_MAX" default:"0s"`
+	DeadlineMaxSkew     time.Duration `envconfig:"DEADLINE_MAX_SKEW" default:"30s"`
+	RequestTimeout      time.Duration `envconfig:"REQUEST_TIMEOUT" default:"11s"`
+	DefaultS3Region     string        `envconfig:"DEFAULT_S3_REGION" default:"eu-central-1"`
+	// RegionFallbacks are tried as hints after DefaultS3Region when looking up bucket regions
+	RegionFallbacks   []string      `envconfig:"REGION_FALLBACKS"`
 	MaxWidth          uint64        `envconfig:"MAX_WIDTH" default:"4096"`
 	MaxHeight         uint64        `envconfig:"MAX_HEIGHT" default:"4096"`
 	UrlSigningSecret  string        `envconfig:"URL_SIGNING_SECRET" default:"deadbeef"`
 	SigningBucketSize time.Duration `envconfig:"SIGNING_BUCKET_SIZE" default:"8h"`
+	// AllowedDestinations is a list of `bucket` or `bucket/prefix` entries. Empty allows everything.
+	AllowedDestinations         []string      `envconfig:"ALLOWED_DESTINATIONS"`
+	EnableDelete                bool          `envconfig:"ENABLE_DELETE" default:"false"`
+	EnableGet                   bool          `envconfig:"ENABLE_GET" default:"false"`
+	CacheRenditions             bool          `envconfig:"CACHE_RENDITIONS" default:"false"`
+	EnableUI                    bool          `envconfig:"ENABLE_UI" default:"false"`
+	CacheControl                string        `envconfig:"CACHE_CONTROL" default:"public, max-age=86400"`
+	UnknownParameters           string        `envconfig:"UNKNOWN_PARAMETERS" default:"ignore"`
+	ResponseStyle               string        `envconfig:"RESPONSE_STYLE" default:"legacy"`
+	MultiRange                  string        `envconfig:"MULTI_RANGE" default:"reject"`
+	DeleteCheckExists           bool          `envconfig:"DELETE_CHECK_EXISTS" default:"false"`
+	TrashPrefix                 string        `envconfig:"TRASH_PREFIX" default:".trash/"`
+	HeadCacheTTL                time.Duration `envconfig:"HEAD_CACHE_TTL" default:"5s"`
+	HeadCacheMissTTL            time.Duration `envconfig:"HEAD_CACHE_MISS_TTL" default:"0s"`
+	HeadCacheSize               int           `envconfig:"HEAD_CACHE_SIZE" default:"4096"`
+	BucketConfigFile            string        `envconfig:"BUCKET_CONFIG_FILE"`
+	ProfileConfigFile           string        `envconfig:"PROFILE_CONFIG_FILE"`
+	ListenerConfigFile          string        `envconfig:"LISTENER_CONFIG_FILE"`
+	AdminPort                   string        `envconfig:"ADMIN_PORT"`
+	AdminToken                  string        `envconfig:"ADMIN_TOKEN"`
+	GRPCPort                    string        `envconfig:"GRPC_PORT"`
+	TrustedProxies              []string      `envconfig:"TRUSTED_PROXIES"`
+	IPAllowlistFile             string        `envconfig:"IP_ALLOWLIST_FILE"`
+	IPDenylistFile              string        `envconfig:"IP_DENYLIST_FILE"`
+	EnableTus                   bool          `envconfig:"ENABLE_TUS" default:"false"`
+	TusDir                      string        `envconfig:"TUS_DIR"`
+	TusUploadExpiry             time.Duration `envconfig:"TUS_UPLOAD_EXPIRY" default:"1h"`
+	AdaptiveConcurrency         bool          `envconfig:"ADAPTIVE_CONCURRENCY" default:"false"`
+	ConcurrencyInitialLimit     int           `envconfig:"CONCURRENCY_INITIAL_LIMIT" default:"20"`
+	ConcurrencyMinLimit         int           `envconfig:"CONCURRENCY_MIN_LIMIT" default:"1"`
+	ConcurrencyMaxLimit         int           `envconfig:"CONCURRENCY_MAX_LIMIT" default:"100"`
+	ConcurrencyAdditiveIncrease float64       `envconfig:"CONCURRENCY_ADDITIVE_INCREASE" default:"1"`
+	ConcurrencyDecreaseFactor   float64       `envconfig:"CONCURRENCY_DECREASE_FACTOR" default:"0.5"`
+	ConcurrencyQueueTimeout     time.Duration `envconfig:"CONCURRENCY_QUEUE_TIMEOUT" default:"1s"`
+	ConcurrencyRetryAfter       time.Duration `envconfig:"CONCURRENCY_RETRY_AFTER" default:"1s"`
+	MaintenanceMaxDuration      time.Duration `envconfig:"MAINTENANCE_MAX_DURATION" default:"6h"`
+	MaintenanceAutoBuckets      int           `envconfig:"MAINTENANCE_AUTO_BUCKETS" default:"0"`
+	MaintenanceTripThreshold    int           `envconfig:"MAINTENANCE_TRIP_THRESHOLD" default:"5"`
+	MaintenanceAutoDuration     time.Duration `envconfig:"MAINTENANCE_AUTO_DURATION" default:"5m"`
+	MaxConcurrentPerPrincipal   int           `envconfig:"MAX_CONCURRENT_PER_PRINCIPAL" default:"0"`
+	AdmissionControl            bool          `envconfig:"ADMISSION_CONTROL" default:"false"`
+	AdmissionSmallUploadSize    int64         `envconfig:"ADMISSION_SMALL_UPLOAD_SIZE" default:"262144"`
+	AdmissionPriorityLimit      int           `envconfig:"ADMISSION_PRIORITY_LIMIT" default:"8"`
+	AdmissionNormalLimit        int           `envconfig:"ADMISSION_NORMAL_LIMIT" default:"16"`
+	AdmissionMaxLimit           int           `envconfig:"ADMISSION_MAX_LIMIT" default:"20"`
+	AdmissionMaxWait            time.Duration `envconfig:"ADMISSION_MAX_WAIT" default:"5s"`
+	ProgressLogInterval         time.Duration `envconfig:"PROGRESS_LOG_INTERVAL" default:"2s"`
+	ProgressLogAfter            time.Duration `envconfig:"PROGRESS_LOG_AFTER" default:"2s"`
+	SlowRequestThreshold        time.Duration `envconfig:"SLOW_REQUEST_THRESHOLD" default:"5s"`
+	StallTimeout                time.Duration `envconfig:"STALL_TIMEOUT" default:"0s"`
+	ShadowPercent               float64       `envconfig:"SHADOW_PERCENT" default:"0"`
+	ShadowProfile               string        `envconfig:"SHADOW_PROFILE"`
+	ShadowKeyPrefix             string        `envconfig:"SHADOW_KEY_PREFIX"`
+	SentryDSN                   string        `envconfig:"SENTRY_DSN"`
+	SentryScrubKeys             bool          `envconfig:"SENTRY_SCRUB_KEYS" default:"false"`
+	FailureBufferSize           int           `envconfig:"FAILURE_BUFFER_SIZE" default:"100"`
+	FailureRetention            time.Duration `envconfig:"FAILURE_RETENTION" default:"1h"`
+	ShutdownPhaseTimeout        time.Duration `envconfig:"SHUTDOWN_PHASE_TIMEOUT" default:"10s"`
+	ShutdownTimeout             time.Duration `envconfig:"SHUTDOWN_TIMEOUT" default:"25s"`
+	PreShutdownDelay            time.Duration `envconfig:"PRE_SHUTDOWN_DELAY" default:"0s"`
+	AllowKeyTemplateHeader      bool          `envconfig:"ALLOW_KEY_TEMPLATE_HEADER" default:"false"`
+	AllowRegionHeader           bool          `envconfig:"ALLOW_REGION_HEADER" default:"false"`
+	EchoHeaders                 []string      `envconfig:"ECHO_HEADERS"`
+	SessionSecret               string        `envconfig:"SESSION_SECRET"`
+	SessionMaxTTL               time.Duration `envconfig:"SESSION_MAX_TTL" default:"15m"`
+	SessionClockSkew            time.Duration `envconfig:"SESSION_CLOCK_SKEW" default:"30s"`
+	CoalesceUploads             bool          `envconfig:"COALESCE_UPLOADS" default:"false"`
+	KeyPrefix                   string        `envconfig:"KEY_PREFIX"`
+	ScanURL                     string        `envconfig:"SCAN_URL"`
+	ScanTimeout                 time.Duration `envconfig:"SCAN_TIMEOUT" default:"10s"`
+	ScanPolicy                  string        `envconfig:"SCAN_POLICY" default:"fail_closed"`
+	ScanCacheSize               int           `envconfig:"SCAN_CACHE_SIZE" default:"1024"`
+	PerceptualHash              bool          `envconfig:"PERCEPTUAL_HASH" default:"false"`
+	ChecksumAlgorithm           string        `envconfig:"CHECKSUM_ALGORITHM"`
+	PhashDenylistFile           string        `envconfig:"PHASH_DENYLIST_FILE"`
+	PhashMaxDistance            int           `envconfig:"PHASH_MAX_DISTANCE" default:"8"`
+	TextFont                    string        `envconfig:"TEXT_FONT"`
+	TextSize                    uint64        `envconfig:"TEXT_SIZE" default:"32"`
+	TextMaxSize                 uint64        `envconfig:"TEXT_MAX_SIZE" default:"256"`
+	TextMaxLength               int           `envconfig:"TEXT_MAX_LENGTH" default:"200"`
+	RedactMaxRegions            int           `envconfig:"REDACT_MAX_REGIONS" default:"16"`
+	WorkBudget                  float64       `envconfig:"WORK_BUDGET" default:"0"`
+	MaxRenditions               int           `envconfig:"MAX_RENDITIONS" default:"0"`
+	AVIFOutputFormat            string        `envconfig:"AVIF_OUTPUT_FORMAT" default:"jpeg"`
+	Deterministic               bool          `envconfig:"DETERMINISTIC" default:"false"`
+	OriginalKeyTemplate         string        `envconfig:"ORIGINAL_KEY_TEMPLATE" default:"{orig_key}.orig"`
+	KeepOriginalBestEffort      bool          `envconfig:"KEEP_ORIGINAL_BEST_EFFORT" default:"false"`
+	SiblingsBestEffort          bool          `envconfig:"SIBLINGS_BEST_EFFORT" default:"false"`
+	ObjectLimitPolicy           string        `envconfig:"OBJECT_LIMIT_POLICY" default:"reject"`
+	StreamingTransforms         bool          `envconfig:"STREAMING_TRANSFORMS" default:"false"`
+	CapabilitiesBuckets         bool          `envconfig:"CAPABILITIES_BUCKETS" default:"false"`
+	CollisionSuffixAttempts     int           `envconfig:"COLLISION_SUFFIX_ATTEMPTS" default:"10"`
+	CanaryBucket                string        `envconfig:"CANARY_BUCKET"`
+	CanaryKey                   string        `envconfig:"CANARY_KEY" default:".imgdeflator-canary.png"`
+	CanaryInterval              time.Duration `envconfig:"CANARY_INTERVAL" default:"1m"`
+	CanaryAffectsReadiness      bool          `envconfig:"CANARY_AFFECTS_READINESS" default:"false"`
+	NormalizeKeys               bool          `envconfig:"NORMALIZE_KEYS" default:"true"`
+	NormalizePaths              bool          `envconfig:"NORMALIZE_PATHS" default:"true"`
+	DisallowedKeyCharacters     string        `envconfig:"DISALLOWED_KEY_CHARACTERS" default:"\\\x7f"`
+	UsageReportBucket           string        `envconfig:"USAGE_REPORT_BUCKET"`
+	UsageReportPrefix           string        `envconfig:"USAGE_REPORT_PREFIX" default:"usage/"`
+	AllowAnonymous              bool          `envconfig:"ALLOW_ANONYMOUS" default:"false"`
+	WarmupBuckets               []string      `envconfig:"WARMUP_BUCKETS"`
+	WarmupConcurrency           int           `envconfig:"WARMUP_CONCURRENCY" default:"4"`
+	WarmupTimeout               time.Duration `envconfig:"WARMUP_TIMEOUT" default:"10s"`
+	WarmupStrict                bool          `envconfig:"WARMUP_STRICT" default:"false"`
+	MemoryHighWater             uint64        `envconfig:"MEMORY_HIGH_WATER" default:"0"`
+	DiskMinFree                 uint64        `envconfig:"DISK_MIN_FREE" default:"0"`
+	S3UseAccelerate             bool          `envconfig:"S3_USE_ACCELERATE" default:"false"`
+	AWSProfiles                 []string      `envconfig:"AWS_PROFILES"`
+	S3UseDualstack              bool          `envconfig:"S3_USE_DUALSTACK" default:"false"`
+	S3MaxIdleConns              int           `envconfig:"S3_MAX_IDLE_CONNS" default:"100"`
+	S3MaxIdleConnsPerHost       int           `envconfig:"S3_MAX_IDLE_CONNS_PER_HOST" default:"100"`
+	S3IdleConnTimeout           time.Duration `envconfig:"S3_IDLE_CONN_TIMEOUT" default:"90s"`
+	S3TLSHandshakeTimeout       time.Duration `envconfig:"S3_TLS_HANDSHAKE_TIMEOUT" default:"10s"`
+	S3DisableHTTP2              bool          `envconfig:"S3_DISABLE_HTTP2" default:"false"`
+	S3ProxyURL                  string        `envconfig:"S3_PROXY_URL"`
+	S3PutRate                   float64       `envconfig:"S3_PUT_RATE" default:"0"`
+	S3PutBurst                  int           `envconfig:"S3_PUT_BURST" default:"0"`
+	S3GetRate                   float64       `envconfig:"S3_GET_RATE" default:"0"`
+	S3GetBurst                  int           `envconfig:"S3_GET_BURST" default:"0"`
+	S3BudgetMaxWait             time.Duration `envconfig:"S3_BUDGET_MAX_WAIT" default:"1s"`
+	ProxyURL                    string        `envconfig:"PROXY_URL"`
+	CABundleFile                string        `envconfig:"CA_BUNDLE_FILE"`
+	S3Endpoint                  string        `envconfig:"S3_ENDPOINT"`
+	FilesystemRoot              string        `envconfig:"FILESYSTEM_ROOT"`
+	FilesystemBucketPrefixes    []string      `envconfig:"FILESYSTEM_BUCKET_PREFIXES"`
+	FilesystemSync              bool          `envconfig:"FILESYSTEM_SYNC" default:"true"`
+	ExpectedBucketOwner         string        `envconfig:"EXPECTED_BUCKET_OWNER"`
+	VerifyBucketOwner           bool          `envconfig:"VERIFY_BUCKET_OWNER" default:"false"`
+	RegionLookupAttempts        int           `envconfig:"REGION_LOOKUP_ATTEMPTS" default:"3"`
+	RegionFailureBackoff        time.Duration `envconfig:"REGION_FAILURE_BACKOFF" default:"5s"`
+	RegionFailureMaxBackoff     time.Duration `envconfig:"REGION_FAILURE_MAX_BACKOFF" default:"5m"`
+	RegionCacheFile             string        `envconfig:"REGION_CACHE_FILE"`
+	RegionCacheMaxAge           time.Duration `envconfig:"REGION_CACHE_MAX_AGE" default:"168h"`
+	RegionCacheDisabled         bool          `envconfig:"REGION_CACHE_DISABLED" default:"false"`
+	UploaderCacheSize           int           `envconfig:"UPLOADER_CACHE_SIZE" default:"25"`
+	UploaderCacheMaxSize        int           `envconfig:"UPLOADER_CACHE_MAX_SIZE" default:"0"`
+	UploaderCacheThrash         int           `envconfig:"UPLOADER_CACHE_THRASH_THRESHOLD" default:"10"`
+	RestartTimeout              time.Duration `envconfig:"RESTART_TIMEOUT" default:"30s"`
 }
 
 func configureLoggingLevel(config *Config) {
@@ -65,64 +230,227 @@ func configureLoggingLevel(config *Config) {
 	}
 }
 
+// uploaderCacheEntry is a cached uploader together with the stats reported
+// by the admin API
+type uploaderCacheEntry struct {
+	uploader *s3manager.Uploader
+	region   string
+	endpoint string
+	created  time.Time
+	hits     int64
+	// expectedOwner is the AWS account the bucket must belong to, if any
+	expectedOwner string
+	ownerCheck    string
+	// ownerErr is returned for buckets of another owner
+	ownerErr error
+	// profile is the named AWS profile of the uploader, if any. The profile
+	// of a bucket doesn't change, so the bucket name keys the uploaders of
+	// all the profiles.
+	profile string
+}
+
 // getS3Uploader looks up an S3 bucket in the uploaderCache and returns a configured
-// s3manager.Uploader for it or provisions a new one and returns that.
-func getS3Uploader(ctx context.Context, bucket, defaultRegion string) (*s3manager.Uploader, error) {
-	if uploader, ok := uploaderCache.Get(bucket); ok {
-		return uploader.(*s3manager.Uploader), nil
+// s3manager.Uploader for it or provisions a new one and returns that. The bucket
+// region gets looked up unless a regionHint is provided. When Transfer
+// Acceleration is requested but can't be used for the bucket, the uploader
+// falls back to the regional endpoint. Buckets stored on the filesystem get an
+// uploader backed by it.
+func getS3Uploader(ctx context.Context, bucket, regionHint, defaultRegion string, options s3EndpointOptions) (*s3manager.Uploader, error) {
+	// The filesystem buckets don't need any AWS credentials
+	if options.filesystemRoot != "" {
+		return getFilesystemUploader(bucket, options), nil
+	}
+
+	if err := credentialsError(options); err != nil {
+		return nil, err
+	}
+
+	if entry, ok := uploaderCache.Get(bucket); ok {
+		atomic.AddInt64(&entry.(*uploaderCacheEntry).hits, 1)
+		if ownerErr := entry.(*uploaderCacheEntry).ownerErr; ownerErr != nil {
+			return nil, ownerErr
+		}
+		return entry.(*uploaderCacheEntry).uploader, nil
 	}
 
-	awsCfg, err := external.LoadDefaultAWSConfig()
+	var awsCfg aws.Config
+	var err error
+	if options.profile != "" {
+		awsCfg, err = loadProfileAWSConfig(options.profile)
+	} else {
+		awsCfg, err = loadAWSConfig()
+	}
 	if err != nil {
-		return nil, fmt.Errorf("could not load the default AWS config: %s", err)
+		return nil, err
 	}
 
-	region, err := s3manager.GetBucketRegion(ctx, awsCfg, bucket, defaultRegion)
+	ap, err := parseAccessPoint(bucket)
 	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "NotFound" {
-			return nil, fmt.Errorf("region for bucket %q not found", bucket)
+		return nil, err
+	}
+
+	// The configured region takes precedence over the one from the URL
+	region, regionSource := options.region, RegionSourceBucketConfig
+	if region == "" {
+		region, regionSource = regionHint, options.hintSource
+		if regionSource == "" {
+			regionSource = RegionSourceURL
+		}
+	}
+
+	if ap != nil {
+		// The region comes from the ARN and GetBucketLocation doesn't work with access points
+		region, regionSource = ap.region, RegionSourceAccessPoint
+	} else if region == "" {
+		var ok bool
+		region, ok = persistedRegions.get(bucket)
+		regionSource = RegionSourceCache
+		if !ok {
+			region, err = lookupBucketRegion(ctx, awsCfg, bucket, append([]string{defaultRegion}, options.regionFallbacks...))
+			if err != nil {
+				return nil, err
+			}
+			persistedRegions.learn(bucket, region)
+			regionSource = RegionSourceResolved
 		}
-		return nil, fmt.Errorf("failed to determine region for bucket %q: %s", bucket, err)
 	}
-	log.Debugf("Bucket %q is in region: %s", bucket, region)
+
+	partition, err := regionPartition(region)
+	if err != nil {
+		return nil, err
+	}
+	log.Debugf("Bucket %q is in region %s (partition %s)", bucket, region, partition)
 
 	awsCfg.Region = region
-	uploader := s3manager.NewUploader(awsCfg)
 
-	// Don't overwrite a cached entry that got written by another goroutine in the mean time
-	_, _ = uploaderCache.ContainsOrAdd(bucket, uploader)
+	// Custom endpoints have no dualstack variant
+	if options.dualstack && ap == nil && s3Endpoint == "" {
+		useDualstack(&awsCfg)
+	}
+
+	if options.accelerate {
+		if ap != nil {
+			err = fmt.Errorf("access points are not compatible with Transfer Acceleration")
+		} else {
+			err = checkAccelerate(ctx, awsCfg, bucket)
+		}
+		if err != nil {
+			log.Warnf("Not using Transfer Acceleration for bucket %q: %s", bucket, err)
+			options.accelerate = false
+		}
+	}
+
+	var client *s3.S3
+	endpoint := options.style()
+	if ap != nil {
+		awsCfg.EndpointResolver = aws.ResolveWithEndpointURL(ap.endpoint(options.dualstack))
+		client = s3.New(awsCfg)
+		client.Handlers.Validate.PushFront(ap.useAccessPoint)
+		endpoint = "access point"
+		if options.dualstack {
+			endpoint += "+dualstack"
+		}
+	} else {
+		client = s3.New(awsCfg)
+		client.UseAccelerate = options.accelerate
+		// Custom endpoints don't resolve virtual-hosted bucket names
+		if s3Endpoint != "" {
+			client.ForcePathStyle = true
+			endpoint = "custom"
+		}
+	}
+	log.WithFields(log.Fields{
+		"bucket":        bucket,
+		"region":        region,
+		"region_source": regionSource,
+	}).Infof("Provisioned uploader for bucket %q using the %s endpoint in region %s", bucket, endpoint, region)
+
+	ownerCheck := ""
+	var ownerErr error
+	if options.expectedOwner != "" {
+		expectBucketOwner(client, options.expectedOwner)
+		ownerCheck = OwnerCheckUnchecked
+		if options.verifyOwner {
+			ownerCheck, ownerErr = checkBucketOwner(ctx, client, bucket)
+		}
+	}
+
+	uploader := s3manager.NewUploaderWithClient(client)
+
+	// Don't overwrite a cached entry that got written by another goroutine in the mean time.
+	// Owner mismatches are cached too, until the entry gets evicted.
+	cacheUploader(bucket, &uploaderCacheEntry{
+		uploader:      uploader,
+		region:        region,
+		endpoint:      endpoint,
+		created:       time.Now(),
+		expectedOwner: options.expectedOwner,
+		ownerCheck:    ownerCheck,
+		ownerErr:      ownerErr,
+		profile:       options.profile,
+	})
+	if ownerErr != nil {
+		return nil, ownerErr
+	}
 
 	return uploader, nil
 }
 
+// decodePath decodes the base64 encoded S3 URL of a request path. Paths
+// longer than MaxEncodedPathLength are rejected before anything gets
+// allocated for them, and so are the URLs containing control characters.
 func decodePath(path string) (string, error) {
-	decodedPath, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(path, "/"))
+	path = strings.TrimPrefix(path, "/")
+	if len(path) > MaxEncodedPathLength {
+		return "", fmt.Errorf("path too long (%d bytes, limit: %d)", len(path), MaxEncodedPathLength)
+	}
+
+	// Some clients keep the padding
+	decodedPath, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(path, "="))
 	if err != nil {
 		return "", err
 	}
 
+	// Keys with special characters have to be percent-encoded in the URL
+	for _, c := range decodedPath {
+		if c < 0x20 || c == 0x7f {
+			return "", fmt.Errorf("control character %q in decoded path", c)
+		}
+	}
+
 	return string(decodedPath), nil
 }
 
-func parseS3URL(s3URL string) (*url.URL, error) {
-	u, err := url.Parse(s3URL)
-	if err != nil {
-		return nil, fmt.Errorf("Invalid S3 URL: %s", err)
+// isAllowedDestination checks the bucket and key against the configured
+// AllowedDestinations. An empty list allows all destinations.
+func isAllowedDestination(allowed []string, bucket, key string) bool {
+	if len(allowed) == 0 {
+		return true
 	}
 
-	return u, nil
-}
+	// Access points are allowed by name
+	bucket = accessPointName(bucket)
 
-func parseUintValue(value string, maxValue uint64) uint64 {
-	if value != "" {
-		parsedValue, err := strconv.ParseUint(value, 10, 32)
-		if err != nil || parsedValue > maxValue {
-			return 0
+	for _, entry := range allowed {
+		allowedBucket, prefix := entry, ""
+		if i := strings.Index(entry, "/"); i >= 0 {
+			allowedBucket, prefix = entry[:i], entry[i+1:]
 		}
 
-		return parsedValue
+		if allowedBucket == bucket && strings.HasPrefix(key, prefix) {
+			return true
+		}
 	}
-	return 0
+
+	return false
+}
+
+// awsErrorCode returns the AWS error code wrapped in err or an empty string
+func awsErrorCode(err error) string {
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code()
+	}
+	return ""
 }
 
 type Clock interface {
@@ -137,160 +465,850 @@ func (c *utcClock) Now() time.Time {
 }
 
 type Deflator struct {
-	config *Config
-	server *http.Server
-	clock  Clock
+	config           *Config
+	buckets          map[string]*BucketConfig
+	listenerConfigs  []*ListenerConfig
+	listeners        []*listener
+	clock            Clock
+	replicationQueue chan *replicationJob
+	grpcServer       *grpc.Server
+	grpcListener     net.Listener
+	tus              *tusStore
+	trustedProxies   []*net.IPNet
+	// ipFilter holds an *ipFilter, which gets replaced on reloads
+	ipFilter atomic.Value
+	// profiles holds the transformProfiles, which get replaced on reloads
+	profiles atomic.Value
+	// denylist holds the phashDenylist, which gets replaced on reloads
+	denylist atomic.Value
+	// capabilities caches the *cachedCapabilities until the next reload
+	capabilities atomic.Value
+	// inflight holds the *uploadRequest being processed
+	inflight sync.Map
+	// dumping is set while a diagnostic dump is in progress
+	dumping int32
+	// replicationRetries counts the replica uploads waiting for their retry
+	replicationRetries int64
+	// draining is set once the shutdown started, failing the readiness
+	draining int32
+	// errorReporter is nil when error reporting is disabled
+	errorReporter *errorReporter
+	// failures is nil when the failure buffer is disabled
+	failures *failureBuffer
+	// sessions is nil when upload sessions are disabled
+	sessions      *sessionStore
+	shadowProfile *encoderProfile
+	shadowQueue   chan *shadowJob
+	// sizeLimits override MaxUploadSize for specific (sniffed) content types
+	sizeLimits map[string]int64
+	// awsProfiles route the buckets to named AWS profiles, in order
+	awsProfiles []bucketProfile
+	// passthroughBuckets is set when some buckets are in passthrough mode
+	passthroughBuckets bool
+	// concurrency is nil when adaptive concurrency is disabled
+	concurrency *concurrencyLimiters
+	coalescer   uploadCoalescer
+	hooks       []Hook
+	// scanner is nil when virus scanning is disabled
+	scanner *scanGuard
+	// admission is nil when admission control is disabled
+	admission *admissionQueue
+	// principals counts the in-flight requests of each principal
+	principals *principalLimiter
+	// resources is nil when no resource limits are configured
+	resources *resourceGuard
+	// originalKeyTemplate is where keep_original stores the originals
+	originalKeyTemplate *keyTemplate
+	// usage is kept across config reloads
+	usage *usageAccounting
+	// renditions tracks the background refreshes of the cached renditions
+	renditions *renditionCache
+	// lastCanary holds the *canaryResult of the last canary upload
+	lastCanary atomic.Value
+	// maintenance is kept across config reloads
+	maintenance *maintenanceMode
 }
 
-func NewDeflator(config *Config) *Deflator {
-	return &Deflator{
-		config: config,
-		server: &http.Server{
-			Addr:         ":" + config.HTTPPort,
-			ReadTimeout:  config.RequestTimeout,
-			WriteTimeout: config.RequestTimeout,
-		},
-		clock: &utcClock{},
+// NewDeflator sets up a Deflator. The hooks get called for every upload, in
+// the specified order.
+func NewDeflator(config *Config, buckets map[string]*BucketConfig, listenerConfigs []*ListenerConfig, hooks ...Hook) (*Deflator, error) {
+	trustedProxies, err := parseCIDRs(config.TrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trusted proxies: %s", err)
+	}
+
+	filter, err := loadIPFilter(config)
+	if err != nil {
+		return nil, err
+	}
+
+	shadowProfile, err := parseEncoderProfile(config.ShadowProfile)
+	if err != nil {
+		return nil, fmt.Errorf("invalid shadow profile: %s", err)
+	}
+
+	sizeLimits, err := parseSizeLimits(config.MaxUploadSizeByType)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upload size limits: %s", err)
+	}
+
+	err = validateEchoHeaders(config.EchoHeaders)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := outputFormats[config.AVIFOutputFormat]; !ok {
+		return nil, fmt.Errorf("invalid AVIF output format %q", config.AVIFOutputFormat)
+	}
+
+	if config.WorkBudget < 0 || config.MaxRenditions < 0 {
+		return nil, fmt.Errorf("invalid work budget %g or max renditions %d", config.WorkBudget, config.MaxRenditions)
+	}
+
+	if config.SoftUploadSizePct < 0 || config.SoftUploadSizePct >= 100 {
+		return nil, fmt.Errorf("invalid soft upload size percent %d", config.SoftUploadSizePct)
+	}
+
+	if config.DeadlineMaxSkew < 0 {
+		return nil, fmt.Errorf("invalid deadline max skew %s", config.DeadlineMaxSkew)
+	}
+
+	for _, region := range append([]string{config.DefaultS3Region}, config.RegionFallbacks...) {
+		if _, err := regionPartition(region); err != nil {
+			return nil, fmt.Errorf("invalid region hint: %s", err)
+		}
+	}
+
+	if config.EnableUI && config.AdminToken == "" {
+		return nil, fmt.Errorf("the UI needs an admin token")
+	}
+
+	if config.RegionLookupAttempts < 1 {
+		return nil, fmt.Errorf("invalid region lookup attempts %d", config.RegionLookupAttempts)
+	}
+	if config.RegionFailureBackoff > config.RegionFailureMaxBackoff {
+		return nil, fmt.Errorf("the region failure backoff %s exceeds the maximum %s", config.RegionFailureBackoff, config.RegionFailureMaxBackoff)
+	}
+	regionLookupAttempts = config.RegionLookupAttempts
+	regionFailures.configure(config.RegionFailureBackoff, config.RegionFailureMaxBackoff)
+	if config.RegionCacheDisabled {
+		persistedRegions.configure("", 0)
+	} else {
+		persistedRegions.configure(config.RegionCacheFile, config.RegionCacheMaxAge)
+	}
+	err = configureUploaderCache(config.UploaderCacheSize, config.UploaderCacheMaxSize, config.UploaderCacheThrash)
+	if err != nil {
+		return nil, err
+	}
+	err = configureHeadCache(config.HeadCacheSize)
+	if err != nil {
+		return nil, err
+	}
+
+	scanner, err := newScanGuard(config)
+	if err != nil {
+		return nil, fmt.Errorf("invalid virus scanning config: %s", err)
+	}
+
+	if config.UnknownParameters != UnknownParametersIgnore && config.UnknownParameters != UnknownParametersReject {
+		return nil, fmt.Errorf("invalid unknown parameters policy %q", config.UnknownParameters)
+	}
+
+	originalKeyTemplate, err := parseKeyTemplate(config.OriginalKeyTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid original key template: %s", err)
+	}
+	if config.OriginalKeyTemplate == "{orig_key}" {
+		return nil, fmt.Errorf("the original key template must differ from the processed key")
+	}
+
+	if config.CanaryBucket != "" {
+		if err := sanitizeKey(config.CanaryKey); err != nil {
+			return nil, fmt.Errorf("invalid canary key: %s", err)
+		}
+		if config.CanaryInterval <= 0 {
+			return nil, fmt.Errorf("invalid canary interval %s", config.CanaryInterval)
+		}
+	}
+
+	if config.CollisionSuffixAttempts < 1 {
+		return nil, fmt.Errorf("invalid collision suffix attempts %d", config.CollisionSuffixAttempts)
+	}
+
+	if err := validateChecksumAlgorithm(config.ChecksumAlgorithm); err != nil {
+		return nil, err
+	}
+	if err := validateObjectLimitPolicy(config.ObjectLimitPolicy); err != nil {
+		return nil, err
+	}
+	if err := validateAccountID(config.ExpectedBucketOwner); err != nil {
+		return nil, fmt.Errorf("invalid expected bucket owner: %s", err)
+	}
+
+	if !isResponseStyle(config.ResponseStyle) {
+		return nil, fmt.Errorf("invalid response style %q", config.ResponseStyle)
+	}
+
+	if !isLogKeysMode(config.LogKeys) {
+		return nil, fmt.Errorf("invalid log keys mode %q", config.LogKeys)
+	}
+	if !isLogKeysMode(config.AuditKeys) {
+		return nil, fmt.Errorf("invalid audit keys mode %q", config.AuditKeys)
+	}
+	logKeys = config.LogKeys
+	auditKeys = config.AuditKeys
+	setMetricBuckets(config, buckets)
+
+	if config.MultiRange != MultiRangeReject && config.MultiRange != MultiRangeFull {
+		return nil, fmt.Errorf("invalid multi-range policy %q", config.MultiRange)
+	}
+
+	s3HTTPClient, err = newS3HTTPClient(config)
+	if err != nil {
+		return nil, fmt.Errorf("invalid S3 transport settings: %s", err)
+	}
+
+	if config.S3Endpoint != "" {
+		endpointURL, err := url.Parse(config.S3Endpoint)
+		if err != nil || endpointURL.Host == "" {
+			return nil, fmt.Errorf("invalid S3 endpoint %q", config.S3Endpoint)
+		}
+	}
+	s3Endpoint = config.S3Endpoint
+
+	s3Budget, err = newS3CallBudget(config)
+	if err != nil {
+		return nil, err
+	}
+
+	awsProfiles, err := parseBucketProfiles(config.AWSProfiles)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(config.FilesystemBucketPrefixes) > 0 {
+		if !filepath.IsAbs(config.FilesystemRoot) {
+			return nil, fmt.Errorf("the filesystem root must be an absolute path, got %q", config.FilesystemRoot)
+		}
+		config.FilesystemRoot = filepath.Clean(config.FilesystemRoot)
+		err = os.MkdirAll(config.FilesystemRoot, 0755)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create the filesystem root: %s", err)
+		}
+	}
+
+	d := &Deflator{
+		config:           config,
+		buckets:          buckets,
+		listenerConfigs:  listenerConfigs,
+		clock:            &utcClock{},
+		replicationQueue: make(chan *replicationJob, ReplicationQueueSize),
+		trustedProxies:   trustedProxies,
+		shadowProfile:    shadowProfile,
+		shadowQueue:      make(chan *shadowJob, ShadowQueueSize),
+		sizeLimits:       sizeLimits,
+		awsProfiles:      awsProfiles,
+		hooks:            hooks,
+		scanner:          scanner,
+
+		originalKeyTemplate: originalKeyTemplate,
+		usage:               newUsageAccounting(),
+		passthroughBuckets:  hasPassthroughBucket(buckets),
+		renditions:          newRenditionCache(),
+	}
+
+	if config.GRPCPort != "" {
+		d.grpcServer = newGRPCServer(d)
+	}
+
+	tusDir := config.TusDir
+	if tusDir == "" {
+		tusDir = filepath.Join(os.TempDir(), "imgdeflator-tus")
+	}
+	d.tus = newTusStore(tusDir)
+
+	d.resources, err = newResourceGuard(config, tusDir)
+	if err != nil {
+		return nil, fmt.Errorf("invalid resource limits: %s", err)
+	}
+	d.ipFilter.Store(filter)
+
+	profiles, err := d.loadTransformProfiles(config.ProfileConfigFile)
+	if err != nil {
+		return nil, err
+	}
+	err = validateBucketProfiles(buckets, profiles)
+	if err != nil {
+		return nil, err
+	}
+	d.profiles.Store(profiles)
+
+	if config.PhashMaxDistance < 0 || config.PhashMaxDistance > 64 {
+		return nil, fmt.Errorf("invalid perceptual hash max distance %d", config.PhashMaxDistance)
+	}
+	denylist, err := loadPhashDenylist(config.PhashDenylistFile)
+	if err != nil {
+		return nil, fmt.Errorf("invalid perceptual hash denylist: %s", err)
 	}
+	d.denylist.Store(denylist)
+
+	if config.AdaptiveConcurrency {
+		if config.ConcurrencyMinLimit < 1 || config.ConcurrencyMaxLimit < config.ConcurrencyMinLimit {
+			return nil, fmt.Errorf("invalid concurrency limits (min: %d, max: %d)", config.ConcurrencyMinLimit, config.ConcurrencyMaxLimit)
+		}
+		if config.ConcurrencyDecreaseFactor <= 0 || config.ConcurrencyDecreaseFactor >= 1 {
+			return nil, fmt.Errorf("invalid concurrency decrease factor %g", config.ConcurrencyDecreaseFactor)
+		}
+		d.concurrency = newConcurrencyLimiters(config)
+	}
+
+	if config.MaintenanceMaxDuration <= 0 {
+		return nil, fmt.Errorf("invalid maintenance max duration %s", config.MaintenanceMaxDuration)
+	}
+	if config.MaintenanceAutoBuckets > 0 {
+		if !config.AdaptiveConcurrency {
+			return nil, fmt.Errorf("the automatic maintenance mode needs the adaptive concurrency")
+		}
+		if config.MaintenanceTripThreshold < 1 || config.MaintenanceAutoDuration <= 0 {
+			return nil, fmt.Errorf("invalid automatic maintenance (trip threshold: %d, duration: %s)", config.MaintenanceTripThreshold, config.MaintenanceAutoDuration)
+		}
+	}
+	d.maintenance = newMaintenanceMode(d.clock)
+
+	if config.MaxConcurrentPerPrincipal < 0 {
+		return nil, fmt.Errorf("invalid max concurrent requests per principal %d", config.MaxConcurrentPerPrincipal)
+	}
+	d.principals = newPrincipalLimiter()
+
+	if config.AdmissionControl {
+		if config.AdmissionPriorityLimit < 1 || config.AdmissionNormalLimit < 1 {
+			return nil, fmt.Errorf("invalid admission lane limits (priority: %d, normal: %d)", config.AdmissionPriorityLimit, config.AdmissionNormalLimit)
+		}
+		// The priority lane needs slots the normal lane can't take
+		if config.AdmissionMaxLimit < config.AdmissionPriorityLimit || config.AdmissionMaxLimit <= config.AdmissionNormalLimit {
+			return nil, fmt.Errorf(
+				"the admission max limit %d must be at least the priority limit and above the normal limit",
+				config.AdmissionMaxLimit,
+			)
+		}
+		if config.AdmissionMaxWait <= 0 {
+			return nil, fmt.Errorf("invalid admission max wait %s", config.AdmissionMaxWait)
+		}
+		d.admission = newAdmissionQueue(config)
+	}
+
+	if config.SentryDSN != "" {
+		client, err := newOutboundHTTPClient(config)
+		if err != nil {
+			return nil, fmt.Errorf("invalid egress settings: %s", err)
+		}
+		transport, err := newSentryTransport(config.SentryDSN, client)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Sentry DSN: %s", err)
+		}
+		d.errorReporter = newErrorReporter(transport, config.SentryScrubKeys)
+	}
+
+	if config.FailureBufferSize < 0 || config.FailureRetention < 0 {
+		return nil, fmt.Errorf("invalid failure buffer size %d or retention %s", config.FailureBufferSize, config.FailureRetention)
+	}
+	if config.FailureBufferSize > 0 && config.FailureRetention > 0 {
+		d.failures = newFailureBuffer(d.clock, config.FailureBufferSize, config.FailureRetention)
+	}
+
+	if config.ShutdownPhaseTimeout <= 0 || config.ShutdownTimeout <= 0 {
+		return nil, fmt.Errorf("invalid shutdown phase timeout %s or timeout %s", config.ShutdownPhaseTimeout, config.ShutdownTimeout)
+	}
+
+	if config.SessionSecret != "" {
+		if config.AdminToken == "" {
+			return nil, fmt.Errorf("upload sessions need an admin token")
+		}
+		if config.SessionMaxTTL <= 0 || config.SessionClockSkew < 0 {
+			return nil, fmt.Errorf("invalid session max TTL %s or clock skew %s", config.SessionMaxTTL, config.SessionClockSkew)
+		}
+		d.sessions = newSessionStore()
+	}
+
+	err = d.resizeUploaderCache()
+	if err != nil {
+		return nil, err
+	}
+
+	return d, nil
 }
 
 func (d *Deflator) InitVips() {
 	// Start vips and disable caching, because I think we won't benefit much from it
 	// Details: https://github.com/DarthSim/imgproxy/blob/a344a47f0fa4b492e0a54db047a53991c05419ac/process.go#L52
-	vips.Startup(&vips.Config{
+	config := &vips.Config{
 		// TODO: See if we want to enable file caching later
 		MaxCacheFiles: 1,
 		MaxCacheSize:  1,
 		MaxCacheMem:   1,
-	})
+	}
+	// The output of the threaded encoders can depend on the thread count
+	if d.config.Deterministic {
+		config.ConcurrencyLevel = 1
+	}
+	vips.Startup(config)
 }
 
-func (d *Deflator) Shutdown(ctx context.Context) error {
-	err := d.server.Shutdown(ctx)
+// lifecycle registers the background components of d in their shutdown
+// phases: the servers stop taking requests first, then the work and the
+// outbound queues the requests left get drained, and the reports get flushed
+// last, while the credentials are still refreshed
+func (d *Deflator) lifecycle() *lifecycle {
+	l := newLifecycle(d.config.ShutdownPhaseTimeout, d.config.ShutdownTimeout)
+	l.inflight = d.inflightRequests
 
-	// Shutdown Vips after the HTTP server is stopped
-	vips.Shutdown()
+	l.register("http", ShutdownPhaseIntake, nil, func(ctx context.Context) (int, error) {
+		return 0, d.shutdownListeners(ctx)
+	})
+	if d.grpcServer != nil {
+		l.register("grpc", ShutdownPhaseIntake, nil, func(ctx context.Context) (int, error) {
+			d.stopGRPC(ctx)
+			return 0, nil
+		})
+	}
+	if d.config.CanaryBucket != "" {
+		l.register("canary", ShutdownPhaseIntake, d.RunCanary, nil)
+	}
+
+	shadow := l.register("shadow", ShutdownPhaseWorkers, d.RunShadowQueue, d.drainShadowQueue)
+	shadow.backlog = func() int { return len(d.shadowQueue) }
+	if d.config.EnableTus {
+		l.register("tus_gc", ShutdownPhaseWorkers, d.RunTusGC, nil)
+	}
+	if d.resources != nil {
+		l.register("resource_guard", ShutdownPhaseWorkers, d.resources.Run, nil)
+	}
+	if d.config.MaintenanceAutoBuckets > 0 {
+		l.register("maintenance", ShutdownPhaseWorkers, d.RunMaintenanceWatch, nil)
+	}
+
+	replication := l.register("replication", ShutdownPhaseQueues, d.RunReplicationQueue, d.drainReplicationQueue)
+	replication.backlog = d.replicationBacklog
+	var runUsageFlush func(ctx context.Context)
+	if d.config.UsageReportBucket != "" {
+		runUsageFlush = d.RunUsageFlush
+	}
+	// Flush the usage of the drained requests, including the current day
+	l.register("usage", ShutdownPhaseQueues, runUsageFlush, func(ctx context.Context) (int, error) {
+		d.flushUsage(ctx, "")
+		return 0, nil
+	})
+
+	if d.errorReporter != nil {
+		// Send the errors captured while draining
+		l.register("error_reports", ShutdownPhaseSinks, nil, func(ctx context.Context) (int, error) {
+			d.errorReporter.Flush(ctx)
+			return 0, nil
+		})
+	}
+	l.register("credentials", ShutdownPhaseSinks, sharedCredentials.Run, nil)
+	// Shutdown Vips once nothing transforms images anymore
+	l.register("vips", ShutdownPhaseSinks, nil, func(ctx context.Context) (int, error) {
+		vips.Shutdown()
+		return 0, nil
+	})
 
-	return err
+	return l
 }
 
-func (d *Deflator) ListenAndServe() {
-	err := d.server.ListenAndServe()
-	if err != http.ErrServerClosed {
-		log.Errorf("http.ListenAndServe error: %s", err)
+// verifySignature checks the signature of u, unless signing is disabled
+// globally or for the listener
+func (d *Deflator) verifySignature(ctx context.Context, u *url.URL) error {
+	if d.config.UrlSigningSecret != "" && !listenerFromContext(ctx).DisableAuth &&
+		!urlsign.IsValidSignature(
+			d.config.UrlSigningSecret,
+			d.config.SigningBucketSize,
+			d.clock.Now(),
+			u.String(),
+		) {
+		log.Debugf("Invalid URL signature for %s", describePath(u.Path))
+		return newRequestError(http.StatusBadRequest, ErrorCodeInvalidSignature, "Invalid signature")
 	}
+	return nil
+}
+
+// resolveDestination validates the signature of u (unless the listener has
+// auth disabled) and extracts the S3 location encoded in its path, checking
+// it against the allowed destinations
+func (d *Deflator) resolveDestination(ctx context.Context, u *url.URL) (*s3Location, error) {
+	u, err := d.normalizeRoute(u)
+	if err != nil {
+		return nil, err
+	}
+	err = d.verifySignature(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+
+	decodedPath, err := decodePath(u.Path)
+	if err != nil {
+		log.Debugf("Failed to extract s3 URL from path %s: %s", logRawPath(u.Path), err)
+		return nil, newRequestError(http.StatusBadRequest, ErrorCodeInvalidPath, "Bad request")
+	}
+
+	location, err := parseS3Location(decodedPath)
+	if hostErr, ok := err.(*endpointHostError); ok {
+		log.Debugf("Endpoint host as bucket in path %s: %s", logRawPath(u.Path), err)
+		return nil, newRequestError(
+			http.StatusBadRequest, ErrorCodeInvalidBucket,
+			"%q is the host of a storage endpoint, not a bucket name. Accepted formats: %s", hostErr.host, AcceptedS3URLFormats,
+		)
+	}
+	if err != nil {
+		log.Debugf("Failed to extract s3 bucket from path %s: %s", logRawPath(u.Path), err)
+		return nil, newRequestError(
+			http.StatusBadRequest, ErrorCodeInvalidPath,
+			"Unrecognized S3 URL. Accepted formats: %s", AcceptedS3URLFormats,
+		)
+	}
+
+	// url.Parse percent-decodes the key exactly once, and it stays as is
+	// from there on
+	location.key, err = d.normalizeKey(location.key)
+	if err != nil {
+		log.Debugf("Invalid key in path %s: %s", logRawPath(u.Path), err)
+		return nil, err
+	}
+
+	err = d.authorizeDestination(location.bucket, location.key)
+	if err != nil {
+		return nil, err
+	}
+
+	return location, nil
 }
 
 func (d *Deflator) Handler(w http.ResponseWriter, r *http.Request) {
-	log.Infof("Received resize request: %s", r.URL)
+	log.Infof("Received %s request from %s: %s", r.Method, d.clientIP(r), describePath(r.URL.Path))
+
+	if d.sessions != nil && r.URL.Query().Get(SessionParameter) != "" {
+		d.sessionUploadHandler(w, r)
+		return
+	}
 
-	if r.Method != http.MethodPost {
+	if r.Method == http.MethodPut && listenerFromContext(r.Context()).PlainPut {
+		d.plainPutHandler(w, r)
+		return
+	}
+
+	if r.Method != http.MethodPost && r.Method != http.MethodHead &&
+		!(r.Method == http.MethodDelete && d.config.EnableDelete) &&
+		!(r.Method == http.MethodGet && d.config.EnableGet) {
 		log.Debugf("Method %q not allowed", r.Method)
-		http.Error(w, "Bad request", http.StatusBadRequest)
+		writeError(w, r, newRequestError(http.StatusBadRequest, ErrorCodeMethodNotAllowed, "Bad request"))
 		return
 	}
 
-	if r.ContentLength > d.config.MaxUploadSize {
+	// The limit for the actual content type gets applied once it's sniffed
+	if limit := d.requestSizeLimit(); r.ContentLength > limit {
 		log.Debugf("File too large (%d bytes)", r.ContentLength)
-		http.Error(w, fmt.Sprintf("File too large (%d bytes)", r.ContentLength), http.StatusRequestEntityTooLarge)
+		writeError(w, r, newRequestError(
+			http.StatusRequestEntityTooLarge, ErrorCodePayloadTooLarge,
+			"File too large (%d bytes, limit: %d bytes)", r.ContentLength, limit,
+		))
 		return
 	}
 
-	if d.config.UrlSigningSecret != "" &&
-		!urlsign.IsValidSignature(
-			d.config.UrlSigningSecret,
-			d.config.SigningBucketSize,
-			d.clock.Now(),
-			r.URL.String(),
-		) {
-		log.Debugf("Invalid URL signature: %s", r.URL)
-		http.Error(w, "Invalid signature", http.StatusBadRequest)
+	location, err := d.resolveDestination(r.Context(), r.URL)
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
 
-	query := r.URL.Query()
-	width := parseUintValue(query.Get("width"), d.config.MaxWidth)
-	height := parseUintValue(query.Get("height"), d.config.MaxHeight)
-	if width == 0 && height == 0 {
-		log.Debugf("Invalid width/height (%q/%q)", query.Get("width"), query.Get("height"))
-		http.Error(
-			w,
-			fmt.Sprintf("Invalid width/height (%q/%q)", query.Get("width"), query.Get("height")),
-			http.StatusBadRequest,
-		)
+	err = d.checkMaintenance(location.bucket)
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
 
-	decodedPath, err := decodePath(r.URL.Path)
+	options, err := d.parseOptions(location.bucket, r.URL.Query(), r.Header)
 	if err != nil {
-		log.Debugf("Failed to extract s3 URL from path %q: %s", r.URL.Path, err)
-		http.Error(w, "Bad request", http.StatusBadRequest)
+		writeError(w, r, err)
 		return
 	}
 
-	s3URL, err := parseS3URL(decodedPath)
+	switch r.Method {
+	case http.MethodGet:
+		d.getHandler(w, r, location, options)
+	case http.MethodHead:
+		// HEAD requests with transform parameters describe the GET response
+		if d.config.EnableGet && options.transform() {
+			d.getHandler(w, r, location, options)
+			return
+		}
+		d.headHandler(w, r, location)
+	case http.MethodDelete:
+		d.deleteHandler(w, r, location, options)
+	default:
+		d.resizeHandler(w, r, location, options)
+	}
+}
+
+// deleteHandler removes the object at location from S3
+func (d *Deflator) deleteHandler(w http.ResponseWriter, r *http.Request, location *s3Location, options *requestOptions) {
+	bucket, key := location.bucket, location.key
+
+	uploader, err := getS3Uploader(r.Context(), bucket, location.regionHint, d.config.DefaultS3Region, d.endpointOptions(bucket))
 	if err != nil {
-		log.Debugf("Failed to extract s3 bucket from URL %q: %s", decodedPath, err)
-		http.Error(w, "Bad request", http.StatusBadRequest)
+		writeError(w, r, uploaderError(bucket, err))
 		return
 	}
 
-	uploader, err := getS3Uploader(r.Context(), s3URL.Host, d.config.DefaultS3Region)
+	if d.config.DeleteCheckExists {
+		_, err := headObject(r.Context(), uploader, bucket, key)
+		if err != nil {
+			switch {
+			case isNotFoundError(err):
+				writeError(w, r, newRequestError(http.StatusNotFound, ErrorCodeNotFound, "Not found"))
+			case isAccessDeniedError(err):
+				writeError(w, r, newRequestError(http.StatusForbidden, ErrorCodeForbidden, "Forbidden"))
+			default:
+				log.Warnf("Failed to check if %q exists: %s", location.logString(), err)
+				writeError(w, r, newRequestError(http.StatusServiceUnavailable, ErrorCodeStorageUnavailable, "Internal error"))
+			}
+			return
+		}
+	}
+
+	if options.soft {
+		d.softDelete(w, r, uploader, location)
+		return
+	}
+
+	deleteReq := uploader.S3.DeleteObjectRequest(&s3.DeleteObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	deleteReq.SetContext(r.Context())
+	output, err := deleteReq.Send()
 	if err != nil {
-		log.Warnf("Failed to get uploader for bucket %q: %s", s3URL.Host, err)
-		http.Error(w, "Bad request", http.StatusBadRequest)
+		if isAccessDeniedError(err) {
+			log.Debugf("Access denied when deleting %q: %s", location.logString(), err)
+			writeError(w, r, newRequestError(http.StatusForbidden, ErrorCodeForbidden, "Forbidden"))
+			return
+		}
+		log.Warnf("Failed to delete %q: %s", location.logString(), err)
+		writeError(w, r, newRequestError(http.StatusServiceUnavailable, ErrorCodeStorageUnavailable, "Internal error"))
 		return
 	}
+	invalidateHeadCache(bucket, key)
 
-	// Set a hard limit for how much we can read from the body
-	r.Body = http.MaxBytesReader(w, r.Body, d.config.MaxUploadSize)
+	auditFields := log.Fields{
+		"bucket":    bucket,
+		"key":       key,
+		"client_ip": d.clientIP(r),
+	}
+	if output.VersionId != nil {
+		auditFields["version_id"] = *output.VersionId
+		w.Header().Set("X-Imgdeflator-Version-Id", *output.VersionId)
+	}
+	audit("delete", auditFields)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// uploadRequestFromOptions creates an uploadRequest for location with the
+// transform options
+func (d *Deflator) uploadRequestFromOptions(location *s3Location, options *requestOptions) (*uploadRequest, error) {
+	if options.width == 0 && options.height == 0 {
+		log.Debugf("Missing width/height (%s)", options.canonical())
+		return nil, newRequestError(http.StatusBadRequest, ErrorCodeInvalidDimensions, "Missing width/height")
+	}
+	// The original of a redacted upload is what redaction must keep private
+	if options.keepOriginal && len(options.redactions) > 0 {
+		return nil, newRequestError(http.StatusBadRequest, ErrorCodeConflictingParameter, "keep_original can't be combined with redact")
+	}
+
+	return &uploadRequest{
+		bucket:       location.bucket,
+		key:          location.key,
+		regionHint:   location.regionHint,
+		width:        options.width,
+		height:       options.height,
+		ttl:          options.ttl,
+		caption:      options.caption(),
+		redactions:   options.redactions,
+		keepOriginal: options.keepOriginal,
+		collision:    options.collision,
+		profile:      options.profile,
+		siblings:     options.siblings,
+
+		responseStyle: options.responseStyle,
+		echoImage:     options.echoImage,
+		skipVerify:    options.skipVerify,
+		stripMetadata: options.stripMetadata,
 
-	// Resize image
-	// Note: vips.ResizeStrategyCrop is needed to produce the exact desired dimensions.
-	// It might be useful to have an option to disable this in certain situations
-	// for performance considerations.
-	imageTransform := vips.NewTransform().Load(r.Body).ResizeStrategy(vips.ResizeStrategyCrop)
+		maxInputBytes:  options.maxInputBytes,
+		maxStoredBytes: options.maxStoredBytes,
+	}, nil
+}
+
+// resizeHandler resizes the image in the request body and uploads it to location
+func (d *Deflator) resizeHandler(w http.ResponseWriter, r *http.Request, location *s3Location, options *requestOptions) {
+	if d.bucketConfig(location.bucket).Passthrough {
+		d.passthroughHandler(w, r, location, options)
+		return
+	}
+	if options.source != nil {
+		d.copyTransformHandler(w, r, location, options)
+		return
+	}
 
-	if width > 0 {
-		imageTransform.ResizeWidth(int(width))
+	req, err := d.uploadRequestFromOptions(location, options)
+	if err != nil {
+		writeError(w, r, err)
+		return
 	}
-	if height > 0 {
-		imageTransform.ResizeHeight(int(height))
+	req.contentType = r.Header.Get("Content-Type")
+	req.clientIP = d.clientIP(r)
+	err = d.applyRegionHeader(r, req)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if headerTemplate := r.Header.Get("X-Key-Template"); headerTemplate != "" && d.config.AllowKeyTemplateHeader {
+		req.keyTemplate, err = parseKeyTemplate(headerTemplate)
+		if err != nil {
+			log.Debugf("Invalid X-Key-Template header: %s", err)
+			writeError(w, r, newRequestError(http.StatusBadRequest, ErrorCodeInvalidKey, "Invalid X-Key-Template header: %s", err))
+			return
+		}
+	}
+
+	// Set a hard limit for how much we can read from the body
+	d.serveUpload(w, r, req, http.MaxBytesReader(w, r.Body, d.maxUploadSizeLimit()), r.ContentLength)
+}
+
+// serveUpload runs req through the upload pipeline with body and writes the
+// JSON result
+func (d *Deflator) serveUpload(w http.ResponseWriter, r *http.Request, req *uploadRequest, body io.Reader, declaredSize int64) {
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	req.progress = newUploadProgress()
+	trackDeadlineProgress(ctx, req.progress)
+	go d.watchProgress(ctx, cancel, req.progress, req.location())
+
+	req.body = req.progress.countRead(ctx, body)
+	req.declaredSize = declaredSize
+	req.echo = d.echoHeaders(r.Header)
+
+	// Trailers have to be declared before the response gets written
+	if progressRequested(r) {
+		w.Header().Set("Trailer", ProgressTrailer)
+		defer func() { w.Header().Set(ProgressTrailer, req.progress.progressTrailer()) }()
 	}
 
-	buf, _, err := imageTransform.Apply()
+	result, err := d.upload(ctx, req)
+	w.Header().Set("Server-Timing", req.progress.serverTiming())
 	if err != nil {
-		log.Warnf("Failed to resize image for URL %q: %s", s3URL.String(), err)
-		http.Error(w, "Internal error", http.StatusServiceUnavailable)
+		switch req.progress.stalled() {
+		case StageRead:
+			err = newRequestError(http.StatusRequestTimeout, ErrorCodeRequestStalled, "Request stalled")
+		case StageUpload:
+			err = newRequestError(http.StatusGatewayTimeout, ErrorCodeUploadStalled, "Upload stalled")
+		}
+		err = shedS3BudgetError(err)
+		d.reportServerError(r, req.bucket, req.key, err)
+		d.recordUploadFailure(r, req, err)
+		writeError(w, r, err)
+		return
+	}
+
+	if result.shadowed {
+		w.Header().Set("X-Imgdeflator-Shadow", "sampled")
+	}
+	if result.ETag != "" {
+		w.Header().Set("ETag", result.ETag)
+	}
+	setWarningHeader(w, result.Warnings)
+
+	if result.image != nil {
+		writeEchoedImage(w, r, result)
 		return
 	}
+	writeUploadResult(w, req.responseStyle, result)
+}
+
+// ResultHeader carries the base64 encoded JSON result of the echo uploads,
+// whose body is the processed image
+const ResultHeader = "X-Imgdeflator-Result"
 
-	_, err = uploader.UploadWithContext(
-		r.Context(),
-		&s3manager.UploadInput{
-			Body:        bytes.NewReader(buf),
-			Bucket:      aws.String(s3URL.Host),
-			ContentType: aws.String(r.Header.Get("Content-Type")),
-			Key:         aws.String(strings.TrimPrefix(s3URL.Path, "/")),
-		},
-	)
+// writeEchoedImage writes the processed image of result, whatever the
+// response style. Once the headers are sent, a failure can only truncate the
+// body, which the client detects with the Content-Length.
+func writeEchoedImage(w http.ResponseWriter, r *http.Request, result *uploadResult) {
+	encoded, err := json.Marshal(result)
 	if err != nil {
-		log.Warnf("Failed to upload %q: %s", s3URL.String(), err)
-		http.Error(w, "Internal error", http.StatusServiceUnavailable)
+		writeError(w, r, newRequestError(http.StatusInternalServerError, ErrorCodeInternal, "Internal error").withCause(err))
 		return
 	}
+
+	w.Header().Set(ResultHeader, base64.StdEncoding.EncodeToString(encoded))
+	w.Header().Set("Content-Type", result.ContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(result.image)))
+	w.WriteHeader(http.StatusOK)
+	n, err := w.Write(result.image)
+	if err != nil {
+		log.Warnf("Failed to send the processed image %q after %d of %d bytes: %s", (&s3Location{bucket: result.Bucket, key: result.Key}).logString(), n, len(result.image), err)
+	}
+}
+
+// writeUploadResult writes the response to a successful upload in the
+// requested style. The legacy style is the original 200 with an empty body.
+func writeUploadResult(w http.ResponseWriter, style string, result *uploadResult) {
+	switch style {
+	case ResponseStyleFull:
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(result)
+	case ResponseStyleEmpty:
+		w.WriteHeader(http.StatusNoContent)
+	case ResponseStyleMinimal:
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(struct {
+			Key string `json:"key"`
+		}{Key: result.Key})
+	case ResponseStyleJSON:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(result)
+	default:
+		w.WriteHeader(http.StatusOK)
+	}
 }
 
-func initGracefulStop() context.Context {
+// initGracefulStop returns a context which gets cancelled on SIGINT or
+// SIGTERM. A second one calls onAbort, and SIGUSR1 calls onDump instead.
+func initGracefulStop(onDump, onAbort func()) context.Context {
 	gracefulStop := make(chan os.Signal, 1)
 	signal.Notify(gracefulStop, syscall.SIGINT, syscall.SIGTERM)
 
+	dump := make(chan os.Signal, 1)
+	signal.Notify(dump, syscall.SIGUSR1)
+
 	ctx, cancel := context.WithCancel(context.Background())
 
 	go func() {
-		sig := <-gracefulStop
-		log.Warnf("Received signal %q. Exiting as soon as possible!", sig)
-		cancel()
+		for {
+			select {
+			case <-dump:
+				onDump()
+			case sig := <-gracefulStop:
+				if ctx.Err() != nil {
+					log.Errorf("Received signal %q again, aborting", sig)
+					onAbort()
+					return
+				}
+				log.Warnf("Received signal %q. Exiting as soon as possible!", sig)
+				cancel()
+			}
+		}
 	}()
 
 	return ctx
@@ -308,12 +1326,18 @@ func healthHandler(response http.ResponseWriter, _ *http.Request) {
 	fmt.Fprint(response, string(message))
 }
 
-// corsHandler sets the appropriate CORS headers in a closure
-// which wraps the specified handler
-func corsHandler(handler http.HandlerFunc) http.HandlerFunc {
+// corsHandler sets the appropriate CORS headers for the specified
+// methods in a closure which wraps the specified handler, unless the
+// listener has CORS disabled
+func corsHandler(methods string, handler http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if listenerFromContext(r.Context()).DisableCORS {
+			handler(w, r)
+			return
+		}
+
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Methods", methods)
 
 		// For OPTIONS requests, we just forward the Access-Control-Request-Headers as
 		// Access-Control-Allow-Headers in the reply and return
@@ -331,6 +1355,75 @@ func corsHandler(handler http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
+// uploadCORSHandler is the corsHandler of the upload route, which also allows
+// PUT on the listeners accepting plain PUT uploads
+func uploadCORSHandler(handler http.HandlerFunc) http.HandlerFunc {
+	withoutPut := corsHandler("GET, POST, HEAD, DELETE, OPTIONS", handler)
+	withPut := corsHandler("GET, POST, PUT, HEAD, DELETE, OPTIONS", handler)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if listenerFromContext(r.Context()).PlainPut {
+			withPut(w, r)
+			return
+		}
+		withoutPut(w, r)
+	}
+}
+
+// runCheckCommand implements the `check` command, which exercises the full
+// pipeline once and exits with a non-zero status if anything fails
+func runCheckCommand(deflator *Deflator, args []string) {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	writeCanary := flags.Bool("write-canary", false, "Upload and delete a canary object in each allowed bucket")
+	allowAnonymous := flags.Bool("allow-anonymous", deflator.config.AllowAnonymous, "Send unsigned requests to S3 when no AWS credentials are found")
+	_ = flags.Parse(args)
+
+	ctx, done := context.WithTimeout(context.Background(), deflator.config.RequestTimeout)
+	results := deflator.selfCheck(ctx, *allowAnonymous, *writeCanary)
+	done()
+
+	printCheckReport(os.Stdout, results)
+
+	vips.Shutdown()
+
+	if checksFailed(results) {
+		os.Exit(1)
+	}
+}
+
+// routes sets up the HTTP handlers shared by all the listeners
+func (d *Deflator) routes() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.Handle("/", d.ipFilterHandler(d.resourceGuardHandler(
+		d.timeoutHandler(uploadCORSHandler(d.recoverHandler(d.Handler))),
+	)))
+	mux.Handle(EnvelopeUploadPath, d.ipFilterHandler(d.resourceGuardHandler(
+		d.timeoutHandler(corsHandler("POST, OPTIONS", d.recoverHandler(d.envelopeHandler))),
+	)))
+	if d.config.EnableTus {
+		mux.Handle(TusPathPrefix, d.ipFilterHandler(d.resourceGuardHandler(
+			d.timeoutHandler(d.TusHandler()),
+		)))
+	}
+	if d.config.EnableUI {
+		d.uiRoutes(mux)
+	}
+	if d.sessions != nil {
+		mux.Handle(SessionsPath, d.ipFilterHandler(http.HandlerFunc(d.sessionsHandler)))
+	}
+	mux.HandleFunc("/health", healthHandler)
+	mux.HandleFunc("/readyz", d.ReadinessHandler)
+	mux.Handle(CapabilitiesPath, d.ipFilterHandler(http.HandlerFunc(d.capabilitiesHandler)))
+
+	// pprof and expvar register themselves on the default mux
+	mux.Handle("/debug/", http.DefaultServeMux)
+
+	if d.config.NormalizePaths {
+		return requestIDHandler(collapseLeadingSlashes(mux))
+	}
+	return requestIDHandler(mux)
+}
+
 func main() {
 	var config Config
 	err := envconfig.Process("imgdeflator", &config)
@@ -339,6 +1432,11 @@ func main() {
 	}
 
 	configureLoggingLevel(&config)
+	log.AddHook(keyRedactionHook{})
+	err = configureLogSampling(&config)
+	if err != nil {
+		log.Fatalf("Invalid log sampling settings: %s", err)
+	}
 
 	rubberneck.Print(&config)
 
@@ -346,26 +1444,115 @@ func main() {
 		log.Warn("No URL signing secret was set. Running in insecure mode!")
 	}
 
-	deflator := NewDeflator(&config)
+	buckets, err := loadBucketConfigs(config.BucketConfigFile)
+	if err != nil {
+		log.Fatalf("Failed to load the bucket config: %s", err)
+	}
+
+	listenerConfigs, err := loadListenerConfigs(config.ListenerConfigFile, config.HTTPPort)
+	if err != nil {
+		log.Fatalf("Failed to load the listener config: %s", err)
+	}
+
+	var hooks []Hook
+	if config.KeyPrefix != "" {
+		hooks = append(hooks, &KeyPrefixHook{Prefix: config.KeyPrefix})
+	}
+
+	deflator, err := NewDeflator(&config, buckets, listenerConfigs, hooks...)
+	if err != nil {
+		log.Fatalf("Failed to initialise: %s", err)
+	}
 	deflator.InitVips()
 
-	// Setup HTTP handlers
-	http.Handle("/", http.TimeoutHandler(corsHandler(deflator.Handler), config.UploadTimeout, "Upload timeout"))
-	http.HandleFunc("/health", healthHandler)
+	err = deflator.checkTextFont()
+	if err != nil {
+		log.Fatalf("Failed to initialise text overlays: %s", err)
+	}
+
+	if config.EnableTus {
+		err = deflator.tus.prepare()
+		if err != nil {
+			log.Fatalf("Failed to prepare the tus upload directory: %s", err)
+		}
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "check" {
+		runCheckCommand(deflator, os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "reprocess" {
+		runReprocessCommand(deflator, os.Args[2:])
+		return
+	}
+
+	flags := flag.NewFlagSet("imgdeflator", flag.ExitOnError)
+	allowAnonymous := flags.Bool("allow-anonymous", config.AllowAnonymous, "Send unsigned requests to S3 when no AWS credentials are found")
+	_ = flags.Parse(os.Args[1:])
+
+	err = initCredentials(*allowAnonymous)
+	if err != nil {
+		log.Fatalf("Failed to resolve the AWS credentials: %s", err)
+	}
+
+	err = deflator.warmUploaders(context.Background())
+	if err != nil {
+		log.Fatalf("Failed to warm up: %s", err)
+	}
+
+	err = deflator.Listen(deflator.routes())
+	if err != nil {
+		log.Fatalf("Failed to start the HTTP server: %s", err)
+	}
 
-	// Start the HTTP server in the background
-	go deflator.ListenAndServe()
+	if config.AdminPort != "" {
+		err = deflator.bind(&ListenerConfig{Addr: ":" + config.AdminPort, Network: "tcp"}, deflator.adminRoutes())
+		if err != nil {
+			deflator.closeListeners()
+			log.Fatalf("Failed to start the admin server: %s", err)
+		}
+	}
+
+	ctx, stop := context.WithCancel(initGracefulStop(deflator.DiagnosticDump, deflator.abort))
+	defer stop()
+
+	go handleReloads(ctx, deflator)
+	if deflator.errorReporter != nil {
+		go deflator.errorReporter.Run()
+	}
+
+	if deflator.grpcServer != nil {
+		err = deflator.ListenGRPC()
+		if err != nil {
+			log.Fatalf("Failed to start the gRPC server: %s", err)
+		}
+	}
+
+	// Start the HTTP servers in the background
+	deflator.Serve()
+
+	if isRestarted() {
+		log.Infof("Serving the inherited listeners (pid %d, parent pid %d)", os.Getpid(), os.Getppid())
+		notifyReady()
+	} else {
+		log.Infof("Serving (pid %d)", os.Getpid())
+	}
+	go handleRestarts(ctx, stop, deflator)
+
+	if deflator.grpcServer != nil {
+		go deflator.ServeGRPC()
+	}
 
-	ctx := initGracefulStop()
+	// The background components get stopped in order on shutdown
+	components := deflator.lifecycle()
+	components.start()
 
 	// Wait for shutdown signal
 	<-ctx.Done()
 
-	// Shutdown server gracefully
-	ctx, done := context.WithTimeout(context.Background(), config.UploadTimeout)
-	defer done()
-	err = deflator.Shutdown(ctx)
+	deflator.drain()
+	_, err = components.shutdown()
 	if err != nil {
-		log.Fatalf("HTTP server exited with error: %s", err)
+		log.Fatalf("Failed to shut down cleanly: %s", err)
 	}
 }
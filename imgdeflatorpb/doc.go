@@ -0,0 +1,4 @@
+// Package imgdeflatorpb contains the gRPC API definition of imgdeflator
+package imgdeflatorpb
+
+//go:generate protoc --go_out=plugins=grpc:. imgdeflator.proto
@@ -0,0 +1,661 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// source: imgdeflator.proto
+
+package imgdeflatorpb
+
+import (
+	context "context"
+	fmt "fmt"
+	proto "github.com/golang/protobuf/proto"
+	grpc "google.golang.org/grpc"
+	math "math"
+)
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = fmt.Errorf
+var _ = math.Inf
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the proto package it is being compiled against.
+// A compilation error at this line likely means your copy of the
+// proto package needs to be updated.
+const _ = proto.ProtoPackageIsVersion3 // please upgrade the proto package
+
+type UploadRequest struct {
+	// Types that are valid to be assigned to Data:
+	//	*UploadRequest_Metadata
+	//	*UploadRequest_Chunk
+	Data                 isUploadRequest_Data `protobuf_oneof:"data"`
+	XXX_NoUnkeyedLiteral struct{}             `json:"-"`
+	XXX_unrecognized     []byte               `json:"-"`
+	XXX_sizecache        int32                `json:"-"`
+}
+
+func (m *UploadRequest) Reset()         { *m = UploadRequest{} }
+func (m *UploadRequest) String() string { return proto.CompactTextString(m) }
+func (*UploadRequest) ProtoMessage()    {}
+func (*UploadRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_7a4d95a73b722953, []int{0}
+}
+
+func (m *UploadRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_UploadRequest.Unmarshal(m, b)
+}
+func (m *UploadRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_UploadRequest.Marshal(b, m, deterministic)
+}
+func (m *UploadRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_UploadRequest.Merge(m, src)
+}
+func (m *UploadRequest) XXX_Size() int {
+	return xxx_messageInfo_UploadRequest.Size(m)
+}
+func (m *UploadRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_UploadRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_UploadRequest proto.InternalMessageInfo
+
+type isUploadRequest_Data interface {
+	isUploadRequest_Data()
+}
+
+type UploadRequest_Metadata struct {
+	Metadata *UploadMetadata `protobuf:"bytes,1,opt,name=metadata,proto3,oneof"`
+}
+
+type UploadRequest_Chunk struct {
+	Chunk []byte `protobuf:"bytes,2,opt,name=chunk,proto3,oneof"`
+}
+
+func (*UploadRequest_Metadata) isUploadRequest_Data() {}
+
+func (*UploadRequest_Chunk) isUploadRequest_Data() {}
+
+func (m *UploadRequest) GetData() isUploadRequest_Data {
+	if m != nil {
+		return m.Data
+	}
+	return nil
+}
+
+func (m *UploadRequest) GetMetadata() *UploadMetadata {
+	if x, ok := m.GetData().(*UploadRequest_Metadata); ok {
+		return x.Metadata
+	}
+	return nil
+}
+
+func (m *UploadRequest) GetChunk() []byte {
+	if x, ok := m.GetData().(*UploadRequest_Chunk); ok {
+		return x.Chunk
+	}
+	return nil
+}
+
+// XXX_OneofWrappers is for the internal use of the proto package.
+func (*UploadRequest) XXX_OneofWrappers() []interface{} {
+	return []interface{}{
+		(*UploadRequest_Metadata)(nil),
+		(*UploadRequest_Chunk)(nil),
+	}
+}
+
+type UploadMetadata struct {
+	Bucket               string            `protobuf:"bytes,1,opt,name=bucket,proto3" json:"bucket,omitempty"`
+	Key                  string            `protobuf:"bytes,2,opt,name=key,proto3" json:"key,omitempty"`
+	ContentType          string            `protobuf:"bytes,3,opt,name=content_type,json=contentType,proto3" json:"content_type,omitempty"`
+	Options              *TransformOptions `protobuf:"bytes,4,opt,name=options,proto3" json:"options,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}          `json:"-"`
+	XXX_unrecognized     []byte            `json:"-"`
+	XXX_sizecache        int32             `json:"-"`
+}
+
+func (m *UploadMetadata) Reset()         { *m = UploadMetadata{} }
+func (m *UploadMetadata) String() string { return proto.CompactTextString(m) }
+func (*UploadMetadata) ProtoMessage()    {}
+func (*UploadMetadata) Descriptor() ([]byte, []int) {
+	return fileDescriptor_7a4d95a73b722953, []int{1}
+}
+
+func (m *UploadMetadata) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_UploadMetadata.Unmarshal(m, b)
+}
+func (m *UploadMetadata) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_UploadMetadata.Marshal(b, m, deterministic)
+}
+func (m *UploadMetadata) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_UploadMetadata.Merge(m, src)
+}
+func (m *UploadMetadata) XXX_Size() int {
+	return xxx_messageInfo_UploadMetadata.Size(m)
+}
+func (m *UploadMetadata) XXX_DiscardUnknown() {
+	xxx_messageInfo_UploadMetadata.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_UploadMetadata proto.InternalMessageInfo
+
+func (m *UploadMetadata) GetBucket() string {
+	if m != nil {
+		return m.Bucket
+	}
+	return ""
+}
+
+func (m *UploadMetadata) GetKey() string {
+	if m != nil {
+		return m.Key
+	}
+	return ""
+}
+
+func (m *UploadMetadata) GetContentType() string {
+	if m != nil {
+		return m.ContentType
+	}
+	return ""
+}
+
+func (m *UploadMetadata) GetOptions() *TransformOptions {
+	if m != nil {
+		return m.Options
+	}
+	return nil
+}
+
+type TransformOptions struct {
+	Width  uint64 `protobuf:"varint,1,opt,name=width,proto3" json:"width,omitempty"`
+	Height uint64 `protobuf:"varint,2,opt,name=height,proto3" json:"height,omitempty"`
+	// ttl in seconds after which the object should expire. Zero means no expiry.
+	Ttl                  uint64   `protobuf:"varint,3,opt,name=ttl,proto3" json:"ttl,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *TransformOptions) Reset()         { *m = TransformOptions{} }
+func (m *TransformOptions) String() string { return proto.CompactTextString(m) }
+func (*TransformOptions) ProtoMessage()    {}
+func (*TransformOptions) Descriptor() ([]byte, []int) {
+	return fileDescriptor_7a4d95a73b722953, []int{2}
+}
+
+func (m *TransformOptions) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_TransformOptions.Unmarshal(m, b)
+}
+func (m *TransformOptions) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_TransformOptions.Marshal(b, m, deterministic)
+}
+func (m *TransformOptions) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_TransformOptions.Merge(m, src)
+}
+func (m *TransformOptions) XXX_Size() int {
+	return xxx_messageInfo_TransformOptions.Size(m)
+}
+func (m *TransformOptions) XXX_DiscardUnknown() {
+	xxx_messageInfo_TransformOptions.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_TransformOptions proto.InternalMessageInfo
+
+func (m *TransformOptions) GetWidth() uint64 {
+	if m != nil {
+		return m.Width
+	}
+	return 0
+}
+
+func (m *TransformOptions) GetHeight() uint64 {
+	if m != nil {
+		return m.Height
+	}
+	return 0
+}
+
+func (m *TransformOptions) GetTtl() uint64 {
+	if m != nil {
+		return m.Ttl
+	}
+	return 0
+}
+
+type UploadResponse struct {
+	Bucket string `protobuf:"bytes,1,opt,name=bucket,proto3" json:"bucket,omitempty"`
+	Key    string `protobuf:"bytes,2,opt,name=key,proto3" json:"key,omitempty"`
+	Size   int64  `protobuf:"varint,3,opt,name=size,proto3" json:"size,omitempty"`
+	// expires_at is an RFC3339 timestamp, empty if the object doesn't expire
+	ExpiresAt            string           `protobuf:"bytes,4,opt,name=expires_at,json=expiresAt,proto3" json:"expires_at,omitempty"`
+	Replicas             []*ReplicaResult `protobuf:"bytes,5,rep,name=replicas,proto3" json:"replicas,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}         `json:"-"`
+	XXX_unrecognized     []byte           `json:"-"`
+	XXX_sizecache        int32            `json:"-"`
+}
+
+func (m *UploadResponse) Reset()         { *m = UploadResponse{} }
+func (m *UploadResponse) String() string { return proto.CompactTextString(m) }
+func (*UploadResponse) ProtoMessage()    {}
+func (*UploadResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_7a4d95a73b722953, []int{3}
+}
+
+func (m *UploadResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_UploadResponse.Unmarshal(m, b)
+}
+func (m *UploadResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_UploadResponse.Marshal(b, m, deterministic)
+}
+func (m *UploadResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_UploadResponse.Merge(m, src)
+}
+func (m *UploadResponse) XXX_Size() int {
+	return xxx_messageInfo_UploadResponse.Size(m)
+}
+func (m *UploadResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_UploadResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_UploadResponse proto.InternalMessageInfo
+
+func (m *UploadResponse) GetBucket() string {
+	if m != nil {
+		return m.Bucket
+	}
+	return ""
+}
+
+func (m *UploadResponse) GetKey() string {
+	if m != nil {
+		return m.Key
+	}
+	return ""
+}
+
+func (m *UploadResponse) GetSize() int64 {
+	if m != nil {
+		return m.Size
+	}
+	return 0
+}
+
+func (m *UploadResponse) GetExpiresAt() string {
+	if m != nil {
+		return m.ExpiresAt
+	}
+	return ""
+}
+
+func (m *UploadResponse) GetReplicas() []*ReplicaResult {
+	if m != nil {
+		return m.Replicas
+	}
+	return nil
+}
+
+type ReplicaResult struct {
+	Bucket               string   `protobuf:"bytes,1,opt,name=bucket,proto3" json:"bucket,omitempty"`
+	Status               string   `protobuf:"bytes,2,opt,name=status,proto3" json:"status,omitempty"`
+	Error                string   `protobuf:"bytes,3,opt,name=error,proto3" json:"error,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *ReplicaResult) Reset()         { *m = ReplicaResult{} }
+func (m *ReplicaResult) String() string { return proto.CompactTextString(m) }
+func (*ReplicaResult) ProtoMessage()    {}
+func (*ReplicaResult) Descriptor() ([]byte, []int) {
+	return fileDescriptor_7a4d95a73b722953, []int{4}
+}
+
+func (m *ReplicaResult) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ReplicaResult.Unmarshal(m, b)
+}
+func (m *ReplicaResult) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ReplicaResult.Marshal(b, m, deterministic)
+}
+func (m *ReplicaResult) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ReplicaResult.Merge(m, src)
+}
+func (m *ReplicaResult) XXX_Size() int {
+	return xxx_messageInfo_ReplicaResult.Size(m)
+}
+func (m *ReplicaResult) XXX_DiscardUnknown() {
+	xxx_messageInfo_ReplicaResult.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ReplicaResult proto.InternalMessageInfo
+
+func (m *ReplicaResult) GetBucket() string {
+	if m != nil {
+		return m.Bucket
+	}
+	return ""
+}
+
+func (m *ReplicaResult) GetStatus() string {
+	if m != nil {
+		return m.Status
+	}
+	return ""
+}
+
+func (m *ReplicaResult) GetError() string {
+	if m != nil {
+		return m.Error
+	}
+	return ""
+}
+
+type InspectRequest struct {
+	Bucket               string   `protobuf:"bytes,1,opt,name=bucket,proto3" json:"bucket,omitempty"`
+	Key                  string   `protobuf:"bytes,2,opt,name=key,proto3" json:"key,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *InspectRequest) Reset()         { *m = InspectRequest{} }
+func (m *InspectRequest) String() string { return proto.CompactTextString(m) }
+func (*InspectRequest) ProtoMessage()    {}
+func (*InspectRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_7a4d95a73b722953, []int{5}
+}
+
+func (m *InspectRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_InspectRequest.Unmarshal(m, b)
+}
+func (m *InspectRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_InspectRequest.Marshal(b, m, deterministic)
+}
+func (m *InspectRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_InspectRequest.Merge(m, src)
+}
+func (m *InspectRequest) XXX_Size() int {
+	return xxx_messageInfo_InspectRequest.Size(m)
+}
+func (m *InspectRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_InspectRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_InspectRequest proto.InternalMessageInfo
+
+func (m *InspectRequest) GetBucket() string {
+	if m != nil {
+		return m.Bucket
+	}
+	return ""
+}
+
+func (m *InspectRequest) GetKey() string {
+	if m != nil {
+		return m.Key
+	}
+	return ""
+}
+
+type InspectResponse struct {
+	Exists        bool   `protobuf:"varint,1,opt,name=exists,proto3" json:"exists,omitempty"`
+	ContentLength int64  `protobuf:"varint,2,opt,name=content_length,json=contentLength,proto3" json:"content_length,omitempty"`
+	ContentType   string `protobuf:"bytes,3,opt,name=content_type,json=contentType,proto3" json:"content_type,omitempty"`
+	Etag          string `protobuf:"bytes,4,opt,name=etag,proto3" json:"etag,omitempty"`
+	// last_modified is an RFC3339 timestamp
+	LastModified         string   `protobuf:"bytes,5,opt,name=last_modified,json=lastModified,proto3" json:"last_modified,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *InspectResponse) Reset()         { *m = InspectResponse{} }
+func (m *InspectResponse) String() string { return proto.CompactTextString(m) }
+func (*InspectResponse) ProtoMessage()    {}
+func (*InspectResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_7a4d95a73b722953, []int{6}
+}
+
+func (m *InspectResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_InspectResponse.Unmarshal(m, b)
+}
+func (m *InspectResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_InspectResponse.Marshal(b, m, deterministic)
+}
+func (m *InspectResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_InspectResponse.Merge(m, src)
+}
+func (m *InspectResponse) XXX_Size() int {
+	return xxx_messageInfo_InspectResponse.Size(m)
+}
+func (m *InspectResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_InspectResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_InspectResponse proto.InternalMessageInfo
+
+func (m *InspectResponse) GetExists() bool {
+	if m != nil {
+		return m.Exists
+	}
+	return false
+}
+
+func (m *InspectResponse) GetContentLength() int64 {
+	if m != nil {
+		return m.ContentLength
+	}
+	return 0
+}
+
+func (m *InspectResponse) GetContentType() string {
+	if m != nil {
+		return m.ContentType
+	}
+	return ""
+}
+
+func (m *InspectResponse) GetEtag() string {
+	if m != nil {
+		return m.Etag
+	}
+	return ""
+}
+
+func (m *InspectResponse) GetLastModified() string {
+	if m != nil {
+		return m.LastModified
+	}
+	return ""
+}
+
+func init() {
+	proto.RegisterType((*UploadRequest)(nil), "imgdeflator.UploadRequest")
+	proto.RegisterType((*UploadMetadata)(nil), "imgdeflator.UploadMetadata")
+	proto.RegisterType((*TransformOptions)(nil), "imgdeflator.TransformOptions")
+	proto.RegisterType((*UploadResponse)(nil), "imgdeflator.UploadResponse")
+	proto.RegisterType((*ReplicaResult)(nil), "imgdeflator.ReplicaResult")
+	proto.RegisterType((*InspectRequest)(nil), "imgdeflator.InspectRequest")
+	proto.RegisterType((*InspectResponse)(nil), "imgdeflator.InspectResponse")
+}
+
+func init() { proto.RegisterFile("imgdeflator.proto", fileDescriptor_7a4d95a73b722953) }
+
+var fileDescriptor_7a4d95a73b722953 = []byte{
+	// 496 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x94, 0x53, 0x4f, 0x6f, 0xd3, 0x4e,
+	0x10, 0xad, 0x7f, 0x71, 0xd2, 0x64, 0xf2, 0xa7, 0xfd, 0xad, 0x50, 0x64, 0xa5, 0x54, 0x0a, 0x46,
+	0x48, 0x39, 0xf5, 0x10, 0x24, 0x10, 0xdc, 0x28, 0x3d, 0x14, 0x89, 0x0a, 0x69, 0xd5, 0x5e, 0xb8,
+	0x44, 0x9b, 0x78, 0x92, 0x2c, 0x71, 0xbc, 0x8b, 0x77, 0x2c, 0x1a, 0xbe, 0x07, 0x7c, 0x03, 0x6e,
+	0x7c, 0x48, 0xe4, 0xdd, 0x4d, 0x88, 0x51, 0x90, 0xca, 0x6d, 0xe6, 0xbd, 0xb7, 0xe3, 0xf7, 0xc6,
+	0xbb, 0xf0, 0xbf, 0x5c, 0x2f, 0x12, 0x9c, 0xa7, 0x82, 0x54, 0x7e, 0xa1, 0x73, 0x45, 0x8a, 0xb5,
+	0xf7, 0xa0, 0xf8, 0x13, 0x74, 0xef, 0x74, 0xaa, 0x44, 0xc2, 0xf1, 0x73, 0x81, 0x86, 0xd8, 0x2b,
+	0x68, 0xae, 0x91, 0x44, 0x22, 0x48, 0x44, 0xc1, 0x30, 0x18, 0xb5, 0xc7, 0x67, 0x17, 0xfb, 0x33,
+	0x9c, 0xfa, 0xc6, 0x4b, 0xae, 0x8f, 0xf8, 0x4e, 0xce, 0xfa, 0x50, 0x9f, 0x2d, 0x8b, 0x6c, 0x15,
+	0xfd, 0x37, 0x0c, 0x46, 0x9d, 0xeb, 0x23, 0xee, 0xda, 0xcb, 0x06, 0x84, 0x25, 0x1f, 0x7f, 0x0f,
+	0xa0, 0x57, 0x3d, 0xce, 0xfa, 0xd0, 0x98, 0x16, 0xb3, 0x15, 0x92, 0xfd, 0x56, 0x8b, 0xfb, 0x8e,
+	0x9d, 0x42, 0x6d, 0x85, 0x1b, 0x3b, 0xa8, 0xc5, 0xcb, 0x92, 0x3d, 0x81, 0xce, 0x4c, 0x65, 0x84,
+	0x19, 0x4d, 0x68, 0xa3, 0x31, 0xaa, 0x59, 0xaa, 0xed, 0xb1, 0xdb, 0x8d, 0x46, 0xf6, 0x12, 0x8e,
+	0x95, 0x26, 0xa9, 0x32, 0x13, 0x85, 0xd6, 0xf9, 0x79, 0xc5, 0xf9, 0x6d, 0x2e, 0x32, 0x33, 0x57,
+	0xf9, 0xfa, 0x83, 0x13, 0xf1, 0xad, 0x3a, 0xe6, 0x70, 0xfa, 0x27, 0xc9, 0x1e, 0x41, 0xfd, 0x8b,
+	0x4c, 0x68, 0x69, 0x8d, 0x85, 0xdc, 0x35, 0xa5, 0xdf, 0x25, 0xca, 0xc5, 0x92, 0xac, 0xb5, 0x90,
+	0xfb, 0xae, 0xf4, 0x4b, 0x94, 0x5a, 0x53, 0x21, 0x2f, 0xcb, 0xf8, 0xc7, 0x2e, 0x2c, 0x47, 0xa3,
+	0x55, 0x66, 0xf0, 0x1f, 0xc2, 0x32, 0x08, 0x8d, 0xfc, 0xea, 0x42, 0xd6, 0xb8, 0xad, 0xd9, 0x39,
+	0x00, 0xde, 0x6b, 0x99, 0xa3, 0x99, 0x08, 0xb2, 0x01, 0x5b, 0xbc, 0xe5, 0x91, 0x37, 0xc4, 0x5e,
+	0x40, 0x33, 0x47, 0x9d, 0xca, 0x99, 0x30, 0x51, 0x7d, 0x58, 0x1b, 0xb5, 0xc7, 0x83, 0x4a, 0x7a,
+	0xee, 0x48, 0x8e, 0xa6, 0x48, 0x89, 0xef, 0xb4, 0xf1, 0x1d, 0x74, 0x2b, 0xd4, 0x5f, 0x5d, 0xf6,
+	0xa1, 0x61, 0x48, 0x50, 0x61, 0xbc, 0x51, 0xdf, 0x95, 0x8b, 0xc2, 0x3c, 0x57, 0xb9, 0xff, 0x23,
+	0xae, 0x89, 0x5f, 0x43, 0xef, 0x5d, 0x66, 0x34, 0xce, 0x68, 0x7b, 0xb1, 0x1e, 0x9c, 0x3e, 0xfe,
+	0x19, 0xc0, 0xc9, 0xee, 0xf0, 0xef, 0xdd, 0xe1, 0xbd, 0x34, 0x64, 0xec, 0xe9, 0x26, 0xf7, 0x1d,
+	0x7b, 0x06, 0xbd, 0xed, 0xb5, 0x48, 0x31, 0x5b, 0xd0, 0xd2, 0x0e, 0xaa, 0xf1, 0xae, 0x47, 0xdf,
+	0x5b, 0xf0, 0x21, 0xb7, 0x87, 0x41, 0x88, 0x24, 0x16, 0x7e, 0xb3, 0xb6, 0x66, 0x4f, 0xa1, 0x9b,
+	0x0a, 0x43, 0x93, 0xb5, 0x4a, 0xe4, 0x5c, 0x62, 0x12, 0xd5, 0x2d, 0xd9, 0x29, 0xc1, 0x1b, 0x8f,
+	0x8d, 0xbf, 0x05, 0xd0, 0xbc, 0xf2, 0x6b, 0x66, 0x6f, 0xa1, 0xe1, 0xfe, 0x3a, 0x1b, 0x1c, 0x78,
+	0x36, 0x7e, 0x17, 0x83, 0xb3, 0x83, 0x9c, 0x8b, 0x3a, 0x0a, 0xd8, 0x15, 0x1c, 0xfb, 0xfc, 0xac,
+	0xaa, 0xac, 0xae, 0x74, 0xf0, 0xf8, 0x30, 0xe9, 0xe6, 0x5c, 0x9e, 0x7c, 0xec, 0xee, 0xd1, 0x7a,
+	0x3a, 0x6d, 0xd8, 0xf7, 0xff, 0xfc, 0xd7, 0x00, 0x72, 0x61, 0xb2, 0xe7, 0x14, 0x04, 0x00, 0x00,
+}
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ context.Context
+var _ grpc.ClientConn
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+const _ = grpc.SupportPackageIsVersion4
+
+// DeflatorClient is the client API for Deflator service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://godoc.org/google.golang.org/grpc#ClientConn.NewStream.
+type DeflatorClient interface {
+	// Upload resizes the streamed image and stores it in S3. The first message
+	// must carry the metadata and all the following ones the image bytes.
+	Upload(ctx context.Context, opts ...grpc.CallOption) (Deflator_UploadClient, error)
+	// Inspect returns the metadata of a stored object
+	Inspect(ctx context.Context, in *InspectRequest, opts ...grpc.CallOption) (*InspectResponse, error)
+}
+
+type deflatorClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewDeflatorClient(cc *grpc.ClientConn) DeflatorClient {
+	return &deflatorClient{cc}
+}
+
+func (c *deflatorClient) Upload(ctx context.Context, opts ...grpc.CallOption) (Deflator_UploadClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_Deflator_serviceDesc.Streams[0], "/imgdeflator.Deflator/Upload", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &deflatorUploadClient{stream}
+	return x, nil
+}
+
+type Deflator_UploadClient interface {
+	Send(*UploadRequest) error
+	CloseAndRecv() (*UploadResponse, error)
+	grpc.ClientStream
+}
+
+type deflatorUploadClient struct {
+	grpc.ClientStream
+}
+
+func (x *deflatorUploadClient) Send(m *UploadRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *deflatorUploadClient) CloseAndRecv() (*UploadResponse, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(UploadResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *deflatorClient) Inspect(ctx context.Context, in *InspectRequest, opts ...grpc.CallOption) (*InspectResponse, error) {
+	out := new(InspectResponse)
+	err := c.cc.Invoke(ctx, "/imgdeflator.Deflator/Inspect", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// DeflatorServer is the server API for Deflator service.
+type DeflatorServer interface {
+	// Upload resizes the streamed image and stores it in S3. The first message
+	// must carry the metadata and all the following ones the image bytes.
+	Upload(Deflator_UploadServer) error
+	// Inspect returns the metadata of a stored object
+	Inspect(context.Context, *InspectRequest) (*InspectResponse, error)
+}
+
+func RegisterDeflatorServer(s *grpc.Server, srv DeflatorServer) {
+	s.RegisterService(&_Deflator_serviceDesc, srv)
+}
+
+func _Deflator_Upload_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(DeflatorServer).Upload(&deflatorUploadServer{stream})
+}
+
+type Deflator_UploadServer interface {
+	SendAndClose(*UploadResponse) error
+	Recv() (*UploadRequest, error)
+	grpc.ServerStream
+}
+
+type deflatorUploadServer struct {
+	grpc.ServerStream
+}
+
+func (x *deflatorUploadServer) SendAndClose(m *UploadResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *deflatorUploadServer) Recv() (*UploadRequest, error) {
+	m := new(UploadRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _Deflator_Inspect_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(InspectRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DeflatorServer).Inspect(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/imgdeflator.Deflator/Inspect",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DeflatorServer).Inspect(ctx, req.(*InspectRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+var _Deflator_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "imgdeflator.Deflator",
+	HandlerType: (*DeflatorServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Inspect",
+			Handler:    _Deflator_Inspect_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Upload",
+			Handler:       _Deflator_Upload_Handler,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "imgdeflator.proto",
+}
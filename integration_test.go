@@ -0,0 +1,512 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Nitro/imgdeflator/fakes3"
+	"github.com/Nitro/urlsign"
+	"github.com/davidbyttow/govips/pkg/vips"
+	"github.com/relistan/envconfig"
+	log "github.com/sirupsen/logrus"
+)
+
+// TestBucket is created in the fakes3 server of every testServer
+const TestBucket = "test-bucket"
+
+func TestMain(m *testing.M) {
+	// fakes3 doesn't check the signatures, but the requests have to be signed
+	os.Setenv("AWS_ACCESS_KEY_ID", "test")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	os.Setenv("AWS_CONFIG_FILE", os.DevNull)
+	os.Setenv("AWS_SHARED_CREDENTIALS_FILE", os.DevNull)
+	// Nor should the tests without credentials wait for the instance metadata
+	os.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	// The tests check the warnings they expect with hooks
+	log.SetLevel(log.WarnLevel)
+	log.SetOutput(ioutil.Discard)
+
+	vips.Startup(&vips.Config{MaxCacheFiles: 1, MaxCacheSize: 1, MaxCacheMem: 1})
+	if os.Getenv(restartedTestEnv) != "" {
+		// The test binary got restarted by TestRestartHandoff
+		code := runRestartedTest()
+		vips.Shutdown()
+		os.Exit(code)
+	}
+	if os.Getenv(abortTestEnv) != "" {
+		// The test binary got started by TestAbortShutdown
+		code := runAbortTest()
+		vips.Shutdown()
+		os.Exit(code)
+	}
+	code := m.Run()
+	vips.Shutdown()
+	os.Exit(code)
+}
+
+// testServer is a Deflator storing to an in-memory S3 server, serving its
+// routes over HTTP
+type testServer struct {
+	t        *testing.T
+	fake     *fakes3.Server
+	s3       *httptest.Server
+	deflator *Deflator
+	server   *httptest.Server
+}
+
+// testConfig returns the default config, with a custom S3 endpoint
+func testConfig(t *testing.T, endpoint string) *Config {
+	config, err := loadTestConfig(endpoint)
+	if err != nil {
+		t.Fatalf("Failed to load the default config: %s", err)
+	}
+	return config
+}
+
+// loadTestConfig loads the config of testConfig, outside of a test
+func loadTestConfig(endpoint string) (*Config, error) {
+	var config Config
+	err := envconfig.Process("imgdeflator_test", &config)
+	if err != nil {
+		return nil, err
+	}
+	config.S3Endpoint = endpoint
+	config.DefaultS3Region = fakes3.DefaultRegion
+	config.RegionCacheDisabled = true
+	config.RegionLookupAttempts = 1
+	config.TusDir = ""
+	// The tests check the upload results
+	config.ResponseStyle = ResponseStyleFull
+	return &config, nil
+}
+
+// newTestServer starts a Deflator against a new fakes3 server with the
+// TestBucket. configure can change the config before the Deflator gets
+// created.
+func newTestServer(t *testing.T, configure func(config *Config)) *testServer {
+	fake := fakes3.New()
+	fake.CreateBucket(TestBucket, "")
+	s3Server := httptest.NewServer(fake)
+
+	config := testConfig(t, s3Server.URL)
+	if configure != nil {
+		configure(config)
+	}
+
+	deflator, err := NewDeflator(config, nil, nil)
+	if err != nil {
+		s3Server.Close()
+		t.Fatalf("Failed to create the Deflator: %s", err)
+	}
+	err = initCredentials(false)
+	if err != nil {
+		s3Server.Close()
+		t.Fatalf("Failed to resolve the test credentials: %s", err)
+	}
+
+	return &testServer{
+		t:        t,
+		fake:     fake,
+		s3:       s3Server,
+		deflator: deflator,
+		server:   httptest.NewServer(deflator.routes()),
+	}
+}
+
+func (s *testServer) close() {
+	s.server.Close()
+	s.s3.Close()
+}
+
+// uploadURL returns the signed URL of an upload to bucket and key with the
+// query parameters
+func (s *testServer) uploadURL(bucket, key, query string) string {
+	return s.server.URL + s.uploadPath(bucket, key, query)
+}
+
+// uploadPath returns the signed relative URL of an upload, like uploadURL
+func (s *testServer) uploadPath(bucket, key, query string) string {
+	return s.destinationPath("s3://"+bucket+"/"+key, query)
+}
+
+// destinationPath returns the signed relative URL of an upload to any of the
+// accepted destination formats
+func (s *testServer) destinationPath(destination, query string) string {
+	path := "/" + base64.RawURLEncoding.EncodeToString([]byte(destination))
+	if query != "" {
+		path += "?" + query
+	}
+
+	config := s.deflator.config
+	if config.UrlSigningSecret != "" {
+		// The signature covers the sorted parameters
+		signed := path
+		if query != "" {
+			params := strings.Split(query, "&")
+			sort.Strings(params)
+			signed = path[:len(path)-len(query)] + strings.Join(params, "&")
+		}
+		token := urlsign.GenerateToken(config.UrlSigningSecret, config.SigningBucketSize, s.deflator.clock.Now(), signed)
+		if query == "" {
+			path += "?token=" + token
+		} else {
+			path += "&token=" + token
+		}
+	}
+
+	return path
+}
+
+// post sends body to the upload URL of key in the TestBucket
+func (s *testServer) post(key, query string, body io.Reader) *http.Response {
+	resp, err := http.Post(s.uploadURL(TestBucket, key, query), "image/png", body)
+	if err != nil {
+		s.t.Fatalf("Failed to send the upload of %q: %s", key, err)
+	}
+	return resp
+}
+
+// testPNG encodes a width x height PNG
+func testPNG(t *testing.T, width, height int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		for y := 0; y < height; y++ {
+			img.Set(x, y, color.RGBA{R: uint8(x * y), G: uint8(x ^ y), B: uint8(x*x + y), A: 255})
+		}
+	}
+
+	var buf bytes.Buffer
+	err := png.Encode(&buf, img)
+	if err != nil {
+		t.Fatalf("Failed to encode the test image: %s", err)
+	}
+	return buf.Bytes()
+}
+
+// decodeError reads the JSON error of resp, checking its status
+func decodeError(t *testing.T, resp *http.Response, status int) *errorResponse {
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != status {
+		t.Fatalf("Expected status %d, got %d: %s", status, resp.StatusCode, body)
+	}
+
+	var response errorResponse
+	err := json.Unmarshal(body, &response)
+	if err != nil {
+		t.Fatalf("Failed to decode the error response %q: %s", body, err)
+	}
+	return &response
+}
+
+// waitIdle waits until the Deflator has no in-flight uploads left
+func waitIdle(t *testing.T, d *Deflator) {
+	deadline := time.Now().Add(5 * time.Second)
+	for d.inflightRequests() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Still %d in-flight requests", d.inflightRequests())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestUploadSuccess(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.close()
+
+	resp := s.post("images/photo.png", "width=16", bytes.NewReader(testPNG(t, 64, 32)))
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", resp.StatusCode, body)
+	}
+
+	var result uploadResult
+	err := json.Unmarshal(body, &result)
+	if err != nil {
+		t.Fatalf("Failed to decode the upload result %q: %s", body, err)
+	}
+	if result.Bucket != TestBucket || result.Key != "images/photo.png" {
+		t.Errorf("Expected the upload to %s/images/photo.png, got %s/%s", TestBucket, result.Bucket, result.Key)
+	}
+
+	object, ok := s.fake.Object(TestBucket, "images/photo.png")
+	if !ok {
+		t.Fatalf("The processed image wasn't stored, keys: %v", s.fake.Keys(TestBucket))
+	}
+	img, _, err := image.Decode(bytes.NewReader(object.Body))
+	if err != nil {
+		t.Fatalf("Failed to decode the stored image: %s", err)
+	}
+	if bounds := img.Bounds(); bounds.Dx() != 16 || bounds.Dy() != 8 {
+		t.Errorf("Expected a 16x8 image, got %dx%d", bounds.Dx(), bounds.Dy())
+	}
+}
+
+func TestUploadDefaultResponse(t *testing.T) {
+	var defaults Config
+	err := envconfig.Process("imgdeflator_test", &defaults)
+	if err != nil || defaults.ResponseStyle != ResponseStyleLegacy {
+		t.Fatalf("Expected the %s response style by default, got %q (%v)", ResponseStyleLegacy, defaults.ResponseStyle, err)
+	}
+	s := newTestServer(t, func(config *Config) {
+		config.ResponseStyle = defaults.ResponseStyle
+	})
+	defer s.close()
+
+	// The original response, which legacy callers depend on
+	resp := s.post("photo.png", "width=16", bytes.NewReader(testPNG(t, 32, 32)))
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(body, []byte{}) {
+		t.Errorf("Expected a 200 with an empty body, got %d: %q", resp.StatusCode, body)
+	}
+	if resp.ContentLength != 0 || resp.Header.Get("Content-Type") != "" {
+		t.Errorf("Expected no content, got the length %d and the type %q", resp.ContentLength, resp.Header.Get("Content-Type"))
+	}
+	if _, ok := s.fake.Object(TestBucket, "photo.png"); !ok {
+		t.Errorf("Expected the upload to be stored")
+	}
+}
+
+func TestUploadSizeLimit(t *testing.T) {
+	s := newTestServer(t, func(config *Config) {
+		config.MaxUploadSize = 1024
+	})
+	defer s.close()
+
+	data := testPNG(t, 128, 128)
+	if len(data) <= 1024 {
+		t.Fatalf("The test image is too small: %d bytes", len(data))
+	}
+
+	t.Run("declared", func(t *testing.T) {
+		resp := s.post("declared.png", "width=16", bytes.NewReader(data))
+		if code := decodeError(t, resp, http.StatusRequestEntityTooLarge).Code; code != ErrorCodePayloadTooLarge {
+			t.Errorf("Expected the %s code, got %s", ErrorCodePayloadTooLarge, code)
+		}
+	})
+
+	t.Run("chunked", func(t *testing.T) {
+		// Without a Content-Length, the body gets cut at the limit
+		resp := s.post("chunked.png", "width=16", struct{ io.Reader }{bytes.NewReader(data)})
+		if code := decodeError(t, resp, http.StatusRequestEntityTooLarge).Code; code != ErrorCodePayloadTooLarge {
+			t.Errorf("Expected the %s code, got %s", ErrorCodePayloadTooLarge, code)
+		}
+	})
+
+	if keys := s.fake.Keys(TestBucket); len(keys) != 0 {
+		t.Errorf("Expected no stored objects, got %v", keys)
+	}
+}
+
+func TestUploadBadBase64(t *testing.T) {
+	s := newTestServer(t, func(config *Config) {
+		config.UrlSigningSecret = ""
+	})
+	defer s.close()
+
+	resp, err := http.Post(s.server.URL+"/not*base64!?width=16", "image/png", bytes.NewReader(testPNG(t, 8, 8)))
+	if err != nil {
+		t.Fatalf("Failed to send the upload: %s", err)
+	}
+	if code := decodeError(t, resp, http.StatusBadRequest).Code; code != ErrorCodeInvalidPath {
+		t.Errorf("Expected the %s code, got %s", ErrorCodeInvalidPath, code)
+	}
+	if requests := s.fake.Requests(); requests != 0 {
+		t.Errorf("Expected no S3 requests, got %d", requests)
+	}
+}
+
+func TestUploadUnknownBucket(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.close()
+
+	resp, err := http.Post(s.uploadURL("missing-bucket", "photo.png", "width=16"), "image/png", bytes.NewReader(testPNG(t, 8, 8)))
+	if err != nil {
+		t.Fatalf("Failed to send the upload: %s", err)
+	}
+	if code := decodeError(t, resp, http.StatusNotFound).Code; code != ErrorCodeNotFound {
+		t.Errorf("Expected the %s code, got %s", ErrorCodeNotFound, code)
+	}
+}
+
+func TestUploadStorageErrors(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.close()
+
+	// The bucket region gets looked up before any object is written
+	s.fake.SetFault(func(r *http.Request) int {
+		if r.Method == http.MethodPut || r.Method == http.MethodPost {
+			return http.StatusInternalServerError
+		}
+		return 0
+	})
+
+	resp := s.post("photo.png", "width=16", bytes.NewReader(testPNG(t, 32, 32)))
+	response := decodeError(t, resp, http.StatusServiceUnavailable)
+	if response.Code != ErrorCodeStorageUnavailable {
+		t.Errorf("Expected the %s code, got %s", ErrorCodeStorageUnavailable, response.Code)
+	}
+	if !response.Retryable {
+		t.Errorf("Expected a retryable error")
+	}
+	if keys := s.fake.Keys(TestBucket); len(keys) != 0 {
+		t.Errorf("Expected no stored objects, got %v", keys)
+	}
+}
+
+// blockingReader returns its data, then blocks until it's closed
+type blockingReader struct {
+	data   io.Reader
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (r *blockingReader) Read(p []byte) (int, error) {
+	n, err := r.data.Read(p)
+	if err != io.EOF {
+		return n, err
+	}
+	<-r.closed
+	return 0, io.ErrUnexpectedEOF
+}
+
+func (r *blockingReader) Close() error {
+	r.once.Do(func() { close(r.closed) })
+	return nil
+}
+
+func TestUploadClientDisconnect(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.close()
+
+	data := testPNG(t, 32, 32)
+	body := &blockingReader{data: bytes.NewReader(data[:len(data)/2]), closed: make(chan struct{})}
+	defer body.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r, err := http.NewRequest(http.MethodPost, s.uploadURL(TestBucket, "photo.png", "width=16"), body)
+	if err != nil {
+		t.Fatalf("Failed to create the request: %s", err)
+	}
+	r.ContentLength = int64(len(data))
+	r = r.WithContext(ctx)
+
+	errs := make(chan error, 1)
+	go func() {
+		resp, err := http.DefaultClient.Do(r)
+		if err == nil {
+			resp.Body.Close()
+		}
+		errs <- err
+	}()
+
+	// Disconnect once the upload is being read
+	deadline := time.Now().Add(5 * time.Second)
+	for s.deflator.inflightRequests() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("The upload never started")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	// The transport waits for the body to stop being read
+	body.Close()
+
+	if err := <-errs; err == nil {
+		t.Fatalf("Expected the request to fail")
+	}
+	waitIdle(t, s.deflator)
+	if keys := s.fake.Keys(TestBucket); len(keys) != 0 {
+		t.Errorf("Expected no stored objects, got %v", keys)
+	}
+}
+
+func TestShutdownDrainsUploads(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.close()
+
+	// The processed image upload blocks until released
+	started, release := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	s.fake.SetFault(func(r *http.Request) int {
+		if r.Method == http.MethodPut {
+			once.Do(func() { close(started) })
+			<-release
+		}
+		return 0
+	})
+
+	d := s.deflator
+	baseURL := s.listen(&ListenerConfig{})
+	uploadURL := baseURL + s.uploadPath(TestBucket, "photo.png", "width=16")
+
+	responses := make(chan *http.Response, 1)
+	go func() {
+		resp, err := http.Post(uploadURL, "image/png", bytes.NewReader(testPNG(t, 32, 32)))
+		if err != nil {
+			t.Errorf("The in-flight upload failed: %s", err)
+			close(responses)
+			return
+		}
+		responses <- resp
+	}()
+
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("The upload never reached S3")
+	}
+
+	d.drain()
+	resp, err := http.Get(baseURL + "/readyz")
+	if err != nil {
+		t.Fatalf("Failed to check the readiness: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected the readiness check to fail while draining, got %d", resp.StatusCode)
+	}
+
+	stopped := make(chan error, 1)
+	go func() { stopped <- d.shutdownListeners(context.Background()) }()
+
+	select {
+	case err := <-stopped:
+		t.Fatalf("The listeners stopped before the upload finished: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+
+	resp, ok := <-responses
+	if !ok {
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected the in-flight upload to succeed, got %d", resp.StatusCode)
+	}
+	if err := <-stopped; err != nil {
+		t.Errorf("Failed to shut down: %s", err)
+	}
+	if _, ok := s.fake.Object(TestBucket, "photo.png"); !ok {
+		t.Errorf("The drained upload wasn't stored")
+	}
+}
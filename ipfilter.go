@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// ipFilter holds the parsed IP allowlist and denylist
+type ipFilter struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// loadCIDRFile reads a file containing one CIDR (or IP address) per line.
+// Empty lines and lines starting with `#` are ignored.
+func loadCIDRFile(path string) ([]*net.IPNet, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var cidrs []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		cidrs = append(cidrs, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return parseCIDRs(cidrs)
+}
+
+// loadIPFilter reads the configured allowlist and denylist files
+func loadIPFilter(config *Config) (*ipFilter, error) {
+	allow, err := loadCIDRFile(config.IPAllowlistFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the IP allowlist: %s", err)
+	}
+
+	deny, err := loadCIDRFile(config.IPDenylistFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the IP denylist: %s", err)
+	}
+
+	return &ipFilter{allow: allow, deny: deny}, nil
+}
+
+// blockedBy returns the name of the list which blocks ip or an empty string
+// if ip is allowed. The denylist takes precedence and an empty allowlist
+// allows everything.
+func (f *ipFilter) blockedBy(ip net.IP) string {
+	if ip == nil {
+		return "allow"
+	}
+
+	if containsIP(f.deny, ip) {
+		return "deny"
+	}
+
+	if len(f.allow) > 0 && !containsIP(f.allow, ip) {
+		return "allow"
+	}
+
+	return ""
+}
+
+// isBlocked checks the client IP against the current IP filter and counts the
+// blocked requests
+func (d *Deflator) isBlocked(clientIP string) bool {
+	filter := d.ipFilter.Load().(*ipFilter)
+
+	list := filter.blockedBy(net.ParseIP(clientIP))
+	if list == "" {
+		return false
+	}
+
+	log.Debugf("Client %s blocked by the IP %slist", clientIP, list)
+	ipBlocksByList.Add(list, 1)
+
+	return true
+}
+
+// ipFilterHandler rejects requests from blocked clients before any other
+// processing happens
+func (d *Deflator) ipFilterHandler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if d.isBlocked(d.clientIP(r)) {
+			writeError(w, r, newRequestError(http.StatusForbidden, ErrorCodeForbidden, "Forbidden"))
+			return
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// grpcPeerIP returns the IP address of the gRPC client
+func grpcPeerIP(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+
+	return host
+}
+
+// grpcIPFilterInterceptors return the gRPC interceptors rejecting calls from blocked clients
+func (d *Deflator) grpcIPFilterInterceptors() (grpc.UnaryServerInterceptor, grpc.StreamServerInterceptor) {
+	unary := func(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if d.isBlocked(grpcPeerIP(ctx)) {
+			return nil, status.Error(codes.PermissionDenied, "Forbidden")
+		}
+		return handler(ctx, req)
+	}
+
+	stream := func(srv interface{}, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if d.isBlocked(grpcPeerIP(ss.Context())) {
+			return status.Error(codes.PermissionDenied, "Forbidden")
+		}
+		return handler(srv, ss)
+	}
+
+	return unary, stream
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// keyTemplatePlaceholders lists the placeholders which can be used in key templates
+var keyTemplatePlaceholders = map[string]bool{
+	"yyyy":     true,
+	"mm":       true,
+	"dd":       true,
+	"sha256":   true,
+	"ext":      true,
+	"orig_key": true,
+	"uuid":     true,
+}
+
+// keyTemplate is a parsed key template. Even indexes of parts hold literal
+// text and odd indexes hold placeholder names.
+type keyTemplate struct {
+	raw   string
+	parts []string
+}
+
+// keyTemplateValues holds the data which placeholders get expanded to
+type keyTemplateValues struct {
+	now     time.Time
+	body    []byte
+	ext     string
+	origKey string
+	// digest replaces the hash of body for {sha256}, if set
+	digest []byte
+}
+
+// parseKeyTemplate parses templates like `{yyyy}/{mm}/{dd}/{sha256}.{ext}`
+func parseKeyTemplate(template string) (*keyTemplate, error) {
+	t := &keyTemplate{raw: template}
+
+	rest := template
+	for {
+		start := strings.IndexAny(rest, "{}")
+		if start < 0 {
+			t.parts = append(t.parts, rest)
+			break
+		}
+		if rest[start] == '}' {
+			return nil, fmt.Errorf("unexpected '}' in key template %q", template)
+		}
+
+		end := strings.IndexAny(rest[start+1:], "{}")
+		if end < 0 || rest[start+1+end] != '}' {
+			return nil, fmt.Errorf("unterminated placeholder in key template %q", template)
+		}
+
+		name := rest[start+1 : start+1+end]
+		if !keyTemplatePlaceholders[name] {
+			return nil, fmt.Errorf("unknown placeholder {%s} in key template %q", name, template)
+		}
+
+		t.parts = append(t.parts, rest[:start], name)
+		rest = rest[start+end+2:]
+	}
+
+	return t, nil
+}
+
+// uses checks whether the template has the placeholder name
+func (t *keyTemplate) uses(name string) bool {
+	for i := 1; i < len(t.parts); i += 2 {
+		if t.parts[i] == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Expand renders the template using the specified values
+func (t *keyTemplate) Expand(values *keyTemplateValues) (string, error) {
+	var key strings.Builder
+	for i, part := range t.parts {
+		if i%2 == 0 {
+			key.WriteString(part)
+			continue
+		}
+
+		switch part {
+		case "yyyy":
+			key.WriteString(values.now.Format("2006"))
+		case "mm":
+			key.WriteString(values.now.Format("01"))
+		case "dd":
+			key.WriteString(values.now.Format("02"))
+		case "sha256":
+			if values.digest != nil {
+				key.WriteString(hex.EncodeToString(values.digest))
+				break
+			}
+			sum := sha256.Sum256(values.body)
+			key.WriteString(hex.EncodeToString(sum[:]))
+		case "ext":
+			key.WriteString(values.ext)
+		case "orig_key":
+			key.WriteString(values.origKey)
+		case "uuid":
+			uuid, err := newUUID()
+			if err != nil {
+				return "", err
+			}
+			key.WriteString(uuid)
+		}
+	}
+
+	return key.String(), nil
+}
+
+// newUUID generates a random (version 4) UUID
+func newUUID() (string, error) {
+	var buf [16]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return "", fmt.Errorf("failed to generate UUID: %s", err)
+	}
+	buf[6] = (buf[6] & 0x0f) | 0x40
+	buf[8] = (buf[8] & 0x3f) | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", buf[0:4], buf[4:6], buf[6:8], buf[8:10], buf[10:]), nil
+}
+
+// MaxKeyLength is the S3 limit for object keys, in bytes of UTF-8
+const MaxKeyLength = 1024
+
+// normalizeKey applies the NFC normalization to key, with NormalizeKeys, and
+// checks it against the DisallowedKeyCharacters, the control characters and
+// the length limit. S3 tells
+// the normal forms apart, so keys typed with NFD file names (from macOS,
+// typically) would otherwise end up next to their NFC equivalents.
+func (d *Deflator) normalizeKey(key string) (string, error) {
+	if !utf8.ValidString(key) {
+		return "", newRequestError(http.StatusBadRequest, ErrorCodeInvalidKey, "Invalid key: not valid UTF-8")
+	}
+
+	if d.config.NormalizeKeys {
+		key = norm.NFC.String(key)
+	}
+
+	if i := strings.IndexAny(key, d.config.DisallowedKeyCharacters); i >= 0 {
+		c, _ := utf8.DecodeRuneInString(key[i:])
+		return "", newRequestError(http.StatusBadRequest, ErrorCodeInvalidKey, "Invalid key: disallowed character %q", c)
+	}
+	// Percent-encoded control characters made it past decodePath
+	if i := strings.IndexFunc(key, unicode.IsControl); i >= 0 {
+		c, _ := utf8.DecodeRuneInString(key[i:])
+		return "", newRequestError(http.StatusBadRequest, ErrorCodeInvalidKey, "Invalid key: disallowed character %q", c)
+	}
+
+	if len(key) > MaxKeyLength {
+		return "", newRequestError(http.StatusBadRequest, ErrorCodeInvalidKey, "Invalid key: key too long (%d bytes, limit: %d)", len(key), MaxKeyLength)
+	}
+
+	return key, nil
+}
+
+// sanitizeKey validates an S3 object key before it gets used for an upload
+func sanitizeKey(key string) error {
+	if key == "" {
+		return fmt.Errorf("empty key")
+	}
+
+	if len(key) > MaxKeyLength {
+		return fmt.Errorf("key too long (%d bytes, limit: %d)", len(key), MaxKeyLength)
+	}
+
+	if !utf8.ValidString(key) {
+		return fmt.Errorf("key is not valid UTF-8")
+	}
+
+	if strings.HasPrefix(key, "/") {
+		return fmt.Errorf("key %q starts with '/'", key)
+	}
+
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "." || segment == ".." {
+			return fmt.Errorf("key %q contains relative path segments", key)
+		}
+	}
+
+	for _, c := range key {
+		if unicode.IsControl(c) {
+			return fmt.Errorf("key %q contains control characters", key)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeKey(t *testing.T) {
+	tests := []struct {
+		name      string
+		key       string
+		normalize bool
+		expected  string
+		err       string
+	}{
+		{"nfd", "cafe\u0301.png", true, "caf\u00e9.png", ""},
+		{"nfc", "caf\u00e9.png", true, "caf\u00e9.png", ""},
+		{"not normalized", "cafe\u0301.png", false, "cafe\u0301.png", ""},
+		{"emoji", "photos/\U0001F4F7 \U0001F600.png", true, "photos/\U0001F4F7 \U0001F600.png", ""},
+		{"limit", strings.Repeat("a", MaxKeyLength), true, strings.Repeat("a", MaxKeyLength), ""},
+		{"too long", strings.Repeat("a", MaxKeyLength+1), true, "", "key too long (1025 bytes, limit: 1024)"},
+		// The NFC form is one byte shorter, and the limit applies to it
+		{"nfd limit", strings.Repeat("a", MaxKeyLength-2) + "e\u0301", true, strings.Repeat("a", MaxKeyLength-2) + "\u00e9", ""},
+		{"nfd too long", strings.Repeat("a", MaxKeyLength-2) + "e\u0301", false, "", "key too long (1025 bytes, limit: 1024)"},
+		{"backslash", `photos\photo.png`, true, "", `disallowed character '\\'`},
+		{"del", "photo\x7f.png", true, "", `disallowed character '\x7f'`},
+		{"nul", "photo\x00.png", true, "", `disallowed character '\x00'`},
+		{"c1 control", "photo\u0085.png", true, "", `disallowed character '\u0085'`},
+		{"invalid utf-8", "photo\xff.png", true, "", "not valid UTF-8"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := &Deflator{config: &Config{NormalizeKeys: test.normalize, DisallowedKeyCharacters: "\\\x7f"}}
+			key, err := d.normalizeKey(test.key)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("Expected the %q error, got %v", test.err, err)
+				}
+				if code := errorCode(err); code != ErrorCodeInvalidKey {
+					t.Errorf("Expected the %s code, got %s", ErrorCodeInvalidKey, code)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to normalize the key: %s", err)
+			}
+			if key != test.expected {
+				t.Errorf("Expected %q, got %q", test.expected, key)
+			}
+		})
+	}
+}
+
+func TestUploadNormalizedKey(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.close()
+
+	tests := []struct {
+		name     string
+		key      string
+		expected string
+	}{
+		{"nfd", "images/cafe\u0301.png", "images/caf\u00e9.png"},
+		{"emoji", "images/\U0001F4F7.png", "images/\U0001F4F7.png"},
+		// The s3:// URLs are percent-decoded exactly once
+		{"encoded", "images/a%2541.png", "images/a%41.png"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp := s.post(test.key, "width=16", bytes.NewReader(testPNG(t, 32, 32)))
+			defer resp.Body.Close()
+			body, _ := ioutil.ReadAll(resp.Body)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("Expected status 200, got %d: %s", resp.StatusCode, body)
+			}
+
+			var result uploadResult
+			err := json.Unmarshal(body, &result)
+			if err != nil {
+				t.Fatalf("Failed to decode the upload result %q: %s", body, err)
+			}
+			if result.Key != test.expected {
+				t.Errorf("Expected the upload result for %q, got %q", test.expected, result.Key)
+			}
+			if _, ok := s.fake.Object(TestBucket, test.expected); !ok {
+				t.Errorf("The upload wasn't stored as %q, got %q", test.expected, s.fake.Keys(TestBucket))
+			}
+		})
+	}
+}
+
+func TestUploadKeyTooLong(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.close()
+
+	resp := s.post(strings.Repeat("a", MaxKeyLength+1), "width=16", bytes.NewReader(testPNG(t, 32, 32)))
+	response := decodeError(t, resp, http.StatusBadRequest)
+	if response.Code != ErrorCodeInvalidKey || !strings.Contains(response.Message, "1025 bytes") {
+		t.Errorf("Expected the %s code with the key length, got %+v", ErrorCodeInvalidKey, response)
+	}
+	if keys := s.fake.Keys(TestBucket); len(keys) != 0 {
+		t.Errorf("Expected nothing to be stored, got %q", keys)
+	}
+}
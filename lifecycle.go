@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The shutdown phases, in the order they run. The components of a phase stop
+// concurrently, once all the ones of the previous phase are done.
+const (
+	// ShutdownPhaseIntake stops accepting requests and waits for the
+	// in-flight ones
+	ShutdownPhaseIntake = iota
+	// ShutdownPhaseWorkers drains the background processing
+	ShutdownPhaseWorkers
+	// ShutdownPhaseQueues drains the outbound queues
+	ShutdownPhaseQueues
+	// ShutdownPhaseSinks flushes the reports and releases the libraries
+	ShutdownPhaseSinks
+
+	shutdownPhases
+)
+
+var shutdownPhaseNames = [shutdownPhases]string{"intake", "workers", "queues", "sinks"}
+
+// lifecycleComponent is something which runs in the background until
+// shutdown, or which only needs to be stopped
+type lifecycleComponent struct {
+	name  string
+	phase int
+	// run, if set, runs until its context gets cancelled, at the start of
+	// the component shutdown
+	run func(ctx context.Context)
+	// stop, if set, finishes the shutdown once run returned, returning how
+	// many items it dropped
+	stop func(ctx context.Context) (int, error)
+	// backlog, if set, counts the items left, which get dropped when the
+	// component is abandoned
+	backlog func() int
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// lifecycle starts the background components and shuts them down phase by
+// phase. Every phase gets phaseTimeout, and the components still running at
+// the deadline of the whole shutdown are abandoned.
+type lifecycle struct {
+	phaseTimeout time.Duration
+	deadline     time.Duration
+	// inflight, if set, counts the requests still being processed, for the
+	// logs of every phase
+	inflight func() int
+
+	components []*lifecycleComponent
+}
+
+func newLifecycle(phaseTimeout, deadline time.Duration) *lifecycle {
+	return &lifecycle{phaseTimeout: phaseTimeout, deadline: deadline}
+}
+
+// register adds a component, which gets started by start
+func (l *lifecycle) register(name string, phase int, run func(ctx context.Context), stop func(ctx context.Context) (int, error)) *lifecycleComponent {
+	c := &lifecycleComponent{name: name, phase: phase, run: run, stop: stop}
+	l.components = append(l.components, c)
+	return c
+}
+
+// start runs the components in the background
+func (l *lifecycle) start() {
+	for _, c := range l.components {
+		c.done = make(chan struct{})
+		if c.run == nil {
+			close(c.done)
+			continue
+		}
+
+		var ctx context.Context
+		ctx, c.cancel = context.WithCancel(context.Background())
+		go func(c *lifecycleComponent) {
+			defer close(c.done)
+			c.run(ctx)
+		}(c)
+	}
+}
+
+// shutdownResult is the outcome of stopping a component
+type shutdownResult struct {
+	name    string
+	dropped int
+	err     error
+}
+
+// shutdown stops the components phase by phase, returning the first error
+// and the number of dropped items, including the ones of the abandoned
+// components
+func (l *lifecycle) shutdown() (int, error) {
+	start := time.Now()
+	deadline, cancel := context.WithTimeout(context.Background(), l.deadline)
+	defer cancel()
+
+	dropped := 0
+	var firstErr error
+	for phase := 0; phase < shutdownPhases; phase++ {
+		var components []*lifecycleComponent
+		for _, c := range l.components {
+			if c.phase == phase {
+				components = append(components, c)
+			}
+		}
+		if len(components) == 0 {
+			continue
+		}
+
+		if deadline.Err() != nil {
+			log.Errorf("Shutdown deadline exceeded, skipping the %s phase (%s)", shutdownPhaseNames[phase], componentNames(components))
+			for _, c := range components {
+				dropped += c.abandon()
+			}
+			if firstErr == nil {
+				firstErr = fmt.Errorf("shutdown deadline exceeded before the %s phase", shutdownPhaseNames[phase])
+			}
+			continue
+		}
+
+		phaseDropped, err := l.stopPhase(deadline, phase, components)
+		dropped += phaseDropped
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	if dropped > 0 {
+		log.Warnf("Shut down in %s, dropping %d items", time.Since(start), dropped)
+	} else {
+		log.Infof("Shut down in %s", time.Since(start))
+	}
+	return dropped, firstErr
+}
+
+// stopPhase stops components concurrently, until phaseTimeout or the
+// shutdown deadline
+func (l *lifecycle) stopPhase(deadline context.Context, phase int, components []*lifecycleComponent) (int, error) {
+	start := time.Now()
+	log.Infof("Starting the %s shutdown phase (%s)%s", shutdownPhaseNames[phase], componentNames(components), l.inflightCount())
+	ctx, cancel := context.WithTimeout(deadline, l.phaseTimeout)
+	defer cancel()
+
+	results := make(chan shutdownResult, len(components))
+	for _, c := range components {
+		go func(c *lifecycleComponent) {
+			results <- c.shutdown(ctx)
+		}(c)
+	}
+
+	dropped := 0
+	var firstErr error
+	pending := make(map[string]*lifecycleComponent, len(components))
+	for _, c := range components {
+		pending[c.name] = c
+	}
+	for len(pending) > 0 {
+		select {
+		case result := <-results:
+			delete(pending, result.name)
+			dropped += result.dropped
+			if result.err != nil {
+				log.Errorf("Failed to stop %s: %s", result.name, result.err)
+				if firstErr == nil {
+					firstErr = fmt.Errorf("failed to stop %s: %s", result.name, result.err)
+				}
+			}
+		case <-ctx.Done():
+			var names []string
+			for name, c := range pending {
+				names = append(names, name)
+				dropped += c.abandon()
+			}
+			log.Errorf("Timed out stopping %s in the %s phase, abandoning them", strings.Join(names, ", "), shutdownPhaseNames[phase])
+			if firstErr == nil {
+				firstErr = fmt.Errorf("timed out stopping %s", strings.Join(names, ", "))
+			}
+			pending = nil
+		}
+	}
+
+	log.Infof("Finished the %s shutdown phase in %s%s", shutdownPhaseNames[phase], time.Since(start), l.inflightCount())
+	return dropped, firstErr
+}
+
+// inflightCount describes the number of in-flight requests for the logs
+func (l *lifecycle) inflightCount() string {
+	if l.inflight == nil {
+		return ""
+	}
+	return fmt.Sprintf(", %d in-flight requests", l.inflight())
+}
+
+// shutdown cancels the run of c, waits for it and then stops c
+func (c *lifecycleComponent) shutdown(ctx context.Context) shutdownResult {
+	result := shutdownResult{name: c.name}
+	if c.cancel != nil {
+		c.cancel()
+		select {
+		case <-c.done:
+		case <-ctx.Done():
+			result.err = ctx.Err()
+			return result
+		}
+	}
+
+	if c.stop != nil {
+		result.dropped, result.err = c.stop(ctx)
+	}
+	return result
+}
+
+// abandon returns the number of items c drops by not finishing its shutdown
+func (c *lifecycleComponent) abandon() int {
+	if c.backlog == nil {
+		return 0
+	}
+	return c.backlog()
+}
+
+func componentNames(components []*lifecycleComponent) string {
+	names := make([]string, len(components))
+	for i, c := range components {
+		names[i] = c.name
+	}
+	return strings.Join(names, ", ")
+}
+
+// inflightRequests counts the uploads being processed
+func (d *Deflator) inflightRequests() int {
+	count := 0
+	d.inflight.Range(func(_, _ interface{}) bool {
+		count++
+		return true
+	})
+	return count
+}
+
+// isDraining checks whether the shutdown started
+func (d *Deflator) isDraining() bool {
+	return atomic.LoadInt32(&d.draining) != 0
+}
+
+// drain starts the shutdown by failing the readiness checks, then waits for
+// PreShutdownDelay so the load balancers deregister the instance before it
+// stops accepting requests
+func (d *Deflator) drain() {
+	atomic.StoreInt32(&d.draining, 1)
+	if d.config.PreShutdownDelay <= 0 {
+		return
+	}
+
+	log.Infof("Waiting %s before shutting down, %d in-flight requests", d.config.PreShutdownDelay, d.inflightRequests())
+	time.Sleep(d.config.PreShutdownDelay)
+}
+
+// abort gives up on the shutdown: the connections get closed, which cancels
+// the in-flight requests, and the process exits with an error
+func (d *Deflator) abort() {
+	log.Errorf("Aborting the shutdown, cancelling %d in-flight requests", d.inflightRequests())
+	for _, l := range d.listeners {
+		_ = l.server.Close()
+	}
+	if d.grpcServer != nil {
+		d.grpcServer.Stop()
+	}
+	os.Exit(1)
+}
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// shutdownLog records the order of the component events
+type shutdownLog struct {
+	sync.Mutex
+	events []string
+}
+
+func (l *shutdownLog) add(event string) {
+	l.Lock()
+	defer l.Unlock()
+	l.events = append(l.events, event)
+}
+
+func (l *shutdownLog) get() []string {
+	l.Lock()
+	defer l.Unlock()
+	return append([]string(nil), l.events...)
+}
+
+// run returns a run function recording when it gets cancelled
+func (l *shutdownLog) run(name string) func(ctx context.Context) {
+	return func(ctx context.Context) {
+		<-ctx.Done()
+		l.add(name + " run")
+	}
+}
+
+// stop returns a stop function recording when it's called
+func (l *shutdownLog) stop(name string, dropped int) func(ctx context.Context) (int, error) {
+	return func(ctx context.Context) (int, error) {
+		l.add(name + " stop")
+		return dropped, nil
+	}
+}
+
+// stuck blocks until the test ends, ignoring the shutdown
+func stuck(release chan struct{}) func(ctx context.Context) (int, error) {
+	return func(ctx context.Context) (int, error) {
+		<-release
+		return 0, nil
+	}
+}
+
+func TestLifecycleOrder(t *testing.T) {
+	events := &shutdownLog{}
+	l := newLifecycle(time.Second, 5*time.Second)
+	// Registered out of order, the phases decide
+	l.register("metrics", ShutdownPhaseSinks, nil, events.stop("metrics", 0))
+	l.register("webhooks", ShutdownPhaseQueues, events.run("webhooks"), events.stop("webhooks", 2))
+	l.register("workers", ShutdownPhaseWorkers, events.run("workers"), events.stop("workers", 0))
+	l.register("http", ShutdownPhaseIntake, nil, events.stop("http", 0))
+	l.register("replication", ShutdownPhaseQueues, nil, events.stop("replication", 1))
+	l.start()
+
+	dropped, err := l.shutdown()
+	if err != nil {
+		t.Fatalf("Failed to shut down: %s", err)
+	}
+	if dropped != 3 {
+		t.Errorf("Expected 3 dropped items, got %d", dropped)
+	}
+
+	order := map[string]int{}
+	for i, event := range events.get() {
+		order[event] = i
+	}
+	if len(order) != 7 {
+		t.Fatalf("Expected every component to run and stop once, got %q", events.get())
+	}
+	before := [][2]string{
+		{"http stop", "workers run"},
+		{"workers run", "workers stop"},
+		{"workers stop", "webhooks run"},
+		{"workers stop", "replication stop"},
+		{"webhooks run", "webhooks stop"},
+		{"webhooks stop", "metrics stop"},
+		{"replication stop", "metrics stop"},
+	}
+	for _, pair := range before {
+		if order[pair[0]] > order[pair[1]] {
+			t.Errorf("Expected %q before %q, got %q", pair[0], pair[1], events.get())
+		}
+	}
+}
+
+func TestLifecyclePhaseTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	events := &shutdownLog{}
+	l := newLifecycle(50*time.Millisecond, 5*time.Second)
+	stuckWorker := l.register("stuck", ShutdownPhaseWorkers, nil, stuck(release))
+	stuckWorker.backlog = func() int { return 4 }
+	l.register("workers", ShutdownPhaseWorkers, nil, events.stop("workers", 0))
+	l.register("webhooks", ShutdownPhaseQueues, nil, events.stop("webhooks", 0))
+	l.start()
+
+	start := time.Now()
+	dropped, err := l.shutdown()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the stuck component to be abandoned after the phase timeout, took %s", elapsed)
+	}
+	if err == nil || !strings.Contains(err.Error(), "timed out stopping stuck") {
+		t.Errorf("Expected the timeout error, got %v", err)
+	}
+	if dropped != 4 {
+		t.Errorf("Expected the backlog of the stuck component to be dropped, got %d", dropped)
+	}
+
+	// The next phases still run
+	if events := events.get(); len(events) != 2 || events[1] != "webhooks stop" {
+		t.Errorf("Expected the other components to stop, got %q", events)
+	}
+}
+
+func TestLifecycleDeadline(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	events := &shutdownLog{}
+	// A single phase could take longer than the whole shutdown
+	l := newLifecycle(time.Minute, 100*time.Millisecond)
+	l.register("http", ShutdownPhaseIntake, nil, events.stop("http", 0))
+	// Nor does ignoring the cancellation hang the shutdown
+	stuckWorker := l.register("stuck", ShutdownPhaseWorkers, func(ctx context.Context) { <-release }, nil)
+	stuckWorker.backlog = func() int { return 1 }
+	webhooks := l.register("webhooks", ShutdownPhaseQueues, events.run("webhooks"), events.stop("webhooks", 0))
+	webhooks.backlog = func() int { return 5 }
+	l.register("metrics", ShutdownPhaseSinks, nil, events.stop("metrics", 0))
+	l.start()
+
+	start := time.Now()
+	dropped, err := l.shutdown()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the shutdown to end at the deadline, took %s", elapsed)
+	}
+	if err == nil || !strings.Contains(err.Error(), "timed out stopping stuck") {
+		t.Errorf("Expected the timeout error, got %v", err)
+	}
+
+	// The remaining phases are skipped, dropping their backlog
+	if dropped != 6 {
+		t.Errorf("Expected 6 dropped items, got %d", dropped)
+	}
+	if events := events.get(); len(events) != 1 || events[0] != "http stop" {
+		t.Errorf("Expected only the intake to stop, got %q", events)
+	}
+}
+
+func TestLifecycleStopError(t *testing.T) {
+	events := &shutdownLog{}
+	l := newLifecycle(time.Second, 5*time.Second)
+	l.register("http", ShutdownPhaseIntake, nil, func(ctx context.Context) (int, error) {
+		return 0, errors.New("connection reset")
+	})
+	l.register("vips", ShutdownPhaseSinks, nil, events.stop("vips", 0))
+	l.start()
+
+	_, err := l.shutdown()
+	if err == nil || err.Error() != "failed to stop http: connection reset" {
+		t.Errorf("Expected the stop error, got %v", err)
+	}
+	if events := events.get(); len(events) != 1 {
+		t.Errorf("Expected the later phases to run after an error, got %q", events)
+	}
+}
+
+// abortTestEnv is the fakes3 endpoint of the test binary started by
+// TestAbortShutdown
+const abortTestEnv = "IMGDEFLATOR_TEST_ABORT_S3"
+
+// runAbortTest serves uploads like main, printing the listener address, until
+// the shutdown ends
+func runAbortTest() int {
+	config, err := loadTestConfig(os.Getenv(abortTestEnv))
+	if err != nil {
+		return 2
+	}
+	config.PreShutdownDelay = 100 * time.Millisecond
+	d, err := NewDeflator(config, nil, nil)
+	if err != nil {
+		return 2
+	}
+	err = initCredentials(false)
+	if err != nil {
+		return 2
+	}
+
+	d.listenerConfigs = []*ListenerConfig{{Addr: "127.0.0.1:0", Network: "tcp"}}
+	err = d.Listen(d.routes())
+	if err != nil {
+		return 2
+	}
+	d.Serve()
+	ctx := initGracefulStop(d.DiagnosticDump, d.abort)
+	fmt.Println(d.listeners[0].listener.Addr())
+
+	<-ctx.Done()
+	d.drain()
+	err = d.shutdownListeners(context.Background())
+	if err != nil {
+		return 2
+	}
+	return 0
+}
+
+// blockUpload makes the S3 upload of key block until release gets closed,
+// closing started once it does
+func blockUpload(s *testServer, key string) (started, release chan struct{}) {
+	started, release = make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	s.fake.SetFault(func(r *http.Request) int {
+		if r.Method == http.MethodPut && r.URL.Path == "/"+TestBucket+"/"+key {
+			once.Do(func() { close(started) })
+			<-release
+		}
+		return 0
+	})
+	return started, release
+}
+
+// readiness returns the status of /readyz, or 0 when it can't be reached
+func readiness(baseURL string) int {
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}, Timeout: time.Second}
+	resp, err := client.Get(baseURL + "/readyz")
+	if err != nil {
+		return 0
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	s := newTestServer(t, func(config *Config) {
+		config.PreShutdownDelay = 300 * time.Millisecond
+	})
+	defer s.close()
+	started, release := blockUpload(s, "slow.png")
+	defer func() {
+		select {
+		case <-release:
+		default:
+			close(release)
+		}
+	}()
+
+	d := s.deflator
+	baseURL := s.listen(&ListenerConfig{})
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}, Timeout: 10 * time.Second}
+	upload := func(key string) (*http.Response, error) {
+		return client.Post(baseURL+s.uploadPath(TestBucket, key, "width=16"), "image/png", bytes.NewReader(testPNG(t, 32, 32)))
+	}
+
+	responses := make(chan *http.Response, 1)
+	go func() {
+		resp, err := upload("slow.png")
+		if err != nil {
+			t.Errorf("The in-flight upload failed: %s", err)
+			close(responses)
+			return
+		}
+		responses <- resp
+	}()
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("The upload never reached S3")
+	}
+	if count := d.inflightRequests(); count != 1 {
+		t.Errorf("Expected 1 in-flight request, got %d", count)
+	}
+
+	// The shutdown runs like in main
+	l := newLifecycle(5*time.Second, 10*time.Second)
+	l.inflight = d.inflightRequests
+	l.register("http", ShutdownPhaseIntake, nil, func(ctx context.Context) (int, error) {
+		return 0, d.shutdownListeners(ctx)
+	})
+	l.start()
+	start := time.Now()
+	stopped := make(chan error, 1)
+	go func() {
+		d.drain()
+		_, err := l.shutdown()
+		stopped <- err
+	}()
+
+	// During the delay, the instance isn't ready but still serves uploads
+	status := 0
+	for i := 0; i < 50 && status != http.StatusServiceUnavailable; i++ {
+		status = readiness(baseURL)
+		if status != http.StatusServiceUnavailable {
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	if status != http.StatusServiceUnavailable {
+		t.Fatalf("Expected the readiness to fail after the signal, got %d", status)
+	}
+	resp, err := upload("during.png")
+	if err != nil {
+		t.Fatalf("The upload during the delay failed: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected the upload during the delay to succeed, got %d", resp.StatusCode)
+	}
+
+	// Then the shutdown waits for the in-flight upload
+	for i := 0; i < 100 && readiness(baseURL) != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Errorf("Expected the listener to stay open for the delay, closed after %s", elapsed)
+	}
+	select {
+	case err := <-stopped:
+		t.Fatalf("The shutdown ended before the in-flight upload: %v", err)
+	default:
+	}
+	close(release)
+
+	resp, ok := <-responses
+	if !ok {
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected the in-flight upload to complete, got %d", resp.StatusCode)
+	}
+	if err := <-stopped; err != nil {
+		t.Errorf("Failed to shut down: %s", err)
+	}
+	for _, key := range []string{"slow.png", "during.png"} {
+		if _, ok := s.fake.Object(TestBucket, key); !ok {
+			t.Errorf("The upload of %s wasn't stored", key)
+		}
+	}
+}
+
+func TestAbortShutdown(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.close()
+	started, release := blockUpload(s, "slow.png")
+	defer close(release)
+
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	cmd.Env = append(os.Environ(), abortTestEnv+"="+s.s3.URL)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatalf("Failed to get the output: %s", err)
+	}
+	err = cmd.Start()
+	if err != nil {
+		t.Fatalf("Failed to start the server: %s", err)
+	}
+	exited := make(chan error, 1)
+	defer func() {
+		select {
+		case <-exited:
+		default:
+			_ = cmd.Process.Kill()
+		}
+	}()
+	addr, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		t.Fatalf("Failed to read the server address: %s", err)
+	}
+	go func() { exited <- cmd.Wait() }()
+	baseURL := "http://" + strings.TrimSpace(addr)
+
+	responses := make(chan error, 1)
+	go func() {
+		resp, err := http.Post(baseURL+s.uploadPath(TestBucket, "slow.png", "width=16"), "image/png", bytes.NewReader(testPNG(t, 32, 32)))
+		if err == nil {
+			resp.Body.Close()
+			err = fmt.Errorf("status %d", resp.StatusCode)
+		}
+		responses <- err
+	}()
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("The upload never reached S3")
+	}
+
+	// The first signal starts the shutdown, which waits for the upload
+	_ = cmd.Process.Signal(syscall.SIGTERM)
+	for i := 0; i < 100 && readiness(baseURL) != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status := readiness(baseURL); status != 0 {
+		t.Fatalf("Expected the server to stop accepting, got %d", status)
+	}
+	select {
+	case err := <-exited:
+		t.Fatalf("The server exited before the in-flight upload: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// The second one cancels it
+	_ = cmd.Process.Signal(syscall.SIGTERM)
+	select {
+	case err := <-exited:
+		if exit, ok := err.(*exec.ExitError); !ok || exit.Sys().(syscall.WaitStatus).ExitStatus() != 1 {
+			t.Errorf("Expected the server to exit with status 1, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("The server didn't abort")
+	}
+	select {
+	case err := <-responses:
+		if err == nil {
+			t.Errorf("Expected the in-flight upload to be cancelled")
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("The in-flight upload didn't get cancelled")
+	}
+	if _, ok := s.fake.Object(TestBucket, "slow.png"); ok {
+		t.Errorf("The cancelled upload was stored")
+	}
+}
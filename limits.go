@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SniffLength is how much of the body is used to detect its content type
+const SniffLength = 512
+
+// smallBodies counts the uploads rejected for their too small bodies, by
+// error code and bucket
+var smallBodies = newBucketMap("small_bodies")
+
+// rejectSmallBody counts the rejection of a too small body
+func rejectSmallBody(bucket string, err *requestError) error {
+	smallBodies.add(err.code+":", bucket, "", 1)
+	return err
+}
+
+// emptyBodyError is returned for the uploads without a single byte
+func emptyBodyError(bucket string) error {
+	return rejectSmallBody(bucket, newRequestError(http.StatusBadRequest, ErrorCodeEmptyBody, "Empty body"))
+}
+
+// checkEmptyBody rejects empty bodies before anything else happens with the
+// upload. It reads the first byte, since chunked bodies don't have a length.
+func checkEmptyBody(req *uploadRequest) error {
+	reader := bufio.NewReaderSize(req.body, SniffLength)
+	req.body = reader
+	// Other errors get returned again when the body gets read
+	if _, err := reader.Peek(1); err == io.EOF {
+		log.Debugf("Empty body for URL %q", req.location())
+		return emptyBodyError(req.bucket)
+	}
+	return nil
+}
+
+// minUploadSize returns the minimum upload size for bucket
+func (d *Deflator) minUploadSize(bucket string) int64 {
+	if min := d.bucketConfig(bucket).MinBytes; min > 0 {
+		return min
+	}
+	return d.config.MinUploadSize
+}
+
+// parseSizeLimits parses a list of `<content type>:<max size in bytes>` entries
+func parseSizeLimits(entries []string) (map[string]int64, error) {
+	limits := make(map[string]int64, len(entries))
+	for _, entry := range entries {
+		i := strings.LastIndex(entry, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("missing size in %q", entry)
+		}
+
+		size, err := strconv.ParseInt(entry[i+1:], 10, 64)
+		if err != nil || size <= 0 {
+			return nil, fmt.Errorf("invalid size in %q", entry)
+		}
+
+		limits[strings.ToLower(strings.TrimSpace(entry[:i]))] = size
+	}
+
+	return limits, nil
+}
+
+// sniffContentType detects the content type of a body from its first bytes.
+// It complements http.DetectContentType with the image formats it doesn't know.
+func sniffContentType(head []byte) string {
+	switch {
+	case bytes.HasPrefix(head, []byte("II*\x00")), bytes.HasPrefix(head, []byte("MM\x00*")):
+		return "image/tiff"
+	case isAVIF(head):
+		return AVIFContentType
+	case bytes.Contains(bytes.ToLower(head), []byte("<svg")):
+		return "image/svg+xml"
+	}
+
+	contentType := http.DetectContentType(head)
+	if i := strings.Index(contentType, ";"); i >= 0 {
+		contentType = contentType[:i]
+	}
+	return contentType
+}
+
+// normalizeContentType cleans up the Content-Type of an upload before it gets
+// stored, since CDN behaviors match the exact value: the type is lowercased,
+// images lose all their parameters and other types only keep their charset.
+// A missing or `application/octet-stream` type is replaced with the sniffed
+// one, while wildcard types are rejected.
+func normalizeContentType(value, sniffed string) (string, error) {
+	base := value
+	if i := strings.Index(value, ";"); i >= 0 {
+		base = value[:i]
+	}
+	if strings.TrimSpace(base) == "" {
+		return sniffed, nil
+	}
+
+	// Parse the type alone, so broken or duplicate parameters don't matter
+	mediaType, _, err := mime.ParseMediaType(base)
+	i := strings.Index(mediaType, "/")
+	if err != nil || i <= 0 || i == len(mediaType)-1 {
+		return "", newRequestError(http.StatusBadRequest, ErrorCodeInvalidContentType, "Invalid Content-Type %q", value)
+	}
+	if mediaType[:i] == "*" || mediaType[i+1:] == "*" {
+		return "", newRequestError(http.StatusBadRequest, ErrorCodeInvalidContentType, "Wildcard Content-Type %q not allowed", value)
+	}
+
+	switch {
+	case mediaType == "application/octet-stream":
+		return sniffed, nil
+	case strings.HasPrefix(mediaType, "image/"):
+		return mediaType, nil
+	}
+
+	_, params, err := mime.ParseMediaType(value)
+	if charset := params["charset"]; err == nil && charset != "" {
+		return mime.FormatMediaType(mediaType, map[string]string{"charset": strings.ToLower(charset)}), nil
+	}
+	return mediaType, nil
+}
+
+// isNonImageContentType checks whether the declared Content-Type value
+// clearly isn't an image. It's only a hint, since a missing, generic or wrong
+// type doesn't stop the body from being sniffed: XML is left out because of
+// SVG, and so are the form types, which is what `curl --data-binary` sends.
+func isNonImageContentType(value string) bool {
+	mediaType, _, err := mime.ParseMediaType(value)
+	if err != nil {
+		return false
+	}
+	i := strings.Index(mediaType, "/")
+	if i <= 0 {
+		return false
+	}
+
+	switch mediaType[:i] {
+	case "text":
+		return mediaType != "text/xml"
+	case "video", "audio", "font":
+		return true
+	case "application":
+		switch mediaType[i+1:] {
+		case "json", "javascript", "pdf", "zip", "gzip", "x-tar":
+			return true
+		}
+		return strings.HasSuffix(mediaType, "+json")
+	}
+	return false
+}
+
+// checkDeclaredContentType rejects the uploads whose Content-Type clearly
+// isn't an image before their body gets read, unless the gate is disabled
+// globally or for the bucket
+func (d *Deflator) checkDeclaredContentType(req *uploadRequest) error {
+	if !d.config.ContentTypeGate || d.bucketConfig(req.bucket).AnyContentType {
+		return nil
+	}
+	if !isNonImageContentType(req.contentType) {
+		return nil
+	}
+	log.Debugf("Rejecting the non-image Content-Type %q for URL %q", req.contentType, req.location())
+	return newRequestError(http.StatusUnsupportedMediaType, ErrorCodeUnsupportedMediaType, "Content-Type %q isn't an image", req.contentType)
+}
+
+// uploadSizeLimit returns the maximum upload size for contentType
+func (d *Deflator) uploadSizeLimit(contentType string) int64 {
+	if limit, ok := d.sizeLimits[contentType]; ok {
+		return limit
+	}
+	return d.config.MaxUploadSize
+}
+
+// maxUploadSizeLimit returns the highest upload size limit of all content
+// types, buckets and profiles, to be applied before they're known
+func (d *Deflator) maxUploadSizeLimit() int64 {
+	max := d.config.MaxUploadSize
+	for _, limit := range d.sizeLimits {
+		if limit > max {
+			max = limit
+		}
+	}
+	for _, config := range d.buckets {
+		if config.MaxInputBytes > max {
+			max = config.MaxInputBytes
+		}
+	}
+	for _, profile := range d.transformProfiles() {
+		if limit, err := strconv.ParseInt(profile.Get("max_input_bytes"), 10, 64); err == nil && limit > max {
+			max = limit
+		}
+	}
+	return max
+}
+
+// inputSizeLimit returns the size limit of the body of req, sniffed as
+// contentType. The profile limit takes precedence over the bucket one, which
+// takes precedence over the content type and global ones.
+func (d *Deflator) inputSizeLimit(req *uploadRequest, contentType string) int64 {
+	limit := d.uploadSizeLimit(contentType)
+	if bucketLimit := d.bucketConfig(req.bucket).MaxInputBytes; bucketLimit > 0 {
+		limit = bucketLimit
+	}
+	if req.maxInputBytes > 0 {
+		limit = req.maxInputBytes
+	}
+	if req.maxSize > 0 && req.maxSize < limit {
+		limit = req.maxSize
+	}
+	return limit
+}
+
+// storedSizeLimit returns the size limit of the processed image of req, zero
+// if there's none
+func (d *Deflator) storedSizeLimit(req *uploadRequest) int64 {
+	limit := d.config.MaxStoredSize
+	if bucketLimit := d.bucketConfig(req.bucket).MaxStoredBytes; bucketLimit > 0 {
+		limit = bucketLimit
+	}
+	if req.maxStoredBytes > 0 {
+		limit = req.maxStoredBytes
+	}
+	return limit
+}
+
+// sizeLimits is the detail of the errors about the size limits
+type sizeLimits struct {
+	MaxInputBytes  int64 `json:"max_input_bytes"`
+	MaxStoredBytes int64 `json:"max_stored_bytes,omitempty"`
+}
+
+// sizeLimitError adds the size limits of req to err
+func (d *Deflator) sizeLimitError(req *uploadRequest, inputLimit int64, err *requestError) error {
+	err.detail = &sizeLimits{MaxInputBytes: inputLimit, MaxStoredBytes: d.storedSizeLimit(req)}
+	return err
+}
+
+// checkStoredSize rejects processed images above the stored size limit
+func (d *Deflator) checkStoredSize(req *uploadRequest, inputLimit int64, size int) error {
+	limit := d.storedSizeLimit(req)
+	if limit <= 0 || int64(size) <= limit {
+		return nil
+	}
+	log.Debugf("Processed image too large for URL %q (%d bytes, limit: %d bytes)", req.location(), size, limit)
+	return d.sizeLimitError(req, inputLimit, newRequestError(
+		http.StatusRequestEntityTooLarge, ErrorCodeOutputTooLarge,
+		"Processed image too large (%d bytes, limit: %d bytes)", size, limit,
+	))
+}
+
+// isBodyTooLargeError checks if err is returned by the http.MaxBytesReader
+// of a request body, whose hard limit can be the limit of the content type
+func isBodyTooLargeError(err error) bool {
+	return err != nil && err.Error() == "http: request body too large"
+}
+
+// readBody spools the request body, enforcing the size limit of its sniffed
+// content type and the minimum upload size. Bodies above the soft limit get
+// through with a warning, while the ones too short to hold an image header
+// are rejected when ValidateHeaders is set.
+func (d *Deflator) readBody(ctx context.Context, req *uploadRequest) ([]byte, error) {
+	reader := bufio.NewReaderSize(req.body, SniffLength)
+	// Errors other than short bodies get returned again by the reads below
+	head, _ := reader.Peek(SniffLength)
+	contentType := sniffContentType(head)
+
+	limit := d.inputSizeLimit(req, contentType)
+	if req.declaredSize > limit {
+		log.Debugf("File too large (%d bytes, limit for %s: %d bytes)", req.declaredSize, contentType, limit)
+		return nil, d.sizeLimitError(req, limit, newRequestError(
+			http.StatusRequestEntityTooLarge, ErrorCodePayloadTooLarge,
+			"File too large (%d bytes, limit for %s: %d bytes)", req.declaredSize, contentType, limit,
+		))
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(reader, limit+1))
+	if isBodyTooLargeError(err) {
+		log.Debugf("File too large (limit for %s: %d bytes)", contentType, limit)
+		return nil, d.sizeLimitError(req, limit, newRequestError(
+			http.StatusRequestEntityTooLarge, ErrorCodePayloadTooLarge,
+			"File too large (limit for %s: %d bytes)", contentType, limit,
+		))
+	}
+	if err != nil {
+		log.Warnf("Failed to read image for URL %q: %s", req.location(), err)
+		return nil, newRequestError(http.StatusServiceUnavailable, ErrorCodeInternal, "Internal error").withCause(err)
+	}
+
+	if int64(len(body)) > limit {
+		log.Debugf("File too large (limit for %s: %d bytes)", contentType, limit)
+		return nil, d.sizeLimitError(req, limit, newRequestError(
+			http.StatusRequestEntityTooLarge, ErrorCodePayloadTooLarge,
+			"File too large (limit for %s: %d bytes)", contentType, limit,
+		))
+	}
+
+	if soft := d.softSizeLimit(limit); soft > 0 && int64(len(body)) > soft {
+		log.Debugf("File close to the size limit (%d bytes, limit for %s: %d bytes)", len(body), contentType, limit)
+		addWarning(ctx, req.bucket, WarningApproachingSizeLimit)
+	}
+
+	if len(body) == 0 {
+		return nil, emptyBodyError(req.bucket)
+	}
+	// Bodies shorter than the sniffed bytes which aren't recognized as images
+	// end before their header
+	if d.config.ValidateHeaders && len(body) < SniffLength && !strings.HasPrefix(contentType, "image/") {
+		log.Debugf("Truncated image (%d bytes, sniffed as %s)", len(body), contentType)
+		return nil, rejectSmallBody(req.bucket, newRequestError(
+			http.StatusUnprocessableEntity, ErrorCodeTruncatedImage,
+			"Truncated image (%d bytes)", len(body),
+		))
+	}
+	if min := d.minUploadSize(req.bucket); int64(len(body)) < min {
+		log.Debugf("File too small (%d bytes)", len(body))
+		return nil, rejectSmallBody(req.bucket, newRequestError(
+			http.StatusUnprocessableEntity, ErrorCodePayloadTooSmall,
+			"File too small (%d bytes, minimum: %d bytes)", len(body), min,
+		))
+	}
+
+	return body, nil
+}
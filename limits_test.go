@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+func TestNormalizeContentType(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected string
+	}{
+		{"image/jpeg", "image/jpeg"},
+		{"IMAGE/JPEG", "image/jpeg"},
+		{"image/jpeg; charset=UTF-8", "image/jpeg"},
+		{"Image/PNG;charset=utf-8; name=photo.png", "image/png"},
+		{" image/webp ", "image/webp"},
+		// The image parameters are dropped, even when they're broken
+		{"image/jpeg; charset=UTF-8; charset=latin1", "image/jpeg"},
+		{"image/jpeg; charset", "image/jpeg"},
+		{"image/svg+xml; charset=utf-8", "image/svg+xml"},
+		{"text/plain; charset=UTF-8; format=flowed", "text/plain; charset=utf-8"},
+		{"Application/JSON", "application/json"},
+		{"application/json; charset=utf-8; charset=latin1", "application/json"},
+		{"", "image/png"},
+		{"   ", "image/png"},
+		{"; charset=utf-8", "image/png"},
+		{"application/octet-stream", "image/png"},
+		{"APPLICATION/OCTET-STREAM; name=photo.png", "image/png"},
+	}
+
+	for _, test := range tests {
+		contentType, err := normalizeContentType(test.value, "image/png")
+		if err != nil {
+			t.Errorf("Failed to normalize %q: %s", test.value, err)
+			continue
+		}
+		if contentType != test.expected {
+			t.Errorf("Expected %q to be normalized to %q, got %q", test.value, test.expected, contentType)
+		}
+	}
+}
+
+func TestNormalizeContentTypeErrors(t *testing.T) {
+	for _, value := range []string{"image/*", "*/*", "*/jpeg", "IMAGE/*; q=0.8", "image", "image/", "/jpeg", "image jpeg", "image/jpeg/extra"} {
+		_, err := normalizeContentType(value, "image/png")
+		if err == nil {
+			t.Errorf("Expected %q to be rejected", value)
+			continue
+		}
+		if status, _ := errorStatus(err); status != http.StatusBadRequest || errorCode(err) != ErrorCodeInvalidContentType {
+			t.Errorf("Expected a 400 %s error for %q, got %d %s", ErrorCodeInvalidContentType, value, status, errorCode(err))
+		}
+	}
+}
+
+func TestUploadNormalizedContentType(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.close()
+
+	for _, value := range []string{"IMAGE/PNG; charset=UTF-8", "application/octet-stream", ""} {
+		r, err := http.NewRequest(http.MethodPost, s.uploadURL(TestBucket, "photo.png", "width=16"), bytes.NewReader(testPNG(t, 32, 32)))
+		if err != nil {
+			t.Fatalf("Failed to create the request: %s", err)
+		}
+		r.Header.Set("Content-Type", value)
+		resp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatalf("Failed to send the upload: %s", err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected the upload with %q to succeed, got %d: %s", value, resp.StatusCode, body)
+		}
+
+		var result uploadResult
+		err = json.Unmarshal(body, &result)
+		if err != nil {
+			t.Fatalf("Failed to decode the upload result %q: %s", body, err)
+		}
+		object, ok := s.fake.Object(TestBucket, "photo.png")
+		if !ok {
+			t.Fatalf("The upload with %q wasn't stored", value)
+		}
+		if result.ContentType != "image/png" || object.ContentType != "image/png" {
+			t.Errorf("Expected %q to be stored and returned as image/png, got %q and %q", value, object.ContentType, result.ContentType)
+		}
+	}
+
+	r, err := http.NewRequest(http.MethodPost, s.uploadURL(TestBucket, "wildcard.png", "width=16"), bytes.NewReader(testPNG(t, 32, 32)))
+	if err != nil {
+		t.Fatalf("Failed to create the request: %s", err)
+	}
+	r.Header.Set("Content-Type", "image/*")
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatalf("Failed to send the upload: %s", err)
+	}
+	if code := decodeError(t, resp, http.StatusBadRequest).Code; code != ErrorCodeInvalidContentType {
+		t.Errorf("Expected the %s code, got %s", ErrorCodeInvalidContentType, code)
+	}
+	if _, ok := s.fake.Object(TestBucket, "wildcard.png"); ok {
+		t.Errorf("The upload with a wildcard type was stored")
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// HTTP2DrainPollInterval is how often shutdowns check if the HTTP/2
+// requests are done
+const HTTP2DrainPollInterval = 100 * time.Millisecond
+
+// ListenerConfig holds the settings of one of the HTTP listeners loaded from
+// the listener config file
+type ListenerConfig struct {
+	Addr string `json:"addr"`
+	// Network is `tcp` (default), `tcp4` or `tcp6` for IPv6-only binds
+	Network     string `json:"network"`
+	TLSCertFile string `json:"tls_cert_file"`
+	TLSKeyFile  string `json:"tls_key_file"`
+	// DisableAuth skips the URL signature check, for trusted internal callers
+	DisableAuth bool `json:"disable_auth"`
+	DisableCORS bool `json:"disable_cors"`
+	// PlainPut accepts `PUT /<bucket>/<key>` uploads
+	PlainPut bool `json:"plain_put"`
+	// Principal is who the uploads received on this listener are billed to
+	Principal string `json:"principal"`
+	// MaxConcurrentRequests overrides MaxConcurrentPerPrincipal for the
+	// principal of this listener
+	MaxConcurrentRequests int `json:"max_concurrent_requests"`
+	// H2C serves HTTP/2 over cleartext, besides HTTP/1.1
+	H2C bool `json:"h2c"`
+}
+
+// listener is a bound HTTP listener and the server which serves it
+type listener struct {
+	config   *ListenerConfig
+	server   *http.Server
+	listener net.Listener
+	// h2Streams counts the in-flight HTTP/2 requests, whose connections
+	// http.Server.Shutdown doesn't wait for
+	h2Streams int64
+}
+
+// loadListenerConfigs reads and validates the JSON listener config file. When
+// path is empty, a single listener on defaultPort is configured.
+func loadListenerConfigs(path, defaultPort string) ([]*ListenerConfig, error) {
+	if path == "" {
+		return []*ListenerConfig{{Addr: ":" + defaultPort}}, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read listener config file: %s", err)
+	}
+
+	var configs []*ListenerConfig
+	err = json.Unmarshal(data, &configs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse listener config file: %s", err)
+	}
+
+	if len(configs) == 0 {
+		return nil, fmt.Errorf("no listeners configured in %q", path)
+	}
+
+	for _, config := range configs {
+		switch config.Network {
+		case "":
+			config.Network = "tcp"
+		case "tcp", "tcp4", "tcp6":
+		default:
+			return nil, fmt.Errorf("invalid config for listener %q: unknown network %q", config.Addr, config.Network)
+		}
+
+		if (config.TLSCertFile == "") != (config.TLSKeyFile == "") {
+			return nil, fmt.Errorf("invalid config for listener %q: both tls_cert_file and tls_key_file are required", config.Addr)
+		}
+
+		if config.MaxConcurrentRequests < 0 {
+			return nil, fmt.Errorf("invalid config for listener %q: negative max_concurrent_requests", config.Addr)
+		}
+
+		if config.H2C && config.TLSCertFile != "" {
+			return nil, fmt.Errorf("invalid config for listener %q: h2c is only for listeners without TLS", config.Addr)
+		}
+	}
+
+	return configs, nil
+}
+
+type listenerContextKey struct{}
+
+// listenerFromContext returns the config of the listener which received the
+// request. Requests which didn't come through a listener get the defaults.
+func listenerFromContext(ctx context.Context) *ListenerConfig {
+	if config, ok := ctx.Value(listenerContextKey{}).(*ListenerConfig); ok {
+		return config
+	}
+	return &ListenerConfig{}
+}
+
+// isHTTP2Preface checks for the request line which starts HTTP/2 connections
+// with prior knowledge
+func isHTTP2Preface(r *http.Request) bool {
+	return r.Method == "PRI" && r.RequestURI == "*" && r.ProtoMajor == 2
+}
+
+// newListenerServer creates the server for l, passing the listener config to
+// handler through the request context. Listeners without h2c reject HTTP/2
+// prior knowledge connections right away, instead of letting the client wait
+// for a response it can parse.
+func (d *Deflator) newListenerServer(l *listener, handler http.Handler) *http.Server {
+	config := l.config
+	server := &http.Server{
+		Addr: config.Addr,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if isHTTP2Preface(r) {
+				w.Header().Set("Connection", "close")
+				writeError(w, r, newRequestError(http.StatusHTTPVersionNotSupported, ErrorCodeNotImplemented, "HTTP/2 over cleartext is not enabled"))
+				return
+			}
+			if r.ProtoMajor == 2 {
+				atomic.AddInt64(&l.h2Streams, 1)
+				defer atomic.AddInt64(&l.h2Streams, -1)
+			}
+
+			handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), listenerContextKey{}, config)))
+		}),
+		ReadTimeout:  d.serverTimeout(),
+		WriteTimeout: d.serverTimeout(),
+	}
+
+	if config.H2C {
+		// Registers the HTTP/2 server for Shutdown, which then sends GOAWAY on
+		// the h2c connections too
+		h2Server := &http2.Server{IdleTimeout: d.serverTimeout()}
+		_ = http2.ConfigureServer(server, h2Server)
+		inner := server.Handler
+		server.Handler = h2c.NewHandler(inner, h2Server)
+	}
+
+	return server
+}
+
+// Listen binds all the configured listeners to serve handler. It fails if any
+// of them can't be bound.
+func (d *Deflator) Listen(handler http.Handler) error {
+	for _, config := range d.listenerConfigs {
+		err := d.bind(config, handler)
+		if err != nil {
+			d.closeListeners()
+			return err
+		}
+	}
+
+	return nil
+}
+
+// bind adds a listener serving handler, which gets started by Serve
+func (d *Deflator) bind(config *ListenerConfig, handler http.Handler) error {
+	ln := takeInheritedListener(config.Addr)
+	if ln == nil {
+		var err error
+		ln, err = net.Listen(config.Network, config.Addr)
+		if err != nil {
+			return fmt.Errorf("failed to listen on %q: %s", config.Addr, err)
+		}
+	}
+
+	l := &listener{config: config, listener: ln}
+	l.server = d.newListenerServer(l, handler)
+	d.listeners = append(d.listeners, l)
+
+	return nil
+}
+
+func (d *Deflator) closeListeners() {
+	for _, l := range d.listeners {
+		l.listener.Close()
+	}
+	d.listeners = nil
+}
+
+// Serve serves the bound listeners in the background
+func (d *Deflator) Serve() {
+	for _, l := range d.listeners {
+		go func(l *listener) {
+			log.Infof("Listening for HTTP requests on %s", l.config.Addr)
+
+			var err error
+			if l.config.TLSCertFile != "" {
+				err = l.server.ServeTLS(l.listener, l.config.TLSCertFile, l.config.TLSKeyFile)
+			} else {
+				err = l.server.Serve(l.listener)
+			}
+			if err != http.ErrServerClosed {
+				log.Errorf("HTTP server on %s exited with error: %s", l.config.Addr, err)
+			}
+		}(l)
+	}
+}
+
+// shutdownListeners gracefully stops all the HTTP servers
+func (d *Deflator) shutdownListeners(ctx context.Context) error {
+	var firstErr error
+	for _, l := range d.listeners {
+		err := l.server.Shutdown(ctx)
+		if err == nil {
+			err = l.drainHTTP2(ctx)
+		}
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("failed to stop the HTTP server on %s: %s", l.config.Addr, err)
+		}
+	}
+	return firstErr
+}
+
+// drainHTTP2 waits for the in-flight HTTP/2 requests, after Shutdown sent
+// GOAWAY on their connections
+func (l *listener) drainHTTP2(ctx context.Context) error {
+	ticker := time.NewTicker(HTTP2DrainPollInterval)
+	defer ticker.Stop()
+
+	for atomic.LoadInt64(&l.h2Streams) > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+
+	return nil
+}
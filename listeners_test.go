@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// h2cClient speaks HTTP/2 with prior knowledge over cleartext
+var h2cClient = &http.Client{
+	Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	},
+	Timeout: 10 * time.Second,
+}
+
+// listen serves the routes of s on a local listener with config, returning
+// its base URL
+func (s *testServer) listen(config *ListenerConfig) string {
+	config.Addr, config.Network = "127.0.0.1:0", "tcp"
+	d := s.deflator
+	d.listenerConfigs = []*ListenerConfig{config}
+	err := d.Listen(d.routes())
+	if err != nil {
+		s.t.Fatalf("Failed to listen: %s", err)
+	}
+	d.Serve()
+	return "http://" + d.listeners[0].listener.Addr().String()
+}
+
+// h2cPost uploads body to key over h2c
+func (s *testServer) h2cPost(baseURL, key string, body io.Reader) *http.Response {
+	resp, err := h2cClient.Post(baseURL+s.uploadPath(TestBucket, key, "width=16"), "image/png", body)
+	if err != nil {
+		s.t.Fatalf("Failed to send the h2c upload: %s", err)
+	}
+	return resp
+}
+
+func TestH2CUpload(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.close()
+	baseURL := s.listen(&ListenerConfig{H2C: true})
+	defer s.deflator.closeListeners()
+
+	resp := s.h2cPost(baseURL, "photo.png", bytes.NewReader(testPNG(t, 32, 32)))
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.ProtoMajor != 2 {
+		t.Fatalf("Expected the upload to succeed over HTTP/2, got %d over %s", resp.StatusCode, resp.Proto)
+	}
+	if _, ok := s.fake.Object(TestBucket, "photo.png"); !ok {
+		t.Errorf("The h2c upload wasn't stored")
+	}
+}
+
+func TestH2CSizeLimit(t *testing.T) {
+	s := newTestServer(t, func(config *Config) {
+		config.MaxUploadSize = 1024
+	})
+	defer s.close()
+	baseURL := s.listen(&ListenerConfig{H2C: true})
+	defer s.deflator.closeListeners()
+
+	body := bytes.Repeat([]byte{0}, 4096)
+	for name, reader := range map[string]io.Reader{
+		"declared": bytes.NewReader(body),
+		// Without a known length, the stream has no content-length
+		"streamed": io.MultiReader(bytes.NewReader(body)),
+	} {
+		resp := s.h2cPost(baseURL, "photo.png", reader)
+		if resp.ProtoMajor != 2 {
+			t.Errorf("%s: expected an HTTP/2 response, got %s", name, resp.Proto)
+		}
+		if code := decodeError(t, resp, http.StatusRequestEntityTooLarge).Code; code != ErrorCodePayloadTooLarge {
+			t.Errorf("%s: expected the %s code, got %s", name, ErrorCodePayloadTooLarge, code)
+		}
+	}
+	if keys := s.fake.Keys(TestBucket); len(keys) != 0 {
+		t.Errorf("Expected nothing to be stored, got %q", keys)
+	}
+}
+
+func TestH2CDisabled(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.close()
+	baseURL := s.listen(&ListenerConfig{})
+	defer s.deflator.closeListeners()
+
+	conn, err := net.Dial("tcp", baseURL[len("http://"):])
+	if err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	_, err = conn.Write([]byte(http2.ClientPreface))
+	if err != nil {
+		t.Fatalf("Failed to send the HTTP/2 preface: %s", err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("Expected an immediate HTTP/1.1 response, got %s", err)
+	}
+	if code := decodeError(t, resp, http.StatusHTTPVersionNotSupported).Code; code != ErrorCodeNotImplemented {
+		t.Errorf("Expected the %s code, got %s", ErrorCodeNotImplemented, code)
+	}
+}
+
+func TestH2CShutdownDrains(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.close()
+
+	started, release := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	s.fake.SetFault(func(r *http.Request) int {
+		if r.Method == http.MethodPut {
+			once.Do(func() { close(started) })
+			<-release
+		}
+		return 0
+	})
+	baseURL := s.listen(&ListenerConfig{H2C: true})
+
+	responses := make(chan *http.Response, 1)
+	go func() {
+		resp, err := h2cClient.Post(baseURL+s.uploadPath(TestBucket, "photo.png", "width=16"), "image/png", bytes.NewReader(testPNG(t, 32, 32)))
+		if err != nil {
+			t.Errorf("The in-flight h2c upload failed: %s", err)
+			close(responses)
+			return
+		}
+		responses <- resp
+	}()
+
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("The upload never reached S3")
+	}
+
+	stopped := make(chan error, 1)
+	go func() {
+		ctx, done := context.WithTimeout(context.Background(), 10*time.Second)
+		defer done()
+		stopped <- s.deflator.shutdownListeners(ctx)
+	}()
+
+	select {
+	case err := <-stopped:
+		t.Fatalf("The shutdown didn't wait for the HTTP/2 upload: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	resp, ok := <-responses
+	if !ok {
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected the in-flight upload to complete, got %d", resp.StatusCode)
+	}
+	if err := <-stopped; err != nil {
+		t.Errorf("Failed to shut down: %s", err)
+	}
+}
+
+func TestPlainPutCORS(t *testing.T) {
+	for _, plainPut := range []bool{false, true} {
+		s := newTestServer(t, nil)
+		baseURL := s.listen(&ListenerConfig{PlainPut: plainPut})
+
+		r, err := http.NewRequest(http.MethodOptions, baseURL+"/"+TestBucket+"/photo.png", nil)
+		if err != nil {
+			t.Fatalf("Failed to create the request: %s", err)
+		}
+		r.Header.Set("Access-Control-Request-Method", http.MethodPut)
+		resp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatalf("Failed to send the preflight request: %s", err)
+		}
+		resp.Body.Close()
+
+		// Browsers can only send the plain PUT uploads the listener accepts
+		methods := resp.Header.Get("Access-Control-Allow-Methods")
+		if allowed := strings.Contains(methods, http.MethodPut); allowed != plainPut {
+			t.Errorf("Expected PUT to be allowed only with plain PUT (%t), got %q", plainPut, methods)
+		}
+		if !strings.Contains(methods, http.MethodGet) {
+			t.Errorf("Expected GET to be allowed, got %q", methods)
+		}
+
+		s.deflator.closeListeners()
+		s.close()
+	}
+}
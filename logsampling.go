@@ -0,0 +1,200 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// LogSamplingMaxClasses caps how many (class, bucket) pairs get sampled
+	// separately in an interval, and counted separately in the metrics. The
+	// pairs past it share the LogSamplingOverflow class.
+	LogSamplingMaxClasses = 1000
+	// LogSamplingOverflow is the class of the lines past LogSamplingMaxClasses
+	LogSamplingOverflow = "other"
+
+	// logClassLength is how much of a normalized message makes its class
+	logClassLength = 80
+	// logSuppressedField marks the entries the sampling drops
+	logSuppressedField = "log_sampling_suppressed"
+	// logSummaryField carries the suppressed count of the summary lines,
+	// which aren't sampled themselves
+	logSummaryField = "suppressed"
+)
+
+var (
+	// suppressedLogs counts the log lines dropped by the sampling by class,
+	// as `<class>|<bucket>`, and in total
+	suppressedLogs = expvar.NewMap("suppressed_logs")
+
+	// logClassValues matches the parts of the messages which vary between
+	// lines of the same class: quoted values and numbers, but not the digits
+	// of words like `s3`
+	logClassValues = regexp.MustCompile(`"(?:[^"\\]|\\.)*"|\b[0-9]+(?:\.[0-9]+)?\b`)
+)
+
+// logClass returns the class of message, i.e. its start without the values
+func logClass(message string) string {
+	class := logClassValues.ReplaceAllStringFunc(message, func(value string) string {
+		if strings.HasPrefix(value, `"`) {
+			return `"*"`
+		}
+		return "#"
+	})
+	if len(class) > logClassLength {
+		class = class[:logClassLength]
+	}
+	return class
+}
+
+// logSampleKey identifies the lines which are sampled together
+type logSampleKey struct {
+	class  string
+	bucket string
+}
+
+// logSampler is a logrus hook which logs the first lines of each class and
+// bucket in every interval, marking the following ones for sampledFormatter
+// to drop and counting them. The counts are logged as summary lines at the
+// end of the interval. Hooks can't log themselves, since they run with the
+// logger locked, so the summaries come from their own goroutine.
+type logSampler struct {
+	first    int
+	interval time.Duration
+
+	mu         sync.Mutex
+	counts     map[logSampleKey]int
+	suppressed map[logSampleKey]int
+	// metrics remembers the classes which have a count in suppressedLogs,
+	// which lives longer than the intervals
+	metrics map[string]bool
+}
+
+func newLogSampler(first int, interval time.Duration) *logSampler {
+	return &logSampler{
+		first:      first,
+		interval:   interval,
+		counts:     make(map[logSampleKey]int),
+		suppressed: make(map[logSampleKey]int),
+		metrics:    make(map[string]bool),
+	}
+}
+
+// Levels only includes the warnings, which repeat when something fails. The
+// info lines, which include the access logs, and the errors and above are
+// never sampled.
+func (s *logSampler) Levels() []log.Level {
+	return []log.Level{log.WarnLevel}
+}
+
+func (s *logSampler) Fire(entry *log.Entry) error {
+	if _, ok := entry.Data[logSummaryField]; ok {
+		return nil
+	}
+
+	key := logSampleKey{class: logClass(entry.Message)}
+	if bucket, ok := entry.Data["bucket"].(string); ok {
+		key.bucket = bucket
+	}
+
+	s.mu.Lock()
+	if _, ok := s.counts[key]; !ok && len(s.counts) >= LogSamplingMaxClasses {
+		key = logSampleKey{class: LogSamplingOverflow}
+	}
+	s.counts[key]++
+	drop := s.counts[key] > s.first
+	metric := key.class + "|" + key.bucket
+	if drop {
+		s.suppressed[key]++
+		if !s.metrics[metric] && len(s.metrics) >= LogSamplingMaxClasses {
+			metric = LogSamplingOverflow + "|"
+		}
+		s.metrics[metric] = true
+	}
+	s.mu.Unlock()
+
+	if !drop {
+		return nil
+	}
+	suppressedLogs.Add("total", 1)
+	suppressedLogs.Add(metric, 1)
+
+	// The data of an entry can be shared with other entries, but the entry
+	// itself is a copy
+	data := make(log.Fields, len(entry.Data)+1)
+	for name, value := range entry.Data {
+		data[name] = value
+	}
+	data[logSuppressedField] = true
+	entry.Data = data
+	return nil
+}
+
+// run logs the summaries of the suppressed lines at the end of every
+// interval, in a stable order
+func (s *logSampler) run() {
+	for range time.Tick(s.interval) {
+		s.mu.Lock()
+		suppressed := s.suppressed
+		s.counts = make(map[logSampleKey]int)
+		s.suppressed = make(map[logSampleKey]int)
+		s.mu.Unlock()
+
+		keys := make([]logSampleKey, 0, len(suppressed))
+		for key := range suppressed {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			if keys[i].class != keys[j].class {
+				return keys[i].class < keys[j].class
+			}
+			return keys[i].bucket < keys[j].bucket
+		})
+		for _, key := range keys {
+			fields := log.Fields{logSummaryField: suppressed[key]}
+			if key.bucket != "" {
+				fields["bucket"] = key.bucket
+			}
+			log.WithFields(fields).Warnf("Suppressed %d log lines like %q in the last %s", suppressed[key], key.class, s.interval)
+		}
+	}
+}
+
+// sampledFormatter drops the entries marked by logSampler
+type sampledFormatter struct {
+	log.Formatter
+}
+
+func (f *sampledFormatter) Format(entry *log.Entry) ([]byte, error) {
+	if _, ok := entry.Data[logSuppressedField]; ok {
+		return nil, nil
+	}
+	return f.Formatter.Format(entry)
+}
+
+// configureLogSampling installs the log sampling on the standard logger,
+// unless LogSampleFirst is zero
+func configureLogSampling(config *Config) error {
+	if config.LogSampleFirst < 0 {
+		return fmt.Errorf("invalid log sampling count %d", config.LogSampleFirst)
+	}
+	if config.LogSampleFirst == 0 {
+		return nil
+	}
+	if config.LogSampleInterval <= 0 {
+		return fmt.Errorf("invalid log sampling interval %s", config.LogSampleInterval)
+	}
+
+	sampler := newLogSampler(config.LogSampleFirst, config.LogSampleInterval)
+	log.AddHook(sampler)
+	log.SetFormatter(&sampledFormatter{log.StandardLogger().Formatter})
+	go sampler.run()
+	return nil
+}
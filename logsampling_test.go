@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// newSampledLogger returns a logger sampling the first line of each class,
+// and its output
+func newSampledLogger() (*log.Logger, *bytes.Buffer) {
+	var out bytes.Buffer
+	logger := log.New()
+	logger.Out = &out
+	logger.Level = log.DebugLevel
+	logger.Formatter = &sampledFormatter{&log.TextFormatter{DisableTimestamp: true}}
+	logger.AddHook(newLogSampler(1, time.Minute))
+	return logger, &out
+}
+
+func TestLogSampling(t *testing.T) {
+	logger, out := newSampledLogger()
+	for i := 0; i < 3; i++ {
+		logger.WithField("bucket", TestBucket).Warnf("Failed to upload %q: %d", "photo.png", i)
+		logger.Errorf("Failed to store %q", "photo.png")
+	}
+
+	if n := strings.Count(out.String(), "Failed to upload"); n != 1 {
+		t.Errorf("Expected only the first warning to be logged, got %d in %s", n, out)
+	}
+	if n := strings.Count(out.String(), "Failed to store"); n != 3 {
+		t.Errorf("Expected all the errors to be logged, got %d in %s", n, out)
+	}
+}
+
+func TestLogSamplingInfo(t *testing.T) {
+	logger, out := newSampledLogger()
+	// Like the access logs of the requests
+	for i := 0; i < 3; i++ {
+		logger.Infof("Received %s request from %s: %s", "POST", "10.0.0.1", "/test-bucket/photo.png")
+		logger.Debugf("Uploading %q", "photo.png")
+	}
+
+	if n := strings.Count(out.String(), "Received POST request"); n != 3 {
+		t.Errorf("Expected all the info lines to be logged, got %d in %s", n, out)
+	}
+	if n := strings.Count(out.String(), "Uploading"); n != 3 {
+		t.Errorf("Expected all the debug lines to be logged, got %d in %s", n, out)
+	}
+}
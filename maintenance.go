@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// AdminMaintenancePath is the admin endpoint of the maintenance mode
+	AdminMaintenancePath = "/admin/maintenance"
+
+	// Sources of the maintenance windows
+	MaintenanceSourceAdmin    = "admin"
+	MaintenanceSourceBreakers = "breakers"
+
+	// maintenanceCheckInterval is how often the tripped buckets are counted
+	maintenanceCheckInterval = 5 * time.Second
+)
+
+// maintenanceWindow is a period during which the requests to its buckets,
+// or all of them, are rejected without calling S3
+type maintenanceWindow struct {
+	Source string    `json:"source"`
+	Since  time.Time `json:"since"`
+	Until  time.Time `json:"until"`
+	// Buckets are the affected buckets, empty for all of them
+	Buckets []string `json:"buckets,omitempty"`
+	// Tripped are the buckets which activated a MaintenanceSourceBreakers
+	// window
+	Tripped []string `json:"tripped,omitempty"`
+}
+
+// affects checks whether the window applies to bucket
+func (w *maintenanceWindow) affects(bucket string) bool {
+	if len(w.Buckets) == 0 {
+		return true
+	}
+	for _, affected := range w.Buckets {
+		if affected == bucket {
+			return true
+		}
+	}
+	return false
+}
+
+// maintenanceMode holds the current maintenance window, if any. It lives as
+// long as the process, so it's kept across the config reloads but not the
+// restarts.
+type maintenanceMode struct {
+	clock Clock
+
+	mu     sync.Mutex
+	window *maintenanceWindow
+}
+
+func newMaintenanceMode(clock Clock) *maintenanceMode {
+	return &maintenanceMode{clock: clock}
+}
+
+// current returns the active window, expiring it first if it's over
+func (m *maintenanceMode) current() *maintenanceWindow {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.window != nil && !m.clock.Now().Before(m.window.Until) {
+		auditMaintenance("maintenance_deactivated", m.window, log.Fields{"reason": "expired"})
+		m.window = nil
+	}
+	return m.window
+}
+
+// activate replaces the current window, if any, with window
+func (m *maintenanceMode) activate(window *maintenanceWindow, fields log.Fields) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.window = window
+	log.Warnf("Maintenance mode activated by %s until %s", window.Source, window.Until.Format(time.RFC3339))
+	auditMaintenance("maintenance_activated", window, fields)
+}
+
+// deactivate ends the current window, returning false if there was none
+func (m *maintenanceMode) deactivate(fields log.Fields) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.window == nil {
+		return false
+	}
+	log.Warnf("Maintenance mode deactivated")
+	auditMaintenance("maintenance_deactivated", m.window, fields)
+	m.window = nil
+	return true
+}
+
+// auditMaintenance records a change of the maintenance window in the audit
+// log
+func auditMaintenance(action string, window *maintenanceWindow, fields log.Fields) {
+	auditFields := log.Fields{
+		"source": window.Source,
+		"since":  window.Since.Format(time.RFC3339),
+		"until":  window.Until.Format(time.RFC3339),
+	}
+	if len(window.Buckets) > 0 {
+		auditFields["buckets"] = window.Buckets
+	}
+	if len(window.Tripped) > 0 {
+		auditFields["tripped"] = window.Tripped
+	}
+	for name, value := range fields {
+		auditFields[name] = value
+	}
+	audit(action, auditFields)
+}
+
+// checkMaintenance rejects the requests to bucket during a maintenance
+// window with 503, and the end of the window as their Retry-After
+func (d *Deflator) checkMaintenance(bucket string) error {
+	window := d.maintenance.current()
+	if window == nil || !window.affects(bucket) {
+		return nil
+	}
+
+	log.Debugf("Rejecting the request to bucket %q during the maintenance", bucket)
+	err := newRequestError(http.StatusServiceUnavailable, ErrorCodeStorageMaintenance, "Storage under maintenance")
+	err.retryAfter = window.Until.Sub(d.clock.Now())
+	return err
+}
+
+// maintenanceCheck describes the active maintenance window on /readyz. It
+// doesn't fail the readiness, since every instance is in the same state.
+func (d *Deflator) maintenanceCheck() (checkResult, bool) {
+	window := d.maintenance.current()
+	if window == nil {
+		return checkResult{}, false
+	}
+	return checkResult{Name: "maintenance", Detail: window}, true
+}
+
+// RunMaintenanceWatch activates the maintenance mode for all the buckets
+// for MaintenanceAutoDuration when more than MaintenanceAutoBuckets buckets
+// get tripped by MaintenanceTripThreshold throttled uploads in a row. The
+// buckets are reset on activation, so they have to trip again once the
+// window is over to extend it.
+func (d *Deflator) RunMaintenanceWatch(ctx context.Context) {
+	ticker := time.NewTicker(maintenanceCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if d.maintenance.current() != nil {
+			continue
+		}
+		tripped := d.concurrency.trippedBuckets(d.config.MaintenanceTripThreshold)
+		if len(tripped) <= d.config.MaintenanceAutoBuckets {
+			continue
+		}
+
+		now := d.clock.Now()
+		d.concurrency.resetTripped()
+		d.maintenance.activate(&maintenanceWindow{
+			Source:  MaintenanceSourceBreakers,
+			Since:   now,
+			Until:   now.Add(d.config.MaintenanceAutoDuration),
+			Tripped: tripped,
+		}, nil)
+	}
+}
+
+// maintenanceRequest is the body of the POST requests to the maintenance
+// endpoint
+type maintenanceRequest struct {
+	// Duration is how long the maintenance lasts, e.g. `15m`
+	Duration string `json:"duration"`
+	// Buckets restricts the maintenance to some buckets
+	Buckets []string `json:"buckets"`
+}
+
+// maintenanceHandler describes the maintenance window (GET), activates one
+// (POST) or ends it (DELETE)
+func (d *Deflator) maintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost, http.MethodDelete:
+		if !d.isAdminAuthorized(r) {
+			writeError(w, r, newRequestError(http.StatusForbidden, ErrorCodeForbidden, "Forbidden"))
+			return
+		}
+	default:
+		writeError(w, r, newRequestError(http.StatusMethodNotAllowed, ErrorCodeMethodNotAllowed, "Method not allowed"))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		var req maintenanceRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			writeError(w, r, newRequestError(http.StatusBadRequest, ErrorCodeInvalidParameter, "Invalid maintenance request"))
+			return
+		}
+		duration, err := time.ParseDuration(req.Duration)
+		if err != nil || duration <= 0 || duration > d.config.MaintenanceMaxDuration {
+			writeError(w, r, newRequestError(
+				http.StatusBadRequest, ErrorCodeInvalidParameter,
+				"Invalid duration %q (maximum: %s)", req.Duration, d.config.MaintenanceMaxDuration,
+			))
+			return
+		}
+		for _, bucket := range req.Buckets {
+			if bucket == "" {
+				writeError(w, r, newRequestError(http.StatusBadRequest, ErrorCodeInvalidBucket, "Invalid bucket %q", bucket))
+				return
+			}
+		}
+
+		now := d.clock.Now()
+		d.maintenance.activate(&maintenanceWindow{
+			Source:  MaintenanceSourceAdmin,
+			Since:   now,
+			Until:   now.Add(duration),
+			Buckets: req.Buckets,
+		}, log.Fields{"client_ip": d.clientIP(r)})
+	case http.MethodDelete:
+		if !d.maintenance.deactivate(log.Fields{"reason": "admin", "client_ip": d.clientIP(r)}) {
+			writeError(w, r, newRequestError(http.StatusNotFound, ErrorCodeNotFound, "No maintenance in progress"))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	window := d.maintenance.current()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		Active bool               `json:"active"`
+		Window *maintenanceWindow `json:"window,omitempty"`
+	}{Active: window != nil, Window: window})
+}
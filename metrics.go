@@ -0,0 +1,73 @@
+package main
+
+import (
+	"expvar"
+	"strings"
+)
+
+// MetricBucketOther stands for the buckets missing from the metric buckets
+const MetricBucketOther = "other"
+
+// Metrics are published via expvar on /debug/vars
+var (
+	// ipBlocksByList counts the requests blocked by the IP allowlist or denylist
+	ipBlocksByList = expvar.NewMap("ip_blocks")
+)
+
+// metricBuckets are the bucket names the metrics can be labeled with, so
+// the clients can't add new entries by sending requests to random buckets
+var metricBuckets = map[string]bool{}
+
+// setMetricBuckets sets the metric buckets: the MetricBuckets setting, or
+// the buckets of the AllowedDestinations and of the bucket config file
+func setMetricBuckets(config *Config, buckets map[string]*BucketConfig) {
+	allowed := map[string]bool{}
+	if len(config.MetricBuckets) > 0 {
+		for _, bucket := range config.MetricBuckets {
+			allowed[bucket] = true
+		}
+	} else {
+		for _, entry := range config.AllowedDestinations {
+			allowed[strings.SplitN(entry, "/", 2)[0]] = true
+		}
+		for bucket := range buckets {
+			allowed[bucket] = true
+		}
+	}
+	metricBuckets = allowed
+}
+
+// bucketLabel is how bucket appears in the metrics: its name, or the one of
+// its access point, if it's a metric bucket, MetricBucketOther otherwise
+func bucketLabel(bucket string) (string, bool) {
+	name := accessPointName(bucket)
+	if metricBuckets[name] {
+		return name, true
+	}
+	return MetricBucketOther, false
+}
+
+// bucketMap is an expvar map whose entries are labeled with a bucket. The
+// labels only go through bucketLabel, and none of its entries has an object
+// key.
+type bucketMap struct {
+	m *expvar.Map
+}
+
+func newBucketMap(name string) *bucketMap {
+	return &bucketMap{m: expvar.NewMap(name)}
+}
+
+// add adds delta to the `<prefix><bucket><suffix>` entry
+func (b *bucketMap) add(prefix, bucket, suffix string, delta int64) {
+	label, _ := bucketLabel(bucket)
+	b.m.Add(prefix+label+suffix, delta)
+}
+
+// set publishes v as the entry of bucket. The buckets which aren't metric
+// buckets aren't published, since they'd all share the same entry.
+func (b *bucketMap) set(bucket string, v expvar.Var) {
+	if label, ok := bucketLabel(bucket); ok {
+		b.m.Set(label, v)
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/s3manager"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Values of ObjectLimitPolicy, for the object attributes over an S3 limit
+	ObjectLimitsReject   = "reject"
+	ObjectLimitsTruncate = "truncate"
+
+	// MaxMetadataSize is the S3 limit on the user-defined metadata of an
+	// object, counting the bytes of its names and values
+	MaxMetadataSize = 2048
+	// MaxObjectTags is how many tags S3 accepts per object, with keys of up
+	// to MaxTagKeyLength characters and values of up to MaxTagValueLength
+	MaxObjectTags     = 10
+	MaxTagKeyLength   = 128
+	MaxTagValueLength = 256
+	// MaxObjectHeaderLength bounds the Cache-Control and Content-Disposition
+	// of the objects, which S3 only limits through the 8KB of the request
+	// headers, shared with the metadata and the signature
+	MaxObjectHeaderLength = 1024
+)
+
+// validateObjectLimitPolicy checks the ObjectLimitPolicy setting
+func validateObjectLimitPolicy(policy string) error {
+	switch policy {
+	case ObjectLimitsReject, ObjectLimitsTruncate:
+		return nil
+	}
+	return fmt.Errorf("invalid object limit policy %q (expected %s or %s)", policy, ObjectLimitsReject, ObjectLimitsTruncate)
+}
+
+// truncateString cuts value to at most length bytes, or characters with
+// runes, without splitting a character
+func truncateString(value string, length int, runes bool) string {
+	if !runes {
+		for len(value) > length {
+			_, size := utf8.DecodeLastRuneInString(value)
+			value = value[:len(value)-size]
+		}
+		return value
+	}
+	for i := range value {
+		if length == 0 {
+			return value[:i]
+		}
+		length--
+	}
+	return value
+}
+
+// limitMetadata returns metadata within MaxMetadataSize. With truncate, the
+// values of the truncatable names get shortened, the last ones by name
+// first, and dropped when nothing is left of them. The other entries, like
+// the encryption metadata, are never touched, so they alone can still make
+// the metadata too large. metadata itself isn't modified.
+func limitMetadata(metadata map[string]string, truncatable map[string]string, policy string) (map[string]string, bool, error) {
+	size := 0
+	for name, value := range metadata {
+		size += len(name) + len(value)
+	}
+	if size <= MaxMetadataSize {
+		return metadata, false, nil
+	}
+	tooLarge := newRequestError(
+		http.StatusBadRequest, ErrorCodeMetadataTooLarge,
+		"Object metadata too large (%d bytes, maximum: %d bytes)", size, MaxMetadataSize,
+	)
+	if policy != ObjectLimitsTruncate {
+		return nil, false, tooLarge
+	}
+
+	names := make([]string, 0, len(truncatable))
+	for name := range truncatable {
+		if _, ok := metadata[name]; ok {
+			names = append(names, name)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+
+	limited := make(map[string]string, len(metadata))
+	for name, value := range metadata {
+		limited[name] = value
+	}
+	for _, name := range names {
+		excess := size - MaxMetadataSize
+		if excess <= 0 {
+			break
+		}
+		value := limited[name]
+		if excess >= len(value) {
+			delete(limited, name)
+			size -= len(name) + len(value)
+			continue
+		}
+		truncated := truncateString(value, len(value)-excess, false)
+		limited[name] = truncated
+		size -= len(value) - len(truncated)
+	}
+	if size > MaxMetadataSize {
+		return nil, false, tooLarge
+	}
+	return limited, true, nil
+}
+
+// limitTagging checks the URL encoded tag set against the S3 limits. With
+// truncate, the keys and values which are too long get shortened, but
+// extra tags are still rejected, since none of them is more expendable.
+func limitTagging(tagging string, policy string) (string, bool, error) {
+	tags, err := url.ParseQuery(tagging)
+	if err != nil {
+		return "", false, newRequestError(http.StatusBadRequest, ErrorCodeObjectLimitExceeded, "Invalid object tags: %s", err)
+	}
+	if len(tags) > MaxObjectTags {
+		return "", false, newRequestError(http.StatusBadRequest, ErrorCodeObjectLimitExceeded, "Too many object tags (%d, maximum: %d)", len(tags), MaxObjectTags)
+	}
+
+	truncated := false
+	limited := make(url.Values, len(tags))
+	for key, values := range tags {
+		if len(values) > 1 {
+			return "", false, newRequestError(http.StatusBadRequest, ErrorCodeObjectLimitExceeded, "Repeated object tag %q", key)
+		}
+		value := values[0]
+		if utf8.RuneCountInString(key) > MaxTagKeyLength || utf8.RuneCountInString(value) > MaxTagValueLength {
+			if policy != ObjectLimitsTruncate {
+				return "", false, newRequestError(
+					http.StatusBadRequest, ErrorCodeObjectLimitExceeded,
+					"Object tag %q too long (maximum: %d characters for keys, %d for values)", key, MaxTagKeyLength, MaxTagValueLength,
+				)
+			}
+			key = truncateString(key, MaxTagKeyLength, true)
+			value = truncateString(value, MaxTagValueLength, true)
+			truncated = true
+		}
+		if _, ok := limited[key]; ok {
+			return "", false, newRequestError(http.StatusBadRequest, ErrorCodeObjectLimitExceeded, "Repeated object tag %q", key)
+		}
+		limited.Set(key, value)
+	}
+	if !truncated {
+		return tagging, false, nil
+	}
+	return limited.Encode(), true, nil
+}
+
+// limitHeader checks the value of the object header name, which must be
+// printable ASCII of up to MaxObjectHeaderLength bytes. With truncate, longer
+// values get shortened.
+func limitHeader(name, value string, policy string) (string, bool, error) {
+	if strings.IndexFunc(value, func(r rune) bool { return r < ' ' || r > '~' }) >= 0 {
+		return "", false, newRequestError(http.StatusBadRequest, ErrorCodeObjectLimitExceeded, "Invalid %s: only printable ASCII is allowed", name)
+	}
+	if len(value) <= MaxObjectHeaderLength {
+		return value, false, nil
+	}
+	if policy != ObjectLimitsTruncate {
+		return "", false, newRequestError(
+			http.StatusBadRequest, ErrorCodeObjectLimitExceeded,
+			"%s too long (%d bytes, maximum: %d bytes)", name, len(value), MaxObjectHeaderLength,
+		)
+	}
+	return value[:MaxObjectHeaderLength], true, nil
+}
+
+// limitObjectMetadata applies the ObjectLimitPolicy to metadata, whose echo
+// headers of req are the only entries which can be truncated
+func (d *Deflator) limitObjectMetadata(ctx context.Context, req *uploadRequest, metadata map[string]string) (map[string]string, error) {
+	limited, truncated, err := limitMetadata(metadata, req.echo, d.config.ObjectLimitPolicy)
+	if err != nil {
+		log.Debugf("Metadata too large for URL %q", req.location())
+		return nil, err
+	}
+	if truncated {
+		log.Debugf("Truncated the metadata of URL %q", req.location())
+		addWarning(ctx, req.bucket, WarningObjectAttributesTruncated)
+	}
+	return limited, nil
+}
+
+// limitUploadInput checks the metadata, tags, Cache-Control and
+// Content-Disposition of input against the S3 limits before anything gets
+// uploaded, since S3 only rejects them once the body was sent, applying the
+// ObjectLimitPolicy. Every upload of the pipeline goes through it, whatever
+// the API of its request.
+func (d *Deflator) limitUploadInput(ctx context.Context, req *uploadRequest, input *s3manager.UploadInput) error {
+	policy := d.config.ObjectLimitPolicy
+	var err error
+	if len(input.Metadata) > 0 {
+		input.Metadata, err = d.limitObjectMetadata(ctx, req, input.Metadata)
+		if err != nil {
+			return err
+		}
+	}
+
+	truncated := false
+	if input.Tagging != nil {
+		var tagsTruncated bool
+		var tagging string
+		tagging, tagsTruncated, err = limitTagging(aws.StringValue(input.Tagging), policy)
+		if err != nil {
+			log.Debugf("Invalid tags for URL %q: %s", req.location(), err)
+			return err
+		}
+		input.Tagging = aws.String(tagging)
+		truncated = truncated || tagsTruncated
+	}
+
+	headers := []struct {
+		name  string
+		value **string
+	}{
+		{"Cache-Control", &input.CacheControl},
+		{"Content-Disposition", &input.ContentDisposition},
+	}
+	for _, header := range headers {
+		if *header.value == nil {
+			continue
+		}
+		var value string
+		var headerTruncated bool
+		value, headerTruncated, err = limitHeader(header.name, **header.value, policy)
+		if err != nil {
+			log.Debugf("Invalid %s for URL %q: %s", header.name, req.location(), err)
+			return err
+		}
+		*header.value = aws.String(value)
+		truncated = truncated || headerTruncated
+	}
+
+	if truncated {
+		log.Debugf("Truncated the object attributes of URL %q", req.location())
+		addWarning(ctx, req.bucket, WarningObjectAttributesTruncated)
+	}
+	return nil
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// UnknownParametersIgnore ignores query parameters which aren't options
+	UnknownParametersIgnore = "ignore"
+	// UnknownParametersReject rejects requests with unknown query parameters
+	UnknownParametersReject = "reject"
+
+	// OptionHeaderPrefix is the prefix of the headers which can carry options,
+	// e.g. `X-Imgdeflator-Width`
+	OptionHeaderPrefix = "X-Imgdeflator-"
+
+	// Values of the `response` option, which selects the upload responses
+	ResponseStyleLegacy  = "legacy"
+	ResponseStyleFull    = "full"
+	ResponseStyleJSON    = "json"
+	ResponseStyleEmpty   = "empty"
+	ResponseStyleMinimal = "minimal"
+	// ResponseStyleHeader can carry the `response` option too
+	ResponseStyleHeader = "X-Response-Style"
+)
+
+// requestOptions are the normalized options of a request. Zero values mean
+// that an option isn't set.
+type requestOptions struct {
+	width  uint64
+	height uint64
+	format string
+	ttl    uint64
+	soft   bool
+	// keepOriginal stores the untouched upload next to the processed object
+	keepOriginal bool
+	// responseStyle selects the response to successful uploads
+	responseStyle string
+	// echoImage returns the processed image in the response body
+	echoImage bool
+	// skipVerify opts out of the verification of the stored object
+	skipVerify bool
+	// collision is the strategy for keys which are already taken
+	collision string
+	// profile is the name of the applied transform profile
+	profile string
+	// maxInputBytes and maxStoredBytes are the size limits set by the profile
+	maxInputBytes  int64
+	maxStoredBytes int64
+	// source is the object copy-transform requests read the image from
+	source *transformSource
+	// siblings are the formats of the variants stored next to the object.
+	// Nil leaves the bucket default, empty disables it.
+	siblings []string
+	// stripMetadata drops the metadata of the image, like EXIF or ICC
+	stripMetadata bool
+
+	// The caption options, rendered with the configured font
+	text         string
+	textPosition string
+	textSize     uint64
+	textColor    string
+	textFont     string
+
+	// redactions are the `redact` regions, in source pixels
+	redactions []redactRegion
+}
+
+// optionParser validates and normalizes the value of an option
+type optionParser func(d *Deflator, options *requestOptions, name, value string) error
+
+// optionParsers lists the known options
+var optionParsers = map[string]optionParser{
+	"width":  parseDimensionOption,
+	"height": parseDimensionOption,
+	"format": parseFormatOption,
+	"ttl":    parseTTLOption,
+	"soft":   parseSoftOption,
+	// The timeout is handled by timeoutHandler
+	"timeout": parseTimeoutOption,
+	// The profile is applied by parseOptions
+	"profile": parseProfileOption,
+
+	"keep_original": parseKeepOriginalOption,
+	"response":      parseResponseOption,
+	"echo":          parseEchoOption,
+	"collision":     parseCollisionOption,
+	"source":        parseSourceOption,
+	"verify":        parseVerifyOption,
+	"siblings":      parseSiblingsOption,
+	"strip":         parseStripOption,
+
+	"text":          parseTextOption,
+	"text_position": parseTextPositionOption,
+	"text_size":     parseTextSizeOption,
+	"text_color":    parseTextColorOption,
+
+	"redact": parseRedactOption,
+}
+
+// repeatableOptions can be specified several times, the parser being called
+// for each value
+var repeatableOptions = map[string]bool{
+	"redact": true,
+}
+
+func parseDimensionOption(d *Deflator, options *requestOptions, name, value string) error {
+	maxValue, target := d.config.MaxWidth, &options.width
+	if name == "height" {
+		maxValue, target = d.config.MaxHeight, &options.height
+	}
+
+	parsed, err := strconv.ParseUint(value, 10, 32)
+	if err != nil || parsed > maxValue {
+		return newRequestError(http.StatusBadRequest, ErrorCodeInvalidDimensions, "Invalid %s %q (max: %d)", name, value, maxValue)
+	}
+	*target = parsed
+
+	return nil
+}
+
+func parseFormatOption(d *Deflator, options *requestOptions, name, value string) error {
+	if _, ok := outputFormats[value]; !ok && value != FormatAuto {
+		return newRequestError(http.StatusBadRequest, ErrorCodeInvalidFormat, "Invalid format %q", value)
+	}
+	options.format = value
+
+	return nil
+}
+
+func parseTTLOption(d *Deflator, options *requestOptions, name, value string) error {
+	parsed, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return newRequestError(http.StatusBadRequest, ErrorCodeInvalidTTL, "Invalid ttl %q", value)
+	}
+	options.ttl = parsed
+
+	return nil
+}
+
+func parseSoftOption(d *Deflator, options *requestOptions, name, value string) error {
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return newRequestError(http.StatusBadRequest, ErrorCodeInvalidParameter, "Invalid %s %q", name, value)
+	}
+	options.soft = parsed
+
+	return nil
+}
+
+func parseTimeoutOption(d *Deflator, options *requestOptions, name, value string) error {
+	return nil
+}
+
+func parseProfileOption(d *Deflator, options *requestOptions, name, value string) error {
+	return nil
+}
+
+func parseKeepOriginalOption(d *Deflator, options *requestOptions, name, value string) error {
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return newRequestError(http.StatusBadRequest, ErrorCodeInvalidParameter, "Invalid %s %q", name, value)
+	}
+	options.keepOriginal = parsed
+
+	return nil
+}
+
+func parseEchoOption(d *Deflator, options *requestOptions, name, value string) error {
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return newRequestError(http.StatusBadRequest, ErrorCodeInvalidParameter, "Invalid %s %q", name, value)
+	}
+	options.echoImage = parsed
+
+	return nil
+}
+
+func parseVerifyOption(d *Deflator, options *requestOptions, name, value string) error {
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return newRequestError(http.StatusBadRequest, ErrorCodeInvalidParameter, "Invalid %s %q", name, value)
+	}
+	options.skipVerify = !parsed
+
+	return nil
+}
+
+func parseSizeLimitOption(d *Deflator, options *requestOptions, name, value string) error {
+	parsed, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || parsed <= 0 {
+		return newRequestError(http.StatusBadRequest, ErrorCodeInvalidParameter, "Invalid %s %q", name, value)
+	}
+	if name == "max_input_bytes" {
+		options.maxInputBytes = parsed
+	} else {
+		options.maxStoredBytes = parsed
+	}
+
+	return nil
+}
+
+func parseResponseOption(d *Deflator, options *requestOptions, name, value string) error {
+	if !isResponseStyle(value) {
+		return newRequestError(http.StatusBadRequest, ErrorCodeInvalidParameter, "Invalid %s %q", name, value)
+	}
+	options.responseStyle = value
+
+	return nil
+}
+
+func parseCollisionOption(d *Deflator, options *requestOptions, name, value string) error {
+	if !isCollisionStrategy(value) {
+		return newRequestError(http.StatusBadRequest, ErrorCodeInvalidParameter, "Invalid %s %q", name, value)
+	}
+	options.collision = value
+
+	return nil
+}
+
+func isResponseStyle(value string) bool {
+	switch value {
+	case ResponseStyleLegacy, ResponseStyleFull, ResponseStyleJSON, ResponseStyleEmpty, ResponseStyleMinimal:
+		return true
+	default:
+		return false
+	}
+}
+
+func parseTextOption(d *Deflator, options *requestOptions, name, value string) error {
+	if d.config.TextFont == "" {
+		return newRequestError(http.StatusNotImplemented, ErrorCodeNotImplemented, "Text overlays are not enabled")
+	}
+
+	text := sanitizeText(value)
+	if !utf8.ValidString(text) || strings.TrimSpace(text) == "" {
+		return newRequestError(http.StatusBadRequest, ErrorCodeInvalidParameter, "Invalid %s", name)
+	}
+	if length := utf8.RuneCountInString(text); length > d.config.TextMaxLength {
+		return newRequestError(http.StatusBadRequest, ErrorCodeInvalidParameter, "Text too long (%d characters, limit: %d)", length, d.config.TextMaxLength)
+	}
+	options.text = text
+	options.textFont = d.config.TextFont
+
+	return nil
+}
+
+func parseTextPositionOption(d *Deflator, options *requestOptions, name, value string) error {
+	switch value {
+	case TextPositionTop, TextPositionCenter, TextPositionBottom:
+		options.textPosition = value
+		return nil
+	default:
+		return newRequestError(http.StatusBadRequest, ErrorCodeInvalidParameter, "Invalid %s %q", name, value)
+	}
+}
+
+func parseTextSizeOption(d *Deflator, options *requestOptions, name, value string) error {
+	parsed, err := strconv.ParseUint(value, 10, 32)
+	if err != nil || parsed == 0 || parsed > d.config.TextMaxSize {
+		return newRequestError(http.StatusBadRequest, ErrorCodeInvalidParameter, "Invalid %s %q (max: %d)", name, value, d.config.TextMaxSize)
+	}
+	options.textSize = parsed
+
+	return nil
+}
+
+func parseTextColorOption(d *Deflator, options *requestOptions, name, value string) error {
+	_, err := parseTextColor(value)
+	if err != nil {
+		return newRequestError(http.StatusBadRequest, ErrorCodeInvalidParameter, "Invalid %s %q", name, value)
+	}
+	options.textColor = strings.ToLower(strings.TrimPrefix(value, "#"))
+
+	return nil
+}
+
+func parseRedactOption(d *Deflator, options *requestOptions, name, value string) error {
+	if len(options.redactions) >= d.config.RedactMaxRegions {
+		return newRequestError(http.StatusBadRequest, ErrorCodeInvalidParameter, "Too many %s regions (limit: %d)", name, d.config.RedactMaxRegions)
+	}
+
+	region, err := parseRedactRegion(value)
+	if err != nil {
+		return newRequestError(http.StatusBadRequest, ErrorCodeInvalidParameter, "Invalid %s %q: %s", name, value, err)
+	}
+	options.redactions = append(options.redactions, region)
+
+	return nil
+}
+
+// singleValue returns the value of a parameter which was specified once, or
+// several times with the same value
+func singleValue(name string, values []string) (string, error) {
+	for _, value := range values[1:] {
+		if value != values[0] {
+			return "", newRequestError(http.StatusBadRequest, ErrorCodeConflictingParameter, "Conflicting values for parameter %q", name)
+		}
+	}
+	return values[0], nil
+}
+
+// newRequestOptions returns the options of a request which sets none
+func (d *Deflator) newRequestOptions() *requestOptions {
+	return &requestOptions{
+		textPosition: TextPositionBottom,
+		textSize:     d.config.TextSize,
+		textColor:    "ffffff",
+
+		responseStyle: d.config.ResponseStyle,
+	}
+}
+
+// optionValues returns the values of an option from the query string, or
+// from the headers if it's not in there
+func optionValues(name string, query url.Values, header http.Header) []string {
+	values := query[name]
+	if len(values) == 0 {
+		values = header[http.CanonicalHeaderKey(OptionHeaderPrefix+name)]
+	}
+	if len(values) == 0 && name == "response" {
+		values = header[ResponseStyleHeader]
+	}
+	return values
+}
+
+// parseOptions collects the options of a request for bucket. The query
+// string takes precedence over the `X-Imgdeflator-<Option>` headers, which
+// take precedence over the requested transform profile. Repeating an option
+// with different values in the same source is rejected, and so are unknown
+// query parameters when UnknownParameters is set to `reject`, and explicit
+// transform options for buckets with profiles_only. header may be nil for
+// requests which only have a query string, like tus uploads.
+func (d *Deflator) parseOptions(bucket string, query url.Values, header http.Header) (*requestOptions, error) {
+	for name := range query {
+		if _, ok := optionParsers[name]; !ok && d.config.UnknownParameters == UnknownParametersReject {
+			log.Debugf("Unknown parameter %q", name)
+			return nil, newRequestError(http.StatusBadRequest, ErrorCodeInvalidParameter, "Unknown parameter %q", name)
+		}
+	}
+
+	options := d.newRequestOptions()
+	var profile url.Values
+	var err error
+	options.profile, profile, err = d.selectProfile(bucket, query, header)
+	if err != nil {
+		return nil, err
+	}
+	profilesOnly := d.bucketConfig(bucket).ProfilesOnly
+
+	for name, parse := range optionParsers {
+		values := optionValues(name, query, header)
+		if len(values) > 0 && profilesOnly && profileOptions[name] {
+			log.Debugf("Explicit %s for bucket %q, which only accepts profiles", name, bucket)
+			return nil, newRequestError(http.StatusForbidden, ErrorCodeForbidden, "Parameter %q not allowed for this bucket, use a profile", name)
+		}
+		if len(values) == 0 {
+			values = profile[name]
+		}
+		if len(values) == 0 {
+			continue
+		}
+
+		if repeatableOptions[name] {
+			for _, value := range values {
+				err = parse(d, options, name, value)
+				if err != nil {
+					break
+				}
+			}
+		} else {
+			var value string
+			value, err = singleValue(name, values)
+			if err == nil {
+				err = parse(d, options, name, value)
+			}
+		}
+		if err != nil {
+			log.Debugf("Invalid options: %s", err)
+			return nil, err
+		}
+	}
+	// The limits only come from the profile, they were validated when it got
+	// loaded
+	for name, parse := range profileLimitParsers {
+		if values := profile[name]; len(values) > 0 {
+			_ = parse(d, options, name, values[0])
+		}
+	}
+	if options.profile != "" {
+		log.Debugf("Applied profile %q (%s)", options.profile, options.canonical())
+	}
+
+	return options, nil
+}
+
+// caption returns the text overlay, nil if there's none
+func (o *requestOptions) caption() *textCaption {
+	if o.text == "" {
+		return nil
+	}
+
+	color, _ := parseTextColor(o.textColor)
+	return &textCaption{
+		text:     o.text,
+		font:     o.textFont,
+		position: o.textPosition,
+		size:     o.textSize,
+		color:    color,
+	}
+}
+
+// canonical returns the options which are set in a stable form, for cache
+// keys and logging
+func (o *requestOptions) canonical() string {
+	values := url.Values{}
+	if o.width > 0 {
+		values.Set("width", strconv.FormatUint(o.width, 10))
+	}
+	if o.height > 0 {
+		values.Set("height", strconv.FormatUint(o.height, 10))
+	}
+	if o.format != "" {
+		values.Set("format", o.format)
+	}
+	if o.ttl > 0 {
+		values.Set("ttl", strconv.FormatUint(o.ttl, 10))
+	}
+	if o.soft {
+		values.Set("soft", "true")
+	}
+	if o.keepOriginal {
+		values.Set("keep_original", "true")
+	}
+	if o.collision != "" {
+		values.Set("collision", o.collision)
+	}
+	if o.siblings != nil {
+		siblings := strings.Join(o.siblings, ",")
+		if siblings == "" {
+			siblings = SiblingsNone
+		}
+		values.Set("siblings", siblings)
+	}
+	if o.stripMetadata {
+		values.Set("strip", "true")
+	}
+	if o.text != "" {
+		values.Set("text", o.text)
+		values.Set("text_position", o.textPosition)
+		values.Set("text_size", strconv.FormatUint(o.textSize, 10))
+		values.Set("text_color", o.textColor)
+	}
+	for _, region := range o.redactions {
+		values.Add("redact", fmt.Sprintf("%d,%d,%d,%d", region.X, region.Y, region.Width, region.Height))
+	}
+
+	// Encode sorts the parameters by name
+	return values.Encode()
+}
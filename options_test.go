@@ -0,0 +1,159 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newOptionsDeflator returns a Deflator with a `thumb` transform profile
+func newOptionsDeflator(t *testing.T, configure func(*Config)) (*Deflator, func()) {
+	dir, err := ioutil.TempDir("", "imgdeflator-options-test")
+	if err != nil {
+		t.Fatalf("Failed to create the profile directory: %s", err)
+	}
+	profiles := filepath.Join(dir, "profiles.json")
+	err = ioutil.WriteFile(profiles, []byte(`{"thumb": {"width": 100, "format": "webp"}}`), 0600)
+	if err != nil {
+		t.Fatalf("Failed to write the profiles: %s", err)
+	}
+
+	config := testConfig(t, "http://127.0.0.1:1")
+	config.ProfileConfigFile = profiles
+	if configure != nil {
+		configure(config)
+	}
+	d, err := NewDeflator(config, nil, nil)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("Failed to create the Deflator: %s", err)
+	}
+
+	return d, func() { os.RemoveAll(dir) }
+}
+
+func TestParseOptions(t *testing.T) {
+	d, done := newOptionsDeflator(t, nil)
+	defer done()
+
+	tests := []struct {
+		name      string
+		query     string
+		header    http.Header
+		canonical string
+	}{
+		{"none", "", nil, ""},
+		{"dimensions", "width=100&height=50", nil, "height=50&width=100"},
+		{"max dimensions", "width=4096&height=4096", nil, "height=4096&width=4096"},
+		{"repeated value", "width=100&width=100", nil, "width=100"},
+		{"format", "format=webp", nil, "format=webp"},
+		{"auto format", "format=auto", nil, "format=auto"},
+		{"bools", "soft=1&keep_original=TRUE&strip=t", nil, "keep_original=true&soft=true&strip=true"},
+		{"false bools", "soft=false&keep_original=0", nil, ""},
+		{"ttl", "ttl=3600", nil, "ttl=3600"},
+		{"collision", "collision=suffix", nil, "collision=suffix"},
+		{"unknown parameter", "width=10&utm_source=mail", nil, "width=10"},
+		{"ignored timeout", "timeout=5", nil, ""},
+		{"header", "", http.Header{"X-Imgdeflator-Width": {"100"}}, "width=100"},
+		{"query over header", "width=50", http.Header{"X-Imgdeflator-Width": {"100"}}, "width=50"},
+		{"profile", "profile=thumb", nil, "format=webp&width=100"},
+		{"query over profile", "profile=thumb&width=50", nil, "format=webp&width=50"},
+		{"header over profile", "profile=thumb", http.Header{"X-Imgdeflator-Format": {"png"}}, "format=png&width=100"},
+		{"profile header", "", http.Header{"X-Imgdeflator-Profile": {"thumb"}}, "format=webp&width=100"},
+		{"redactions", "redact=0,0,10,10&redact=5,5,10,10", nil, "redact=0%2C0%2C10%2C10&redact=5%2C5%2C10%2C10"},
+	}
+
+	for _, test := range tests {
+		query, err := url.ParseQuery(test.query)
+		if err != nil {
+			t.Fatalf("Invalid query %q: %s", test.query, err)
+		}
+
+		options, err := d.parseOptions(TestBucket, query, test.header)
+		if err != nil {
+			t.Errorf("%s: failed to parse %q: %s", test.name, test.query, err)
+			continue
+		}
+		if canonical := options.canonical(); canonical != test.canonical {
+			t.Errorf("%s: expected %q, got %q", test.name, test.canonical, canonical)
+		}
+	}
+}
+
+func TestParseOptionsErrors(t *testing.T) {
+	d, done := newOptionsDeflator(t, nil)
+	defer done()
+
+	tests := []struct {
+		name   string
+		query  string
+		header http.Header
+		status int
+		code   string
+	}{
+		{"conflicting values", "width=100&width=200", nil, http.StatusBadRequest, ErrorCodeConflictingParameter},
+		{"conflicting headers", "", http.Header{"X-Imgdeflator-Width": {"100", "200"}}, http.StatusBadRequest, ErrorCodeConflictingParameter},
+		{"conflicting profiles", "profile=thumb&profile=other", nil, http.StatusBadRequest, ErrorCodeConflictingParameter},
+		{"negative width", "width=-1", nil, http.StatusBadRequest, ErrorCodeInvalidDimensions},
+		{"width too large", "width=4097", nil, http.StatusBadRequest, ErrorCodeInvalidDimensions},
+		{"invalid height", "height=tall", nil, http.StatusBadRequest, ErrorCodeInvalidDimensions},
+		{"invalid format", "format=bmp", nil, http.StatusBadRequest, ErrorCodeInvalidFormat},
+		{"invalid ttl", "ttl=soon", nil, http.StatusBadRequest, ErrorCodeInvalidTTL},
+		{"invalid bool", "soft=maybe", nil, http.StatusBadRequest, ErrorCodeInvalidParameter},
+		{"invalid header", "", http.Header{"X-Imgdeflator-Soft": {"maybe"}}, http.StatusBadRequest, ErrorCodeInvalidParameter},
+		{"invalid response", "response=xml", nil, http.StatusBadRequest, ErrorCodeInvalidParameter},
+		{"invalid collision", "collision=rename", nil, http.StatusBadRequest, ErrorCodeInvalidParameter},
+		{"unknown profile", "profile=banner", nil, http.StatusBadRequest, ErrorCodeInvalidParameter},
+		{"invalid redaction", "redact=0,0,10", nil, http.StatusBadRequest, ErrorCodeInvalidParameter},
+		{"text without font", "text=hello", nil, http.StatusNotImplemented, ErrorCodeNotImplemented},
+	}
+
+	for _, test := range tests {
+		query, err := url.ParseQuery(test.query)
+		if err != nil {
+			t.Fatalf("Invalid query %q: %s", test.query, err)
+		}
+
+		_, err = d.parseOptions(TestBucket, query, test.header)
+		rerr, ok := err.(*requestError)
+		if !ok {
+			t.Errorf("%s: expected a request error for %q, got %v", test.name, test.query, err)
+			continue
+		}
+		if rerr.status != test.status || rerr.code != test.code {
+			t.Errorf("%s: expected %d %s, got %d %s", test.name, test.status, test.code, rerr.status, rerr.code)
+		}
+	}
+}
+
+func TestParseOptionsUnknownParameters(t *testing.T) {
+	d, done := newOptionsDeflator(t, func(config *Config) {
+		config.UnknownParameters = UnknownParametersReject
+	})
+	defer done()
+
+	_, err := d.parseOptions(TestBucket, url.Values{"width": {"10"}, "utm_source": {"mail"}}, nil)
+	rerr, ok := err.(*requestError)
+	if !ok || rerr.code != ErrorCodeInvalidParameter || rerr.message != `Unknown parameter "utm_source"` {
+		t.Errorf("Expected the unknown parameter to be rejected, got %v", err)
+	}
+
+	// Unknown headers are never rejected
+	_, err = d.parseOptions(TestBucket, url.Values{"width": {"10"}}, http.Header{"X-Imgdeflator-Unknown": {"1"}})
+	if err != nil {
+		t.Errorf("Expected the unknown header to be ignored, got %s", err)
+	}
+}
+
+func TestParseOptionsNilHeader(t *testing.T) {
+	d, done := newOptionsDeflator(t, nil)
+	defer done()
+
+	options, err := d.parseOptions(TestBucket, url.Values{"width": {"10"}}, nil)
+	if err != nil || options.width != 10 || options.responseStyle != d.config.ResponseStyle {
+		t.Errorf("Expected the defaults and the width 10, got %+v (%v)", options, err)
+	}
+}
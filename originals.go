@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/s3manager"
+	"github.com/davidbyttow/govips/pkg/vips"
+	log "github.com/sirupsen/logrus"
+)
+
+// originalResult describes the untouched original stored with `keep_original`
+type originalResult struct {
+	Key    string `json:"key"`
+	Size   int    `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+func sha256Hex(buf []byte) string {
+	sum := sha256.Sum256(buf)
+	return hex.EncodeToString(sum[:])
+}
+
+// keepOriginalKey expands the OriginalKeyTemplate for the original of the
+// object stored at key
+func (d *Deflator) keepOriginalKey(bucket, key string, body []byte) (string, error) {
+	originalKey, err := d.originalKeyTemplate.Expand(&keyTemplateValues{
+		now:     d.clock.Now(),
+		body:    body,
+		ext:     strings.TrimPrefix(vips.DetermineImageType(body).OutputExt(), "."),
+		origKey: key,
+	})
+	if err != nil {
+		return "", newRequestError(http.StatusServiceUnavailable, ErrorCodeInternal, "Internal error").withCause(err)
+	}
+
+	err = sanitizeKey(originalKey)
+	if err != nil {
+		log.Debugf("Invalid original key %q: %s", logKey(originalKey), err)
+		return "", newRequestError(http.StatusBadRequest, ErrorCodeInvalidKey, "Invalid original key: %s", err)
+	}
+
+	if originalKey == key {
+		log.Warnf("The original key template %q expands to the processed key %q", d.originalKeyTemplate.raw, logKey(key))
+		return "", newRequestError(http.StatusServiceUnavailable, ErrorCodeInternal, "Internal error")
+	}
+
+	return originalKey, d.authorizeDestination(bucket, originalKey)
+}
+
+// uploadOriginal stores body at key with the same settings as the processed
+// object described by input. The stored payload is body, or its ciphertext
+// for encrypted buckets.
+func uploadOriginal(ctx context.Context, uploader *s3manager.Uploader, input s3manager.UploadInput, key string, body, payload []byte) (*originalResult, error) {
+	input.Key = aws.String(key)
+	input.Body = bytes.NewReader(payload)
+
+	_, err := uploader.UploadWithContext(ctx, &input)
+	if err != nil {
+		return nil, err
+	}
+	invalidateHeadCache(aws.StringValue(input.Bucket), key)
+
+	return &originalResult{Key: key, Size: len(body), SHA256: sha256Hex(body)}, nil
+}
+
+// cleanupObject deletes an object which was stored by a failed request
+func cleanupObject(ctx context.Context, uploader *s3manager.Uploader, bucket, key string) {
+	err := deleteObject(ctx, uploader, bucket, key)
+	if err != nil {
+		log.Errorf("Failed to clean up %q: %s", (&s3Location{bucket: bucket, key: key}).logString(), err)
+	}
+}
+
+// deleteObject deletes an object, and invalidates its cached HEAD
+func deleteObject(ctx context.Context, uploader *s3manager.Uploader, bucket, key string) error {
+	deleteReq := uploader.S3.DeleteObjectRequest(&s3.DeleteObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	deleteReq.SetContext(ctx)
+	_, err := deleteReq.Send()
+	if err != nil {
+		return err
+	}
+	invalidateHeadCache(bucket, key)
+	return nil
+}
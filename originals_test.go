@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// failOriginals makes the uploads of the originals to the fakes3 server of s fail
+func failOriginals(s *testServer) {
+	s.fake.SetFault(func(r *http.Request) int {
+		if r.Method == http.MethodPut && strings.HasSuffix(r.URL.Path, ".orig") {
+			return http.StatusInternalServerError
+		}
+		return 0
+	})
+}
+
+func TestKeepOriginalBestEffort(t *testing.T) {
+	s := newTestServer(t, func(config *Config) {
+		config.KeepOriginalBestEffort = true
+	})
+	defer s.close()
+	failOriginals(s)
+
+	resp := s.post("photo.png", "width=16&keep_original=1", bytes.NewReader(testPNG(t, 32, 32)))
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the upload to succeed without its original, got %d", resp.StatusCode)
+	}
+	if warning := resp.Header.Get(WarningHeader); warning != WarningOriginalFailed {
+		t.Errorf("Expected the %s warning, got %q", WarningOriginalFailed, warning)
+	}
+
+	var result map[string]interface{}
+	err := json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		t.Fatalf("Failed to decode the result: %s", err)
+	}
+	if _, ok := result["original"]; ok {
+		t.Errorf("Expected no original in the result, got %v", result["original"])
+	}
+	if _, ok := s.fake.Object(TestBucket, "photo.png"); !ok {
+		t.Errorf("The processed object wasn't stored")
+	}
+}
+
+func TestKeepOriginalFailure(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.close()
+	failOriginals(s)
+
+	resp := s.post("photo.png", "width=16&keep_original=1", bytes.NewReader(testPNG(t, 32, 32)))
+	if code := decodeError(t, resp, http.StatusServiceUnavailable).Code; code != ErrorCodeStorageUnavailable {
+		t.Errorf("Expected the %s code, got %s", ErrorCodeStorageUnavailable, code)
+	}
+	if keys := s.fake.Keys(TestBucket); len(keys) != 0 {
+		t.Errorf("Expected the processed object to be deleted, got %q", keys)
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"expvar"
+	"io"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/s3manager"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// uploadModes counts the uploads and their bytes by mode, to show the
+	// split between the transformed and the passthrough traffic
+	uploadModes = expvar.NewMap("upload_modes")
+)
+
+// The upload modes counted in uploadModes
+const (
+	UploadModeTransform   = "transform"
+	UploadModePassthrough = "passthrough"
+)
+
+// countUploadMode accounts for an upload of size bytes in mode
+func countUploadMode(mode string, size int64) {
+	uploadModes.Add(mode, 1)
+	uploadModes.Add(mode+"_bytes", size)
+}
+
+// limitReader fails once more than limit bytes were read
+type limitReader struct {
+	r        io.Reader
+	read     int64
+	limit    int64
+	tooLarge bool
+}
+
+func (r *limitReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.read += int64(n)
+	if r.read > r.limit {
+		r.tooLarge = true
+		return 0, errors.New("body too large")
+	}
+	return n, err
+}
+
+// requestSizeLimit returns the size limit which applies before the bucket
+// of a request is known
+func (d *Deflator) requestSizeLimit() int64 {
+	limit := d.maxUploadSizeLimit()
+	if d.passthroughBuckets && d.config.PassthroughMaxSize > limit {
+		limit = d.config.PassthroughMaxSize
+	}
+	return limit
+}
+
+// passthroughSizeLimit returns the size limit of the passthrough uploads to
+// bucket. They're stored as is, so it's the stricter of the input and stored
+// limits.
+func (d *Deflator) passthroughSizeLimit(bucket string) int64 {
+	config := d.bucketConfig(bucket)
+	limit := d.config.PassthroughMaxSize
+	if config.MaxInputBytes > 0 {
+		limit = config.MaxInputBytes
+	}
+	stored := d.config.MaxStoredSize
+	if config.MaxStoredBytes > 0 {
+		stored = config.MaxStoredBytes
+	}
+	if stored > 0 && stored < limit {
+		limit = stored
+	}
+	return limit
+}
+
+// hasPassthroughBucket checks whether any bucket is in passthrough mode
+func hasPassthroughBucket(buckets map[string]*BucketConfig) bool {
+	for _, config := range buckets {
+		if config.Passthrough {
+			return true
+		}
+	}
+	return false
+}
+
+// passthroughHandler streams the request body to location as is, for the
+// buckets with passthrough set. The body is neither spooled nor transformed,
+// so the hooks, the scanner and the replicas don't get it either.
+func (d *Deflator) passthroughHandler(w http.ResponseWriter, r *http.Request, location *s3Location, options *requestOptions) {
+	if options.transform() || len(options.redactions) > 0 || options.keepOriginal || options.ttl > 0 || options.collision != "" || options.echoImage || options.source != nil || len(options.siblings) > 0 || options.stripMetadata {
+		log.Debugf("Options %s not allowed for passthrough bucket %q", options.canonical(), location.bucket)
+		writeError(w, r, newRequestError(
+			http.StatusBadRequest, ErrorCodeInvalidParameter,
+			"Transform parameters not allowed for this bucket, which stores uploads as is",
+		))
+		return
+	}
+
+	limit := d.passthroughSizeLimit(location.bucket)
+	if r.ContentLength > limit {
+		log.Debugf("File too large (%d bytes)", r.ContentLength)
+		writeError(w, r, newRequestError(
+			http.StatusRequestEntityTooLarge, ErrorCodePayloadTooLarge,
+			"File too large (%d bytes, limit: %d bytes)", r.ContentLength, limit,
+		))
+		return
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	progress := newUploadProgress()
+	limited := &limitReader{r: r.Body, limit: limit}
+	body := bufio.NewReaderSize(progress.countRead(ctx, limited), SniffLength)
+	// Errors other than short bodies get returned again by the upload
+	head, err := body.Peek(SniffLength)
+	if len(head) == 0 && err == io.EOF {
+		writeError(w, r, emptyBodyError(location.bucket))
+		return
+	}
+	// The size of streamed bodies is only known when they're shorter than
+	// the sniffed bytes
+	size := r.ContentLength
+	if err == io.EOF {
+		size = int64(len(head))
+	}
+	if min := d.minUploadSize(location.bucket); size >= 0 && size < min {
+		writeError(w, r, rejectSmallBody(location.bucket, newRequestError(
+			http.StatusUnprocessableEntity, ErrorCodePayloadTooSmall,
+			"File too small (%d bytes, minimum: %d bytes)", size, min,
+		)))
+		return
+	}
+	contentType, err := normalizeContentType(r.Header.Get("Content-Type"), sniffContentType(head))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	uploader, err := getS3Uploader(ctx, location.bucket, location.regionHint, d.config.DefaultS3Region, d.endpointOptions(location.bucket))
+	if err != nil {
+		writeError(w, r, uploaderError(location.bucket, err))
+		return
+	}
+
+	release, err := d.concurrency.acquire(ctx, location.bucket)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	progress.setStage(StageUpload)
+	_, err = uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+		Bucket:      aws.String(location.bucket),
+		Key:         aws.String(location.key),
+		ContentType: aws.String(contentType),
+		Body:        body,
+	})
+	release(err)
+	progress.setStage(StageDone)
+	if err != nil {
+		switch {
+		case limited.tooLarge:
+			err = newRequestError(
+				http.StatusRequestEntityTooLarge, ErrorCodePayloadTooLarge,
+				"File too large (limit: %d bytes)", limit,
+			)
+		case isProxyError(err):
+			err = newRequestError(http.StatusBadGateway, ErrorCodeProxyUnavailable, "Egress proxy unavailable").withCause(err)
+		case isAccessDeniedError(err) && d.endpointOptions(location.bucket).expectedOwner != "":
+			err = bucketOwnerMismatchError(location.bucket)
+		default:
+			log.Warnf("Failed to upload %q: %s", location.logString(), err)
+			err = newRequestError(http.StatusServiceUnavailable, ErrorCodeStorageUnavailable, "Internal error").withCause(err)
+		}
+		writeError(w, r, err)
+		return
+	}
+	invalidateHeadCache(location.bucket, location.key)
+
+	size = limited.read
+	countUploadMode(UploadModePassthrough, size)
+
+	principal := listenerFromContext(ctx).principal()
+	audit("upload", log.Fields{
+		"bucket":      location.bucket,
+		"key":         location.key,
+		"size":        size,
+		"client_ip":   d.clientIP(r),
+		"principal":   principal,
+		"passthrough": true,
+	})
+	if !isCanary(ctx) {
+		d.usage.record(location.bucket, principal, d.clock.Now(), int(size))
+	}
+
+	w.Header().Set("Server-Timing", progress.serverTiming())
+	writeUploadResult(w, options.responseStyle, &uploadResult{
+		Bucket:      location.bucket,
+		Key:         location.key,
+		Size:        int(size),
+		ContentType: contentType,
+	})
+}
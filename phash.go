@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"image"
+	"image/png"
+	"math"
+	"math/bits"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/davidbyttow/govips/pkg/vips"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// PerceptualHashMetaKey is the object metadata holding the perceptual
+	// hash of the uploaded image, i.e. `x-amz-meta-phash`
+	PerceptualHashMetaKey = "Phash"
+
+	// phashSize is the side of the grayscale working image of the hash
+	phashSize = 32
+	// phashBits is the side of the block of low frequencies it keeps
+	phashBits = 8
+)
+
+// phashDenylist holds the perceptual hashes of known-bad images
+type phashDenylist []uint64
+
+// loadPhashDenylist reads the denylist file at path, which lists one hash in
+// hex per line. Empty lines and lines starting with `#` are ignored.
+func loadPhashDenylist(path string) (phashDenylist, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var denylist phashDenylist
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		hash, err := strconv.ParseUint(line, 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hash %q on line %d of %q", line, n, path)
+		}
+		denylist = append(denylist, hash)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return denylist, nil
+}
+
+// match returns the distance to the closest hash within maxDistance of hash
+func (l phashDenylist) match(hash uint64, maxDistance int) (int, bool) {
+	closest := -1
+	for _, denied := range l {
+		if distance := hammingDistance(hash, denied); distance <= maxDistance && (closest < 0 || distance < closest) {
+			closest = distance
+		}
+	}
+	return closest, closest >= 0
+}
+
+func (d *Deflator) phashDenylist() phashDenylist {
+	denylist, _ := d.denylist.Load().(phashDenylist)
+	return denylist
+}
+
+// hammingDistance counts the bits which differ between two hashes
+func hammingDistance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+// formatPerceptualHash formats hash as 16 hex digits
+func formatPerceptualHash(hash uint64) string {
+	return fmt.Sprintf("%016x", hash)
+}
+
+// perceptualHash computes the pHash of body: libvips decodes it into a
+// stretched 32x32 grayscale copy, which is cheap to encode and decode again
+// as a PNG
+func perceptualHash(body []byte) (uint64, error) {
+	buf, _, err := vips.NewTransform().
+		LoadBuffer(body).
+		ResizeStrategy(vips.ResizeStrategyStretch).
+		Resize(phashSize, phashSize).
+		Interpretation(vips.InterpretationBW).
+		StripMetadata().
+		Format(vips.ImageTypePNG).
+		Apply()
+	if err != nil {
+		return 0, err
+	}
+	img, err := png.Decode(bytes.NewReader(buf))
+	if err != nil {
+		return 0, err
+	}
+	return phashPixels(grayPixels(img)), nil
+}
+
+// grayPixels returns the luminance of the phashSize sided img
+func grayPixels(img image.Image) *[phashSize][phashSize]float64 {
+	var pixels [phashSize][phashSize]float64
+	bounds := img.Bounds()
+	for y := 0; y < phashSize && y < bounds.Dy(); y++ {
+		for x := 0; x < phashSize && x < bounds.Dx(); x++ {
+			r, g, b, _ := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			pixels[y][x] = 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+		}
+	}
+	return &pixels
+}
+
+// phashPixels sets a bit for each of the lowest 8x8 frequencies of the DCT
+// of pixels which is above their median. The DC term only carries the
+// average brightness, so it's left out of the median.
+func phashPixels(pixels *[phashSize][phashSize]float64) uint64 {
+	var coefficients [phashBits * phashBits]float64
+	for v := 0; v < phashBits; v++ {
+		for u := 0; u < phashBits; u++ {
+			sum := 0.0
+			for y := 0; y < phashSize; y++ {
+				for x := 0; x < phashSize; x++ {
+					sum += pixels[y][x] *
+						math.Cos(float64(2*x+1)*float64(u)*math.Pi/(2*phashSize)) *
+						math.Cos(float64(2*y+1)*float64(v)*math.Pi/(2*phashSize))
+				}
+			}
+			coefficients[v*phashBits+u] = sum
+		}
+	}
+
+	sorted := make([]float64, len(coefficients)-1)
+	copy(sorted, coefficients[1:])
+	sort.Float64s(sorted)
+	median := (sorted[len(sorted)/2-1] + sorted[len(sorted)/2]) / 2
+
+	var hash uint64
+	for i, coefficient := range coefficients {
+		if coefficient > median {
+			hash |= 1 << uint(len(coefficients)-1-i)
+		}
+	}
+	return hash
+}
+
+// hashUpload computes the perceptual hash of the body of req, unless the
+// bucket opts out, and rejects the images close to a denylisted hash. Images
+// libvips can't hash are stored without one.
+func (d *Deflator) hashUpload(req *uploadRequest, body []byte) (string, error) {
+	if !d.config.PerceptualHash || d.bucketConfig(req.bucket).SkipPhash {
+		return "", nil
+	}
+
+	hash, err := perceptualHash(body)
+	if err != nil {
+		log.Debugf("Failed to compute the perceptual hash for URL %q: %s", req.location(), err)
+		return "", nil
+	}
+	formatted := formatPerceptualHash(hash)
+
+	if distance, ok := d.phashDenylist().match(hash, d.config.PhashMaxDistance); ok {
+		log.Infof("Rejecting the denylisted image for URL %q (phash %s, distance %d)", req.location(), formatted, distance)
+		audit("upload_rejected", log.Fields{
+			"bucket":            req.bucket,
+			"key":               req.key,
+			"client_ip":         req.clientIP,
+			"phash":             formatted,
+			"denylist_distance": distance,
+		})
+		return "", newRequestError(http.StatusUnavailableForLegalReasons, ErrorCodeDenylistedImage, "Image not allowed")
+	}
+	return formatted, nil
+}
@@ -0,0 +1,865 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/s3manager"
+	"github.com/davidbyttow/govips/pkg/vips"
+	log "github.com/sirupsen/logrus"
+)
+
+// uploadRequest holds everything the pipeline needs to process and store an
+// image, independent of the API the request came through
+type uploadRequest struct {
+	bucket string
+	key    string
+	// regionHint is the bucket region found in the destination URL, if any
+	regionHint  string
+	contentType string
+	body        io.Reader
+	// declaredSize is the body size announced by the client, if known
+	declaredSize int64
+	width        uint64
+	height       uint64
+	// ttl in seconds after which the object should expire. Zero means no expiry.
+	ttl uint64
+	// keyTemplate overrides the key template from the bucket config
+	keyTemplate *keyTemplate
+	clientIP    string
+	// progress is optional and tracks the pipeline stages
+	progress *uploadProgress
+	// hook describes the request to the hooks
+	hook *HookRequest
+	// caption is rendered onto the resized image, if set
+	caption *textCaption
+	// redactions are pixelated before the image is resized
+	redactions []redactRegion
+	// scanVerdict is the outcome of the virus scan, if enabled
+	scanVerdict string
+	// keepOriginal stores the untouched body next to the processed object
+	keepOriginal bool
+	// collision overrides the collision strategy from the bucket config
+	collision string
+	// profile is the name of the applied transform profile, if any
+	profile string
+	// principal is who the upload is billed to
+	principal string
+	// canary is set for the synthetic canary uploads
+	canary bool
+	// lane is the admission lane of the upload, if admission control is enabled
+	lane string
+	// responseStyle selects the HTTP response to a successful upload
+	responseStyle string
+	// echoImage returns the processed image instead of the JSON result
+	echoImage bool
+	// skipVerify skips the verification of the stored object
+	skipVerify bool
+	// maxInputBytes and maxStoredBytes are the size limits of the profile
+	maxInputBytes  int64
+	maxStoredBytes int64
+	// echo holds the echo headers of the request, by lowercase name
+	echo map[string]string
+	// session is the ID of the upload session, if any
+	session string
+	// maxSize lowers the upload size limits, if set
+	maxSize int64
+	// source is the object the body was downloaded from, for copy-transforms
+	source *sourceObject
+	// regionHeader is set when regionHint comes from the RegionHeader
+	regionHeader bool
+	// siblings are the formats of the variants stored next to the object.
+	// Nil applies the bucket default.
+	siblings []string
+	// stripMetadata drops the metadata of the processed image and siblings
+	stripMetadata bool
+}
+
+// location describes the destination of req in the logs
+func (req *uploadRequest) location() string {
+	return (&s3Location{bucket: req.bucket, key: req.key}).logString()
+}
+
+// uploadResult is returned as JSON after a successful upload
+type uploadResult struct {
+	Bucket    string          `json:"bucket"`
+	Key       string          `json:"key"`
+	Size      int             `json:"size"`
+	ExpiresAt *time.Time      `json:"expires_at,omitempty"`
+	Replicas  []replicaResult `json:"replicas,omitempty"`
+	// ContentType is the normalized Content-Type of the stored object
+	ContentType string `json:"content_type,omitempty"`
+	// ETag is the MD5 based ETag of objects uploaded in a single part
+	ETag string `json:"etag,omitempty"`
+	// SHA256 is the checksum of the processed object, set with keep_original
+	SHA256 string `json:"sha256,omitempty"`
+	// Original describes the untouched original, stored with keep_original
+	Original *originalResult `json:"original,omitempty"`
+	// Redacted lists the redacted regions in output coordinates
+	Redacted []redactRegion `json:"redacted,omitempty"`
+	// Coalesced is set when the result is shared with an identical concurrent request
+	Coalesced bool `json:"coalesced,omitempty"`
+	// Profile is the name of the applied transform profile
+	Profile string `json:"profile,omitempty"`
+	// Encoder identifies the encoder of the processed image and its version
+	Encoder string `json:"encoder,omitempty"`
+	// Warnings lists the problems which didn't prevent the upload
+	Warnings []string `json:"warnings,omitempty"`
+	// PHash is the perceptual hash of the uploaded image, in hex
+	PHash string `json:"phash,omitempty"`
+	// Checksum is the additional checksum of the stored object
+	Checksum *uploadChecksum `json:"checksum,omitempty"`
+	// Siblings lists the format variants stored next to the object
+	Siblings []siblingResult `json:"siblings,omitempty"`
+	// TransformPath tells whether the image was decoded, or only stripped of
+	// its metadata or copied by the streaming transforms
+	TransformPath string `json:"transform_path,omitempty"`
+	// ClientMetadata holds the echo headers of the request
+	ClientMetadata map[string]string `json:"client_metadata,omitempty"`
+	// Source is the object a copy-transform read the image from
+	Source *sourceObject `json:"source,omitempty"`
+	// shadowed is set when the request was sampled for the shadow profile
+	shadowed bool
+	// image is the processed image, kept for the echoImage requests
+	image []byte
+}
+
+// authorizeDestination checks the destination against the AllowedDestinations
+func (d *Deflator) authorizeDestination(bucket, key string) error {
+	if !isAllowedDestination(d.config.AllowedDestinations, bucket, key) {
+		log.Debugf("Destination %q not allowed", (&s3Location{bucket: bucket, key: key}).logString())
+		return newRequestError(http.StatusForbidden, ErrorCodeBucketNotAllowed, "Forbidden")
+	}
+	return nil
+}
+
+// upload resizes the image in the request body and stores it in S3
+func (d *Deflator) upload(ctx context.Context, req *uploadRequest) (*uploadResult, error) {
+	if req.progress == nil {
+		req.progress = newUploadProgress()
+	}
+	defer d.trackInflight(req)()
+	if warningsFromContext(ctx) == nil {
+		ctx = withWarnings(ctx)
+	}
+	req.principal = listenerFromContext(ctx).principal()
+	req.canary = isCanary(ctx)
+
+	// Normalize the key first, so it's also what gets logged
+	key, err := d.normalizeKey(req.key)
+	if err != nil {
+		log.Debugf("Invalid key for URL %q: %s", req.location(), err)
+		return nil, err
+	}
+	req.key = key
+
+	if (req.width == 0 && req.height == 0) || req.width > d.config.MaxWidth || req.height > d.config.MaxHeight {
+		log.Debugf("Invalid width/height (%d/%d)", req.width, req.height)
+		return nil, newRequestError(http.StatusBadRequest, ErrorCodeInvalidDimensions, "Invalid width/height (%d/%d)", req.width, req.height)
+	}
+
+	// The other APIs don't go through the Handler
+	err = d.checkMaintenance(req.bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	bucketConfig := d.bucketConfig(req.bucket)
+
+	var expiresAt *time.Time
+	if req.ttl > 0 {
+		if bucketConfig.MaxTTL == 0 {
+			log.Debugf("ttl not allowed for bucket %q", req.bucket)
+			return nil, newRequestError(http.StatusBadRequest, ErrorCodeInvalidTTL, "ttl not allowed for this bucket")
+		}
+
+		if req.ttl > bucketConfig.MaxTTL {
+			log.Debugf("ttl %d exceeds the maximum for bucket %q (%d)", req.ttl, req.bucket, bucketConfig.MaxTTL)
+			return nil, newRequestError(
+				http.StatusBadRequest, ErrorCodeInvalidTTL,
+				"Invalid ttl %d (maximum for this bucket: %d)", req.ttl, bucketConfig.MaxTTL,
+			)
+		}
+
+		expiry := d.clock.Now().Add(time.Duration(req.ttl) * time.Second).Truncate(time.Second)
+		expiresAt = &expiry
+	}
+
+	// Before the first read, so clients which sent `Expect: 100-continue`
+	// don't send the body at all
+	err = d.checkDeclaredContentType(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// Fail fast without credentials too, before the body gets peeked at
+	endpointOptions := d.endpointOptions(req.bucket)
+	err = credentialsError(endpointOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkEmptyBody(req)
+	if err != nil {
+		return nil, err
+	}
+
+	req.hook = &HookRequest{
+		Bucket:      req.bucket,
+		Key:         req.key,
+		ContentType: req.contentType,
+		Width:       req.width,
+		Height:      req.height,
+		ClientIP:    req.clientIP,
+		Metadata:    make(map[string]string, len(req.echo)),
+	}
+	for name, value := range req.echo {
+		req.hook.Metadata[name] = value
+	}
+	err = d.runRequestValidated(&HookContext{Context: ctx, Request: req.hook})
+	if err != nil {
+		return nil, err
+	}
+
+	if req.regionHeader {
+		endpointOptions.hintSource = RegionSourceHeader
+	}
+	uploader, err := getS3Uploader(ctx, req.bucket, req.regionHint, d.config.DefaultS3Region, endpointOptions)
+	if err != nil {
+		return nil, uploaderError(req.bucket, err)
+	}
+
+	// Slow clients hold their slot while their body gets read
+	releasePrincipal, err := d.acquirePrincipalSlot(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer releasePrincipal()
+
+	// Spool the body so it can be mirrored through the shadow profile
+	body, err := d.readBody(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	head := body
+	if len(head) > SniffLength {
+		head = head[:SniffLength]
+	}
+	sniffed := sniffContentType(head)
+	req.contentType, err = normalizeContentType(req.contentType, sniffed)
+	if err != nil {
+		log.Debugf("Invalid Content-Type for URL %q: %s", req.location(), err)
+		return nil, err
+	}
+	req.hook.ContentType = req.contentType
+	err = checkAVIFSupport(sniffed)
+	if err != nil {
+		log.Debugf("Unsupported AVIF image for URL %q", req.location())
+		return nil, err
+	}
+	err = d.checkSiblings(ctx, req, body)
+	if err != nil {
+		return nil, err
+	}
+
+	// Redaction encodes the image once more before the transform, and every
+	// sibling is another encode and rendition
+	work := workload{encodes: 1 + len(req.siblings), renditions: 1 + len(req.siblings)}
+	if len(req.redactions) > 0 {
+		work.encodes++
+	}
+	err = d.checkWorkBudget(req.bucket, body, work)
+	if err != nil {
+		return nil, err
+	}
+
+	// The slow stages only start once admitted, by spooled size
+	if d.admission != nil {
+		req.lane = d.admission.lane(len(body))
+	}
+	release, err := d.admission.admit(ctx, req.lane)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	if d.scanner != nil {
+		req.progress.setStage(StageScan)
+		req.scanVerdict, err = d.scanner.check(ctx, req.location(), body)
+		if req.scanVerdict == ScanVerdictInfected {
+			audit("upload_rejected", log.Fields{
+				"bucket":    req.bucket,
+				"key":       req.key,
+				"client_ip": req.clientIP,
+				"scan":      req.scanVerdict,
+			})
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var result *uploadResult
+	if !d.config.CoalesceUploads {
+		result, err = d.store(ctx, req, body, uploader, expiresAt)
+	} else {
+		result, err = d.coalescer.do(uploadDigest(req, body), func() (*uploadResult, error) {
+			return d.store(ctx, req, body, uploader, expiresAt)
+		})
+	}
+	if err != nil && req.regionHeader && isWrongRegionError(err) {
+		return nil, wrongRegionHeaderError(req, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Coalesced requests share the result, but not their warnings
+	if warnings := warningsFromContext(ctx).list(); len(warnings) > 0 {
+		shared := *result
+		shared.Warnings = warnings
+		result = &shared
+	}
+	return result, nil
+}
+
+// store transforms the spooled body of req and uploads the result
+func (d *Deflator) store(ctx context.Context, req *uploadRequest, body []byte, uploader *s3manager.Uploader, expiresAt *time.Time) (*uploadResult, error) {
+	bucketConfig := d.bucketConfig(req.bucket)
+	template := bucketConfig.keyTemplate
+	if req.keyTemplate != nil {
+		template = req.keyTemplate
+	}
+
+	req.progress.setStage(StageTransform)
+	start := time.Now()
+
+	// Redacted uploads only keep the redacted body, so the original never
+	// reaches the hooks, the shadow queue or S3
+	original := body
+	var profile *encoderProfile
+	avif := isAVIF(body)
+	if avif {
+		var err error
+		body, err = decodeAVIF(body)
+		if err != nil {
+			log.Debugf("Failed to decode AVIF image for URL %q: %s", req.location(), err)
+			return nil, newRequestError(http.StatusBadRequest, ErrorCodeInvalidContentType, "Failed to decode AVIF image: %s", err)
+		}
+	}
+	// The hash is of the image as uploaded, which re-uploads reproduce
+	phash, err := d.hashUpload(req, body)
+	if err != nil {
+		return nil, err
+	}
+	if phash != "" {
+		req.hook.Metadata[PerceptualHashMetaKey] = phash
+	}
+
+	var redacted *redactedImage
+	if len(req.redactions) > 0 {
+		redacted, err = redactImage(body, req.redactions)
+		if err != nil {
+			log.Debugf("Failed to redact image for URL %q: %s", req.location(), err)
+			return nil, newRequestError(http.StatusBadRequest, ErrorCodeInvalidParameter, "Failed to redact image: %s", err)
+		}
+		body = redacted.body
+		profile = &encoderProfile{format: redacted.format}
+	}
+	if avif {
+		// AVIF can't be encoded, so it gets converted
+		profile = &encoderProfile{format: outputFormats[d.config.AVIFOutputFormat]}
+	}
+
+	transformPath := d.fastTransformPath(req, body, profile)
+	if req.stripMetadata {
+		if profile == nil {
+			profile = &encoderProfile{}
+		}
+		profile.StripMetadata = true
+	}
+
+	var buf []byte
+	var imageType vips.ImageType
+	var siblings []*siblingImage
+	if transformPath != TransformPathFull {
+		buf, transformPath = fastTransform(body, transformPath)
+		imageType = vips.ImageTypeJPEG
+		if transformPath == TransformPathFull {
+			log.Debugf("Falling back to the full transform for URL %q", req.location())
+		}
+	}
+	if transformPath == TransformPathFull {
+		// The siblings are encoded from the same decoded image
+		source, err := vips.NewImageFromBuffer(body)
+		if err != nil {
+			log.Warnf("Failed to resize image for URL %q: %s", req.location(), err)
+			return nil, newRequestError(http.StatusServiceUnavailable, ErrorCodeTransformFailed, "Internal error").withCause(err)
+		}
+		buf, imageType, err = transformDecoded(source, req.width, req.height, profile, req.caption)
+		if err != nil {
+			source.Close()
+			log.Warnf("Failed to resize image for URL %q: %s", req.location(), err)
+			return nil, newRequestError(http.StatusServiceUnavailable, ErrorCodeTransformFailed, "Internal error").withCause(err)
+		}
+		if len(req.siblings) > 0 {
+			siblings, err = d.encodeSiblings(ctx, req, source, profile)
+		}
+		source.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	req.progress.setTransformPath(transformPath)
+	err = d.checkStoredSize(req, d.inputSizeLimit(req, req.contentType), len(buf))
+	if err != nil {
+		return nil, err
+	}
+	if avif {
+		req.contentType = "image/" + strings.TrimPrefix(imageType.OutputExt(), ".")
+		req.hook.ContentType = req.contentType
+	}
+	transformDuration := time.Since(start)
+
+	key := req.key
+	if template != nil {
+		var digest []byte
+		if template.uses("sha256") {
+			digest = d.contentDigest(imageType, body, req.width, req.height, profile, req.caption)
+		}
+		key, err = template.Expand(&keyTemplateValues{
+			now:     d.clock.Now(),
+			body:    buf,
+			ext:     strings.TrimPrefix(imageType.OutputExt(), "."),
+			origKey: key,
+			digest:  digest,
+		})
+		if err != nil {
+			log.Warnf("Failed to expand key template %q for URL %q: %s", template.raw, req.location(), err)
+			return nil, newRequestError(http.StatusServiceUnavailable, ErrorCodeInternal, "Internal error").withCause(err)
+		}
+	}
+
+	req.hook.Key = key
+	err = d.runBeforeUpload(&HookContext{Context: ctx, Request: req.hook, Body: bytes.NewReader(body), Size: int64(len(body))})
+	if err != nil {
+		return nil, err
+	}
+	key, err = d.normalizeKey(req.hook.Key)
+	if err != nil {
+		log.Debugf("Invalid key for URL %q: %s", req.location(), err)
+		return nil, err
+	}
+
+	err = sanitizeKey(key)
+	if err != nil {
+		log.Debugf("Invalid key for URL %q: %s", req.location(), err)
+		return nil, newRequestError(http.StatusBadRequest, ErrorCodeInvalidKey, "Invalid key: %s", err)
+	}
+
+	uploadInput := &s3manager.UploadInput{
+		Bucket:      aws.String(req.bucket),
+		ContentType: aws.String(req.contentType),
+		Key:         aws.String(key),
+	}
+	if len(req.hook.Metadata) > 0 {
+		uploadInput.Metadata = req.hook.Metadata
+	}
+
+	if expiresAt != nil {
+		switch bucketConfig.ExpiryMechanism {
+		case ExpiryMechanismExpires:
+			uploadInput.Expires = expiresAt
+		default:
+			uploadInput.Tagging = aws.String(url.Values{"expiry": {expiresAt.Format(time.RFC3339)}}.Encode())
+		}
+	}
+
+	// Encrypted buckets only ever get the ciphertext
+	payload, originalPayload := buf, original
+	var originalMetadata map[string]string
+	if bucketConfig.KMSKeyID != "" {
+		var encryptionMetadata map[string]string
+		payload, encryptionMetadata, err = encryptPayload(ctx, uploader, bucketConfig.KMSKeyID, buf)
+		if err != nil {
+			return nil, err
+		}
+		uploadInput.Metadata = mergeMetadata(req.hook.Metadata, encryptionMetadata)
+		if req.keepOriginal {
+			originalPayload, encryptionMetadata, err = encryptPayload(ctx, uploader, bucketConfig.KMSKeyID, original)
+			if err != nil {
+				return nil, err
+			}
+			originalMetadata = mergeMetadata(req.hook.Metadata, encryptionMetadata)
+		}
+		for _, sibling := range siblings {
+			sibling.payload, encryptionMetadata, err = encryptPayload(ctx, uploader, bucketConfig.KMSKeyID, sibling.body)
+			if err != nil {
+				return nil, err
+			}
+			sibling.metadata = mergeMetadata(req.hook.Metadata, encryptionMetadata)
+		}
+	}
+
+	err = d.limitUploadInput(ctx, req, uploadInput)
+	if err != nil {
+		return nil, err
+	}
+	if originalMetadata != nil {
+		originalMetadata, err = d.limitObjectMetadata(ctx, req, originalMetadata)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, sibling := range siblings {
+		if sibling.metadata != nil {
+			sibling.metadata, err = d.limitObjectMetadata(ctx, req, sibling.metadata)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	collision := bucketConfig.Collision
+	if req.collision != "" {
+		collision = req.collision
+	}
+	var uploadOptions []func(*s3manager.Uploader)
+	if collision != CollisionOverwrite {
+		uploadOptions = append(uploadOptions, noOverwrite)
+	}
+	var checksumAcknowledged int32
+	checksum, checksumOptions := d.checksumUpload(ctx, req, uploader, payload, &checksumAcknowledged)
+
+	var originalKey string
+	var originalStored *originalResult
+	var originalErr error
+	var siblingsStored []siblingResult
+	var siblingsErr error
+	tx := &uploadTransaction{}
+	baseKey := key
+	for suffix := 0; ; suffix++ {
+		if collision != CollisionOverwrite {
+			key, suffix, err = d.freeKey(ctx, uploader, req.bucket, baseKey, collision, suffix)
+			if err != nil {
+				return nil, err
+			}
+			uploadInput.Key = aws.String(key)
+		}
+
+		if req.keepOriginal {
+			originalKey, err = d.keepOriginalKey(req.bucket, key, original)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		var release func(error)
+		release, err = d.concurrency.acquire(ctx, req.bucket)
+		if err != nil {
+			return nil, err
+		}
+
+		// The original and the siblings get uploaded alongside the processed
+		// object. Without overwriting, they wait for its conditional upload
+		// instead, so an upload which lost the key never replaces nor deletes
+		// the ones of the upload which took it.
+		originalStored, originalErr = nil, nil
+		siblingsStored, siblingsErr = nil, nil
+		var companions sync.WaitGroup
+		uploadCompanions := func() {
+			if req.keepOriginal {
+				originalInput := *uploadInput
+				if originalMetadata != nil {
+					originalInput.Metadata = originalMetadata
+				}
+				companions.Add(1)
+				go func() {
+					defer companions.Done()
+					originalStored, originalErr = uploadOriginal(ctx, uploader, originalInput, originalKey, original, originalPayload)
+				}()
+			}
+			if len(siblings) > 0 {
+				siblingsInput := *uploadInput
+				companions.Add(1)
+				go func() {
+					defer companions.Done()
+					siblingsStored, siblingsErr = uploadSiblings(ctx, uploader, siblingsInput, key, siblings)
+				}()
+			}
+		}
+		if collision == CollisionOverwrite {
+			uploadCompanions()
+		}
+
+		req.progress.setStage(StageUpload)
+		uploadInput.Body = req.progress.countUpload(bytes.NewReader(payload))
+		_, err = uploader.UploadWithContext(ctx, uploadInput, append(uploadOptions, checksumOptions...)...)
+		if err != nil && checksumOptions != nil && isChecksumUnsupportedError(err) {
+			disableChecksums(req.bucket, err)
+			addWarning(ctx, req.bucket, WarningChecksumUnvalidated)
+			checksumOptions = nil
+			uploadInput.Body = req.progress.countUpload(bytes.NewReader(payload))
+			_, err = uploader.UploadWithContext(ctx, uploadInput, uploadOptions...)
+		}
+		if err == nil && collision != CollisionOverwrite {
+			uploadCompanions()
+		}
+		companions.Wait()
+		release(err)
+		if err == nil {
+			tx.record(uploader, ObjectRoleProcessed, req.bucket, key)
+		}
+		if originalStored != nil {
+			tx.record(uploader, ObjectRoleOriginal, req.bucket, originalKey)
+		}
+		for _, sibling := range siblingsStored {
+			tx.record(uploader, ObjectRoleSibling, req.bucket, sibling.Key)
+		}
+		if err == nil {
+			break
+		}
+
+		// Another upload took the key since it was probed
+		if collision != CollisionOverwrite && isPreconditionFailedError(err) {
+			// Nothing else was stored yet
+			log.Debugf("Key %q got taken during the upload", logKey(key))
+			if collision == CollisionSuffix {
+				continue
+			}
+			return nil, collisionError(key)
+		}
+		if budgetErr := asS3BudgetError(err); budgetErr != nil {
+			return nil, d.abortUpload(tx, shedS3BudgetError(budgetErr))
+		}
+		log.Warnf("Failed to upload %q: %s", req.location(), err)
+		if isProxyError(err) {
+			return nil, d.abortUpload(tx, newRequestError(http.StatusBadGateway, ErrorCodeProxyUnavailable, "Egress proxy unavailable").withCause(err))
+		}
+		// S3 denies the uploads to buckets of another owner
+		if isAccessDeniedError(err) && d.endpointOptions(req.bucket).expectedOwner != "" {
+			return nil, d.abortUpload(tx, bucketOwnerMismatchError(req.bucket))
+		}
+		if isInsufficientStorageError(err) {
+			return nil, d.abortUpload(tx, newRequestError(http.StatusInsufficientStorage, ErrorCodeInsufficientStorage, "Insufficient storage").withCause(err))
+		}
+		return nil, d.abortUpload(tx, newRequestError(http.StatusServiceUnavailable, ErrorCodeStorageUnavailable, "Internal error").withCause(err))
+	}
+	invalidateHeadCache(req.bucket, key)
+	// The endpoints which don't know the checksum headers ignore them
+	if checksumOptions != nil && atomic.LoadInt32(&checksumAcknowledged) == 0 {
+		log.Debugf("The %s checksum of %q wasn't acknowledged by the endpoint", checksum.Algorithm, req.location())
+		addWarning(ctx, req.bucket, WarningChecksumUnvalidated)
+	}
+
+	if bucketConfig.VerifyUploads && !req.skipVerify {
+		err = d.verifyUpload(ctx, req, uploader, uploadInput, payload, uploadOptions)
+		if err != nil {
+			return nil, d.abortUpload(tx, err)
+		}
+	}
+
+	if originalErr != nil {
+		log.Warnf("Failed to upload the original of %q to %q: %s", req.location(), logKey(originalKey), originalErr)
+		if !d.config.KeepOriginalBestEffort {
+			return nil, d.abortUpload(tx, newRequestError(http.StatusServiceUnavailable, ErrorCodeStorageUnavailable, "Internal error").withCause(originalErr))
+		}
+		addWarning(ctx, req.bucket, WarningOriginalFailed)
+	}
+	if siblingsErr != nil {
+		log.Warnf("Failed to upload the siblings of %q: %s", req.location(), siblingsErr)
+		if !d.config.SiblingsBestEffort {
+			return nil, d.abortUpload(tx, newRequestError(http.StatusServiceUnavailable, ErrorCodeStorageUnavailable, "Internal error").withCause(siblingsErr))
+		}
+		addWarning(ctx, req.bucket, WarningSiblingFailed)
+	}
+
+	result := &uploadResult{
+		Bucket:      req.bucket,
+		Key:         key,
+		Size:        len(buf),
+		ContentType: req.contentType,
+		ExpiresAt:   expiresAt,
+		Profile:     req.profile,
+		Source:      req.source,
+		PHash:       phash,
+		Checksum:    checksum,
+		Siblings:    siblingsStored,
+		Encoder:     encoderID(),
+
+		TransformPath:  transformPath,
+		ClientMetadata: req.echo,
+	}
+	if req.echoImage {
+		if int64(len(buf)) <= d.config.EchoMaxSize {
+			result.image = buf
+		} else {
+			log.Debugf("Not echoing the image for URL %q (%d bytes)", req.location(), len(buf))
+			addWarning(ctx, req.bucket, WarningEchoTooLarge)
+		}
+	}
+	// Larger objects are uploaded in multiple parts, which get another ETag
+	if int64(len(payload)) < uploader.PartSize {
+		hash := md5.Sum(payload)
+		result.ETag = `"` + hex.EncodeToString(hash[:]) + `"`
+	}
+	if req.keepOriginal {
+		result.SHA256 = sha256Hex(buf)
+		result.Original = originalStored
+	}
+	if redacted != nil {
+		result.Redacted = scaleRegions(redacted.regions, redacted.width, redacted.height, req.width, req.height)
+	}
+
+	if len(bucketConfig.Replicas) > 0 {
+		req.progress.setStage(StageReplicate)
+		var ok bool
+		result.Replicas, ok = d.replicate(ctx, tx, bucketConfig.Replicas, bucketConfig.ReplicationPolicy, *uploadInput, payload)
+		if !ok {
+			log.Warnf("Failed to replicate %q to all the required buckets", req.location())
+			return nil, d.abortUpload(tx, newRequestError(http.StatusServiceUnavailable, ErrorCodeStorageUnavailable, "Internal error"))
+		}
+	}
+
+	auditFields := log.Fields{
+		"bucket":    result.Bucket,
+		"key":       result.Key,
+		"size":      result.Size,
+		"client_ip": req.clientIP,
+		"principal": req.principal,
+	}
+	if expiresAt != nil {
+		auditFields["expires_at"] = expiresAt.Format(time.RFC3339)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		auditFields["deadline"] = deadline.UTC().Format(time.RFC3339Nano)
+	}
+	if req.scanVerdict != "" {
+		auditFields["scan"] = req.scanVerdict
+	}
+	if req.canary {
+		auditFields["canary"] = true
+	}
+	if req.lane != "" {
+		auditFields["lane"] = req.lane
+	}
+	if checksum != nil {
+		auditFields["checksum_algorithm"] = checksum.Algorithm
+		auditFields["checksum"] = checksum.Value
+	}
+	if req.profile != "" {
+		auditFields["profile"] = req.profile
+	}
+	if warnings := warningsFromContext(ctx).list(); len(warnings) > 0 {
+		auditFields["warnings"] = warnings
+	}
+	if len(req.echo) > 0 {
+		auditFields["client_metadata"] = req.echo
+	}
+	if req.session != "" {
+		auditFields["session"] = req.session
+	}
+	if req.source != nil {
+		auditFields["source"] = (&s3Location{bucket: req.source.Bucket, key: req.source.Key}).logString()
+		auditFields["source_etag"] = req.source.ETag
+	}
+	if len(siblingsStored) > 0 {
+		siblingKeys := make([]string, 0, len(siblingsStored))
+		for _, sibling := range siblingsStored {
+			siblingKeys = append(siblingKeys, sibling.Key)
+		}
+		auditFields["siblings"] = siblingKeys
+	}
+	if req.keepOriginal {
+		auditFields["sha256"] = result.SHA256
+		if result.Original != nil {
+			auditFields["original_key"] = result.Original.Key
+			auditFields["original_size"] = result.Original.Size
+			auditFields["original_sha256"] = result.Original.SHA256
+		} else {
+			auditFields["original_error"] = originalErr.Error()
+		}
+	}
+	audit("upload", auditFields)
+
+	storedSize := len(buf)
+	if result.Original != nil {
+		storedSize += result.Original.Size
+	}
+	for _, sibling := range siblingsStored {
+		storedSize += sibling.Size
+	}
+	if !req.canary {
+		d.usage.record(req.bucket, req.principal, d.clock.Now(), storedSize)
+	}
+	countUploadMode(UploadModeTransform, int64(len(original)))
+
+	d.runUploadComplete(&HookContext{Context: ctx, Request: req.hook, Result: result})
+
+	if redacted == nil && !req.canary && d.sampleShadow() {
+		d.scheduleShadow(&shadowJob{
+			bucket:          req.bucket,
+			key:             key,
+			contentType:     req.contentType,
+			body:            body,
+			width:           req.width,
+			height:          req.height,
+			caption:         req.caption,
+			primarySize:     len(buf),
+			primaryDuration: transformDuration,
+		})
+		result.shadowed = true
+	}
+
+	return result, nil
+}
+
+// transformImage resizes body to the requested dimensions, applying the
+// encoder settings from profile (if any)
+func transformImage(body []byte, width, height uint64, profile *encoderProfile, caption *textCaption) ([]byte, vips.ImageType, error) {
+	source, err := vips.NewImageFromBuffer(body)
+	if err != nil {
+		return nil, vips.ImageTypeUnknown, err
+	}
+	defer source.Close()
+
+	return transformDecoded(source, width, height, profile, caption)
+}
+
+// transformDecoded is transformImage for an image which is already decoded,
+// so it can be encoded several times. source is left untouched.
+func transformDecoded(source *vips.ImageRef, width, height uint64, profile *encoderProfile, caption *textCaption) ([]byte, vips.ImageType, error) {
+	// Note: vips.ResizeStrategyCrop is needed to produce the exact desired dimensions.
+	// It might be useful to have an option to disable this in certain situations
+	// for performance considerations.
+	imageTransform := vips.NewTransform().Image(source).ResizeStrategy(vips.ResizeStrategyCrop)
+
+	if width > 0 {
+		imageTransform.ResizeWidth(int(width))
+	}
+	if height > 0 {
+		imageTransform.ResizeHeight(int(height))
+	}
+	if profile != nil {
+		profile.apply(imageTransform)
+	}
+
+	if caption != nil {
+		// The caption gets positioned within the resized image
+		outputWidth, outputHeight := outputSize(source.Width(), source.Height(), width, height)
+		imageTransform.Label(caption.label(outputWidth, outputHeight))
+	}
+
+	return imageTransform.Apply()
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	log "github.com/sirupsen/logrus"
+)
+
+// checkPreconditions evaluates the If-None-Match and If-Match headers of a
+// conditional write against the current object at location. The object can
+// still change between the check and the upload.
+func (d *Deflator) checkPreconditions(ctx context.Context, location *s3Location, header http.Header) error {
+	ifNoneMatch, ifMatch := header.Get("If-None-Match"), header.Get("If-Match")
+	if ifNoneMatch == "" && ifMatch == "" {
+		return nil
+	}
+
+	// The head cache could be stale
+	uploader, err := getS3Uploader(ctx, location.bucket, location.regionHint, d.config.DefaultS3Region, d.endpointOptions(location.bucket))
+	if err != nil {
+		return uploaderError(location.bucket, err)
+	}
+
+	object, err := headObject(ctx, uploader, location.bucket, location.key)
+	switch {
+	case isNotFoundError(err):
+		object = nil
+	case err != nil:
+		log.Warnf("Failed to check if %q exists: %s", location.logString(), err)
+		return newRequestError(http.StatusServiceUnavailable, ErrorCodeStorageUnavailable, "Internal error").withCause(err)
+	}
+
+	etag := ""
+	if object != nil {
+		etag = aws.StringValue(object.ETag)
+	}
+
+	switch {
+	case ifNoneMatch != "" && object != nil && (strings.TrimSpace(ifNoneMatch) == "*" || matchesETag(ifNoneMatch, etag)):
+		return newRequestError(http.StatusPreconditionFailed, ErrorCodePreconditionFailed, "Object %q already exists", location.key)
+	case ifMatch != "" && (object == nil || !(strings.TrimSpace(ifMatch) == "*" || matchesETag(ifMatch, etag))):
+		return newRequestError(http.StatusPreconditionFailed, ErrorCodePreconditionFailed, "Object %q doesn't match", location.key)
+	}
+
+	return nil
+}
+
+// plainPutHandler uploads the request body to `/<bucket>/<key>`, like a plain
+// object store, on listeners with PlainPut enabled. The options are taken from
+// the query string and the headers as for regular uploads.
+func (d *Deflator) plainPutHandler(w http.ResponseWriter, r *http.Request) {
+	err := d.verifySignature(r.Context(), r.URL)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		log.Debugf("Invalid plain PUT path %s", logRawPath(r.URL.Path))
+		writeError(w, r, newRequestError(http.StatusBadRequest, ErrorCodeInvalidPath, "Expected /<bucket>/<key>"))
+		return
+	}
+	location := &s3Location{bucket: parts[0]}
+	location.key, err = d.normalizeKey(parts[1])
+	if err != nil {
+		log.Debugf("Invalid plain PUT key %s: %s", logRawPath(r.URL.Path), err)
+		writeError(w, r, err)
+		return
+	}
+
+	if limit := d.maxUploadSizeLimit(); r.ContentLength > limit {
+		log.Debugf("File too large (%d bytes)", r.ContentLength)
+		writeError(w, r, newRequestError(
+			http.StatusRequestEntityTooLarge, ErrorCodePayloadTooLarge,
+			"File too large (%d bytes, limit: %d bytes)", r.ContentLength, limit,
+		))
+		return
+	}
+
+	err = d.authorizeDestination(location.bucket, location.key)
+	var options *requestOptions
+	if err == nil {
+		options, err = d.parseOptions(location.bucket, r.URL.Query(), r.Header)
+	}
+	var req *uploadRequest
+	if err == nil {
+		req, err = d.uploadRequestFromOptions(location, options)
+	}
+	if err == nil {
+		err = d.checkPreconditions(r.Context(), location, r.Header)
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	req.contentType = r.Header.Get("Content-Type")
+	req.clientIP = d.clientIP(r)
+	err = d.applyRegionHeader(r, req)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	d.serveUpload(w, r, req, http.MaxBytesReader(w, r.Body, d.maxUploadSizeLimit()), r.ContentLength)
+}
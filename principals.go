@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// AdminPrincipalsPath is the admin endpoint reporting the concurrent
+	// requests of each principal
+	AdminPrincipalsPath = "/admin/principals"
+
+	// PrincipalGaugeTopN is how many principals are published in the
+	// principal_concurrency metric, the others being summed up as `other`
+	PrincipalGaugeTopN = 10
+)
+
+// publishedPrincipals holds the *principalLimiter whose gauge is published as
+// the principal_concurrency metric: the one of the last Deflator created
+var publishedPrincipals atomic.Value
+
+func init() {
+	expvar.Publish("principal_concurrency", expvar.Func(func() interface{} {
+		l, ok := publishedPrincipals.Load().(*principalLimiter)
+		if !ok {
+			return map[string]int{}
+		}
+		return l.gauge()
+	}))
+}
+
+// principalUsage describes the in-flight requests of a principal in the admin
+// API
+type principalUsage struct {
+	Principal string `json:"principal"`
+	Inflight  int    `json:"inflight"`
+	// Limit is zero for principals without a limit
+	Limit int `json:"limit,omitempty"`
+}
+
+// principalLimiter caps the number of concurrent requests of each principal,
+// so a single client with slow uploads can't take up the whole service
+type principalLimiter struct {
+	mu       sync.Mutex
+	inflight map[string]*principalUsage
+}
+
+func newPrincipalLimiter() *principalLimiter {
+	l := &principalLimiter{inflight: make(map[string]*principalUsage)}
+	publishedPrincipals.Store(l)
+	return l
+}
+
+// requestPrincipal identifies who a request counts against: the principal of
+// the listener it came through, or its client IP for the listeners without
+// one
+func requestPrincipal(ctx context.Context, clientIP string) string {
+	if principal := listenerFromContext(ctx).Principal; principal != "" {
+		return principal
+	}
+	return "ip:" + clientIP
+}
+
+// acquire takes one of the limit slots of principal without waiting. A zero
+// limit only counts the request.
+func (l *principalLimiter) acquire(principal string, limit int) (func(), bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	usage, ok := l.inflight[principal]
+	if !ok {
+		usage = &principalUsage{Principal: principal}
+		l.inflight[principal] = usage
+	}
+	usage.Limit = limit
+	if limit > 0 && usage.Inflight >= limit {
+		return nil, false
+	}
+	usage.Inflight++
+
+	var once sync.Once
+	return func() { once.Do(func() { l.release(principal) }) }, true
+}
+
+func (l *principalLimiter) release(principal string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	usage := l.inflight[principal]
+	usage.Inflight--
+	// Client IPs come and go
+	if usage.Inflight == 0 {
+		delete(l.inflight, principal)
+	}
+}
+
+// snapshot returns the principals with in-flight requests, busiest first
+func (l *principalLimiter) snapshot() []principalUsage {
+	l.mu.Lock()
+	usages := make([]principalUsage, 0, len(l.inflight))
+	for _, usage := range l.inflight {
+		usages = append(usages, *usage)
+	}
+	l.mu.Unlock()
+
+	sort.Slice(usages, func(i, j int) bool {
+		if usages[i].Inflight != usages[j].Inflight {
+			return usages[i].Inflight > usages[j].Inflight
+		}
+		return usages[i].Principal < usages[j].Principal
+	})
+	return usages
+}
+
+// gauge publishes the in-flight requests of the PrincipalGaugeTopN busiest
+// principals, which bounds the number of labels
+func (l *principalLimiter) gauge() interface{} {
+	gauge := make(map[string]int)
+	for i, usage := range l.snapshot() {
+		if i < PrincipalGaugeTopN {
+			gauge[usage.Principal] = usage.Inflight
+		} else {
+			gauge["other"] += usage.Inflight
+		}
+	}
+	return gauge
+}
+
+// acquirePrincipalSlot counts req against the concurrency limit of its
+// principal, failing with 429 when it's reached. The limit of the listener
+// takes precedence over MaxConcurrentPerPrincipal.
+func (d *Deflator) acquirePrincipalSlot(ctx context.Context, req *uploadRequest) (func(), error) {
+	// The canary shouldn't take the slots of real clients
+	if req.canary {
+		return func() {}, nil
+	}
+
+	limit := d.config.MaxConcurrentPerPrincipal
+	if listenerLimit := listenerFromContext(ctx).MaxConcurrentRequests; listenerLimit > 0 {
+		limit = listenerLimit
+	}
+
+	principal := requestPrincipal(ctx, req.clientIP)
+	release, ok := d.principals.acquire(principal, limit)
+	if !ok {
+		log.Debugf("Concurrency limit of %d reached for principal %q", limit, principal)
+		err := newRequestError(http.StatusTooManyRequests, ErrorCodeConcurrencyLimitExceeded, "Too many concurrent requests")
+		err.retryAfter = d.config.ConcurrencyRetryAfter
+		return nil, err
+	}
+
+	return release, nil
+}
+
+// principalsHandler lists the principals with in-flight requests
+func (d *Deflator) principalsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, newRequestError(http.StatusMethodNotAllowed, ErrorCodeMethodNotAllowed, "Method not allowed"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(d.principals.snapshot())
+}
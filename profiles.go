@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// profileRequests counts the requests applying each transform profile
+	profileRequests = expvar.NewMap("profile_requests")
+
+	// profileName matches the names of the transform profiles
+	profileName = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+)
+
+// profileOptions are the options which transform profiles set. Buckets with
+// profiles_only reject them as explicit request parameters.
+var profileOptions = map[string]bool{
+	"width":         true,
+	"height":        true,
+	"format":        true,
+	"text":          true,
+	"text_position": true,
+	"text_size":     true,
+	"text_color":    true,
+	"siblings":      true,
+	"strip":         true,
+}
+
+// profileLimitParsers are the size limits which transform profiles
+// override. Requests can't set them.
+var profileLimitParsers = map[string]optionParser{
+	"max_input_bytes":  parseSizeLimitOption,
+	"max_stored_bytes": parseSizeLimitOption,
+}
+
+// transformProfiles maps the profile names to their option values, in the
+// same form as the query parameters
+type transformProfiles map[string]url.Values
+
+// loadTransformProfiles reads the JSON profile config file, which maps
+// profile names to their options, e.g. `{"avatar": {"width": 256}}`. Every
+// profile goes through the same checks as the request options.
+func (d *Deflator) loadTransformProfiles(path string) (transformProfiles, error) {
+	profiles := make(transformProfiles)
+	if path == "" {
+		return profiles, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read profile config file: %s", err)
+	}
+
+	var configs map[string]map[string]interface{}
+	err = json.Unmarshal(data, &configs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse profile config file: %s", err)
+	}
+
+	for name, config := range configs {
+		if !profileName.MatchString(name) {
+			return nil, fmt.Errorf("invalid profile name %q", name)
+		}
+
+		// The values take the same types as the envelope options
+		values, err := (&uploadEnvelope{Options: config}).query()
+		if err != nil {
+			return nil, fmt.Errorf("invalid profile %q: %s", name, err)
+		}
+
+		options := d.newRequestOptions()
+		for option := range values {
+			parse, ok := profileLimitParsers[option]
+			if !ok && profileOptions[option] {
+				parse, ok = optionParsers[option]
+			}
+			if !ok {
+				return nil, fmt.Errorf("invalid profile %q: option %q can't be set by profiles", name, option)
+			}
+			value, err := singleValue(option, values[option])
+			if err == nil {
+				err = parse(d, options, option, value)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid profile %q: %s", name, err)
+			}
+		}
+
+		profiles[name] = values
+	}
+
+	return profiles, nil
+}
+
+// validateBucketProfiles checks that the profiles allowed for the buckets
+// exist
+func validateBucketProfiles(buckets map[string]*BucketConfig, profiles transformProfiles) error {
+	for bucket, config := range buckets {
+		for _, name := range config.Profiles {
+			if _, ok := profiles[name]; !ok {
+				return fmt.Errorf("invalid config for bucket %q: unknown profile %q", bucket, name)
+			}
+		}
+	}
+	return nil
+}
+
+// transformProfiles returns the current profiles, which get replaced on
+// reloads
+func (d *Deflator) transformProfiles() transformProfiles {
+	profiles, _ := d.profiles.Load().(transformProfiles)
+	return profiles
+}
+
+// selectProfile returns the name and options of the profile requested with
+// the `profile` option, if any, checking that bucket allows it
+func (d *Deflator) selectProfile(bucket string, query url.Values, header http.Header) (string, url.Values, error) {
+	values := optionValues("profile", query, header)
+	if len(values) == 0 {
+		return "", nil, nil
+	}
+	name, err := singleValue("profile", values)
+	if err != nil {
+		return "", nil, err
+	}
+
+	profile, ok := d.transformProfiles()[name]
+	if !ok {
+		log.Debugf("Unknown profile %q", name)
+		return "", nil, newRequestError(http.StatusBadRequest, ErrorCodeInvalidParameter, "Unknown profile %q", name)
+	}
+
+	if allowed := d.bucketConfig(bucket).Profiles; len(allowed) > 0 {
+		ok = false
+		for _, allowedName := range allowed {
+			ok = ok || allowedName == name
+		}
+		if !ok {
+			log.Debugf("Profile %q not allowed for bucket %q", name, bucket)
+			return "", nil, newRequestError(http.StatusForbidden, ErrorCodeForbidden, "Profile %q not allowed for this bucket", name)
+		}
+	}
+
+	profileRequests.Add(name, 1)
+	return name, profile, nil
+}
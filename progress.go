@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Stages of the upload pipeline reported by uploadProgress
+const (
+	StageRead      = "read"
+	StageScan      = "scan"
+	StageTransform = "transform"
+	StageUpload    = "upload"
+	StageVerify    = "verify"
+	StageReplicate = "replicate"
+	// StageDone is only reported in the ProgressTrailer
+	StageDone = "done"
+)
+
+const (
+	// ProgressHeader opts a request into the ProgressTrailer
+	ProgressHeader = "X-Progress"
+	// ProgressTrailer lists when each stage started, in milliseconds since
+	// the request was received
+	ProgressTrailer = "X-Imgdeflator-Progress"
+)
+
+var (
+	// stalledRequests counts the requests cancelled because no bytes moved
+	// for StallTimeout, by stage
+	stalledRequests = expvar.NewMap("stalled_requests")
+)
+
+// countingReader counts the bytes read from the underlying reader
+type countingReader struct {
+	ctx context.Context
+	r   io.Reader
+	n   *int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	// Stop reading from stalled clients as soon as the request gets cancelled
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	n, err := c.r.Read(p)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
+
+// readAtSeeker is implemented by the upload bodies. The S3 uploader relies on
+// ReadAt and Seek to avoid buffering them.
+type readAtSeeker interface {
+	io.ReadSeeker
+	io.ReaderAt
+}
+
+// countingReadAtSeeker counts the bytes read from an upload body
+type countingReadAtSeeker struct {
+	readAtSeeker
+	n *int64
+}
+
+func (c *countingReadAtSeeker) Read(p []byte) (int, error) {
+	n, err := c.readAtSeeker.Read(p)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
+
+func (c *countingReadAtSeeker) ReadAt(p []byte, off int64) (int, error) {
+	n, err := c.readAtSeeker.ReadAt(p, off)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
+
+// stageTiming is the time spent in a pipeline stage
+type stageTiming struct {
+	stage    string
+	duration time.Duration
+}
+
+// uploadProgress tracks the current stage and the bytes moved by an upload
+// request. The methods used by the pipeline are safe to call on a nil
+// *uploadProgress, so it stays optional.
+type uploadProgress struct {
+	start    time.Time
+	read     int64
+	uploaded int64
+
+	mu           sync.Mutex
+	stage        string
+	stageStart   time.Time
+	timings      []stageTiming
+	stalledStage string
+	// transformPath is how the image was transformed, one of the
+	// TransformPath values
+	transformPath string
+}
+
+func newUploadProgress() *uploadProgress {
+	now := time.Now()
+	return &uploadProgress{start: now, stage: StageRead, stageStart: now}
+}
+
+// countRead wraps the request body
+func (p *uploadProgress) countRead(ctx context.Context, r io.Reader) io.Reader {
+	if p == nil {
+		return r
+	}
+	return &countingReader{ctx: ctx, r: r, n: &p.read}
+}
+
+// countUpload wraps the body sent to S3
+func (p *uploadProgress) countUpload(r readAtSeeker) io.Reader {
+	if p == nil {
+		return r
+	}
+	return &countingReadAtSeeker{readAtSeeker: r, n: &p.uploaded}
+}
+
+// setStage records the end of the current stage and the start of the next one
+func (p *uploadProgress) setStage(stage string) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	p.timings = append(p.timings, stageTiming{stage: p.stage, duration: now.Sub(p.stageStart)})
+	p.stage = stage
+	p.stageStart = now
+}
+
+// setTransformPath records how the image was transformed
+func (p *uploadProgress) setTransformPath(path string) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	p.transformPath = path
+	p.mu.Unlock()
+}
+
+// snapshot returns the current stage and byte counts
+func (p *uploadProgress) snapshot() (stage string, read, uploaded int64) {
+	p.mu.Lock()
+	stage = p.stage
+	p.mu.Unlock()
+
+	return stage, atomic.LoadInt64(&p.read), atomic.LoadInt64(&p.uploaded)
+}
+
+// stalled returns the stage in which the request stalled, if it did
+func (p *uploadProgress) stalled() string {
+	if p == nil {
+		return ""
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.stalledStage
+}
+
+// stageTimings returns the time spent in each stage so far, including the
+// current one
+func (p *uploadProgress) stageTimings() []stageTiming {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	timings := make([]stageTiming, len(p.timings), len(p.timings)+1)
+	copy(timings, p.timings)
+	return append(timings, stageTiming{stage: p.stage, duration: time.Since(p.stageStart)})
+}
+
+// serverTiming formats the stage timings for the Server-Timing header
+func (p *uploadProgress) serverTiming() string {
+	timings := p.stageTimings()
+	p.mu.Lock()
+	transformPath := p.transformPath
+	p.mu.Unlock()
+
+	metrics := make([]string, 0, len(timings))
+	for _, timing := range timings {
+		metric := fmt.Sprintf("%s;dur=%.1f", timing.stage, float64(timing.duration)/float64(time.Millisecond))
+		switch timing.stage {
+		case StageRead:
+			metric += fmt.Sprintf(";desc=\"%d bytes\"", atomic.LoadInt64(&p.read))
+		case StageTransform:
+			if transformPath != "" {
+				metric += fmt.Sprintf(";desc=%q", transformPath)
+			}
+		case StageUpload:
+			metric += fmt.Sprintf(";desc=\"%d bytes\"", atomic.LoadInt64(&p.uploaded))
+		}
+		metrics = append(metrics, metric)
+	}
+
+	return strings.Join(metrics, ", ")
+}
+
+// progressTrailer formats the start of each stage and the end of the request
+// for the ProgressTrailer, e.g. `read;at=0.0, transform;at=12.5, done;at=80.2`
+func (p *uploadProgress) progressTrailer() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stages := make([]string, 0, len(p.timings)+2)
+	at := time.Duration(0)
+	for _, timing := range p.timings {
+		stages = append(stages, fmt.Sprintf("%s;at=%.1f", timing.stage, float64(at)/float64(time.Millisecond)))
+		at += timing.duration
+	}
+	stages = append(stages,
+		fmt.Sprintf("%s;at=%.1f", p.stage, float64(p.stageStart.Sub(p.start))/float64(time.Millisecond)),
+		fmt.Sprintf("%s;at=%.1f", StageDone, float64(time.Since(p.start))/float64(time.Millisecond)),
+	)
+
+	return strings.Join(stages, ", ")
+}
+
+// progressRequested checks if the client asked for the ProgressTrailer
+func progressRequested(r *http.Request) bool {
+	return r.Header.Get(ProgressHeader) == "1"
+}
+
+// watchProgress logs progress snapshots for long-running requests and calls
+// cancel if no bytes move for StallTimeout while reading or uploading. It
+// returns when ctx is done.
+func (d *Deflator) watchProgress(ctx context.Context, cancel context.CancelFunc, p *uploadProgress, location string) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	var lastLog time.Time
+	var lastBytes int64
+	lastMoved := time.Now()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			stage, read, uploaded := p.snapshot()
+
+			if read+uploaded != lastBytes {
+				lastBytes = read + uploaded
+				lastMoved = now
+			}
+
+			elapsed := now.Sub(p.start)
+			if elapsed >= d.config.ProgressLogAfter && now.Sub(lastLog) >= d.config.ProgressLogInterval {
+				lastLog = now
+				logf := log.Debugf
+				if elapsed >= d.config.SlowRequestThreshold {
+					logf = log.Infof
+				}
+				logf(
+					"Upload to %q in progress for %s: stage %s, %d bytes read, %d bytes uploaded",
+					location, elapsed.Truncate(time.Millisecond), stage, read, uploaded,
+				)
+			}
+
+			// Only reading and uploading are expected to move bytes
+			if d.config.StallTimeout > 0 && (stage == StageRead || stage == StageUpload) &&
+				now.Sub(lastMoved) >= d.config.StallTimeout {
+				log.Warnf("Upload to %q stalled in stage %s for %s. Cancelling it", location, stage, d.config.StallTimeout)
+				stalledRequests.Add(stage, 1)
+
+				p.mu.Lock()
+				p.stalledStage = stage
+				p.mu.Unlock()
+
+				cancel()
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// MultiRangeReject answers multi-range requests with 416
+	MultiRangeReject = "reject"
+	// MultiRangeFull answers multi-range requests with the whole object
+	MultiRangeFull = "full"
+)
+
+var (
+	errMultiRange   = fmt.Errorf("multiple ranges are not supported")
+	errInvalidRange = fmt.Errorf("invalid range")
+)
+
+// byteRange is an inclusive range of bytes of an object
+type byteRange struct {
+	start int64
+	end   int64
+}
+
+// header returns the range in the format of the Range request header
+func (br *byteRange) header() string {
+	return fmt.Sprintf("bytes=%d-%d", br.start, br.end)
+}
+
+// contentRange returns the Content-Range response header for the range of an
+// object of the specified size
+func (br *byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", br.start, br.end, size)
+}
+
+// parseRange parses the value of a Range header for an object of the
+// specified size. It returns nil for headers which should be ignored (per RFC
+// 7233, that's anything but a bytes range), errMultiRange for multiple ranges
+// and errInvalidRange for ranges which can't be satisfied.
+func parseRange(header string, size int64) (*byteRange, error) {
+	if !strings.HasPrefix(header, "bytes=") {
+		return nil, nil
+	}
+
+	spec := strings.TrimSpace(strings.TrimPrefix(header, "bytes="))
+	if strings.Contains(spec, ",") {
+		return nil, errMultiRange
+	}
+
+	i := strings.Index(spec, "-")
+	if i < 0 {
+		return nil, nil
+	}
+	first, last := strings.TrimSpace(spec[:i]), strings.TrimSpace(spec[i+1:])
+
+	// Suffix range: the last bytes of the object
+	if first == "" {
+		suffix, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || suffix < 0 {
+			return nil, nil
+		}
+		if suffix == 0 || size == 0 {
+			return nil, errInvalidRange
+		}
+		if suffix > size {
+			suffix = size
+		}
+		return &byteRange{start: size - suffix, end: size - 1}, nil
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return nil, nil
+	}
+
+	end := size - 1
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < start {
+			return nil, nil
+		}
+	}
+
+	if start >= size {
+		return nil, errInvalidRange
+	}
+	if end >= size {
+		end = size - 1
+	}
+
+	return &byteRange{start: start, end: end}, nil
+}
+
+// requestedRange resolves the Range header of r against an object of the
+// specified size. It writes the error response and returns false if the
+// request can't be served.
+func (d *Deflator) requestedRange(w http.ResponseWriter, r *http.Request, size int64) (*byteRange, bool) {
+	header := r.Header.Get("Range")
+	if header == "" {
+		return nil, true
+	}
+
+	br, err := parseRange(header, size)
+	switch {
+	case err == errMultiRange && d.config.MultiRange == MultiRangeFull:
+		return nil, true
+	case err != nil:
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		writeError(w, r, newRequestError(http.StatusRequestedRangeNotSatisfiable, ErrorCodeInvalidRange, "Range not satisfiable: %s", err))
+		return nil, false
+	}
+
+	return br, true
+}
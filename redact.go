@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"math"
+	"strconv"
+	"strings"
+
+	// Register the formats which can be redacted
+	_ "image/gif"
+	_ "image/jpeg"
+
+	"github.com/davidbyttow/govips/pkg/vips"
+)
+
+const (
+	// RedactBlocks is the number of pixelation blocks along the longest side
+	// of a redacted region. The blocks are at least RedactMinBlockSize pixels.
+	RedactBlocks       = 8
+	RedactMinBlockSize = 8
+)
+
+// redactRegion is a rectangle, in pixels
+type redactRegion struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// parseRedactRegion parses `X,Y,W,H`
+func parseRedactRegion(value string) (redactRegion, error) {
+	parts := strings.Split(value, ",")
+	if len(parts) != 4 {
+		return redactRegion{}, fmt.Errorf("expected X,Y,W,H")
+	}
+
+	var coords [4]int
+	for i, part := range parts {
+		coord, err := strconv.ParseUint(strings.TrimSpace(part), 10, 31)
+		if err != nil {
+			return redactRegion{}, fmt.Errorf("invalid coordinate %q", part)
+		}
+		coords[i] = int(coord)
+	}
+
+	region := redactRegion{X: coords[0], Y: coords[1], Width: coords[2], Height: coords[3]}
+	if region.Width == 0 || region.Height == 0 {
+		return redactRegion{}, fmt.Errorf("empty region")
+	}
+
+	return region, nil
+}
+
+func (r redactRegion) rect() image.Rectangle {
+	return image.Rect(r.X, r.Y, r.X+r.Width, r.Y+r.Height)
+}
+
+func regionFromRect(rect image.Rectangle) redactRegion {
+	return redactRegion{X: rect.Min.X, Y: rect.Min.Y, Width: rect.Dx(), Height: rect.Dy()}
+}
+
+// pixelate replaces each block of rect with its average color
+func pixelate(img draw.Image, rect image.Rectangle) {
+	blockSize := rect.Dx()
+	if rect.Dy() > blockSize {
+		blockSize = rect.Dy()
+	}
+	blockSize /= RedactBlocks
+	if blockSize < RedactMinBlockSize {
+		blockSize = RedactMinBlockSize
+	}
+
+	for y := rect.Min.Y; y < rect.Max.Y; y += blockSize {
+		for x := rect.Min.X; x < rect.Max.X; x += blockSize {
+			block := image.Rect(x, y, x+blockSize, y+blockSize).Intersect(rect)
+
+			var r, g, b, a, n uint64
+			for by := block.Min.Y; by < block.Max.Y; by++ {
+				for bx := block.Min.X; bx < block.Max.X; bx++ {
+					cr, cg, cb, ca := img.At(bx, by).RGBA()
+					r, g, b, a, n = r+uint64(cr), g+uint64(cg), b+uint64(cb), a+uint64(ca), n+1
+				}
+			}
+
+			average := color.RGBA64{R: uint16(r / n), G: uint16(g / n), B: uint16(b / n), A: uint16(a / n)}
+			draw.Draw(img, block, &image.Uniform{C: average}, image.ZP, draw.Src)
+		}
+	}
+}
+
+// redactedImage is the result of redactImage
+type redactedImage struct {
+	// body is the redacted image as PNG
+	body []byte
+	// format is the format of the source image
+	format vips.ImageType
+	width  int
+	height int
+	// regions are the redacted regions, clamped to the image bounds
+	regions []redactRegion
+}
+
+// redactImage decodes body and pixelates the regions, which get clamped to
+// the image bounds. Regions entirely outside the image are an error.
+func redactImage(body []byte, regions []redactRegion) (*redactedImage, error) {
+	decoded, format, err := image.Decode(bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode the image: %s", err)
+	}
+
+	bounds := decoded.Bounds()
+	img := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(img, img.Bounds(), decoded, bounds.Min, draw.Src)
+
+	result := &redactedImage{format: outputFormats[format], width: bounds.Dx(), height: bounds.Dy()}
+	if result.format == vips.ImageTypeUnknown {
+		result.format = vips.ImageTypePNG
+	}
+
+	for _, region := range regions {
+		rect := region.rect().Intersect(img.Bounds())
+		if rect.Empty() {
+			return nil, fmt.Errorf("region %d,%d,%d,%d is outside the %dx%d image", region.X, region.Y, region.Width, region.Height, result.width, result.height)
+		}
+
+		pixelate(img, rect)
+		result.regions = append(result.regions, regionFromRect(rect))
+	}
+
+	var buf bytes.Buffer
+	err = png.Encode(&buf, img)
+	if err != nil {
+		return nil, err
+	}
+	result.body = buf.Bytes()
+
+	return result, nil
+}
+
+// scaleRegions maps regions of a sourceWidth x sourceHeight image to the
+// image resized to width and/or height, which gets center-cropped when both
+// are set. Regions cropped out of the output are dropped.
+func scaleRegions(regions []redactRegion, sourceWidth, sourceHeight int, width, height uint64) []redactRegion {
+	outputWidth, outputHeight := outputSize(sourceWidth, sourceHeight, width, height)
+	scale := math.Max(float64(outputWidth)/float64(sourceWidth), float64(outputHeight)/float64(sourceHeight))
+	offsetX := (float64(sourceWidth)*scale - float64(outputWidth)) / 2
+	offsetY := (float64(sourceHeight)*scale - float64(outputHeight)) / 2
+
+	output := image.Rect(0, 0, outputWidth, outputHeight)
+	scaled := make([]redactRegion, 0, len(regions))
+	for _, region := range regions {
+		rect := image.Rect(
+			int(math.Floor(float64(region.X)*scale-offsetX)),
+			int(math.Floor(float64(region.Y)*scale-offsetY)),
+			int(math.Ceil(float64(region.X+region.Width)*scale-offsetX)),
+			int(math.Ceil(float64(region.Y+region.Height)*scale-offsetY)),
+		).Intersect(output)
+
+		if !rect.Empty() {
+			scaled = append(scaled, regionFromRect(rect))
+		}
+	}
+
+	return scaled
+}
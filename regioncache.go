@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// persistedRegions keeps the learned bucket regions across restarts
+var persistedRegions = &regionCache{}
+
+// learnedRegion is an entry of the region cache file
+type learnedRegion struct {
+	Region    string    `json:"region"`
+	LearnedAt time.Time `json:"learned_at"`
+}
+
+// regionCache persists the regions looked up by getS3Uploader to a JSON
+// file, so they don't need to be looked up again after a restart. Without a
+// path it does nothing.
+type regionCache struct {
+	mu      sync.Mutex
+	path    string
+	maxAge  time.Duration
+	entries map[string]learnedRegion
+}
+
+// configure loads the cache file at path, dropping the entries older than
+// maxAge (unless it's zero). Unreadable or corrupt files are ignored, since
+// the regions can always be looked up again.
+func (c *regionCache) configure(path string, maxAge time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.path, c.maxAge = path, maxAge
+	c.entries = make(map[string]learnedRegion)
+	if path == "" {
+		return
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warnf("Ignoring the region cache file: %s", err)
+		}
+		return
+	}
+	var entries map[string]learnedRegion
+	err = json.Unmarshal(data, &entries)
+	if err != nil {
+		log.Warnf("Ignoring the corrupt region cache file %q: %s", path, err)
+		return
+	}
+
+	for bucket, entry := range entries {
+		if entry.Region != "" && c.fresh(entry) {
+			c.entries[bucket] = entry
+		}
+	}
+	log.Infof("Loaded %d bucket regions from %q", len(c.entries), path)
+}
+
+func (c *regionCache) fresh(entry learnedRegion) bool {
+	return c.maxAge <= 0 || time.Since(entry.LearnedAt) < c.maxAge
+}
+
+// get returns the persisted region of bucket, if it's recent enough
+func (c *regionCache) get(bucket string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[bucket]
+	if !ok || !c.fresh(entry) {
+		return "", false
+	}
+	return entry.Region, true
+}
+
+// learn records the region of bucket, rewriting the cache file when it's new
+func (c *regionCache) learn(bucket, region string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.path == "" {
+		return
+	}
+	if entry, ok := c.entries[bucket]; ok && entry.Region == region && c.fresh(entry) {
+		return
+	}
+	c.entries[bucket] = learnedRegion{Region: region, LearnedAt: time.Now().UTC()}
+
+	err := c.write()
+	if err != nil {
+		log.Warnf("Failed to write the region cache file %q: %s", c.path, err)
+	}
+}
+
+// write replaces the cache file atomically, so readers never see a partial one
+func (c *regionCache) write() error {
+	data, err := json.Marshal(c.entries)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(c.path), ".imgdeflator-regions-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), c.path)
+}
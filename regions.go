@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+	"github.com/aws/aws-sdk-go-v2/aws/endpoints"
+	"github.com/aws/aws-sdk-go-v2/service/s3/s3manager"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Sources of the region of a bucket, logged when its uploader gets
+	// provisioned
+	RegionSourceBucketConfig = "bucket_config"
+	RegionSourceURL          = "url"
+	RegionSourceHeader       = "header"
+	RegionSourceAccessPoint  = "access_point"
+	RegionSourceCache        = "cache"
+	RegionSourceResolved     = "resolved"
+
+	// RegionHeader is the request header hinting the region of the
+	// destination bucket, when AllowRegionHeader is set
+	RegionHeader = "X-S3-Region"
+)
+
+var (
+	// commercialRegion matches the regions of the standard partition which
+	// are newer than the endpoint data bundled with the AWS SDK
+	commercialRegion = regexp.MustCompile(`^(us|eu|ap|sa|ca|me|af|il|mx)-[a-z]+-[0-9]+$`)
+
+	// regionLookupStats counts the region lookups by outcome (`success`,
+	// `not_found`, `failure` and `cached_failure` for the ones answered by the
+	// regionFailures) and accumulates their durations in milliseconds
+	regionLookupStats = expvar.NewMap("region_lookups")
+
+	// regionLookupAttempts is how many times a region hint gets tried when
+	// S3 fails, set from the RegionLookupAttempts
+	regionLookupAttempts = 1
+	// regionFailures keeps the failed lookups for a cool-down period
+	regionFailures = &regionFailureCache{entries: make(map[string]*regionFailure)}
+)
+
+// RegionLookupRetryDelay is the base delay before retrying a region lookup,
+// doubled with every attempt and jittered
+const RegionLookupRetryDelay = 100 * time.Millisecond
+
+// unknownPartitionError is returned for regions outside of the partitions
+// supported by the AWS SDK
+type unknownPartitionError struct {
+	region string
+}
+
+func (e *unknownPartitionError) Error() string {
+	return fmt.Sprintf("unknown partition for region %q", e.region)
+}
+
+// regionLookupError is returned when the region of a bucket couldn't be
+// determined because of an S3 failure, as opposed to a bucket which doesn't exist
+type regionLookupError struct {
+	bucket string
+	err    error
+}
+
+func (e *regionLookupError) Error() string {
+	return fmt.Sprintf("failed to determine region for bucket %q: %s", e.bucket, e.err)
+}
+
+// bucketNotFoundError is returned for buckets whose region couldn't be found
+// with any of the hints, because they don't exist
+type bucketNotFoundError struct {
+	bucket string
+}
+
+func (e *bucketNotFoundError) Error() string {
+	return fmt.Sprintf("region for bucket %q not found", e.bucket)
+}
+
+// regionFailure is a failed lookup cached by the regionFailureCache
+type regionFailure struct {
+	err   error
+	until time.Time
+	// failures is the number of consecutive failed lookups
+	failures int
+}
+
+// regionFailureCache answers the lookups of the buckets whose region couldn't
+// be determined with the same error, without asking S3 again. The cool-down
+// starts at backoff and doubles with every consecutive failure, up to
+// maxBackoff. A zero backoff disables it.
+type regionFailureCache struct {
+	mu         sync.Mutex
+	backoff    time.Duration
+	maxBackoff time.Duration
+	entries    map[string]*regionFailure
+}
+
+func (c *regionFailureCache) configure(backoff, maxBackoff time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.backoff, c.maxBackoff = backoff, maxBackoff
+	c.entries = make(map[string]*regionFailure)
+}
+
+// get returns the cached error for bucket, if it's cooling down
+func (c *regionFailureCache) get(bucket string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[bucket]
+	if !ok || time.Now().After(entry.until) {
+		return nil
+	}
+	return entry.err
+}
+
+// record caches the outcome of a lookup of bucket. Successes clear the
+// failures.
+func (c *regionFailureCache) record(bucket string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err == nil || c.backoff <= 0 {
+		delete(c.entries, bucket)
+		return
+	}
+
+	entry, ok := c.entries[bucket]
+	if !ok {
+		entry = &regionFailure{}
+		c.entries[bucket] = entry
+	}
+	entry.failures++
+
+	cooldown := c.backoff
+	for i := 1; i < entry.failures && cooldown < c.maxBackoff; i++ {
+		cooldown *= 2
+	}
+	if cooldown > c.maxBackoff {
+		cooldown = c.maxBackoff
+	}
+	entry.err = err
+	entry.until = time.Now().Add(cooldown)
+	log.Debugf("Not looking up the region of bucket %q again for %s (%d failures)", bucket, cooldown, entry.failures)
+}
+
+// regionPartition returns the ID of the partition (`aws`, `aws-cn` or
+// `aws-us-gov`) which region belongs to
+func regionPartition(region string) (string, error) {
+	if partition, ok := endpoints.NewDefaultResolver().Partitions().ForRegion(region); ok {
+		return partition.ID(), nil
+	}
+
+	if commercialRegion.MatchString(region) {
+		return endpoints.AwsPartitionID, nil
+	}
+
+	return "", &unknownPartitionError{region: region}
+}
+
+// lookupBucketRegion asks S3 for the region of bucket, trying each of the
+// hints in turn. Buckets only get found with a hint in their partition. S3
+// failures get retried up to regionLookupAttempts times per hint, and the
+// buckets which couldn't be looked up are answered from the regionFailures
+// for a while.
+func lookupBucketRegion(ctx context.Context, awsCfg aws.Config, bucket string, hints []string) (string, error) {
+	if err := regionFailures.get(bucket); err != nil {
+		regionLookupStats.Add("cached_failure", 1)
+		return "", err
+	}
+
+	start := time.Now()
+	region, err := resolveBucketRegion(ctx, awsCfg, bucket, hints)
+	regionLookupStats.Add("duration_ms", int64(time.Since(start)/time.Millisecond))
+
+	switch err.(type) {
+	case nil:
+		regionLookupStats.Add("success", 1)
+	case *bucketNotFoundError:
+		regionLookupStats.Add("not_found", 1)
+	default:
+		regionLookupStats.Add("failure", 1)
+	}
+
+	// Cancelled requests say nothing about the bucket
+	if ctx.Err() == nil {
+		regionFailures.record(bucket, err)
+	}
+
+	return region, err
+}
+
+func resolveBucketRegion(ctx context.Context, awsCfg aws.Config, bucket string, hints []string) (string, error) {
+	for _, hint := range hints {
+		var err error
+		for attempt := 1; ; attempt++ {
+			var region string
+			region, err = s3manager.GetBucketRegion(ctx, awsCfg, bucket, hint)
+			if err == nil {
+				return region, nil
+			}
+			if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "NotFound" {
+				break
+			}
+			if attempt >= regionLookupAttempts || isProxyError(err) {
+				return "", &regionLookupError{bucket: bucket, err: err}
+			}
+
+			// Full jitter
+			delay := time.Duration(rand.Int63n(int64(RegionLookupRetryDelay << uint(attempt-1))))
+			log.Debugf("Retrying the region lookup of bucket %q in %s: %s", bucket, delay, err)
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return "", &regionLookupError{bucket: bucket, err: ctx.Err()}
+			}
+		}
+		log.Debugf("Bucket %q not found using region hint %s", bucket, hint)
+	}
+
+	return "", &bucketNotFoundError{bucket: bucket}
+}
+
+// uploaderError converts an error returned by getS3Uploader to the error
+// returned to clients
+func uploaderError(bucket string, err error) error {
+	if reqErr, ok := err.(*requestError); ok {
+		return reqErr
+	}
+
+	log.Warnf("Failed to get uploader for bucket %q: %s", bucket, err)
+
+	switch err := err.(type) {
+	case *unknownPartitionError:
+		return newRequestError(http.StatusBadRequest, ErrorCodeInvalidRegion, "Unknown AWS partition for region %q", err.region)
+	case *bucketNotFoundError:
+		return newRequestError(http.StatusNotFound, ErrorCodeNotFound, "Bucket not found")
+	case *regionLookupError:
+		if isProxyError(err.err) {
+			return newRequestError(http.StatusBadGateway, ErrorCodeProxyUnavailable, "Egress proxy unavailable").withCause(err.err)
+		}
+		return newRequestError(http.StatusServiceUnavailable, ErrorCodeRegionLookupFailed, "Failed to determine the bucket region").withCause(err.err)
+	default:
+		return newRequestError(http.StatusBadRequest, ErrorCodeInvalidBucket, "Bad request")
+	}
+}
+
+// applyRegionHeader uses the RegionHeader of r as the region of the bucket
+// of req, if it's allowed. It takes precedence over the region of the URL,
+// but not over the one of the bucket config.
+func (d *Deflator) applyRegionHeader(r *http.Request, req *uploadRequest) error {
+	region := r.Header.Get(RegionHeader)
+	if region == "" || !d.config.AllowRegionHeader {
+		return nil
+	}
+	if _, err := regionPartition(region); err != nil {
+		log.Debugf("Invalid %s header %q", RegionHeader, region)
+		return newRequestError(http.StatusBadRequest, ErrorCodeInvalidRegion, "Invalid %s header %q", RegionHeader, region)
+	}
+	req.regionHint = region
+	req.regionHeader = true
+	return nil
+}
+
+// isWrongRegionError checks if err, or the error it's caused by, is the
+// AWS error of requests sent to another region than the bucket's
+func isWrongRegionError(err error) bool {
+	if rerr, ok := err.(*requestError); ok {
+		err = rerr.cause
+	}
+	// s3manager wraps the errors of multipart uploads
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "MultipartUpload" {
+		err = aerr.OrigErr()
+	}
+	switch awsErrorCode(err) {
+	case "AuthorizationHeaderMalformed", "PermanentRedirect", "BucketRegionError", "IllegalLocationConstraintException":
+		return true
+	}
+	return false
+}
+
+// wrongRegionHeaderError evicts the uploader provisioned for the wrong
+// region hinted by the RegionHeader of req, so the next requests look the
+// region up again, and tells the client about it
+func wrongRegionHeaderError(req *uploadRequest, err error) error {
+	if entry, ok := uploaderCache.Peek(req.bucket); ok && entry.(*uploaderCacheEntry).region == req.regionHint {
+		uploaderCache.Remove(req.bucket)
+	}
+	log.Debugf("Wrong %s header %q for URL %q: %s", RegionHeader, req.regionHint, req.location(), err)
+	return newRequestError(
+		http.StatusBadRequest, ErrorCodeInvalidRegion,
+		"Incorrect %s header: bucket %q isn't in region %s", RegionHeader, req.bucket, req.regionHint,
+	).withCause(err)
+}
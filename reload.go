@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Reload re-reads the configuration files which support hot reloading. The
+// current configuration is kept if any of them fails to load.
+func (d *Deflator) Reload() error {
+	filter, err := loadIPFilter(d.config)
+	if err != nil {
+		return err
+	}
+
+	profiles, err := d.loadTransformProfiles(d.config.ProfileConfigFile)
+	if err == nil {
+		err = validateBucketProfiles(d.buckets, profiles)
+	}
+	if err != nil {
+		return err
+	}
+
+	denylist, err := loadPhashDenylist(d.config.PhashDenylistFile)
+	if err != nil {
+		return err
+	}
+
+	d.ipFilter.Store(filter)
+	d.profiles.Store(profiles)
+	d.denylist.Store(denylist)
+	d.invalidateCapabilities()
+	log.Infof("Loaded %d transform profiles", len(profiles))
+	if d.config.PhashDenylistFile != "" {
+		log.Infof("Loaded %d denylisted perceptual hashes", len(denylist))
+	}
+
+	return nil
+}
+
+// handleReloads calls Reload on the deflator every time a SIGHUP is received,
+// until ctx is cancelled
+func handleReloads(ctx context.Context, d *Deflator) {
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	defer signal.Stop(reload)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-reload:
+			log.Info("Received SIGHUP. Reloading the configuration")
+			err := d.Reload()
+			if err != nil {
+				log.Errorf("Failed to reload the configuration: %s", err)
+			}
+		}
+	}
+}
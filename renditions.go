@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"expvar"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/s3manager"
+	"github.com/davidbyttow/govips/pkg/vips"
+	log "github.com/sirupsen/logrus"
+)
+
+// RenditionSourceETagMetaKey is the object metadata of the cached renditions
+// which holds the ETag of the source object they were generated from
+const RenditionSourceETagMetaKey = "Imgdeflator-Source-Etag"
+
+// The X-Cache values of the transformed GET responses
+const (
+	CacheHit   = "hit"
+	CacheStale = "stale"
+	CacheMiss  = "miss"
+)
+
+var (
+	// renditionCacheStats counts the outcomes of the rendition cache lookups
+	// and of their background revalidations
+	renditionCacheStats = expvar.NewMap("rendition_cache")
+)
+
+// renditionCache tracks the cached renditions being revalidated or
+// regenerated in the background, so only one refresh runs per key
+type renditionCache struct {
+	mu sync.Mutex
+	// refreshing maps the keys being refreshed to whether they're known to
+	// be stale
+	refreshing map[string]bool
+}
+
+func newRenditionCache() *renditionCache {
+	return &renditionCache{refreshing: make(map[string]bool)}
+}
+
+// begin claims the refresh of key, unless one is already running
+func (c *renditionCache) begin(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.refreshing[key]; ok {
+		return false
+	}
+	c.refreshing[key] = false
+	return true
+}
+
+// markStale records that the rendition at key is being regenerated
+func (c *renditionCache) markStale(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.refreshing[key] = true
+}
+
+// stale checks whether the rendition at key is known to be stale
+func (c *renditionCache) stale(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.refreshing[key]
+}
+
+func (c *renditionCache) end(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.refreshing, key)
+}
+
+// renditionKey returns where the rendition of location for r gets cached, or
+// an empty key when it doesn't. The key is the derived key of the resolved
+// output format, so `format=auto` caches each format separately. Encrypted
+// buckets and keys outside the allowed destinations aren't cached.
+func (d *Deflator) renditionKey(r *http.Request, location *s3Location, options *requestOptions) string {
+	if !d.config.CacheRenditions || r.Method != http.MethodGet || !options.transform() ||
+		d.bucketConfig(location.bucket).KMSKeyID != "" {
+		return ""
+	}
+
+	resolved := *options
+	resolved.format = ""
+	if format := options.outputFormat(r); format != vips.ImageTypeUnknown {
+		resolved.format = vips.ImageTypes[format]
+	}
+	key := derivedKey(location.key, &resolved)
+	if d.authorizeDestination(location.bucket, key) != nil {
+		return ""
+	}
+	return key
+}
+
+// serveCachedRendition serves the rendition cached at key, if there is one,
+// and revalidates it against its source in the background. It returns
+// whether the response was sent and, if not, whether a rendition can be
+// stored at key: objects without the source ETag metadata weren't stored by
+// the cache, so they never get overwritten.
+func (d *Deflator) serveCachedRendition(w http.ResponseWriter, r *http.Request, location *s3Location, options *requestOptions, key string) (bool, bool) {
+	cached := &s3Location{bucket: location.bucket, key: key, regionHint: location.regionHint}
+	output, err := d.getObject(r.Context(), cached, nil)
+	if err != nil {
+		// Other failures fall back to the transform
+		return false, errorCode(err) == ErrorCodeNotFound
+	}
+	defer output.Body.Close()
+
+	sourceETag := metadataValue(output.Metadata, RenditionSourceETagMetaKey)
+	if sourceETag == "" || isEncrypted(output.Metadata) {
+		log.Debugf("Not serving %q, which wasn't stored by the rendition cache", cached.logString())
+		return false, false
+	}
+
+	state := CacheHit
+	if d.renditions.stale(key) {
+		state = CacheStale
+	}
+	renditionCacheStats.Add(state, 1)
+
+	format := options.outputFormat(r)
+	go d.revalidateRendition(location, options.transformOptions(), format, key, sourceETag)
+
+	etag := transformETag(sourceETag, options, format)
+	w.Header().Set("ETag", etag)
+	if output.LastModified != nil {
+		w.Header().Set("Last-Modified", output.LastModified.UTC().Format(http.TimeFormat))
+		if age := d.clock.Now().Sub(*output.LastModified); age > 0 {
+			w.Header().Set("Age", strconv.FormatInt(int64(age/time.Second), 10))
+		}
+	}
+	if options.format == FormatAuto {
+		w.Header().Set("Vary", "Accept")
+	}
+	w.Header().Set("Cache-Control", d.cacheControl(location.bucket))
+	w.Header().Set("X-Cache", state)
+
+	if matchesETag(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return true, false
+	}
+
+	if output.ContentType != nil {
+		w.Header().Set("Content-Type", *output.ContentType)
+	}
+	if output.ContentLength != nil {
+		w.Header().Set("Content-Length", strconv.FormatInt(*output.ContentLength, 10))
+	}
+	w.WriteHeader(http.StatusOK)
+	_, err = io.Copy(w, output.Body)
+	if err != nil {
+		log.Warnf("Failed to send %q: %s", cached.logString(), err)
+	}
+	return true, false
+}
+
+// revalidateRendition compares the source ETag of the rendition cached at key
+// with the one of its source, regenerating the rendition when they differ
+func (d *Deflator) revalidateRendition(location *s3Location, options *requestOptions, format vips.ImageType, key, sourceETag string) {
+	if !d.renditions.begin(key) {
+		return
+	}
+	defer d.renditions.end(key)
+
+	ctx, cancel := context.WithTimeout(context.Background(), d.config.UploadTimeout)
+	defer cancel()
+
+	source, err := d.inspect(ctx, location.bucket, location.key, location.regionHint)
+	if err != nil || source == nil || aws.StringValue(source.ETag) == sourceETag {
+		return
+	}
+
+	d.renditions.markStale(key)
+	log.Debugf("Regenerating the stale rendition %q", (&s3Location{bucket: location.bucket, key: key}).logString())
+	err = d.regenerateRendition(ctx, location, options, format, key)
+	if err != nil {
+		renditionCacheStats.Add("regeneration_failures", 1)
+		log.Warnf("Failed to regenerate the rendition %q: %s", (&s3Location{bucket: location.bucket, key: key}).logString(), err)
+		return
+	}
+	renditionCacheStats.Add("regenerations", 1)
+}
+
+// regenerateRendition transforms the current source object and stores the
+// result at key
+func (d *Deflator) regenerateRendition(ctx context.Context, location *s3Location, options *requestOptions, format vips.ImageType, key string) error {
+	output, err := d.getObject(ctx, location, nil)
+	if err != nil {
+		return err
+	}
+	defer output.Body.Close()
+
+	// The plaintext of encrypted sources mustn't end up in the cache
+	if isEncrypted(output.Metadata) {
+		return nil
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(output.Body, d.config.MaxUploadSize+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(body)) > d.config.MaxUploadSize {
+		return newRequestError(http.StatusRequestEntityTooLarge, ErrorCodePayloadTooLarge, "Source object too large")
+	}
+
+	err = d.checkWorkBudget(location.bucket, body, workload{encodes: 1, renditions: 1})
+	if err != nil {
+		return err
+	}
+
+	buf, imageType, err := transformImage(body, options.width, options.height, &encoderProfile{format: format}, options.caption())
+	if err != nil {
+		return err
+	}
+	return d.storeRendition(ctx, location, key, buf, imageType, aws.StringValue(output.ETag))
+}
+
+// cacheRendition stores a rendition generated by a GET in the background,
+// unless the key is already being refreshed
+func (d *Deflator) cacheRendition(location *s3Location, key string, buf []byte, imageType vips.ImageType, sourceETag string) {
+	if sourceETag == "" || !d.renditions.begin(key) {
+		return
+	}
+
+	go func() {
+		defer d.renditions.end(key)
+
+		ctx, cancel := context.WithTimeout(context.Background(), d.config.UploadTimeout)
+		defer cancel()
+
+		err := d.storeRendition(ctx, location, key, buf, imageType, sourceETag)
+		if err != nil {
+			log.Warnf("Failed to cache the rendition %q: %s", (&s3Location{bucket: location.bucket, key: key}).logString(), err)
+		}
+	}()
+}
+
+// storeRendition uploads the rendition of location to key, recording the
+// ETag of the source it was generated from
+func (d *Deflator) storeRendition(ctx context.Context, location *s3Location, key string, buf []byte, imageType vips.ImageType, sourceETag string) error {
+	uploader, err := getS3Uploader(ctx, location.bucket, location.regionHint, d.config.DefaultS3Region, d.endpointOptions(location.bucket))
+	if err != nil {
+		return err
+	}
+
+	_, err = uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+		Bucket:      aws.String(location.bucket),
+		Key:         aws.String(key),
+		ContentType: aws.String("image/" + strings.TrimPrefix(imageType.OutputExt(), ".")),
+		Metadata:    map[string]string{RenditionSourceETagMetaKey: sourceETag},
+		Body:        bytes.NewReader(buf),
+	})
+	if err != nil {
+		return err
+	}
+	invalidateHeadCache(location.bucket, key)
+	return nil
+}
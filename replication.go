@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/s3manager"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// ReplicationPolicyRequired fails the request when any replica upload fails
+	ReplicationPolicyRequired = "required"
+	// ReplicationPolicyBestEffort only logs replica upload failures and retries them in the background
+	ReplicationPolicyBestEffort = "best_effort"
+
+	ReplicationQueueSize      = 1000
+	ReplicationRetryAttempts  = 5
+	ReplicationRetryBaseDelay = 1 * time.Second
+)
+
+// replicaResult reports the outcome of uploading a replica to a secondary bucket
+type replicaResult struct {
+	Bucket string `json:"bucket"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// replicationJob is a failed best-effort replica upload waiting to be retried
+type replicationJob struct {
+	input    s3manager.UploadInput
+	body     []byte
+	attempts int
+}
+
+// uploadReplica stores body in the specified bucket, using input as a template
+// for the upload parameters, and returns the uploader of the bucket
+func (d *Deflator) uploadReplica(ctx context.Context, bucket string, input s3manager.UploadInput, body []byte) (*s3manager.Uploader, error) {
+	uploader, err := getS3Uploader(ctx, bucket, "", d.config.DefaultS3Region, d.endpointOptions(bucket))
+	if err != nil {
+		return nil, err
+	}
+
+	input.Bucket = aws.String(bucket)
+	input.Body = bytes.NewReader(body)
+
+	_, err = uploader.UploadWithContext(ctx, &input)
+	return uploader, err
+}
+
+// replicate uploads body to all the replica buckets concurrently and returns
+// the result for each of them in the order of the replicas list, plus false if
+// the replication policy was violated. The stored replicas are recorded in tx
+// in that order too. Failed best-effort uploads are queued for retrying.
+func (d *Deflator) replicate(ctx context.Context, tx *uploadTransaction, replicas []string, policy string, input s3manager.UploadInput, body []byte) ([]replicaResult, bool) {
+	results := make([]replicaResult, len(replicas))
+	uploaders := make([]*s3manager.Uploader, len(replicas))
+	ok := true
+
+	var wg sync.WaitGroup
+	for i, bucket := range replicas {
+		wg.Add(1)
+		go func(i int, bucket string) {
+			defer wg.Done()
+
+			results[i] = replicaResult{Bucket: bucket, Status: "ok"}
+
+			uploader, err := d.uploadReplica(ctx, bucket, input, body)
+			if err == nil {
+				uploaders[i] = uploader
+				return
+			}
+
+			log.Warnf("Failed to replicate %q to bucket %q: %s", logKey(aws.StringValue(input.Key)), bucket, err)
+			results[i].Error = err.Error()
+			results[i].Status = "failed"
+
+			if policy == ReplicationPolicyBestEffort {
+				replicaInput := input
+				replicaInput.Bucket = aws.String(bucket)
+				d.scheduleReplication(&replicationJob{input: replicaInput, body: body})
+				results[i].Status = "queued"
+			}
+		}(i, bucket)
+	}
+	wg.Wait()
+
+	for i, result := range results {
+		if result.Status == "failed" && policy == ReplicationPolicyRequired {
+			ok = false
+		}
+		if uploaders[i] != nil {
+			tx.record(uploaders[i], ObjectRoleReplica, result.Bucket, aws.StringValue(input.Key))
+		}
+	}
+
+	return results, ok
+}
+
+// scheduleReplication queues a job for retrying after an exponential backoff
+// based on the number of attempts made so far
+func (d *Deflator) scheduleReplication(job *replicationJob) {
+	atomic.AddInt64(&d.replicationRetries, 1)
+	time.AfterFunc(ReplicationRetryBaseDelay<<uint(job.attempts), func() {
+		atomic.AddInt64(&d.replicationRetries, -1)
+		select {
+		case d.replicationQueue <- job:
+		default:
+			log.Errorf("Replication queue full. Dropping replica of %q for bucket %q",
+				aws.StringValue(job.input.Key), aws.StringValue(job.input.Bucket))
+		}
+	})
+}
+
+// RunReplicationQueue retries failed best-effort replica uploads until ctx is cancelled
+func (d *Deflator) RunReplicationQueue(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case job := <-d.replicationQueue:
+			job.attempts++
+
+			uploadCtx, cancel := context.WithTimeout(ctx, d.config.UploadTimeout)
+			_, err := d.uploadReplica(uploadCtx, aws.StringValue(job.input.Bucket), job.input, job.body)
+			cancel()
+			if err == nil {
+				log.Infof("Replicated %q to bucket %q after %d retries",
+					aws.StringValue(job.input.Key), aws.StringValue(job.input.Bucket), job.attempts)
+				continue
+			}
+
+			if job.attempts >= ReplicationRetryAttempts {
+				log.Errorf("Giving up replicating %q to bucket %q after %d retries: %s",
+					aws.StringValue(job.input.Key), aws.StringValue(job.input.Bucket), job.attempts, err)
+				continue
+			}
+
+			d.scheduleReplication(job)
+		}
+	}
+}
+
+// drainReplicationQueue makes a last attempt at the queued replica uploads,
+// once RunReplicationQueue returned. The failed ones and the ones still
+// waiting for their retry delay are dropped.
+func (d *Deflator) drainReplicationQueue(ctx context.Context) (int, error) {
+	dropped := 0
+	for {
+		select {
+		case job := <-d.replicationQueue:
+			_, err := d.uploadReplica(ctx, aws.StringValue(job.input.Bucket), job.input, job.body)
+			if err != nil {
+				log.Errorf("Dropping the replica of %q for bucket %q on shutdown: %s",
+					aws.StringValue(job.input.Key), aws.StringValue(job.input.Bucket), err)
+				dropped++
+			}
+		case <-ctx.Done():
+			return dropped + d.replicationBacklog(), ctx.Err()
+		default:
+			return dropped + int(atomic.LoadInt64(&d.replicationRetries)), nil
+		}
+	}
+}
+
+// replicationBacklog counts the replica uploads which are queued or waiting
+// for their retry delay
+func (d *Deflator) replicationBacklog() int {
+	return len(d.replicationQueue) + int(atomic.LoadInt64(&d.replicationRetries))
+}
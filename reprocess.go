@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/davidbyttow/govips/pkg/vips"
+	log "github.com/sirupsen/logrus"
+)
+
+// errReprocessInterrupted is returned by the runs stopped by a signal
+var errReprocessInterrupted = errors.New("interrupted")
+
+// reprocessJob describes a run of the reprocess command
+type reprocessJob struct {
+	bucket  string
+	prefix  string
+	profile string
+	// destPrefix replaces prefix in the rewritten keys, if set
+	destPrefix  string
+	concurrency int
+	dryRun      bool
+}
+
+// reprocessCheckpoint is saved after every page of objects, so interrupted
+// runs resume after the last object of the listing which got reprocessed,
+// with every object before it done
+type reprocessCheckpoint struct {
+	Bucket     string `json:"bucket"`
+	Prefix     string `json:"prefix"`
+	StartAfter string `json:"start_after"`
+	Processed  int    `json:"processed"`
+	Failed     int    `json:"failed"`
+}
+
+// reprocessFailure is a line of the error report
+type reprocessFailure struct {
+	Key   string `json:"key"`
+	Code  string `json:"code"`
+	Error string `json:"error"`
+}
+
+// loadReprocessCheckpoint reads the checkpoint at path, which must be of
+// the same bucket and prefix. A missing file starts from scratch.
+func loadReprocessCheckpoint(path string, job *reprocessJob) (*reprocessCheckpoint, error) {
+	checkpoint := &reprocessCheckpoint{Bucket: job.bucket, Prefix: job.prefix}
+	if path == "" {
+		return checkpoint, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return checkpoint, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, checkpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid checkpoint %q: %s", path, err)
+	}
+	if checkpoint.Bucket != job.bucket || checkpoint.Prefix != job.prefix {
+		return nil, fmt.Errorf("the checkpoint %q is of s3://%s/%s", path, checkpoint.Bucket, checkpoint.Prefix)
+	}
+	return checkpoint, nil
+}
+
+// save writes the checkpoint to path through a temporary file, so an
+// interruption doesn't leave half of it
+func (c *reprocessCheckpoint) save(path string) error {
+	if path == "" {
+		return nil
+	}
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(path+".tmp", data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// destinationKey returns the key key gets rewritten to
+func (job *reprocessJob) destinationKey(key string) string {
+	if job.destPrefix == "" {
+		return key
+	}
+	return job.destPrefix + strings.TrimPrefix(key, job.prefix)
+}
+
+// reprocessObject runs the object at key through the same pipeline as the
+// copy-transforms, with the transform profile of job, and overwrites its
+// destination. The destination key is kept as is, whatever the key template
+// of the bucket.
+func (d *Deflator) reprocessObject(ctx context.Context, job *reprocessJob, key string) error {
+	destination := &s3Location{bucket: job.bucket, key: job.destinationKey(key)}
+	err := d.authorizeDestination(destination.bucket, destination.key)
+	if err != nil {
+		return err
+	}
+	options, err := d.parseOptions(job.bucket, url.Values{"profile": {job.profile}}, http.Header{})
+	if err != nil {
+		return err
+	}
+	req, err := d.uploadRequestFromOptions(destination, options)
+	if err != nil {
+		return err
+	}
+	req.collision = CollisionOverwrite
+	req.keyTemplate, err = parseKeyTemplate("{orig_key}")
+	if err != nil {
+		return err
+	}
+
+	body, source, contentType, err := d.downloadSource(ctx, req, &s3Location{bucket: job.bucket, key: key})
+	if err != nil {
+		return err
+	}
+	req.body = bytes.NewReader(body)
+	req.declaredSize = int64(len(body))
+	req.contentType = contentType
+	req.source = source
+
+	_, err = d.upload(ctx, req)
+	return err
+}
+
+// reprocessOne reprocesses the object at key, waiting for the S3 call
+// budget when it's exhausted instead of failing. Dry runs only log where
+// the object would go.
+func (d *Deflator) reprocessOne(ctx context.Context, job *reprocessJob, key string) error {
+	if job.dryRun {
+		log.Infof("Would reprocess %q to %q", key, job.destinationKey(key))
+		return nil
+	}
+	for {
+		err := d.reprocessObject(ctx, job, key)
+		budgetErr := asS3BudgetError(err)
+		if budgetErr == nil {
+			return err
+		}
+		select {
+		case <-time.After(budgetErr.wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// reprocess lists the objects of job page by page and reprocesses them
+// with job.concurrency workers, recording the failures in report. Once stop
+// gets closed, no more objects are started and the run ends with the
+// checkpoint of the objects which are done.
+func (d *Deflator) reprocess(ctx context.Context, stop <-chan struct{}, job *reprocessJob, checkpoint *reprocessCheckpoint, checkpointPath string, report *json.Encoder) error {
+	uploader, err := getS3Uploader(ctx, job.bucket, "", d.config.DefaultS3Region, d.endpointOptions(job.bucket))
+	if err != nil {
+		return uploaderError(job.bucket, err)
+	}
+
+	var reportMu sync.Mutex
+	input := &s3.ListObjectsV2Input{Bucket: aws.String(job.bucket), Prefix: aws.String(job.prefix)}
+	if checkpoint.StartAfter != "" {
+		input.StartAfter = aws.String(checkpoint.StartAfter)
+	}
+	for {
+		select {
+		case <-stop:
+			return errReprocessInterrupted
+		default:
+		}
+
+		listReq := uploader.S3.ListObjectsV2Request(input)
+		listReq.SetContext(ctx)
+		page, err := listReq.Send()
+		if err != nil {
+			return fmt.Errorf("failed to list s3://%s/%s: %s", job.bucket, job.prefix, err)
+		}
+
+		// done marks the objects of the page which got reprocessed or failed
+		keys := make([]string, 0, len(page.Contents))
+		for _, object := range page.Contents {
+			keys = append(keys, aws.StringValue(object.Key))
+		}
+		done := make([]bool, len(keys))
+		work := make(chan int)
+		var wg sync.WaitGroup
+		for i := 0; i < job.concurrency; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := range work {
+					err := d.reprocessOne(ctx, job, keys[i])
+					// The aborted objects are left for the next run
+					if err != nil && ctx.Err() != nil {
+						continue
+					}
+					reportMu.Lock()
+					if err != nil {
+						log.Warnf("Failed to reprocess %q: %s", (&s3Location{bucket: job.bucket, key: keys[i]}).logString(), err)
+						checkpoint.Failed++
+						if report != nil {
+							_ = report.Encode(&reprocessFailure{Key: keys[i], Code: errorCode(err), Error: err.Error()})
+						}
+					} else {
+						checkpoint.Processed++
+					}
+					done[i] = true
+					reportMu.Unlock()
+				}
+			}()
+		}
+
+		stopped := false
+	dispatch:
+		for i := range keys {
+			select {
+			case work <- i:
+			case <-stop:
+				stopped = true
+				break dispatch
+			}
+		}
+		close(work)
+		wg.Wait()
+
+		for i := 0; i < len(keys) && done[i]; i++ {
+			checkpoint.StartAfter = keys[i]
+		}
+		// Dry runs don't reprocess anything a later run could skip
+		if !job.dryRun {
+			err = checkpoint.save(checkpointPath)
+			if err != nil {
+				return fmt.Errorf("failed to save the checkpoint: %s", err)
+			}
+		}
+		log.Infof("Reprocessed %d objects of s3://%s/%s (%d failed), up to %q", checkpoint.Processed, job.bucket, job.prefix, checkpoint.Failed, checkpoint.StartAfter)
+
+		if stopped {
+			return errReprocessInterrupted
+		}
+		if !aws.BoolValue(page.IsTruncated) {
+			return nil
+		}
+		input.ContinuationToken = page.NextContinuationToken
+	}
+}
+
+// runReprocessCommand re-encodes the existing objects of a bucket prefix
+// with a transform profile. The first SIGINT or SIGTERM lets the objects in
+// progress finish and saves the checkpoint, the second one aborts them.
+func runReprocessCommand(deflator *Deflator, args []string) {
+	flags := flag.NewFlagSet("reprocess", flag.ExitOnError)
+	job := &reprocessJob{}
+	flags.StringVar(&job.bucket, "bucket", "", "Bucket of the objects to reprocess")
+	flags.StringVar(&job.prefix, "prefix", "", "Key prefix of the objects to reprocess")
+	flags.StringVar(&job.profile, "profile", "", "Transform profile to apply")
+	flags.StringVar(&job.destPrefix, "dest-prefix", "", "Key prefix replacing -prefix in the rewritten keys (default: overwrite the objects)")
+	flags.IntVar(&job.concurrency, "concurrency", 4, "How many objects get reprocessed at once")
+	flags.BoolVar(&job.dryRun, "dry-run", false, "Only list the objects which would be reprocessed")
+	checkpointPath := flags.String("checkpoint", "", "File recording the progress, to resume interrupted runs")
+	reportPath := flags.String("report", "", "File receiving a JSON line for each object which failed")
+	allowAnonymous := flags.Bool("allow-anonymous", deflator.config.AllowAnonymous, "Send unsigned requests to S3 when no AWS credentials are found")
+	_ = flags.Parse(args)
+
+	switch {
+	case job.bucket == "" || job.profile == "":
+		log.Fatalf("Both -bucket and -profile are required")
+	case job.concurrency <= 0:
+		log.Fatalf("Invalid concurrency %d", job.concurrency)
+	// The rewritten objects would get listed again
+	case job.destPrefix != "" && job.destPrefix != job.prefix && strings.HasPrefix(job.destPrefix, job.prefix):
+		log.Fatalf("The destination prefix %q can't be inside the prefix %q", job.destPrefix, job.prefix)
+	}
+	if _, ok := deflator.transformProfiles()[job.profile]; !ok {
+		log.Fatalf("Unknown transform profile %q", job.profile)
+	}
+
+	err := initCredentials(*allowAnonymous)
+	if err != nil {
+		log.Fatalf("Failed to resolve the AWS credentials: %s", err)
+	}
+
+	checkpoint, err := loadReprocessCheckpoint(*checkpointPath, job)
+	if err != nil {
+		log.Fatalf("Failed to load the checkpoint: %s", err)
+	}
+	var report *json.Encoder
+	if *reportPath != "" {
+		file, err := os.OpenFile(*reportPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			log.Fatalf("Failed to open the error report: %s", err)
+		}
+		defer file.Close()
+		report = json.NewEncoder(file)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stop := make(chan struct{})
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		log.Info("Stopping once the objects in progress are done")
+		close(stop)
+		<-signals
+		log.Info("Aborting the objects in progress")
+		cancel()
+	}()
+
+	err = deflator.reprocess(ctx, stop, job, checkpoint, *checkpointPath, report)
+	vips.Shutdown()
+	if err != nil {
+		log.Fatalf("Reprocessing stopped after %q (%d objects done, %d failed): %s", checkpoint.StartAfter, checkpoint.Processed, checkpoint.Failed, err)
+	}
+	log.Infof("Reprocessed %d objects of s3://%s/%s (%d failed)", checkpoint.Processed, job.bucket, job.prefix, checkpoint.Failed)
+	if checkpoint.Failed > 0 {
+		os.Exit(1)
+	}
+}
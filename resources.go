@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"runtime"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// ResourceCheckInterval is how often the memory and disk usage get sampled
+	ResourceCheckInterval = time.Second
+	// ResourceLowWaterRatio is the fraction of the high-water marks below which
+	// shedding stops again, so the guard doesn't flap
+	ResourceLowWaterRatio = 0.9
+	// GoMemLimitRatio is the fraction of GOMEMLIMIT used as the memory
+	// high-water mark when none is configured
+	GoMemLimitRatio = 0.9
+)
+
+var (
+	// resourceStats publishes the state of the resource guard: 1 for
+	// `shedding` while new requests are rejected, and the sampled usage
+	resourceStats = expvar.NewMap("resource_guard")
+
+	// goMemLimit matches GOMEMLIMIT values like `512MiB`
+	goMemLimit = regexp.MustCompile(`^([0-9]+)(B|KiB|MiB|GiB|TiB)?$`)
+)
+
+// resourceGuard sheds new requests while the memory usage is above
+// MemoryHighWater or the spool disk has less than DiskMinFree bytes free
+type resourceGuard struct {
+	memoryHighWater uint64
+	diskMinFree     uint64
+	spoolDir        string
+	retryAfter      time.Duration
+	shedding        int32
+
+	memoryGauge   *expvar.Int
+	diskFreeGauge *expvar.Int
+	sheddingGauge *expvar.Int
+}
+
+// parseGoMemLimit parses the value of the GOMEMLIMIT environment variable,
+// returning 0 if it's not set or disabled
+func parseGoMemLimit(value string) (uint64, error) {
+	if value == "" || value == "off" {
+		return 0, nil
+	}
+
+	match := goMemLimit.FindStringSubmatch(value)
+	if match == nil {
+		return 0, fmt.Errorf("invalid GOMEMLIMIT %q", value)
+	}
+
+	limit, err := strconv.ParseUint(match[1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid GOMEMLIMIT %q", value)
+	}
+
+	switch match[2] {
+	case "KiB":
+		limit <<= 10
+	case "MiB":
+		limit <<= 20
+	case "GiB":
+		limit <<= 30
+	case "TiB":
+		limit <<= 40
+	}
+
+	return limit, nil
+}
+
+// newResourceGuard returns nil when neither limit is configured. Without a
+// MemoryHighWater, 90% of GOMEMLIMIT is used if it's set.
+func newResourceGuard(config *Config, spoolDir string) (*resourceGuard, error) {
+	memoryHighWater := config.MemoryHighWater
+	if memoryHighWater == 0 {
+		limit, err := parseGoMemLimit(os.Getenv("GOMEMLIMIT"))
+		if err != nil {
+			return nil, err
+		}
+		memoryHighWater = uint64(float64(limit) * GoMemLimitRatio)
+	}
+
+	if memoryHighWater == 0 && config.DiskMinFree == 0 {
+		return nil, nil
+	}
+
+	g := &resourceGuard{
+		memoryHighWater: memoryHighWater,
+		diskMinFree:     config.DiskMinFree,
+		spoolDir:        spoolDir,
+		retryAfter:      config.ConcurrencyRetryAfter,
+		memoryGauge:     new(expvar.Int),
+		diskFreeGauge:   new(expvar.Int),
+		sheddingGauge:   new(expvar.Int),
+	}
+	resourceStats.Set("memory_bytes", g.memoryGauge)
+	resourceStats.Set("disk_free_bytes", g.diskFreeGauge)
+	resourceStats.Set("shedding", g.sheddingGauge)
+
+	return g, nil
+}
+
+// isShedding is safe to call on a nil resourceGuard
+func (g *resourceGuard) isShedding() bool {
+	return g != nil && atomic.LoadInt32(&g.shedding) == 1
+}
+
+// memoryInUse approximates the memory used by the process. Spooled bodies
+// are held on the heap, so they're part of it.
+func memoryInUse() uint64 {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.Sys - stats.HeapReleased
+}
+
+// diskFree returns the number of bytes available in dir
+func diskFree(dir string) (uint64, error) {
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(dir, &stat)
+	if err != nil {
+		return 0, err
+	}
+	return stat.Bavail * uint64(stat.Bsize), nil
+}
+
+// update samples the resource usage and switches between the normal and
+// shedding states
+func (g *resourceGuard) update() {
+	shedding := g.isShedding()
+	threshold := func(limit uint64) uint64 {
+		if shedding {
+			return uint64(float64(limit) * ResourceLowWaterRatio)
+		}
+		return limit
+	}
+
+	var reasons []string
+	if g.memoryHighWater > 0 {
+		memory := memoryInUse()
+		g.memoryGauge.Set(int64(memory))
+		if memory > threshold(g.memoryHighWater) {
+			reasons = append(reasons, fmt.Sprintf("memory in use %d bytes (high-water mark: %d)", memory, g.memoryHighWater))
+		}
+	}
+
+	if g.diskMinFree > 0 {
+		free, err := diskFree(g.spoolDir)
+		if err != nil {
+			log.Warnf("Failed to check the free disk space in %q: %s", g.spoolDir, err)
+		} else {
+			g.diskFreeGauge.Set(int64(free))
+			// Shedding stops once the free space is back above the limit plus 10%
+			limit := g.diskMinFree
+			if shedding {
+				limit = uint64(float64(limit) / ResourceLowWaterRatio)
+			}
+			if free < limit {
+				reasons = append(reasons, fmt.Sprintf("%d bytes free in %s (minimum: %d)", free, g.spoolDir, g.diskMinFree))
+			}
+		}
+	}
+
+	switch {
+	case len(reasons) > 0 && !shedding:
+		log.Warnf("Shedding new requests: %v", reasons)
+		atomic.StoreInt32(&g.shedding, 1)
+	case len(reasons) == 0 && shedding:
+		log.Infof("Resource usage back to normal, accepting new requests again")
+		atomic.StoreInt32(&g.shedding, 0)
+	}
+	g.sheddingGauge.Set(int64(atomic.LoadInt32(&g.shedding)))
+}
+
+// Run samples the resource usage until ctx is cancelled
+func (g *resourceGuard) Run(ctx context.Context) {
+	ticker := time.NewTicker(ResourceCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		g.update()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// err returns the error for requests rejected while shedding, nil otherwise
+func (g *resourceGuard) err() error {
+	if !g.isShedding() {
+		return nil
+	}
+
+	err := newRequestError(http.StatusServiceUnavailable, ErrorCodeOverloaded, "Server overloaded, try again later")
+	err.retryAfter = g.retryAfter
+	return err
+}
+
+// resourceGuardHandler rejects new requests while shedding. The in-flight
+// requests carry on.
+func (d *Deflator) resourceGuardHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := d.resources.err(); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// InheritedListenersEnv lists the addresses of the listeners passed to a
+	// restarted process, in the order of their file descriptors
+	InheritedListenersEnv = "IMGDEFLATOR_INHERITED_LISTENERS"
+	// ReadyFDEnv is the file descriptor restarted processes close once they
+	// serve the inherited listeners
+	ReadyFDEnv = "IMGDEFLATOR_READY_FD"
+
+	// inheritedFDStart is the first file descriptor of exec.Cmd.ExtraFiles
+	inheritedFDStart = 3
+)
+
+// inheritedListeners are the listeners passed by the process which restarted
+// this one, by address. bind takes them instead of opening new sockets.
+var inheritedListeners = loadInheritedListeners()
+
+func loadInheritedListeners() map[string]net.Listener {
+	addrs := os.Getenv(InheritedListenersEnv)
+	if addrs == "" {
+		return nil
+	}
+
+	listeners := make(map[string]net.Listener)
+	for i, addr := range strings.Split(addrs, ",") {
+		file := os.NewFile(uintptr(inheritedFDStart+i), addr)
+		ln, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			log.Errorf("Failed to inherit the listener on %s: %s", addr, err)
+			continue
+		}
+		listeners[addr] = ln
+	}
+
+	return listeners
+}
+
+// takeInheritedListener returns the inherited listener for addr, if any
+func takeInheritedListener(addr string) net.Listener {
+	ln, ok := inheritedListeners[addr]
+	if ok {
+		delete(inheritedListeners, addr)
+	}
+	return ln
+}
+
+// isRestarted checks whether this process was started by a restart
+func isRestarted() bool {
+	return os.Getenv(ReadyFDEnv) != ""
+}
+
+// notifyReady tells the process which restarted this one that it can start
+// draining, and closes the inherited listeners which aren't configured anymore
+func notifyReady() {
+	for addr, ln := range inheritedListeners {
+		log.Warnf("Closing the inherited listener on %s, which isn't configured anymore", addr)
+		ln.Close()
+	}
+	inheritedListeners = nil
+
+	fd, err := strconv.Atoi(os.Getenv(ReadyFDEnv))
+	if err != nil {
+		return
+	}
+	ready := os.NewFile(uintptr(fd), "ready")
+	_, _ = ready.Write([]byte("ready"))
+	ready.Close()
+}
+
+// restart starts a new process running the same executable with the bound
+// listeners, and returns once it serves them
+func (d *Deflator) restart() error {
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to find the executable: %s", err)
+	}
+
+	var files []*os.File
+	var addrs []string
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+	for _, l := range d.listeners {
+		filer, ok := l.listener.(interface{ File() (*os.File, error) })
+		if !ok {
+			return fmt.Errorf("the listener on %s can't be passed on", l.config.Addr)
+		}
+		file, err := filer.File()
+		if err != nil {
+			return fmt.Errorf("failed to pass on the listener on %s: %s", l.config.Addr, err)
+		}
+		files = append(files, file)
+		addrs = append(addrs, l.config.Addr)
+	}
+	if d.grpcListener != nil {
+		file, err := d.grpcListener.(*net.TCPListener).File()
+		if err != nil {
+			return fmt.Errorf("failed to pass on the gRPC listener: %s", err)
+		}
+		files = append(files, file)
+		addrs = append(addrs, ":"+d.config.GRPCPort)
+	}
+
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("failed to create the readiness pipe: %s", err)
+	}
+	defer readyReader.Close()
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(files, readyWriter)
+	cmd.Env = append(os.Environ(),
+		InheritedListenersEnv+"="+strings.Join(addrs, ","),
+		ReadyFDEnv+"="+strconv.Itoa(inheritedFDStart+len(files)),
+	)
+	err = cmd.Start()
+	readyWriter.Close()
+	if err != nil {
+		return fmt.Errorf("failed to start the new process: %s", err)
+	}
+	log.Infof("Started the new process (pid %d), waiting for it to be ready", cmd.Process.Pid)
+
+	// The new process gets reaped by init once this one exits
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	ready := make(chan bool, 1)
+	go func() {
+		message, _ := ioutil.ReadAll(readyReader)
+		ready <- string(message) == "ready"
+	}()
+
+	select {
+	case ok := <-ready:
+		if !ok {
+			return fmt.Errorf("the new process (pid %d) exited before getting ready: %s", cmd.Process.Pid, <-exited)
+		}
+		return nil
+	case <-time.After(d.config.RestartTimeout):
+		_ = cmd.Process.Kill()
+		return fmt.Errorf("the new process (pid %d) didn't get ready within %s", cmd.Process.Pid, d.config.RestartTimeout)
+	}
+}
+
+// handleRestarts restarts the process on SIGUSR2, until ctx is cancelled.
+// Once the new process serves the listeners, stop gets called so this one
+// drains the in-flight requests and exits.
+func handleRestarts(ctx context.Context, stop func(), d *Deflator) {
+	restarts := make(chan os.Signal, 1)
+	signal.Notify(restarts, syscall.SIGUSR2)
+	defer signal.Stop(restarts)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-restarts:
+			log.Infof("Received SIGUSR2. Restarting (parent pid %d)", os.Getpid())
+			err := d.restart()
+			if err != nil {
+				log.Errorf("Failed to restart, still serving: %s", err)
+				continue
+			}
+
+			log.Infof("The new process is ready. Draining (parent pid %d)", os.Getpid())
+			stop()
+			return
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+const (
+	// restartedTestEnv is the fakes3 endpoint of the test binary restarted by
+	// TestRestartHandoff
+	restartedTestEnv = "IMGDEFLATOR_TEST_RESTARTED_S3"
+	// restartedPIDHeader tells the uploads served by the restarted process
+	restartedPIDHeader = "X-Test-Pid"
+)
+
+// runRestartedTest serves the inherited listeners like a restarted process,
+// until SIGTERM
+func runRestartedTest() int {
+	config, err := loadTestConfig(os.Getenv(restartedTestEnv))
+	if err != nil {
+		return 1
+	}
+	d, err := NewDeflator(config, nil, nil)
+	if err != nil {
+		return 1
+	}
+	err = initCredentials(false)
+	if err != nil {
+		return 1
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM)
+
+	routes := d.routes()
+	d.listenerConfigs = []*ListenerConfig{{Addr: "127.0.0.1:0", Network: "tcp"}}
+	err = d.Listen(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(restartedPIDHeader, strconv.Itoa(os.Getpid()))
+		routes.ServeHTTP(w, r)
+	}))
+	if err != nil {
+		return 1
+	}
+	d.Serve()
+	notifyReady()
+
+	<-stop
+	err = d.shutdownListeners(context.Background())
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+func TestRestartHandoff(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.close()
+
+	// The upload to the old process blocks until released
+	started, release := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	s.fake.SetFault(func(r *http.Request) int {
+		if r.Method == http.MethodPut && r.URL.Path == "/"+TestBucket+"/old.png" {
+			once.Do(func() { close(started) })
+			<-release
+		}
+		return 0
+	})
+
+	d := s.deflator
+	baseURL := s.listen(&ListenerConfig{})
+	// Every upload gets its own connection, accepted by either process
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}, Timeout: 10 * time.Second}
+	upload := func(key string) (*http.Response, error) {
+		return client.Post(baseURL+s.uploadPath(TestBucket, key, "width=16"), "image/png", bytes.NewReader(testPNG(t, 32, 32)))
+	}
+
+	responses := make(chan *http.Response, 1)
+	go func() {
+		resp, err := upload("old.png")
+		if err != nil {
+			t.Errorf("The upload to the old process failed: %s", err)
+			close(responses)
+			return
+		}
+		responses <- resp
+	}()
+
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("The upload never reached S3")
+	}
+
+	os.Setenv(restartedTestEnv, s.s3.URL)
+	defer os.Unsetenv(restartedTestEnv)
+	err := d.restart()
+	if err != nil {
+		t.Fatalf("Failed to restart: %s", err)
+	}
+
+	d.drain()
+	stopped := make(chan error, 1)
+	go func() { stopped <- d.shutdownListeners(context.Background()) }()
+
+	// Once the old process stops accepting, the new one serves the uploads
+	pid := 0
+	for i := 0; i < 50 && pid == 0; i++ {
+		resp, err := upload("new.png")
+		if err != nil {
+			t.Fatalf("The upload during the restart failed: %s", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected the upload during the restart to succeed, got %d", resp.StatusCode)
+		}
+		pid, _ = strconv.Atoi(resp.Header.Get(restartedPIDHeader))
+		if pid == 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if pid == 0 {
+		t.Fatalf("The new process never served an upload")
+	}
+	defer func() {
+		_ = syscall.Kill(pid, syscall.SIGTERM)
+		// The restart reaps the new process once it exits
+		deadline := time.Now().Add(5 * time.Second)
+		for syscall.Kill(pid, 0) == nil {
+			if time.Now().After(deadline) {
+				_ = syscall.Kill(pid, syscall.SIGKILL)
+				t.Errorf("The new process (pid %d) didn't stop", pid)
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	if pid == os.Getpid() {
+		t.Fatalf("The upload was served by the old process")
+	}
+
+	select {
+	case err := <-stopped:
+		t.Fatalf("The old process stopped before its upload finished: %v", err)
+	default:
+	}
+	close(release)
+
+	resp, ok := <-responses
+	if !ok {
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected the upload to the old process to complete, got %d", resp.StatusCode)
+	}
+	if err := <-stopped; err != nil {
+		t.Errorf("Failed to stop the old process: %s", err)
+	}
+	for _, key := range []string{"old.png", "new.png"} {
+		if _, ok := s.fake.Object(TestBucket, key); !ok {
+			t.Errorf("The upload of %s wasn't stored", key)
+		}
+	}
+}
+
+func TestTakeInheritedListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	defer ln.Close()
+
+	inheritedListeners = map[string]net.Listener{":8080": ln}
+	defer func() { inheritedListeners = nil }()
+
+	if takeInheritedListener(":9090") != nil {
+		t.Errorf("Expected no listener for another address")
+	}
+	if takeInheritedListener(":8080") != ln {
+		t.Errorf("Expected the inherited listener")
+	}
+	if takeInheritedListener(":8080") != nil {
+		t.Errorf("Expected the inherited listener to be taken only once")
+	}
+}
+
+func TestNotifyReady(t *testing.T) {
+	stale, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	defer stale.Close()
+	inheritedListeners = map[string]net.Listener{":8080": stale}
+	defer func() { inheritedListeners = nil }()
+
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Failed to create the pipe: %s", err)
+	}
+	defer reader.Close()
+	// notifyReady closes the descriptor, which no os.File may own
+	fd, err := syscall.Dup(int(writer.Fd()))
+	writer.Close()
+	if err != nil {
+		t.Fatalf("Failed to duplicate the pipe: %s", err)
+	}
+	os.Setenv(ReadyFDEnv, strconv.Itoa(fd))
+	defer os.Unsetenv(ReadyFDEnv)
+
+	if !isRestarted() {
+		t.Errorf("Expected the process to be restarted with %s", ReadyFDEnv)
+	}
+	notifyReady()
+
+	message, err := ioutil.ReadAll(reader)
+	if err != nil || string(message) != "ready" {
+		t.Errorf("Expected the ready message, got %q (%v)", message, err)
+	}
+	if inheritedListeners != nil {
+		t.Errorf("Expected the unused inherited listeners to be dropped")
+	}
+	if _, err := stale.Accept(); err == nil {
+		t.Errorf("Expected the unused inherited listener to be closed")
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// normalizeRoutePath collapses the duplicate leading slashes of path, and
+// strips a single trailing slash, which some proxies add around the base64
+// token of the upload paths. It returns the normalizations it applied.
+func normalizeRoutePath(path string) (string, []string) {
+	var applied []string
+	if strings.HasPrefix(path, "//") {
+		trimmed := "/" + strings.TrimLeft(path, "/")
+		applied = append(applied, fmt.Sprintf("collapsed %d leading slashes", len(path)-len(trimmed)+1))
+		path = trimmed
+	}
+	if len(path) > 1 && strings.HasSuffix(path, "/") {
+		applied = append(applied, "stripped the trailing slash")
+		path = strings.TrimSuffix(path, "/")
+	}
+	return path, applied
+}
+
+// normalizeRoute returns u with its path normalized, with NormalizePaths,
+// before its signature gets checked and its path decoded. The paths which
+// still have separators in them can't be a single base64 token, and are
+// rejected with ErrorCodeMalformedPath.
+func (d *Deflator) normalizeRoute(u *url.URL) (*url.URL, error) {
+	path := u.Path
+	if d.config.NormalizePaths {
+		var applied []string
+		path, applied = normalizeRoutePath(path)
+		if len(applied) > 0 {
+			log.Debugf("Normalized path %s: %s", logRawPath(u.Path), strings.Join(applied, ", "))
+		}
+	}
+	if strings.Contains(strings.TrimPrefix(path, "/"), "/") {
+		log.Debugf("Path separator in path %s", logRawPath(u.Path))
+		return nil, newRequestError(http.StatusBadRequest, ErrorCodeMalformedPath, "Malformed path: expected a single base64 token")
+	}
+	if path == u.Path {
+		return u, nil
+	}
+
+	normalized := *u
+	normalized.Path = path
+	normalized.RawPath = ""
+	return &normalized, nil
+}
+
+// collapseLeadingSlashes serves the requests whose path starts with several
+// slashes, which the mux would redirect, as if it had a single one
+func collapseLeadingSlashes(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "//") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		path := "/" + strings.TrimLeft(r.URL.Path, "/")
+		log.Debugf("Collapsed the %d leading slashes of path %s", len(r.URL.Path)-len(path)+1, logRawPath(r.URL.Path))
+		u := *r.URL
+		u.Path = path
+		u.RawPath = ""
+		collapsed := *r
+		collapsed.URL = &u
+		next.ServeHTTP(w, &collapsed)
+	})
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// S3BudgetPut is the budget of the PUT-class calls: PUT, POST and DELETE
+	S3BudgetPut = "put"
+	// S3BudgetGet is the budget of the GET-class calls: GET and HEAD
+	S3BudgetGet = "get"
+)
+
+var (
+	// s3BudgetStats counts the S3 calls which waited for the call budget,
+	// their accumulated wait and the calls which got shed, per class, and
+	// publishes the current utilization of each budget
+	s3BudgetStats = expvar.NewMap("s3_budget")
+
+	// s3Budget limits the rate of all the S3 calls, whatever their bucket.
+	// It's set up by NewDeflator.
+	s3Budget *s3CallBudget
+)
+
+// tokenBucket hands out rate tokens per second, up to burst at once. The
+// tokens are reserved in the order they're asked for, going negative when
+// they run out, so concurrent callers are served first come, first served.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: now}
+}
+
+// advance adds the tokens accrued since the last call
+func (b *tokenBucket) advance(now time.Time) {
+	if now.After(b.last) {
+		b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+		b.last = now
+	}
+}
+
+// reserve takes a token and returns how long the caller has to wait before
+// using it. If that's longer than maxWait, no token is taken.
+func (b *tokenBucket) reserve(now time.Time, maxWait time.Duration) (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.advance(now)
+	var wait time.Duration
+	if b.tokens < 1 {
+		wait = time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+	}
+	if wait > maxWait {
+		return wait, false
+	}
+	b.tokens--
+	return wait, true
+}
+
+// release gives back a reserved token which didn't get used
+func (b *tokenBucket) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = math.Min(b.burst, b.tokens+1)
+}
+
+// utilization returns the share of the burst which is currently taken
+func (b *tokenBucket) utilization(now time.Time) float64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.advance(now)
+	return math.Max(0, 1-b.tokens/b.burst)
+}
+
+// s3CallBudget holds a token bucket per class of S3 calls. A nil bucket
+// doesn't limit its class.
+type s3CallBudget struct {
+	buckets map[string]*tokenBucket
+	maxWait time.Duration
+}
+
+// newS3CallBudget builds the S3 call budget from config, or returns nil
+// when no rate is set. A zero burst defaults to one second worth of calls.
+func newS3CallBudget(config *Config) (*s3CallBudget, error) {
+	limits := []struct {
+		class string
+		rate  float64
+		burst int
+	}{
+		{S3BudgetPut, config.S3PutRate, config.S3PutBurst},
+		{S3BudgetGet, config.S3GetRate, config.S3GetBurst},
+	}
+
+	budget := &s3CallBudget{buckets: make(map[string]*tokenBucket), maxWait: config.S3BudgetMaxWait}
+	now := time.Now()
+	for _, limit := range limits {
+		if limit.rate < 0 || limit.burst < 0 {
+			return nil, fmt.Errorf("invalid S3 %s budget (rate %g, burst %d)", limit.class, limit.rate, limit.burst)
+		}
+		if limit.rate == 0 {
+			continue
+		}
+		burst := limit.burst
+		if burst == 0 {
+			burst = int(math.Max(1, math.Ceil(limit.rate)))
+		}
+		bucket := newTokenBucket(limit.rate, burst, now)
+		budget.buckets[limit.class] = bucket
+		s3BudgetStats.Set(limit.class+"_utilization", expvar.Func(func() interface{} {
+			return bucket.utilization(time.Now())
+		}))
+	}
+	if len(budget.buckets) == 0 {
+		return nil, nil
+	}
+	if config.S3BudgetMaxWait < 0 {
+		return nil, fmt.Errorf("invalid S3 budget max wait %s", config.S3BudgetMaxWait)
+	}
+	return budget, nil
+}
+
+// s3CallClass returns the budget class of the S3 calls using method
+func s3CallClass(method string) string {
+	switch method {
+	case "", "GET", "HEAD":
+		return S3BudgetGet
+	}
+	return S3BudgetPut
+}
+
+// acquire waits for a token of the class of method. The wait is bounded by
+// maxWait and the deadline of ctx, and the calls which would have to wait
+// longer get an s3BudgetError without taking a token.
+func (b *s3CallBudget) acquire(ctx context.Context, method string) error {
+	class := s3CallClass(method)
+	bucket := b.buckets[class]
+	if bucket == nil {
+		return nil
+	}
+
+	maxWait := b.maxWait
+	if deadline, ok := ctx.Deadline(); ok {
+		if remaining := time.Until(deadline); remaining < maxWait {
+			maxWait = remaining
+		}
+	}
+	wait, ok := bucket.reserve(time.Now(), maxWait)
+	if !ok {
+		s3BudgetStats.Add(class+"_shed", 1)
+		return &s3BudgetError{class: class, wait: wait}
+	}
+	if wait <= 0 {
+		return nil
+	}
+
+	s3BudgetStats.Add(class+"_waits", 1)
+	s3BudgetStats.Add(class+"_wait_ms", int64(wait/time.Millisecond))
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		bucket.release()
+		return ctx.Err()
+	}
+}
+
+// handler acquires from the budget before each attempt of the S3 requests,
+// retries included. It runs before the request gets signed, so a failure
+// stops it from being sent.
+func (b *s3CallBudget) handler() aws.NamedHandler {
+	return aws.NamedHandler{
+		Name: "imgdeflator.S3CallBudget",
+		Fn: func(r *aws.Request) {
+			if err := b.acquire(r.Context(), r.Operation.HTTPMethod); err != nil {
+				r.Error = err
+			}
+		},
+	}
+}
+
+// limitS3Calls makes the requests of the clients built from awsCfg acquire
+// from the S3 call budget, if there is one
+func limitS3Calls(awsCfg *aws.Config) {
+	if s3Budget != nil {
+		awsCfg.Handlers.Sign.PushFrontNamed(s3Budget.handler())
+	}
+}
+
+// s3BudgetError is returned for the S3 calls which would have waited longer
+// than allowed for the call budget
+type s3BudgetError struct {
+	class string
+	wait  time.Duration
+}
+
+func (e *s3BudgetError) Error() string {
+	return fmt.Sprintf("S3 %s call budget exhausted (next call in %s)", e.class, e.wait)
+}
+
+// asS3BudgetError returns the s3BudgetError err is or wraps, if any
+func asS3BudgetError(err error) *s3BudgetError {
+	for err != nil {
+		switch e := err.(type) {
+		case *s3BudgetError:
+			return e
+		case *requestError:
+			err = e.cause
+		case *regionLookupError:
+			err = e.err
+		case *url.Error:
+			err = e.Err
+		case awserr.Error:
+			err = e.OrigErr()
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+// shedS3BudgetError turns the errors caused by the S3 call budget into 429
+// responses, with the wait for the next call as their Retry-After
+func shedS3BudgetError(err error) error {
+	budgetErr := asS3BudgetError(err)
+	if budgetErr == nil {
+		return err
+	}
+	log.Debugf("Shedding the request: %s", budgetErr)
+	rerr := newRequestError(http.StatusTooManyRequests, ErrorCodeRateLimited, "S3 call budget exhausted").withCause(budgetErr)
+	rerr.retryAfter = budgetErr.wait
+	return rerr
+}
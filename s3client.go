@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/tls"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/external"
+	"golang.org/x/net/http2"
+)
+
+var (
+	// s3Connections counts the new and reused connections to the AWS endpoints
+	s3Connections = expvar.NewMap("s3_connections")
+
+	// s3HTTPClient is shared by all the AWS clients so the cached uploaders
+	// draw from the same connection pool. It's set up by NewDeflator.
+	s3HTTPClient *http.Client
+
+	// s3Endpoint replaces the AWS endpoints when set, e.g. for S3-compatible
+	// servers or fakes3. It's set up by NewDeflator.
+	s3Endpoint string
+)
+
+// connectionTracer counts whether the requests it sends got a new or a
+// pooled connection, and turns the failures to connect through the egress
+// proxy into proxyErrors
+type connectionTracer struct {
+	transport http.RoundTripper
+	proxy     func(*http.Request) (*url.URL, error)
+	// connections counts the new and reused connections, if set
+	connections *expvar.Map
+}
+
+func newConnectionTracer(transport http.RoundTripper, proxy func(*http.Request) (*url.URL, error), connections *expvar.Map) *connectionTracer {
+	return &connectionTracer{transport: transport, proxy: proxy, connections: connections}
+}
+
+func (t *connectionTracer) RoundTrip(req *http.Request) (*http.Response, error) {
+	proxyURL, _ := t.proxy(req)
+
+	// The connection got through the proxy once the transport has it, or
+	// starts the TLS handshake with the endpoint. HTTPS proxies get their own
+	// handshake first.
+	var connected, handshakes int32
+	proxyHandshakes := int32(0)
+	if proxyURL != nil && proxyURL.Scheme == "https" {
+		proxyHandshakes = 1
+	}
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			atomic.StoreInt32(&connected, 1)
+			if t.connections == nil {
+				return
+			}
+			if info.Reused {
+				t.connections.Add("reused", 1)
+			} else {
+				t.connections.Add("new", 1)
+			}
+		},
+		TLSHandshakeStart: func() {
+			if atomic.AddInt32(&handshakes, 1) > proxyHandshakes {
+				atomic.StoreInt32(&connected, 1)
+			}
+		},
+	}
+
+	resp, err := t.transport.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+	if err != nil && proxyURL != nil && atomic.LoadInt32(&connected) == 0 && req.Context().Err() == nil {
+		proxyFailures.Add(1)
+		return nil, &proxyError{err: err}
+	}
+	return resp, err
+}
+
+// newS3HTTPClient builds the HTTP client used for the AWS requests from the
+// S3 transport settings in config. S3ProxyURL overrides ProxyURL.
+func newS3HTTPClient(config *Config) (*http.Client, error) {
+	proxyURL := config.ProxyURL
+	if config.S3ProxyURL != "" {
+		proxyURL = config.S3ProxyURL
+	}
+	proxy, err := egressProxy(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	roots, err := loadCABundle(config.CABundleFile)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          config.S3MaxIdleConns,
+		MaxIdleConnsPerHost:   config.S3MaxIdleConnsPerHost,
+		IdleConnTimeout:       config.S3IdleConnTimeout,
+		TLSHandshakeTimeout:   config.S3TLSHandshakeTimeout,
+		ExpectContinueTimeout: 5 * time.Second,
+	}
+	if roots != nil {
+		transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+	}
+	if config.S3DisableHTTP2 {
+		// A non-nil empty map stops the transport from negotiating HTTP/2
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	} else if roots != nil {
+		// Transports with a custom TLS config don't negotiate HTTP/2 by themselves
+		err = http2.ConfigureTransport(transport)
+		if err != nil {
+			return nil, fmt.Errorf("failed to enable HTTP/2: %s", err)
+		}
+	}
+
+	return &http.Client{Transport: newConnectionTracer(transport, proxy, s3Connections)}, nil
+}
+
+// loadAWSConfig loads the default AWS config with the shared HTTP client
+func loadAWSConfig() (aws.Config, error) {
+	awsCfg, err := external.LoadDefaultAWSConfig()
+	if err != nil {
+		return awsCfg, fmt.Errorf("could not load the default AWS config: %s", err)
+	}
+
+	if s3HTTPClient != nil {
+		awsCfg.HTTPClient = s3HTTPClient
+	}
+	if s3Endpoint != "" {
+		awsCfg.EndpointResolver = aws.ResolveWithEndpointURL(s3Endpoint)
+	}
+	if sharedCredentials != nil {
+		awsCfg.Credentials = sharedCredentials.credentials()
+	}
+	limitS3Calls(&awsCfg)
+
+	return awsCfg, nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/endpoints"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// s3EndpointOptions selects the S3 endpoint used by an uploader
+type s3EndpointOptions struct {
+	accelerate bool
+	dualstack  bool
+	// region is the configured bucket region, which saves looking it up
+	region string
+	// regionFallbacks are the hints tried after the default region when
+	// looking up the bucket region
+	regionFallbacks []string
+	// expectedOwner is the AWS account ID the bucket must belong to, checked
+	// with a HeadBucket request when verifyOwner is set
+	expectedOwner string
+	verifyOwner   bool
+	// filesystemRoot stores the bucket on the filesystem instead of S3
+	filesystemRoot string
+	filesystemSync bool
+	// profile is the named AWS profile of the bucket, empty for the default
+	// credentials chain
+	profile string
+	// hintSource is where the region hint comes from, RegionSourceURL if
+	// empty
+	hintSource string
+}
+
+// style describes the endpoint for the logs and the admin API
+func (o s3EndpointOptions) style() string {
+	switch {
+	case o.accelerate && o.dualstack:
+		return "accelerate+dualstack"
+	case o.accelerate:
+		return "accelerate"
+	case o.dualstack:
+		return "dualstack"
+	default:
+		return "standard"
+	}
+}
+
+// endpointOptions returns the endpoint options for bucket, applying the
+// bucket config on top of the global defaults
+func (d *Deflator) endpointOptions(bucket string) s3EndpointOptions {
+	config := d.bucketConfig(bucket)
+	options := s3EndpointOptions{
+		accelerate:      d.config.S3UseAccelerate,
+		dualstack:       d.config.S3UseDualstack,
+		region:          config.Region,
+		regionFallbacks: d.config.RegionFallbacks,
+		expectedOwner:   d.config.ExpectedBucketOwner,
+		verifyOwner:     d.config.VerifyBucketOwner,
+		profile:         d.awsProfile(bucket),
+	}
+	if config.ExpectedOwner != "" {
+		options.expectedOwner = config.ExpectedOwner
+	}
+
+	if isFilesystemBucket(d.config.FilesystemBucketPrefixes, bucket) {
+		options.filesystemRoot = d.config.FilesystemRoot
+		options.filesystemSync = d.config.FilesystemSync
+	}
+
+	if config.UseAccelerate != nil {
+		options.accelerate = *config.UseAccelerate
+	}
+	if config.UseDualstack != nil {
+		options.dualstack = *config.UseDualstack
+	}
+
+	return options
+}
+
+// useDualstack makes awsCfg resolve the dualstack (IPv4 and IPv6) endpoints
+func useDualstack(awsCfg *aws.Config) {
+	resolver := endpoints.NewDefaultResolver()
+	resolver.UseDualStack = true
+	awsCfg.EndpointResolver = resolver
+}
+
+// checkAccelerate makes sure that Transfer Acceleration can be used for
+// bucket. The regional endpoint must be used to query the bucket settings.
+func checkAccelerate(ctx context.Context, awsCfg aws.Config, bucket string) error {
+	if strings.Contains(bucket, ".") {
+		return fmt.Errorf("bucket names containing dots are not compatible with Transfer Acceleration")
+	}
+
+	req := s3.New(awsCfg).GetBucketAccelerateConfigurationRequest(&s3.GetBucketAccelerateConfigurationInput{
+		Bucket: aws.String(bucket),
+	})
+	req.SetContext(ctx)
+	output, err := req.Send()
+	if err != nil {
+		return fmt.Errorf("failed to get the accelerate configuration: %s", err)
+	}
+
+	if output.Status != s3.BucketAccelerateStatusEnabled {
+		return fmt.Errorf("Transfer Acceleration is not enabled")
+	}
+
+	return nil
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// AcceptedS3URLFormats is reported to clients sending an unrecognized S3 URL
+const AcceptedS3URLFormats = "s3://<bucket>/<key>, https://<bucket>.s3.<region>.amazonaws.com/<key>, " +
+	"https://s3.<region>.amazonaws.com/<bucket>/<key>, arn:aws:s3:::<bucket>/<key> or " +
+	"arn:aws:s3:<region>:<account>:accesspoint/<name>/object/<key>"
+
+var (
+	// virtualHostedS3Host matches `<bucket>.s3.amazonaws.com`, `<bucket>.s3.<region>.amazonaws.com`,
+	// the legacy `<bucket>.s3-<region>.amazonaws.com` and the website endpoints
+	virtualHostedS3Host = regexp.MustCompile(`^(.+)\.s3(?:[.-]((?:dualstack\.|website\.)?[a-z0-9-]+))?\.amazonaws\.com(?:\.cn)?$`)
+	// pathStyleS3Host matches `s3.amazonaws.com`, `s3.<region>.amazonaws.com` and `s3-<region>.amazonaws.com`
+	pathStyleS3Host = regexp.MustCompile(`^s3(?:[.-]((?:dualstack\.|website\.)?[a-z0-9-]+))?\.amazonaws\.com(?:\.cn)?$`)
+	// accessPointResource matches the resource of access point object ARNs
+	accessPointResource = regexp.MustCompile(`^accesspoint/([a-zA-Z0-9.-]+)/object/(.*)$`)
+	// storageEndpointHost matches the hosts of the AWS endpoints and of the
+	// object stores of other cloud providers, which aren't bucket names even
+	// though they'd be valid ones
+	storageEndpointHost = regexp.MustCompile(`(?i)(?:^|\.)(?:amazonaws\.com(?:\.cn)?|cloudfront\.net|storage\.googleapis\.com|` +
+		`blob\.core\.windows\.net|digitaloceanspaces\.com|r2\.cloudflarestorage\.com|backblazeb2\.com)$`)
+	// bucketName matches the current and the legacy bucket names
+	bucketName = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,255}$`)
+	// arnField matches the partition and region of ARNs
+	arnField = regexp.MustCompile(`^[a-z0-9-]*$`)
+	// arnAccount matches the account ID of ARNs
+	arnAccount = regexp.MustCompile(`^[0-9]*$`)
+)
+
+// s3Location is an S3 object, normalized from any of the accepted URL formats
+type s3Location struct {
+	// bucket is the bucket name or, for access points, the access point ARN
+	bucket string
+	key    string
+	// regionHint is the region found in the URL, if any, which avoids looking it up
+	regionHint string
+}
+
+func (l *s3Location) String() string {
+	return "s3://" + l.bucket + "/" + l.key
+}
+
+const (
+	// Values of LogKeys, which controls how object keys appear in the logs
+	LogKeysFull     = "full"
+	LogKeysHash     = "hash"
+	LogKeysTruncate = "truncate"
+	LogKeysOmit     = "omit"
+
+	// LogKeyOmitted replaces the keys with LogKeysOmit
+	LogKeyOmitted = "[omitted]"
+
+	// LogKeysTruncateLength is how much of the keys gets logged with
+	// LogKeysTruncate
+	LogKeysTruncateLength = 32
+	// LogRawPathLength is how much of the paths which can't be decoded gets
+	// logged
+	LogRawPathLength = 16
+
+	// MaxEncodedPathLength is the longest request path decodePath accepts,
+	// enough for HTTPS URLs with fully percent-encoded keys of MaxKeyLength
+	// bytes
+	MaxEncodedPathLength = 8192
+)
+
+// endpointHostError is returned for S3 URLs and ARNs whose bucket is the host
+// of a storage endpoint
+type endpointHostError struct {
+	host string
+}
+
+func (e *endpointHostError) Error() string {
+	return fmt.Sprintf("bucket %q is a storage endpoint host", e.host)
+}
+
+// logKeys is the LogKeys setting, applied to all the log lines
+var logKeys = LogKeysFull
+
+// isLogKeysMode checks whether mode is one of the LogKeys values
+func isLogKeysMode(mode string) bool {
+	switch mode {
+	case LogKeysFull, LogKeysHash, LogKeysTruncate, LogKeysOmit:
+		return true
+	}
+	return false
+}
+
+// redactKey renders key according to the LogKeys mode
+func redactKey(mode, key string) string {
+	switch mode {
+	case LogKeysHash:
+		sum := sha256.Sum256([]byte(key))
+		return "sha256:" + hex.EncodeToString(sum[:8])
+	case LogKeysTruncate:
+		if len(key) > LogKeysTruncateLength {
+			return key[:LogKeysTruncateLength] + "..."
+		}
+	case LogKeysOmit:
+		return LogKeyOmitted
+	}
+	return key
+}
+
+// logKey renders key for the logs according to logKeys
+func logKey(key string) string {
+	return redactKey(logKeys, key)
+}
+
+// logString describes the location in the logs, which don't get the full key
+// unless logKeys allows it
+func (l *s3Location) logString() string {
+	return "s3://" + l.bucket + "/" + logKey(l.key)
+}
+
+// logRawPath describes a request path which couldn't be decoded, without
+// logging more of it than needed to recognize it
+func logRawPath(path string) string {
+	if len(path) <= LogRawPathLength {
+		return fmt.Sprintf("%q", path)
+	}
+	return fmt.Sprintf("%q... (%d bytes)", path[:LogRawPathLength], len(path))
+}
+
+// describePath describes the destination encoded in a request path for the
+// logs: the decoded location when possible, a prefix of the path otherwise
+func describePath(path string) string {
+	decodedPath, err := decodePath(path)
+	if err == nil {
+		var location *s3Location
+		location, err = parseS3Location(decodedPath)
+		if err == nil {
+			return location.logString()
+		}
+	}
+	return logRawPath(path)
+}
+
+// parseS3Location recognizes s3://, AWS virtual-hosted-style and path-style
+// HTTPS URLs and S3 ARNs, including access point ARNs
+func parseS3Location(raw string) (*s3Location, error) {
+	if strings.HasPrefix(raw, "arn:") {
+		return parseS3ARN(raw)
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid S3 URL: %s", err)
+	}
+
+	var location *s3Location
+	switch u.Scheme {
+	case "s3":
+		location, err = parseS3SchemeURL(u)
+		if err != nil {
+			return nil, err
+		}
+	case "https":
+		location = parseS3HTTPSURL(u)
+	}
+
+	if location == nil || !bucketName.MatchString(location.bucket) {
+		return nil, fmt.Errorf("unrecognized S3 URL %q", raw)
+	}
+	if location.key == "" {
+		return nil, fmt.Errorf("missing key in S3 URL %q", raw)
+	}
+
+	return location, nil
+}
+
+// parseS3SchemeURL parses `s3://<bucket>/<key>`. Clients sometimes put the
+// endpoint host of the bucket in there instead, which would otherwise go
+// through slow region lookups of a nonexistent bucket: S3 hosts are parsed
+// like the HTTPS URLs, and the other endpoint hosts are rejected. Dotted
+// bucket names are fine as long as they don't end like an endpoint host.
+func parseS3SchemeURL(u *url.URL) (*s3Location, error) {
+	if location := parseS3HTTPSURL(u); location != nil {
+		log.Debugf("Interpreting the S3 endpoint host %q of an s3:// URL as bucket %q", u.Host, location.bucket)
+		return location, nil
+	}
+	if storageEndpointHost.MatchString(u.Host) {
+		return nil, &endpointHostError{host: u.Host}
+	}
+
+	return &s3Location{bucket: u.Host, key: strings.TrimPrefix(u.Path, "/")}, nil
+}
+
+// parseS3HTTPSURL extracts the location from an AWS S3 HTTPS URL, returning
+// nil if the host isn't an S3 endpoint
+func parseS3HTTPSURL(u *url.URL) *s3Location {
+	host := strings.ToLower(u.Hostname())
+	path := strings.TrimPrefix(u.Path, "/")
+
+	if match := pathStyleS3Host.FindStringSubmatch(host); match != nil {
+		parts := strings.SplitN(path, "/", 2)
+		location := &s3Location{bucket: parts[0], regionHint: s3HostRegion(match[1])}
+		if len(parts) == 2 {
+			location.key = parts[1]
+		}
+		return location
+	}
+
+	if match := virtualHostedS3Host.FindStringSubmatch(host); match != nil {
+		return &s3Location{bucket: match[1], key: path, regionHint: s3HostRegion(match[2])}
+	}
+
+	return nil
+}
+
+// s3HostRegion returns the region in an S3 endpoint host, ignoring the
+// dualstack and website prefixes and the pseudo regions which don't identify
+// one
+func s3HostRegion(region string) string {
+	region = strings.TrimPrefix(region, "dualstack.")
+	region = strings.TrimPrefix(strings.TrimPrefix(region, "website-"), "website.")
+	switch region {
+	case "dualstack", "accelerate", "external-1":
+		return ""
+	}
+	return region
+}
+
+// parseS3ARN parses `arn:<partition>:s3:::<bucket>/<key>` and
+// `arn:<partition>:s3:<region>:<account>:accesspoint/<name>/object/<key>`
+func parseS3ARN(raw string) (*s3Location, error) {
+	parts := strings.SplitN(raw, ":", 6)
+	if len(parts) != 6 || parts[2] != "s3" {
+		return nil, fmt.Errorf("unrecognized S3 ARN %q", raw)
+	}
+	partition, region, account, resource := parts[1], parts[3], parts[4], parts[5]
+	if partition == "" || !arnField.MatchString(partition) || !arnField.MatchString(region) || !arnAccount.MatchString(account) {
+		return nil, fmt.Errorf("unrecognized S3 ARN %q", raw)
+	}
+
+	if match := accessPointResource.FindStringSubmatch(resource); match != nil {
+		if region == "" {
+			return nil, errMultiRegionAccessPoint
+		}
+		if account == "" {
+			return nil, fmt.Errorf("missing account in access point ARN %q", raw)
+		}
+		if match[2] == "" {
+			return nil, fmt.Errorf("missing key in access point ARN %q", raw)
+		}
+		return &s3Location{
+			bucket:     "arn:" + partition + ":s3:" + region + ":" + account + ":accesspoint/" + match[1],
+			key:        match[2],
+			regionHint: region,
+		}, nil
+	}
+
+	if region != "" || account != "" {
+		return nil, fmt.Errorf("unexpected region or account in S3 object ARN %q", raw)
+	}
+
+	bucketAndKey := strings.SplitN(resource, "/", 2)
+	if len(bucketAndKey) != 2 || !bucketName.MatchString(bucketAndKey[0]) || bucketAndKey[1] == "" {
+		return nil, fmt.Errorf("unrecognized S3 ARN %q", raw)
+	}
+	if storageEndpointHost.MatchString(bucketAndKey[0]) {
+		return nil, &endpointHostError{host: bucketAndKey[0]}
+	}
+
+	return &s3Location{bucket: bucketAndKey[0], key: bucketAndKey[1]}, nil
+}
@@ -0,0 +1,57 @@
+//go:build go1.18
+// +build go1.18
+
+package main
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func FuzzDecodePath(f *testing.F) {
+	for _, raw := range trickyLocations {
+		f.Add("/" + base64.RawURLEncoding.EncodeToString([]byte(raw)))
+		f.Add("/" + base64.URLEncoding.EncodeToString([]byte(raw)))
+	}
+	f.Add("/%41")
+	f.Add("/====")
+
+	f.Fuzz(func(t *testing.T, path string) {
+		decoded, err := decodePath(path)
+		if err != nil {
+			return
+		}
+		if len(strings.TrimPrefix(path, "/")) > MaxEncodedPathLength {
+			t.Errorf("Decoded a path of %d bytes", len(path))
+		}
+		for _, c := range []byte(decoded) {
+			if c < 0x20 || c == 0x7f {
+				t.Errorf("Decoded the control character %q", c)
+			}
+		}
+	})
+}
+
+func FuzzParseS3Location(f *testing.F) {
+	for _, raw := range trickyLocations {
+		f.Add(raw)
+	}
+
+	f.Fuzz(func(t *testing.T, raw string) {
+		location, err := parseS3Location(raw)
+		checkLocation(t, raw, location, err)
+	})
+}
+
+func FuzzResolveDestination(f *testing.F) {
+	d := newResolverDeflator(f)
+	for _, raw := range trickyLocations {
+		f.Add("/" + base64.RawURLEncoding.EncodeToString([]byte(raw)))
+	}
+
+	f.Fuzz(func(t *testing.T, path string) {
+		location, err := resolvePath(d, path)
+		checkDestination(t, path, location, err)
+	})
+}
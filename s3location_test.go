@@ -0,0 +1,480 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"testing/quick"
+	"unicode/utf8"
+)
+
+func TestParseS3Location(t *testing.T) {
+	tests := []struct {
+		raw        string
+		bucket     string
+		key        string
+		regionHint string
+	}{
+		// s3:// URLs
+		{"s3://bucket/key", "bucket", "key", ""},
+		{"s3://bucket/path/to/key.png", "bucket", "path/to/key.png", ""},
+		{"s3://my.dotted.bucket/key", "my.dotted.bucket", "key", ""},
+		{"s3://Legacy_Bucket/key", "Legacy_Bucket", "key", ""},
+		{"s3://bucket/key%20with%20spaces", "bucket", "key with spaces", ""},
+		{"s3://bucket.s3.eu-west-1.amazonaws.com/key", "bucket", "key", "eu-west-1"},
+
+		// Virtual-hosted-style HTTPS URLs
+		{"https://bucket.s3.amazonaws.com/key", "bucket", "key", ""},
+		{"https://bucket.s3.eu-west-1.amazonaws.com/path/key", "bucket", "path/key", "eu-west-1"},
+		{"https://bucket.s3-eu-west-1.amazonaws.com/key", "bucket", "key", "eu-west-1"},
+		{"https://bucket.s3.dualstack.us-east-2.amazonaws.com/key", "bucket", "key", "us-east-2"},
+		{"https://bucket.s3-external-1.amazonaws.com/key", "bucket", "key", ""},
+		{"https://bucket.s3-accelerate.amazonaws.com/key", "bucket", "key", ""},
+		{"https://bucket.s3.cn-north-1.amazonaws.com.cn/key", "bucket", "key", "cn-north-1"},
+		{"https://my.dotted.bucket.s3.us-west-2.amazonaws.com/key", "my.dotted.bucket", "key", "us-west-2"},
+		{"https://BUCKET.S3.EU-WEST-1.AMAZONAWS.COM/key", "bucket", "key", "eu-west-1"},
+		{"https://bucket.s3.eu-west-1.amazonaws.com:443/key", "bucket", "key", "eu-west-1"},
+
+		// Path-style HTTPS URLs
+		{"https://s3.amazonaws.com/bucket/key", "bucket", "key", ""},
+		{"https://s3.eu-central-1.amazonaws.com/bucket/path/key", "bucket", "path/key", "eu-central-1"},
+		{"https://s3-eu-central-1.amazonaws.com/bucket/key", "bucket", "key", "eu-central-1"},
+		{"https://s3.dualstack.ap-south-1.amazonaws.com/bucket/key", "bucket", "key", "ap-south-1"},
+
+		// ARNs
+		{"arn:aws:s3:::bucket/key", "bucket", "key", ""},
+		{"arn:aws:s3:::bucket/path/to/key", "bucket", "path/to/key", ""},
+		{"arn:aws-cn:s3:::bucket/key", "bucket", "key", ""},
+		{"arn:aws:s3:us-west-2:123456789012:accesspoint/my-ap/object/path/key",
+			"arn:aws:s3:us-west-2:123456789012:accesspoint/my-ap", "path/key", "us-west-2"},
+		{"arn:aws-us-gov:s3:us-gov-west-1:123456789012:accesspoint/ap/object/key",
+			"arn:aws-us-gov:s3:us-gov-west-1:123456789012:accesspoint/ap", "key", "us-gov-west-1"},
+	}
+
+	for _, test := range tests {
+		location, err := parseS3Location(test.raw)
+		if err != nil {
+			t.Errorf("Failed to parse %q: %s", test.raw, err)
+			continue
+		}
+		if location.bucket != test.bucket || location.key != test.key || location.regionHint != test.regionHint {
+			t.Errorf("Expected bucket %q, key %q and region %q from %q, got %+v",
+				test.bucket, test.key, test.regionHint, test.raw, location)
+		}
+	}
+}
+
+func TestParseS3LocationErrors(t *testing.T) {
+	tests := []struct {
+		raw          string
+		endpointHost bool
+	}{
+		{"", false},
+		{"bucket/key", false},
+		{"http://bucket.s3.amazonaws.com/key", false},
+		{"https://example.com/bucket/key", false},
+		{"https://bucket.s3.amazonaws.com/", false},
+		{"https://s3.amazonaws.com/bucket", false},
+		{"https://s3.amazonaws.com/", false},
+		{"s3://bucket", false},
+		{"s3://bucket/", false},
+		{"s3:///key", false},
+		{"s3://bad bucket/key", false},
+		{"s3://bucket.storage.googleapis.com/key", true},
+		{"s3://account.blob.core.windows.net/key", true},
+		{"s3://d111111abcdef8.cloudfront.net/key", true},
+		{"ftp://bucket/key", false},
+		{"arn:aws:s3:::bucket", false},
+		{"arn:aws:s3:::bucket/", false},
+		{"arn:aws:s3:::/key", false},
+		{"arn:aws:s3:::bucket.s3.amazonaws.com/key", true},
+		{"arn:aws:s3:us-east-1::bucket/key", false},
+		{"arn:aws:s3::123456789012:bucket/key", false},
+		{"arn:aws:sqs:::queue/key", false},
+		{"arn::s3:::bucket/key", false},
+		{"arn:aws:s3", false},
+		{"arn:aws:s3:us-west-2:123456789012:accesspoint/my-ap/object/", false},
+		{"arn:aws:s3:us-west-2::accesspoint/my-ap/object/key", false},
+		{"arn:aws:s3::123456789012:accesspoint/my-ap/object/key", false},
+		{"arn:aws:s3:us-west-2:account:accesspoint/my-ap/object/key", false},
+	}
+
+	for _, test := range tests {
+		location, err := parseS3Location(test.raw)
+		if err == nil {
+			t.Errorf("Expected %q to be rejected, got %+v", test.raw, location)
+			continue
+		}
+		if _, ok := err.(*endpointHostError); ok != test.endpointHost {
+			t.Errorf("Expected an endpoint host error for %q: %t, got %s", test.raw, test.endpointHost, err)
+		}
+	}
+
+	_, err := parseS3Location("arn:aws:s3::123456789012:accesspoint/my-ap/object/key")
+	if err != errMultiRegionAccessPoint {
+		t.Errorf("Expected the multi-region access points to be rejected, got %v", err)
+	}
+}
+
+func TestEndpointHostBuckets(t *testing.T) {
+	tests := []struct {
+		raw        string
+		bucket     string
+		key        string
+		regionHint string
+		// rejected is set for the endpoint hosts which aren't S3 ones
+		rejected bool
+	}{
+		// S3 endpoint hosts are read like the HTTPS URLs
+		{"s3://my-bucket.s3.amazonaws.com/key", "my-bucket", "key", "", false},
+		{"s3://my-bucket.s3.us-west-2.amazonaws.com/path/key", "my-bucket", "path/key", "us-west-2", false},
+		{"s3://my-bucket.s3-eu-west-1.amazonaws.com/key", "my-bucket", "key", "eu-west-1", false},
+		{"s3://my-bucket.s3.dualstack.ap-south-1.amazonaws.com/key", "my-bucket", "key", "ap-south-1", false},
+		{"s3://my-bucket.s3-website-us-east-1.amazonaws.com/key", "my-bucket", "key", "us-east-1", false},
+		{"s3://my-bucket.s3-website.eu-central-1.amazonaws.com/key", "my-bucket", "key", "eu-central-1", false},
+		{"s3://my.dotted.bucket.s3.amazonaws.com/key", "my.dotted.bucket", "key", "", false},
+		{"s3://MY-BUCKET.S3.AMAZONAWS.COM/key", "my-bucket", "key", "", false},
+		{"s3://s3.us-west-2.amazonaws.com/my-bucket/key", "my-bucket", "key", "us-west-2", false},
+		{"s3://my-bucket.s3.cn-north-1.amazonaws.com.cn/key", "my-bucket", "key", "cn-north-1", false},
+
+		// Other AWS and cloud storage endpoint hosts are rejected
+		{"s3://my-bucket.execute-api.us-east-1.amazonaws.com/key", "", "", "", true},
+		{"s3://amazonaws.com/key", "", "", "", true},
+		{"s3://d111111abcdef8.cloudfront.net/key", "", "", "", true},
+		{"s3://my-bucket.storage.googleapis.com/key", "", "", "", true},
+		{"s3://STORAGE.GOOGLEAPIS.COM/key", "", "", "", true},
+		{"s3://account.blob.core.windows.net/key", "", "", "", true},
+		{"s3://my-bucket.nyc3.digitaloceanspaces.com/key", "", "", "", true},
+		{"s3://account.r2.cloudflarestorage.com/key", "", "", "", true},
+		{"s3://my-bucket.s3.us-west-000.backblazeb2.com/key", "", "", "", true},
+		{"arn:aws:s3:::my-bucket.s3.amazonaws.com/key", "", "", "", true},
+		{"arn:aws:s3:::my-bucket.storage.googleapis.com/key", "", "", "", true},
+
+		// Dotted bucket names without an endpoint suffix are legal
+		{"s3://images.example.com/key", "images.example.com", "key", "", false},
+		{"s3://my-bucket.s3.us-west-2.amazonaws.com.evil/key", "my-bucket.s3.us-west-2.amazonaws.com.evil", "key", "", false},
+		{"s3://amazonaws.com.backup/key", "amazonaws.com.backup", "key", "", false},
+		{"s3://my.amazonaws.bucket/key", "my.amazonaws.bucket", "key", "", false},
+		{"s3://s3.my-bucket/key", "s3.my-bucket", "key", "", false},
+		{"s3://notamazonaws.com/key", "notamazonaws.com", "key", "", false},
+		{"s3://my-cloudfront.net.bucket/key", "my-cloudfront.net.bucket", "key", "", false},
+		{"arn:aws:s3:::images.example.com/key", "images.example.com", "key", "", false},
+	}
+
+	for _, test := range tests {
+		location, err := parseS3Location(test.raw)
+		if _, ok := err.(*endpointHostError); ok != test.rejected {
+			t.Errorf("Expected an endpoint host error for %q: %t, got %v", test.raw, test.rejected, err)
+			continue
+		}
+		if test.bucket == "" {
+			if err == nil {
+				t.Errorf("Expected %q to be rejected, got %+v", test.raw, location)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Failed to parse %q: %s", test.raw, err)
+			continue
+		}
+		if location.bucket != test.bucket || location.key != test.key || location.regionHint != test.regionHint {
+			t.Errorf("Expected %s/%s (region hint %q) for %q, got %s/%s (%q)",
+				test.bucket, test.key, test.regionHint, test.raw, location.bucket, location.key, location.regionHint)
+		}
+	}
+}
+
+func TestUploadEndpointHostBucket(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.close()
+	regionLookups := countRegionLookups(s)
+
+	// The bucket of an S3 endpoint host gets its region from the URL
+	resp, err := http.Post(s.server.URL+s.destinationPath("s3://"+TestBucket+".s3.us-east-1.amazonaws.com/photo.png", "width=16"),
+		"image/png", bytes.NewReader(testPNG(t, 32, 32)))
+	if err != nil {
+		t.Fatalf("Failed to send the upload: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the upload to succeed, got %d", resp.StatusCode)
+	}
+	if _, ok := s.fake.Object(TestBucket, "photo.png"); !ok {
+		t.Errorf("The upload wasn't stored in %s", TestBucket)
+	}
+	if n := atomic.LoadInt64(regionLookups); n != 0 {
+		t.Errorf("Expected no region lookup, got %d", n)
+	}
+
+	resp, err = http.Post(s.server.URL+s.destinationPath("s3://"+TestBucket+".storage.googleapis.com/photo.png", "width=16"),
+		"image/png", bytes.NewReader(testPNG(t, 32, 32)))
+	if err != nil {
+		t.Fatalf("Failed to send the upload: %s", err)
+	}
+	response := decodeError(t, resp, http.StatusBadRequest)
+	if response.Code != ErrorCodeInvalidBucket || !strings.Contains(response.Message, AcceptedS3URLFormats) {
+		t.Errorf("Expected the %s code with the accepted formats, got %+v", ErrorCodeInvalidBucket, response)
+	}
+	if n := atomic.LoadInt64(regionLookups); n != 0 {
+		t.Errorf("Expected no region lookup for the rejected bucket, got %d", n)
+	}
+}
+
+// countRegionLookups counts the HeadBucket requests to the fakes3 server of s
+func countRegionLookups(s *testServer) *int64 {
+	var lookups int64
+	s.fake.SetFault(func(r *http.Request) int {
+		if r.Method == http.MethodHead && strings.Count(r.URL.Path, "/") == 1 {
+			atomic.AddInt64(&lookups, 1)
+		}
+		return 0
+	})
+	return &lookups
+}
+
+func TestRedactKey(t *testing.T) {
+	key := strings.Repeat("k", LogKeysTruncateLength+1)
+
+	tests := []struct {
+		mode, key, redacted string
+	}{
+		{LogKeysFull, key, key},
+		{LogKeysTruncate, key, key[:LogKeysTruncateLength] + "..."},
+		{LogKeysTruncate, "short", "short"},
+		{LogKeysOmit, key, LogKeyOmitted},
+		{LogKeysHash, "photo.png", redactKey(LogKeysHash, "photo.png")},
+	}
+
+	for _, test := range tests {
+		if redacted := redactKey(test.mode, test.key); redacted != test.redacted {
+			t.Errorf("Expected %q for %q in %s mode, got %q", test.redacted, test.key, test.mode, redacted)
+		}
+	}
+
+	hashed := redactKey(LogKeysHash, "photo.png")
+	if !strings.HasPrefix(hashed, "sha256:") || len(hashed) != len("sha256:")+16 || hashed == redactKey(LogKeysHash, "other.png") {
+		t.Errorf("Unexpected hash %q", hashed)
+	}
+}
+
+func TestUploadDestinationFormats(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.close()
+
+	for i, destination := range []string{
+		"https://" + TestBucket + ".s3.amazonaws.com/https.png",
+		"arn:aws:s3:::" + TestBucket + "/arn.png",
+	} {
+		resp, err := http.Post(s.server.URL+s.destinationPath(destination, "width=16"), "image/png", bytes.NewReader(testPNG(t, 32, 32)))
+		if err != nil {
+			t.Fatalf("Failed to send the upload: %s", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Expected the upload to %s to succeed, got %d", destination, resp.StatusCode)
+		}
+		if keys := s.fake.Keys(TestBucket); len(keys) != i+1 {
+			t.Errorf("Expected %d stored objects, got %q", i+1, keys)
+		}
+	}
+
+	for _, destination := range []string{"https://example.com/" + TestBucket + "/photo.png", "s3://storage.googleapis.com/photo.png"} {
+		resp, err := http.Post(s.server.URL+s.destinationPath(destination, "width=16"), "image/png", bytes.NewReader(testPNG(t, 32, 32)))
+		if err != nil {
+			t.Fatalf("Failed to send the upload: %s", err)
+		}
+		response := decodeError(t, resp, http.StatusBadRequest)
+		if !strings.Contains(response.Message, AcceptedS3URLFormats) {
+			t.Errorf("Expected the accepted formats in the error for %s, got %q", destination, response.Message)
+		}
+	}
+}
+
+// trickyLocations are decoded request paths which caused trouble in
+// production, seeding the property tests and the fuzz targets
+var trickyLocations = []string{
+	"s3://bucket/key",
+	"s3://bucket/%",
+	"s3://bucket/%zz",
+	"s3://bucket/%%41",
+	"s3://bucket/%2541",
+	"s3://bucket/%00",
+	"s3://bucket/%E2%82",
+	"s3://bucket/%C3%A9.png",
+	"s3://bucket/key?versionId=1#fragment",
+	"s3://bucket:80/key",
+	"s3://user:password@bucket/key",
+	"s3://bucket//key",
+	"s3://bucket/../../etc/passwd",
+	"s3://[::1]/key",
+	"s3:bucket/key",
+	"s3:///",
+	"https://bucket.s3.amazonaws.com/%",
+	"https://bucket.s3.amazonaws.com:notaport/key",
+	"https://s3.amazonaws.com//key",
+	"https://s3.amazonaws.com/bucket/",
+	"arn:aws:s3:::",
+	"arn:aws:s3:::bucket/%00",
+	"arn:aws:s3:us-west-2:123456789012:accesspoint/ap/object/key",
+	"arn:aws:s3:us-west-2:123456789012:accesspoint//object/key",
+	"arn:aws:s3:US-WEST-2:123456789012:accesspoint/ap/object/key",
+	"arn:aws:s3:::bucket/" + strings.Repeat("k", MaxKeyLength+1),
+	"\x00s3://bucket/key",
+	"s3://bucket/key\x00",
+	"s3://bucket/\xff\xfe",
+	"s3://" + strings.Repeat("b", 256) + "/key",
+}
+
+// accessPointBucket matches the access point ARNs used as bucket names
+var accessPointBucket = regexp.MustCompile(`^arn:[a-z0-9-]+:s3:[a-z0-9-]+:[0-9]+:accesspoint/[a-zA-Z0-9.-]+$`)
+
+// checkLocation verifies that a parsed location is usable: either it's
+// rejected, or it has a well-formed bucket and a key
+func checkLocation(tb testing.TB, raw string, location *s3Location, err error) {
+	if err != nil {
+		if location != nil {
+			tb.Errorf("Got both a location and an error for %q: %+v, %s", raw, location, err)
+		}
+		return
+	}
+	if location == nil {
+		tb.Fatalf("Got neither a location nor an error for %q", raw)
+	}
+	if !bucketName.MatchString(location.bucket) && !accessPointBucket.MatchString(location.bucket) {
+		tb.Errorf("Accepted the invalid bucket %q from %q", location.bucket, raw)
+	}
+	if location.key == "" {
+		tb.Errorf("Accepted %q without a key", raw)
+	}
+}
+
+// checkDestination verifies the invariants of the resolved destinations,
+// on top of the ones of checkLocation
+func checkDestination(tb testing.TB, raw string, location *s3Location, err error) {
+	checkLocation(tb, raw, location, err)
+	if err != nil {
+		if status, _ := errorStatus(err); status != http.StatusBadRequest && status != http.StatusForbidden {
+			tb.Errorf("Expected a client error for %q, got %d: %s", raw, status, err)
+		}
+		return
+	}
+	if len(location.key) > MaxKeyLength || !utf8.ValidString(location.key) || strings.ContainsAny(location.key, "\\\x7f\x00") {
+		tb.Errorf("Accepted the invalid key %q from %q", location.key, raw)
+	}
+}
+
+// newResolverDeflator returns a Deflator resolving unsigned destinations
+func newResolverDeflator(tb testing.TB) *Deflator {
+	config, err := loadTestConfig("")
+	if err != nil {
+		tb.Fatalf("Failed to load the config: %s", err)
+	}
+	config.UrlSigningSecret = ""
+	d, err := NewDeflator(config, nil, nil)
+	if err != nil {
+		tb.Fatalf("Failed to create the Deflator: %s", err)
+	}
+	return d
+}
+
+// resolvePath resolves the destination of a request path
+func resolvePath(d *Deflator, path string) (*s3Location, error) {
+	return d.resolveDestination(context.Background(), &url.URL{Path: path})
+}
+
+func TestDecodePath(t *testing.T) {
+	encoded := base64.RawURLEncoding.EncodeToString([]byte("s3://bucket/key.png"))
+
+	tests := []struct {
+		path    string
+		decoded string
+	}{
+		{"/" + encoded, "s3://bucket/key.png"},
+		{encoded, "s3://bucket/key.png"},
+		{"/" + base64.URLEncoding.EncodeToString([]byte("s3://bucket/key.png")), "s3://bucket/key.png"},
+		{"/" + base64.URLEncoding.EncodeToString([]byte("s3://bucket/k")), "s3://bucket/k"},
+		{"/" + base64.RawURLEncoding.EncodeToString([]byte("s3://bucket/k")) + "=====", "s3://bucket/k"},
+		{"/", ""},
+	}
+	for _, test := range tests {
+		decoded, err := decodePath(test.path)
+		if err != nil || decoded != test.decoded {
+			t.Errorf("Expected %q to decode to %q, got %q (%v)", test.path, test.decoded, decoded, err)
+		}
+	}
+
+	for _, path := range []string{
+		// The standard alphabet isn't accepted
+		"/" + base64.StdEncoding.EncodeToString([]byte("s3://bucket/key>>>")),
+		"/" + encoded[:len(encoded)-1] + "=" + encoded[len(encoded)-1:],
+		"/%41",
+		"/" + encoded + "\x00",
+		"/" + base64.RawURLEncoding.EncodeToString([]byte("s3://bucket/key\x00")),
+		"/" + base64.RawURLEncoding.EncodeToString([]byte("s3://bucket/key\n")),
+		"/" + base64.RawURLEncoding.EncodeToString([]byte("s3://bucket/key\x7f")),
+		"/" + strings.Repeat("A", MaxEncodedPathLength+1),
+	} {
+		if decoded, err := decodePath(path); err == nil {
+			t.Errorf("Expected %q to be rejected, got %q", logRawPath(path), decoded)
+		}
+	}
+}
+
+func TestParseS3LocationInvariant(t *testing.T) {
+	for _, raw := range trickyLocations {
+		location, err := parseS3Location(raw)
+		checkLocation(t, raw, location, err)
+	}
+
+	// Random mutations of the tricky locations
+	property := func(seed uint, position uint, insert string) bool {
+		raw := trickyLocations[seed%uint(len(trickyLocations))]
+		i := int(position % uint(len(raw)+1))
+		raw = raw[:i] + insert + raw[i:]
+
+		location, err := parseS3Location(raw)
+		checkLocation(t, raw, location, err)
+		return !t.Failed()
+	}
+	err := quick.Check(property, &quick.Config{MaxCount: 5000})
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestResolveDestinationInvariant(t *testing.T) {
+	d := newResolverDeflator(t)
+
+	for _, raw := range trickyLocations {
+		path := "/" + base64.RawURLEncoding.EncodeToString([]byte(raw))
+		location, err := resolvePath(d, path)
+		checkDestination(t, raw, location, err)
+	}
+
+	// Random request paths, most of which don't decode at all
+	property := func(path string, raw []byte) bool {
+		location, err := resolvePath(d, "/"+path)
+		checkDestination(t, path, location, err)
+
+		path = "/" + base64.RawURLEncoding.EncodeToString(append([]byte("s3://bucket/"), raw...))
+		location, err = resolvePath(d, path)
+		checkDestination(t, path, location, err)
+		return !t.Failed()
+	}
+	err := quick.Check(property, &quick.Config{MaxCount: 5000})
+	if err != nil {
+		t.Error(err)
+	}
+
+	// The path length is bounded before decoding
+	path := "/" + base64.RawURLEncoding.EncodeToString([]byte("s3://bucket/"+strings.Repeat("k", MaxEncodedPathLength)))
+	if _, err := resolvePath(d, path); errorCode(err) != ErrorCodeInvalidPath {
+		t.Errorf("Expected the %s code for a path of %d bytes, got %v", ErrorCodeInvalidPath, len(path), err)
+	}
+}
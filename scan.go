@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"expvar"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/golang-lru"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// ScanPolicyFailOpen lets uploads through when the scanner is unavailable
+	ScanPolicyFailOpen = "fail_open"
+	// ScanPolicyFailClosed rejects uploads when the scanner is unavailable
+	ScanPolicyFailClosed = "fail_closed"
+
+	// Scan verdicts recorded in the audit log
+	ScanVerdictClean       = "clean"
+	ScanVerdictInfected    = "infected"
+	ScanVerdictUnavailable = "unavailable"
+
+	// clamdChunkSize must stay below the StreamMaxLength of clamd
+	clamdChunkSize = 64 * 1024
+)
+
+var (
+	// scanStats counts the scan verdicts and accumulates the scan durations
+	// in milliseconds
+	scanStats = expvar.NewMap("scans")
+)
+
+// virusScanner scans a file, returning the name of the signature which
+// matched if it's infected
+type virusScanner interface {
+	scan(ctx context.Context, body []byte) (string, error)
+}
+
+// newVirusScanner returns the scanner for a `clamd://host:port` or
+// `icap://host:port/service` URL
+func newVirusScanner(rawURL string) (virusScanner, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid scanner URL %q", rawURL)
+	}
+
+	switch u.Scheme {
+	case "clamd":
+		return &clamdScanner{addr: u.Host}, nil
+	case "icap":
+		if u.Port() == "" {
+			u.Host += ":1344"
+		}
+		return &icapScanner{url: u}, nil
+	default:
+		return nil, fmt.Errorf("unsupported scanner URL scheme %q", u.Scheme)
+	}
+}
+
+// dialScanner connects to addr, applying the deadline of ctx to the connection
+func dialScanner(ctx context.Context, addr string) (net.Conn, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	return conn, nil
+}
+
+// clamdScanner streams files to clamd using the INSTREAM command
+type clamdScanner struct {
+	addr string
+}
+
+func (s *clamdScanner) scan(ctx context.Context, body []byte) (string, error) {
+	conn, err := dialScanner(ctx, s.addr)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	w := bufio.NewWriter(conn)
+	_, _ = w.WriteString("zINSTREAM\x00")
+
+	size := make([]byte, 4)
+	for offset := 0; offset < len(body); offset += clamdChunkSize {
+		chunk := body[offset:]
+		if len(chunk) > clamdChunkSize {
+			chunk = chunk[:clamdChunkSize]
+		}
+
+		binary.BigEndian.PutUint32(size, uint32(len(chunk)))
+		_, _ = w.Write(size)
+		_, _ = w.Write(chunk)
+	}
+
+	// A zero-length chunk terminates the stream
+	binary.BigEndian.PutUint32(size, 0)
+	_, _ = w.Write(size)
+	if err := w.Flush(); err != nil {
+		return "", err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	reply = strings.TrimSpace(strings.TrimRight(reply, "\x00"))
+
+	// Replies look like `stream: OK` or `stream: <signature> FOUND`
+	result := strings.TrimSpace(strings.TrimPrefix(reply, "stream:"))
+	switch {
+	case result == "OK":
+		return "", nil
+	case strings.HasSuffix(result, " FOUND"):
+		return strings.TrimSuffix(result, " FOUND"), nil
+	default:
+		return "", fmt.Errorf("unexpected clamd reply %q", reply)
+	}
+}
+
+// icapScanner sends files to an ICAP service in RESPMOD requests
+type icapScanner struct {
+	url *url.URL
+}
+
+func (s *icapScanner) scan(ctx context.Context, body []byte) (string, error) {
+	conn, err := dialScanner(ctx, s.url.Host)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	// The file is encapsulated as the body of an HTTP response
+	httpHeader := "HTTP/1.1 200 OK\r\nContent-Type: application/octet-stream\r\n\r\n"
+
+	var req bytes.Buffer
+	fmt.Fprintf(&req, "RESPMOD %s ICAP/1.0\r\n", s.url.String())
+	fmt.Fprintf(&req, "Host: %s\r\n", s.url.Host)
+	fmt.Fprintf(&req, "Allow: 204\r\n")
+	fmt.Fprintf(&req, "Encapsulated: res-hdr=0, res-body=%d\r\n\r\n", len(httpHeader))
+	req.WriteString(httpHeader)
+	if len(body) > 0 {
+		fmt.Fprintf(&req, "%x\r\n", len(body))
+		req.Write(body)
+		req.WriteString("\r\n")
+	}
+	req.WriteString("0\r\n\r\n")
+
+	_, err = conn.Write(req.Bytes())
+	if err != nil {
+		return "", err
+	}
+
+	reader := textproto.NewReader(bufio.NewReader(conn))
+	statusLine, err := reader.ReadLine()
+	if err != nil {
+		return "", err
+	}
+	header, err := reader.ReadMIMEHeader()
+	if err != nil {
+		return "", err
+	}
+
+	parts := strings.SplitN(statusLine, " ", 3)
+	if len(parts) < 2 || !strings.HasPrefix(parts[0], "ICAP/") {
+		return "", fmt.Errorf("unexpected ICAP status line %q", statusLine)
+	}
+
+	switch parts[1] {
+	case "204":
+		return "", nil
+	case "200":
+		// The service replaced the file, i.e. blocked it
+		return icapSignature(header), nil
+	default:
+		return "", fmt.Errorf("unexpected ICAP status %q", statusLine)
+	}
+}
+
+// icapSignature extracts the threat name from the headers of an ICAP response
+func icapSignature(header textproto.MIMEHeader) string {
+	if virus := header.Get("X-Virus-Id"); virus != "" {
+		return virus
+	}
+
+	// X-Infection-Found: Type=0; Resolution=2; Threat=<name>;
+	for _, field := range strings.Split(header.Get("X-Infection-Found"), ";") {
+		field = strings.TrimSpace(field)
+		if strings.HasPrefix(field, "Threat=") {
+			return strings.TrimPrefix(field, "Threat=")
+		}
+	}
+
+	return "unknown"
+}
+
+// scanGuard runs the virus scans, caching the hashes of clean files so
+// retries of the same upload don't get scanned again
+type scanGuard struct {
+	scanner virusScanner
+	timeout time.Duration
+	policy  string
+	clean   *lru.Cache
+}
+
+func newScanGuard(config *Config) (*scanGuard, error) {
+	if config.ScanURL == "" {
+		return nil, nil
+	}
+
+	scanner, err := newVirusScanner(config.ScanURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.ScanPolicy != ScanPolicyFailOpen && config.ScanPolicy != ScanPolicyFailClosed {
+		return nil, fmt.Errorf("invalid scan policy %q", config.ScanPolicy)
+	}
+
+	guard := &scanGuard{scanner: scanner, timeout: config.ScanTimeout, policy: config.ScanPolicy}
+	if config.ScanCacheSize > 0 {
+		guard.clean, err = lru.New(config.ScanCacheSize)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return guard, nil
+}
+
+// check scans body, returning the verdict for the audit log or an error if
+// the upload must be rejected. A nil scanGuard doesn't scan anything.
+func (g *scanGuard) check(ctx context.Context, location string, body []byte) (string, error) {
+	if g == nil {
+		return "", nil
+	}
+
+	hash := sha256.Sum256(body)
+	digest := hex.EncodeToString(hash[:])
+	if g.clean != nil && g.clean.Contains(digest) {
+		scanStats.Add("cached", 1)
+		return ScanVerdictClean, nil
+	}
+
+	scanCtx, cancel := context.WithTimeout(ctx, g.timeout)
+	defer cancel()
+
+	start := time.Now()
+	signature, err := g.scanner.scan(scanCtx, body)
+	scanStats.Add("duration_ms", int64(time.Since(start)/time.Millisecond))
+
+	switch {
+	case err != nil:
+		scanStats.Add(ScanVerdictUnavailable, 1)
+		log.Warnf("Failed to scan %q: %s", location, err)
+		if g.policy == ScanPolicyFailOpen {
+			return ScanVerdictUnavailable, nil
+		}
+		return ScanVerdictUnavailable, newRequestError(http.StatusServiceUnavailable, ErrorCodeScannerUnavailable, "Virus scanner unavailable").withCause(err)
+	case signature != "":
+		scanStats.Add(ScanVerdictInfected, 1)
+		log.Warnf("Rejected infected upload %q: %s", location, signature)
+		return ScanVerdictInfected, newRequestError(http.StatusUnprocessableEntity, ErrorCodeInfected, "File infected: %s", signature)
+	default:
+		scanStats.Add(ScanVerdictClean, 1)
+		if g.clean != nil {
+			g.clean.Add(digest, struct{}{})
+		}
+		return ScanVerdictClean, nil
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// SessionsPath creates upload sessions
+	SessionsPath = "/sessions"
+	// SessionParameter carries the session token of an upload
+	SessionParameter = "session"
+
+	// sessionMaxBody is plenty for the destination and the options
+	sessionMaxBody = 64 << 10
+)
+
+// uploadSession is what a session token authorizes: a single upload to the
+// key, with the options and up to the size. It's carried by the token itself,
+// so verifying it doesn't need any storage.
+type uploadSession struct {
+	ID      string `json:"id"`
+	Bucket  string `json:"bucket"`
+	Key     string `json:"key"`
+	Options string `json:"options,omitempty"`
+	MaxSize int64  `json:"max_size"`
+	// IssuedAt and ExpiresAt are Unix times
+	IssuedAt  int64 `json:"iat"`
+	ExpiresAt int64 `json:"exp"`
+}
+
+// sessionCreateRequest is the body of the SessionsPath requests. Options take
+// the same values as the ones of the JSON envelopes.
+type sessionCreateRequest struct {
+	Bucket  string                 `json:"bucket"`
+	Key     string                 `json:"key"`
+	Options map[string]interface{} `json:"options"`
+	MaxSize int64                  `json:"max_size"`
+	// ExpiresIn is how many seconds the session is valid for
+	ExpiresIn int64 `json:"expires_in"`
+}
+
+type sessionCreateResponse struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// UploadURL is where the browser posts the image
+	UploadURL string `json:"upload_url"`
+}
+
+// sessionStore remembers the sessions which were used, until they expire.
+// It's local to the instance, so sessions are only single-use on the
+// instance which received them.
+type sessionStore struct {
+	mu   sync.Mutex
+	used map[string]time.Time
+}
+
+func newSessionStore() *sessionStore {
+	return &sessionStore{used: make(map[string]time.Time)}
+}
+
+// claim marks the session id as used, unless it already is. Expired sessions
+// get forgotten, since they're rejected anyway.
+func (s *sessionStore) claim(id string, expires, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for usedID, usedExpires := range s.used {
+		if usedExpires.Before(now) {
+			delete(s.used, usedID)
+		}
+	}
+	if _, ok := s.used[id]; ok {
+		return false
+	}
+	s.used[id] = expires
+	return true
+}
+
+// signSession encodes session as `<base64 JSON>.<base64 HMAC>`
+func (d *Deflator) signSession(session *uploadSession) (string, error) {
+	payload, err := json.Marshal(session)
+	if err != nil {
+		return "", err
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(d.sessionMAC(encoded)), nil
+}
+
+func (d *Deflator) sessionMAC(encoded string) []byte {
+	h := hmac.New(sha256.New, []byte(d.config.SessionSecret))
+	h.Write([]byte(encoded))
+	return h.Sum(nil)
+}
+
+// verifySession decodes the session of token, checking its signature and
+// its validity with the SessionClockSkew tolerance
+func (d *Deflator) verifySession(token string) (*uploadSession, error) {
+	invalid := newRequestError(http.StatusBadRequest, ErrorCodeInvalidSession, "Invalid session")
+
+	i := strings.Index(token, ".")
+	if i < 0 {
+		return nil, invalid
+	}
+	// Strictly, so the signature has a single encoding
+	signature, err := base64.RawURLEncoding.Strict().DecodeString(token[i+1:])
+	if err != nil || !hmac.Equal(signature, d.sessionMAC(token[:i])) {
+		log.Debugf("Invalid session signature")
+		return nil, invalid
+	}
+
+	payload, err := base64.RawURLEncoding.Strict().DecodeString(token[:i])
+	if err != nil {
+		return nil, invalid
+	}
+	var session uploadSession
+	err = json.Unmarshal(payload, &session)
+	if err != nil || session.ID == "" {
+		return nil, invalid
+	}
+
+	now := d.clock.Now()
+	skew := d.config.SessionClockSkew
+	if now.Add(skew).Before(time.Unix(session.IssuedAt, 0)) {
+		log.Debugf("Session %s issued in the future", session.ID)
+		return nil, invalid
+	}
+	if !now.Add(-skew).Before(time.Unix(session.ExpiresAt, 0)) {
+		log.Debugf("Session %s expired", session.ID)
+		return nil, newRequestError(http.StatusForbidden, ErrorCodeSessionExpired, "Session expired")
+	}
+
+	return &session, nil
+}
+
+// sessionsHandler creates the session for the destination and options of
+// the request, which needs the admin token
+func (d *Deflator) sessionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, newRequestError(http.StatusMethodNotAllowed, ErrorCodeMethodNotAllowed, "Method not allowed"))
+		return
+	}
+	if !d.isAdminAuthorized(r) {
+		writeError(w, r, newRequestError(http.StatusForbidden, ErrorCodeForbidden, "Forbidden"))
+		return
+	}
+
+	var req sessionCreateRequest
+	err := json.NewDecoder(io.LimitReader(r.Body, sessionMaxBody)).Decode(&req)
+	if err != nil {
+		writeError(w, r, newRequestError(http.StatusBadRequest, ErrorCodeInvalidEnvelope, "Invalid JSON body: %s", err))
+		return
+	}
+
+	session, err := d.newSession(&req)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	token, err := d.signSession(session)
+	if err != nil {
+		writeError(w, r, newRequestError(http.StatusInternalServerError, ErrorCodeInternal, "Internal error").withCause(err))
+		return
+	}
+
+	audit("session_create", log.Fields{
+		"session":    session.ID,
+		"bucket":     session.Bucket,
+		"key":        session.Key,
+		"max_size":   session.MaxSize,
+		"expires_at": time.Unix(session.ExpiresAt, 0).UTC().Format(time.RFC3339),
+		"client_ip":  d.clientIP(r),
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(sessionCreateResponse{
+		Token:     token,
+		ExpiresAt: time.Unix(session.ExpiresAt, 0).UTC(),
+		UploadURL: "/?" + url.Values{SessionParameter: {token}}.Encode(),
+	})
+}
+
+// newSession validates req like the upload it authorizes
+func (d *Deflator) newSession(req *sessionCreateRequest) (*uploadSession, error) {
+	for _, field := range []struct{ field, value string }{{"bucket", req.Bucket}, {"key", req.Key}} {
+		if field.value == "" {
+			return nil, newRequestError(http.StatusBadRequest, ErrorCodeMissingField, "Missing field %q", field.field)
+		}
+	}
+
+	key, err := d.normalizeKey(req.Key)
+	if err != nil {
+		return nil, err
+	}
+	err = d.authorizeDestination(req.Bucket, key)
+	if err != nil {
+		return nil, err
+	}
+
+	query, err := (&uploadEnvelope{Options: req.Options}).query()
+	if err != nil {
+		return nil, err
+	}
+	options, err := d.parseOptions(req.Bucket, query, nil)
+	if err == nil {
+		_, err = d.uploadRequestFromOptions(&s3Location{bucket: req.Bucket, key: key}, options)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	limit := d.maxUploadSizeLimit()
+	if req.MaxSize < 0 || req.MaxSize > limit {
+		return nil, newRequestError(http.StatusBadRequest, ErrorCodeInvalidParameter, "Invalid max_size %d (maximum: %d)", req.MaxSize, limit)
+	}
+	maxSize := req.MaxSize
+	if maxSize == 0 {
+		maxSize = limit
+	}
+
+	ttl := time.Duration(req.ExpiresIn) * time.Second
+	if ttl <= 0 || ttl > d.config.SessionMaxTTL {
+		return nil, newRequestError(
+			http.StatusBadRequest, ErrorCodeInvalidParameter,
+			"Invalid expires_in %d (maximum: %d)", req.ExpiresIn, int64(d.config.SessionMaxTTL/time.Second),
+		)
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, newRequestError(http.StatusInternalServerError, ErrorCodeInternal, "Internal error").withCause(err)
+	}
+
+	now := d.clock.Now()
+	return &uploadSession{
+		ID:        hex.EncodeToString(id),
+		Bucket:    req.Bucket,
+		Key:       key,
+		Options:   query.Encode(),
+		MaxSize:   maxSize,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(ttl).Unix(),
+	}, nil
+}
+
+// sessionUploadHandler serves the uploads authorized by a session token
+// instead of an encoded path and a signature. The request can't carry
+// anything but the token, and the first attempt uses the session up, even if
+// it fails.
+func (d *Deflator) sessionUploadHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	session, err := d.verifySession(query.Get(SessionParameter))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if r.Method != http.MethodPost || r.URL.Path != "/" || len(query) != 1 || len(query[SessionParameter]) != 1 {
+		log.Debugf("Request doesn't match session %s", session.ID)
+		writeError(w, r, newRequestError(http.StatusBadRequest, ErrorCodeSessionMismatch, "Request doesn't match the session"))
+		return
+	}
+	if r.ContentLength > session.MaxSize {
+		writeError(w, r, newRequestError(
+			http.StatusRequestEntityTooLarge, ErrorCodePayloadTooLarge,
+			"File too large (%d bytes, limit: %d bytes)", r.ContentLength, session.MaxSize,
+		))
+		return
+	}
+
+	sessionQuery, err := url.ParseQuery(session.Options)
+	var options *requestOptions
+	if err == nil {
+		options, err = d.parseOptions(session.Bucket, sessionQuery, nil)
+	}
+	var req *uploadRequest
+	if err == nil {
+		req, err = d.uploadRequestFromOptions(&s3Location{bucket: session.Bucket, key: session.Key}, options)
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	req.contentType = r.Header.Get("Content-Type")
+	req.clientIP = d.clientIP(r)
+	req.session = session.ID
+	req.maxSize = session.MaxSize
+
+	if !d.sessions.claim(session.ID, time.Unix(session.ExpiresAt, 0).Add(d.config.SessionClockSkew), d.clock.Now()) {
+		log.Debugf("Session %s already used", session.ID)
+		writeError(w, r, newRequestError(http.StatusConflict, ErrorCodeSessionUsed, "Session already used"))
+		return
+	}
+
+	d.serveUpload(w, r, req, http.MaxBytesReader(w, r.Body, session.MaxSize), r.ContentLength)
+}
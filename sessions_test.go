@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testAdminToken = "admin-token"
+
+// fakeClock is a Clock stuck at now
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+// newSessionTestServer starts a testServer with the upload sessions enabled
+func newSessionTestServer(t *testing.T) *testServer {
+	return newTestServer(t, func(config *Config) {
+		config.AdminToken = testAdminToken
+		config.SessionSecret = "session-secret"
+		config.SessionMaxTTL = 15 * time.Minute
+		config.SessionClockSkew = 30 * time.Second
+	})
+}
+
+// createSession posts the session request body with the admin token
+func (s *testServer) createSession(body string) *http.Response {
+	r, err := http.NewRequest(http.MethodPost, s.server.URL+SessionsPath, strings.NewReader(body))
+	if err != nil {
+		s.t.Fatalf("Failed to create the session request: %s", err)
+	}
+	r.Header.Set("Authorization", "Bearer "+testAdminToken)
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		s.t.Fatalf("Failed to create the session: %s", err)
+	}
+	return resp
+}
+
+// session creates a session, returning its upload URL
+func (s *testServer) session(body string) string {
+	resp := s.createSession(body)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		s.t.Fatalf("Expected the session to be created, got %d", resp.StatusCode)
+	}
+
+	var session sessionCreateResponse
+	err := json.NewDecoder(resp.Body).Decode(&session)
+	if err != nil {
+		s.t.Fatalf("Failed to decode the session: %s", err)
+	}
+	return s.server.URL + session.UploadURL
+}
+
+// postSession uploads body to the session upload URL
+func postSession(t *testing.T, uploadURL string, body io.Reader) *http.Response {
+	resp, err := http.Post(uploadURL, "image/png", body)
+	if err != nil {
+		t.Fatalf("Failed to send the session upload: %s", err)
+	}
+	return resp
+}
+
+func TestSessionToken(t *testing.T) {
+	s := newSessionTestServer(t)
+	defer s.close()
+	d := s.deflator
+	issued := time.Date(2019, 7, 1, 12, 0, 0, 0, time.UTC)
+	d.clock = &fakeClock{now: issued}
+
+	session, err := d.newSession(&sessionCreateRequest{
+		Bucket:    TestBucket,
+		Key:       "avatars/42.png",
+		Options:   map[string]interface{}{"width": 256.0, "height": 256.0, "format": "webp"},
+		MaxSize:   1024,
+		ExpiresIn: 300,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create the session: %s", err)
+	}
+	if len(session.ID) != 32 || session.Bucket != TestBucket || session.Key != "avatars/42.png" || session.MaxSize != 1024 {
+		t.Errorf("Unexpected session %+v", session)
+	}
+	if session.Options != "format=webp&height=256&width=256" {
+		t.Errorf("Expected the encoded options, got %q", session.Options)
+	}
+	if session.IssuedAt != issued.Unix() || session.ExpiresAt != issued.Add(5*time.Minute).Unix() {
+		t.Errorf("Expected the session to be valid from %d to %d, got %d to %d", issued.Unix(), issued.Add(5*time.Minute).Unix(), session.IssuedAt, session.ExpiresAt)
+	}
+
+	token, err := d.signSession(session)
+	if err != nil {
+		t.Fatalf("Failed to sign the session: %s", err)
+	}
+	verified, err := d.verifySession(token)
+	if err != nil {
+		t.Fatalf("Failed to verify the session: %s", err)
+	}
+	if *verified != *session {
+		t.Errorf("Expected the session %+v, got %+v", session, verified)
+	}
+
+	// The max size defaults to the upload size limit
+	session, err = d.newSession(&sessionCreateRequest{Bucket: TestBucket, Key: "photo.png", Options: map[string]interface{}{"width": 16.0}, ExpiresIn: 60})
+	if err != nil {
+		t.Fatalf("Failed to create the session: %s", err)
+	}
+	if session.MaxSize != d.maxUploadSizeLimit() {
+		t.Errorf("Expected the max size %d, got %d", d.maxUploadSizeLimit(), session.MaxSize)
+	}
+}
+
+func TestSessionClockSkew(t *testing.T) {
+	s := newSessionTestServer(t)
+	defer s.close()
+	d := s.deflator
+	issued := time.Date(2019, 7, 1, 12, 0, 0, 0, time.UTC)
+	d.clock = &fakeClock{now: issued}
+
+	session, err := d.newSession(&sessionCreateRequest{Bucket: TestBucket, Key: "photo.png", Options: map[string]interface{}{"width": 16.0}, ExpiresIn: 300})
+	if err != nil {
+		t.Fatalf("Failed to create the session: %s", err)
+	}
+	token, err := d.signSession(session)
+	if err != nil {
+		t.Fatalf("Failed to sign the session: %s", err)
+	}
+
+	expires := issued.Add(5 * time.Minute)
+	tests := []struct {
+		name string
+		now  time.Time
+		code string
+	}{
+		{"issued", issued, ""},
+		// Another instance's clock may be behind the one which issued it
+		{"early within the skew", issued.Add(-30 * time.Second), ""},
+		{"early", issued.Add(-31 * time.Second), ErrorCodeInvalidSession},
+		{"before expiry", expires.Add(-time.Second), ""},
+		{"expired within the skew", expires.Add(29 * time.Second), ""},
+		{"expired at the end of the skew", expires.Add(30 * time.Second), ErrorCodeSessionExpired},
+		{"expired", expires.Add(time.Hour), ErrorCodeSessionExpired},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d.clock = &fakeClock{now: test.now}
+			_, err := d.verifySession(token)
+			if code := errorCode(err); err != nil && code != test.code || err == nil && test.code != "" {
+				t.Errorf("Expected the %q code, got %v", test.code, err)
+			}
+		})
+	}
+
+	d.clock = &fakeClock{now: expires.Add(time.Hour)}
+	status, _ := errorStatus(verifyError(d, token))
+	if status != http.StatusForbidden {
+		t.Errorf("Expected the expired session to be forbidden, got %d", status)
+	}
+}
+
+// verifyError returns the error of verifying token
+func verifyError(d *Deflator, token string) error {
+	_, err := d.verifySession(token)
+	return err
+}
+
+func TestSessionTokenTampering(t *testing.T) {
+	s := newSessionTestServer(t)
+	defer s.close()
+	d := s.deflator
+
+	session, err := d.newSession(&sessionCreateRequest{Bucket: TestBucket, Key: "photo.png", Options: map[string]interface{}{"width": 16.0}, ExpiresIn: 300})
+	if err != nil {
+		t.Fatalf("Failed to create the session: %s", err)
+	}
+	token, err := d.signSession(session)
+	if err != nil {
+		t.Fatalf("Failed to sign the session: %s", err)
+	}
+	i := strings.Index(token, ".")
+	payload, signature := token[:i], token[i+1:]
+
+	// A flipped byte can't verify, while a changed last character of the
+	// signature can only change its unused padding bits
+	mac, _ := base64.RawURLEncoding.DecodeString(signature)
+	mac[len(mac)-1] ^= 1
+	tampered := base64.RawURLEncoding.EncodeToString(mac)
+	const alphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_"
+	last := strings.IndexByte(alphabet, signature[len(signature)-1])
+	nonCanonical := signature[:len(signature)-1] + string(alphabet[last^1])
+
+	other := *session
+	other.Key = "other.png"
+	otherPayload, _ := json.Marshal(&other)
+	withoutID := *session
+	withoutID.ID = ""
+	withoutIDToken, _ := d.signSession(&withoutID)
+
+	otherSecret := *s.deflator.config
+	otherSecret.SessionSecret = "other-secret"
+	forged, _ := (&Deflator{config: &otherSecret}).signSession(session)
+
+	for name, token := range map[string]string{
+		"empty":         "",
+		"no signature":  payload,
+		"key":           base64.RawURLEncoding.EncodeToString(otherPayload) + "." + signature,
+		"signature":     payload + "." + tampered,
+		"padding bits":  payload + "." + nonCanonical,
+		"other secret":  forged,
+		"not base64":    payload + ".!!!",
+		"not json":      base64.RawURLEncoding.EncodeToString([]byte("session")) + "." + base64.RawURLEncoding.EncodeToString(d.sessionMAC(base64.RawURLEncoding.EncodeToString([]byte("session")))),
+		"missing id":    withoutIDToken,
+		"swapped parts": signature + "." + payload,
+	} {
+		if code := errorCode(verifyError(d, token)); code != ErrorCodeInvalidSession {
+			t.Errorf("Expected the %s code for the %s token, got %s", ErrorCodeInvalidSession, name, code)
+		}
+	}
+}
+
+func TestNewSessionErrors(t *testing.T) {
+	s := newTestServer(t, func(config *Config) {
+		config.AdminToken = testAdminToken
+		config.SessionSecret = "session-secret"
+		config.SessionMaxTTL = 15 * time.Minute
+		config.MaxUploadSize = 1 << 20
+		config.AllowedDestinations = []string{TestBucket + "/avatars/"}
+	})
+	defer s.close()
+
+	tests := []struct {
+		name string
+		req  sessionCreateRequest
+		code string
+	}{
+		{"bucket", sessionCreateRequest{Key: "avatars/42.png", ExpiresIn: 60}, ErrorCodeMissingField},
+		{"key", sessionCreateRequest{Bucket: TestBucket, ExpiresIn: 60}, ErrorCodeMissingField},
+		{"destination", sessionCreateRequest{Bucket: TestBucket, Key: "other/42.png", Options: map[string]interface{}{"width": 16.0}, ExpiresIn: 60}, ErrorCodeBucketNotAllowed},
+		{"invalid key", sessionCreateRequest{Bucket: TestBucket, Key: "avatars/4\\2.png", Options: map[string]interface{}{"width": 16.0}, ExpiresIn: 60}, ErrorCodeInvalidKey},
+		{"dimensions", sessionCreateRequest{Bucket: TestBucket, Key: "avatars/42.png", ExpiresIn: 60}, ErrorCodeInvalidDimensions},
+		{"format", sessionCreateRequest{Bucket: TestBucket, Key: "avatars/42.png", Options: map[string]interface{}{"width": 16.0, "format": "bmp"}, ExpiresIn: 60}, ErrorCodeInvalidFormat},
+		{"negative max size", sessionCreateRequest{Bucket: TestBucket, Key: "avatars/42.png", Options: map[string]interface{}{"width": 16.0}, MaxSize: -1, ExpiresIn: 60}, ErrorCodeInvalidParameter},
+		{"max size", sessionCreateRequest{Bucket: TestBucket, Key: "avatars/42.png", Options: map[string]interface{}{"width": 16.0}, MaxSize: 2 << 20, ExpiresIn: 60}, ErrorCodeInvalidParameter},
+		{"no expiry", sessionCreateRequest{Bucket: TestBucket, Key: "avatars/42.png", Options: map[string]interface{}{"width": 16.0}}, ErrorCodeInvalidParameter},
+		{"expiry", sessionCreateRequest{Bucket: TestBucket, Key: "avatars/42.png", Options: map[string]interface{}{"width": 16.0}, ExpiresIn: 901}, ErrorCodeInvalidParameter},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := s.deflator.newSession(&test.req)
+			if code := errorCode(err); code != test.code {
+				t.Errorf("Expected the %s code, got %v", test.code, err)
+			}
+		})
+	}
+}
+
+func TestSessionStoreClaim(t *testing.T) {
+	store := newSessionStore()
+	now := time.Date(2019, 7, 1, 12, 0, 0, 0, time.UTC)
+
+	if !store.claim("a", now.Add(time.Minute), now) {
+		t.Fatalf("Failed to claim a new session")
+	}
+	if store.claim("a", now.Add(time.Minute), now) {
+		t.Errorf("Claimed a session twice")
+	}
+	if !store.claim("b", now.Add(time.Minute), now) {
+		t.Errorf("Failed to claim another session")
+	}
+
+	// Expired sessions get forgotten
+	later := now.Add(2 * time.Minute)
+	store.claim("c", later.Add(time.Minute), later)
+	if len(store.used) != 1 {
+		t.Errorf("Expected only the unexpired session to be remembered, got %d", len(store.used))
+	}
+}
+
+func TestSessionUpload(t *testing.T) {
+	s := newSessionTestServer(t)
+	defer s.close()
+
+	uploadURL := s.session(`{"bucket": "` + TestBucket + `", "key": "avatars/42.png", "options": {"width": 16.0}, "expires_in": 300}`)
+	resp := postSession(t, uploadURL, bytes.NewReader(testPNG(t, 64, 32)))
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the session upload to succeed, got %d", resp.StatusCode)
+	}
+	if _, ok := s.fake.Object(TestBucket, "avatars/42.png"); !ok {
+		t.Fatalf("The session upload wasn't stored")
+	}
+
+	resp = postSession(t, uploadURL, bytes.NewReader(testPNG(t, 64, 32)))
+	if code := decodeError(t, resp, http.StatusConflict).Code; code != ErrorCodeSessionUsed {
+		t.Errorf("Expected the reused session to get %s, got %s", ErrorCodeSessionUsed, code)
+	}
+}
+
+func TestSessionUploadErrors(t *testing.T) {
+	s := newSessionTestServer(t)
+	defer s.close()
+	body := `{"bucket": "` + TestBucket + `", "key": "photo.png", "options": {"width": 16.0}, "max_size": 100, "expires_in": 300}`
+
+	// Only the token can be sent
+	for _, suffix := range []string{"&width=32", "&session=other"} {
+		resp := postSession(t, s.session(body)+suffix, bytes.NewReader(testPNG(t, 64, 32)))
+		if code := decodeError(t, resp, http.StatusBadRequest).Code; code != ErrorCodeSessionMismatch {
+			t.Errorf("Expected the %s code with %q, got %s", ErrorCodeSessionMismatch, suffix, code)
+		}
+	}
+	resp, err := http.Get(s.session(body))
+	if err != nil {
+		t.Fatalf("Failed to send the request: %s", err)
+	}
+	if code := decodeError(t, resp, http.StatusBadRequest).Code; code != ErrorCodeSessionMismatch {
+		t.Errorf("Expected the %s code for a GET, got %s", ErrorCodeSessionMismatch, code)
+	}
+
+	resp = postSession(t, s.session(body), bytes.NewReader(testPNG(t, 64, 32)))
+	if code := decodeError(t, resp, http.StatusRequestEntityTooLarge).Code; code != ErrorCodePayloadTooLarge {
+		t.Errorf("Expected the %s code, got %s", ErrorCodePayloadTooLarge, code)
+	}
+
+	resp = postSession(t, s.server.URL+"/?"+SessionParameter+"=forged", bytes.NewReader(testPNG(t, 64, 32)))
+	if code := decodeError(t, resp, http.StatusBadRequest).Code; code != ErrorCodeInvalidSession {
+		t.Errorf("Expected the %s code, got %s", ErrorCodeInvalidSession, code)
+	}
+	if keys := s.fake.Keys(TestBucket); len(keys) != 0 {
+		t.Errorf("Expected nothing to be stored, got %q", keys)
+	}
+
+	// Creating sessions needs the admin token
+	r, err := http.NewRequest(http.MethodPost, s.server.URL+SessionsPath, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to create the request: %s", err)
+	}
+	r.Header.Set("Authorization", "Bearer other-token")
+	resp, err = http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatalf("Failed to send the request: %s", err)
+	}
+	if code := decodeError(t, resp, http.StatusForbidden).Code; code != ErrorCodeForbidden {
+		t.Errorf("Expected the %s code, got %s", ErrorCodeForbidden, code)
+	}
+	resp = s.createSession(`{"bucket": "` + TestBucket + `"`)
+	if code := decodeError(t, resp, http.StatusBadRequest).Code; code != ErrorCodeInvalidEnvelope {
+		t.Errorf("Expected the %s code for a truncated body, got %s", ErrorCodeInvalidEnvelope, code)
+	}
+}
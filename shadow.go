@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"expvar"
+	"math/rand"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/s3manager"
+	"github.com/davidbyttow/govips/pkg/vips"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	ShadowQueueSize = 100
+)
+
+var (
+	// shadowStats compares the primary and shadow outputs of the sampled
+	// requests. Sizes are in bytes and durations in milliseconds.
+	shadowStats = expvar.NewMap("shadow")
+)
+
+// encoderProfile holds the encoder settings applied on top of the resize
+type encoderProfile struct {
+	Quality       int  `json:"quality"`
+	Compression   int  `json:"compression"`
+	Lossless      bool `json:"lossless"`
+	StripMetadata bool `json:"strip_metadata"`
+	Interlaced    bool `json:"interlaced"`
+
+	// format overrides the output format, which otherwise matches the source
+	format vips.ImageType
+}
+
+// parseEncoderProfile decodes a JSON encoder profile
+func parseEncoderProfile(raw string) (*encoderProfile, error) {
+	profile := &encoderProfile{}
+	if raw == "" {
+		return profile, nil
+	}
+
+	err := json.Unmarshal([]byte(raw), profile)
+	if err != nil {
+		return nil, err
+	}
+
+	return profile, nil
+}
+
+func (p *encoderProfile) apply(t *vips.Transform) {
+	if p.Quality > 0 {
+		t.Quality(p.Quality)
+	}
+	if p.Compression > 0 {
+		t.Compression(p.Compression)
+	}
+	if p.Lossless {
+		t.Lossless()
+	}
+	if p.StripMetadata {
+		t.StripMetadata()
+	}
+	if p.Interlaced {
+		t.Interlaced()
+	}
+	if p.format != vips.ImageTypeUnknown {
+		t.Format(p.format)
+	}
+}
+
+// shadowJob is a sampled request waiting to be processed with the shadow profile
+type shadowJob struct {
+	bucket          string
+	key             string
+	contentType     string
+	body            []byte
+	width           uint64
+	height          uint64
+	caption         *textCaption
+	primarySize     int
+	primaryDuration time.Duration
+}
+
+// sampleShadow decides whether a request gets mirrored through the shadow profile
+func (d *Deflator) sampleShadow() bool {
+	return d.config.ShadowPercent > 0 && rand.Float64()*100 < d.config.ShadowPercent
+}
+
+// scheduleShadow queues job without ever blocking the primary request
+func (d *Deflator) scheduleShadow(job *shadowJob) {
+	select {
+	case d.shadowQueue <- job:
+		shadowStats.Add("sampled", 1)
+	default:
+		shadowStats.Add("dropped", 1)
+		log.Debugf("Shadow queue full. Dropping s3://%s/%s", job.bucket, logKey(job.key))
+	}
+}
+
+// RunShadowQueue processes the sampled requests until ctx is cancelled
+func (d *Deflator) RunShadowQueue(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case job := <-d.shadowQueue:
+			d.processShadow(ctx, job)
+		}
+	}
+}
+
+// drainShadowQueue processes the queued requests, once RunShadowQueue
+// returned, dropping the ones left when ctx expires
+func (d *Deflator) drainShadowQueue(ctx context.Context) (int, error) {
+	for {
+		select {
+		case <-ctx.Done():
+			return len(d.shadowQueue), ctx.Err()
+		default:
+		}
+
+		select {
+		case job := <-d.shadowQueue:
+			d.processShadow(ctx, job)
+		default:
+			return 0, nil
+		}
+	}
+}
+
+// processShadow transforms the body of job with the shadow profile, records
+// how it compares with the primary output and optionally uploads it under the
+// shadow key prefix
+func (d *Deflator) processShadow(ctx context.Context, job *shadowJob) {
+	start := time.Now()
+	buf, _, err := transformImage(job.body, job.width, job.height, d.shadowProfile, job.caption)
+	duration := time.Since(start)
+	if err != nil {
+		shadowStats.Add("failed", 1)
+		log.Warnf("Failed to process shadow request for s3://%s/%s: %s", job.bucket, logKey(job.key), err)
+		return
+	}
+
+	shadowStats.Add("completed", 1)
+	shadowStats.Add("primary_bytes", int64(job.primarySize))
+	shadowStats.Add("shadow_bytes", int64(len(buf)))
+	shadowStats.Add("primary_duration_ms", int64(job.primaryDuration/time.Millisecond))
+	shadowStats.Add("shadow_duration_ms", int64(duration/time.Millisecond))
+
+	log.Debugf(
+		"Shadow request for s3://%s/%s: %d bytes in %s (primary: %d bytes in %s)",
+		job.bucket, job.key, len(buf), duration, job.primarySize, job.primaryDuration,
+	)
+
+	if d.config.ShadowKeyPrefix == "" {
+		return
+	}
+
+	uploader, err := getS3Uploader(ctx, job.bucket, "", d.config.DefaultS3Region, d.endpointOptions(job.bucket))
+	if err != nil {
+		log.Warnf("Failed to get uploader for bucket %q: %s", job.bucket, err)
+		return
+	}
+
+	_, err = uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+		Body:        bytes.NewReader(buf),
+		Bucket:      aws.String(job.bucket),
+		ContentType: aws.String(job.contentType),
+		Key:         aws.String(d.config.ShadowKeyPrefix + job.key),
+	})
+	if err != nil {
+		shadowStats.Add("upload_failed", 1)
+		log.Warnf("Failed to upload shadow output for s3://%s/%s: %s", job.bucket, logKey(job.key), err)
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/s3manager"
+	"github.com/davidbyttow/govips/pkg/vips"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Formats of the `siblings` option, stored next to the processed object
+	// under its key with the format as extension, e.g. `photo.jpg.webp`
+	SiblingFormatWEBP = "webp"
+	SiblingFormatAVIF = "avif"
+
+	// SiblingsNone disables the siblings of the bucket config
+	SiblingsNone = "none"
+)
+
+// encodeAVIF encodes a PNG image as AVIF, with quality between 0 and 100, or
+// the libavif default for zero. Like decodeAVIF, it's only set by the builds
+// with the `avif` tag.
+var encodeAVIF func(png []byte, quality int) ([]byte, error)
+
+// siblingImage is an encoded sibling waiting to be uploaded
+type siblingImage struct {
+	format      string
+	contentType string
+	body        []byte
+	// payload is what gets stored, the ciphertext for encrypted buckets
+	payload []byte
+	// metadata replaces the metadata of the processed object, if set
+	metadata map[string]string
+}
+
+// siblingResult describes a sibling stored next to the processed object
+type siblingResult struct {
+	Format      string `json:"format"`
+	Key         string `json:"key"`
+	Size        int    `json:"size"`
+	ContentType string `json:"content_type"`
+}
+
+// parseSiblingFormats validates the sibling formats, dropping the duplicates.
+// SiblingsNone alone gives an empty list.
+func parseSiblingFormats(formats []string) ([]string, error) {
+	if len(formats) == 1 && formats[0] == SiblingsNone {
+		return []string{}, nil
+	}
+
+	parsed := make([]string, 0, len(formats))
+	seen := make(map[string]bool, len(formats))
+	for _, format := range formats {
+		format = strings.TrimSpace(format)
+		switch format {
+		case SiblingFormatWEBP:
+		case SiblingFormatAVIF:
+			if encodeAVIF == nil {
+				return nil, fmt.Errorf("AVIF siblings aren't supported in this build")
+			}
+		default:
+			return nil, fmt.Errorf("unknown sibling format %q (expected %s or %s)", format, SiblingFormatWEBP, SiblingFormatAVIF)
+		}
+		if !seen[format] {
+			seen[format] = true
+			parsed = append(parsed, format)
+		}
+	}
+	return parsed, nil
+}
+
+func parseSiblingsOption(d *Deflator, options *requestOptions, name, value string) error {
+	formats, err := parseSiblingFormats(strings.Split(value, ","))
+	if err != nil {
+		return newRequestError(http.StatusBadRequest, ErrorCodeInvalidParameter, "Invalid %s %q: %s", name, value, err)
+	}
+	options.siblings = formats
+
+	return nil
+}
+
+// isAnimated checks whether body is an animated GIF, WebP or PNG
+func isAnimated(body []byte) bool {
+	switch {
+	case bytes.HasPrefix(body, []byte("GIF8")):
+		return gifFrames(body) > 1
+	case len(body) >= 21 && bytes.Equal(body[:4], []byte("RIFF")) && bytes.Equal(body[8:16], []byte("WEBPVP8X")):
+		// The animation flag of the extended header
+		return body[20]&0x02 != 0
+	case bytes.HasPrefix(body, []byte("\x89PNG\r\n\x1a\n")):
+		return hasPNGChunk(body, "acTL")
+	}
+	return false
+}
+
+// gifFrames counts the image descriptors of a GIF, up to two, by walking its
+// blocks without decompressing them
+func gifFrames(body []byte) int {
+	// The header, then the logical screen descriptor and its color table
+	if len(body) < 13 {
+		return 0
+	}
+	i := 13
+	if body[10]&0x80 != 0 {
+		i += 3 << (uint(body[10]&0x07) + 1)
+	}
+
+	// skipSubBlocks returns the offset after the data sub-blocks at i
+	skipSubBlocks := func(i int) int {
+		for i < len(body) && body[i] != 0 {
+			i += int(body[i]) + 1
+		}
+		return i + 1
+	}
+
+	frames := 0
+	for i < len(body) && frames < 2 {
+		switch body[i] {
+		case 0x21:
+			// Extension: label, then sub-blocks
+			i = skipSubBlocks(i + 2)
+		case 0x2c:
+			// Image descriptor, local color table, LZW code size, then data
+			frames++
+			if i+10 > len(body) {
+				return frames
+			}
+			flags := body[i+9]
+			i += 10
+			if flags&0x80 != 0 {
+				i += 3 << (uint(flags&0x07) + 1)
+			}
+			i = skipSubBlocks(i + 1)
+		default:
+			// The trailer, or garbage
+			return frames
+		}
+	}
+	return frames
+}
+
+// hasPNGChunk checks whether the PNG body has a chunk of kind before its
+// image data
+func hasPNGChunk(body []byte, kind string) bool {
+	for i := 8; i+8 <= len(body); {
+		length := int(binary.BigEndian.Uint32(body[i : i+4]))
+		chunk := string(body[i+4 : i+8])
+		if chunk == kind {
+			return true
+		}
+		if chunk == "IDAT" {
+			return false
+		}
+		i += 12 + length
+	}
+	return false
+}
+
+// checkSiblings applies the sibling default of the bucket to req, and the
+// restrictions of the animated images: libvips only encodes their first
+// frame here, so their siblings would be stills. They're rejected when the
+// request asks for siblings, and skipped with a warning when they come from
+// the bucket config.
+func (d *Deflator) checkSiblings(ctx context.Context, req *uploadRequest, body []byte) error {
+	explicit := req.siblings != nil
+	if !explicit {
+		req.siblings = d.bucketConfig(req.bucket).Siblings
+	}
+	if len(req.siblings) == 0 || !isAnimated(body) {
+		return nil
+	}
+
+	if explicit {
+		log.Debugf("Siblings requested for the animated image of URL %q", req.location())
+		return newRequestError(http.StatusBadRequest, ErrorCodeInvalidParameter, "siblings aren't supported for animated images")
+	}
+	log.Debugf("Skipping the siblings of the animated image of URL %q", req.location())
+	addWarning(ctx, req.bucket, WarningSiblingsSkipped)
+	req.siblings = nil
+	return nil
+}
+
+// encodeSiblings encodes the siblings of req from the decoded source, with
+// the same dimensions, caption and encoder settings as the processed image.
+// With SiblingsBestEffort, the siblings which fail are left out.
+func (d *Deflator) encodeSiblings(ctx context.Context, req *uploadRequest, source *vips.ImageRef, profile *encoderProfile) ([]*siblingImage, error) {
+	siblings := make([]*siblingImage, 0, len(req.siblings))
+	for _, format := range req.siblings {
+		siblingProfile := &encoderProfile{}
+		if profile != nil {
+			*siblingProfile = *profile
+		}
+
+		var body []byte
+		var err error
+		switch format {
+		case SiblingFormatAVIF:
+			// libvips can't encode AVIF, so it gets a lossless PNG to convert
+			siblingProfile.format = vips.ImageTypePNG
+			body, _, err = transformDecoded(source, req.width, req.height, siblingProfile, req.caption)
+			if err == nil {
+				body, err = encodeAVIF(body, siblingProfile.Quality)
+			}
+		default:
+			siblingProfile.format = vips.ImageTypeWEBP
+			body, _, err = transformDecoded(source, req.width, req.height, siblingProfile, req.caption)
+		}
+		if err != nil {
+			log.Warnf("Failed to encode the %s sibling for URL %q: %s", format, req.location(), err)
+			if d.config.SiblingsBestEffort {
+				addWarning(ctx, req.bucket, WarningSiblingFailed)
+				continue
+			}
+			return nil, newRequestError(http.StatusServiceUnavailable, ErrorCodeTransformFailed, "Internal error").withCause(err)
+		}
+
+		siblings = append(siblings, &siblingImage{format: format, contentType: "image/" + format, body: body, payload: body})
+	}
+	return siblings, nil
+}
+
+// siblingKey is where the sibling of format of the object at key is stored
+func siblingKey(key, format string) string {
+	return key + "." + format
+}
+
+// uploadSiblings stores the siblings next to the object at key, with the
+// settings of the processed object described by input. It returns the
+// siblings which got stored and the first error.
+func uploadSiblings(ctx context.Context, uploader *s3manager.Uploader, input s3manager.UploadInput, key string, siblings []*siblingImage) ([]siblingResult, error) {
+	var stored []siblingResult
+	var firstErr error
+	for _, sibling := range siblings {
+		siblingInput := input
+		siblingInput.Key = aws.String(siblingKey(key, sibling.format))
+		siblingInput.ContentType = aws.String(sibling.contentType)
+		siblingInput.Body = bytes.NewReader(sibling.payload)
+		if sibling.metadata != nil {
+			siblingInput.Metadata = sibling.metadata
+		}
+
+		_, err := uploader.UploadWithContext(ctx, &siblingInput)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		invalidateHeadCache(aws.StringValue(input.Bucket), aws.StringValue(siblingInput.Key))
+		stored = append(stored, siblingResult{
+			Format:      sibling.format,
+			Key:         aws.StringValue(siblingInput.Key),
+			Size:        len(sibling.body),
+			ContentType: sibling.contentType,
+		})
+	}
+	return stored, firstErr
+}
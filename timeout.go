@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"expvar"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// TimeoutHeader lets clients pick their upload timeout, within the
+	// configured bounds. The effective timeout is echoed in the response.
+	TimeoutHeader = "X-Timeout-Seconds"
+	// RequestDeadlineHeader is the RFC3339 deadline of the callers which
+	// propagate their own request budget, shortening the upload timeout
+	RequestDeadlineHeader = "X-Request-Deadline"
+)
+
+// maxUploadTimeout is the longest upload timeout clients can request
+func (d *Deflator) maxUploadTimeout() time.Duration {
+	if d.config.UploadTimeoutMax > d.config.UploadTimeout {
+		return d.config.UploadTimeoutMax
+	}
+	return d.config.UploadTimeout
+}
+
+// serverTimeout is the read and write timeout of the listeners, which must
+// outlast the longest upload timeout
+func (d *Deflator) serverTimeout() time.Duration {
+	if extended := d.maxUploadTimeout() + d.config.RequestTimeout - d.config.UploadTimeout; extended > d.config.RequestTimeout {
+		return extended
+	}
+	return d.config.RequestTimeout
+}
+
+// uploadTimeout returns the timeout requested through the `timeout` query
+// parameter or the TimeoutHeader, clamped to the configured bounds, and
+// UploadTimeout when there's none
+func (d *Deflator) uploadTimeout(r *http.Request) time.Duration {
+	value := r.URL.Query().Get("timeout")
+	if value == "" {
+		value = r.Header.Get(TimeoutHeader)
+	}
+	if value == "" {
+		return d.config.UploadTimeout
+	}
+
+	seconds, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsNaN(seconds) {
+		log.Debugf("Ignoring invalid timeout %q", value)
+		return d.config.UploadTimeout
+	}
+
+	// Clamp before converting, so huge values don't overflow
+	minTimeout, maxTimeout := d.config.UploadTimeoutMin, d.maxUploadTimeout()
+	switch {
+	case seconds < minTimeout.Seconds():
+		log.Debugf("Clamping timeout %q to %s", value, minTimeout)
+		return minTimeout
+	case seconds > maxTimeout.Seconds():
+		log.Debugf("Clamping timeout %q to %s", value, maxTimeout)
+		return maxTimeout
+	}
+
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// callerDeadline returns the RequestDeadlineHeader of r, if any. The invalid
+// deadlines are ignored, and so are the ones more than DeadlineMaxSkew in the
+// past, which rather hint at a skewed clock than at an expired budget.
+func (d *Deflator) callerDeadline(r *http.Request, now time.Time) (time.Time, bool) {
+	value := r.Header.Get(RequestDeadlineHeader)
+	if value == "" {
+		return time.Time{}, false
+	}
+
+	deadline, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		callerDeadlines.Add("invalid", 1)
+		log.Debugf("Ignoring invalid request deadline %q", value)
+		return time.Time{}, false
+	}
+	if late := now.Sub(deadline); late > d.config.DeadlineMaxSkew {
+		callerDeadlines.Add("skewed", 1)
+		log.Warnf("Ignoring request deadline %q, %s in the past: the clock of the caller is likely skewed", value, late.Round(time.Millisecond))
+		return time.Time{}, false
+	}
+	return deadline, true
+}
+
+var (
+	// timeouts counts the requests which ran into their upload timeout, by
+	// the pipeline stage they were in
+	timeouts = expvar.NewMap("upload_timeouts")
+	// callerDeadlines counts the requests with a RequestDeadlineHeader by
+	// outcome: `applied` when it shortened the upload timeout, `expired`,
+	// `skewed` and `invalid`
+	callerDeadlines = expvar.NewMap("caller_deadlines")
+)
+
+type deadlineContextKey struct{}
+
+// deadlineState lets timeoutHandler report how far a request got
+type deadlineState struct {
+	progress atomic.Value
+}
+
+// trackDeadlineProgress registers the progress of the upload served by the
+// request of ctx, which gets reported if it times out
+func trackDeadlineProgress(ctx context.Context, progress *uploadProgress) {
+	if state, ok := ctx.Value(deadlineContextKey{}).(*deadlineState); ok {
+		state.progress.Store(progress)
+	}
+}
+
+// timeoutProgress is the detail of upload_timeout errors
+type timeoutProgress struct {
+	Stage         string `json:"stage"`
+	BytesRead     int64  `json:"bytes_read"`
+	BytesUploaded int64  `json:"bytes_uploaded"`
+	ElapsedMS     int64  `json:"elapsed_ms"`
+}
+
+// timeoutError describes a request which didn't complete within timeout
+func (state *deadlineState) timeoutError(timeout time.Duration) *requestError {
+	detail := &timeoutProgress{Stage: "none", ElapsedMS: int64(timeout / time.Millisecond)}
+	if progress, ok := state.progress.Load().(*uploadProgress); ok {
+		detail.Stage, detail.BytesRead, detail.BytesUploaded = progress.snapshot()
+		detail.ElapsedMS = int64(time.Since(progress.start) / time.Millisecond)
+	}
+	timeouts.Add(detail.Stage, 1)
+
+	err := newRequestError(http.StatusGatewayTimeout, ErrorCodeUploadTimeout, "Upload timeout (%s) in stage %s", timeout, detail.Stage)
+	err.detail = detail
+	return err
+}
+
+// timeoutWriter buffers the response of the handler until it completes, so
+// it can be dropped in favour of the timeout error
+type timeoutWriter struct {
+	header http.Header
+	body   bytes.Buffer
+	status int
+
+	mu sync.Mutex
+	// done is set once either the handler completed or the request timed
+	// out. Writes after a timeout fail with http.ErrHandlerTimeout.
+	done     bool
+	timedOut bool
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.header
+}
+
+func (tw *timeoutWriter) Write(p []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	if tw.status == 0 {
+		tw.status = http.StatusOK
+	}
+	return tw.body.Write(p)
+}
+
+func (tw *timeoutWriter) WriteHeader(status int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if tw.timedOut || tw.status != 0 {
+		return
+	}
+	tw.status = status
+}
+
+// flush sends the buffered response. tw.mu must be held.
+func (tw *timeoutWriter) flush(w http.ResponseWriter) {
+	trailers := make(map[string]bool)
+	for _, declared := range tw.header["Trailer"] {
+		for _, name := range strings.Split(declared, ",") {
+			trailers[http.CanonicalHeaderKey(strings.TrimSpace(name))] = true
+		}
+	}
+
+	dst := w.Header()
+	for name, values := range tw.header {
+		if !trailers[name] {
+			dst[name] = values
+		}
+	}
+	if tw.status == 0 {
+		tw.status = http.StatusOK
+	}
+	w.WriteHeader(tw.status)
+	_, _ = w.Write(tw.body.Bytes())
+
+	// The declared trailers only get sent after the body
+	for name := range trailers {
+		if values, ok := tw.header[name]; ok {
+			dst[name] = values
+		}
+	}
+}
+
+// isUploadRequest checks if r sends a body to process. The other requests
+// (GET, HEAD, DELETE and OPTIONS) have no upload timeout, and their responses
+// get streamed, within the write timeout of the listener.
+func isUploadRequest(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch:
+		return true
+	}
+	return false
+}
+
+// timeoutHandler cancels the uploads which take longer than their upload
+// timeout, like http.TimeoutHandler, and answers them with a structured
+// upload_timeout error saying how far they got. Exactly one of the handler
+// response and the timeout error gets sent: a handler which completes before
+// the timeout is acted upon wins, even if the deadline passed in the mean
+// time.
+func (d *Deflator) timeoutHandler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isUploadRequest(r) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		timeout := d.uploadTimeout(r)
+		now := time.Now()
+		if deadline, ok := d.callerDeadline(r, now); ok {
+			remaining := deadline.Sub(now)
+			if remaining <= 0 {
+				callerDeadlines.Add("expired", 1)
+				log.Debugf("%s request for %s arrived %s after its deadline", r.Method, describePath(r.URL.Path), -remaining)
+				writeError(w, r, newRequestError(http.StatusGatewayTimeout, ErrorCodeDeadlineExceededOnArrival, "Request deadline %s exceeded on arrival", deadline.Format(time.RFC3339Nano)))
+				return
+			}
+			if remaining < timeout {
+				callerDeadlines.Add("applied", 1)
+				timeout = remaining
+			}
+		}
+		log.Debugf("%s request for %s has deadline %s", r.Method, describePath(r.URL.Path), now.Add(timeout).UTC().Format(time.RFC3339Nano))
+		w.Header().Set(TimeoutHeader, strconv.FormatFloat(timeout.Seconds(), 'f', -1, 64))
+
+		state := &deadlineState{}
+		ctx, cancel := context.WithTimeout(context.WithValue(r.Context(), deadlineContextKey{}, state), timeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+
+		tw := &timeoutWriter{header: make(http.Header)}
+		finished := make(chan struct{})
+		panicked := make(chan interface{}, 1)
+		go func() {
+			defer func() {
+				if p := recover(); p != nil {
+					panicked <- p
+				}
+			}()
+			handler.ServeHTTP(tw, r)
+
+			tw.mu.Lock()
+			defer tw.mu.Unlock()
+			if !tw.done {
+				tw.done = true
+				close(finished)
+			}
+		}()
+
+		select {
+		case p := <-panicked:
+			panic(p)
+		case <-finished:
+			tw.mu.Lock()
+			defer tw.mu.Unlock()
+			tw.flush(w)
+		case <-ctx.Done():
+			tw.mu.Lock()
+			defer tw.mu.Unlock()
+			if tw.done {
+				// The handler completed right as the deadline passed
+				tw.flush(w)
+				return
+			}
+			tw.done, tw.timedOut = true, true
+
+			if ctx.Err() != context.DeadlineExceeded {
+				// The client went away, nobody is waiting for a response
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			err := state.timeoutError(timeout)
+			log.Warnf("%s request for %s timed out after %s (stage %s)", r.Method, describePath(r.URL.Path), timeout, err.detail.(*timeoutProgress).Stage)
+			writeError(w, r, err)
+		}
+	})
+}
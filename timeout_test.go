@@ -0,0 +1,182 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestTimeoutHandlerStreamsDownloads(t *testing.T) {
+	d := &Deflator{config: &Config{UploadTimeout: 20 * time.Millisecond, DeadlineMaxSkew: time.Second}}
+
+	handler := d.timeoutHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := w.(http.Flusher); !ok {
+			t.Errorf("The %s response isn't streamed", r.Method)
+		}
+		if _, ok := r.Context().Deadline(); ok {
+			t.Errorf("The %s request got an upload deadline", r.Method)
+		}
+		_, _ = w.Write([]byte("first"))
+		// Outlives the upload timeout
+		time.Sleep(50 * time.Millisecond)
+		_, _ = w.Write([]byte(" second"))
+	}))
+
+	for _, method := range []string{http.MethodGet, http.MethodHead, http.MethodDelete} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(method, "/object", nil))
+		if w.Code != http.StatusOK || w.Body.String() != "first second" {
+			t.Errorf("Expected the whole %s response, got %d: %q", method, w.Code, w.Body.String())
+		}
+		if w.Header().Get(TimeoutHeader) != "" {
+			t.Errorf("Expected no %s header for %s requests", TimeoutHeader, method)
+		}
+	}
+}
+
+func TestTimeoutHandlerUploads(t *testing.T) {
+	d := &Deflator{config: &Config{UploadTimeout: 20 * time.Millisecond, DeadlineMaxSkew: time.Second}}
+
+	for _, method := range []string{http.MethodPost, http.MethodPut, http.MethodPatch} {
+		// The handler only completes after the timeout error was sent
+		sent := make(chan struct{})
+		handler := d.timeoutHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-sent
+			_, _ = w.Write([]byte("too late"))
+		}))
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(method, "/upload", strings.NewReader("body")))
+		close(sent)
+		if w.Code != http.StatusGatewayTimeout || !strings.Contains(w.Body.String(), ErrorCodeUploadTimeout) {
+			t.Errorf("Expected the %s upload to time out, got %d: %q", method, w.Code, w.Body.String())
+		}
+		if w.Header().Get(TimeoutHeader) != "0.02" {
+			t.Errorf("Expected the %s header 0.02, got %q", TimeoutHeader, w.Header().Get(TimeoutHeader))
+		}
+	}
+}
+
+func TestCallerDeadline(t *testing.T) {
+	d := &Deflator{config: &Config{DeadlineMaxSkew: 30 * time.Second}}
+	now := time.Date(2019, 5, 20, 10, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		value    string
+		expected time.Time
+		ok       bool
+	}{
+		{"missing", "", time.Time{}, false},
+		{"fraction", "2019-05-20T10:00:05.250Z", now.Add(5250 * time.Millisecond), true},
+		{"seconds", "2019-05-20T10:00:05Z", now.Add(5 * time.Second), true},
+		{"offset", "2019-05-20T12:00:05+02:00", now.Add(5 * time.Second), true},
+		{"far", "2019-05-21T10:00:00Z", now.Add(24 * time.Hour), true},
+		// The expired deadlines are only rejected by the handler
+		{"expired", "2019-05-20T09:59:45Z", now.Add(-15 * time.Second), true},
+		{"skewed", "2019-05-20T09:59:29Z", time.Time{}, false},
+		{"unix", "1558346405", time.Time{}, false},
+		{"rfc1123", "Mon, 20 May 2019 10:00:05 GMT", time.Time{}, false},
+		{"no zone", "2019-05-20T10:00:05", time.Time{}, false},
+		{"date", "2019-05-20", time.Time{}, false},
+		{"garbage", "soon", time.Time{}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/upload", nil)
+			if test.value != "" {
+				r.Header.Set(RequestDeadlineHeader, test.value)
+			}
+			deadline, ok := d.callerDeadline(r, now)
+			if ok != test.ok || !deadline.Equal(test.expected) {
+				t.Errorf("Expected %s (%t), got %s (%t)", test.expected, test.ok, deadline, ok)
+			}
+		})
+	}
+}
+
+func TestCallerDeadlineSkewWarning(t *testing.T) {
+	hook := test.NewLocal(log.StandardLogger())
+	defer log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+	d := &Deflator{config: &Config{DeadlineMaxSkew: 30 * time.Second}}
+	now := time.Date(2019, 5, 20, 10, 0, 0, 0, time.UTC)
+
+	r := httptest.NewRequest(http.MethodPost, "/upload", nil)
+	r.Header.Set(RequestDeadlineHeader, "2019-05-20T09:00:00Z")
+	if _, ok := d.callerDeadline(r, now); ok {
+		t.Fatalf("Expected the skewed deadline to be ignored")
+	}
+	entry := hook.LastEntry()
+	if entry == nil || entry.Level != log.WarnLevel || !strings.Contains(entry.Message, "1h0m0s in the past") {
+		t.Errorf("Expected a warning about the skew, got %+v", entry)
+	}
+}
+
+func TestTimeoutHandlerCallerDeadline(t *testing.T) {
+	d := &Deflator{config: &Config{UploadTimeout: 10 * time.Second, DeadlineMaxSkew: 30 * time.Second}}
+
+	tests := []struct {
+		name  string
+		value func(now time.Time) string
+		// timeout is the expected upload timeout, in seconds
+		timeout float64
+	}{
+		{"shorter", func(now time.Time) string { return now.Add(2 * time.Second).Format(time.RFC3339Nano) }, 2},
+		{"longer", func(now time.Time) string { return now.Add(time.Hour).Format(time.RFC3339Nano) }, 10},
+		{"malformed", func(time.Time) string { return "in 2 seconds" }, 10},
+		{"truncated", func(now time.Time) string { return now.Add(2 * time.Second).Format(time.RFC3339Nano)[:19] }, 10},
+		{"skewed", func(now time.Time) string { return now.Add(-time.Hour).Format(time.RFC3339Nano) }, 10},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var deadline time.Time
+			handler := d.timeoutHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				deadline, _ = r.Context().Deadline()
+			}))
+
+			start := time.Now()
+			r := httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader("body"))
+			r.Header.Set(RequestDeadlineHeader, test.value(start))
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected the upload to be handled, got %d: %q", w.Code, w.Body.String())
+			}
+
+			// The deadline was computed a bit after start
+			timeout, err := strconv.ParseFloat(w.Header().Get(TimeoutHeader), 64)
+			if err != nil || timeout > test.timeout || timeout < test.timeout-0.5 {
+				t.Errorf("Expected the %s header %g, got %q", TimeoutHeader, test.timeout, w.Header().Get(TimeoutHeader))
+			}
+			expected := start.Add(time.Duration(test.timeout * float64(time.Second)))
+			if deadline.Before(expected) || deadline.After(expected.Add(500*time.Millisecond)) {
+				t.Errorf("Expected the request to get the deadline %s, got %s", expected, deadline)
+			}
+		})
+	}
+}
+
+func TestTimeoutHandlerExpiredDeadline(t *testing.T) {
+	d := &Deflator{config: &Config{UploadTimeout: 10 * time.Second, DeadlineMaxSkew: 30 * time.Second}}
+	handler := d.timeoutHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("The expired request was handled")
+	}))
+
+	for _, late := range []time.Duration{0, time.Second, 29 * time.Second} {
+		r := httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader("body"))
+		r.Header.Set(RequestDeadlineHeader, time.Now().Add(-late).Format(time.RFC3339Nano))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusGatewayTimeout || !strings.Contains(w.Body.String(), ErrorCodeDeadlineExceededOnArrival) {
+			t.Errorf("Expected the request %s late to be rejected with %s, got %d: %q", late, ErrorCodeDeadlineExceededOnArrival, w.Code, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/s3manager"
+	log "github.com/sirupsen/logrus"
+)
+
+// AdminRestorePath is the admin endpoint which moves soft-deleted objects back
+const AdminRestorePath = "/admin/restore"
+
+// trashResult is returned as JSON after a soft delete
+type trashResult struct {
+	Bucket   string `json:"bucket"`
+	Key      string `json:"key"`
+	TrashKey string `json:"trash_key"`
+}
+
+// restoreRequest is the JSON body of restore requests
+type restoreRequest struct {
+	Bucket   string `json:"bucket"`
+	TrashKey string `json:"trash_key"`
+}
+
+// trashKey returns the key under which a soft-deleted object is kept:
+// `<TrashPrefix><yyyy-mm-dd>/<key>`
+func (d *Deflator) trashKey(key string) string {
+	return d.config.TrashPrefix + d.clock.Now().Format("2006-01-02") + "/" + key
+}
+
+// originalKey extracts the original key from a trash key
+func (d *Deflator) originalKey(trashKey string) (string, bool) {
+	if !strings.HasPrefix(trashKey, d.config.TrashPrefix) {
+		return "", false
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(trashKey, d.config.TrashPrefix), "/", 2)
+	if len(parts) != 2 || len(parts[0]) != len("2006-01-02") || parts[1] == "" {
+		return "", false
+	}
+
+	return parts[1], true
+}
+
+// copySource returns the x-amz-copy-source value for an object
+func copySource(bucket, key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+
+	if ap, err := parseAccessPoint(bucket); err == nil && ap != nil {
+		return bucket + "/object/" + strings.Join(segments, "/")
+	}
+
+	return bucket + "/" + strings.Join(segments, "/")
+}
+
+// moveObject copies an object to newKey in the same bucket and then deletes
+// the original. Nothing gets deleted if the copy fails.
+func moveObject(ctx context.Context, uploader *s3manager.Uploader, bucket, key, newKey string) error {
+	location := (&s3Location{bucket: bucket, key: key}).logString()
+
+	copyReq := uploader.S3.CopyObjectRequest(&s3.CopyObjectInput{
+		Bucket:     aws.String(bucket),
+		Key:        aws.String(newKey),
+		CopySource: aws.String(copySource(bucket, key)),
+	})
+	copyReq.SetContext(ctx)
+	_, err := copyReq.Send()
+	if err != nil {
+		switch {
+		case isNotFoundError(err):
+			return newRequestError(http.StatusNotFound, ErrorCodeNotFound, "Not found")
+		case isAccessDeniedError(err):
+			log.Debugf("Access denied when copying %q: %s", location, err)
+			return newRequestError(http.StatusForbidden, ErrorCodeForbidden, "Forbidden")
+		default:
+			log.Warnf("Failed to copy %q to %q: %s", location, logKey(newKey), err)
+			return newRequestError(http.StatusServiceUnavailable, ErrorCodeStorageUnavailable, "Internal error").withCause(err)
+		}
+	}
+	invalidateHeadCache(bucket, newKey)
+
+	deleteReq := uploader.S3.DeleteObjectRequest(&s3.DeleteObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	deleteReq.SetContext(ctx)
+	_, err = deleteReq.Send()
+	if err != nil {
+		log.Warnf("Failed to delete %q after copying it to %q: %s", location, logKey(newKey), err)
+		return newRequestError(http.StatusServiceUnavailable, ErrorCodeStorageUnavailable, "Internal error").withCause(err)
+	}
+	invalidateHeadCache(bucket, key)
+
+	return nil
+}
+
+// softDelete moves the object at location to the trash prefix. The trash key
+// isn't subject to the AllowedDestinations, since clients can't write there.
+func (d *Deflator) softDelete(w http.ResponseWriter, r *http.Request, uploader *s3manager.Uploader, location *s3Location) {
+	trashKey := d.trashKey(location.key)
+
+	err := moveObject(r.Context(), uploader, location.bucket, location.key, trashKey)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	audit("soft_delete", log.Fields{
+		"bucket":    location.bucket,
+		"key":       location.key,
+		"trash_key": trashKey,
+		"client_ip": d.clientIP(r),
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(&trashResult{
+		Bucket:   location.bucket,
+		Key:      location.key,
+		TrashKey: trashKey,
+	})
+}
+
+// restoreHandler moves a soft-deleted object back to its original key,
+// unless another object was stored there in the mean time
+func (d *Deflator) restoreHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, newRequestError(http.StatusMethodNotAllowed, ErrorCodeMethodNotAllowed, "Method not allowed"))
+		return
+	}
+
+	if !d.isAdminAuthorized(r) {
+		writeError(w, r, newRequestError(http.StatusForbidden, ErrorCodeForbidden, "Forbidden"))
+		return
+	}
+
+	var req restoreRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.Bucket == "" {
+		writeError(w, r, newRequestError(http.StatusBadRequest, ErrorCodeInvalidBucket, "Invalid restore request"))
+		return
+	}
+
+	key, ok := d.originalKey(req.TrashKey)
+	if !ok {
+		writeError(w, r, newRequestError(http.StatusBadRequest, ErrorCodeInvalidKey, "Invalid trash key %q", req.TrashKey))
+		return
+	}
+
+	uploader, err := getS3Uploader(r.Context(), req.Bucket, "", d.config.DefaultS3Region, d.endpointOptions(req.Bucket))
+	if err != nil {
+		writeError(w, r, uploaderError(req.Bucket, err))
+		return
+	}
+
+	_, err = headObject(r.Context(), uploader, req.Bucket, key)
+	switch {
+	case err == nil:
+		writeError(w, r, newRequestError(http.StatusConflict, ErrorCodeAlreadyExists, "Object %q already exists", key))
+		return
+	case !isNotFoundError(err):
+		log.Warnf("Failed to check if %q exists: %s", (&s3Location{bucket: req.Bucket, key: key}).logString(), err)
+		writeError(w, r, newRequestError(http.StatusServiceUnavailable, ErrorCodeStorageUnavailable, "Internal error").withCause(err))
+		return
+	}
+
+	err = moveObject(r.Context(), uploader, req.Bucket, req.TrashKey, key)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	audit("restore", log.Fields{
+		"bucket":    req.Bucket,
+		"key":       key,
+		"trash_key": req.TrashKey,
+		"client_ip": d.clientIP(r),
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(&trashResult{
+		Bucket:   req.Bucket,
+		Key:      key,
+		TrashKey: req.TrashKey,
+	})
+}
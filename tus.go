@@ -0,0 +1,461 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	TusVersion    = "1.0.0"
+	TusExtensions = "creation,expiration"
+	TusPathPrefix = "/files/"
+	TusGCInterval = 1 * time.Minute
+)
+
+// tusUpload is a partial upload spooled to a temporary file
+type tusUpload struct {
+	sync.Mutex
+	// busy is set while a PATCH request appends to the upload
+	busy bool
+	// finalizing is set while the complete upload goes through the pipeline
+	finalizing bool
+
+	id          string
+	path        string
+	length      int64
+	offset      int64
+	expires     time.Time
+	contentType string
+	// location and options are extracted from the signed upload URL in the metadata
+	location *s3Location
+	options  *requestOptions
+}
+
+// tusStore keeps track of the partial uploads
+type tusStore struct {
+	sync.Mutex
+	dir     string
+	uploads map[string]*tusUpload
+}
+
+func newTusStore(dir string) *tusStore {
+	return &tusStore{
+		dir:     dir,
+		uploads: make(map[string]*tusUpload),
+	}
+}
+
+// prepare creates the upload directory and removes the files left behind by
+// a previous process, since their uploads can't be resumed anyway. Restarted
+// processes leave them to their parent, which is still draining its uploads:
+// the tus state isn't handed over.
+func (s *tusStore) prepare() error {
+	err := os.MkdirAll(s.dir, 0700)
+	if err != nil {
+		return err
+	}
+	if isRestarted() {
+		return nil
+	}
+
+	leftovers, err := filepath.Glob(filepath.Join(s.dir, "*"))
+	if err != nil {
+		return err
+	}
+
+	for _, path := range leftovers {
+		err = os.Remove(path)
+		if err != nil {
+			log.Warnf("Failed to remove stale tus upload file %q: %s", path, err)
+		}
+	}
+
+	return nil
+}
+
+func (s *tusStore) get(id string) *tusUpload {
+	s.Lock()
+	defer s.Unlock()
+	return s.uploads[id]
+}
+
+func (s *tusStore) add(upload *tusUpload) {
+	s.Lock()
+	defer s.Unlock()
+	s.uploads[upload.id] = upload
+}
+
+// remove drops the upload and deletes its spooled file
+func (s *tusStore) remove(upload *tusUpload) {
+	s.Lock()
+	delete(s.uploads, upload.id)
+	s.Unlock()
+
+	err := os.Remove(upload.path)
+	if err != nil && !os.IsNotExist(err) {
+		log.Warnf("Failed to remove tus upload file %q: %s", upload.path, err)
+	}
+}
+
+// collectGarbage removes the uploads which expired before now and which
+// aren't currently being appended to or processed
+func (s *tusStore) collectGarbage(now time.Time) {
+	s.Lock()
+	var expired []*tusUpload
+	for _, upload := range s.uploads {
+		upload.Lock()
+		if !upload.busy && !upload.finalizing && now.After(upload.expires) {
+			expired = append(expired, upload)
+		}
+		upload.Unlock()
+	}
+	s.Unlock()
+
+	for _, upload := range expired {
+		log.Debugf("Removing expired tus upload %q", upload.id)
+		s.remove(upload)
+	}
+}
+
+// RunTusGC periodically removes the expired partial uploads until ctx is cancelled
+func (d *Deflator) RunTusGC(ctx context.Context) {
+	ticker := time.NewTicker(TusGCInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			d.tus.collectGarbage(d.clock.Now())
+		}
+	}
+}
+
+// parseTusMetadata decodes the Upload-Metadata header, which consists of comma
+// separated `key base64(value)` pairs
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		fields := strings.Fields(pair)
+		value := ""
+		if len(fields) > 1 {
+			decoded, err := base64.StdEncoding.DecodeString(fields[1])
+			if err != nil {
+				return nil, err
+			}
+			value = string(decoded)
+		}
+		metadata[fields[0]] = value
+	}
+
+	return metadata, nil
+}
+
+func newTusUploadID() (string, error) {
+	var buf [16]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf[:]), nil
+}
+
+// TusHandler implements the tus resumable upload protocol
+// (https://tus.io/protocols/resumable-upload.html). The `url` upload metadata
+// must contain the same signed relative URL which would be used for a regular
+// POST request. Once the upload is complete, the assembled body goes through
+// the regular pipeline.
+func (d *Deflator) TusHandler() http.HandlerFunc {
+	handler := corsHandler("POST, HEAD, PATCH, OPTIONS", func(w http.ResponseWriter, r *http.Request) {
+		log.Infof("Received tus %s request from %s: %s", r.Method, d.clientIP(r), r.URL)
+
+		if r.Header.Get("Tus-Resumable") != TusVersion {
+			w.Header().Set("Tus-Version", TusVersion)
+			writeError(w, r, newRequestError(http.StatusPreconditionFailed, ErrorCodePreconditionFailed, "Unsupported tus version"))
+			return
+		}
+
+		id := strings.TrimPrefix(r.URL.Path, TusPathPrefix)
+
+		switch {
+		case r.Method == http.MethodPost && id == "":
+			d.tusCreate(w, r)
+		case r.Method == http.MethodHead && id != "":
+			d.tusHead(w, r, id)
+		case r.Method == http.MethodPatch && id != "":
+			d.tusPatch(w, r, id)
+		default:
+			writeError(w, r, newRequestError(http.StatusBadRequest, ErrorCodeMethodNotAllowed, "Bad request"))
+		}
+	})
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Tus-Resumable", TusVersion)
+		w.Header().Set("Access-Control-Expose-Headers",
+			"Location, Tus-Resumable, Tus-Version, Tus-Extension, Tus-Max-Size, Upload-Offset, Upload-Length, Upload-Expires")
+
+		if r.Method == http.MethodOptions {
+			w.Header().Set("Tus-Version", TusVersion)
+			w.Header().Set("Tus-Extension", TusExtensions)
+			w.Header().Set("Tus-Max-Size", strconv.FormatInt(d.maxUploadSizeLimit(), 10))
+
+			// Clients discover the tus capabilities with OPTIONS even where CORS is disabled
+			if listenerFromContext(r.Context()).DisableCORS {
+				return
+			}
+		}
+
+		handler(w, r)
+	}
+}
+
+func (d *Deflator) tusCreate(w http.ResponseWriter, r *http.Request) {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		writeError(w, r, newRequestError(http.StatusBadRequest, ErrorCodeInvalidParameter, "Invalid Upload-Length"))
+		return
+	}
+
+	if limit := d.maxUploadSizeLimit(); length > limit {
+		log.Debugf("File too large (%d bytes)", length)
+		writeError(w, r, newRequestError(
+			http.StatusRequestEntityTooLarge, ErrorCodePayloadTooLarge,
+			"File too large (%d bytes, limit: %d bytes)", length, limit,
+		))
+		return
+	}
+
+	metadata, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		writeError(w, r, newRequestError(http.StatusBadRequest, ErrorCodeInvalidParameter, "Invalid Upload-Metadata"))
+		return
+	}
+
+	if metadata["url"] == "" {
+		writeError(w, r, newRequestError(http.StatusBadRequest, ErrorCodeMissingField, "Missing url in Upload-Metadata"))
+		return
+	}
+	destination, err := url.Parse(metadata["url"])
+	if err != nil {
+		writeError(w, r, newRequestError(http.StatusBadRequest, ErrorCodeInvalidParameter, "Invalid url in Upload-Metadata"))
+		return
+	}
+
+	// Validate the destination and transform options before accepting any data
+	location, err := d.resolveDestination(r.Context(), destination)
+	var options *requestOptions
+	if err == nil {
+		options, err = d.parseOptions(location.bucket, destination.Query(), nil)
+	}
+	if err == nil {
+		_, err = d.uploadRequestFromOptions(location, options)
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	id, err := newTusUploadID()
+	if err != nil {
+		log.Errorf("Failed to generate tus upload ID: %s", err)
+		writeError(w, r, newRequestError(http.StatusInternalServerError, ErrorCodeInternal, "Internal error").withCause(err))
+		return
+	}
+
+	upload := &tusUpload{
+		id:          id,
+		path:        filepath.Join(d.tus.dir, id),
+		length:      length,
+		expires:     d.clock.Now().Add(d.config.TusUploadExpiry),
+		contentType: metadata["content_type"],
+		location:    location,
+		options:     options,
+	}
+	if upload.contentType == "" {
+		upload.contentType = metadata["filetype"]
+	}
+
+	file, err := os.OpenFile(upload.path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Errorf("Failed to create tus upload file: %s", err)
+		writeError(w, r, newRequestError(http.StatusInternalServerError, ErrorCodeInternal, "Internal error").withCause(err))
+		return
+	}
+	file.Close()
+
+	d.tus.add(upload)
+
+	w.Header().Set("Location", TusPathPrefix+id)
+	w.Header().Set("Upload-Expires", upload.expires.Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (d *Deflator) tusHead(w http.ResponseWriter, r *http.Request, id string) {
+	upload := d.tus.get(id)
+	if upload == nil {
+		writeError(w, r, newRequestError(http.StatusNotFound, ErrorCodeNotFound, "Not found"))
+		return
+	}
+
+	upload.Lock()
+	defer upload.Unlock()
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.length, 10))
+	w.Header().Set("Upload-Expires", upload.expires.Format(http.TimeFormat))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (d *Deflator) tusPatch(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		writeError(w, r, newRequestError(http.StatusUnsupportedMediaType, ErrorCodeUnsupportedMediaType, "Invalid Content-Type"))
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		writeError(w, r, newRequestError(http.StatusBadRequest, ErrorCodeInvalidParameter, "Invalid Upload-Offset"))
+		return
+	}
+
+	upload := d.tus.get(id)
+	if upload == nil {
+		writeError(w, r, newRequestError(http.StatusNotFound, ErrorCodeNotFound, "Not found"))
+		return
+	}
+
+	// Only one PATCH request can append to an upload at any given time. The
+	// offset check happens while holding the lock, so a concurrent request
+	// which lost the race gets a conflict instead of corrupting the file.
+	// Retries of the final PATCH conflict too until it's been processed.
+	upload.Lock()
+	if upload.finalizing {
+		upload.Unlock()
+		writeError(w, r, newRequestError(http.StatusConflict, ErrorCodeUploadFinalizing, "Upload is being processed"))
+		return
+	}
+	if upload.busy || offset != upload.offset {
+		upload.Unlock()
+		writeError(w, r, newRequestError(http.StatusConflict, ErrorCodeOffsetMismatch, "Upload-Offset mismatch"))
+		return
+	}
+	if d.clock.Now().After(upload.expires) {
+		upload.Unlock()
+		writeError(w, r, newRequestError(http.StatusGone, ErrorCodeUploadExpired, "Upload expired"))
+		return
+	}
+	upload.busy = true
+	upload.Unlock()
+
+	written, err := appendToFile(upload.path, offset, io.LimitReader(r.Body, upload.length-offset))
+
+	upload.Lock()
+	upload.offset += written
+	upload.busy = false
+	complete := err == nil && upload.offset == upload.length
+	upload.finalizing = complete
+	upload.Unlock()
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset+written, 10))
+
+	if err != nil {
+		// The client can resume from the new offset
+		log.Warnf("Failed to append to tus upload %q: %s", id, err)
+		writeError(w, r, newRequestError(http.StatusInternalServerError, ErrorCodeInternal, "Internal error").withCause(err))
+		return
+	}
+
+	if !complete {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	d.tusComplete(w, r, upload)
+}
+
+// appendToFile writes the contents of body to the file at path, starting at offset
+func appendToFile(path string, offset int64, body io.Reader) (int64, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	_, err = file.Seek(offset, io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+
+	written, err := io.Copy(file, body)
+	if err != nil {
+		return written, err
+	}
+
+	return written, file.Sync()
+}
+
+// tusComplete feeds a fully received upload through the pipeline. After the
+// failures which may succeed on a retry, the upload is kept for the client
+// to PATCH it again with an empty body.
+func (d *Deflator) tusComplete(w http.ResponseWriter, r *http.Request, upload *tusUpload) {
+	result, err := d.tusProcess(r, upload)
+	if err != nil && retryableErrorCodes[errorCode(err)] {
+		log.Debugf("Keeping tus upload %q for a retry: %s", upload.id, err)
+		upload.Lock()
+		upload.finalizing = false
+		upload.Unlock()
+	} else {
+		d.tus.remove(upload)
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("X-Imgdeflator-Bucket", result.Bucket)
+	w.Header().Set("X-Imgdeflator-Key", result.Key)
+	setWarningHeader(w, result.Warnings)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// tusProcess uploads the spooled file of upload
+func (d *Deflator) tusProcess(r *http.Request, upload *tusUpload) (*uploadResult, error) {
+	req, err := d.uploadRequestFromOptions(upload.location, upload.options)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(upload.path)
+	if err != nil {
+		log.Errorf("Failed to open tus upload file %q: %s", upload.path, err)
+		return nil, newRequestError(http.StatusInternalServerError, ErrorCodeInternal, "Internal error").withCause(err)
+	}
+	defer file.Close()
+
+	req.body = file
+	req.declaredSize = upload.length
+	req.contentType = upload.contentType
+	req.clientIP = d.clientIP(r)
+	req.echo = d.echoHeaders(r.Header)
+
+	return d.upload(r.Context(), req)
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTusTestServer starts a testServer accepting tus uploads, spooled to a
+// temporary directory
+func newTusTestServer(t *testing.T) (*testServer, func()) {
+	dir, err := ioutil.TempDir("", "imgdeflator-tus-test")
+	if err != nil {
+		t.Fatalf("Failed to create the tus directory: %s", err)
+	}
+
+	s := newTestServer(t, func(config *Config) {
+		config.EnableTus = true
+		config.TusDir = dir
+	})
+	err = s.deflator.tus.prepare()
+	if err != nil {
+		t.Fatalf("Failed to prepare the tus directory: %s", err)
+	}
+
+	return s, func() {
+		s.close()
+		os.RemoveAll(dir)
+	}
+}
+
+// tusRequest sends a tus request with the headers, as name and value pairs
+func (s *testServer) tusRequest(method, path string, body io.Reader, headers ...string) *http.Response {
+	r, err := http.NewRequest(method, s.server.URL+path, body)
+	if err != nil {
+		s.t.Fatalf("Failed to create the tus request: %s", err)
+	}
+	r.Header.Set("Tus-Resumable", TusVersion)
+	for i := 0; i+1 < len(headers); i += 2 {
+		r.Header.Set(headers[i], headers[i+1])
+	}
+
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		s.t.Fatalf("Failed to send the tus %s request: %s", method, err)
+	}
+	return resp
+}
+
+// tusCreate creates an upload of length bytes to key, returning its path
+func (s *testServer) tusCreate(key string, length int) string {
+	metadata := "url " + base64.StdEncoding.EncodeToString([]byte(s.uploadPath(TestBucket, key, "width=16"))) +
+		",content_type " + base64.StdEncoding.EncodeToString([]byte("image/png"))
+	resp := s.tusRequest(http.MethodPost, TusPathPrefix, nil, "Upload-Length", strconv.Itoa(length), "Upload-Metadata", metadata)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		s.t.Fatalf("Expected the tus upload to be created, got %d", resp.StatusCode)
+	}
+	return resp.Header.Get("Location")
+}
+
+// tusPatch appends data to the upload at path, from offset
+func (s *testServer) tusPatch(path string, offset int, data []byte) *http.Response {
+	return s.tusRequest(http.MethodPatch, path, bytes.NewReader(data),
+		"Content-Type", "application/offset+octet-stream", "Upload-Offset", strconv.Itoa(offset))
+}
+
+// countPuts counts the objects written to the fakes3 server of s, calling
+// before with each of them first
+func countPuts(s *testServer, before func()) *int64 {
+	var puts int64
+	s.fake.SetFault(func(r *http.Request) int {
+		if r.Method == http.MethodPut {
+			atomic.AddInt64(&puts, 1)
+			if before != nil {
+				before()
+			}
+		}
+		return 0
+	})
+	return &puts
+}
+
+func TestTusOffsetConflict(t *testing.T) {
+	s, done := newTusTestServer(t)
+	defer done()
+
+	data := testPNG(t, 32, 32)
+	path := s.tusCreate("photo.png", len(data))
+
+	resp := s.tusPatch(path, 0, data[:100])
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent || resp.Header.Get("Upload-Offset") != "100" {
+		t.Fatalf("Expected the first chunk to be appended, got %d at offset %q", resp.StatusCode, resp.Header.Get("Upload-Offset"))
+	}
+
+	// Resending the first chunk conflicts, and so does skipping ahead
+	for _, offset := range []int{0, 200} {
+		resp := s.tusPatch(path, offset, data[offset:offset+100])
+		if code := decodeError(t, resp, http.StatusConflict).Code; code != ErrorCodeOffsetMismatch {
+			t.Errorf("Expected the %s code at offset %d, got %s", ErrorCodeOffsetMismatch, offset, code)
+		}
+	}
+
+	resp = s.tusPatch(path, 100, data[100:])
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected the upload to complete, got %d", resp.StatusCode)
+	}
+	object, ok := s.fake.Object(TestBucket, "photo.png")
+	if !ok {
+		t.Fatalf("The completed upload wasn't stored")
+	}
+	if len(object.Body) == 0 {
+		t.Errorf("The completed upload is empty")
+	}
+}
+
+func TestTusParallelPatch(t *testing.T) {
+	s, done := newTusTestServer(t)
+	defer done()
+	puts := countPuts(s, nil)
+
+	data := testPNG(t, 32, 32)
+	path := s.tusCreate("photo.png", len(data))
+
+	const clients = 8
+	responses := make(chan *http.Response, clients)
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			responses <- s.tusPatch(path, 0, data)
+		}()
+	}
+	wg.Wait()
+	close(responses)
+
+	completed := 0
+	for resp := range responses {
+		switch resp.StatusCode {
+		case http.StatusNoContent:
+			completed++
+			resp.Body.Close()
+		case http.StatusConflict:
+			code := decodeError(t, resp, http.StatusConflict).Code
+			if code != ErrorCodeOffsetMismatch && code != ErrorCodeUploadFinalizing {
+				t.Errorf("Unexpected conflict code %s", code)
+			}
+		default:
+			resp.Body.Close()
+			t.Errorf("Unexpected status %d", resp.StatusCode)
+		}
+	}
+	if completed != 1 {
+		t.Errorf("Expected exactly one PATCH to complete the upload, got %d", completed)
+	}
+	if n := atomic.LoadInt64(puts); n != 1 {
+		t.Errorf("Expected the upload to be stored once, got %d writes", n)
+	}
+}
+
+func TestTusRetriedFinalPatch(t *testing.T) {
+	s, done := newTusTestServer(t)
+	defer done()
+
+	started, release := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	puts := countPuts(s, func() {
+		once.Do(func() { close(started) })
+		<-release
+	})
+
+	data := testPNG(t, 32, 32)
+	path := s.tusCreate("photo.png", len(data))
+
+	final := make(chan *http.Response, 1)
+	go func() { final <- s.tusPatch(path, 0, data) }()
+
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("The upload never reached S3")
+	}
+
+	// The client retries the final PATCH while it's being processed
+	resp := s.tusPatch(path, len(data), nil)
+	if code := decodeError(t, resp, http.StatusConflict).Code; code != ErrorCodeUploadFinalizing {
+		t.Errorf("Expected the %s code, got %s", ErrorCodeUploadFinalizing, code)
+	}
+
+	// Nor does the finalizing upload expire
+	s.deflator.tus.collectGarbage(time.Now().Add(2 * s.deflator.config.TusUploadExpiry))
+	id := path[len(TusPathPrefix):]
+	if s.deflator.tus.get(id) == nil {
+		t.Errorf("The finalizing upload was collected")
+	}
+
+	close(release)
+	resp = <-final
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected the final PATCH to succeed, got %d", resp.StatusCode)
+	}
+	if n := atomic.LoadInt64(puts); n != 1 {
+		t.Errorf("Expected the upload to be stored once, got %d writes", n)
+	}
+	if s.deflator.tus.get(id) != nil {
+		t.Errorf("The processed upload wasn't removed")
+	}
+}
+
+func TestTusRetryAfterStorageError(t *testing.T) {
+	s, done := newTusTestServer(t)
+	defer done()
+
+	s.fake.SetFault(func(r *http.Request) int {
+		if r.Method == http.MethodPut {
+			return http.StatusInternalServerError
+		}
+		return 0
+	})
+
+	data := testPNG(t, 32, 32)
+	path := s.tusCreate("photo.png", len(data))
+
+	resp := s.tusPatch(path, 0, data)
+	response := decodeError(t, resp, http.StatusServiceUnavailable)
+	if response.Code != ErrorCodeStorageUnavailable || !response.Retryable {
+		t.Fatalf("Expected a retryable %s error, got %+v", ErrorCodeStorageUnavailable, response)
+	}
+
+	// The received data is kept for the retry
+	resp = s.tusRequest(http.MethodHead, path, nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Upload-Offset") != strconv.Itoa(len(data)) {
+		t.Fatalf("Expected the complete upload to be kept, got %d at offset %q", resp.StatusCode, resp.Header.Get("Upload-Offset"))
+	}
+
+	s.fake.SetFault(nil)
+	resp = s.tusPatch(path, len(data), nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected the retry to succeed, got %d", resp.StatusCode)
+	}
+	if _, ok := s.fake.Object(TestBucket, "photo.png"); !ok {
+		t.Errorf("The retried upload wasn't stored")
+	}
+}
+
+func TestTusErrorResponses(t *testing.T) {
+	s, done := newTusTestServer(t)
+	defer done()
+
+	tests := []struct {
+		name    string
+		method  string
+		path    string
+		headers []string
+		status  int
+		code    string
+	}{
+		{"missing length", http.MethodPost, TusPathPrefix, nil, http.StatusBadRequest, ErrorCodeInvalidParameter},
+		{"too large", http.MethodPost, TusPathPrefix, []string{"Upload-Length", "1000000000000"}, http.StatusRequestEntityTooLarge, ErrorCodePayloadTooLarge},
+		{"missing url", http.MethodPost, TusPathPrefix, []string{"Upload-Length", "10"}, http.StatusBadRequest, ErrorCodeMissingField},
+		{"unknown upload", http.MethodPatch, TusPathPrefix + "unknown", []string{"Content-Type", "application/offset+octet-stream", "Upload-Offset", "0"}, http.StatusNotFound, ErrorCodeNotFound},
+		{"content type", http.MethodPatch, TusPathPrefix + "unknown", []string{"Upload-Offset", "0"}, http.StatusUnsupportedMediaType, ErrorCodeUnsupportedMediaType},
+		{"method", http.MethodGet, TusPathPrefix + "unknown", nil, http.StatusBadRequest, ErrorCodeMethodNotAllowed},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp := s.tusRequest(test.method, test.path, nil, test.headers...)
+			if code := decodeError(t, resp, test.status).Code; code != test.code {
+				t.Errorf("Expected the %s code, got %s", test.code, code)
+			}
+		})
+	}
+}
+
+func TestTusPrepare(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imgdeflator-tus-test")
+	if err != nil {
+		t.Fatalf("Failed to create the tus directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	leftover := filepath.Join(dir, "upload")
+	store := newTusStore(dir)
+
+	// The process started by a restart leaves the uploads of its parent alone
+	err = ioutil.WriteFile(leftover, []byte("partial"), 0600)
+	if err != nil {
+		t.Fatalf("Failed to write the upload file: %s", err)
+	}
+	os.Setenv(ReadyFDEnv, "3")
+	err = store.prepare()
+	os.Unsetenv(ReadyFDEnv)
+	if err != nil {
+		t.Fatalf("Failed to prepare the tus directory: %s", err)
+	}
+	if _, err := os.Stat(leftover); err != nil {
+		t.Errorf("Expected the restarted process to keep the upload file, got %s", err)
+	}
+
+	err = store.prepare()
+	if err != nil {
+		t.Fatalf("Failed to prepare the tus directory: %s", err)
+	}
+	if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+		t.Errorf("Expected the upload file to be removed on startup, got %v", err)
+	}
+}
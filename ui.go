@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/Nitro/urlsign"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// UIPath serves the test upload page
+	UIPath = "/ui"
+	// UISignPath signs the upload and preview URLs built by the page
+	UISignPath = "/ui/sign"
+
+	// uiSignMaxBody is plenty for a JSON encoded relative URL
+	uiSignMaxBody = 16 << 10
+)
+
+var uiPage = template.Must(template.New("ui").Parse(uiPageSource))
+
+// uiPageData is what the UI page template gets rendered with
+type uiPageData struct {
+	Nonce     string
+	SignPath  string
+	EnableGet bool
+}
+
+// uiSignRequest and uiSignResponse are the bodies of the UISignPath requests
+type uiSignRequest struct {
+	URL string `json:"url"`
+}
+
+type uiSignResponse struct {
+	URL string `json:"url"`
+}
+
+// uiRoutes sets up the handlers of the test upload page, which is only
+// registered when EnableUI is set
+func (d *Deflator) uiRoutes(mux *http.ServeMux) {
+	mux.Handle(UIPath, d.ipFilterHandler(d.uiAuthHandler(d.uiHandler)))
+	mux.Handle(UISignPath, d.ipFilterHandler(d.uiAuthHandler(d.uiSignHandler)))
+}
+
+// uiAuthHandler requires the AdminToken, either as a bearer token or as the
+// password of HTTP basic auth so browsers can prompt for it
+func (d *Deflator) uiAuthHandler(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, password, ok := r.BasicAuth()
+		basicAuthorized := ok && d.config.AdminToken != "" &&
+			subtle.ConstantTimeCompare([]byte(password), []byte(d.config.AdminToken)) == 1
+
+		if !basicAuthorized && !d.isAdminAuthorized(r) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="imgdeflator"`)
+			writeError(w, r, newRequestError(http.StatusUnauthorized, ErrorCodeForbidden, "Unauthorized"))
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+// uiHandler renders the test upload page. Its scripts and styles are inline,
+// so the CSP only allows them through a nonce and the page can't load
+// anything but the upload responses and previews of this origin.
+func (d *Deflator) uiHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeError(w, r, newRequestError(http.StatusMethodNotAllowed, ErrorCodeMethodNotAllowed, "Method not allowed"))
+		return
+	}
+
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		writeError(w, r, newRequestError(http.StatusInternalServerError, ErrorCodeInternal, "Internal error").withCause(err))
+		return
+	}
+	data := uiPageData{
+		Nonce:     base64.StdEncoding.EncodeToString(nonce),
+		SignPath:  UISignPath,
+		EnableGet: d.config.EnableGet,
+	}
+
+	var page bytes.Buffer
+	if err := uiPage.Execute(&page, data); err != nil {
+		log.Warnf("Failed to render the UI page: %s", err)
+		writeError(w, r, newRequestError(http.StatusInternalServerError, ErrorCodeInternal, "Internal error").withCause(err))
+		return
+	}
+
+	header := w.Header()
+	header.Set("Content-Type", "text/html; charset=utf-8")
+	header.Set("Content-Security-Policy", "default-src 'none'; "+
+		"script-src 'nonce-"+data.Nonce+"'; style-src 'nonce-"+data.Nonce+"'; "+
+		"connect-src 'self'; img-src 'self'; "+
+		"base-uri 'none'; form-action 'none'; frame-ancestors 'none'")
+	header.Set("X-Content-Type-Options", "nosniff")
+	header.Set("X-Frame-Options", "DENY")
+	header.Set("Referrer-Policy", "no-referrer")
+	header.Set("Cache-Control", "no-store")
+	_, _ = page.WriteTo(w)
+}
+
+// uiSignHandler signs the relative upload or preview URL built by the UI
+// page, the same way the canary signs its uploads
+func (d *Deflator) uiSignHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, newRequestError(http.StatusMethodNotAllowed, ErrorCodeMethodNotAllowed, "Method not allowed"))
+		return
+	}
+
+	var req uiSignRequest
+	err := json.NewDecoder(io.LimitReader(r.Body, uiSignMaxBody)).Decode(&req)
+	if err != nil {
+		writeError(w, r, newRequestError(http.StatusBadRequest, ErrorCodeInvalidEnvelope, "Invalid JSON body: %s", err))
+		return
+	}
+	u, err := url.Parse(req.URL)
+	if err != nil || u.IsAbs() || u.Host != "" || !strings.HasPrefix(u.Path, "/") {
+		writeError(w, r, newRequestError(http.StatusBadRequest, ErrorCodeInvalidParameter, "Invalid relative URL %q", req.URL))
+		return
+	}
+
+	signed := u.String()
+	if d.config.UrlSigningSecret != "" {
+		token := urlsign.GenerateToken(d.config.UrlSigningSecret, d.config.SigningBucketSize, d.clock.Now(), signed)
+		if u.RawQuery == "" {
+			signed += "?token=" + token
+		} else {
+			signed += "&token=" + token
+		}
+	}
+	audit("ui_sign", log.Fields{"url": describePath(u.Path), "client_ip": d.clientIP(r)})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(uiSignResponse{URL: signed})
+}
@@ -0,0 +1,174 @@
+package main
+
+// uiPageSource is the template of the test upload page. It's kept in a Go
+// file rather than embedded, as the builder image predates go:embed.
+const uiPageSource = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>imgdeflator test upload</title>
+<style nonce="{{.Nonce}}">
+body { font: 14px sans-serif; margin: 2em auto; max-width: 48em; color: #222; }
+fieldset { border: 1px solid #ccc; margin-bottom: 1em; }
+label { display: inline-block; margin: 0.3em 1em 0.3em 0; }
+input[type=text], input[type=number] { width: 12em; }
+pre { background: #f4f4f4; padding: 1em; overflow: auto; white-space: pre-wrap; word-break: break-all; }
+img { max-width: 100%; border: 1px solid #ccc; }
+.error { color: #b00; }
+</style>
+</head>
+<body data-sign-path="{{.SignPath}}" data-enable-get="{{.EnableGet}}">
+<h1>imgdeflator test upload</h1>
+<form id="upload">
+<fieldset>
+<legend>Image</legend>
+<input type="file" id="file" accept="image/*" required>
+</fieldset>
+<fieldset>
+<legend>Destination</legend>
+<label>Bucket <input type="text" id="bucket" required></label>
+<label>Key <input type="text" id="key" required></label>
+</fieldset>
+<fieldset>
+<legend>Options</legend>
+<label>width <input type="number" id="width" min="1"></label>
+<label>height <input type="number" id="height" min="1"></label>
+<label>format
+<select id="format">
+<option value=""></option>
+<option>jpeg</option>
+<option>png</option>
+<option>webp</option>
+</select>
+</label>
+<label>ttl <input type="number" id="ttl" min="1"></label>
+<label>collision
+<select id="collision">
+<option value=""></option>
+<option>overwrite</option>
+<option>error</option>
+<option>suffix</option>
+</select>
+</label>
+<label><input type="checkbox" id="keep_original"> keep_original</label>
+<label>text <input type="text" id="text"></label>
+<label>Extra query <input type="text" id="extra" placeholder="redact=0,0,10,10"></label>
+</fieldset>
+<button type="submit">Upload</button>
+</form>
+<h2>Request</h2>
+<pre id="request"></pre>
+<h2>Response</h2>
+<pre id="response"></pre>
+<div id="preview"></div>
+<script nonce="{{.Nonce}}">
+(function () {
+  "use strict";
+
+  var config = document.body.dataset;
+
+  function $(id) { return document.getElementById(id); }
+
+  // The path is the base64url encoded S3 URL, whose key gets percent-decoded
+  // once by the server
+  function encodePath(bucket, key) {
+    var location = "s3://" + bucket + "/" + key.split("/").map(encodeURIComponent).join("/");
+    var bytes = new TextEncoder().encode(location);
+    var binary = "";
+    bytes.forEach(function (b) { binary += String.fromCharCode(b); });
+    return "/" + btoa(binary).replace(/\+/g, "-").replace(/\//g, "_").replace(/=+$/, "");
+  }
+
+  function sign(url) {
+    return fetch(config.signPath, {
+      method: "POST",
+      credentials: "same-origin",
+      headers: { "Content-Type": "application/json" },
+      body: JSON.stringify({ url: url })
+    }).then(function (response) {
+      return response.json().then(function (body) {
+        if (!response.ok) {
+          throw new Error(body.message || response.statusText);
+        }
+        return body.url;
+      });
+    });
+  }
+
+  function query() {
+    var params = new URLSearchParams();
+    ["width", "height", "format", "ttl", "collision", "text"].forEach(function (name) {
+      var value = $(name).value.trim();
+      if (value !== "") {
+        params.set(name, value);
+      }
+    });
+    if ($("keep_original").checked) {
+      params.set("keep_original", "true");
+    }
+    new URLSearchParams($("extra").value.trim()).forEach(function (value, name) {
+      params.append(name, value);
+    });
+    params.set("response", "json");
+    return params;
+  }
+
+  function showPreview(path) {
+    var preview = $("preview");
+    preview.textContent = "";
+    if (config.enableGet !== "true") {
+      return Promise.resolve();
+    }
+    return sign(path + "?width=320").then(function (url) {
+      var heading = document.createElement("h2");
+      heading.textContent = "Preview";
+      var img = document.createElement("img");
+      img.alt = "Preview of the stored image";
+      img.src = url;
+      preview.appendChild(heading);
+      preview.appendChild(img);
+    });
+  }
+
+  $("upload").addEventListener("submit", function (event) {
+    event.preventDefault();
+
+    var file = $("file").files[0];
+    var path = encodePath($("bucket").value.trim(), $("key").value.trim());
+    var response = $("response");
+    response.className = "";
+    response.textContent = "Uploading...";
+    $("preview").textContent = "";
+
+    sign(path + "?" + query().toString()).then(function (url) {
+      $("request").textContent = "POST " + url + "\nContent-Type: " + (file.type || "application/octet-stream");
+      return fetch(url, {
+        method: "POST",
+        credentials: "omit",
+        headers: { "Content-Type": file.type || "application/octet-stream", "Accept": "application/json" },
+        body: file
+      });
+    }).then(function (result) {
+      return result.text().then(function (text) {
+        try {
+          text = JSON.stringify(JSON.parse(text), null, 2);
+        } catch (e) {
+          // Not every response style returns JSON
+        }
+        response.textContent = result.status + " " + result.statusText + "\n\n" + text;
+        if (!result.ok) {
+          response.className = "error";
+          return;
+        }
+        return showPreview(path);
+      });
+    }).catch(function (err) {
+      response.className = "error";
+      response.textContent = String(err);
+    });
+  });
+})();
+</script>
+</body>
+</html>
+`
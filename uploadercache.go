@@ -0,0 +1,154 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/golang-lru"
+	log "github.com/sirupsen/logrus"
+)
+
+// UploaderCacheThrashWindow is the period over which the re-provisions of
+// evicted uploaders are counted to detect thrashing
+const UploaderCacheThrashWindow = time.Minute
+
+var (
+	// uploaderCacheStats counts the evictions from the uploader cache, the
+	// uploaders provisioned again after being evicted and the times the cache
+	// grew, and publishes its current size
+	uploaderCacheStats = expvar.NewMap("uploader_cache")
+
+	// uploaderCacheSize is the current size of the uploader cache
+	uploaderCacheSize = new(expvar.Int)
+
+	// uploaderCacheSizing keeps the uploader cache within its current size
+	uploaderCacheSizing = &uploaderCacheLimits{size: UploaderCacheSize, maxSize: UploaderCacheSize}
+)
+
+func init() {
+	uploaderCacheSize.Set(UploaderCacheSize)
+	uploaderCacheStats.Set("size", uploaderCacheSize)
+}
+
+// uploaderCacheLimits enforces the size of the uploader cache, which is
+// allocated with its maximum size so it can grow without being replaced.
+// Thrashing shows up as evicted buckets getting their uploader provisioned
+// again, which repeats the region lookups: past threshold re-provisions in
+// a window, the size doubles up to maxSize.
+type uploaderCacheLimits struct {
+	mu        sync.Mutex
+	size      int
+	maxSize   int
+	threshold int
+	// evicted remembers the recently evicted buckets
+	evicted      *lru.Cache
+	windowStart  time.Time
+	reprovisions int
+}
+
+// configureUploaderCache replaces the uploader cache with one of size
+// entries, which can grow up to maxSize (zero disables the growth)
+func configureUploaderCache(size, maxSize, threshold int) error {
+	if size <= 0 {
+		return fmt.Errorf("invalid uploader cache size %d", size)
+	}
+	if maxSize == 0 {
+		maxSize = size
+	}
+	if maxSize < size {
+		return fmt.Errorf("the uploader cache max size %d is below its size %d", maxSize, size)
+	}
+	if threshold < 0 {
+		return fmt.Errorf("invalid uploader cache thrash threshold %d", threshold)
+	}
+
+	// The spare entry leaves the evictions to cacheUploader, which counts them
+	cache, err := lru.New(maxSize + 1)
+	if err != nil {
+		return err
+	}
+	evicted, err := lru.New(4 * maxSize)
+	if err != nil {
+		return err
+	}
+
+	uploaderCacheSizing.mu.Lock()
+	defer uploaderCacheSizing.mu.Unlock()
+	uploaderCache = cache
+	uploaderCacheSizing.size, uploaderCacheSizing.maxSize = size, maxSize
+	uploaderCacheSizing.threshold = threshold
+	uploaderCacheSizing.evicted = evicted
+	uploaderCacheSizing.windowStart, uploaderCacheSizing.reprovisions = time.Time{}, 0
+	uploaderCacheSize.Set(int64(size))
+	return nil
+}
+
+// cacheUploader adds the entry of bucket to the uploader cache, unless
+// another goroutine cached one in the mean time, then evicts the least
+// recently used entries above the current size
+func cacheUploader(bucket string, entry *uploaderCacheEntry) {
+	c := uploaderCacheSizing
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if ok, _ := uploaderCache.ContainsOrAdd(bucket, entry); ok {
+		return
+	}
+	if c.evicted != nil && c.evicted.Contains(bucket) {
+		c.evicted.Remove(bucket)
+		c.recordReprovision()
+	}
+
+	for uploaderCache.Len() > c.size {
+		keys := uploaderCache.Keys()
+		if len(keys) == 0 {
+			break
+		}
+		// Keys lists the entries from the least recently used
+		uploaderCache.Remove(keys[0])
+		uploaderCacheStats.Add("evictions", 1)
+		if c.evicted != nil {
+			c.evicted.Add(keys[0], true)
+		}
+	}
+}
+
+// recordReprovision counts a re-provisioned uploader, growing the cache when
+// they exceed the threshold. The warning is logged once per window.
+func (c *uploaderCacheLimits) recordReprovision() {
+	uploaderCacheStats.Add("reprovisions", 1)
+	if c.threshold == 0 {
+		return
+	}
+
+	now := time.Now()
+	if now.Sub(c.windowStart) > UploaderCacheThrashWindow {
+		c.windowStart, c.reprovisions = now, 0
+	}
+	c.reprovisions++
+	if c.reprovisions != c.threshold {
+		return
+	}
+
+	if c.size >= c.maxSize {
+		log.Warnf(
+			"The uploader cache is thrashing (%d evicted uploaders provisioned again in %s): IMGDEFLATOR_UPLOADER_CACHE_SIZE (%d) is too small",
+			c.reprovisions, UploaderCacheThrashWindow, c.size,
+		)
+		return
+	}
+
+	size := 2 * c.size
+	if size > c.maxSize {
+		size = c.maxSize
+	}
+	log.Warnf(
+		"The uploader cache is thrashing (%d evicted uploaders provisioned again in %s), growing it from %d to %d entries",
+		c.reprovisions, UploaderCacheThrashWindow, c.size, size,
+	)
+	c.size = size
+	uploaderCacheSize.Set(int64(size))
+	uploaderCacheStats.Add("growths", 1)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+// thrashCache provisions the uploaders of buckets, twice in a row
+func thrashCache(buckets int) {
+	for pass := 0; pass < 2; pass++ {
+		for i := 0; i < buckets; i++ {
+			bucket := fmt.Sprintf("bucket-%d", i)
+			if _, ok := uploaderCache.Get(bucket); !ok {
+				cacheUploader(bucket, &uploaderCacheEntry{region: "us-east-1"})
+			}
+		}
+	}
+}
+
+// uploaderCacheCount returns the uploader cache counter name
+func uploaderCacheCount(name string) int64 {
+	count, ok := uploaderCacheStats.Get(name).(*expvar.Int)
+	if !ok {
+		return 0
+	}
+	return count.Value()
+}
+
+// thrashWarnings returns the thrash warnings logged to hook
+func thrashWarnings(hook *test.Hook) []string {
+	var warnings []string
+	for _, entry := range hook.AllEntries() {
+		if entry.Level == log.WarnLevel && strings.Contains(entry.Message, "thrashing") {
+			warnings = append(warnings, entry.Message)
+		}
+	}
+	return warnings
+}
+
+func TestUploaderCacheThrash(t *testing.T) {
+	hook := test.NewLocal(log.StandardLogger())
+	defer log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+
+	err := configureUploaderCache(25, 25, 10)
+	if err != nil {
+		t.Fatalf("Failed to configure the uploader cache: %s", err)
+	}
+	evictions, reprovisions := uploaderCacheCount("evictions"), uploaderCacheCount("reprovisions")
+
+	thrashCache(50)
+
+	// The first pass evicts 25 uploaders, the second one all 50 of them
+	if n := uploaderCacheCount("evictions") - evictions; n != 75 {
+		t.Errorf("Expected 75 evictions, got %d", n)
+	}
+	if n := uploaderCacheCount("reprovisions") - reprovisions; n != 50 {
+		t.Errorf("Expected 50 re-provisions, got %d", n)
+	}
+	if uploaderCache.Len() != 25 {
+		t.Errorf("Expected the cache to hold 25 uploaders, got %d", uploaderCache.Len())
+	}
+
+	warnings := thrashWarnings(hook)
+	if len(warnings) != 1 {
+		t.Fatalf("Expected one thrash warning per window, got %q", warnings)
+	}
+	if !strings.Contains(warnings[0], "IMGDEFLATOR_UPLOADER_CACHE_SIZE (25) is too small") {
+		t.Errorf("Expected the warning to suggest a bigger cache, got %q", warnings[0])
+	}
+}
+
+func TestUploaderCacheGrowth(t *testing.T) {
+	hook := test.NewLocal(log.StandardLogger())
+	defer log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+
+	err := configureUploaderCache(25, 100, 10)
+	if err != nil {
+		t.Fatalf("Failed to configure the uploader cache: %s", err)
+	}
+	growths, reprovisions := uploaderCacheCount("growths"), uploaderCacheCount("reprovisions")
+
+	thrashCache(50)
+
+	// The cache doubles on the 10th re-provision, making room for all of them
+	if n := uploaderCacheCount("growths") - growths; n != 1 {
+		t.Errorf("Expected the cache to grow once, got %d", n)
+	}
+	if uploaderCacheSize.Value() != 50 {
+		t.Errorf("Expected the cache to grow to 50 entries, got %d", uploaderCacheSize.Value())
+	}
+	if n := uploaderCacheCount("reprovisions") - reprovisions; n >= 50 {
+		t.Errorf("Expected the growth to stop the re-provisions, got %d", n)
+	}
+
+	thrashCache(50)
+	if uploaderCache.Len() != 50 {
+		t.Errorf("Expected the cache to hold the 50 uploaders, got %d", uploaderCache.Len())
+	}
+
+	warnings := thrashWarnings(hook)
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "growing it from 25 to 50 entries") {
+		t.Errorf("Expected a warning about the growth, got %q", warnings)
+	}
+}
+
+func TestConfigureUploaderCache(t *testing.T) {
+	tests := []struct {
+		size, maxSize, threshold int
+	}{
+		{0, 0, 10},
+		{-1, 0, 10},
+		{25, 10, 10},
+		{25, 50, -1},
+	}
+
+	for _, test := range tests {
+		err := configureUploaderCache(test.size, test.maxSize, test.threshold)
+		if err == nil {
+			t.Errorf("Expected size %d, max size %d and threshold %d to be rejected", test.size, test.maxSize, test.threshold)
+		}
+	}
+}
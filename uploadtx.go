@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/s3manager"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Roles of the objects stored by an upload
+	ObjectRoleProcessed = "processed"
+	ObjectRoleOriginal  = "original"
+	ObjectRoleSibling   = "sibling"
+	ObjectRoleReplica   = "replica"
+
+	// UploadCleanupAttempts bounds the deletions of each object of a failed
+	// upload, retried after an exponential backoff
+	UploadCleanupAttempts  = 3
+	UploadCleanupBaseDelay = 200 * time.Millisecond
+)
+
+// uploadCleanups counts the outcomes of the deletions of the objects of the
+// failed uploads
+var uploadCleanups = expvar.NewMap("upload_cleanups")
+
+// storedObject is an object written by an upload
+type storedObject struct {
+	Role   string `json:"role"`
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+	// Error is why an orphaned object couldn't be deleted
+	Error string `json:"error,omitempty"`
+
+	uploader *s3manager.Uploader
+}
+
+// cleanupReport tells the clients of a failed upload which of its objects
+// got deleted, and which ones were left behind
+type cleanupReport struct {
+	Deleted  []storedObject `json:"deleted"`
+	Orphaned []storedObject `json:"orphaned"`
+}
+
+// cleanupDetail is the detail of the errors of the uploads which stored
+// objects before failing
+type cleanupDetail struct {
+	Cleanup *cleanupReport `json:"cleanup"`
+}
+
+// uploadTransaction records the objects stored by an upload, so they all get
+// deleted if it fails. The objects uploaded concurrently are only recorded
+// once they're all done, in a fixed order: the processed object, its
+// original, its siblings and its replicas. The transaction isn't safe for
+// concurrent use.
+type uploadTransaction struct {
+	objects []storedObject
+}
+
+// record adds an object stored with uploader to the transaction
+func (tx *uploadTransaction) record(uploader *s3manager.Uploader, role, bucket, key string) {
+	tx.objects = append(tx.objects, storedObject{Role: role, Bucket: bucket, Key: key, uploader: uploader})
+}
+
+// rollback deletes the objects of tx, the last stored first, and forgets
+// them. It returns nil if there were none. The deletions get their own
+// UploadTimeout, since the upload often fails because its context expired.
+func (d *Deflator) rollback(tx *uploadTransaction) *cleanupReport {
+	if len(tx.objects) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), d.config.UploadTimeout)
+	defer cancel()
+
+	report := &cleanupReport{Deleted: []storedObject{}, Orphaned: []storedObject{}}
+	for i := len(tx.objects) - 1; i >= 0; i-- {
+		object := tx.objects[i]
+		location := (&s3Location{bucket: object.Bucket, key: object.Key}).logString()
+		err := deleteStoredObject(ctx, object)
+		if err == nil {
+			uploadCleanups.Add("deleted", 1)
+			log.Debugf("Cleaned up the %s object %q", object.Role, location)
+			report.Deleted = append(report.Deleted, object)
+			continue
+		}
+
+		uploadCleanups.Add("orphaned", 1)
+		log.Errorf("Failed to clean up the %s object %q, leaving it orphaned: %s", object.Role, location, err)
+		audit("upload_orphaned", log.Fields{
+			"bucket": object.Bucket,
+			"key":    object.Key,
+			"role":   object.Role,
+			"error":  err.Error(),
+		})
+		object.Error = err.Error()
+		report.Orphaned = append(report.Orphaned, object)
+	}
+	tx.objects = nil
+	return report
+}
+
+// deleteStoredObject deletes object, retrying up to UploadCleanupAttempts
+// times. The deletions S3 denies, without the s3:DeleteObject permission, are
+// never retried.
+func deleteStoredObject(ctx context.Context, object storedObject) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = deleteObject(ctx, object.uploader, object.Bucket, object.Key)
+		if err == nil || isAccessDeniedError(err) || attempt == UploadCleanupAttempts {
+			return err
+		}
+
+		uploadCleanups.Add("retries", 1)
+		log.Warnf("Failed to clean up %q (attempt %d): %s", (&s3Location{bucket: object.Bucket, key: object.Key}).logString(), attempt, err)
+		select {
+		case <-time.After(UploadCleanupBaseDelay << uint(attempt-1)):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// abortUpload rolls back tx for an upload failing with err, and returns err
+// with the cleanup report as its detail
+func (d *Deflator) abortUpload(tx *uploadTransaction, err error) error {
+	report := d.rollback(tx)
+	if report == nil {
+		return err
+	}
+	if rerr, ok := err.(*requestError); ok && rerr.detail == nil {
+		rerr.detail = &cleanupDetail{Cleanup: report}
+	}
+	return err
+}
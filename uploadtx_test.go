@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+const (
+	replicaBucketA = "replica-a"
+	replicaBucketB = "replica-b"
+)
+
+// newRollbackTestServer starts a testServer whose uploads store 4 objects: the
+// processed one, its original and its replicas in 2 required buckets
+func newRollbackTestServer(t *testing.T) *testServer {
+	s := newTestServer(t, nil)
+	s.fake.CreateBucket(replicaBucketA, "")
+	s.fake.CreateBucket(replicaBucketB, "")
+	s.deflator.buckets = map[string]*BucketConfig{
+		TestBucket: {
+			ExpiryMechanism:   ExpiryMechanismTag,
+			ReplicationPolicy: ReplicationPolicyRequired,
+			Collision:         CollisionOverwrite,
+			Replicas:          []string{replicaBucketA, replicaBucketB},
+		},
+	}
+	return s
+}
+
+// s3Faults fails the requests to /bucket/key with the given methods and
+// statuses, counting them by method and path
+type s3Faults struct {
+	sync.Mutex
+	statuses map[string]int
+	counts   map[string]int
+}
+
+func newS3Faults(s *testServer, statuses map[string]int) *s3Faults {
+	faults := &s3Faults{statuses: statuses, counts: make(map[string]int)}
+	s.fake.SetFault(func(r *http.Request) int {
+		request := r.Method + " " + r.URL.Path
+		faults.Lock()
+		defer faults.Unlock()
+		faults.counts[request]++
+		return faults.statuses[request]
+	})
+	return faults
+}
+
+func (f *s3Faults) count(request string) int {
+	f.Lock()
+	defer f.Unlock()
+	return f.counts[request]
+}
+
+// decodeCleanup decodes the cleanup report of an error response
+func decodeCleanup(t *testing.T, response *errorResponse) *cleanupReport {
+	raw, err := json.Marshal(response.Detail)
+	if err != nil {
+		t.Fatalf("Failed to encode the detail: %s", err)
+	}
+	var detail cleanupDetail
+	err = json.Unmarshal(raw, &detail)
+	if err != nil || detail.Cleanup == nil {
+		t.Fatalf("Expected a cleanup report, got %s", raw)
+	}
+	return detail.Cleanup
+}
+
+func TestUploadRollback(t *testing.T) {
+	processed := storedObject{Role: ObjectRoleProcessed, Bucket: TestBucket, Key: "photo.png"}
+	original := storedObject{Role: ObjectRoleOriginal, Bucket: TestBucket, Key: "photo.png.orig"}
+	replicaA := storedObject{Role: ObjectRoleReplica, Bucket: replicaBucketA, Key: "photo.png"}
+	replicaB := storedObject{Role: ObjectRoleReplica, Bucket: replicaBucketB, Key: "photo.png"}
+
+	tests := []struct {
+		name string
+		// failing is the upload which fails
+		failing string
+		// deleted are the objects stored before, the last stored first
+		deleted []storedObject
+	}{
+		{"first", "PUT /" + TestBucket + "/photo.png.orig", []storedObject{processed}},
+		{"middle", "PUT /" + replicaBucketA + "/photo.png", []storedObject{replicaB, original, processed}},
+		{"last", "PUT /" + replicaBucketB + "/photo.png", []storedObject{replicaA, original, processed}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newRollbackTestServer(t)
+			defer s.close()
+			newS3Faults(s, map[string]int{test.failing: http.StatusForbidden})
+
+			resp := s.post("photo.png", "width=16&keep_original=1", bytes.NewReader(testPNG(t, 32, 32)))
+			response := decodeError(t, resp, http.StatusServiceUnavailable)
+			if response.Code != ErrorCodeStorageUnavailable {
+				t.Errorf("Expected the %s code, got %s", ErrorCodeStorageUnavailable, response.Code)
+			}
+			report := decodeCleanup(t, response)
+			if !reflect.DeepEqual(report.Deleted, test.deleted) || len(report.Orphaned) != 0 {
+				t.Errorf("Expected %+v to be deleted, got %+v and the orphans %+v", test.deleted, report.Deleted, report.Orphaned)
+			}
+
+			for _, bucket := range []string{TestBucket, replicaBucketA, replicaBucketB} {
+				if keys := s.fake.Keys(bucket); len(keys) != 0 {
+					t.Errorf("Expected nothing to be left in %s, got %q", bucket, keys)
+				}
+			}
+		})
+	}
+}
+
+func TestUploadRollbackOrphans(t *testing.T) {
+	s := newRollbackTestServer(t)
+	defer s.close()
+	// Without s3:DeleteObject on the destination bucket
+	faults := newS3Faults(s, map[string]int{
+		"PUT /" + replicaBucketB + "/photo.png":     http.StatusForbidden,
+		"DELETE /" + TestBucket + "/photo.png":      http.StatusForbidden,
+		"DELETE /" + TestBucket + "/photo.png.orig": http.StatusForbidden,
+	})
+
+	resp := s.post("photo.png", "width=16&keep_original=1", bytes.NewReader(testPNG(t, 32, 32)))
+	report := decodeCleanup(t, decodeError(t, resp, http.StatusServiceUnavailable))
+
+	expected := []storedObject{{Role: ObjectRoleReplica, Bucket: replicaBucketA, Key: "photo.png"}}
+	if !reflect.DeepEqual(report.Deleted, expected) {
+		t.Errorf("Expected %+v to be deleted, got %+v", expected, report.Deleted)
+	}
+	if len(report.Orphaned) != 2 {
+		t.Fatalf("Expected 2 orphans, got %+v", report.Orphaned)
+	}
+	for i, key := range []string{"photo.png.orig", "photo.png"} {
+		orphan := report.Orphaned[i]
+		if orphan.Bucket != TestBucket || orphan.Key != key || orphan.Error == "" {
+			t.Errorf("Expected %s to be orphaned with its error, got %+v", key, orphan)
+		}
+		if _, ok := s.fake.Object(TestBucket, key); !ok {
+			t.Errorf("Expected the orphan %s to be left", key)
+		}
+		// The denied deletions aren't retried
+		if n := faults.count("DELETE /" + TestBucket + "/" + key); n != 1 {
+			t.Errorf("Expected 1 deletion of %s, got %d", key, n)
+		}
+	}
+}
+
+func TestUploadRollbackRetries(t *testing.T) {
+	s := newRollbackTestServer(t)
+	defer s.close()
+	faults := newS3Faults(s, map[string]int{
+		"PUT /" + TestBucket + "/photo.png.orig": http.StatusForbidden,
+		"DELETE /" + TestBucket + "/photo.png":   http.StatusInternalServerError,
+	})
+
+	resp := s.post("photo.png", "width=16&keep_original=1", bytes.NewReader(testPNG(t, 32, 32)))
+	report := decodeCleanup(t, decodeError(t, resp, http.StatusServiceUnavailable))
+	if len(report.Deleted) != 0 || len(report.Orphaned) != 1 || report.Orphaned[0].Key != "photo.png" {
+		t.Errorf("Expected the processed object to be orphaned, got %+v and the orphans %+v", report.Deleted, report.Orphaned)
+	}
+	// Each attempt can be retried by the SDK too
+	if n := faults.count("DELETE /" + TestBucket + "/photo.png"); n < UploadCleanupAttempts {
+		t.Errorf("Expected %d attempts at least, got %d", UploadCleanupAttempts, n)
+	}
+}
+
+func TestUploadWithoutRollback(t *testing.T) {
+	s := newRollbackTestServer(t)
+	defer s.close()
+	newS3Faults(s, map[string]int{"PUT /" + TestBucket + "/photo.png": http.StatusInternalServerError})
+
+	// Nothing else got stored, so there's nothing to report
+	resp := s.post("photo.png", "width=16", bytes.NewReader(testPNG(t, 32, 32)))
+	if response := decodeError(t, resp, http.StatusServiceUnavailable); response.Detail != nil {
+		t.Errorf("Expected no cleanup report, got %+v", response.Detail)
+	}
+}
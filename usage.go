@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"hash/fnv"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/s3manager"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// AdminUsagePath is the admin endpoint for the upload accounting
+	AdminUsagePath = "/admin/usage"
+	// UsageShards is the number of independently locked counter maps
+	UsageShards = 16
+	// DefaultPrincipal accounts for uploads received on listeners without a
+	// principal, and through gRPC
+	DefaultPrincipal = "default"
+)
+
+var (
+	// usageUploads and usageBytes count the successful uploads and the stored
+	// bytes by `<bucket>/<principal>`, for chargeback
+	usageUploads = newBucketMap("usage_uploads")
+	usageBytes   = newBucketMap("usage_bytes")
+)
+
+// usageKey identifies a usage rollup. The day is in UTC.
+type usageKey struct {
+	bucket    string
+	principal string
+	day       string
+}
+
+type usageCounter struct {
+	uploads int64
+	bytes   int64
+}
+
+type usageShard struct {
+	sync.RWMutex
+	counters map[usageKey]*usageCounter
+}
+
+// usageRollup is the total of one usageKey, as reported by the admin API and
+// flushed to the report bucket
+type usageRollup struct {
+	Bucket    string `json:"bucket"`
+	Principal string `json:"principal"`
+	Day       string `json:"day"`
+	Uploads   int64  `json:"uploads"`
+	Bytes     int64  `json:"bytes"`
+}
+
+// usageAccounting aggregates the successful uploads in memory. The counters
+// are sharded, and only get locked exclusively when a new key shows up, so
+// the upload path never waits for a flush.
+type usageAccounting struct {
+	shards [UsageShards]usageShard
+}
+
+func newUsageAccounting() *usageAccounting {
+	usage := &usageAccounting{}
+	for i := range usage.shards {
+		usage.shards[i].counters = make(map[usageKey]*usageCounter)
+	}
+	return usage
+}
+
+func (u *usageAccounting) shard(key usageKey) *usageShard {
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(key.bucket + "\x00" + key.principal))
+	return &u.shards[hash.Sum32()%UsageShards]
+}
+
+// record accounts for an upload of size bytes
+func (u *usageAccounting) record(bucket, principal string, at time.Time, size int) {
+	key := usageKey{bucket: bucket, principal: principal, day: at.UTC().Format("2006-01-02")}
+	shard := u.shard(key)
+
+	// The shard stays locked while counting, so a flush can't take the
+	// counter in between
+	shard.RLock()
+	counter, ok := shard.counters[key]
+	if ok {
+		atomic.AddInt64(&counter.uploads, 1)
+		atomic.AddInt64(&counter.bytes, int64(size))
+	}
+	shard.RUnlock()
+	if !ok {
+		shard.Lock()
+		counter, ok = shard.counters[key]
+		if !ok {
+			counter = &usageCounter{}
+			shard.counters[key] = counter
+		}
+		counter.uploads++
+		counter.bytes += int64(size)
+		shard.Unlock()
+	}
+
+	usageUploads.add("", bucket, "/"+principal, 1)
+	usageBytes.add("", bucket, "/"+principal, int64(size))
+}
+
+// rollups returns the totals sorted by day, bucket and principal. With take
+// set, the days before until get removed from the counters.
+func (u *usageAccounting) rollups(until string, take bool) []usageRollup {
+	rollups := []usageRollup{}
+	for i := range u.shards {
+		shard := &u.shards[i]
+		if take {
+			shard.Lock()
+		} else {
+			shard.RLock()
+		}
+
+		for key, counter := range shard.counters {
+			if until != "" && key.day >= until {
+				continue
+			}
+			rollups = append(rollups, usageRollup{
+				Bucket:    key.bucket,
+				Principal: key.principal,
+				Day:       key.day,
+				Uploads:   atomic.LoadInt64(&counter.uploads),
+				Bytes:     atomic.LoadInt64(&counter.bytes),
+			})
+			if take {
+				delete(shard.counters, key)
+			}
+		}
+
+		if take {
+			shard.Unlock()
+		} else {
+			shard.RUnlock()
+		}
+	}
+
+	sort.Slice(rollups, func(i, j int) bool {
+		a, b := rollups[i], rollups[j]
+		if a.Day != b.Day {
+			return a.Day < b.Day
+		}
+		if a.Bucket != b.Bucket {
+			return a.Bucket < b.Bucket
+		}
+		return a.Principal < b.Principal
+	})
+
+	return rollups
+}
+
+// restore adds rollups which failed to get flushed back to the counters
+func (u *usageAccounting) restore(rollups []usageRollup) {
+	for _, rollup := range rollups {
+		key := usageKey{bucket: rollup.Bucket, principal: rollup.Principal, day: rollup.Day}
+		shard := u.shard(key)
+
+		shard.Lock()
+		counter, ok := shard.counters[key]
+		if !ok {
+			counter = &usageCounter{}
+			shard.counters[key] = counter
+		}
+		counter.uploads += rollup.Uploads
+		counter.bytes += rollup.Bytes
+		shard.Unlock()
+	}
+}
+
+// principal identifies who the uploads received on the listener get billed to
+func (c *ListenerConfig) principal() string {
+	if c.Principal == "" {
+		return DefaultPrincipal
+	}
+	return c.Principal
+}
+
+// usageHandler reports the rollups which haven't been flushed yet, optionally
+// only for the `day` query parameter
+func (d *Deflator) usageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, newRequestError(http.StatusMethodNotAllowed, ErrorCodeMethodNotAllowed, "Method not allowed"))
+		return
+	}
+
+	rollups := d.usage.rollups("", false)
+	if day := r.URL.Query().Get("day"); day != "" {
+		filtered := []usageRollup{}
+		for _, rollup := range rollups {
+			if rollup.Day == day {
+				filtered = append(filtered, rollup)
+			}
+		}
+		rollups = filtered
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(rollups)
+}
+
+// flushUsage uploads the rollups of the days before until (all of them if
+// until is empty) to the UsageReportBucket, as one JSON object per day and
+// instance. The rollups are kept for the next flush if the upload fails.
+func (d *Deflator) flushUsage(ctx context.Context, until string) {
+	if d.config.UsageReportBucket == "" {
+		return
+	}
+
+	rollups := d.usage.rollups(until, true)
+	if len(rollups) == 0 {
+		return
+	}
+
+	byDay := make(map[string][]usageRollup)
+	for _, rollup := range rollups {
+		byDay[rollup.Day] = append(byDay[rollup.Day], rollup)
+	}
+
+	bucket := d.config.UsageReportBucket
+	uploader, err := getS3Uploader(ctx, bucket, "", d.config.DefaultS3Region, d.endpointOptions(bucket))
+	if err != nil {
+		log.Errorf("Failed to flush the usage rollups to %q: %s", bucket, err)
+		d.usage.restore(rollups)
+		return
+	}
+
+	// Instances flush their own rollups, possibly several times a day when
+	// they get restarted, so the report for a day is the sum of its objects
+	hostname, _ := os.Hostname()
+	suffix := hostname + "-" + strconv.FormatInt(d.clock.Now().Unix(), 10) + ".json"
+
+	for day, dayRollups := range byDay {
+		body, err := json.Marshal(dayRollups)
+		if err == nil {
+			_, err = uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+				Bucket:      aws.String(bucket),
+				Key:         aws.String(d.config.UsageReportPrefix + day + "/" + suffix),
+				ContentType: aws.String("application/json"),
+				Body:        bytes.NewReader(body),
+			})
+		}
+		if err != nil {
+			log.Errorf("Failed to flush the usage rollups of %s to %q: %s", day, bucket, err)
+			d.usage.restore(dayRollups)
+			continue
+		}
+		log.Infof("Flushed %d usage rollups of %s to %q", len(dayRollups), day, bucket)
+	}
+}
+
+// RunUsageFlush flushes the rollups of the previous days after every midnight
+// (UTC), until ctx is cancelled. The current day gets flushed on shutdown.
+func (d *Deflator) RunUsageFlush(ctx context.Context) {
+	for {
+		now := d.clock.Now().UTC()
+		midnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+		timer := time.NewTimer(midnight.Sub(now))
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		flushCtx, cancel := context.WithTimeout(ctx, d.config.UploadTimeout)
+		d.flushUsage(flushCtx, d.clock.Now().UTC().Format("2006-01-02"))
+		cancel()
+	}
+}
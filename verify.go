@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"expvar"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/s3manager"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// uploadVerifications counts the outcomes of the post-upload
+	// verifications and their accumulated duration
+	uploadVerifications = expvar.NewMap("upload_verifications")
+)
+
+// storedObjectMismatch describes how a stored object differs from what was
+// uploaded, or returns an empty string if it doesn't. The ETag is only
+// compared for single part uploads, without SSE-KMS, where it's the MD5 of
+// the payload.
+func storedObjectMismatch(head *s3.HeadObjectOutput, payload []byte, partSize int64) string {
+	if size := aws.Int64Value(head.ContentLength); size != int64(len(payload)) {
+		return fmt.Sprintf("stored %d bytes instead of %d", size, len(payload))
+	}
+	if int64(len(payload)) >= partSize || head.ServerSideEncryption == s3.ServerSideEncryptionAwsKms {
+		return ""
+	}
+
+	hash := md5.Sum(payload)
+	expected := hex.EncodeToString(hash[:])
+	if etag := strings.Trim(aws.StringValue(head.ETag), `"`); etag != "" && etag != expected {
+		return fmt.Sprintf("stored ETag %s instead of %s", etag, expected)
+	}
+	return ""
+}
+
+// checkStoredObject compares the object stored by input with payload
+func checkStoredObject(ctx context.Context, uploader *s3manager.Uploader, input *s3manager.UploadInput, payload []byte) (string, error) {
+	head, err := headObject(ctx, uploader, aws.StringValue(input.Bucket), aws.StringValue(input.Key))
+	if err != nil {
+		if isNotFoundError(err) {
+			return "object not found", nil
+		}
+		return "", err
+	}
+	return storedObjectMismatch(head, payload, uploader.PartSize), nil
+}
+
+// verifyUpload checks that the object stored for req matches payload. A
+// mismatching object gets deleted and uploaded once more, and if it still
+// doesn't match the upload fails with storage_verification_failed. The
+// verification is a stage of its own, so its latency shows up separately.
+func (d *Deflator) verifyUpload(ctx context.Context, req *uploadRequest, uploader *s3manager.Uploader, input *s3manager.UploadInput, payload []byte, options []func(*s3manager.Uploader)) error {
+	req.progress.setStage(StageVerify)
+	start := time.Now()
+	defer func() { uploadVerifications.Add("duration_ms", int64(time.Since(start)/time.Millisecond)) }()
+
+	location := (&s3Location{bucket: aws.StringValue(input.Bucket), key: aws.StringValue(input.Key)}).logString()
+	for attempt := 1; ; attempt++ {
+		mismatch, err := checkStoredObject(ctx, uploader, input, payload)
+		if err != nil {
+			uploadVerifications.Add("errors", 1)
+			log.Warnf("Failed to verify %q: %s", location, err)
+			return newRequestError(http.StatusBadGateway, ErrorCodeStorageVerificationFailed, "Failed to verify the stored object").withCause(err)
+		}
+		if mismatch == "" {
+			uploadVerifications.Add("ok", 1)
+			return nil
+		}
+
+		uploadVerifications.Add("mismatches", 1)
+		log.Warnf("The object stored at %q doesn't match the upload (attempt %d): %s", location, attempt, mismatch)
+		cleanupObject(ctx, uploader, aws.StringValue(input.Bucket), aws.StringValue(input.Key))
+		if attempt == 2 {
+			uploadVerifications.Add("failures", 1)
+			return newRequestError(http.StatusBadGateway, ErrorCodeStorageVerificationFailed, "The stored object doesn't match the upload")
+		}
+
+		release, err := d.concurrency.acquire(ctx, req.bucket)
+		if err != nil {
+			return err
+		}
+		input.Body = req.progress.countUpload(bytes.NewReader(payload))
+		_, err = uploader.UploadWithContext(ctx, input, options...)
+		release(err)
+		invalidateHeadCache(aws.StringValue(input.Bucket), aws.StringValue(input.Key))
+		if err != nil {
+			uploadVerifications.Add("failures", 1)
+			log.Warnf("Failed to upload %q again: %s", location, err)
+			return newRequestError(http.StatusBadGateway, ErrorCodeStorageVerificationFailed, "Failed to upload the object again").withCause(err)
+		}
+		uploadVerifications.Add("retries", 1)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// knownBuckets returns the buckets listed in the allowed destinations and
+// the bucket config
+func (d *Deflator) knownBuckets() map[string]bool {
+	known := make(map[string]bool)
+	for bucket := range d.allowedBuckets() {
+		known[bucket] = true
+	}
+	for bucket := range d.buckets {
+		if bucket != DefaultBucketConfigName {
+			known[bucket] = true
+		}
+	}
+
+	return known
+}
+
+// warmupBuckets returns the sorted buckets to provision at startup: the
+// WarmupBuckets, or the known buckets if none are configured. The known
+// buckets using Transfer Acceleration are always included, so the ones where
+// it's not enabled fall back to the regional endpoint at startup rather than
+// with the first request.
+func (d *Deflator) warmupBuckets() []string {
+	known := d.knownBuckets()
+
+	selected := make(map[string]bool)
+	if len(d.config.WarmupBuckets) > 0 {
+		for _, bucket := range d.config.WarmupBuckets {
+			selected[bucket] = true
+		}
+	} else {
+		selected = known
+	}
+
+	for bucket := range known {
+		if d.endpointOptions(bucket).accelerate {
+			selected[bucket] = true
+		}
+	}
+
+	buckets := make([]string, 0, len(selected))
+	for bucket := range selected {
+		buckets = append(buckets, bucket)
+	}
+	sort.Strings(buckets)
+
+	return buckets
+}
+
+// resizeUploaderCache makes room in the uploaderCache for all the known
+// buckets, so the warm entries don't get evicted straight away. It must be
+// called before any uploader is provisioned.
+func (d *Deflator) resizeUploaderCache() error {
+	size := len(d.knownBuckets())
+	if len(d.config.WarmupBuckets) > size {
+		size = len(d.config.WarmupBuckets)
+	}
+	if size <= d.config.UploaderCacheSize {
+		return nil
+	}
+
+	maxSize := d.config.UploaderCacheMaxSize
+	if maxSize < size {
+		maxSize = size
+	}
+	return configureUploaderCache(size, maxSize, d.config.UploaderCacheThrash)
+}
+
+// warmUploaders provisions the uploaders of the warm-up buckets concurrently
+// within WarmupTimeout, so the first requests after a deploy don't pay for
+// loading the AWS config and looking up the bucket regions. It returns an
+// error if some failed and WarmupStrict is set.
+func (d *Deflator) warmUploaders(ctx context.Context) error {
+	buckets := d.warmupBuckets()
+	if len(buckets) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, d.config.WarmupTimeout)
+	defer cancel()
+
+	concurrency := d.config.WarmupConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	sem := make(chan struct{}, concurrency)
+
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		failed []string
+	)
+	start := time.Now()
+	for _, bucket := range buckets {
+		wg.Add(1)
+		go func(bucket string) {
+			defer wg.Done()
+
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+				log.Warnf("Skipped warming up the uploader for bucket %q: %s", bucket, ctx.Err())
+				mu.Lock()
+				failed = append(failed, bucket)
+				mu.Unlock()
+				return
+			}
+
+			bucketStart := time.Now()
+			_, err := getS3Uploader(ctx, bucket, "", d.config.DefaultS3Region, d.endpointOptions(bucket))
+			if err != nil {
+				log.Warnf("Failed to warm up the uploader for bucket %q: %s", bucket, err)
+				mu.Lock()
+				failed = append(failed, bucket)
+				mu.Unlock()
+				return
+			}
+			log.Infof("Warmed up the uploader for bucket %q in %s", bucket, time.Since(bucketStart))
+		}(bucket)
+	}
+	wg.Wait()
+
+	log.Infof("Warmed up %d of %d uploaders in %s", len(buckets)-len(failed), len(buckets), time.Since(start))
+
+	if len(failed) > 0 && d.config.WarmupStrict {
+		sort.Strings(failed)
+		return fmt.Errorf("failed to warm up the uploaders for buckets %v", failed)
+	}
+
+	return nil
+}
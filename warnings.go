@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const (
+	// WarningHeader lists the warnings of successful uploads
+	WarningHeader = "X-Imgdeflator-Warning"
+
+	// WarningApproachingSizeLimit flags uploads above the soft size limit
+	WarningApproachingSizeLimit = "approaching_size_limit"
+	// WarningEchoTooLarge flags echo uploads whose processed image is above
+	// EchoMaxSize, which get the JSON result instead
+	WarningEchoTooLarge = "echo_too_large"
+	// WarningChecksumUnvalidated flags uploads whose additional checksum
+	// wasn't validated by the storage
+	WarningChecksumUnvalidated = "checksum_unvalidated"
+	// WarningOriginalFailed flags keep_original uploads with
+	// KeepOriginalBestEffort whose original couldn't be stored
+	WarningOriginalFailed = "original_failed"
+	// WarningSiblingFailed flags uploads with SiblingsBestEffort whose
+	// siblings couldn't all be stored
+	WarningSiblingFailed = "sibling_failed"
+	// WarningSiblingsSkipped flags animated uploads whose bucket default
+	// siblings were skipped
+	WarningSiblingsSkipped = "siblings_skipped"
+	// WarningObjectAttributesTruncated flags uploads whose metadata, tags or
+	// headers were truncated to the S3 limits
+	WarningObjectAttributesTruncated = "object_attributes_truncated"
+)
+
+// uploadWarnings counts the warnings by code and bucket
+var uploadWarnings = newBucketMap("upload_warnings")
+
+// warningCollector gathers the warnings raised while serving a request. A
+// nil *warningCollector drops them.
+type warningCollector struct {
+	mu       sync.Mutex
+	warnings []string
+}
+
+type warningsContextKey struct{}
+
+// withWarnings attaches a new warning collector to ctx
+func withWarnings(ctx context.Context) context.Context {
+	return context.WithValue(ctx, warningsContextKey{}, &warningCollector{})
+}
+
+func warningsFromContext(ctx context.Context) *warningCollector {
+	collector, _ := ctx.Value(warningsContextKey{}).(*warningCollector)
+	return collector
+}
+
+// addWarning raises the warning code for the request of ctx, once per
+// request, and counts it for bucket
+func addWarning(ctx context.Context, bucket, code string) {
+	uploadWarnings.add(code+":", bucket, "", 1)
+
+	c := warningsFromContext(ctx)
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, warning := range c.warnings {
+		if warning == code {
+			return
+		}
+	}
+	c.warnings = append(c.warnings, code)
+}
+
+// list returns the warnings raised so far
+func (c *warningCollector) list() []string {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.warnings...)
+}
+
+// setWarningHeader lists warnings in the WarningHeader of w
+func setWarningHeader(w http.ResponseWriter, warnings []string) {
+	if len(warnings) > 0 {
+		w.Header().Set(WarningHeader, strings.Join(warnings, ", "))
+	}
+}
+
+// softSizeLimit returns the size above which uploads within limit get the
+// WarningApproachingSizeLimit warning, or 0 when it's disabled
+func (d *Deflator) softSizeLimit(limit int64) int64 {
+	if d.config.SoftUploadSizePct == 0 {
+		return 0
+	}
+	return limit * int64(d.config.SoftUploadSizePct) / 100
+}